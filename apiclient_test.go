@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"receipt_api/client"
+)
+
+// clientTarget is validReceiptPayload for the client.
+var clientTarget = client.Receipt{
+	Retailer:     "Target",
+	PurchaseDate: "2022-01-01",
+	PurchaseTime: "13:01",
+	Items: []client.Item{
+		{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+		{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+		{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+		{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+		{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+	},
+	Total: "35.35",
+}
+
+// serveAPI serves the API's handlers on a local port for the rest of the test.
+func serveAPI(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestClientAgainstHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useIdempotencyKeys(t)
+	useAPIKeys(t, []apiKey{{ID: "pos", Key: "pos-key", Scopes: []string{scopeRead, scopeWrite}}})
+	url := serveAPI(t, newRouter())
+	ctx := context.Background()
+
+	c, err := client.New(url, client.WithAPIKey("pos-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points, err := c.Preview(ctx, clientTarget); err != nil || points != 28 {
+		t.Fatalf("expected a preview of 28 points but got %d, %v", points, err)
+	}
+	if len(receipts) != 0 {
+		t.Fatalf("expected the preview not to be stored")
+	}
+	id, err := c.ProcessReceipt(ctx, clientTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points, err := c.GetPoints(ctx, id); err != nil || points != 28 {
+		t.Errorf("expected 28 points but got %d, %v", points, err)
+	}
+
+	// The server's errors come back typed.
+	_, err = c.GetPoints(ctx, "no-such-receipt")
+	var notFound *client.NotFoundError
+	if !errors.As(err, &notFound) || notFound.Err.Code != client.CodeReceiptNotFound {
+		t.Errorf("expected an unknown receipt but got %v", err)
+	}
+	invalid := clientTarget
+	invalid.Total = ""
+	_, err = c.ProcessReceipt(ctx, invalid)
+	var validation *client.ValidationError
+	if !errors.As(err, &validation) || validation.Err.Message != "Total amount is required" || validation.Err.RequestID == "" {
+		t.Errorf("expected an invalid receipt but got %v", err)
+	}
+	anonymous, _ := client.New(url)
+	_, err = anonymous.GetPoints(ctx, id)
+	var auth *client.AuthError
+	if !errors.As(err, &auth) || auth.Err.Code != client.CodeAPIKeyRequired {
+		t.Errorf("expected the API key to be required but got %v", err)
+	}
+}
+
+func TestClientRetriesSubmissionsOnce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useIdempotencyKeys(t)
+	router := newRouter()
+
+	// The first submission is processed but its response lost, as if the connection
+	// dropped; the client's retry must not store the receipt again.
+	var requests atomic.Int32
+	url := serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			router.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	c, err := client.New(url, client.WithRetryPolicy(client.RetryPolicy{MaxAttempts: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := client.WithIdempotencyKey(context.Background(), "order-1")
+	id, err := c.ProcessReceipt(ctx, clientTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptsMu.RLock()
+	_, stored := receipts[string(id)]
+	count := len(receipts)
+	receiptsMu.RUnlock()
+	if requests.Load() != 2 || count != 1 || !stored {
+		t.Errorf("expected 2 requests storing receipt %s once but got %d requests and %d receipts", id, requests.Load(), count)
+	}
+	if again, err := c.ProcessReceipt(ctx, clientTarget); err != nil || again != id {
+		t.Errorf("expected resubmitting with the key to give %s but got %s, %v", id, again, err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes an API key can be granted. Reading receipts and rules needs scopeRead,
+// processing receipts scopeWrite and the /admin endpoints scopeAdmin.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+// defaultScopes are granted to keys that list no scopes, which is everything a key
+// allowed before keys had scopes.
+var defaultScopes = []string{scopeRead, scopeWrite}
+
+// apiKey is a key clients send in the X-API-Key header. ID identifies the key in logs
+// and never has to be kept secret. A key with an ExpiresAt is rejected from then on.
+type apiKey struct {
+	ID        string     `json:"id"`
+	Key       string     `json:"key"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// RateLimit limits the key's requests, e.g. "10/s", and DailyQuota the receipts it
+	// may process each day. Zero values leave them unlimited.
+	RateLimit  string `json:"rateLimit,omitempty"`
+	DailyQuota int    `json:"dailyQuota,omitempty"`
+
+	rate rate
+}
+
+// hasScope reports whether the key was granted scope.
+func (k *apiKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeys holds the keys accepted by requireAPIKey, read from --api-keys-file at
+// startup and again on SIGHUP. It is replaced as a whole, so a request checks its key
+// against one version of the file. No keys leaves the API open.
+var apiKeys atomic.Pointer[[]apiKey]
+
+// apiKeysFilePath is the --api-keys-file.
+var apiKeysFilePath string
+
+// apiKeyRequests counts the requests each key ID authenticated.
+var apiKeyRequests sync.Map
+
+// setAPIKeys makes keys the accepted keys.
+func setAPIKeys(keys []apiKey) {
+	apiKeys.Store(&keys)
+}
+
+// currentAPIKeys returns the accepted keys.
+func currentAPIKeys() []apiKey {
+	if keys := apiKeys.Load(); keys != nil {
+		return *keys
+	}
+	return nil
+}
+
+// loadAPIKeys reads an API keys file. It is either a JSON array of {"id", "key",
+// "scopes", "expiresAt", "rateLimit", "dailyQuota"} objects or plain text with one
+// key per line, identified by its line number. Blank lines and lines starting with #
+// are ignored. Keys without scopes get defaultScopes.
+func loadAPIKeys(path string) ([]apiKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []apiKey
+	lines := make(map[string]int)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&keys); err != nil {
+			return nil, &configError{path: path, msg: err.Error()}
+		}
+		ids := make(map[string]bool)
+		for i, key := range keys {
+			if key.ID == "" {
+				return nil, &configError{path: path, msg: fmt.Sprintf("key %d has no id", i)}
+			}
+			if ids[key.ID] {
+				return nil, &configError{path: path, msg: fmt.Sprintf("id %q is used by more than one key", key.ID)}
+			}
+			ids[key.ID] = true
+			if key.Scopes != nil && len(key.Scopes) == 0 {
+				return nil, &configError{path: path, msg: fmt.Sprintf("key %q has an empty scopes list", key.ID)}
+			}
+			granted := make(map[string]bool)
+			for _, scope := range key.Scopes {
+				if scope != scopeRead && scope != scopeWrite && scope != scopeAdmin {
+					return nil, &configError{path: path, msg: fmt.Sprintf("key %q has unknown scope %q, expected read, write or admin", key.ID, scope)}
+				}
+				if granted[scope] {
+					return nil, &configError{path: path, msg: fmt.Sprintf("key %q lists scope %q more than once", key.ID, scope)}
+				}
+				granted[scope] = true
+			}
+			if key.RateLimit != "" {
+				if err := keys[i].rate.Set(key.RateLimit); err != nil {
+					return nil, &configError{path: path, msg: fmt.Sprintf("key %q: %v", key.ID, err)}
+				}
+			}
+			if key.DailyQuota < 0 {
+				return nil, &configError{path: path, msg: fmt.Sprintf("key %q has a negative daily quota", key.ID)}
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			key := strings.TrimSpace(scanner.Text())
+			if key == "" || strings.HasPrefix(key, "#") {
+				continue
+			}
+			id := fmt.Sprintf("line %d", line)
+			keys = append(keys, apiKey{ID: id, Key: key})
+			lines[id] = line
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, &configError{path: path, msg: err.Error()}
+		}
+	}
+
+	seen := make(map[string]string)
+	for i, key := range keys {
+		if key.Scopes == nil {
+			keys[i].Scopes = defaultScopes
+		}
+		if key.Key == "" {
+			return nil, &configError{path: path, msg: fmt.Sprintf("key %q is empty", key.ID)}
+		}
+		if other, ok := seen[key.Key]; ok {
+			return nil, &configError{path: path, line: lines[key.ID], msg: fmt.Sprintf("key %q repeats the key of %q", key.ID, other)}
+		}
+		seen[key.Key] = key.ID
+	}
+	if len(keys) == 0 {
+		return nil, &configError{path: path, msg: "has no keys"}
+	}
+	return keys, nil
+}
+
+// reloadAPIKeys reads --api-keys-file again. On error the current keys are kept.
+func reloadAPIKeys() error {
+	if apiKeysFilePath == "" {
+		return nil
+	}
+	keys, err := loadAPIKeys(apiKeysFilePath)
+	if err != nil {
+		return err
+	}
+	setAPIKeys(keys)
+	return nil
+}
+
+// requireAPIKey rejects requests without an X-API-Key header carrying one of the
+// current keys with a 401, and those whose key lacks scope with a 403. It records the
+// ID of the key under "apiKey" in the context and lets everything through while no
+// keys are configured.
+func requireAPIKey(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := currentAPIKeys()
+		if len(keys) == 0 {
+			c.Next()
+			return
+		}
+		presented := []byte(c.GetHeader("X-API-Key"))
+		var matched *apiKey
+		// Compare with every key so the time taken doesn't reveal which one matched.
+		for i := range keys {
+			if subtle.ConstantTimeCompare(presented, []byte(keys[i].Key)) == 1 {
+				matched = &keys[i]
+			}
+		}
+		if len(presented) == 0 || matched == nil {
+			abortWithProblem(c, http.StatusUnauthorized, "API_KEY_REQUIRED", "requests require a valid X-API-Key header")
+			return
+		}
+		if matched.ExpiresAt != nil && !clock.Now().Before(*matched.ExpiresAt) {
+			logRequestf(c, "%s %s rejected: API key %s expired at %s", c.Request.Method, route(c), matched.ID, matched.ExpiresAt.Format(time.RFC3339))
+			abortWithProblem(c, http.StatusUnauthorized, "API_KEY_EXPIRED", "the API key expired at "+matched.ExpiresAt.Format(time.RFC3339))
+			return
+		}
+		if !matched.hasScope(scope) {
+			logRequestf(c, "%s %s rejected: API key %s lacks the %s scope", c.Request.Method, route(c), matched.ID, scope)
+			abortWithProblem(c, http.StatusForbidden, "API_KEY_SCOPE_MISSING", fmt.Sprintf("the API key lacks the %q scope", scope))
+			return
+		}
+
+		logRequestf(c, "%s %s authenticated with API key %s", c.Request.Method, route(c), matched.ID)
+		count, _ := apiKeyRequests.LoadOrStore(matched.ID, new(atomic.Int64))
+		count.(*atomic.Int64).Add(1)
+		c.Set("apiKey", matched.ID)
+		c.Next()
+	}
+}
+
+// listAPIKeys lists the current keys by ID, with their scopes, expiry and how many
+// requests each authenticated. The keys themselves are never shown.
+func listAPIKeys(c *gin.Context) {
+	type keyInfo struct {
+		ID        string     `json:"id"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+		Expired   bool       `json:"expired"`
+		Requests  int64      `json:"requests"`
+	}
+	now := clock.Now()
+	keys := currentAPIKeys()
+	infos := make([]keyInfo, 0, len(keys))
+	for _, key := range keys {
+		info := keyInfo{ID: key.ID, Scopes: key.Scopes, ExpiresAt: key.ExpiresAt, Expired: key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)}
+		if count, ok := apiKeyRequests.Load(key.ID); ok {
+			info.Requests = count.(*atomic.Int64).Load()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	c.JSON(http.StatusOK, gin.H{"keys": infos})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useAPIKeys makes keys the accepted keys for the rest of the test.
+func useAPIKeys(t *testing.T, keys []apiKey) {
+	t.Helper()
+	previous := currentAPIKeys()
+	setAPIKeys(keys)
+	t.Cleanup(func() { setAPIKeys(previous) })
+}
+
+// requestWithKey sends a request with an X-API-Key header, if key isn't empty.
+func requestWithKey(router *gin.Engine, method, path, key string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	var req *http.Request
+	if method == http.MethodPost {
+		req = httptest.NewRequest(method, path, strings.NewReader(validReceiptPayload))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	keys, err := loadAPIKeys(writeConfig(t, "keys.txt", "# partner keys\nk-one\n\n  k-two  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []apiKey{{ID: "line 2", Key: "k-one", Scopes: defaultScopes}, {ID: "line 4", Key: "k-two", Scopes: defaultScopes}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %+v but got %+v", expected, keys)
+	}
+
+	keys, err = loadAPIKeys(writeConfig(t, "keys.json", `[
+  {"id": "acme-2024", "key": "k-acme", "expiresAt": "2025-01-31T00:00:00Z"},
+  {"id": "acme-2025", "key": "k-acme-new"},
+  {"id": "dashboard", "key": "k-dashboard", "scopes": ["read"], "rateLimit": "10/s", "dailyQuota": 1000}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+	expected = []apiKey{
+		{ID: "acme-2024", Key: "k-acme", Scopes: defaultScopes, ExpiresAt: &expiresAt},
+		{ID: "acme-2025", Key: "k-acme-new", Scopes: defaultScopes},
+		{ID: "dashboard", Key: "k-dashboard", Scopes: []string{scopeRead}, RateLimit: "10/s", DailyQuota: 1000, rate: rate{10, time.Second}},
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %+v but got %+v", expected, keys)
+	}
+
+	testCases := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{"Empty", "# no keys yet\n", "keys: has no keys"},
+		{"Repeated", "k-one\nk-two\nk-one\n", `keys:3: key "line 3" repeats the key of "line 1"`},
+		{"NoID", `[{"key": "k-acme"}]`, "keys: key 0 has no id"},
+		{"RepeatedID", `[{"id": "acme", "key": "k-1"}, {"id": "acme", "key": "k-2"}]`, `keys: id "acme" is used by more than one key`},
+		{"EmptyKey", `[{"id": "acme", "key": ""}]`, `keys: key "acme" is empty`},
+		{"UnknownField", `[{"id": "acme", "secret": "k-acme"}]`, `keys: json: unknown field "secret"`},
+		{"NoScopes", `[{"id": "acme", "key": "k-acme", "scopes": []}]`, `keys: key "acme" has an empty scopes list`},
+		{"UnknownScope", `[{"id": "acme", "key": "k-acme", "scopes": ["read", "delete"]}]`, `keys: key "acme" has unknown scope "delete", expected read, write or admin`},
+		{"RepeatedScope", `[{"id": "acme", "key": "k-acme", "scopes": ["read", "read"]}]`, `keys: key "acme" lists scope "read" more than once`},
+		{"BadRate", `[{"id": "acme", "key": "k-acme", "rateLimit": "10"}]`, `keys: key "acme": invalid rate "10", expected a count per s, m or h such as 100/s`},
+		{"NegativeQuota", `[{"id": "acme", "key": "k-acme", "dailyQuota": -1}]`, `keys: key "acme" has a negative daily quota`},
+		{"BadExpiry", `[{"id": "acme", "key": "k-acme", "expiresAt": "tomorrow"}]`, `keys: parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`},
+	}
+	for _, tc := range testCases {
+		path := writeConfig(t, "keys", tc.contents)
+		_, err := loadAPIKeys(path)
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		if got := strings.TrimPrefix(err.Error(), filepath.Dir(path)+string(filepath.Separator)); got != tc.expected {
+			t.Errorf("%s: expected %q but got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	router := newRouter()
+	expiresAt := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+	expired := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []apiKey{
+		{ID: "acme", Key: "k-acme", Scopes: defaultScopes, ExpiresAt: &expiresAt},
+		{ID: "mobile", Key: "k-mobile", Scopes: defaultScopes},
+		{ID: "old", Key: "k-old", Scopes: defaultScopes, ExpiresAt: &expired},
+	}
+
+	testCases := []struct {
+		name           string
+		keys           []apiKey
+		method, path   string
+		header         string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "NoKeysConfigured", method: http.MethodPost, path: "/receipts/process", expectedStatus: http.StatusOK},
+		{name: "Valid", keys: keys, method: http.MethodPost, path: "/receipts/process", header: "k-mobile", expectedStatus: http.StatusOK},
+		{name: "ValidUntilExpiry", keys: keys, method: http.MethodPost, path: "/receipts/process", header: "k-acme", expectedStatus: http.StatusOK},
+		{name: "Expired", keys: keys, method: http.MethodPost, path: "/receipts/process", header: "k-old", expectedStatus: http.StatusUnauthorized, expectedCode: "API_KEY_EXPIRED"},
+		{name: "Invalid", keys: keys, method: http.MethodPost, path: "/receipts/process", header: "k-acm", expectedStatus: http.StatusUnauthorized, expectedCode: "API_KEY_REQUIRED"},
+		{name: "Missing", keys: keys, method: http.MethodPost, path: "/receipts/process", expectedStatus: http.StatusUnauthorized, expectedCode: "API_KEY_REQUIRED"},
+		{name: "MissingOnReads", keys: keys, method: http.MethodGet, path: "/rules", expectedStatus: http.StatusUnauthorized, expectedCode: "API_KEY_REQUIRED"},
+		{name: "Health", keys: keys, method: http.MethodGet, path: "/health", expectedStatus: http.StatusOK},
+		{name: "Version", keys: keys, method: http.MethodGet, path: "/version", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			useAPIKeys(t, tc.keys)
+			rr := requestWithKey(router, tc.method, tc.path, tc.header)
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v but got %v: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tc.expectedCode != "" && !strings.Contains(rr.Body.String(), tc.expectedCode) {
+				t.Errorf("expected the %s code but got %s", tc.expectedCode, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	id, _ := processAndScore(t, router, validReceiptPayload)
+	useAPIKeys(t, []apiKey{
+		{ID: "reader", Key: "k-read", Scopes: []string{scopeRead}},
+		{ID: "writer", Key: "k-write", Scopes: []string{scopeWrite}},
+		{ID: "admin", Key: "k-admin", Scopes: []string{scopeAdmin}},
+		{ID: "all", Key: "k-all", Scopes: []string{scopeRead, scopeWrite, scopeAdmin}},
+	})
+
+	endpoints := []struct {
+		name         string
+		method, path string
+		scope        string
+	}{
+		{"Points", http.MethodGet, "/receipts/" + id + "/points", scopeRead},
+		{"Rules", http.MethodGet, "/rules", scopeRead},
+		{"Process", http.MethodPost, "/receipts/process", scopeWrite},
+		{"Admin", http.MethodGet, "/admin/api-keys", scopeAdmin},
+	}
+	for _, endpoint := range endpoints {
+		for _, key := range currentAPIKeys() {
+			rr := requestWithKey(router, endpoint.method, endpoint.path, key.Key)
+			if key.hasScope(endpoint.scope) {
+				if rr.Code != http.StatusOK {
+					t.Errorf("%s with %s: expected status 200 but got %v: %s", endpoint.name, key.ID, rr.Code, rr.Body.String())
+				}
+				continue
+			}
+			var body problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if expected := fmt.Sprintf("the API key lacks the %q scope", endpoint.scope); rr.Code != http.StatusForbidden ||
+				body.Code != "API_KEY_SCOPE_MISSING" || body.Detail != expected {
+				t.Errorf("%s with %s: expected 403 saying %q but got %v: %s", endpoint.name, key.ID, expected, rr.Code, rr.Body.String())
+			}
+		}
+	}
+}
+
+func TestListAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	router := newRouter()
+	expired := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	useAPIKeys(t, []apiKey{
+		{ID: "list-old", Key: "k-old", Scopes: defaultScopes, ExpiresAt: &expired},
+		{ID: "list-current", Key: "k-current", Scopes: defaultScopes},
+		{ID: "list-admin", Key: "k-admin", Scopes: []string{scopeAdmin}},
+	})
+
+	for i := 0; i < 3; i++ {
+		requestWithKey(router, http.MethodGet, "/rules", "k-current")
+	}
+	requestWithKey(router, http.MethodGet, "/rules", "k-old")
+
+	rr := requestWithKey(router, http.MethodGet, "/admin/api-keys", "k-admin")
+	if strings.Contains(rr.Body.String(), "k-current") {
+		t.Fatalf("expected the keys themselves to stay hidden but got %s", rr.Body.String())
+	}
+	var body struct {
+		Keys []struct {
+			ID       string   `json:"id"`
+			Scopes   []string `json:"scopes"`
+			Expired  bool     `json:"expired"`
+			Requests int64    `json:"requests"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Keys) != 3 || body.Keys[0].ID != "list-admin" || body.Keys[0].Requests != 1 || !reflect.DeepEqual(body.Keys[0].Scopes, []string{scopeAdmin}) ||
+		body.Keys[1].ID != "list-current" || body.Keys[1].Requests != 3 || body.Keys[1].Expired ||
+		body.Keys[2].ID != "list-old" || body.Keys[2].Requests != 0 || !body.Keys[2].Expired {
+		t.Errorf("expected 3 requests with the current key, none with the expired one and 1 with the admin key but got %+v", body.Keys)
+	}
+}
+
+func TestReloadAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	useAPIKeys(t, nil)
+	defer func(previous string) { apiKeysFilePath = previous }(apiKeysFilePath)
+	apiKeysFilePath = writeConfig(t, "keys", "k-old\n")
+	if err := reloadAPIKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotation: add the new key, migrate clients, then remove the old one.
+	steps := []struct {
+		contents    string
+		old, rotate int
+	}{
+		{"k-old\nk-new\n", http.StatusOK, http.StatusOK},
+		{"k-new\n", http.StatusUnauthorized, http.StatusOK},
+		// An invalid file keeps the current keys.
+		{"", http.StatusUnauthorized, http.StatusOK},
+	}
+	for _, step := range steps {
+		if err := os.WriteFile(apiKeysFilePath, []byte(step.contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		signals := make(chan os.Signal, 1)
+		signals <- syscall.SIGHUP
+		close(signals)
+		reloadOnSignal(signals)
+
+		if code := requestWithKey(router, http.MethodGet, "/rules", "k-old").Code; code != step.old {
+			t.Errorf("expected %v for the old key with %q but got %v", step.old, step.contents, code)
+		}
+		if code := requestWithKey(router, http.MethodGet, "/rules", "k-new").Code; code != step.rotate {
+			t.Errorf("expected %v for the new key with %q but got %v", step.rotate, step.contents, code)
+		}
+	}
+}
+
+// TestReloadAPIKeysConcurrently reloads the keys while requests are checked against
+// them. Run it with -race.
+func TestReloadAPIKeysConcurrently(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	useAPIKeys(t, []apiKey{{ID: "stable", Key: "k-stable", Scopes: defaultScopes}})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if code := requestWithKey(router, http.MethodGet, "/rules", "k-stable").Code; code != http.StatusOK {
+					t.Errorf("expected the key kept by every reload to work but got %v", code)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		keys := []apiKey{{ID: "stable", Key: "k-stable", Scopes: defaultScopes}}
+		if i%2 == 0 {
+			keys = append(keys, apiKey{ID: "rotating", Key: "k-rotating", Scopes: defaultScopes})
+		}
+		setAPIKeys(keys)
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audited actions.
+const (
+	auditReceiptProcessed = "receipt.processed"
+	auditRulesReloaded    = "rules.reloaded"
+)
+
+// The --audit-log file audit events are appended to, and the --audit-log-max-bytes it
+// is rotated at.
+var (
+	auditLogPath     string
+	auditLogMaxBytes = byteSize(64 << 20)
+)
+
+// auditLog records who changed what. It is nil unless --audit-log is set.
+var auditLog atomic.Pointer[auditor]
+
+// auditQueueSize is how many events may wait to be written before more are dropped.
+const auditQueueSize = 1024
+
+// auditEvent is one mutation. It names what was changed, never its contents.
+type auditEvent struct {
+	Time time.Time `json:"time"`
+	// Actor is "user:<subject>", "client:<id>", "apiKey:<id>", for unauthenticated
+	// requests "ip:<address>", or "signal:SIGHUP" for reloads on a signal.
+	Actor   string `json:"actor"`
+	Action  string `json:"action"`
+	Target  string `json:"target,omitempty"`
+	Outcome string `json:"outcome"`
+	Status  int    `json:"status,omitempty"`
+	// RequestID is the X-Request-ID of the request that made the change, if any.
+	RequestID string `json:"requestId,omitempty"`
+	// ClientIP is the address the request came from, forwarded by a trusted proxy or
+	// else the peer's.
+	ClientIP string `json:"clientIp,omitempty"`
+}
+
+// auditSink stores audit events. The file sink is the only one so far; a database
+// sink can follow.
+type auditSink interface {
+	write(event auditEvent) error
+	// close makes the events written durable and releases the sink.
+	close() error
+}
+
+// auditor hands events to a sink from a queue, so requests never wait on it. Events
+// that don't fit in the queue are dropped and counted.
+type auditor struct {
+	sink    auditSink
+	queue   chan auditEntry
+	dropped atomic.Int64
+}
+
+// auditEntry is an event to write, or with flushed set, a request to close flushed
+// once the events queued before it are written.
+type auditEntry struct {
+	event   auditEvent
+	flushed chan struct{}
+}
+
+// newAuditor starts writing events to sink.
+func newAuditor(sink auditSink) *auditor {
+	a := &auditor{sink: sink, queue: make(chan auditEntry, auditQueueSize)}
+	go func() {
+		for entry := range a.queue {
+			if entry.flushed != nil {
+				close(entry.flushed)
+				continue
+			}
+			if err := a.sink.write(entry.event); err != nil {
+				log.Printf("writing an audit event failed: %v", err)
+			}
+		}
+	}()
+	return a
+}
+
+// record queues event without blocking. The first drop and every power of two after
+// it are logged.
+func (a *auditor) record(event auditEvent) {
+	select {
+	case a.queue <- auditEntry{event: event}:
+	default:
+		if n := a.dropped.Add(1); n&(n-1) == 0 {
+			log.Printf("the audit queue is full, %d events dropped", n)
+		}
+	}
+}
+
+// flush waits for the queued events to be written.
+func (a *auditor) flush() {
+	flushed := make(chan struct{})
+	a.queue <- auditEntry{flushed: flushed}
+	<-flushed
+}
+
+// close writes the queued events and closes the sink. Nothing may record to the
+// auditor afterwards.
+func (a *auditor) close() error {
+	a.flush()
+	return a.sink.close()
+}
+
+// recordAudit records an event if auditing is on.
+func recordAudit(event auditEvent) {
+	if a := auditLog.Load(); a != nil {
+		event.Time = clock.Now()
+		a.record(event)
+	}
+}
+
+// actor identifies who made a request, preferring the most specific identity.
+func actor(c *gin.Context) string {
+	if user := c.GetString("user"); user != "" {
+		return "user:" + user
+	}
+	if client := c.GetString("client"); client != "" {
+		return "client:" + client
+	}
+	if key := c.GetString("apiKey"); key != "" {
+		return "apiKey:" + key
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// auditAction records action once the handler is done, with the target the handler
+// set as "auditTarget" and whether it succeeded, unless the handler set "audited"
+// having recorded events of its own.
+func auditAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.GetBool("audited") {
+			return
+		}
+		outcome := "success"
+		if c.Writer.Status() >= http.StatusBadRequest {
+			outcome = "failure"
+		}
+		recordAudit(auditEvent{Actor: actor(c), Action: action, Target: c.GetString("auditTarget"), Outcome: outcome, Status: c.Writer.Status(), RequestID: c.GetString("requestID"), ClientIP: c.ClientIP()})
+	}
+}
+
+// fileAuditSink appends events to a JSON-lines file. Once it grows past maxBytes it
+// is renamed with the time it was rotated appended and a new file is started; rotated
+// files are kept.
+type fileAuditSink struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openFileAuditSink opens path for appending, creating it if needed.
+func openFileAuditSink(path string, maxBytes int64) (*fileAuditSink, error) {
+	s := &fileAuditSink{path: path, maxBytes: maxBytes}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *fileAuditSink) write(event auditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileAuditSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// rotateLocked renames the file to <path>.<UTC time>, with a counter appended should
+// that exist, and starts a new one. It must be called with mu held.
+func (s *fileAuditSink) rotateLocked() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	base := s.path + "." + clock.Now().UTC().Format("20060102T150405.000000000Z")
+	rotated := base
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%d", base, i)
+	}
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// query returns the events at or after since by actor, or by anyone if actor is empty,
+// from the rotated files and the current one, oldest first.
+func (s *fileAuditSink) query(since time.Time, actor string) ([]auditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	paths = append(paths, s.path)
+
+	events := []auditEvent{}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event auditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if !event.Time.Before(since) && (actor == "" || event.Actor == actor) {
+				events = append(events, event)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// auditHandler returns the audit events of the file sink, filtered by the since
+// (RFC 3339) and actor query parameters.
+func auditHandler(c *gin.Context) {
+	a := auditLog.Load()
+	if a == nil {
+		abortWithProblem(c, http.StatusNotFound, "AUDIT_NOT_CONFIGURED", "no --audit-log was given")
+		return
+	}
+	sink, ok := a.sink.(*fileAuditSink)
+	if !ok {
+		abortWithProblem(c, http.StatusNotImplemented, "AUDIT_NOT_QUERYABLE", "the audit sink can't be queried")
+		return
+	}
+	var since time.Time
+	if s := c.Query("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			abortWithProblem(c, http.StatusBadRequest, "INVALID_SINCE", "since must be an RFC 3339 time such as 2025-01-30T12:00:00Z")
+			return
+		}
+	}
+
+	a.flush()
+	events, err := sink.query(since, c.Query("actor"))
+	if err != nil {
+		abortWithProblem(c, http.StatusInternalServerError, "AUDIT_UNREADABLE", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events, "dropped": a.dropped.Load()})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useAuditLog records audit events in a file for the rest of the test.
+func useAuditLog(t *testing.T, maxBytes int64) (*auditor, *fileAuditSink) {
+	t.Helper()
+	sink, err := openFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"), maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAuditor(sink)
+	auditLog.Store(a)
+	t.Cleanup(func() { auditLog.Store(nil) })
+	return a, sink
+}
+
+// queryAudit requests the audit events matching query as the "ops" key.
+func queryAudit(t *testing.T, router *gin.Engine, query string) []auditEvent {
+	t.Helper()
+	rr := requestWithKey(router, http.MethodGet, "/admin/audit"+query, "k-ops")
+	var body struct {
+		Events []auditEvent `json:"events"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected the audit events but got %v: %s", rr.Code, rr.Body.String())
+	}
+	return body.Events
+}
+
+func TestAuditEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	path := useRulesConfig(t, "itemPairPoints: 10\n")
+	router := newRouter()
+	_, sink := useAuditLog(t, 0)
+	useAPIKeys(t, []apiKey{
+		{ID: "partner", Key: "k-partner", Scopes: defaultScopes},
+		{ID: "ops", Key: "k-ops", Scopes: []string{scopeAdmin}},
+	})
+
+	rr := requestWithKey(router, http.MethodPost, "/receipts/process", "k-partner")
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(time.Minute)
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(`{"retailer": "Target", "total": "1.00"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "k-partner")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	fake.Advance(time.Minute)
+	requestWithKey(router, http.MethodPost, "/admin/rules/reload", "k-ops")
+	reloadedHash := currentEngine().hash
+	fake.Advance(time.Minute)
+	if err := os.WriteFile(path, []byte("oddDayPoints: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	requestWithKey(router, http.MethodPost, "/admin/rules/reload", "k-ops")
+	fake.Advance(time.Minute)
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGHUP
+	close(signals)
+	reloadOnSignal(signals)
+	// Without keys, the client is identified by its address.
+	fake.Advance(time.Minute)
+	useAPIKeys(t, nil)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/admin/rules/reload", nil))
+	useAPIKeys(t, []apiKey{{ID: "ops", Key: "k-ops", Scopes: []string{scopeAdmin}}})
+
+	start := time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+	expected := []auditEvent{
+		{Time: start, Actor: "apiKey:partner", Action: auditReceiptProcessed, Target: processed.ID, Outcome: "success", Status: http.StatusOK, ClientIP: "192.0.2.1"},
+		{Time: start.Add(time.Minute), Actor: "apiKey:partner", Action: auditReceiptProcessed, Outcome: "failure", Status: http.StatusBadRequest, ClientIP: "192.0.2.1"},
+		{Time: start.Add(2 * time.Minute), Actor: "apiKey:ops", Action: auditRulesReloaded, Target: reloadedHash, Outcome: "success", Status: http.StatusOK, ClientIP: "192.0.2.1"},
+		{Time: start.Add(3 * time.Minute), Actor: "apiKey:ops", Action: auditRulesReloaded, Outcome: "failure", Status: http.StatusUnprocessableEntity, ClientIP: "192.0.2.1"},
+		{Time: start.Add(4 * time.Minute), Actor: "signal:SIGHUP", Action: auditRulesReloaded, Outcome: "failure"},
+		{Time: start.Add(5 * time.Minute), Actor: "ip:192.0.2.1", Action: auditRulesReloaded, Outcome: "failure", Status: http.StatusUnprocessableEntity, ClientIP: "192.0.2.1"},
+	}
+	events := queryAudit(t, router, "")
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events but got %+v", len(expected), events)
+	}
+	for i := range expected {
+		// Events made by requests carry their generated ID.
+		if fromRequest := events[i].Actor != "signal:SIGHUP"; (events[i].RequestID != "") != fromRequest {
+			t.Errorf("event %d: expected a request ID %v but got %q", i, fromRequest, events[i].RequestID)
+		}
+		events[i].RequestID = ""
+		if events[i] != expected[i] {
+			t.Errorf("event %d: expected %+v but got %+v", i, expected[i], events[i])
+		}
+	}
+
+	// Reading the audit log isn't a mutation, and contents never reach it.
+	data, err := os.ReadFile(sink.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != len(expected) || strings.Contains(string(data), "Target") || strings.Contains(string(data), "Mountain Dew") {
+		t.Errorf("expected only the events, without receipt contents, but got %s", data)
+	}
+
+	if events := queryAudit(t, router, "?actor=apiKey:ops&since=2025-01-30T12:02:30Z"); len(events) != 1 || events[0].Time != expected[3].Time {
+		t.Errorf("expected the failed reload by ops but got %+v", events)
+	}
+	if events := queryAudit(t, router, "?actor=apiKey:nobody"); len(events) != 0 {
+		t.Errorf("expected no events by an unknown actor but got %+v", events)
+	}
+	if rr := requestWithKey(router, http.MethodGet, "/admin/audit?since=yesterday", "k-ops"); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "INVALID_SINCE") {
+		t.Errorf("expected 400 INVALID_SINCE but got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	auditLog.Store(nil)
+	if rr := requestWithKey(router, http.MethodGet, "/admin/audit", "k-ops"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without an audit log but got %v", rr.Code)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	sink, err := openFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := sink.write(auditEvent{Time: fake.Now(), Actor: "apiKey:partner", Action: auditReceiptProcessed, Outcome: "success"}); err != nil {
+			t.Fatal(err)
+		}
+		fake.Advance(time.Second)
+	}
+
+	rotated, _ := filepath.Glob(sink.path + ".*")
+	if len(rotated) < 2 {
+		t.Fatalf("expected the log to have been rotated more than once but got %v", rotated)
+	}
+	for _, path := range append(rotated, sink.path) {
+		if info, err := os.Stat(path); err != nil || info.Size() > 300 {
+			t.Errorf("expected %s to be at most 300 bytes but got %v, %v", path, info, err)
+		}
+	}
+	events, err := sink.query(time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 {
+		t.Fatalf("expected all 10 events across the rotated files but got %d", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if !events[i].Time.After(events[i-1].Time) {
+			t.Errorf("expected the events oldest first but got %v before %v", events[i-1].Time, events[i].Time)
+		}
+	}
+
+	// A restart appends to the current file.
+	reopened, err := openFileAuditSink(sink.path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.size != sink.size {
+		t.Errorf("expected the reopened file to be %d bytes but got %d", sink.size, reopened.size)
+	}
+}
+
+// blockingSink holds every write until release is closed.
+type blockingSink struct {
+	started, release chan struct{}
+}
+
+func (s *blockingSink) write(auditEvent) error {
+	s.started <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *blockingSink) close() error { return nil }
+
+func TestAuditQueueOverflow(t *testing.T) {
+	sink := &blockingSink{started: make(chan struct{}, auditQueueSize+1), release: make(chan struct{})}
+	a := newAuditor(sink)
+	a.record(auditEvent{Action: auditReceiptProcessed})
+	<-sink.started
+
+	// With the sink stuck, the queue fills and the rest are dropped without blocking.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < auditQueueSize+5; i++ {
+			a.record(auditEvent{Action: auditReceiptProcessed})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected recording to never block on the sink")
+	}
+	if dropped := a.dropped.Load(); dropped != 5 {
+		t.Errorf("expected 5 events to be dropped but got %v", dropped)
+	}
+	close(sink.release)
+	a.flush()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchReceipts is --max-batch-receipts, the most receipts a JSON array posted to
+// POST /receipts/process may hold.
+var maxBatchReceipts = 100
+
+// peekJSONStart returns the first byte of the JSON body of c that isn't whitespace,
+// or 0 for an empty body. The whitespace before it is dropped, which leaves the
+// document as it was, and the body is left to be read from that byte.
+func peekJSONStart(c *gin.Context) (byte, error) {
+	reader := bufio.NewReader(c.Request.Body)
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, c.Request.Body}
+	for {
+		b, err := reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, reader.UnreadByte()
+	}
+}
+
+// batchResult is the outcome of a receipt of a batch: its ID, or why it wasn't
+// stored, with the status it would have been answered alone.
+type batchResult struct {
+	Index  int           `json:"index"`
+	Status int           `json:"status"`
+	ID     string        `json:"id,omitempty"`
+	Links  *receiptLinks `json:"_links,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Code   string        `json:"code,omitempty"`
+}
+
+// processBatch serves a JSON array posted to POST /receipts/process: each receipt is
+// validated, scored and stored as if it were posted alone, and the response is a
+// 207 with the result of each, in order. An invalid receipt doesn't stop the others.
+// Each stored receipt counts against the API key's quota, and is audited on its own.
+func processBatch(c *gin.Context, engine *Engine) {
+	var elements []json.RawMessage
+	err := json.NewDecoder(c.Request.Body).Decode(&elements)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return
+	case err != nil:
+		rejectReceipt(c, reasonBodyInvalid, "Failed to parse the request body")
+		return
+	case len(elements) == 0:
+		abortWithError(c, http.StatusBadRequest, "BATCH_EMPTY", "The batch holds no receipts")
+		return
+	case maxBatchReceipts > 0 && len(elements) > maxBatchReceipts:
+		abortWithError(c, http.StatusBadRequest, "BATCH_TOO_LARGE", fmt.Sprintf("The batch holds %d receipts, more than the %d allowed", len(elements), maxBatchReceipts))
+		return
+	}
+
+	// The receipts are counted against the quota and audited one by one instead of
+	// the request.
+	releaseQuota(c)
+	c.Set("audited", true)
+	key, hasKey := authenticatedKey(c)
+	results := make([]batchResult, len(elements))
+	for i, element := range elements {
+		result := &results[i]
+		result.Index = i
+		audit := auditEvent{Actor: actor(c), Action: auditReceiptProcessed, Outcome: "failure", Status: http.StatusBadRequest, RequestID: c.GetString("requestID"), ClientIP: c.ClientIP()}
+
+		receipt, err := decodeJSONReceipt(bytes.NewReader(element))
+		reason, detail := reasonBodyInvalid, "Failed to parse the receipt"
+		if err == nil {
+			reason, detail = validateReceipt(&receipt, engine)
+		}
+		if reason != "" {
+			receiptValidationFailures.inc(string(reason))
+			result.Status, result.Error, result.Code = http.StatusBadRequest, detail, string(reason)
+			recordAudit(audit)
+			continue
+		}
+
+		var resetAt time.Time
+		if hasKey {
+			var ok bool
+			if resetAt, ok = quotaUsage.reserve(key.ID, key.DailyQuota); !ok {
+				result.Status, result.Code = http.StatusTooManyRequests, "QUOTA_EXHAUSTED"
+				result.Error = fmt.Sprintf("API key %s has processed its %d receipts for the day", key.ID, key.DailyQuota)
+				audit.Status = http.StatusTooManyRequests
+				recordAudit(audit)
+				continue
+			}
+		}
+		id := newReceiptID(receipt)
+		receipt.ProcessedAt = clock.Now()
+		points, err := scoreAndStore(c.Request.Context(), id, receipt, engine, c.GetString("user"))
+		if err != nil {
+			if hasKey {
+				quotaUsage.release(key.ID, resetAt)
+			}
+			abortWithStoreError(c, err)
+			audit.Status = c.Writer.Status()
+			recordAudit(audit)
+			return
+		}
+		receiptsProcessed.inc()
+		result.Status, result.ID, result.Links = http.StatusOK, id, receiptLinksFor(c, id, c.GetString("user"))
+		audit.Target, audit.Outcome, audit.Status = id, "success", http.StatusOK
+		recordAudit(audit)
+		if s := shadow.Load(); s != nil {
+			s.score(id, c.GetString("requestID"), receipt, points)
+		}
+	}
+	c.JSON(http.StatusMultiStatus, gin.H{"results": results})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// postBatch posts body to /receipts/process with key, if given, and decodes the
+// results of a 207.
+func postBatch(t *testing.T, router http.Handler, key, body string) (*httptest.ResponseRecorder, []batchResult) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var response struct {
+		Results []batchResult `json:"results"`
+	}
+	if rr.Code == http.StatusMultiStatus {
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("expected the results of the batch but got %v: %s", err, rr.Body.String())
+		}
+	}
+	return rr, response.Results
+}
+
+func TestProcessBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	// A single object is processed as always, whitespace and all.
+	rr, _ := postBatch(t, router, "", "\r\n  "+validReceiptPayload)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"id":`) {
+		t.Fatalf("expected status 200 for a single receipt but got %v %s", rr.Code, rr.Body.String())
+	}
+
+	invalid := strings.Replace(validReceiptPayload, `"35.35"`, `""`, 1)
+	before := receiptsProcessed.value()
+	rr, results := postBatch(t, router, "", " ["+validReceiptPayload+","+invalid+", 42]")
+	if rr.Code != http.StatusMultiStatus || len(results) != 3 {
+		t.Fatalf("expected the 3 results of a 207 but got %v %s", rr.Code, rr.Body.String())
+	}
+	receiptsMu.RLock()
+	points := receipts[results[0].ID].Points
+	receiptsMu.RUnlock()
+	if results[0].Status != http.StatusOK || points != 28 || results[0].Links == nil {
+		t.Errorf("expected the first receipt stored with 28 points but got %+v", results[0])
+	}
+	if got := results[1]; got.Index != 1 || got.Status != http.StatusBadRequest || got.Code != "TOTAL_MISSING" || got.Error != "Total amount is required" || got.ID != "" {
+		t.Errorf("expected the second receipt rejected for its total but got %+v", got)
+	}
+	if got := results[2]; got.Status != http.StatusBadRequest || got.Code != "BODY_INVALID" {
+		t.Errorf("expected the third rejected as not a receipt but got %+v", got)
+	}
+	if len(receipts) != 2 || receiptsProcessed.value() != before+1 {
+		t.Errorf("expected one more receipt stored and counted but got %d, %v", len(receipts), receiptsProcessed.value()-before)
+	}
+}
+
+func TestProcessBatchErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous int) { maxBatchReceipts = previous }(maxBatchReceipts)
+	maxBatchReceipts = 2
+	router := newRouter()
+
+	testCases := []struct {
+		name     string
+		body     string
+		contains string
+	}{
+		{"Empty", " [ ] ", "The batch holds no receipts"},
+		{"TooLarge", "[{},{},{}]", "The batch holds 3 receipts, more than the 2 allowed"},
+		{"Malformed", `[{"retailer": "Target"`, "Failed to parse the request body"},
+		{"NotJSON", "retailer=Target", "expected a JSON object, or an array of them for a batch"},
+		{"Scalar", `"receipt"`, "expected a JSON object, or an array of them for a batch"},
+		{"Nothing", "   ", "expected a JSON object, or an array of them for a batch"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr, _ := postBatch(t, router, "", tc.body)
+			if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tc.contains) {
+				t.Errorf("expected a 400 containing %q but got %v %s", tc.contains, rr.Code, rr.Body.String())
+			}
+		})
+	}
+	if len(receipts) != 0 {
+		t.Errorf("expected no receipts stored but got %d", len(receipts))
+	}
+}
+
+func TestProcessBatchQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	a, _ := useAuditLog(t, 0)
+	defer a.close()
+	router := newRouter()
+	useQuotaStore(t, newQuotaStore(""))
+	useAPIKeys(t, []apiKey{
+		{ID: "partner", Key: "k-partner", Scopes: defaultScopes, DailyQuota: 2},
+		{ID: "ops", Key: "k-ops", Scopes: []string{scopeAdmin}},
+	})
+
+	// Each stored receipt counts against the quota, not the request.
+	batch := "[" + strings.Repeat(validReceiptPayload+",", 2) + validReceiptPayload + "]"
+	rr, results := postBatch(t, router, "k-partner", batch)
+	if rr.Code != http.StatusMultiStatus || len(results) != 3 {
+		t.Fatalf("expected a 207 but got %v %s", rr.Code, rr.Body.String())
+	}
+	if results[0].Status != http.StatusOK || results[1].Status != http.StatusOK || results[2].Status != http.StatusTooManyRequests || results[2].Code != "QUOTA_EXHAUSTED" {
+		t.Errorf("expected two receipts stored and the third over the quota but got %+v", results)
+	}
+	if used, _, _ := quotaUsage.usage(); used["partner"] != 2 {
+		t.Errorf("expected 2 receipts counted but got %d", used["partner"])
+	}
+
+	// Each receipt is audited, and not the request.
+	events := queryAudit(t, router, "?actor=apiKey:partner")
+	if len(events) != 3 || events[0].Target != results[0].ID || events[2].Status != http.StatusTooManyRequests {
+		t.Errorf("expected an event for each receipt but got %+v", events)
+	}
+}
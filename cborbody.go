@@ -0,0 +1,17 @@
+package main
+
+import "github.com/ugorji/go/codec"
+
+// cbor is CBOR (RFC 8949). Responses are encoded canonically, with times as RFC 3339
+// strings as in JSON, and receipts are decoded without fields a Receipt doesn't have.
+var cbor = codecFormat{
+	handle: func() *codec.CborHandle {
+		h := &codec.CborHandle{}
+		h.Canonical = true
+		h.TimeRFC3339 = true
+		h.ErrorIfNoField = true
+		return h
+	}(),
+	name:  "CBOR",
+	value: "data item",
+}
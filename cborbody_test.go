@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+)
+
+func encodeCBOR(t *testing.T, value any) []byte {
+	t.Helper()
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, cbor.handle).Encode(value); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// canonicalReceiptCBOR is validReceiptPayload in CBOR.
+func canonicalReceiptCBOR(t *testing.T) []byte {
+	t.Helper()
+	var receipt map[string]any
+	if err := json.Unmarshal([]byte(validReceiptPayload), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	return encodeCBOR(t, receipt)
+}
+
+func TestProcessCBORReceipts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	serve := func(method, path, contentType, accept string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodPost, "/receipts/process", "application/cbor", "application/cbor", canonicalReceiptCBOR(t))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/cbor" {
+		t.Fatalf("expected a CBOR 200 but got %v %v: %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+	var processed struct {
+		ID    string       `json:"id"`
+		Links receiptLinks `json:"_links"`
+	}
+	if err := codec.NewDecoderBytes(rr.Body.Bytes(), cbor.handle).Decode(&processed); err != nil || processed.ID == "" {
+		t.Fatalf("expected a CBOR response with an ID but got %v, %x", err, rr.Body.Bytes())
+	}
+	if processed.Links.Points == nil || processed.Links.Points.Href != "http://example.com/receipts/"+processed.ID+"/points" {
+		t.Errorf("expected a link to the points but got %+v", processed.Links)
+	}
+
+	rr = serve(http.MethodGet, "/receipts/"+processed.ID+"/points", "", "application/cbor", nil)
+	var points struct {
+		Points       int          `json:"points"`
+		RulesVersion string       `json:"rulesVersion"`
+		Links        receiptLinks `json:"_links"`
+	}
+	if err := codec.NewDecoderBytes(rr.Body.Bytes(), cbor.handle).Decode(&points); err != nil || rr.Header().Get("Content-Type") != "application/cbor" {
+		t.Fatalf("expected CBOR points but got %v %v: %x", err, rr.Header(), rr.Body.Bytes())
+	}
+	if points.Points != 28 || points.RulesVersion != currentEngine().hash {
+		t.Errorf("expected 28 points with the current rules but got %+v", points)
+	}
+
+	// JSON stays the default, whatever the request was sent in.
+	rr = serve(http.MethodPost, "/receipts/process", "application/cbor", "", canonicalReceiptCBOR(t))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("expected a JSON 200 without an Accept header but got %v %v", rr.Code, rr.Header())
+	}
+	rr = serve(http.MethodGet, "/receipts/"+processed.ID+"/points", "", "text/html, */*;q=0.1", nil)
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") || !strings.Contains(rr.Body.String(), `"points":28`) {
+		t.Errorf("expected JSON points for an Accept header without a format of ours but got %v: %s", rr.Header(), rr.Body.String())
+	}
+	rr = serve(http.MethodGet, "/receipts/"+processed.ID+"/breakdown", "", "application/cbor", nil)
+	var breakdown map[string]any
+	if err := codec.NewDecoderBytes(rr.Body.Bytes(), cbor.handle).Decode(&breakdown); err != nil || breakdown["breakdown"] == nil {
+		t.Errorf("expected a CBOR breakdown but got %v: %x", err, rr.Body.Bytes())
+	}
+}
+
+func TestCBORReceiptErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	canonical := canonicalReceiptCBOR(t)
+
+	receipt := func(change func(map[string]any)) []byte {
+		var r map[string]any
+		json.Unmarshal([]byte(validReceiptPayload), &r)
+		change(r)
+		return encodeCBOR(t, r)
+	}
+	testCases := []struct {
+		name     string
+		payload  []byte
+		reason   validationReason
+		contains string
+	}{
+		{"Malformed", []byte{0xff}, reasonBodyInvalid, "malformed CBOR"},
+		{"Truncated", canonical[:len(canonical)/2], reasonBodyInvalid, "malformed CBOR: it ends early"},
+		{"Empty", nil, reasonBodyInvalid, "it is empty"},
+		{"TwoItems", append(append([]byte{}, canonical...), canonical...), reasonBodyInvalid, "more than one CBOR data item"},
+		{"NotAMap", encodeCBOR(t, []any{"Target"}), reasonBodyInvalid, "the receipt must be a map, not an array"},
+		{"NonTextKey", encodeCBOR(t, map[any]any{1: "Target"}), reasonBodyInvalid, "the keys of the receipt must be text strings, not an integer"},
+		{"UnknownField", receipt(func(r map[string]any) { r["cashier"] = "Sam" }), reasonBodyInvalid, `the receipt has no field "cashier"`},
+		{"NumericTotal", receipt(func(r map[string]any) { r["total"] = 35.35 }), reasonTotalInvalidFormat, `total must be a text string, such as "35.35", not a float`},
+		{"NumericPrice", receipt(func(r map[string]any) { r["items"].([]any)[1].(map[string]any)["price"] = 12 }), reasonItemPriceInvalid, `items[1].price must be a text string, such as "6.49", not an integer`},
+		{"ByteString", receipt(func(r map[string]any) { r["retailer"] = []byte("Target") }), reasonBodyInvalid, "retailer must be a text string, not a byte string"},
+		{"ItemsNotArray", receipt(func(r map[string]any) { r["items"] = "many" }), reasonBodyInvalid, "items must be an array"},
+		{"UnknownItemField", receipt(func(r map[string]any) { r["items"].([]any)[0].(map[string]any)["qty"] = "1" }), reasonBodyInvalid, `items[0] has no field "qty"`},
+		{"TotalMissing", receipt(func(r map[string]any) { r["total"] = nil }), reasonTotalMissing, "Total amount is required"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			failures := `receipt_validation_failures_total{reason="` + string(tc.reason) + `"}`
+			before, _ := scrapeMetrics(t, router)
+			req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewReader(tc.payload))
+			req.Header.Set("Content-Type", "application/cbor")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400 but got %v: %s", rr.Code, rr.Body.String())
+			}
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(body.Error, tc.contains) {
+				t.Errorf("expected an error containing %q but got %q", tc.contains, body.Error)
+			}
+			if after, _ := scrapeMetrics(t, router); after[failures] != before[failures]+1 {
+				t.Errorf("expected the receipt rejected for %s but got %v", tc.reason, after[failures]-before[failures])
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+// Package client calls the Receipt Processor API.
+//
+//	c, err := client.New("https://receipts.example.com", client.WithAPIKey(key))
+//	id, err := c.ProcessReceipt(ctx, receipt)
+//	points, err := c.GetPoints(ctx, id)
+//
+// Errors the API answers with are returned as the typed errors in errors.go.
+// Requests that fail in ways a retry may fix are retried under the client's
+// RetryPolicy, but only when repeating them is safe: lookups and previews always,
+// and submissions only with an idempotency key, see WithIdempotencyKey.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receipt is a receipt as the API takes it. Amounts are strings with two decimals,
+// such as "6.49".
+type Receipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Items        []Item `json:"items"`
+	Total        string `json:"total"`
+	// Timezone is the IANA name of the zone the receipt was printed in, if known.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Item is an item of a Receipt.
+type Item struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+	UPC              string `json:"upc,omitempty"`
+}
+
+// ID identifies a processed receipt.
+type ID string
+
+// RetryPolicy is how a Client retries requests that failed with a network error, a
+// 429 other than for an exhausted quota, a 502, 503 or 504, or a 409 for a
+// submission with the same idempotency key still being processed. MaxAttempts
+// counts the first attempt, so 1 never retries. The delay before each retry doubles
+// from BaseDelay up to MaxDelay, with jitter, unless the response gave a
+// Retry-After, which is waited out up to MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy of a Client unless WithRetryPolicy is given.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+// delay returns how long to wait before retry number retry, from 1.
+func (p RetryPolicy) delay(retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if p.MaxDelay > 0 && retryAfter > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return retryAfter
+	}
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay << (retry - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	// Full jitter, so clients that failed together don't retry together.
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// Client calls the API at a base URL. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	retry      RetryPolicy
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey sends key in the X-API-Key header of every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTimeout limits each attempt at a request to d. The context passed to a method
+// bounds the call as a whole, retries included.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.httpClient.Timeout = d }
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) { c.retry = policy }
+}
+
+// WithHTTPClient sends requests with httpClient instead of a client of the client's
+// own. WithTimeout, if given after it, sets httpClient's Timeout.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// New returns a Client of the API at baseURL, such as "https://receipts.example.com".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("client: invalid base URL %q, expected http:// or https:// and a host", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	c := &Client{baseURL: u, httpClient: &http.Client{}, retry: DefaultRetryPolicy}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey returns a context that sends key as the Idempotency-Key of the
+// submission it is passed to. The API then stores the receipt once however many
+// times it is sent, so the submission is retried like lookups are. Use a key of your
+// own per receipt, such as a UUID, and the same one when resubmitting it.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// ProcessReceipt submits receipt and returns the ID it was stored as.
+func (c *Client) ProcessReceipt(ctx context.Context, receipt Receipt) (ID, error) {
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	var response struct {
+		ID ID `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/receipts/process", receipt, key, key != "", decodeJSON(&response)); err != nil {
+		return "", err
+	}
+	return response.ID, nil
+}
+
+// GetPoints returns the points receipt id was awarded.
+func (c *Client) GetPoints(ctx context.Context, id ID) (int, error) {
+	var response struct {
+		Points int `json:"points"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/receipts/"+url.PathEscape(string(id))+"/points", nil, "", true, decodeJSON(&response)); err != nil {
+		return 0, err
+	}
+	return response.Points, nil
+}
+
+// Preview returns the points receipt would be awarded, without storing it.
+func (c *Client) Preview(ctx context.Context, receipt Receipt) (int, error) {
+	var response struct {
+		Points int `json:"points"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/receipts/preview", receipt, "", true, decodeJSON(&response)); err != nil {
+		return 0, err
+	}
+	return response.Points, nil
+}
+
+// ExportedReceipt is a stored receipt as ExportReceipts lists it.
+type ExportedReceipt struct {
+	ID           ID        `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	PurchaseTime string    `json:"purchaseTime"`
+	Total        string    `json:"total"`
+	Items        int       `json:"items"`
+	Points       int       `json:"points"`
+	RulesVersion string    `json:"rulesVersion"`
+	Variant      string    `json:"variant,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+	ProcessedAt  time.Time `json:"processedAt"`
+}
+
+// ExportReceipts lists every stored receipt, oldest first. It needs an API key with
+// the admin scope.
+func (c *Client) ExportReceipts(ctx context.Context) ([]ExportedReceipt, error) {
+	var exported []ExportedReceipt
+	decode := func(payload []byte) error {
+		exported = exported[:0]
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		for decoder.More() {
+			var receipt ExportedReceipt
+			if err := decoder.Decode(&receipt); err != nil {
+				return err
+			}
+			exported = append(exported, receipt)
+		}
+		return nil
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/receipts/export", nil, "", true, decode); err != nil {
+		return nil, err
+	}
+	return exported, nil
+}
+
+// decodeJSON returns a function decoding a JSON response into out.
+func decodeJSON(out any) func([]byte) error {
+	return func(payload []byte) error { return json.Unmarshal(payload, out) }
+}
+
+// do sends a request with body, if not nil, as JSON and decodes the response with
+// decode, retrying it under the retry policy if retryable.
+func (c *Client) do(ctx context.Context, method, path string, body any, idempotencyKey string, retryable bool, decode func([]byte) error) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("client: encoding the request: %w", err)
+		}
+	}
+	attempts := c.retry.MaxAttempts
+	if attempts < 1 || !retryable {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := c.send(ctx, method, path, data, idempotencyKey, decode)
+		if err == nil || attempt >= attempts || !temporary(err) {
+			return err
+		}
+		timer := time.NewTimer(c.retry.delay(attempt, retryAfter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes one attempt at a request, returning the Retry-After of a failure.
+func (c *Client) send(ctx context.Context, method, path string, data []byte, idempotencyKey string, decode func([]byte) error) (time.Duration, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL.String()+path, body)
+	if err != nil {
+		return 0, fmt.Errorf("client: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// A canceled or expired context is the caller's doing, not the network's.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		return 0, &NetworkError{Err: err}
+	}
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, &NetworkError{Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := parseError(resp, payload)
+		return apiErr.RetryAfter, typedError(apiErr)
+	}
+	if err := decode(payload); err != nil {
+		return 0, fmt.Errorf("client: decoding the %s response: %w", path, err)
+	}
+	return 0, nil
+}
+
+// parseRetryAfter reads a Retry-After header in seconds; HTTP dates aren't sent by
+// the API.
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// temporary reports whether err may not happen again if the request is retried.
+func temporary(err error) bool {
+	var networkErr *NetworkError
+	if errors.As(err, &networkErr) {
+		return true
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		// The quota is only restored the next day.
+		return apiErr.Code != CodeQuotaExhausted
+	case http.StatusConflict:
+		return apiErr.Code == CodeIdempotencyKeyInUse
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var target = Receipt{
+	Retailer:     "Target",
+	PurchaseDate: "2022-01-01",
+	PurchaseTime: "13:01",
+	Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	Total:        "6.49",
+}
+
+// quickRetries retries without waiting, so tests don't.
+var quickRetries = WithRetryPolicy(RetryPolicy{MaxAttempts: 3})
+
+// newTestClient returns a client of an httptest server answering with handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c, err := New(server.URL+"/", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// writeProblem answers with a problem details body.
+func writeProblem(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"type": "about:blank", "title": http.StatusText(status), "status": status, "detail": "it failed", "code": code, "requestId": "req-1"})
+}
+
+func TestNew(t *testing.T) {
+	for _, baseURL := range []string{"", "receipts.example.com", "ftp://receipts.example.com", "http://"} {
+		if _, err := New(baseURL); err == nil {
+			t.Errorf("expected %q to be rejected", baseURL)
+		}
+	}
+}
+
+func TestProcessReceipt(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var receipt Receipt
+		if r.Method != http.MethodPost || r.URL.Path != "/receipts/process" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil || receipt.Retailer != "Target" || len(receipt.Items) != 1 {
+			t.Errorf("expected the receipt but got %+v, %v", receipt, err)
+		}
+		if r.Header.Get("X-API-Key") != "secret" || r.Header.Get("Idempotency-Key") != "" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r-1","_links":{}}`))
+	}, WithAPIKey("secret"))
+
+	id, err := c.ProcessReceipt(context.Background(), target)
+	if err != nil || id != "r-1" {
+		t.Fatalf("expected r-1 but got %q, %v", id, err)
+	}
+}
+
+func TestGetPointsAndPreview(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.EscapedPath() {
+		case "GET /receipts/a%2Fb/points":
+			w.Write([]byte(`{"points":28,"rulesVersion":"v1"}`))
+		case "POST /receipts/preview":
+			w.Write([]byte(`{"points":31,"breakdown":[],"rulesVersion":"v1"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.EscapedPath())
+		}
+	})
+
+	if points, err := c.GetPoints(context.Background(), "a/b"); err != nil || points != 28 {
+		t.Errorf("expected 28 points but got %d, %v", points, err)
+	}
+	if points, err := c.Preview(context.Background(), target); err != nil || points != 31 {
+		t.Errorf("expected a preview of 31 points but got %d, %v", points, err)
+	}
+}
+
+func TestErrorsAreTyped(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		target any
+	}{
+		{http.StatusBadRequest, "BODY_INVALID", new(*ValidationError)},
+		{http.StatusUnsupportedMediaType, CodeContentTypeUnsupported, new(*ValidationError)},
+		{http.StatusUnauthorized, CodeAPIKeyRequired, new(*AuthError)},
+		{http.StatusForbidden, CodeAPIKeyScopeMissing, new(*AuthError)},
+		{http.StatusGone, CodePointsExpired, new(*NotFoundError)},
+		{http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, new(*ConflictError)},
+		{http.StatusTooManyRequests, CodeQuotaExhausted, new(*RateLimitError)},
+		{http.StatusServiceUnavailable, CodeReadOnly, new(*UnavailableError)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) { writeProblem(w, tt.status, tt.code) }, WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+			_, err := c.GetPoints(context.Background(), "r-1")
+			if !errors.As(err, tt.target) {
+				t.Fatalf("expected a %T but got %T: %v", tt.target, err, err)
+			}
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status || apiErr.Code != tt.code || apiErr.Message != "it failed" || apiErr.RequestID != "req-1" {
+				t.Errorf("expected the problem's status, code, detail and request ID but got %+v", apiErr)
+			}
+		})
+	}
+}
+
+func TestReceiptErrors(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-2")
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Receipt not found"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"Total amount is required","requestId":"req-3"}`))
+	})
+
+	_, err := c.GetPoints(context.Background(), "r-1")
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.Err.Code != CodeReceiptNotFound || notFound.Err.RequestID != "req-2" {
+		t.Errorf("expected an unknown receipt but got %v", err)
+	}
+	_, err = c.ProcessReceipt(context.Background(), Receipt{})
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) || invalid.Err.Message != "Total amount is required" || invalid.Err.RequestID != "req-3" {
+		t.Errorf("expected an invalid receipt but got %v", err)
+	}
+}
+
+// flakyHandler fails the first failures requests with status, then answers with
+// body, recording the Idempotency-Key of each request.
+type flakyHandler struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	code     string
+	body     string
+	keys     []string
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys = append(h.keys, r.Header.Get("Idempotency-Key"))
+	if len(h.keys) <= h.failures {
+		writeProblem(w, h.status, h.code)
+		return
+	}
+	w.Write([]byte(h.body))
+}
+
+func (h *flakyHandler) attempts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.keys)
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		status           int
+		code             string
+		call             func(ctx context.Context, c *Client) error
+		expectedAttempts int
+		succeeds         bool
+	}{
+		{"lookups are retried", http.StatusServiceUnavailable, CodeReadOnly, getPoints, 3, true},
+		{"previews are retried", http.StatusTooManyRequests, CodeServerBusy, preview, 3, true},
+		{"gateway timeouts are retried", http.StatusGatewayTimeout, CodeRequestTimeout, getPoints, 3, true},
+		{"submissions are not retried", http.StatusServiceUnavailable, CodeReadOnly, process, 1, false},
+		{"keyed submissions are retried", http.StatusServiceUnavailable, CodeReadOnly, processWithKey, 3, true},
+		{"keys in use are retried", http.StatusConflict, CodeIdempotencyKeyInUse, processWithKey, 3, true},
+		{"invalid requests are not retried", http.StatusBadRequest, "BODY_INVALID", getPoints, 1, false},
+		{"exhausted quotas are not retried", http.StatusTooManyRequests, CodeQuotaExhausted, getPoints, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &flakyHandler{failures: 2, status: tt.status, code: tt.code, body: `{"id":"r-1","points":28}`}
+			c := newTestClient(t, h.ServeHTTP, quickRetries)
+			err := tt.call(context.Background(), c)
+			if (err == nil) != tt.succeeds {
+				t.Errorf("expected success %v but got %v", tt.succeeds, err)
+			}
+			if h.attempts() != tt.expectedAttempts {
+				t.Errorf("expected %d attempts but got %d", tt.expectedAttempts, h.attempts())
+			}
+		})
+	}
+
+	// Each attempt sends the same key, so the API stores the receipt once.
+	h := &flakyHandler{failures: 1, status: http.StatusBadGateway, body: `{"id":"r-1"}`}
+	if err := processWithKey(context.Background(), newTestClient(t, h.ServeHTTP, quickRetries)); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.keys) != 2 || h.keys[0] != "order-1" || h.keys[1] != "order-1" {
+		t.Errorf("expected both attempts to send the key but got %q", h.keys)
+	}
+
+	// Attempts stop at MaxAttempts.
+	h = &flakyHandler{failures: 5, status: http.StatusServiceUnavailable, code: CodeShuttingDown}
+	_, err := newTestClient(t, h.ServeHTTP, quickRetries).GetPoints(context.Background(), "r-1")
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.Err.Code != CodeShuttingDown || h.attempts() != 3 {
+		t.Errorf("expected 3 attempts ending in the last error but got %d and %v", h.attempts(), err)
+	}
+}
+
+func getPoints(ctx context.Context, c *Client) error {
+	_, err := c.GetPoints(ctx, "r-1")
+	return err
+}
+
+func preview(ctx context.Context, c *Client) error {
+	_, err := c.Preview(ctx, target)
+	return err
+}
+
+func process(ctx context.Context, c *Client) error {
+	_, err := c.ProcessReceipt(ctx, target)
+	return err
+}
+
+func processWithKey(ctx context.Context, c *Client) error {
+	_, err := c.ProcessReceipt(WithIdempotencyKey(ctx, "order-1"), target)
+	return err
+}
+
+func TestRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			w.Header().Set("Retry-After", "60")
+			writeProblem(w, http.StatusTooManyRequests, CodeRateLimited)
+			return
+		}
+		w.Write([]byte(`{"points":28}`))
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond}))
+
+	if _, err := c.GetPoints(context.Background(), "r-1"); err != nil {
+		t.Fatal(err)
+	}
+	// The Retry-After is waited out up to MaxDelay.
+	if waited := times[1].Sub(times[0]); waited < 50*time.Millisecond || waited > 5*time.Second {
+		t.Errorf("expected to wait MaxDelay but waited %v", waited)
+	}
+
+	// A context that ends while waiting ends the call with the last error.
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		writeProblem(w, http.StatusTooManyRequests, CodeRateLimited)
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, MaxDelay: time.Minute}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.GetPoints(ctx, "r-1")
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || limited.Err.RetryAfter != time.Minute {
+		t.Errorf("expected the rate limit error with its Retry-After but got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}, WithTimeout(20*time.Millisecond), WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+
+	_, err := c.GetPoints(context.Background(), "r-1")
+	var networkErr *NetworkError
+	if !errors.As(err, &networkErr) {
+		t.Fatalf("expected a network error but got %T: %v", err, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetPoints(ctx, "r-1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context's error but got %v", err)
+	}
+}
+
+func TestExportReceipts(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/receipts/export" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write([]byte(`{"id":"r-1","retailer":"Target","points":28,"processedAt":"2022-01-01T13:01:00Z"}` + "\n" + `{"id":"r-2","retailer":"Walgreens","points":15,"processedAt":"2022-01-01T13:02:00Z"}` + "\n"))
+	})
+
+	exported, err := c.ExportReceipts(context.Background())
+	if err != nil || len(exported) != 2 || exported[0].ID != "r-1" || exported[1].Points != 15 || exported[1].ProcessedAt.Minute() != 2 {
+		t.Errorf("expected both receipts but got %+v, %v", exported, err)
+	}
+}
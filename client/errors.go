@@ -0,0 +1,179 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Codes the API answers errors with, in Error.Code. They are stable, unlike the
+// messages.
+const (
+	CodeAPIKeyRequired         = "API_KEY_REQUIRED"
+	CodeAPIKeyExpired          = "API_KEY_EXPIRED"
+	CodeAPIKeyScopeMissing     = "API_KEY_SCOPE_MISSING"
+	CodeTokenRequired          = "TOKEN_REQUIRED"
+	CodeTokenInvalid           = "TOKEN_INVALID"
+	CodeTokenExpired           = "TOKEN_EXPIRED"
+	CodeSignatureMissing       = "SIGNATURE_MISSING"
+	CodeSignatureInvalid       = "SIGNATURE_INVALID"
+	CodeReceiptNotFound        = "RECEIPT_NOT_FOUND"
+	CodePointsExpired          = "POINTS_EXPIRED"
+	CodeBodyTooLarge           = "BODY_TOO_LARGE"
+	CodeContentTypeUnsupported = "CONTENT_TYPE_UNSUPPORTED"
+	CodeIdempotencyKeyInUse    = "IDEMPOTENCY_KEY_IN_USE"
+	CodeIdempotencyKeyReused   = "IDEMPOTENCY_KEY_REUSED"
+	CodeRateLimited            = "RATE_LIMITED"
+	CodeQuotaExhausted         = "QUOTA_EXHAUSTED"
+	CodeServerBusy             = "SERVER_BUSY"
+	CodeReadOnly               = "READ_ONLY"
+	CodeShuttingDown           = "SHUTTING_DOWN"
+	CodeRequestTimeout         = "REQUEST_TIMEOUT"
+)
+
+// Error is an error response of the API. Code is empty for the invalid receipts
+// the receipt endpoints answer with a message alone; the message then says what is
+// wrong with the receipt.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// RequestID is the X-Request-ID of the request, for support tickets.
+	RequestID string
+	// RetryAfter is how long the API asked to wait before trying again, if it did.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "client: %d", e.StatusCode)
+	if e.Code != "" {
+		b.WriteString(" " + e.Code)
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	}
+	if e.RequestID != "" {
+		b.WriteString(" (request " + e.RequestID + ")")
+	}
+	return b.String()
+}
+
+// The kinds of Error, by status, for errors.As:
+//
+//	var notFound *client.NotFoundError
+//	if errors.As(err, &notFound) { ... }
+//
+// Each unwraps to its *Error, so errors.As finds that too.
+type (
+	// ValidationError is a request the API can't take as it is: an invalid
+	// receipt (400), one too large (413) or in an unsupported format (415).
+	ValidationError struct{ Err *Error }
+	// AuthError is a missing or invalid API key, token or signature (401), or one
+	// without the scope the endpoint needs (403).
+	AuthError struct{ Err *Error }
+	// NotFoundError is an unknown receipt (404), or one whose points expired (410).
+	NotFoundError struct{ Err *Error }
+	// ConflictError is an idempotency key in use by a submission still being
+	// processed (409), or sent before with another receipt (422).
+	ConflictError struct{ Err *Error }
+	// RateLimitError is a request over the API key's rate or quota, or shed while
+	// the API is saturated (429).
+	RateLimitError struct{ Err *Error }
+	// UnavailableError is the API, or what it depends on, failing to answer in time
+	// or not taking requests for now (502, 503, 504).
+	UnavailableError struct{ Err *Error }
+)
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+func (e *AuthError) Error() string { return e.Err.Error() }
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+func (e *NotFoundError) Error() string { return e.Err.Error() }
+
+func (e *NotFoundError) Unwrap() error { return e.Err }
+
+func (e *ConflictError) Error() string { return e.Err.Error() }
+
+func (e *ConflictError) Unwrap() error { return e.Err }
+
+func (e *RateLimitError) Error() string { return e.Err.Error() }
+
+func (e *RateLimitError) Unwrap() error { return e.Err }
+
+func (e *UnavailableError) Error() string { return e.Err.Error() }
+
+func (e *UnavailableError) Unwrap() error { return e.Err }
+
+// NetworkError is a request that got no response, such as one refused or timed out.
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string { return "client: " + e.Err.Error() }
+
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// parseError reads the problem details or {"error": ...} body of a failed response.
+func parseError(resp *http.Response, payload []byte) *Error {
+	var body struct {
+		// Problem details.
+		Code   string `json:"code"`
+		Detail string `json:"detail"`
+		Title  string `json:"title"`
+		// The receipt endpoints' errors.
+		Error string `json:"error"`
+
+		RequestID string `json:"requestId"`
+	}
+	_ = json.Unmarshal(payload, &body)
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Code:       body.Code,
+		Message:    body.Detail,
+		RequestID:  body.RequestID,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	switch {
+	case body.Error != "":
+		e.Message = body.Error
+		// Unknown receipts are the only 404 answered this way.
+		if resp.StatusCode == http.StatusNotFound {
+			e.Code = CodeReceiptNotFound
+		}
+	case e.Message == "":
+		e.Message = body.Title
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return e
+}
+
+// typedError returns e as the kind of error its status is.
+func typedError(e *Error) error {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return &ValidationError{e}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &AuthError{e}
+	case http.StatusNotFound, http.StatusGone:
+		return &NotFoundError{e}
+	case http.StatusConflict, http.StatusUnprocessableEntity:
+		return &ConflictError{e}
+	case http.StatusTooManyRequests:
+		return &RateLimitError{e}
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return &UnavailableError{e}
+	}
+	return e
+}
@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// Clock tells the current time. Code that needs "now" asks clock instead of calling
+// time.Now, so tests can control time; clock_test.go checks that nothing else calls it.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real Clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// clock is the Clock the service runs on.
+var clock Clock = systemClock{}
+
+// fixedClock is a Clock stopped at an instant, the clock of --deterministic.
+type fixedClock struct {
+	t time.Time
+}
+
+func (c fixedClock) Now() time.Time { return c.t }
+
+// deadlineClock is the Clock read and write deadlines of connections are set by. The
+// kernel times them out by the real time, so it stays the real clock whatever clock
+// is.
+var deadlineClock Clock = systemClock{}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to t.
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock runs the service on a fake clock set to start for the rest of the test.
+func useFakeClock(t *testing.T, start time.Time) *fakeClock {
+	t.Helper()
+	fake := &fakeClock{now: start}
+	previous := clock
+	clock = fake
+	t.Cleanup(func() { clock = previous })
+	return fake
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2022, 1, 1, 13, 1, 0, 0, time.UTC)
+	fake := useFakeClock(t, start)
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("expected %v but got %v", start, got)
+	}
+	fake.Advance(90 * time.Minute)
+	if got := clock.Now(); !got.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("expected the clock to advance by 90m but got %v", got)
+	}
+
+	engine := setRules(defaultRulesConfig())
+	defer setRules(defaultRulesConfig())
+	if !engine.loadedAt.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("expected the rules to be loaded at the fake time but got %v", engine.loadedAt)
+	}
+}
+
+// TestNoDirectTimeNow keeps the service on clock: outside clock.go nothing may read
+// the system time directly.
+func TestNoDirectTimeNow(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forbidden := map[string]bool{"Now": true, "Since": true, "Until": true}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || file == "clock.go" {
+			continue
+		}
+		fset := token.NewFileSet()
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(parsed, func(n ast.Node) bool {
+			selector, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if pkg, ok := selector.X.(*ast.Ident); ok && pkg.Name == "time" && forbidden[selector.Sel.Name] {
+				t.Errorf("%s: use clock.Now() instead of time.%s", fset.Position(selector.Pos()), selector.Sel.Name)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+)
+
+// codecReceiptFields and codecItemFields are the fields of a receipt and its items,
+// which are text strings but for the receipt's items.
+var (
+	codecReceiptFields = []string{"retailer", "total", "items", "purchaseDate", "purchaseTime", "timezone"}
+	codecItemFields    = []string{"shortDescription", "price", "upc"}
+)
+
+// codecFormat is a binary format of the codec package receipts are decoded from and
+// responses encoded in: its handle, its name in errors, and what it calls a value,
+// such as "data item" for CBOR.
+type codecFormat struct {
+	handle codec.Handle
+	name   string
+	value  string
+}
+
+// decodeReceipt decodes a receipt, a map with the fields of the JSON one. The receipt
+// is checked field by field before it is decoded into a Receipt, since the decoder
+// would otherwise take a byte string or array for a text string, and report a number
+// in place of one as an unexpected end of data. Errors reading r are returned as
+// they are.
+func (f codecFormat) decodeReceipt(r io.Reader) (Receipt, error) {
+	var receipt Receipt
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return receipt, err
+	}
+	if len(data) == 0 {
+		return receipt, codecError(reasonBodyInvalid, "it is empty")
+	}
+	var value any
+	decoder := codec.NewDecoderBytes(data, f.handle)
+	if err := decoder.Decode(&value); err != nil {
+		return receipt, f.syntaxError(err)
+	}
+	if decoder.NumBytesRead() != len(data) {
+		return receipt, codecError(reasonBodyInvalid, "it holds more than one %s %s", f.name, f.value)
+	}
+	if err := checkCodecReceipt(value); err != nil {
+		return receipt, err
+	}
+	if err := codec.NewDecoderBytes(data, f.handle).Decode(&receipt); err != nil {
+		return receipt, f.syntaxError(err)
+	}
+	return receipt, nil
+}
+
+// encode encodes a response body.
+func (f codecFormat) encode(body gin.H) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, f.handle).Encode(map[string]any(body))
+	return data, err
+}
+
+func (f codecFormat) syntaxError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return codecError(reasonBodyInvalid, "malformed %s: it ends early", f.name)
+	}
+	return codecError(reasonBodyInvalid, "malformed %s: %s", f.name, strings.TrimPrefix(err.Error(), f.handle.Name()+" decode error "))
+}
+
+func codecError(reason validationReason, format string, args ...any) error {
+	return &receiptDecodeError{reason: reason, message: "Failed to parse the request body: " + fmt.Sprintf(format, args...)}
+}
+
+// checkCodecReceipt checks a decoded receipt has only the fields of one, of the
+// right types. Null fields are left empty, as in JSON.
+func checkCodecReceipt(value any) error {
+	receipt, err := codecFields("the receipt", value, codecReceiptFields)
+	if err != nil {
+		return err
+	}
+	for _, name := range codecReceiptFields {
+		field, ok := receipt[name]
+		if !ok || field == nil {
+			continue
+		}
+		if name != "items" {
+			if err := codecText(name, field); err != nil {
+				return err
+			}
+			continue
+		}
+		items, ok := field.([]any)
+		if !ok {
+			return codecError(reasonBodyInvalid, "items must be an array, not %s", codecKind(field))
+		}
+		for i, item := range items {
+			path := fmt.Sprintf("items[%d]", i)
+			fields, err := codecFields(path, item, codecItemFields)
+			if err != nil {
+				return err
+			}
+			for _, name := range codecItemFields {
+				if field := fields[name]; field != nil {
+					if err := codecText(path+"."+name, field); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// codecFields returns the fields of the map at path, rejecting other values, keys that
+// aren't text and fields not in known.
+func codecFields(path string, value any, known []string) (map[string]any, error) {
+	m, ok := value.(map[any]any)
+	if !ok {
+		return nil, codecError(reasonBodyInvalid, "%s must be a map, not %s", path, codecKind(value))
+	}
+	fields := make(map[string]any, len(m))
+	var unknown []string
+	for key, field := range m {
+		name, ok := key.(string)
+		if !ok {
+			return nil, codecError(reasonBodyInvalid, "the keys of %s must be text strings, not %s", path, codecKind(key))
+		}
+		if !containsString(known, name) {
+			unknown = append(unknown, name)
+		}
+		fields[name] = field
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, codecError(reasonBodyInvalid, "%s has no field %q", path, unknown[0])
+	}
+	return fields, nil
+}
+
+// codecText rejects a field at path that isn't a text string, with the reason its
+// field is rejected for when it is an amount.
+func codecText(path string, value any) error {
+	if _, ok := value.(string); ok {
+		return nil
+	}
+	switch {
+	case path == "total":
+		return codecError(reasonTotalInvalidFormat, `total must be a text string, such as "35.35", not %s`, codecKind(value))
+	case strings.HasSuffix(path, ".price"):
+		return codecError(reasonItemPriceInvalid, `%s must be a text string, such as "6.49", not %s`, path, codecKind(value))
+	}
+	return codecError(reasonBodyInvalid, "%s must be a text string, not %s", path, codecKind(value))
+}
+
+// codecKind names the type of a decoded value.
+func codecKind(value any) string {
+	switch value.(type) {
+	case int64, uint64:
+		return "an integer"
+	case float32, float64:
+		return "a float"
+	case []byte:
+		return "a byte string"
+	case bool:
+		return "a boolean"
+	case []any:
+		return "an array"
+	case map[any]any:
+		return "a map"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("a %T", value)
+}
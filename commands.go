@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"receipt_api/client"
+)
+
+// Exit codes of the commands.
+const (
+	exitOK = 0
+	// exitFailure is an error talking to the server or reading a file.
+	exitFailure = 1
+	// exitUsage is a command line the command can't run.
+	exitUsage = 2
+	// exitInvalid is a receipt that failed validation, here or on the server.
+	exitInvalid = 3
+	// exitNotFound is a receipt the server doesn't have.
+	exitNotFound = 4
+)
+
+// command is a subcommand of the binary, such as "fetch-points points <id>". serve,
+// the server, is the default and not among them.
+type command struct {
+	summary string
+	run     func(args []string, stdout, stderr io.Writer) int
+}
+
+// commands are the subcommands by name.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"process": {"submit a receipt to a server and print its ID and points", runProcess},
+		"points":  {"print the points of a receipt on a server", runPoints},
+		"score":   {"validate and score a receipt here, without a server, and print the breakdown", runScore},
+		"export":  {"print the receipts stored on a server as CSV or JSON lines", runExport},
+		"help":    {"list the commands", runHelp},
+	}
+}
+
+// splitCommand returns the command args name, if any, and the rest of args. The
+// server runs for "serve" or no command at all, so existing command lines keep
+// working.
+func splitCommand(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "serve", args
+	}
+	return args[0], args[1:]
+}
+
+func runHelp(args []string, stdout, stderr io.Writer) int {
+	fmt.Fprintln(stdout, "Usage: fetch-points [command] [options]")
+	fmt.Fprintln(stdout)
+	fmt.Fprintln(stdout, "Commands:")
+	fmt.Fprintf(stdout, "  %-8s %s\n", "serve", "run the server, the default; see fetch-points serve -h")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(stdout, "  %-8s %s\n", name, commands[name].summary)
+	}
+	return exitOK
+}
+
+// clientOptions are the options of the commands that call a server.
+type clientOptions struct {
+	addr    string
+	apiKey  string
+	timeout time.Duration
+}
+
+// register defines the options on fs. The API key defaults to $FETCH_API_KEY, so
+// it needn't be on the command line.
+func (o *clientOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "addr", "http://localhost:8080", "base URL of the server")
+	fs.StringVar(&o.apiKey, "api-key", os.Getenv("FETCH_API_KEY"), "API key to send, $FETCH_API_KEY by default")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "how long each request may take")
+}
+
+func (o *clientOptions) client() (*client.Client, error) {
+	opts := []client.Option{client.WithTimeout(o.timeout)}
+	if o.apiKey != "" {
+		opts = append(opts, client.WithAPIKey(o.apiKey))
+	}
+	return client.New(o.addr, opts...)
+}
+
+// newCommandFlags returns the flag set of command name, which writes its usage and
+// errors to stderr.
+func newCommandFlags(name, usage string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: fetch-points %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandFlags parses args, returning the exit code if the command shouldn't
+// run: exitOK for -h and exitUsage for a mistake.
+func parseCommandFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	return 0, true
+}
+
+// readReceiptFile reads the JSON receipt in path, or stdin for "-".
+func readReceiptFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// clientExitCode reports err, a failed call to the server, and returns the exit code
+// for it.
+func clientExitCode(err error, stderr io.Writer) int {
+	fmt.Fprintln(stderr, err)
+	var invalid *client.ValidationError
+	var notFound *client.NotFoundError
+	switch {
+	case errors.As(err, &invalid):
+		return exitInvalid
+	case errors.As(err, &notFound):
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+// runProcess submits the receipt in -f and prints its ID and points, separated by a
+// tab. The submission carries an Idempotency-Key so the client can retry it.
+func runProcess(args []string, stdout, stderr io.Writer) int {
+	var options clientOptions
+	var file, idempotencyKey string
+	fs := newCommandFlags("process", "-f receipt.json [options]", stderr)
+	fs.StringVar(&file, "f", "", "JSON receipt to submit, - for stdin")
+	fs.StringVar(&idempotencyKey, "idempotency-key", "", "Idempotency-Key of the submission, to resubmit a receipt safely (default a new one)")
+	options.register(fs)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if file == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	data, err := readReceiptFile(file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	var receipt client.Receipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		fmt.Fprintf(stderr, "%s is not a JSON receipt: %v\n", file, err)
+		return exitInvalid
+	}
+	c, err := options.client()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.New().String()
+	}
+	ctx := client.WithIdempotencyKey(context.Background(), idempotencyKey)
+	id, err := c.ProcessReceipt(ctx, receipt)
+	if err != nil {
+		return clientExitCode(err, stderr)
+	}
+	points, err := c.GetPoints(ctx, id)
+	if err != nil {
+		return clientExitCode(err, stderr)
+	}
+	fmt.Fprintf(stdout, "%s\t%d\n", id, points)
+	return exitOK
+}
+
+// runPoints prints the points of the receipt named by the argument.
+func runPoints(args []string, stdout, stderr io.Writer) int {
+	var options clientOptions
+	fs := newCommandFlags("points", "[options] <id>", stderr)
+	options.register(fs)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	c, err := options.client()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	points, err := c.GetPoints(context.Background(), client.ID(fs.Arg(0)))
+	if err != nil {
+		return clientExitCode(err, stderr)
+	}
+	fmt.Fprintln(stdout, points)
+	return exitOK
+}
+
+// runScore validates and scores the receipt in -f as the server would, with the
+// default rules or those of --rules-config, and prints the points of each rule and
+// the total.
+func runScore(args []string, stdout, stderr io.Writer) int {
+	var file, rulesPath string
+	fs := newCommandFlags("score", "-f receipt.json [options]", stderr)
+	fs.StringVar(&file, "f", "", "JSON receipt to score, - for stdin")
+	fs.StringVar(&rulesPath, "rules-config", "", "YAML or JSON file overriding the scoring rule parameters")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if file == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	config := defaultRulesConfig()
+	if rulesPath != "" {
+		var err error
+		if config, err = loadRulesConfig(rulesPath); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailure
+		}
+	}
+	engine := newEngine(config)
+	data, err := readReceiptFile(file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	receipt, err := decodeJSONReceipt(bytes.NewReader(data))
+	var decodeErr *receiptDecodeError
+	switch {
+	case errors.As(err, &decodeErr):
+		fmt.Fprintf(stderr, "%s: %s\n", decodeErr.reason, decodeErr.message)
+		return exitInvalid
+	case err != nil:
+		fmt.Fprintf(stderr, "%s: %v\n", reasonBodyInvalid, err)
+		return exitInvalid
+	}
+	if reason, message := validateReceipt(&receipt, engine); reason != "" {
+		fmt.Fprintf(stderr, "%s: %s\n", reason, message)
+		return exitInvalid
+	}
+
+	receipt.ProcessedAt = clock.Now()
+	points, breakdown, err := engine.ScoreReceiptContext(context.Background(), receipt)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	for _, entry := range breakdown {
+		fmt.Fprintf(stdout, "%-24s %4d  %s\n", entry.Rule, entry.Points, entry.Detail)
+	}
+	fmt.Fprintf(stdout, "%-24s %4d\n", "total", points)
+	return exitOK
+}
+
+// exportColumns are the columns of fetch-points export --format csv.
+var exportColumns = []string{"id", "retailer", "purchaseDate", "purchaseTime", "total", "items", "points", "rulesVersion", "variant", "owner", "processedAt"}
+
+// runExport prints the receipts stored on the server, oldest first, as CSV with a
+// header row or as lines of JSON.
+func runExport(args []string, stdout, stderr io.Writer) int {
+	var options clientOptions
+	var format string
+	fs := newCommandFlags("export", "[options]", stderr)
+	fs.StringVar(&format, "format", "csv", "csv, or json for a line of JSON per receipt")
+	options.register(fs)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if (format != "csv" && format != "json") || fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	c, err := options.client()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	exported, err := c.ExportReceipts(context.Background())
+	if err != nil {
+		return clientExitCode(err, stderr)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(stdout)
+		for _, receipt := range exported {
+			if err := encoder.Encode(receipt); err != nil {
+				fmt.Fprintln(stderr, err)
+				return exitFailure
+			}
+		}
+		return exitOK
+	}
+	w := csv.NewWriter(stdout)
+	w.Write(exportColumns)
+	for _, r := range exported {
+		w.Write([]string{
+			string(r.ID), r.Retailer, r.PurchaseDate, r.PurchaseTime, r.Total,
+			strconv.Itoa(r.Items), strconv.Itoa(r.Points), r.RulesVersion, r.Variant, r.Owner,
+			r.ProcessedAt.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
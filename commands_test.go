@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runCommand runs the command of args as main would, returning its exit code and
+// what it wrote.
+func runCommand(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	name, rest := splitCommand(args)
+	cmd, ok := commands[name]
+	if !ok {
+		t.Fatalf("no command %q", name)
+	}
+	var stdout, stderr bytes.Buffer
+	code := cmd.run(rest, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		args         []string
+		expectedName string
+		expectedArgs []string
+	}{
+		{nil, "serve", nil},
+		{[]string{"--addr", ":9000"}, "serve", []string{"--addr", ":9000"}},
+		{[]string{"serve", "--addr", ":9000"}, "serve", []string{"--addr", ":9000"}},
+		{[]string{"points", "r-1"}, "points", []string{"r-1"}},
+	}
+	for _, tt := range tests {
+		name, args := splitCommand(tt.args)
+		if name != tt.expectedName || strings.Join(args, " ") != strings.Join(tt.expectedArgs, " ") {
+			t.Errorf("expected %v to be %s %v but got %s %v", tt.args, tt.expectedName, tt.expectedArgs, name, args)
+		}
+	}
+}
+
+func TestProcessAndPointsCommands(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useIdempotencyKeys(t)
+	useAPIKeys(t, []apiKey{{ID: "ops", Key: "ops-key", Scopes: []string{scopeRead, scopeWrite}}})
+	url := serveAPI(t, newRouter())
+	file := writeConfig(t, "receipt.json", validReceiptPayload)
+
+	code, stdout, stderr := runCommand(t, "process", "-f", file, "--addr", url, "--api-key", "ops-key")
+	id, points, _ := strings.Cut(strings.TrimSpace(stdout), "\t")
+	if code != exitOK || points != "28" || id == "" {
+		t.Fatalf("expected the ID and 28 points but got %d %q %q", code, stdout, stderr)
+	}
+	receiptsMu.RLock()
+	_, ok := receipts[id]
+	receiptsMu.RUnlock()
+	if !ok {
+		t.Errorf("expected receipt %s to be stored", id)
+	}
+	code, stdout, _ = runCommand(t, "points", "--addr", url, "--api-key", "ops-key", id)
+	if code != exitOK || stdout != "28\n" {
+		t.Errorf("expected 28 points but got %d %q", code, stdout)
+	}
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+		expectedErr  string
+	}{
+		{"unknown receipt", []string{"points", "--addr", url, "--api-key", "ops-key", "no-such-receipt"}, exitNotFound, "RECEIPT_NOT_FOUND"},
+		{"invalid receipt", []string{"process", "-f", writeConfig(t, "invalid.json", `{"retailer":"Target"}`), "--addr", url, "--api-key", "ops-key"}, exitInvalid, "Total amount is required"},
+		{"not JSON", []string{"process", "-f", writeConfig(t, "receipt.txt", "Target, 35.35"), "--addr", url}, exitInvalid, "not a JSON receipt"},
+		{"missing key", []string{"points", "--addr", url, id}, exitFailure, "API_KEY_REQUIRED"},
+		{"missing file", []string{"process", "--addr", url}, exitUsage, "Usage: fetch-points process"},
+		{"two receipts", []string{"points", "--addr", url, id, id}, exitUsage, "Usage: fetch-points points"},
+		{"bad address", []string{"points", "--addr", "localhost:8080", id}, exitUsage, "invalid base URL"},
+		{"unknown option", []string{"points", "--verbose", id}, exitUsage, "flag provided but not defined"},
+		{"help", []string{"process", "-h"}, exitOK, "-idempotency-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := runCommand(t, tt.args...)
+			if code != tt.expectedCode || !strings.Contains(stderr, tt.expectedErr) {
+				t.Errorf("expected exit code %d and %q but got %d and %q", tt.expectedCode, tt.expectedErr, code, stderr)
+			}
+		})
+	}
+	if len(receipts) != 1 {
+		t.Errorf("expected only the first receipt to be stored but %d are", len(receipts))
+	}
+}
+
+func TestScoreCommand(t *testing.T) {
+	code, stdout, stderr := runCommand(t, "score", "-f", writeConfig(t, "receipt.json", validReceiptPayload))
+	if code != exitOK {
+		t.Fatalf("expected the receipt to be scored but got %d: %s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if fields := strings.Fields(lines[len(lines)-1]); len(fields) != 2 || fields[0] != "total" || fields[1] != "28" {
+		t.Errorf("expected a total of 28 points but got %q", stdout)
+	}
+	if !strings.HasPrefix(lines[0], "retailer_name") {
+		t.Errorf("expected the breakdown by rule but got %q", stdout)
+	}
+
+	rules := writeConfig(t, "rules.yaml", "itemPairPoints: 10\n")
+	code, stdout, _ = runCommand(t, "score", "-f", writeConfig(t, "receipt.json", validReceiptPayload), "--rules-config", rules)
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); code != exitOK || !strings.HasSuffix(strings.Join(strings.Fields(lines[len(lines)-1]), " "), " 38") {
+		t.Errorf("expected the rules config to double the item pair points but got %d %q", code, stdout)
+	}
+
+	code, _, stderr = runCommand(t, "score", "-f", writeConfig(t, "invalid.json", strings.Replace(validReceiptPayload, `"35.35"`, `""`, 1)))
+	if code != exitInvalid || stderr != "TOTAL_MISSING: Total amount is required\n" {
+		t.Errorf("expected the missing total to be reported but got %d %q", code, stderr)
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useAPIKeys(t, []apiKey{
+		{ID: "ops", Key: "ops-key", Scopes: []string{scopeRead, scopeWrite, scopeAdmin}},
+		{ID: "pos", Key: "pos-key", Scopes: []string{scopeRead, scopeWrite}},
+	})
+	router := newRouter()
+	url := serveAPI(t, router)
+	var ids []string
+	for _, retailer := range []string{"Target", "M&M Corner Market"} {
+		payload := strings.Replace(validReceiptPayload, `"Target"`, `"`+retailer+`"`, 1)
+		code, stdout, stderr := runCommand(t, "process", "-f", writeConfig(t, "receipt.json", payload), "--addr", url, "--api-key", "pos-key")
+		if code != exitOK {
+			t.Fatalf("expected the receipt to be processed but got %d: %s", code, stderr)
+		}
+		id, _, _ := strings.Cut(stdout, "\t")
+		ids = append(ids, id)
+	}
+
+	code, stdout, stderr := runCommand(t, "export", "--addr", url, "--api-key", "ops-key")
+	if code != exitOK {
+		t.Fatalf("expected the export but got %d: %s", code, stderr)
+	}
+	rows, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("expected a header and 2 rows but got %q, %v", stdout, err)
+	}
+	if strings.Join(rows[0], ",") != strings.Join(exportColumns, ",") {
+		t.Errorf("expected the header %v but got %v", exportColumns, rows[0])
+	}
+	processedAt := func(id string) string {
+		receiptsMu.RLock()
+		defer receiptsMu.RUnlock()
+		return receipts[id].Receipt.ProcessedAt.UTC().Format(time.RFC3339Nano)
+	}
+	expected := [][]string{
+		{ids[0], "Target", "2022-01-01", "13:01", "35.35", "5", "28", currentEngine().hash, "", "", processedAt(ids[0])},
+		{ids[1], "M&M Corner Market", "2022-01-01", "13:01", "35.35", "5", "36", currentEngine().hash, "", "", processedAt(ids[1])},
+	}
+	for i, row := range rows[1:] {
+		if strings.Join(row, ",") != strings.Join(expected[i], ",") {
+			t.Errorf("expected row %d to be %v but got %v", i+1, expected[i], row)
+		}
+	}
+
+	code, stdout, _ = runCommand(t, "export", "--addr", url, "--api-key", "ops-key", "--format", "json")
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	var first exportedReceipt
+	if err := json.Unmarshal([]byte(lines[0]), &first); code != exitOK || len(lines) != 2 || err != nil || first.ID != ids[0] || first.Points != 28 {
+		t.Errorf("expected 2 lines of JSON but got %d %q", code, stdout)
+	}
+
+	if code, _, stderr := runCommand(t, "export", "--addr", url, "--api-key", "pos-key"); code != exitFailure || !strings.Contains(stderr, "API_KEY_SCOPE_MISSING") {
+		t.Errorf("expected the export to need the admin scope but got %d %q", code, stderr)
+	}
+	if code, _, _ := runCommand(t, "export", "--format", "xml"); code != exitUsage {
+		t.Errorf("expected an unknown format to be rejected but got %d", code)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The --gzip-level responses are compressed at, 0 disabling compression, and the
+// --gzip-min-bytes below which they aren't worth compressing.
+var (
+	gzipLevel    = 6
+	gzipMinBytes = byteSize(1 << 10)
+)
+
+// compressibleTypes are the media types worth compressing. Others, such as metrics
+// text and profiles, are sent as they are.
+var compressibleTypes = map[string]bool{
+	"application/json":         true,
+	"application/problem+json": true,
+	jsonAPIMediaType:           true,
+	"application/x-ndjson":     true,
+}
+
+// gzipWriters are reusable writers, by level.
+var gzipWriters sync.Map
+
+func getGzipWriter(level int) *gzip.Writer {
+	pool, _ := gzipWriters.LoadOrStore(level, &sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}})
+	return pool.(*sync.Pool).Get().(*gzip.Writer)
+}
+
+func putGzipWriter(level int, w *gzip.Writer) {
+	if pool, ok := gzipWriters.Load(level); ok {
+		pool.(*sync.Pool).Put(w)
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, by name or as *,
+// with a q-value above 0.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// compressResponses gzips JSON responses of at least gzipMinBytes for clients that
+// accept it. Smaller responses are held until they end or reach the threshold, so
+// they are sent as they are. NDJSON streams are compressed from their first line and
+// flushed line by line, so clients see each line as it is written.
+func compressResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if gzipLevel == 0 {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if c.Request.Method == http.MethodHead || !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+		w := &gzipResponseWriter{ResponseWriter: c.Writer, level: gzipLevel, minBytes: int(gzipMinBytes)}
+		c.Writer = w
+		defer func() { c.Writer = w.ResponseWriter }()
+		c.Next()
+		w.finish()
+	}
+}
+
+// gzipResponseWriter decides on the first write past the threshold, or the first
+// flush, whether to compress, holding what is written until then.
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	level    int
+	minBytes int
+
+	held    bytes.Buffer
+	decided bool
+	stream  bool
+	gz      *gzip.Writer
+}
+
+// compressible reports whether the response so far is worth compressing, by its
+// status and headers.
+func (w *gzipResponseWriter) compressible() bool {
+	switch status := w.ResponseWriter.Status(); {
+	case status < http.StatusOK, status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	return compressibleTypes[mediaType]
+}
+
+// decide starts compressing or not, and writes what was held.
+func (w *gzipResponseWriter) decide(compress bool) {
+	w.decided = true
+	if compress {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = getGzipWriter(w.level)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	if w.held.Len() > 0 {
+		w.write(w.held.Bytes())
+		w.held.Reset()
+	}
+}
+
+func (w *gzipResponseWriter) write(data []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		if !w.compressible() {
+			w.decide(false)
+		} else if mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); mediaType == "application/x-ndjson" {
+			w.stream = true
+			w.decide(true)
+		} else {
+			w.held.Write(data)
+			if w.held.Len() >= w.minBytes {
+				w.decide(true)
+			}
+			return len(data), nil
+		}
+	}
+	n, err := w.write(data)
+	if err == nil && w.stream && bytes.HasSuffix(data, []byte("\n")) {
+		w.Flush()
+	}
+	return n, err
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipResponseWriter) WriteHeaderNow() {
+	if w.decided {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *gzipResponseWriter) Written() bool {
+	return w.held.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *gzipResponseWriter) Size() int {
+	if !w.decided && w.held.Len() > 0 {
+		return w.held.Len()
+	}
+	return w.ResponseWriter.Size()
+}
+
+// Flush sends what was written so far, compressing it if the response is compressible
+// whatever its size, since a flushed response is being streamed.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(w.compressible())
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a response that ended below the threshold as it is, or ends the
+// compressed stream.
+func (w *gzipResponseWriter) finish() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		putGzipWriter(w.level, w.gz)
+		w.gz = nil
+	}
+}
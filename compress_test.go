@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                        false,
+		"gzip":                    true,
+		"GZIP":                    true,
+		"deflate, gzip;q=0.5":     true,
+		"br;q=1.0, gzip; q=0.8":   true,
+		"gzip;q=0":                false,
+		"gzip;q=0.000":            false,
+		"*":                       true,
+		"*;q=0":                   false,
+		"gzip;q=0, *":             false,
+		"identity":                false,
+		"deflate, br":             false,
+		"x-gzip":                  true,
+		"gzip;q=nonsense, br":     false,
+		"identity;q=1, *;q=0.001": true,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("%q: expected %v but got %v", header, want, got)
+		}
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(level int, minBytes byteSize) { gzipLevel, gzipMinBytes = level, minBytes }(gzipLevel, gzipMinBytes)
+	gzipMinBytes = 1 << 10
+	large := strings.Repeat("x", 4<<10)
+
+	router := newGinEngine()
+	router.GET("/large", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"data": large}) })
+	router.GET("/small", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"data": "x"}) })
+	router.GET("/text", func(c *gin.Context) { c.String(http.StatusOK, large) })
+	router.GET("/sized", func(c *gin.Context) {
+		body := `{"data":"` + large + `"}`
+		c.Header("Content-Length", strconv.Itoa(len(body)))
+		c.Data(http.StatusOK, "application/json", []byte(body))
+	})
+	router.GET("/empty", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	gunzip := func(t *testing.T, rr *httptest.ResponseRecorder) string {
+		t.Helper()
+		reader, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("expected a gzip body but got %v", err)
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("expected a complete gzip body but got %v", err)
+		}
+		return string(body)
+	}
+
+	t.Run("compressed", func(t *testing.T) {
+		rr := get("/large", "gzip, deflate")
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("expected a gzipped 200 but got %v %v", rr.Code, rr.Header())
+		}
+		if rr.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("expected Vary: Accept-Encoding but got %q", rr.Header().Get("Vary"))
+		}
+		if rr.Body.Len() >= len(large) {
+			t.Errorf("expected the body to shrink from %d bytes but got %d", len(large), rr.Body.Len())
+		}
+		if body := gunzip(t, rr); body != `{"data":"`+large+`"}` {
+			t.Errorf("expected the JSON back after decompressing but got %d bytes", len(body))
+		}
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		for _, acceptEncoding := range []string{"", "gzip;q=0", "br"} {
+			rr := get("/large", acceptEncoding)
+			if rr.Header().Get("Content-Encoding") != "" || !strings.Contains(rr.Body.String(), large) {
+				t.Errorf("%q: expected the plain JSON but got %v", acceptEncoding, rr.Header())
+			}
+			if rr.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("%q: expected Vary: Accept-Encoding but got %q", acceptEncoding, rr.Header().Get("Vary"))
+			}
+		}
+	})
+
+	t.Run("below the threshold", func(t *testing.T) {
+		rr := get("/small", "gzip")
+		if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{"data":"x"}` {
+			t.Errorf("expected a small response as it is but got %v: %q", rr.Header(), rr.Body.String())
+		}
+		gzipMinBytes = 0
+		defer func() { gzipMinBytes = 1 << 10 }()
+		if rr := get("/small", "gzip"); rr.Header().Get("Content-Encoding") != "gzip" || gunzip(t, rr) != `{"data":"x"}` {
+			t.Errorf("expected a small response compressed without a threshold but got %v", rr.Header())
+		}
+	})
+
+	t.Run("not JSON", func(t *testing.T) {
+		if rr := get("/text", "gzip"); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != large {
+			t.Errorf("expected text as it is but got %v", rr.Header())
+		}
+	})
+
+	t.Run("content length", func(t *testing.T) {
+		rr := get("/sized", "gzip")
+		if rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Content-Length") != "" {
+			t.Errorf("expected a gzipped response without a Content-Length but got %v", rr.Header())
+		}
+		gunzip(t, rr)
+		rr = get("/sized", "")
+		if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(rr.Body.Len()) {
+			t.Errorf("expected a Content-Length of %d but got %q", rr.Body.Len(), got)
+		}
+	})
+
+	t.Run("no content", func(t *testing.T) {
+		if rr := get("/empty", "gzip"); rr.Code != http.StatusNoContent || rr.Header().Get("Content-Encoding") != "" || rr.Body.Len() != 0 {
+			t.Errorf("expected an empty 204 but got %v %v %q", rr.Code, rr.Header(), rr.Body.String())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		gzipLevel = 0
+		defer func() { gzipLevel = 6 }()
+		if rr := get("/large", "gzip"); rr.Header().Get("Content-Encoding") != "" || rr.Header().Get("Vary") != "" {
+			t.Errorf("expected no compression at level 0 but got %v", rr.Header())
+		}
+	})
+}
+
+// TestCompressedStream checks NDJSON lines reach the client compressed as they are
+// written, not when the response ends.
+func TestCompressedStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	next := make(chan struct{})
+	router := newGinEngine()
+	router.GET("/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		c.Writer.WriteString(`{"line":1}` + "\n")
+		<-next
+		c.Writer.WriteString(`{"line":2}` + "\n")
+	})
+	addr := startServer(t, router, nil)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		close(next)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		close(next)
+		t.Fatalf("expected a gzipped stream but got %v", resp.Header)
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		close(next)
+		t.Fatalf("expected a gzip stream but got %v", err)
+	}
+	lines := bufio.NewReader(reader)
+	if line, err := lines.ReadString('\n'); err != nil || line != `{"line":1}`+"\n" {
+		t.Errorf("expected the first line before the second is written but got %q, %v", line, err)
+	}
+	close(next)
+	if line, err := lines.ReadString('\n'); err != nil || line != `{"line":2}`+"\n" {
+		t.Errorf("expected the second line but got %q, %v", line, err)
+	}
+	if rest, err := io.ReadAll(lines); err != nil || len(rest) != 0 {
+		t.Errorf("expected the stream to end cleanly but got %q, %v", rest, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The --config file of options and --print-config. The file can also be named in
+// FETCH_CONFIG.
+var (
+	configPath  string
+	printConfig bool
+)
+
+// envPrefix starts the environment variable of each option: FETCH_RATE_LIMIT sets
+// --rate-limit.
+const envPrefix = "FETCH_"
+
+// secretOptions are the parts of option names whose values --print-config masks.
+var secretOptions = []string{"password", "secret", "token"}
+
+// optionEnv returns the environment variable of an option.
+func optionEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// isConfigOption reports whether name is a flag that says how to configure rather than
+// what, which neither the file nor the environment variables of options set.
+func isConfigOption(name string) bool {
+	return name == "config" || name == "print-config" || name == "validate-only"
+}
+
+// fileOption is the value of an option in a config file, and its line.
+type fileOption struct {
+	value string
+	line  int
+}
+
+// loadConfigFile reads the options of a YAML config file. Keys are option names, and
+// nested keys are joined with "-", so tls: {cert: a.pem} sets --tls-cert. Lists are
+// joined with commas. Keys that name no option of fs are rejected with their line.
+func loadConfigFile(path string, fs *flag.FlagSet) (map[string]fileOption, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &configError{path: path, msg: strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	options := make(map[string]fileOption)
+	if len(root.Content) == 0 {
+		return options, nil
+	}
+	if root.Content[0].Kind != yaml.MappingNode {
+		return nil, &configError{path: path, line: root.Content[0].Line, msg: "expected a mapping of options"}
+	}
+	if err := collectOptions(path, root.Content[0], nil, fs, options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// collectOptions adds the options in mapping, whose keys are under the keys of
+// parents, to options.
+func collectOptions(path string, mapping *yaml.Node, parents []string, fs *flag.FlagSet, options map[string]fileOption) error {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		keys := append(append([]string(nil), parents...), key.Value)
+		name := strings.Join(keys, "-")
+		yamlPath := strings.Join(keys, ".")
+		option := fs.Lookup(name)
+		if option == nil || isConfigOption(name) {
+			if value.Kind == yaml.MappingNode {
+				if err := collectOptions(path, value, keys, fs, options); err != nil {
+					return err
+				}
+				continue
+			}
+			return &configError{path: path, line: key.Line, msg: yamlPath + " is not an option"}
+		}
+		switch value.Kind {
+		case yaml.ScalarNode:
+			if value.Tag == "!!null" {
+				return &configError{path: path, line: key.Line, msg: yamlPath + " has no value"}
+			}
+			options[name] = fileOption{value: value.Value, line: key.Line}
+		case yaml.SequenceNode:
+			items := make([]string, len(value.Content))
+			for j, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return &configError{path: path, line: item.Line, msg: yamlPath + " must be a list of values"}
+				}
+				items[j] = item.Value
+			}
+			options[name] = fileOption{value: strings.Join(items, ","), line: key.Line}
+		default:
+			return &configError{path: path, line: key.Line, msg: yamlPath + " must be a value or a list"}
+		}
+	}
+	return nil
+}
+
+// applyConfig sets the options of fs that weren't given on the command line from their
+// environment variable, else from the config file at path, if any. The command line
+// wins over the environment, which wins over the file, which wins over the defaults.
+func applyConfig(fs *flag.FlagSet, path string, lookupEnv func(string) (string, bool)) error {
+	fileOptions := make(map[string]fileOption)
+	if path != "" {
+		var err error
+		if fileOptions, err = loadConfigFile(path, fs); err != nil {
+			return err
+		}
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || isConfigOption(f.Name) {
+			return
+		}
+		if value, ok := lookupEnv(optionEnv(f.Name)); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %v", optionEnv(f.Name), setErr)
+			}
+			return
+		}
+		if option, ok := fileOptions[f.Name]; ok {
+			if setErr := fs.Set(f.Name, option.value); setErr != nil {
+				err = &configError{path: path, line: option.line, msg: fmt.Sprintf("%s: %v", f.Name, setErr)}
+			}
+		}
+	})
+	return err
+}
+
+// The --*-file options naming files to read secret options from, so the secrets
+// aren't in the command line or environment of the process.
+var (
+	adminTokenFile                string
+	metricsPasswordFile           string
+	introspectionClientSecretFile string
+	webhookSecretFile             string
+)
+
+// readSecretFiles sets each option of fs that has a --<name>-file option given from
+// the file it names, less a trailing newline. Giving both is an error, whichever of
+// the flag, environment or config file each came from.
+func readSecretFiles(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		file := fs.Lookup(f.Name + "-file")
+		if err != nil || file == nil || file.Value.String() == "" {
+			return
+		}
+		if f.Value.String() != "" {
+			err = fmt.Errorf("--%s (%s) and --%s (%s) can't both be set", f.Name, optionEnv(f.Name), file.Name, optionEnv(file.Name))
+			return
+		}
+		var data []byte
+		if data, err = os.ReadFile(file.Value.String()); err != nil {
+			err = fmt.Errorf("--%s: %v", file.Name, err)
+			return
+		}
+		secret := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+		if secret == "" {
+			err = fmt.Errorf("--%s: %s is empty", file.Name, file.Value.String())
+			return
+		}
+		err = fs.Set(f.Name, secret)
+	})
+	return err
+}
+
+// writeEffectiveConfig writes the value of every option of fs, in order, as a config
+// file, masking secrets.
+func writeEffectiveConfig(w io.Writer, fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || isConfigOption(f.Name) {
+			return
+		}
+		value := f.Value.String()
+		for _, secret := range secretOptions {
+			if strings.Contains(f.Name, secret) && !strings.HasSuffix(f.Name, "-file") && value != "" {
+				value = "********"
+			}
+		}
+		var encoded []byte
+		if encoded, err = yaml.Marshal(value); err == nil {
+			_, err = fmt.Fprintf(w, "%s: %s", f.Name, encoded)
+		}
+	})
+	return err
+}
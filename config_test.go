@@ -0,0 +1,254 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOptionValues are where the options of testOptions end up.
+type testOptionValues struct {
+	addr       string
+	rateLimit  rate
+	timeout    time.Duration
+	origins    stringList
+	adminToken string
+	pprof      bool
+}
+
+// testOptions returns a flag set with a few options of each kind.
+func testOptions() (*flag.FlagSet, *testOptionValues) {
+	options := &testOptionValues{addr: ":8080", timeout: 30 * time.Second}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&options.addr, "addr", options.addr, "")
+	fs.Var(&options.rateLimit, "rate-limit", "")
+	fs.DurationVar(&options.timeout, "write-timeout", options.timeout, "")
+	fs.Var(&options.origins, "cors-allowed-origins", "")
+	fs.StringVar(&options.adminToken, "admin-token", "", "")
+	fs.BoolVar(&options.pprof, "enable-pprof", false, "")
+	fs.String("config", "", "")
+	return fs, options
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+addr: ":9000"
+rate-limit: 10/s
+write:
+  timeout: 45s
+cors:
+  allowed-origins: [https://a.example.com, https://b.example.com]
+enable-pprof: true
+`)
+	fs, options := testOptions()
+	if err := fs.Parse([]string{"--rate-limit", "100/s"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"FETCH_RATE_LIMIT": "50/s", "FETCH_WRITE_TIMEOUT": "1m", "FETCH_ADMIN_TOKEN": "s3cret"}
+	if err := applyConfig(fs, path, func(name string) (string, bool) { value, ok := env[name]; return value, ok }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flag wins over the environment and the file, the environment over the file,
+	// and the file over the defaults.
+	if options.rateLimit != (rate{100, time.Second}) {
+		t.Errorf("expected the flag's rate limit but got %v", options.rateLimit.String())
+	}
+	if options.timeout != time.Minute {
+		t.Errorf("expected the environment's write timeout but got %v", options.timeout)
+	}
+	if options.adminToken != "s3cret" {
+		t.Errorf("expected the environment's admin token but got %q", options.adminToken)
+	}
+	if options.addr != ":9000" || !options.pprof {
+		t.Errorf("expected the file's address and pprof but got %q, %v", options.addr, options.pprof)
+	}
+	if strings.Join(options.origins, " ") != "https://a.example.com https://b.example.com" {
+		t.Errorf("expected the file's list of origins but got %v", options.origins)
+	}
+
+	// Without a file, the defaults stay.
+	fs, options = testOptions()
+	if err := applyConfig(fs, "", func(string) (string, bool) { return "", false }); err != nil || options.addr != ":8080" {
+		t.Errorf("expected the default address but got %q, %v", options.addr, err)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	testCases := []struct {
+		name     string
+		contents string
+		env      map[string]string
+		expected string
+	}{
+		{"unknown key", "addr: \":9000\"\nrate-limt: 10/s\n", nil, "config.yaml:2: rate-limt is not an option"},
+		{"unknown nested key", "cors:\n  allowed-origins: [https://a.example.com]\n  allowed-origin: x\n", nil, "config.yaml:3: cors.allowed-origin is not an option"},
+		{"config in the file", "config: other.yaml\n", nil, "config.yaml:1: config is not an option"},
+		{"invalid value", "addr: \":9000\"\nwrite-timeout: soon\n", nil, `config.yaml:2: write-timeout: parse error`},
+		{"no value", "addr:\n", nil, "config.yaml:1: addr has no value"},
+		{"nested value", "addr:\n  port: 9000\n", nil, "config.yaml:1: addr must be a value or a list"},
+		{"not a mapping", "- addr\n", nil, "config.yaml:1: expected a mapping of options"},
+		{"invalid environment", "", map[string]string{"FETCH_RATE_LIMIT": "lots"}, `FETCH_RATE_LIMIT: invalid rate "lots"`},
+	}
+	for _, tc := range testCases {
+		fs, _ := testOptions()
+		lookupEnv := noEnv
+		if tc.env != nil {
+			env := tc.env
+			lookupEnv = func(name string) (string, bool) { value, ok := env[name]; return value, ok }
+		}
+		err := applyConfig(fs, writeConfigFile(t, tc.contents), lookupEnv)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s: expected an error containing %q but got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestWriteEffectiveConfig(t *testing.T) {
+	fs, _ := testOptions()
+	if err := fs.Parse([]string{"--admin-token", "s3cret", "--cors-allowed-origins", "https://a.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := writeEffectiveConfig(&b, fs); err != nil {
+		t.Fatal(err)
+	}
+	expected := `addr: :8080
+admin-token: '********'
+cors-allowed-origins: https://a.example.com
+enable-pprof: "false"
+rate-limit: "0"
+write-timeout: 30s
+`
+	if b.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, b.String())
+	}
+
+	// The output can be loaded back as a config file.
+	fs, options := testOptions()
+	if err := applyConfig(fs, writeConfigFile(t, strings.Replace(b.String(), "'********'", "s3cret", 1)), func(string) (string, bool) { return "", false }); err != nil {
+		t.Fatal(err)
+	}
+	if options.adminToken != "s3cret" || len(options.origins) != 1 {
+		t.Errorf("expected the printed options to load back but got %+v", options)
+	}
+}
+
+// TestEveryOptionHasAnEnvironmentVariable keeps new options settable from the
+// environment: each has its own well-formed FETCH_ variable that sets it.
+func TestEveryOptionHasAnEnvironmentVariable(t *testing.T) {
+	fs := flag.NewFlagSet("fetch-points", flag.ContinueOnError)
+	config := defaultRulesConfig()
+	registerFlags(fs, &config)
+
+	reserved := map[string]bool{"FETCH_CONFIG": true, enabledRulesEnv: true, disabledRulesEnv: true}
+	wellFormed := regexp.MustCompile(`^FETCH_[A-Z0-9]+(_[A-Z0-9]+)*$`)
+	options := make(map[string]string)
+	env := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if isConfigOption(f.Name) {
+			return
+		}
+		name := optionEnv(f.Name)
+		if !wellFormed.MatchString(name) || reserved[name] {
+			t.Errorf("--%s: expected a FETCH_ variable of its own but got %s", f.Name, name)
+		}
+		if other, ok := options[name]; ok {
+			t.Errorf("--%s: expected its own variable but %s also sets --%s", f.Name, name, other)
+		}
+		options[name] = f.Name
+		// The defaults are valid values, so setting them changes nothing.
+		env[name] = f.DefValue
+	})
+
+	if err := applyConfig(fs, "", func(name string) (string, bool) { value, ok := env[name]; return value, ok }); err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, option := range options {
+		if !set[option] {
+			t.Errorf("--%s: expected %s to set it", option, name)
+		}
+	}
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	secretFile := func(contents string) string {
+		path := filepath.Join(t.TempDir(), "admin-token")
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	testCases := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected string
+		err      string
+	}{
+		{"trailing newline", []string{"--admin-token-file", secretFile("s3cret\n")}, nil, "s3cret", ""},
+		{"trailing CRLF", []string{"--admin-token-file", secretFile("s3cret\r\n")}, nil, "s3cret", ""},
+		{"only the last newline", []string{"--admin-token-file", secretFile("s3cret\n\n")}, nil, "s3cret\n", ""},
+		{"from the environment", nil, map[string]string{"FETCH_ADMIN_TOKEN_FILE": secretFile("s3cret")}, "s3cret", ""},
+		{"both given", []string{"--admin-token", "a", "--admin-token-file", secretFile("b")}, nil, "",
+			"--admin-token (FETCH_ADMIN_TOKEN) and --admin-token-file (FETCH_ADMIN_TOKEN_FILE) can't both be set"},
+		{"both from different sources", []string{"--admin-token-file", secretFile("b")}, map[string]string{"FETCH_ADMIN_TOKEN": "a"}, "", "can't both be set"},
+		{"empty file", []string{"--admin-token-file", secretFile("\n")}, nil, "", "is empty"},
+		{"missing file", []string{"--admin-token-file", filepath.Join(t.TempDir(), "missing")}, nil, "", "--admin-token-file: open"},
+	}
+	for _, tc := range testCases {
+		fs, options := testOptions()
+		fs.String("admin-token-file", "", "")
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		env := tc.env
+		if err := applyConfig(fs, "", func(name string) (string, bool) { value, ok := env[name]; return value, ok }); err != nil {
+			t.Fatal(err)
+		}
+		err := readSecretFiles(fs)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected an error containing %q but got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || options.adminToken != tc.expected {
+			t.Errorf("%s: expected admin token %q but got %q, %v", tc.name, tc.expected, options.adminToken, err)
+		}
+	}
+
+	// The file's path is printed as it is, but not the secret read from it.
+	fs, _ := testOptions()
+	fs.String("admin-token-file", "", "")
+	path := secretFile("s3cret")
+	if err := fs.Parse([]string{"--admin-token-file", path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := readSecretFiles(fs); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := writeEffectiveConfig(&b, fs); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "admin-token: '********'") || !strings.Contains(b.String(), "admin-token-file: "+path) {
+		t.Errorf("expected the token masked and its file shown but got\n%s", b.String())
+	}
+}
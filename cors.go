@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsOptions configures handleCORS.
+type corsOptions struct {
+	// allowedOrigins may call the API from a browser, "*" meaning any origin. None
+	// disables CORS.
+	allowedOrigins   stringList
+	allowedMethods   stringList
+	allowedHeaders   stringList
+	maxAge           time.Duration
+	allowCredentials bool
+}
+
+// cors holds the --cors-* flags.
+var cors = corsOptions{
+	allowedMethods: stringList{http.MethodGet, http.MethodPost},
+	allowedHeaders: stringList{"Authorization", "Content-Type", "X-API-Key", "X-Signature", "X-Timestamp", "X-Nonce", "Idempotency-Key"},
+	maxAge:         10 * time.Minute,
+}
+
+// corsExposedHeaders are the response headers scripts of allowed origins may read.
+var corsExposedHeaders = []string{"Idempotent-Replayed", "Location", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-Request-ID"}
+
+// validate checks that each allowed origin is "*" or a bare scheme://host[:port].
+func (o corsOptions) validate() error {
+	for _, origin := range o.allowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil || strings.Contains(u.Host, "*") {
+			return fmt.Errorf("invalid CORS origin %q, expected * or a scheme and host such as https://app.example.com", origin)
+		}
+	}
+	if o.maxAge < 0 {
+		return fmt.Errorf("--cors-max-age %s is negative", o.maxAge)
+	}
+	return nil
+}
+
+// allows reports whether origin is allowed.
+func (o corsOptions) allows(origin string) bool {
+	for _, allowed := range o.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsMethod reports whether a preflight may request method.
+func (o corsOptions) allowsMethod(method string) bool {
+	for _, allowed := range o.allowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether a preflight may request the comma separated headers.
+func (o corsOptions) allowsHeaders(requested string) bool {
+	var headers stringList
+	headers.Set(requested)
+	for _, header := range headers {
+		allowed := false
+		for _, a := range o.allowedHeaders {
+			if strings.EqualFold(a, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// handleCORS lets browser scripts of options.allowedOrigins call the API. It answers
+// preflight requests itself, with a 204 or, for an origin, method or header that isn't
+// allowed, a 403, without running any handler. Other requests from allowed origins
+// get the headers that let scripts read their responses. The origin is echoed rather
+// than "*" when credentials are allowed, as browsers require.
+func handleCORS(options corsOptions) gin.HandlerFunc {
+	maxAge := strconv.Itoa(int(options.maxAge.Seconds()))
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if preflight {
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+		if !options.allows(origin) {
+			if preflight {
+				abortWithProblem(c, http.StatusForbidden, "CORS_ORIGIN_NOT_ALLOWED", "origin "+origin+" is not allowed")
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if options.allowCredentials {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+		} else if options.allows("*") {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			c.Header("Access-Control-Expose-Headers", exposed)
+			c.Next()
+			return
+		}
+
+		method, headers := c.GetHeader("Access-Control-Request-Method"), c.GetHeader("Access-Control-Request-Headers")
+		if !options.allowsMethod(method) || !options.allowsHeaders(headers) {
+			c.Writer.Header().Del("Access-Control-Allow-Origin")
+			c.Writer.Header().Del("Access-Control-Allow-Credentials")
+			abortWithProblem(c, http.StatusForbidden, "CORS_PREFLIGHT_REJECTED",
+				fmt.Sprintf("%s with headers %q is not allowed, expected one of %s with headers among %s", method, headers, options.allowedMethods.String(), options.allowedHeaders.String()))
+			return
+		}
+		c.Header("Access-Control-Allow-Methods", options.allowedMethods.String())
+		if headers != "" {
+			c.Header("Access-Control-Allow-Headers", options.allowedHeaders.String())
+		}
+		c.Header("Access-Control-Max-Age", maxAge)
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
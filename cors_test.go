@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useCORS allows origins with the default --cors-* settings for the rest of the test,
+// returning the options to adjust before building a router.
+func useCORS(t *testing.T, origins ...string) *corsOptions {
+	t.Helper()
+	previous := cors
+	t.Cleanup(func() { cors = previous })
+	cors.allowedOrigins = origins
+	return &cors
+}
+
+// crossOrigin sends a request from origin, a preflight if requestMethod isn't empty.
+func crossOrigin(router *gin.Engine, method, path, origin, requestMethod, requestHeaders string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Origin", origin)
+	if requestMethod != "" {
+		req.Header.Set("Access-Control-Request-Method", requestMethod)
+	}
+	if requestHeaders != "" {
+		req.Header.Set("Access-Control-Request-Headers", requestHeaders)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCORSPreflight(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useCORS(t, "https://app.example.com")
+	router := newRouter()
+	// Preflights carry no credentials, so they are answered before authentication.
+	useAPIKeys(t, []apiKey{{ID: "frontend", Key: "k", Scopes: defaultScopes}})
+
+	rr := crossOrigin(router, http.MethodOptions, "/receipts/process", "https://app.example.com", http.MethodPost, "content-type, x-api-key")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 but got %v: %s", rr.Code, rr.Body.String())
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Authorization, Content-Type, X-API-Key, X-Signature, X-Timestamp, X-Nonce, Idempotency-Key",
+		"Access-Control-Max-Age":           "600",
+		"Access-Control-Allow-Credentials": "",
+	}
+	for header, value := range expected {
+		if got := rr.Header().Get(header); got != value {
+			t.Errorf("expected %s %q but got %q", header, value, got)
+		}
+	}
+	if len(receipts) != 0 {
+		t.Errorf("expected the preflight not to reach the handler but %d receipts were stored", len(receipts))
+	}
+
+	testCases := []struct {
+		name, origin, method, headers, code string
+	}{
+		{"method", "https://app.example.com", http.MethodDelete, "", "CORS_PREFLIGHT_REJECTED"},
+		{"header", "https://app.example.com", http.MethodPost, "Content-Type, X-Debug", "CORS_PREFLIGHT_REJECTED"},
+		{"origin", "https://evil.example.com", http.MethodPost, "Content-Type", "CORS_ORIGIN_NOT_ALLOWED"},
+		{"lookalike origin", "https://app.example.com.evil.example", http.MethodPost, "", "CORS_ORIGIN_NOT_ALLOWED"},
+	}
+	for _, tc := range testCases {
+		rr := crossOrigin(router, http.MethodOptions, "/receipts/process", tc.origin, tc.method, tc.headers)
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), tc.code) {
+			t.Errorf("%s: expected 403 %s but got %v: %s", tc.name, tc.code, rr.Code, rr.Body.String())
+		}
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s: expected no Access-Control-Allow-Origin but got %q", tc.name, got)
+		}
+	}
+}
+
+func TestCORSRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useCORS(t, "https://app.example.com")
+	router := newRouter()
+
+	rr := crossOrigin(router, http.MethodGet, "/rules", "https://app.example.com", "", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("expected an allowed origin to be echoed but got %v with %q", rr.Code, rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if exposed := rr.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "Location") || !strings.Contains(exposed, "X-RateLimit-Remaining") {
+		t.Errorf("expected Location and the rate limit headers to be exposed but got %q", exposed)
+	}
+	if vary := rr.Header().Values("Vary"); !containsString(vary, "Origin") {
+		t.Errorf("expected responses to vary by Origin but got %q", vary)
+	}
+
+	// Other origins are served, but without headers letting their scripts read the
+	// response.
+	rr = crossOrigin(router, http.MethodGet, "/rules", "https://evil.example.com", "", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers for another origin but got %v with %q", rr.Code, rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+
+	testCases := []struct {
+		name              string
+		credentials       bool
+		origin, expected  string
+		expectCredentials string
+	}{
+		{"any origin", false, "https://app.example.com", "*", ""},
+		// Browsers reject "*" with credentials, so the origin is echoed.
+		{"any origin with credentials", true, "https://app.example.com", "https://app.example.com", "true"},
+	}
+	for _, tc := range testCases {
+		useCORS(t, "*").allowCredentials = tc.credentials
+		router := newRouter()
+		for _, rr := range []*httptest.ResponseRecorder{
+			crossOrigin(router, http.MethodOptions, "/rules", tc.origin, http.MethodGet, ""),
+			crossOrigin(router, http.MethodGet, "/rules", tc.origin, "", ""),
+		} {
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tc.expected {
+				t.Errorf("%s: expected Access-Control-Allow-Origin %q but got %q", tc.name, tc.expected, got)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Credentials"); got != tc.expectCredentials {
+				t.Errorf("%s: expected Access-Control-Allow-Credentials %q but got %q", tc.name, tc.expectCredentials, got)
+			}
+		}
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	rr := crossOrigin(router, http.MethodGet, "/rules", "https://app.example.com", "", "")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" || containsString(rr.Header().Values("Vary"), "Origin") {
+		t.Errorf("expected no CORS headers but got %v", rr.Header())
+	}
+	if rr := crossOrigin(router, http.MethodOptions, "/receipts/process", "https://app.example.com", http.MethodPost, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected preflights to go unanswered but got %v", rr.Code)
+	}
+}
+
+func TestCORSValidate(t *testing.T) {
+	valid := []corsOptions{
+		{allowedOrigins: stringList{"*"}},
+		{allowedOrigins: stringList{"https://app.example.com", "http://localhost:3000"}},
+	}
+	for _, options := range valid {
+		if err := options.validate(); err != nil {
+			t.Errorf("expected %q to be accepted but got %v", options.allowedOrigins, err)
+		}
+	}
+	invalid := []corsOptions{
+		{allowedOrigins: stringList{"app.example.com"}},
+		{allowedOrigins: stringList{"https://app.example.com/"}},
+		{allowedOrigins: stringList{"https://app.example.com/path"}},
+		{allowedOrigins: stringList{"ftp://app.example.com"}},
+		{allowedOrigins: stringList{"https://*.example.com"}},
+		{allowedOrigins: stringList{"*"}, maxAge: -time.Second},
+	}
+	for _, options := range invalid {
+		if err := options.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", options)
+		}
+	}
+}
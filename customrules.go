@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"regexp"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// CustomRule is a rule defined in the rules config as CEL expressions over the
+// receipt, see customRuleEnv for the variables they can use. It awards Points, or the value
+// of PointsExpression, when Expression is true. Expression may be omitted to always
+// award PointsExpression. Negative Points deduct points and must be marked as a
+// Penalty, so a stray minus sign can't go unnoticed.
+type CustomRule struct {
+	Name             string `json:"name" yaml:"name"`
+	Expression       string `json:"expression,omitempty" yaml:"expression"`
+	Points           int    `json:"points,omitempty" yaml:"points"`
+	PointsExpression string `json:"pointsExpression,omitempty" yaml:"pointsExpression"`
+	Penalty          bool   `json:"penalty,omitempty" yaml:"penalty"`
+}
+
+// customRuleItem is an element of items in custom rule expressions, which name its
+// fields as the JSON of a trace does.
+type customRuleItem struct {
+	Description string `json:"description"`
+	PriceCents  int64  `json:"priceCents"`
+	Quantity    int64  `json:"quantity"`
+}
+
+// customRuleItems declares customRuleItem as customRuleItemType, which ext.NativeTypes
+// names after the package: main.customRuleItem, or receipt_api.customRuleItem in tests.
+var (
+	customRuleItems    = ext.NativeTypes(reflect.TypeOf(customRuleItem{}), ext.ParseStructTag("json"))
+	customRuleItemType = cel.ObjectType(path.Base(reflect.TypeOf(customRuleItem{}).PkgPath()) + ".customRuleItem")
+)
+
+// customRuleEnv declares the variables available to custom rule expressions:
+//
+//	retailer      string      the retailer name
+//	totalCents    int         the total in cents
+//	items         list(item)  the items as scored, each with description (string),
+//	                          priceCents (int) and quantity (int)
+//	purchaseDate  string      the date as sent, "YYYY-MM-DD"
+//	purchaseTime  string      the time as sent, "HH:MM"
+//	dayOfWeek     int         0 for Sunday through 6 for Saturday, -1 if the date is invalid
+var customRuleEnv = mustExprEnv(
+	customRuleItems,
+	cel.Variable("retailer", cel.StringType),
+	cel.Variable("totalCents", cel.IntType),
+	cel.Variable("items", cel.ListType(customRuleItemType)),
+	cel.Variable("purchaseDate", cel.StringType),
+	cel.Variable("purchaseTime", cel.StringType),
+	cel.Variable("dayOfWeek", cel.IntType),
+)
+
+// defaultCustomRuleCostLimit bounds the work one custom rule may do per receipt.
+const defaultCustomRuleCostLimit = 10000
+
+var customRuleName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// customRule is a compiled CustomRule.
+type customRule struct {
+	definition CustomRule
+	condition  *compiledExpr
+	points     *compiledExpr
+}
+
+// compileCustomRule checks and compiles a custom rule definition. On error it also
+// returns the name of the offending field of the definition.
+func compileCustomRule(definition CustomRule, costLimit int) (*customRule, string, error) {
+	rule := &customRule{definition: definition}
+	if !customRuleName.MatchString(definition.Name) {
+		return nil, "name", fmt.Errorf("%q must be lowercase letters, digits and underscores, starting with a letter", definition.Name)
+	}
+	if definition.Expression == "" && definition.PointsExpression == "" {
+		return nil, "expression", fmt.Errorf("is required unless pointsExpression is set")
+	}
+	if definition.Points != 0 && definition.PointsExpression != "" {
+		return nil, "pointsExpression", fmt.Errorf("cannot be combined with points")
+	}
+	if definition.Points < 0 && !definition.Penalty {
+		return nil, "points", fmt.Errorf("%d is negative, set penalty to deduct points", definition.Points)
+	}
+
+	if definition.Expression != "" {
+		condition, err := compileExpr(customRuleEnv, definition.Expression, costLimit)
+		if err != nil {
+			return nil, "expression", err
+		}
+		if !condition.typ.IsExactType(cel.BoolType) {
+			return nil, "expression", fmt.Errorf("must be a bool expression, found %s", condition.typ)
+		}
+		rule.condition = condition
+	}
+	if definition.PointsExpression != "" {
+		points, err := compileExpr(customRuleEnv, definition.PointsExpression, costLimit)
+		if err != nil {
+			return nil, "pointsExpression", err
+		}
+		if !points.typ.IsExactType(cel.IntType) {
+			return nil, "pointsExpression", fmt.Errorf("must be an int expression, found %s", points.typ)
+		}
+		rule.points = points
+	}
+	return rule, "", nil
+}
+
+// customRules compiles the custom rules of config, which must have been validated.
+func customRules(config RulesConfig) []Rule {
+	var rules []Rule
+	for _, definition := range config.CustomRules {
+		if rule, _, err := compileCustomRule(definition, config.customRuleCostLimit()); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (r *customRule) Name() string { return r.definition.Name }
+
+func (r *customRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	vars := customRuleVars(receipt)
+	tr := receipt.trace
+	if tr != nil {
+		for _, name := range []string{"retailer", "totalCents", "purchaseDate", "purchaseTime", "dayOfWeek", "items"} {
+			tr.input(name, vars[name])
+		}
+	}
+	if r.condition != nil {
+		value, err := r.condition.evaluate(vars)
+		if err != nil {
+			return 0, fmt.Sprintf("%s: evaluation failed: %v", r.definition.Expression, err)
+		}
+		matched := value.Value().(bool)
+		if tr != nil {
+			tr.step(r.definition.Expression, matched)
+		}
+		if !matched {
+			return 0, fmt.Sprintf("%s is false", r.definition.Expression)
+		}
+	}
+
+	if r.points == nil {
+		return r.definition.Points, fmt.Sprintf("%s is true", r.definition.Expression)
+	}
+	value, err := r.points.evaluate(vars)
+	if err != nil {
+		return 0, fmt.Sprintf("%s: evaluation failed: %v", r.definition.PointsExpression, err)
+	}
+	points := value.Value().(int64)
+	if tr != nil {
+		tr.step(r.definition.PointsExpression, points)
+	}
+	if points > math.MaxInt32 || points < math.MinInt32 {
+		return 0, fmt.Sprintf("%s = %d is out of range", r.definition.PointsExpression, points)
+	}
+	if r.condition == nil {
+		return int(points), fmt.Sprintf("%s = %d", r.definition.PointsExpression, points)
+	}
+	return int(points), fmt.Sprintf("%s is true: %s = %d", r.definition.Expression, r.definition.PointsExpression, points)
+}
+
+// customRuleVars returns the values of the variables of customRuleEnv for a receipt.
+func customRuleVars(receipt ParsedReceipt) map[string]interface{} {
+	items := make([]customRuleItem, len(receipt.Items))
+	for i, item := range receipt.Items {
+		items[i] = customRuleItem{
+			Description: item.Description,
+			PriceCents:  int64(math.Round(item.Price * 100)),
+			Quantity:    int64(item.Quantity),
+		}
+	}
+
+	dayOfWeek := int64(-1)
+	if receipt.WeekdayOK {
+		dayOfWeek = int64(receipt.Weekday)
+	}
+
+	return map[string]interface{}{
+		"retailer":     receipt.Retailer,
+		"totalCents":   receipt.TotalCents,
+		"items":        items,
+		"purchaseDate": receipt.PurchaseDate,
+		"purchaseTime": receipt.PurchaseTime,
+		"dayOfWeek":    dayOfWeek,
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const customRulesConfig = `
+customRules:
+  - name: big_basket
+    expression: size(items) > 4 && totalCents > 2000
+    points: 15
+  - name: weekend
+    expression: dayOfWeek == 0 || dayOfWeek == 6
+    points: 5
+  - name: cheese_lover
+    pointsExpression: items.filter(i, i.description.contains("Cheese")).size() * 3
+  - name: lunch_hour
+    expression: purchaseTime >= "12:00" && purchaseTime < "14:00"
+    pointsExpression: 'items.exists(i, i.priceCents >= 1000) ? 8 : 4'
+  - name: warehouse_club
+    expression: retailer in ["Costco", "Sam's Club"]
+    points: 100
+`
+
+func TestCustomRules(t *testing.T) {
+	config, err := loadRulesConfig(writeConfig(t, "rules.yaml", customRulesConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Target example scores 28 with the standard rules. It has 5 items totalling
+	// 35.35, was bought on a Saturday at 13:01 and has two items with "Cheese" in them.
+	points, breakdown := scoreReceipt(exampleReceipts["target"], config)
+	if points != 28+15+5+6+8 {
+		t.Errorf("expected %v points but got %v", 28+15+5+6+8, points)
+	}
+
+	expected := []BreakdownEntry{
+		{Rule: "big_basket", Points: 15, Detail: "size(items) > 4 && totalCents > 2000 is true"},
+		{Rule: "weekend", Points: 5, Detail: "dayOfWeek == 0 || dayOfWeek == 6 is true"},
+		{Rule: "cheese_lover", Points: 6, Detail: `items.filter(i, i.description.contains("Cheese")).size() * 3 = 6`},
+		{Rule: "lunch_hour", Points: 8, Detail: `purchaseTime >= "12:00" && purchaseTime < "14:00" is true: items.exists(i, i.priceCents >= 1000) ? 8 : 4 = 8`},
+		{Rule: "warehouse_club", Points: 0, Detail: `retailer in ["Costco", "Sam's Club"] is false`},
+	}
+	if len(breakdown) != 17 || !reflect.DeepEqual(breakdown[12:], expected) {
+		t.Errorf("expected the custom rules after the standard ones with %+v but got %+v", expected, breakdown)
+	}
+
+	config.DisabledRules = []string{"big_basket"}
+	if points, _ := scoreReceipt(exampleReceipts["target"], config); points != 28+5+6+8 {
+		t.Errorf("expected disabling big_basket to remove its 15 points but got %v", points)
+	}
+}
+
+func TestCustomRuleEvaluationErrors(t *testing.T) {
+	config := defaultRulesConfig()
+	config.CustomRules = []CustomRule{
+		{Name: "first_item", Expression: "items[0].priceCents > 500", Points: 5},
+		{Name: "expensive", Expression: "items.all(a, items.all(b, a.quantity == b.quantity))", Points: 5},
+	}
+	config.CustomRuleCostLimit = 20
+
+	// With five items the nested loops go over the limit and award nothing, and the
+	// standard rules are unaffected: 1 + 50 + 25 + 10 + 6 points, plus 5 for first_item.
+	points, breakdown := scoreReceipt(Receipt{Retailer: "A", Total: "1.00", Items: exampleReceipts["target"].Items}, config)
+	if points != 92+5 {
+		t.Errorf("expected %v points but got %v", 92+5, points)
+	}
+	if breakdown[13].Points != 0 || breakdown[13].Detail != "items.all(a, items.all(b, a.quantity == b.quantity)): evaluation failed: cost limit exceeded" {
+		t.Errorf("expected the cost limit to stop expensive but got %+v", breakdown[13])
+	}
+
+	// Without items the index fails.
+	_, breakdown = scoreReceipt(Receipt{Retailer: "A", Total: "1.00"}, config)
+	if breakdown[12].Points != 0 || breakdown[12].Detail != "items[0].priceCents > 500: evaluation failed: index out of bounds: 0" {
+		t.Errorf("expected first_item to fail on an empty receipt but got %+v", breakdown[12])
+	}
+}
+
+func TestCustomRuleConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			name:     "IllTyped",
+			contents: "customRules:\n  - name: big_total\n    points: 5\n    expression: totalCents > 20.00\n",
+			expected: "rules.yaml:4: customRules[0].expression is invalid: 1:12: found no matching overload for '_>_' applied to '(int, double)'",
+		},
+		{
+			name:     "NotBool",
+			contents: "customRules:\n  - name: ok\n    expression: totalCents > 2000\n    points: 1\n  - name: count\n    expression: size(items)\n",
+			expected: "rules.yaml:6: customRules[1].expression must be a bool expression, found int",
+		},
+		{
+			name:     "PointsNotInt",
+			contents: "customRules:\n  - name: half\n    pointsExpression: double(totalCents) / 200.0\n",
+			expected: "rules.yaml:3: customRules[0].pointsExpression must be an int expression, found double",
+		},
+		{
+			name:     "UnknownVariable",
+			contents: "customRules:\n  - name: big_total\n    expression: total > 20\n    points: 5\n",
+			expected: "rules.yaml:3: customRules[0].expression is invalid: 1:1: undeclared reference to 'total' (in container '')",
+		},
+		{
+			name:     "Syntax",
+			contents: "customRules:\n  - name: big_total\n    expression: totalCents >\n    points: 5\n",
+			expected: "rules.yaml:3: customRules[0].expression is invalid: 1:13: Syntax error: mismatched input '<EOF>' expecting {'[', '{', '(', '.', '-', '!', 'true', 'false', 'null', NUM_FLOAT, NUM_INT, NUM_UINT, STRING, BYTES, IDENTIFIER}",
+		},
+		{
+			name:     "MissingExpression",
+			contents: "customRules:\n  - name: nothing\n    points: 5\n",
+			expected: "rules.yaml:2: customRules[0].expression is required unless pointsExpression is set",
+		},
+		{
+			name:     "BothPoints",
+			contents: "customRules:\n  - name: both\n    points: 5\n    pointsExpression: size(items)\n",
+			expected: "rules.yaml:4: customRules[0].pointsExpression cannot be combined with points",
+		},
+		{
+			name:     "NegativePoints",
+			contents: "customRules:\n  - name: returns\n    expression: totalCents > 5000\n    points: -5\n",
+			expected: "rules.yaml:4: customRules[0].points -5 is negative, set penalty to deduct points",
+		},
+		{
+			name:     "BadName",
+			contents: "customRules:\n  - name: Big Basket\n    expression: size(items) > 4\n",
+			expected: `rules.yaml:2: customRules[0].name "Big Basket" must be lowercase letters, digits and underscores, starting with a letter`,
+		},
+		{
+			name:     "StandardName",
+			contents: "customRules:\n  - name: odd_day\n    expression: dayOfWeek == 5\n",
+			expected: `rules.yaml:2: customRules[0].name "odd_day" is already the name of a rule`,
+		},
+		{
+			name:     "DuplicateName",
+			contents: "customRules:\n  - name: weekend\n    expression: dayOfWeek == 0\n  - name: weekend\n    expression: dayOfWeek == 6\n",
+			expected: `rules.yaml:4: customRules[1].name "weekend" is already the name of a rule`,
+		},
+		{
+			name:     "NegativeCostLimit",
+			contents: "customRuleCostLimit: -1\n",
+			expected: "rules.yaml:1: customRuleCostLimit must not be negative",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "rules.yaml", tc.contents)
+			_, err := loadRulesConfig(path)
+			if err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+			if got := strings.TrimPrefix(err.Error(), filepath.Dir(path)+string(filepath.Separator)); got != tc.expected {
+				t.Errorf("expected error %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCustomRulesEnabledByName(t *testing.T) {
+	config, err := loadRulesConfig(writeConfig(t, "rules.yaml", customRulesConfig+"enabledRules: [weekend, retailer_name]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points, _ := scoreReceipt(exampleReceipts["target"], config); points != 6+5 {
+		t.Errorf("expected only retailer_name and weekend to score but got %v points", points)
+	}
+}
+
+func TestGetRulesShowsCustomRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer setRules(currentEngine().config)
+	config, err := loadRulesConfig(writeConfig(t, "rules.yaml", customRulesConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRules(config)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/rules", nil))
+	var body struct {
+		Rules []struct {
+			Name   string      `json:"name"`
+			Custom *CustomRule `json:"custom"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Rules) != 17 || body.Rules[0].Custom != nil {
+		t.Fatalf("expected 12 standard and 5 custom rules but got %+v", body.Rules)
+	}
+	if custom := body.Rules[12].Custom; custom == nil || *custom != config.CustomRules[0] {
+		t.Errorf("expected big_basket's definition but got %+v", custom)
+	}
+}
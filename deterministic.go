@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The options of --deterministic, which runs the service as a reproducible fake for
+// the test suites of clients: the same requests, in the same order, after the same
+// seeds get the same responses byte for byte.
+var (
+	deterministic     bool
+	deterministicIDs  = "sequential"
+	deterministicTime = "2024-01-01T00:00:00Z"
+	recordDir         string
+)
+
+// deterministicOverrides are the options --deterministic turns off, so the fake
+// needs no credentials and never rate limits: authentication, signatures, the admin
+// token and networks, /metrics credentials and the client IP rate limit.
+var deterministicOverrides = []string{
+	"api-keys-file", "signing-secrets-file", "jwks-url", "introspection-url",
+	"admin-token", "admin-allowed-cidrs", "metrics-username", "metrics-htpasswd", "rate-limit",
+}
+
+// validateDeterministic checks the options of --deterministic.
+func validateDeterministic() []error {
+	var problems []error
+	if deterministicIDs != "sequential" && deterministicIDs != "content" {
+		problems = append(problems, fmt.Errorf("--deterministic-ids %q is not sequential or content", deterministicIDs))
+	}
+	if _, err := time.Parse(time.RFC3339, deterministicTime); err != nil {
+		problems = append(problems, fmt.Errorf("--deterministic-time %q is not an RFC 3339 time such as 2024-01-01T00:00:00Z", deterministicTime))
+	}
+	if recordDir != "" && !deterministic {
+		problems = append(problems, errors.New("--record-dir requires --deterministic"))
+	}
+	return problems
+}
+
+// applyDeterministicMode, with --deterministic, pins clock to --deterministic-time,
+// hands out IDs by --deterministic-ids, turns off the deterministicOverrides, saying
+// so for those that were set, and starts recording exchanges in --record-dir. It is
+// called before the options it turns off are acted on.
+func applyDeterministicMode(fs *flag.FlagSet) error {
+	if !deterministic {
+		return nil
+	}
+	for _, name := range deterministicOverrides {
+		if f := fs.Lookup(name); f != nil && f.Value.String() != f.DefValue {
+			log.Printf("--deterministic ignores --%s", name)
+		}
+	}
+	apiKeysFilePath, signingSecretsFilePath, jwksURL, introspectionURL, adminToken = "", "", "", "", ""
+	metricsUsername, metricsPassword, metricsHtpasswdPath = "", "", ""
+	adminAllowedNets = nil
+	ipRate, ipBurst = rate{}, 0
+
+	now, err := time.Parse(time.RFC3339, deterministicTime)
+	if err != nil {
+		return err
+	}
+	clock = fixedClock{now}
+	if deterministicIDs == "content" {
+		ids = &contentIDs{}
+	} else {
+		ids = &sequentialIDs{}
+	}
+	if recordDir != "" {
+		if err := os.MkdirAll(recordDir, 0o755); err != nil {
+			return fmt.Errorf("--record-dir: %w", err)
+		}
+		exchanges = &exchangeRecorder{dir: recordDir}
+	}
+	log.Printf("deterministic mode: the time is %s and IDs are %s", now.Format(time.RFC3339), deterministicIDs)
+	return nil
+}
+
+// exchanges records every request and its response with --record-dir, nil without.
+var exchanges *exchangeRecorder
+
+// exchangeRecorder writes each request and its response to a file of dir, numbered
+// in the order the requests arrived: 000001.json, 000002.json and so on.
+type exchangeRecorder struct {
+	dir  string
+	next atomic.Uint64
+}
+
+// recordedExchange is the JSON of a file written by exchangeRecorder.
+type recordedExchange struct {
+	Request  recordedMessage `json:"request"`
+	Response recordedMessage `json:"response"`
+}
+
+// recordedMessage is a request, with its method and path, or a response, with its
+// status. A body that isn't UTF-8, such as a gzipped one, is base64 encoded.
+type recordedMessage struct {
+	Method       string      `json:"method,omitempty"`
+	Path         string      `json:"path,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	Header       http.Header `json:"header"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+// setBody sets the body of m, base64 encoded if it isn't UTF-8.
+func (m *recordedMessage) setBody(body []byte) {
+	m.Body, m.BodyEncoding = string(body), ""
+	if !utf8.Valid(body) {
+		m.Body, m.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+}
+
+// unrecordedRoutes are the streams, which stay open for as long as the client
+// listens, so their exchanges have no end to record.
+var unrecordedRoutes = map[string]bool{"/receipts/stream": true, "/ws": true}
+
+// recordedBody is a request body that keeps a copy of what is read of it. The body
+// is read by the endpoint, through its size limit, so no more of it is kept than the
+// endpoint accepts.
+type recordedBody struct {
+	io.Reader
+	io.Closer
+	read bytes.Buffer
+}
+
+func newRecordedBody(body io.ReadCloser) *recordedBody {
+	b := &recordedBody{Closer: body}
+	b.Reader = io.TeeReader(body, &b.read)
+	return b
+}
+
+// record records the exchange of each request but those of unrecordedRoutes: the
+// request with as much of its body as the endpoint read, and the response as it was
+// sent. A failure to write one is logged and the request unaffected.
+func (r *exchangeRecorder) record() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if unrecordedRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		n := r.next.Add(1)
+		request := recordedMessage{Method: c.Request.Method, Path: c.Request.URL.RequestURI(), Header: c.Request.Header.Clone()}
+		body := newRecordedBody(c.Request.Body)
+		c.Request.Body = body
+		recorder := &recordingResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		request.setBody(body.read.Bytes())
+		response := recordedMessage{Status: recorder.Status(), Header: recorder.Header().Clone()}
+		response.setBody(recorder.body.Bytes())
+		data, err := json.MarshalIndent(recordedExchange{Request: request, Response: response}, "", "  ")
+		if err == nil {
+			err = os.WriteFile(filepath.Join(r.dir, fmt.Sprintf("%06d.json", n)), append(data, '\n'), 0o644)
+		}
+		if err != nil {
+			log.Printf("recording exchange %d: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startDeterministic starts the service as main does with args, which include
+// --deterministic, and serves it on a local port for the rest of the test.
+func startDeterministic(t *testing.T, args ...string) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	previousClock, previousIDs, previousExchanges := clock, ids, exchanges
+	t.Cleanup(func() { clock, ids, exchanges = previousClock, previousIDs, previousExchanges })
+	useAPIKeys(t, nil)
+	useIdempotencyKeys(t)
+
+	fs := resettableOptions(t)(args...)
+	if err := validateOptions(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDeterministicMode(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadAPIKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if ipRate.count > 0 {
+		t.Fatalf("expected --deterministic to turn off --rate-limit")
+	}
+	receipts = make(ReceiptsMap)
+	if err := seedReceipts(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return serveAPI(t, newRouter())
+}
+
+// deterministicSession makes the same requests of the service at url every time and
+// returns what came back: the status, headers and body of each response.
+func deterministicSession(t *testing.T, url string) string {
+	t.Helper()
+	var out strings.Builder
+	send := func(method, path, body string, header ...string) {
+		t.Helper()
+		req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Links are built from the Host, which would otherwise name the port.
+		req.Host = "fetch.test"
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&out, "%s %s: %d %s %s\n%s\n", method, path, resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("X-Request-ID"), data)
+	}
+
+	send(http.MethodPost, "/receipts/process", validReceiptPayload)
+	for i := 0; i < 5; i++ {
+		send(http.MethodPost, "/receipts/process", strings.Replace(validReceiptPayload, `"Target"`, fmt.Sprintf(`"Store %d"`, i), 1))
+	}
+	send(http.MethodPost, "/receipts/process", validReceiptPayload, "Idempotency-Key", "order-1")
+	send(http.MethodPost, "/receipts/process", validReceiptPayload, "Idempotency-Key", "order-1")
+	send(http.MethodPost, "/receipts/process", `{"retailer":"Target"}`)
+	send(http.MethodGet, "/receipts/"+seededTargetID+"/points", "")
+	send(http.MethodGet, "/receipts/no-such-receipt/points", "")
+	send(http.MethodGet, "/admin/receipts/export", "")
+	return out.String()
+}
+
+func TestDeterministicMode(t *testing.T) {
+	// The options a deployment might carry over turn nothing on: no key is needed
+	// and the rate limit of 1 request a minute isn't enforced.
+	keys := writeConfig(t, "keys.txt", "ops-key\n")
+	run := func() (string, string) {
+		dir := filepath.Join(t.TempDir(), "exchanges")
+		url := startDeterministic(t, "--deterministic", "--deterministic-time", "2022-03-01T12:00:00Z",
+			"--seed", "examples", "--record-dir", dir, "--api-keys-file", keys, "--rate-limit", "1/m")
+		return deterministicSession(t, url), dir
+	}
+	first, firstDir := run()
+	second, secondDir := run()
+
+	if first != second {
+		t.Errorf("expected the same responses from both runs but got\n%s\nand\n%s", first, second)
+	}
+	if !strings.Contains(first, `"id":"00000001-0000-4000-8000-000000000001"`) {
+		t.Errorf("expected the first receipt to get the first sequential ID but got\n%s", first)
+	}
+	for _, unexpected := range []string{"API_KEY_REQUIRED", "RATE_LIMITED", ": 429 ", ": 401 "} {
+		if strings.Contains(first, unexpected) {
+			t.Errorf("expected no authentication or rate limiting but got %s in\n%s", unexpected, first)
+		}
+	}
+	if !strings.Contains(first, "2022-03-01T12:00:00Z") {
+		t.Errorf("expected the export to show the pinned time but got\n%s", first)
+	}
+
+	files, err := filepath.Glob(filepath.Join(firstDir, "*.json"))
+	if err != nil || len(files) != 12 {
+		t.Fatalf("expected an exchange recorded for each of 12 requests but got %d, %v", len(files), err)
+	}
+	for _, file := range files {
+		expected, _ := os.ReadFile(file)
+		got, err := os.ReadFile(filepath.Join(secondDir, filepath.Base(file)))
+		if err != nil || string(got) != string(expected) {
+			t.Errorf("expected %s to be recorded the same by both runs but got\n%s\nand\n%s", filepath.Base(file), expected, got)
+		}
+	}
+}
+
+func TestDeterministicContentIDs(t *testing.T) {
+	url := startDeterministic(t, "--deterministic", "--deterministic-ids", "content")
+	resp, err := http.Post(url+"/receipts/process", "application/json", strings.NewReader(validReceiptPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	// The receipt gets the ID it is seeded under by --seed examples.
+	if !strings.Contains(string(body), `"id":"`+seededTargetID+`"`) {
+		t.Errorf("expected the ID %s but got %s", seededTargetID, body)
+	}
+}
+
+func TestRecordedExchangesAreBounded(t *testing.T) {
+	dir := t.TempDir()
+	url := startDeterministic(t, "--deterministic", "--record-dir", dir, "--max-body-bytes", "1KiB")
+	exchange := func(name string) recordedExchange {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exchange recordedExchange
+		if err := json.Unmarshal(data, &exchange); err != nil {
+			t.Fatal(err)
+		}
+		return exchange
+	}
+
+	// Only as much of an oversized body as the endpoint reads is kept.
+	oversized := `{"retailer": "` + strings.Repeat("x", 64<<10) + `"}`
+	resp, err := http.Post(url+"/receipts/process", "application/json", strings.NewReader(oversized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if recorded := exchange("000001.json"); recorded.Response.Status != http.StatusRequestEntityTooLarge || len(recorded.Request.Body) > 2<<10 {
+		t.Errorf("expected a 413 with at most the first KiB of the body recorded but got %d with %d bytes", recorded.Response.Status, len(recorded.Request.Body))
+	}
+
+	// A stream isn't recorded, so the next request is the second exchange.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/receipts/stream", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	resp.Body.Close()
+	resp, err = http.Get(url + "/receipts/" + seededTargetID + "/points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if recorded := exchange("000002.json"); recorded.Request.Path != "/receipts/"+seededTargetID+"/points" {
+		t.Errorf("expected the stream to be skipped but exchange 2 is %s %s", recorded.Request.Method, recorded.Request.Path)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// Embed the time zone database so receipt and rule time zones resolve in images
+	// without one.
+	_ "time/tzdata"
+)
+
+// ParsedReceipt is a receipt with its fields parsed into the form the rules work with.
+// Fields that failed to parse are left at their zero value with the matching ok flag
+// unset, so a rule can decide what a missing value is worth.
+type ParsedReceipt struct {
+	Retailer string
+
+	Total      string
+	TotalValue float64
+	TotalOK    bool
+	TotalCents int64
+
+	// Items are the logical items, see logicalItems. LineCount is the number of lines
+	// on the receipt before any consolidation.
+	Items     []logicalItem
+	LineCount int
+
+	PurchaseDate string
+	Day          int
+	DayOK        bool
+	Weekday      time.Weekday
+	WeekdayOK    bool
+
+	// PurchaseMinutes is the purchase time of day in minutes after midnight.
+	PurchaseTime    string
+	PurchaseMinutes int
+	TimeOK          bool
+
+	// PurchasedAt is the purchase date and time together, set if both parsed. It is the
+	// wall clock time in Location, the receipt's time zone, which is nil if the receipt
+	// doesn't give one.
+	PurchasedAt   time.Time
+	PurchasedAtOK bool
+	Location      *time.Location
+
+	// ProcessedAt is when the service processed the receipt, zero if unknown.
+	ProcessedAt time.Time
+	// Tier is the loyalty tier the receipt was processed in, if any.
+	Tier string
+
+	// trace is set while the engine is tracing, see ruleTracer.
+	trace *ruleTracer
+}
+
+// parseReceipt prepares a receipt for scoring under config.
+func parseReceipt(receipt Receipt, config RulesConfig) ParsedReceipt {
+	parsed := ParsedReceipt{
+		Retailer:     receipt.Retailer,
+		Total:        receipt.Total,
+		Items:        logicalItems(receipt.Items, config),
+		LineCount:    len(receipt.Items),
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		ProcessedAt:  receipt.ProcessedAt,
+		Tier:         receipt.Tier,
+	}
+
+	total, err := strconv.ParseFloat(receipt.Total, 64)
+	parsed.TotalValue, parsed.TotalOK = total, err == nil
+	parsed.TotalCents, _ = amountCents(receipt.Total)
+
+	if parts := strings.Split(receipt.PurchaseDate, "-"); len(parts) == 3 {
+		day, err := strconv.Atoi(parts[2])
+		parsed.Day, parsed.DayOK = day, err == nil
+	}
+
+	minutes, err := parseClock(receipt.PurchaseTime)
+	parsed.PurchaseMinutes, parsed.TimeOK = minutes, err == nil
+
+	if date, err := time.Parse("2006-01-02", receipt.PurchaseDate); err == nil {
+		parsed.Weekday, parsed.WeekdayOK = date.Weekday(), true
+		if parsed.TimeOK {
+			parsed.PurchasedAt = date.Add(time.Duration(minutes) * time.Minute)
+			parsed.PurchasedAtOK = true
+		}
+	}
+	if receipt.Timezone != "" {
+		parsed.Location, _ = time.LoadLocation(receipt.Timezone)
+	}
+
+	return parsed
+}
+
+// Rule is one independently evaluated scoring rule.
+type Rule interface {
+	// Name is the rule's stable identifier, as shown in the breakdown.
+	Name() string
+	// Evaluate returns the points the rule awards and a human-readable explanation.
+	Evaluate(receipt ParsedReceipt) (points int, detail string)
+}
+
+// Engine scores receipts with an ordered list of rules. An engine is never modified
+// once built; reloading the rules builds a new one, see setRules.
+type Engine struct {
+	config RulesConfig
+	rules  []Rule
+	// overrides score receipts from the retailers they match instead, see
+	// RetailerOverride.
+	overrides []*retailerOverride
+	// promotions multiply the total, see Promotion.
+	promotions []activePromotion
+
+	// hash identifies config, so operators can tell which rules are in effect.
+	hash     string
+	loadedAt time.Time
+}
+
+// newEngine returns an engine running the standard rules and then the custom rules of
+// config, which must have been validated.
+func newEngine(config RulesConfig) *Engine {
+	return &Engine{
+		config:     config,
+		rules:      append(standardRules(config), customRules(config)...),
+		overrides:  retailerOverrides(config),
+		promotions: promotions(config),
+		hash:       configHash(config),
+		loadedAt:   clock.Now(),
+	}
+}
+
+// configHash returns the hex SHA-256 of the JSON encoding of config in canonical form,
+// see canonicalConfig, and of the SKU bonus file it loaded, if any. Equivalent
+// configs hash the same however they were written, so the hash doubles as the
+// version of the rules that scored a receipt.
+func configHash(config RulesConfig) string {
+	data, _ := json.Marshal(canonicalConfig(config))
+	hash := sha256.New()
+	hash.Write(data)
+	if config.skuBonuses != nil {
+		hash.Write([]byte(config.skuBonuses.digest))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// canonicalConfig returns config with its unordered lists sorted and day names in one
+// case. Lists whose order matters, such as custom rules and retailer overrides, are
+// left as they are. config itself is not modified.
+func canonicalConfig(config RulesConfig) RulesConfig {
+	config.EnabledRules = sortedCopy(config.EnabledRules)
+	config.DisabledRules = sortedCopy(config.DisabledRules)
+	days := make([]string, len(config.DayOfWeekBonus.Days))
+	for i, day := range config.DayOfWeekBonus.Days {
+		days[i] = strings.ToLower(day)
+	}
+	config.DayOfWeekBonus.Days = sortedCopy(days)
+	config.HolidayBonus.Dates = sortedCopy(config.HolidayBonus.Dates)
+	config.HolidayBonus.Recurring = sortedCopy(config.HolidayBonus.Recurring)
+
+	retailers := make([]RetailerOverride, len(config.Retailers))
+	for i, o := range config.Retailers {
+		o.EnableRules = sortedCopy(o.EnableRules)
+		o.DisableRules = sortedCopy(o.DisableRules)
+		retailers[i] = o
+	}
+	config.Retailers = retailers
+	return config
+}
+
+// sortedCopy returns a sorted copy of list, or nil if it is empty.
+func sortedCopy(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), list...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// standardRules returns every rule, enabled or not, parameterized by config.
+func standardRules(config RulesConfig) []Rule {
+	start, _ := parseClock(config.AfternoonBonus.Start)
+	end, _ := parseClock(config.AfternoonBonus.End)
+	return []Rule{
+		retailerNameRule{},
+		roundTotalRule{points: config.RoundTotalPoints},
+		quarterMultipleRule{points: config.QuarterMultiplePoints},
+		itemPairsRule{pointsPerPair: config.ItemPairPoints},
+		newDescriptionLengthRule(config.DescriptionMultiplier, config.DescriptionRounding),
+		oddDayRule{points: config.OddDayPoints},
+		afternoonPurchaseRule{window: config.AfternoonBonus, start: start, end: end},
+		newDayOfWeekRule(config.DayOfWeekBonus),
+		holidayRule{bonus: config.HolidayBonus},
+		skuBonusRule{table: config.skuBonuses},
+		newPromptSubmissionRule(config.PromptSubmissionBonus),
+		itemCountRule{bonuses: config.ItemCountBonuses},
+	}
+}
+
+// newPromptSubmissionRule builds the prompt submission rule from a validated bonus.
+func newPromptSubmissionRule(bonus PromptSubmissionBonus) promptSubmissionRule {
+	rule := promptSubmissionRule{points: bonus.Points, location: time.UTC}
+	rule.window, _ = time.ParseDuration(bonus.Window)
+	if bonus.Timezone != "" {
+		rule.location, _ = time.LoadLocation(bonus.Timezone)
+	}
+	return rule
+}
+
+// newDayOfWeekRule builds the day-of-week rule from a validated bonus.
+func newDayOfWeekRule(bonus DayOfWeekBonus) dayOfWeekRule {
+	rule := dayOfWeekRule{points: bonus.Points, days: make(map[time.Weekday]bool)}
+	for _, name := range bonus.Days {
+		if day, ok := parseWeekday(name); ok {
+			rule.days[day] = true
+		}
+	}
+	if bonus.Timezone != "" {
+		rule.location, _ = time.LoadLocation(bonus.Timezone)
+	}
+	return rule
+}
+
+// ruleNames returns the names of the standard rules in evaluation order.
+func ruleNames() []string {
+	var names []string
+	for _, rule := range standardRules(defaultRulesConfig()) {
+		names = append(names, rule.Name())
+	}
+	return names
+}
+
+// Score runs every enabled rule over the receipt and returns the total with one
+// breakdown entry per rule, in rule order, followed by one for any promotion and one
+// if the total was capped. Receipts from a retailer with an override are scored by the
+// first matching override instead.
+func (e *Engine) Score(receipt ParsedReceipt) (int, []BreakdownEntry) {
+	return e.score(receipt, nil)
+}
+
+// Trace parses and scores a receipt like ScoreReceipt, also recording in a Trace what
+// every rule saw and computed.
+func (e *Engine) Trace(receipt Receipt) (int, []BreakdownEntry, *Trace) {
+	trace := &Trace{}
+	points, breakdown := e.score(parseReceipt(receipt, e.config), trace)
+	return points, breakdown, trace
+}
+
+// score implements Score, recording into trace unless it is nil.
+func (e *Engine) score(receipt ParsedReceipt, trace *Trace) (int, []BreakdownEntry) {
+	for _, override := range e.overrides {
+		if override.matches(receipt.Retailer) {
+			if trace != nil {
+				trace.Override = override.definition.label()
+			}
+			points, breakdown := override.engine.score(receipt, trace)
+			applied := BreakdownEntry{
+				Rule:   "retailer_override",
+				Detail: fmt.Sprintf("%q matched the retailer override with %s", receipt.Retailer, override.definition.label()),
+			}
+			return points, append([]BreakdownEntry{applied}, breakdown...)
+		}
+	}
+
+	if e.config.MinimumTotalCents > 0 && receipt.TotalOK && receipt.TotalCents < e.config.MinimumTotalCents {
+		if trace != nil {
+			trace.skip(e.rules, "below_minimum_total")
+		}
+		return 0, []BreakdownEntry{{
+			Rule:   "below_minimum_total",
+			Points: 0,
+			Detail: fmt.Sprintf("total %s is below the minimum of %s required to earn points", receipt.Total, formatCents(e.config.MinimumTotalCents)),
+		}}
+	}
+
+	breakdown := make([]BreakdownEntry, 0, len(e.rules)+2)
+	if len(receipt.Items) < receipt.LineCount {
+		breakdown = append(breakdown, BreakdownEntry{
+			Rule:   "consolidated_items",
+			Detail: fmt.Sprintf("%d lines consolidated into %d items", receipt.LineCount, len(receipt.Items)),
+		})
+	}
+
+	total := 0
+	for _, rule := range e.rules {
+		if !e.config.ruleEnabled(rule.Name()) {
+			if trace != nil {
+				trace.Rules = append(trace.Rules, RuleTrace{Rule: rule.Name(), Skipped: true, Reason: "disabled"})
+			}
+			continue
+		}
+		var points int
+		var detail string
+		if trace == nil {
+			points, detail = rule.Evaluate(receipt)
+		} else {
+			points, detail = trace.evaluate(rule, receipt)
+		}
+		total += points
+		breakdown = append(breakdown, BreakdownEntry{Rule: rule.Name(), Points: points, Detail: detail})
+	}
+
+	total, promotion := e.applyPromotions(receipt, total)
+	if promotion != nil {
+		breakdown = append(breakdown, *promotion)
+	}
+	total, tier := e.applyTier(receipt, total)
+	if tier != nil {
+		breakdown = append(breakdown, *tier)
+	}
+	// Penalties and custom rules can deduct points, but a receipt never costs any.
+	if total < 0 {
+		breakdown = append(breakdown, BreakdownEntry{
+			Rule:   "clamped_to_zero",
+			Points: -total,
+			Detail: fmt.Sprintf("%d points raised to 0, receipts never score below zero", total),
+		})
+		total = 0
+	}
+	if limit := e.config.MaxPointsPerReceipt; limit > 0 && total > limit {
+		breakdown = append(breakdown, BreakdownEntry{
+			Rule:   "cap_applied",
+			Points: limit - total,
+			Detail: fmt.Sprintf("%d points capped at the maximum of %d per receipt", total, limit),
+		})
+		total = limit
+	}
+	return total, breakdown
+}
+
+// ScoreReceipt parses and scores a receipt with the engine's config.
+func (e *Engine) ScoreReceipt(receipt Receipt) (int, []BreakdownEntry) {
+	return e.Score(parseReceipt(receipt, e.config))
+}
+
+// ScoreReceiptContext is ScoreReceipt for a request, which it doesn't start once ctx is
+// done. Rules don't block, so a receipt whose scoring started is scored in full.
+func (e *Engine) ScoreReceiptContext(ctx context.Context, receipt Receipt) (int, []BreakdownEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	points, breakdown := e.ScoreReceipt(receipt)
+	return points, breakdown, nil
+}
+
+// scoreReceipt parses and scores a receipt under config.
+func scoreReceipt(receipt Receipt, config RulesConfig) (int, []BreakdownEntry) {
+	return newEngine(config).ScoreReceipt(receipt)
+}
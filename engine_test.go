@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+var exampleReceipts = map[string]Receipt{
+	"target": {
+		Retailer: "Target",
+		Total:    "35.35",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+	},
+	"m&m": {
+		Retailer: "M&M Corner Market",
+		Total:    "9.00",
+		Items: []Item{
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+		},
+		PurchaseDate: "2022-03-20",
+		PurchaseTime: "14:33",
+	},
+}
+
+func TestEngineGolden(t *testing.T) {
+	testCases := []struct {
+		name              string
+		expectedPoints    int
+		expectedBreakdown []BreakdownEntry
+	}{
+		{
+			name:           "target",
+			expectedPoints: 28,
+			expectedBreakdown: []BreakdownEntry{
+				{Rule: "retailer_name", Points: 6, Detail: `6 alphanumeric characters in "Target"`},
+				{Rule: "round_total", Points: 0, Detail: "35.35 is not a round dollar amount"},
+				{Rule: "quarter_multiple", Points: 0, Detail: "35.35 is not a multiple of 0.25"},
+				{Rule: "item_pairs", Points: 10, Detail: "5 items make 2 pairs"},
+				{Rule: "description_length", Points: 6, Detail: `"Emils Cheese Pizza" has 18 characters: ceil(12.25 * 0.2) = 3; "Klarbrunn 12-PK 12 FL OZ" has 24 characters: ceil(12.00 * 0.2) = 3`},
+				{Rule: "odd_day", Points: 6, Detail: "day 1 is odd"},
+				{Rule: "afternoon_purchase", Points: 0, Detail: "13:01 is not between 14:00 and 16:00"},
+				{Rule: "day_of_week", Points: 0, Detail: "no bonus days are configured"},
+				{Rule: "holiday", Points: 0, Detail: "no holidays are configured"},
+				{Rule: "sku_bonus", Points: 0, Detail: "no SKU bonuses are configured"},
+				{Rule: "prompt_submission", Points: 0, Detail: "no prompt submission bonus is configured"},
+				{Rule: "item_count", Points: 0, Detail: "no item count bonuses are configured"},
+			},
+		},
+		{
+			name:           "m&m",
+			expectedPoints: 109,
+			expectedBreakdown: []BreakdownEntry{
+				{Rule: "retailer_name", Points: 14, Detail: `14 alphanumeric characters in "M&M Corner Market"`},
+				{Rule: "round_total", Points: 50, Detail: "9.00 is a round dollar amount"},
+				{Rule: "quarter_multiple", Points: 25, Detail: "9.00 is a multiple of 0.25"},
+				{Rule: "item_pairs", Points: 10, Detail: "4 items make 2 pairs"},
+				{Rule: "description_length", Points: 0, Detail: "no description length is a multiple of 3"},
+				{Rule: "odd_day", Points: 0, Detail: "day 20 is not odd"},
+				{Rule: "afternoon_purchase", Points: 10, Detail: "14:33 is between 14:00 and 16:00"},
+				{Rule: "day_of_week", Points: 0, Detail: "no bonus days are configured"},
+				{Rule: "holiday", Points: 0, Detail: "no holidays are configured"},
+				{Rule: "sku_bonus", Points: 0, Detail: "no SKU bonuses are configured"},
+				{Rule: "prompt_submission", Points: 0, Detail: "no prompt submission bonus is configured"},
+				{Rule: "item_count", Points: 0, Detail: "no item count bonuses are configured"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			points, breakdown := scoreReceipt(exampleReceipts[tc.name], defaultRulesConfig())
+			if points != tc.expectedPoints {
+				t.Errorf("expected %v points but got %v", tc.expectedPoints, points)
+			}
+			if !reflect.DeepEqual(breakdown, tc.expectedBreakdown) {
+				t.Errorf("expected breakdown %+v but got %+v", tc.expectedBreakdown, breakdown)
+			}
+		})
+	}
+}
+
+func TestDisabledRules(t *testing.T) {
+	basePoints, baseBreakdown := scoreReceipt(exampleReceipts["target"], defaultRulesConfig())
+
+	for _, entry := range baseBreakdown {
+		entry := entry
+		t.Run(entry.Rule, func(t *testing.T) {
+			config := defaultRulesConfig()
+			config.DisabledRules = []string{entry.Rule}
+			points, breakdown := scoreReceipt(exampleReceipts["target"], config)
+			if points != basePoints-entry.Points {
+				t.Errorf("expected %v points without %s but got %v", basePoints-entry.Points, entry.Rule, points)
+			}
+			if len(breakdown) != len(baseBreakdown)-1 {
+				t.Errorf("expected %v breakdown entries but got %v", len(baseBreakdown)-1, len(breakdown))
+			}
+			for _, e := range breakdown {
+				if e.Rule == entry.Rule {
+					t.Errorf("expected %s to be omitted from the breakdown but got %+v", entry.Rule, e)
+				}
+			}
+		})
+	}
+
+	config := defaultRulesConfig()
+	config.EnabledRules = []string{"retailer_name", "odd_day"}
+	points, breakdown := scoreReceipt(exampleReceipts["target"], config)
+	if points != 12 || len(breakdown) != 2 {
+		t.Errorf("expected only retailer_name and odd_day to score 12 points but got %v from %+v", points, breakdown)
+	}
+
+	config.DisabledRules = []string{"odd_day"}
+	if points, _ := scoreReceipt(exampleReceipts["target"], config); points != 6 {
+		t.Errorf("expected a disabled rule to be skipped even if enabled but got %v points", points)
+	}
+}
+
+func TestParseReceipt(t *testing.T) {
+	parsed := parseReceipt(exampleReceipts["target"], defaultRulesConfig())
+	if !parsed.TotalOK || parsed.TotalValue != 35.35 || parsed.TotalCents != 3535 {
+		t.Errorf("expected a parsed total of 35.35 but got %+v", parsed)
+	}
+	if !parsed.DayOK || parsed.Day != 1 || !parsed.TimeOK || parsed.PurchaseMinutes != 13*60+1 {
+		t.Errorf("expected day 1 and time 13:01 but got %+v", parsed)
+	}
+	if parsed.LineCount != 5 || len(parsed.Items) != 5 || parsed.Items[4].Description != "Klarbrunn 12-PK 12 FL OZ" {
+		t.Errorf("expected 5 normalized items but got %+v", parsed.Items)
+	}
+
+	malformed := parseReceipt(Receipt{Total: "abc", PurchaseDate: "2022", PurchaseTime: "xx"}, defaultRulesConfig())
+	if malformed.TotalOK || malformed.DayOK || malformed.TimeOK {
+		t.Errorf("expected malformed fields to be flagged but got %+v", malformed)
+	}
+}
+
+// constantRule awards a fixed number of points, for testing the engine itself.
+type constantRule struct {
+	name   string
+	points int
+}
+
+func (r constantRule) Name() string { return r.name }
+
+func (r constantRule) Evaluate(ParsedReceipt) (int, string) { return r.points, "constant" }
+
+func TestEngineSumsRulesInOrder(t *testing.T) {
+	engine := &Engine{rules: []Rule{constantRule{"a", 3}, constantRule{"b", 0}, constantRule{"c", 4}}}
+	points, breakdown := engine.Score(ParsedReceipt{})
+	if points != 7 {
+		t.Errorf("expected 7 points but got %v", points)
+	}
+	expected := []BreakdownEntry{
+		{Rule: "a", Points: 3, Detail: "constant"},
+		{Rule: "b", Points: 0, Detail: "constant"},
+		{Rule: "c", Points: 4, Detail: "constant"},
+	}
+	if !reflect.DeepEqual(breakdown, expected) {
+		t.Errorf("expected breakdown %+v but got %+v", expected, breakdown)
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	base := configHash(defaultRulesConfig())
+
+	changed := defaultRulesConfig()
+	changed.OddDayPoints = 7
+	if configHash(changed) == base {
+		t.Error("expected a different oddDayPoints to change the hash")
+	}
+	disabled := defaultRulesConfig()
+	disabled.DisabledRules = []string{"odd_day"}
+	if configHash(disabled) == base {
+		t.Error("expected disabling a rule to change the hash")
+	}
+
+	// The same config written in a different order hashes the same.
+	first, err := loadRulesConfig(writeConfig(t, "first.yaml", `
+oddDayPoints: 7
+disabledRules: [odd_day, item_pairs]
+dayOfWeekBonus:
+  days: [SATURDAY, sunday]
+  points: 15
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadRulesConfig(writeConfig(t, "second.json", `{
+		"dayOfWeekBonus": {"points": 15, "days": ["Sunday", "saturday"]},
+		"disabledRules": ["item_pairs", "odd_day"],
+		"oddDayPoints": 7
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configHash(first) != configHash(second) {
+		t.Errorf("expected equivalent configs to hash the same but got %+v and %+v", first, second)
+	}
+	if first.DisabledRules[0] != "odd_day" || first.DayOfWeekBonus.Days[0] != "SATURDAY" {
+		t.Errorf("expected hashing to leave the config alone but got %+v", first)
+	}
+}
+
+func TestClampedToZero(t *testing.T) {
+	config, err := loadRulesConfig(writeConfig(t, "rules.yaml", `
+customRules:
+  - name: returns
+    expression: retailer == "Target"
+    points: -100
+    penalty: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, breakdown := scoreReceipt(exampleReceipts["target"], config)
+	expected := BreakdownEntry{Rule: "clamped_to_zero", Points: 72, Detail: "-72 points raised to 0, receipts never score below zero"}
+	if points != 0 || breakdown[len(breakdown)-1] != expected {
+		t.Errorf("expected 28 - 100 to be raised to 0 with %+v but got %v and %+v", expected, points, breakdown)
+	}
+
+	// The clamp applies to the total, not to each rule.
+	config.CustomRules[0].Points = -10
+	if points, breakdown := scoreReceipt(exampleReceipts["target"], config); points != 18 || breakdown[len(breakdown)-1].Rule == "clamped_to_zero" {
+		t.Errorf("expected 28 - 10 = 18 points unclamped but got %v and %+v", points, breakdown)
+	}
+}
+
+// randomReceipt generates receipts that pass the validation in processReceipts.
+type randomReceipt Receipt
+
+func (randomReceipt) Generate(r *rand.Rand, size int) reflect.Value {
+	const characters = "abcXYZ019 &-'."
+	text := func(n int) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			b.WriteByte(characters[r.Intn(len(characters))])
+		}
+		return b.String()
+	}
+	cents := func() string {
+		if r.Intn(4) == 0 {
+			return fmt.Sprintf("%d.00", r.Intn(100))
+		}
+		return fmt.Sprintf("%d.%02d", r.Intn(10000), r.Intn(100))
+	}
+
+	receipt := Receipt{
+		Retailer:     text(1 + r.Intn(20)),
+		Total:        cents(),
+		PurchaseDate: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, r.Intn(2000)).Format("2006-01-02"),
+		PurchaseTime: fmt.Sprintf("%02d:%02d", r.Intn(24), r.Intn(60)),
+	}
+	for i := 1 + r.Intn(size+1); i > 0; i-- {
+		item := Item{ShortDescription: text(1 + r.Intn(30)), Price: cents()}
+		if len(receipt.Items) > 0 && r.Intn(3) == 0 {
+			item = receipt.Items[r.Intn(len(receipt.Items))]
+		}
+		receipt.Items = append(receipt.Items, item)
+	}
+	return reflect.ValueOf(randomReceipt(receipt))
+}
+
+func TestScoresAreNonNegativeAndDeterministic(t *testing.T) {
+	config, err := loadRulesConfig(writeConfig(t, "rules.yaml", `
+consolidateItems: true
+customRules:
+  - name: small_basket
+    expression: size(items) < 3
+    points: -40
+    penalty: true
+  - name: refund
+    pointsExpression: 500 - totalCents
+promotions:
+  - name: double
+    start: 2021-01-01
+    end: 2021-12-31
+    multiplier: 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, other := newEngine(config), newEngine(config)
+
+	property := func(generated randomReceipt) bool {
+		receipt := Receipt(generated)
+		points, breakdown := engine.ScoreReceipt(receipt)
+		if points < 0 {
+			t.Logf("%+v scored %v", receipt, points)
+			return false
+		}
+		for i := 0; i < 3; i++ {
+			again, againBreakdown := engine.ScoreReceipt(receipt)
+			fresh, freshBreakdown := other.ScoreReceipt(receipt)
+			if again != points || fresh != points || !reflect.DeepEqual(againBreakdown, breakdown) || !reflect.DeepEqual(freshBreakdown, breakdown) {
+				t.Logf("%+v scored %v, then %v and %v", receipt, points, again, fresh)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500, Rand: rand.New(rand.NewSource(1))}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditUserErased is the action of an erasure of a user's data.
+const auditUserErased = "user.erased"
+
+// erasedActor replaces the actor of audit events by an erased user.
+const erasedActor = "user:[erased]"
+
+// erasureReport counts what an erasure removed.
+type erasureReport struct {
+	Receipts          int `json:"receipts"`
+	ShadowDivergences int `json:"shadowDivergences"`
+	IdempotencyKeys   int `json:"idempotencyKeys"`
+	StreamEvents      int `json:"streamEvents"`
+	LoyaltyTier       int `json:"loyaltyTier"`
+	AuditEvents       int `json:"auditEvents"`
+}
+
+// eraseReceipts removes the receipts owned by user, returning their IDs.
+func eraseReceipts(user string) map[string]bool {
+	erased := make(map[string]bool)
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	for id, stored := range receipts {
+		if stored.Owner == user {
+			delete(receipts, id)
+			erased[id] = true
+		}
+	}
+	return erased
+}
+
+// forget drops the divergences of the receipts in ids, returning how many it dropped.
+func (s *shadowScorer) forget(ids map[string]bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.largest[:0]
+	for _, d := range s.largest {
+		if !ids[d.ReceiptID] {
+			kept = append(kept, d)
+		}
+	}
+	removed := len(s.largest) - len(kept)
+	s.largest = kept
+	return removed
+}
+
+// forgetCaller drops the responses remembered for the Idempotency-Keys of caller, as
+// actor names it, returning how many it dropped.
+func (s *idempotencyStore) forgetCaller(caller string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for key := range s.responses {
+		if strings.HasPrefix(key, caller+" ") {
+			delete(s.responses, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// forget drops the recent events of the receipts of owner, so they are never sent
+// again, returning how many it dropped.
+func (s *stream) forget(owner string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := make([]streamEvent, 0, cap(s.recent))
+	for i := range s.recent {
+		if event := s.recent[(s.next+i)%len(s.recent)]; event.receipt.Owner != owner {
+			kept = append(kept, event)
+		}
+	}
+	removed := len(s.recent) - len(kept)
+	s.recent, s.next = kept, 0
+	return removed
+}
+
+// tombstone rewrites the events of the audit log for which update returns true,
+// returning how many it rewrote. Each file is replaced with a rename, so a crash
+// leaves either the old or the new version.
+func (s *fileAuditSink) tombstone(update func(*auditEvent) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(paths)
+	paths = append(paths, s.path)
+
+	rewritten := 0
+	for _, path := range paths {
+		n, err := rewriteAuditFile(path, update)
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += n
+	}
+	// Writes must go on to the new current file.
+	if err := s.file.Close(); err != nil {
+		return rewritten, err
+	}
+	return rewritten, s.open()
+}
+
+// rewriteAuditFile applies update to the events of one audit file, replacing the file
+// only if any changed.
+func rewriteAuditFile(path string, update func(*auditEvent) bool) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var out []byte
+	changed := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		if update(&event) {
+			changed++
+		}
+		line, err := json.Marshal(event)
+		if err != nil {
+			return 0, err
+		}
+		out = append(append(out, line...), '\n')
+	}
+	if err := scanner.Err(); err != nil || changed == 0 {
+		return 0, err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, out, 0o600); err != nil {
+		return 0, err
+	}
+	return changed, os.Rename(tmp, path)
+}
+
+// eraseUser removes the receipts of user, sending their receipt.deleted events, the
+// shadow divergences of those receipts, the responses remembered for the user's
+// Idempotency-Keys, the user's events kept for /receipts/stream clients to resume from
+// and their loyalty tier, and tombstones the audit events the user made or that name those receipts.
+// Erasing a user with nothing left is not an error.
+func eraseUser(user string) (erasureReport, error) {
+	var report erasureReport
+	ids := eraseReceipts(user)
+	report.Receipts = len(ids)
+	for _, id := range sortedKeys(ids) {
+		notifyDeleted(id, user)
+	}
+	if s := shadow.Load(); s != nil {
+		report.ShadowDivergences = s.forget(ids)
+	}
+	report.IdempotencyKeys = idempotencyKeys.forgetCaller("user:" + user)
+	report.StreamEvents = receiptStream.forget(user)
+	report.LoyaltyTier = userTiers.forget(user)
+
+	a := auditLog.Load()
+	if a == nil {
+		return report, nil
+	}
+	sink, ok := a.sink.(*fileAuditSink)
+	if !ok {
+		return report, fmt.Errorf("the audit sink can't be rewritten")
+	}
+	// Events of the user still in the queue must reach the file before it is rewritten.
+	a.flush()
+	var err error
+	report.AuditEvents, err = sink.tombstone(func(event *auditEvent) bool {
+		changed := false
+		if event.Actor == "user:"+user {
+			event.Actor = erasedActor
+			changed = true
+		}
+		if ids[event.Target] {
+			event.Target = ""
+			changed = true
+		}
+		return changed
+	})
+	return report, err
+}
+
+// pseudonym stands for user in the audit event of its erasure, so the erasure can be
+// matched to the request for it without the log naming the user.
+func pseudonym(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// eraseUserHandler erases everything stored about the user_id path parameter and
+// reports what was removed. Repeating it is harmless and reports nothing removed.
+func eraseUserHandler(c *gin.Context) {
+	user := c.Param("user_id")
+	c.Set("auditTarget", pseudonym(user))
+	report, err := eraseUser(user)
+	if err != nil {
+		abortWithProblem(c, http.StatusInternalServerError, "ERASURE_FAILED", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": report})
+}
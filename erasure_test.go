@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEraseUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	router := newRouter()
+	a, sink := useAuditLog(t, 200)
+	useAPIKeys(t, []apiKey{{ID: "ops", Key: "k-ops", Scopes: []string{scopeRead, scopeAdmin}}})
+	s := newShadowScorer(currentEngine())
+	shadow.Store(s)
+	defer shadow.Store(nil)
+	keys := useIdempotencyKeys(t)
+	receiptStream = newStream(streamReplaySize)
+	defer func() { receiptStream = newStream(streamReplaySize) }()
+	previousTiers := userTiers
+	userTiers = newTierStore()
+	defer func() { userTiers = previousTiers }()
+	userTiers.setTier("alice", tierGold)
+	userTiers.setTier("bob", tierSilver)
+
+	// Alice has two receipts, Bob one, each with a shadow divergence, an audit event,
+	// spread over rotated audit files, an Idempotency-Key and a stream event.
+	for _, r := range []struct{ id, owner string }{{"alice-1", "alice"}, {"alice-2", "alice"}, {"bob-1", "bob"}} {
+		receipts[r.id] = StoredReceipt{Owner: r.owner, Points: 10}
+		s.record(shadowDivergence{ReceiptID: r.id, Points: 10, ShadowPoints: 12, Delta: 2})
+		recordAudit(auditEvent{Actor: "user:" + r.owner, Action: auditReceiptProcessed, Target: r.id, Outcome: "success", Status: http.StatusOK})
+		if _, err := keys.begin("user:"+r.owner+" "+r.id, sha256.Sum256([]byte(r.id))); err != nil {
+			t.Fatal(err)
+		}
+		keys.finish("user:"+r.owner+" "+r.id, http.StatusOK, "application/json", []byte(`{"id":"`+r.id+`"}`))
+		receiptStream.publish(streamReceipt{ID: r.id, Points: 10, Owner: r.owner})
+	}
+	recordAudit(auditEvent{Actor: "apiKey:ops", Action: auditRulesReloaded, Target: "alice-2", Outcome: "success"})
+	a.flush()
+
+	erase := func() map[string]int {
+		t.Helper()
+		rr := requestWithKey(router, http.MethodDelete, "/admin/users/alice/data", "k-ops")
+		var body struct {
+			Removed map[string]int `json:"removed"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %v: %s", rr.Code, rr.Body.String())
+		}
+		return body.Removed
+	}
+	want := map[string]int{"receipts": 2, "shadowDivergences": 2, "idempotencyKeys": 2, "streamEvents": 2, "loyaltyTier": 1, "auditEvents": 3}
+	if removed := erase(); !reflect.DeepEqual(removed, want) {
+		t.Errorf("expected %v to be removed but got %v", want, removed)
+	}
+	// Erasing again finds nothing left.
+	for kind := range want {
+		want[kind] = 0
+	}
+	if removed := erase(); !reflect.DeepEqual(removed, want) {
+		t.Errorf("expected nothing to be removed the second time but got %v", removed)
+	}
+
+	for _, id := range []string{"alice-1", "alice-2"} {
+		if rr := requestWithKey(router, http.MethodGet, "/receipts/"+id, "k-ops"); rr.Code != http.StatusNotFound {
+			t.Errorf("expected %s to be gone but got %v", id, rr.Code)
+		}
+	}
+	rr := requestWithKey(router, http.MethodGet, "/admin/shadow/summary", "k-ops")
+	if strings.Contains(rr.Body.String(), "alice") || !strings.Contains(rr.Body.String(), "bob-1") {
+		t.Errorf("expected only Bob's divergence to be left but got %s", rr.Body.String())
+	}
+	if events := queryAudit(t, router, "?actor=user:alice"); len(events) != 0 {
+		t.Errorf("expected no audit events by Alice but got %+v", events)
+	}
+	events := queryAudit(t, router, "")
+	for _, event := range events {
+		if strings.Contains(event.Actor, "alice") || strings.Contains(event.Target, "alice") {
+			t.Errorf("expected no audit event to name Alice or her receipts but got %+v", event)
+		}
+	}
+	// Bob's data is untouched, and the erasures are audited without naming Alice.
+	receiptsMu.RLock()
+	_, ok := receipts["bob-1"]
+	receiptsMu.RUnlock()
+	if !ok {
+		t.Error("expected Bob's receipt to be kept")
+	}
+	if alice, bob := userTiers.tier("alice"), userTiers.tier("bob"); alice != "" || bob != tierSilver {
+		t.Errorf("expected only Bob's tier to be kept but got %q and %q", alice, bob)
+	}
+	// Alice's Idempotency-Keys can't replay her responses, and stream clients resuming
+	// from before the erasure are only sent Bob's event.
+	for _, r := range []struct{ id, owner string }{{"alice-1", "alice"}, {"alice-2", "alice"}, {"bob-1", "bob"}} {
+		replay, err := keys.begin("user:"+r.owner+" "+r.id, sha256.Sum256([]byte(r.id)))
+		if err != nil || (replay != nil) != (r.owner == "bob") {
+			t.Errorf("expected only Bob's response to be kept but got %+v, %v for %s", replay, err, r.id)
+		}
+	}
+	client, replay, err := receiptStream.subscribe("0", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptStream.unsubscribe(client)
+	if len(replay) != 1 || replay[0].receipt.ID != "bob-1" {
+		t.Errorf("expected only Bob's stream event to be kept but got %+v", replay)
+	}
+	erasures := 0
+	for _, event := range events {
+		switch {
+		case event.Action == auditUserErased:
+			erasures++
+			if event.Actor != "apiKey:ops" || event.Target != pseudonym("alice") || event.Outcome != "success" {
+				t.Errorf("expected the erasure by ops of %s but got %+v", pseudonym("alice"), event)
+			}
+		case event.Target == "bob-1" && event.Actor != "user:bob":
+			t.Errorf("expected Bob's audit event to be kept but got %+v", event)
+		}
+	}
+	if erasures != 2 {
+		t.Errorf("expected both erasures to be audited but got %d", erasures)
+	}
+
+	// Writes continue to the current file after it was rewritten.
+	recordAudit(auditEvent{Actor: "user:bob", Action: auditReceiptProcessed, Target: "bob-2", Outcome: "success"})
+	if events := queryAudit(t, router, "?actor=user:bob"); len(events) != 2 {
+		t.Errorf("expected Bob's two events but got %+v", events)
+	}
+	if sink.size == 0 {
+		t.Error("expected the current audit file to be written to")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventVersion is the version of the Event envelope and the data of each type. Fields
+// are only ever added within a version; anything else starts a new one.
+const eventVersion = 1
+
+// Event types. Nothing rescores stored receipts yet, so receipt.recalculated can be
+// subscribed to but isn't sent.
+const (
+	eventReceiptProcessed    = "receipt.processed"
+	eventReceiptDeleted      = "receipt.deleted"
+	eventReceiptRecalculated = "receipt.recalculated"
+	eventWebhookTest         = "webhook.test"
+)
+
+// subscribableEvents are the events a subscription may name.
+var subscribableEvents = []string{eventReceiptProcessed, eventReceiptDeleted, eventReceiptRecalculated}
+
+// Event is a change to a receipt, as webhooks deliver it and EventPublishers publish
+// it.
+type Event struct {
+	// ID identifies the event, which may be delivered more than once.
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// Data is a receiptEventData for receipt.processed and receipt.recalculated, and
+	// an eventSubject for the others.
+	Data any `json:"data"`
+}
+
+func newEvent(eventType string, data any) Event {
+	return Event{ID: newID(idEvent), Version: eventVersion, Type: eventType, Data: data}
+}
+
+// eventSubject names what an event is about.
+type eventSubject struct {
+	ID string `json:"id"`
+}
+
+// receiptEventData describes the receipt of an event.
+type receiptEventData struct {
+	ID           string    `json:"id"`
+	Points       int       `json:"points"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	ProcessedAt  time.Time `json:"processedAt"`
+	RulesVersion string    `json:"rulesVersion"`
+}
+
+// EventPublisher publishes events to a message bus. Publish is called for one event at
+// a time, in the order the events happened.
+type EventPublisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// The --event-publisher events are published with: none, stdout or nats.
+var eventPublisherName string
+
+// eventPublisher publishes every event in the background. It is nil until the server
+// starts.
+var eventPublisher atomic.Pointer[asyncPublisher]
+
+// eventBufferSize is how many events may wait to be published before more are
+// dropped, and eventPublishTimeout how long publishing one may take.
+const (
+	eventBufferSize     = 1024
+	eventPublishTimeout = 10 * time.Second
+)
+
+var (
+	eventsPublished = newCounterVec("events_published_total",
+		"Events handed to the --event-publisher, by outcome: success or failure.", "outcome")
+	eventsDropped = newCounterVec("events_dropped_total",
+		"Events dropped because the --event-publisher buffer was full.")
+)
+
+// newEventPublisher returns the publisher name configures.
+func newEventPublisher(name string) (EventPublisher, error) {
+	switch name {
+	case "", "none":
+		return noopPublisher{}, nil
+	case "stdout":
+		return &jsonLinesPublisher{w: os.Stdout}, nil
+	case "nats":
+		return newNATSPublisher(natsURL, natsSubjectPrefix)
+	default:
+		return nil, fmt.Errorf("--event-publisher %q is not none, stdout or nats", name)
+	}
+}
+
+// noopPublisher drops every event, the default.
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(context.Context, Event) error { return nil }
+
+// jsonLinesPublisher writes each event as a line of JSON, for local development.
+type jsonLinesPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *jsonLinesPublisher) Publish(ctx context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.w.Write(append(line, '\n'))
+	return err
+}
+
+// asyncPublisher hands events to a publisher from a buffer, one at a time and in
+// order, so requests never wait on it. Events that don't fit in the buffer are
+// dropped and counted, and failures logged and counted; neither is retried.
+type asyncPublisher struct {
+	publisher EventPublisher
+	queue     chan Event
+	done      chan struct{}
+	dropped   atomic.Int64
+}
+
+// newAsyncPublisher starts publishing the events sent to it with publisher.
+func newAsyncPublisher(publisher EventPublisher, size int) *asyncPublisher {
+	p := &asyncPublisher{publisher: publisher, queue: make(chan Event, size), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+func (p *asyncPublisher) run() {
+	defer close(p.done)
+	for event := range p.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+		err := p.publisher.Publish(ctx, event)
+		cancel()
+		if err != nil {
+			eventsPublished.inc("failure")
+			log.Printf("publishing %s event %s failed: %v", event.Type, event.ID, err)
+			continue
+		}
+		eventsPublished.inc("success")
+	}
+}
+
+// send queues event without blocking. The first drop and every power of two after it
+// are logged.
+func (p *asyncPublisher) send(event Event) {
+	select {
+	case p.queue <- event:
+	default:
+		eventsDropped.inc()
+		if n := p.dropped.Add(1); n&(n-1) == 0 {
+			log.Printf("the event buffer is full, %d events dropped", n)
+		}
+	}
+}
+
+// close publishes the queued events, waiting at most until ctx is done, and closes
+// the publisher if it holds a connection. Nothing may send to it afterwards.
+func (p *asyncPublisher) close(ctx context.Context) {
+	close(p.queue)
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+	}
+	if closer, ok := p.publisher.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("closing the event publisher failed: %v", err)
+		}
+	}
+}
+
+// publishEvent sends an event to its webhooks and the event publisher, returning it.
+func publishEvent(eventType string, data any) Event {
+	event := newEvent(eventType, data)
+	sendWebhooks(event)
+	if p := eventPublisher.Load(); p != nil {
+		p.send(event)
+	}
+	return event
+}
+
+// notifyProcessed sends the receipt.processed event of a stored receipt, also to the
+// /ws clients subscribed to it, and the receipt to /receipts/stream.
+func notifyProcessed(id string, stored StoredReceipt) {
+	receiptStream.publish(streamReceipt{ID: id, Retailer: stored.Receipt.Retailer, Points: stored.Points, ProcessedAt: stored.Receipt.ProcessedAt, Owner: stored.Owner})
+	event := publishEvent(eventReceiptProcessed, receiptEventData{
+		ID:           id,
+		Points:       stored.Points,
+		Retailer:     stored.Receipt.Retailer,
+		PurchaseDate: stored.Receipt.PurchaseDate,
+		ProcessedAt:  stored.Receipt.ProcessedAt,
+		RulesVersion: stored.RulesVersion,
+	})
+	liveUpdates.push(event, id, stored.Owner)
+}
+
+// notifyDeleted sends the receipt.deleted event of a removed receipt of owner, also to
+// the /ws clients subscribed to it.
+func notifyDeleted(id, owner string) {
+	liveUpdates.push(publishEvent(eventReceiptDeleted, eventSubject{ID: id}), id, owner)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// usePublisher publishes events with publisher, from a buffer of size, until the test
+// ends or closePublisher is called.
+func usePublisher(t *testing.T, publisher EventPublisher, size int) *asyncPublisher {
+	t.Helper()
+	p := newAsyncPublisher(publisher, size)
+	eventPublisher.Store(p)
+	t.Cleanup(closePublisher)
+	return p
+}
+
+// closePublisher publishes the buffered events and stops publishing.
+func closePublisher() {
+	if p := eventPublisher.Swap(nil); p != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.close(ctx)
+	}
+}
+
+func TestJSONLinesPublisher(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	var out bytes.Buffer
+	usePublisher(t, &jsonLinesPublisher{w: &out}, eventBufferSize)
+	successes := eventsPublished.value("success")
+
+	rr := requestWithKey(newRouter(), http.MethodPost, "/receipts/process", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	closePublisher()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line but got %q", out.String())
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil || event.ID == "" {
+		t.Fatalf("expected an event with an ID but got %s", lines[0])
+	}
+	expected := `{"id":"` + event.ID + `","version":1,"type":"receipt.processed","data":{"id":"` + response.ID + `","points":28,"retailer":"Target","purchaseDate":"2022-01-01","processedAt":"2025-01-30T12:00:00Z","rulesVersion":"` + currentEngine().hash + `"}}`
+	if lines[0] != expected {
+		t.Errorf("expected the line\n%s\nbut got\n%s", expected, lines[0])
+	}
+	if got := eventsPublished.value("success"); got != successes+1 {
+		t.Errorf("expected one more published event but got %v", got-successes)
+	}
+}
+
+// blockingPublisher holds up each event until it is released.
+type blockingPublisher struct {
+	started, release chan struct{}
+	published        chan Event
+}
+
+func (p *blockingPublisher) Publish(ctx context.Context, event Event) error {
+	p.started <- struct{}{}
+	<-p.release
+	p.published <- event
+	return nil
+}
+
+func TestEventPublisherDrops(t *testing.T) {
+	publisher := &blockingPublisher{started: make(chan struct{}, 3), release: make(chan struct{}), published: make(chan Event, 3)}
+	p := usePublisher(t, publisher, 1)
+	dropped := eventsDropped.value()
+
+	first, second, third := newEvent(eventReceiptProcessed, eventSubject{ID: "a"}), newEvent(eventReceiptDeleted, eventSubject{ID: "a"}), newEvent(eventReceiptDeleted, eventSubject{ID: "b"})
+	p.send(first)
+	<-publisher.started
+	// The first is being published and the second fills the buffer.
+	p.send(second)
+	p.send(third)
+	close(publisher.release)
+	closePublisher()
+
+	if got := eventsDropped.value(); got != dropped+1 {
+		t.Errorf("expected one more dropped event but got %v", got-dropped)
+	}
+	close(publisher.published)
+	var ids []string
+	for event := range publisher.published {
+		ids = append(ids, event.ID)
+	}
+	if len(ids) != 2 || ids[0] != first.ID || ids[1] != second.ID {
+		t.Errorf("expected the first two events in order but got %v", ids)
+	}
+}
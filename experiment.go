@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Variants of an experiment. Receipts scored while no experiment runs have none.
+const (
+	variantControl   = "control"
+	variantCandidate = "candidate"
+)
+
+// experiment scores a share of new receipts with a candidate rule set instead of the
+// current rules, so its effect on engagement can be measured. It is nil unless
+// --experiment-rules-config is set.
+var experiment atomic.Pointer[abExperiment]
+
+// experimentRulesConfigPath and experimentPercent are the --experiment-rules-config
+// file and the --experiment-percent of receipts scored with it.
+var (
+	experimentRulesConfigPath string
+	experimentPercent         int
+)
+
+// abExperiment is a candidate engine and the percentage of receipts it scores.
+type abExperiment struct {
+	engine  *Engine
+	percent int
+}
+
+// newExperiment returns an experiment scoring percent of receipts with engine.
+func newExperiment(engine *Engine, percent int) (*abExperiment, error) {
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("experiment percentage %d is not between 0 and 100", percent)
+	}
+	return &abExperiment{engine: engine, percent: percent}, nil
+}
+
+// experimentBucket maps an ID to one of 100 buckets. It depends only on the ID, so a
+// retried receipt always lands in the same bucket.
+func experimentBucket(id string) int {
+	sum := sha256.Sum256([]byte(id))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+// assign returns the variant of the receipt with an ID and the engine to score it
+// with, control being the current engine.
+func (e *abExperiment) assign(id string, control *Engine) (string, *Engine) {
+	if experimentBucket(id) < e.percent {
+		return variantCandidate, e.engine
+	}
+	return variantControl, control
+}
+
+// variantSummary is one variant's line of GET /admin/experiment/summary.
+type variantSummary struct {
+	Variant      string  `json:"variant"`
+	Receipts     int     `json:"receipts"`
+	MeanPoints   float64 `json:"meanPoints"`
+	RulesVersion string  `json:"rulesVersion,omitempty"`
+}
+
+// experimentSummaryHandler reports the receipt count and mean points of each variant
+// among the stored receipts.
+func experimentSummaryHandler(c *gin.Context) {
+	e := experiment.Load()
+	if e == nil {
+		abortWithProblem(c, http.StatusNotFound, "EXPERIMENT_NOT_CONFIGURED", "no --experiment-rules-config was given")
+		return
+	}
+
+	counts := make(map[string]int)
+	totals := make(map[string]int64)
+	receiptsMu.RLock()
+	for _, stored := range receipts {
+		if stored.Variant != "" {
+			counts[stored.Variant]++
+			totals[stored.Variant] += int64(stored.Points)
+		}
+	}
+	receiptsMu.RUnlock()
+
+	variants := []variantSummary{{Variant: variantControl}, {Variant: variantCandidate, RulesVersion: e.engine.hash}}
+	for i := range variants {
+		v := &variants[i]
+		v.Receipts = counts[v.Variant]
+		if v.Receipts > 0 {
+			v.MeanPoints = float64(totals[v.Variant]) / float64(v.Receipts)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"percent": e.percent, "variants": variants})
+}
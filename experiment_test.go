@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useExperiment runs an experiment for the rest of the test.
+func useExperiment(t *testing.T, engine *Engine, percent int) *abExperiment {
+	t.Helper()
+	e, err := newExperiment(engine, percent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	experiment.Store(e)
+	t.Cleanup(func() { experiment.Store(nil) })
+	return e
+}
+
+func TestExperimentBucketDistribution(t *testing.T) {
+	for _, percent := range []int{10, 50} {
+		e, err := newExperiment(currentEngine(), percent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates := 0
+		for i := 0; i < 10000; i++ {
+			id := fmt.Sprintf("receipt-%d", i)
+			variant, _ := e.assign(id, currentEngine())
+			if again, _ := e.assign(id, currentEngine()); again != variant {
+				t.Fatalf("expected %s to be assigned %s again but got %s", id, variant, again)
+			}
+			if variant == variantCandidate {
+				candidates++
+			}
+		}
+		if expected := percent * 100; candidates < expected-300 || candidates > expected+300 {
+			t.Errorf("expected about %v of 10000 receipts in the candidate variant but got %v", expected, candidates)
+		}
+	}
+
+	for _, percent := range []int{-1, 101} {
+		if _, err := newExperiment(currentEngine(), percent); err == nil {
+			t.Errorf("expected %v%% to be rejected", percent)
+		}
+	}
+}
+
+func TestExperiment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	setRules(defaultRulesConfig())
+	router := newRouter()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/experiment/summary", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without an experiment but got %v", rr.Code)
+	}
+
+	// The example receipt has two pairs, worth 10 more points at 10 per pair.
+	config := defaultRulesConfig()
+	config.ItemPairPoints = 10
+	e := useExperiment(t, newEngine(config), 50)
+
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		id, points := processAndScore(t, router, validReceiptPayload)
+		expectedVariant, expectedPoints, expectedVersion := variantControl, 28, currentEngine().hash
+		if experimentBucket(id) < 50 {
+			expectedVariant, expectedPoints, expectedVersion = variantCandidate, 38, e.engine.hash
+		}
+		counts[expectedVariant]++
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/breakdown", nil))
+		var body struct {
+			Variant      string `json:"variant"`
+			RulesVersion string `json:"rulesVersion"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if points != expectedPoints || body.Variant != expectedVariant || body.RulesVersion != expectedVersion {
+			t.Errorf("expected %s to score %v in %s but got %v in %s", id, expectedPoints, expectedVariant, points, body.Variant)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/experiment/summary", nil))
+	var summary struct {
+		Percent  int              `json:"percent"`
+		Variants []variantSummary `json:"variants"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	expected := []variantSummary{
+		{Variant: variantControl, Receipts: counts[variantControl], MeanPoints: 28},
+		{Variant: variantCandidate, Receipts: counts[variantCandidate], MeanPoints: 38, RulesVersion: e.engine.hash},
+	}
+	if summary.Percent != 50 || len(summary.Variants) != 2 || summary.Variants[0] != expected[0] || summary.Variants[1] != expected[1] {
+		t.Errorf("expected %+v but got %+v", expected, summary)
+	}
+
+	// Receipts processed after the experiment ends have no variant, and those processed
+	// during it keep theirs.
+	experiment.Store(nil)
+	id, points := processAndScore(t, router, validReceiptPayload)
+	receiptsMu.RLock()
+	defer receiptsMu.RUnlock()
+	if stored := receipts[id]; points != 28 || stored.Variant != "" {
+		t.Errorf("expected 28 points without a variant but got %v in %q", points, stored.Variant)
+	}
+	for _, stored := range receipts {
+		counts[stored.Variant]--
+	}
+	if counts[variantControl] != 0 || counts[variantCandidate] != 0 {
+		t.Errorf("expected the stored variants to be unchanged but got differences %v", counts)
+	}
+}
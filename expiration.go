@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// pointsExpiryMonths is how many months after its purchase date a receipt's points
+// expire, --points-expiry-months. 0 keeps points forever.
+var pointsExpiryMonths int
+
+// expiredPointsGone makes GET /receipts/{id}/points respond 410 Gone for expired
+// receipts instead of zero points, --expired-points-gone.
+var expiredPointsGone bool
+
+// pointsExpiry returns when the points of a receipt expire: the start of the day
+// pointsExpiryMonths after its purchase date, in the receipt's own time zone if it
+// gives one and UTC otherwise. ok is false if points don't expire or the purchase date
+// is not a valid date.
+func pointsExpiry(receipt Receipt) (expiresAt time.Time, ok bool) {
+	if pointsExpiryMonths <= 0 {
+		return time.Time{}, false
+	}
+	location := time.UTC
+	if receipt.Timezone != "" {
+		if zone, err := time.LoadLocation(receipt.Timezone); err == nil {
+			location = zone
+		}
+	}
+	purchased, err := time.ParseInLocation("2006-01-02", receipt.PurchaseDate, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return purchased.AddDate(0, pointsExpiryMonths, 0), true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type pointsBody struct {
+	Points         int        `json:"points"`
+	Expired        *bool      `json:"expired"`
+	ExpiresAt      *time.Time `json:"expiresAt"`
+	OriginalPoints *int       `json:"originalPoints"`
+}
+
+func getPointsBody(t *testing.T, router *gin.Engine, id string) (int, pointsBody) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/points", nil))
+	var body pointsBody
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, body
+}
+
+func TestPointsExpiry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	fake := useFakeClock(t, time.Date(2022, 1, 2, 9, 0, 0, 0, time.UTC))
+	defer func(months int, gone bool) { pointsExpiryMonths, expiredPointsGone = months, gone }(pointsExpiryMonths, expiredPointsGone)
+
+	// The example receipt was purchased on 2022-01-01.
+	id, _ := processAndScore(t, router, validReceiptPayload)
+	if _, body := getPointsBody(t, router, id); body.Points != 28 || body.Expired != nil || body.ExpiresAt != nil {
+		t.Errorf("expected points not to expire by default but got %+v", body)
+	}
+
+	pointsExpiryMonths = 12
+	expiresAt := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	fake.Set(expiresAt.Add(-time.Second))
+	_, body := getPointsBody(t, router, id)
+	if body.Points != 28 || body.Expired == nil || *body.Expired || body.ExpiresAt == nil || !body.ExpiresAt.Equal(expiresAt) || body.OriginalPoints != nil {
+		t.Errorf("expected 28 points expiring at %v on the last day but got %+v", expiresAt, body)
+	}
+
+	fake.Set(expiresAt)
+	_, body = getPointsBody(t, router, id)
+	if body.Points != 0 || body.Expired == nil || !*body.Expired || body.OriginalPoints == nil || *body.OriginalPoints != 28 {
+		t.Errorf("expected the 28 points to have expired on the boundary day but got %+v", body)
+	}
+
+	expiredPointsGone = true
+	code, _ := getPointsBody(t, router, id)
+	if code != http.StatusGone {
+		t.Errorf("expected 410 for expired points but got %v", code)
+	}
+
+	// Stored points are kept, so the breakdown still shows them.
+	receiptsMu.RLock()
+	stored := receipts[id]
+	receiptsMu.RUnlock()
+	if stored.Points != 28 {
+		t.Errorf("expected the stored points to be kept but got %v", stored.Points)
+	}
+}
+
+func TestPointsExpiryTimezone(t *testing.T) {
+	defer func(months int) { pointsExpiryMonths = months }(pointsExpiryMonths)
+	pointsExpiryMonths = 1
+
+	testCases := []struct {
+		receipt  Receipt
+		expected time.Time
+		ok       bool
+	}{
+		{Receipt{PurchaseDate: "2024-01-15"}, time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC), true},
+		{Receipt{PurchaseDate: "2024-01-15", Timezone: "America/New_York"}, time.Date(2024, 2, 15, 5, 0, 0, 0, time.UTC), true},
+		{Receipt{PurchaseDate: "2024-13-01"}, time.Time{}, false},
+	}
+	for _, tc := range testCases {
+		expiresAt, ok := pointsExpiry(tc.receipt)
+		if ok != tc.ok || !expiresAt.Equal(tc.expected) {
+			t.Errorf("expected %v, %v for %+v but got %v, %v", tc.expected, tc.ok, tc.receipt, expiresAt, ok)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportedReceipt is a stored receipt as GET /admin/receipts/export lists it: what
+// it was scored on and what it earned, without its items.
+type exportedReceipt struct {
+	ID           string    `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	PurchaseTime string    `json:"purchaseTime"`
+	Total        string    `json:"total"`
+	Items        int       `json:"items"`
+	Points       int       `json:"points"`
+	RulesVersion string    `json:"rulesVersion"`
+	Variant      string    `json:"variant,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+	ProcessedAt  time.Time `json:"processedAt"`
+}
+
+// exportReceipts streams every stored receipt as a line of JSON, oldest first.
+func exportReceipts(c *gin.Context) {
+	receiptsMu.RLock()
+	exported := make([]exportedReceipt, 0, len(receipts))
+	for id, stored := range receipts {
+		exported = append(exported, exportedReceipt{
+			ID:           id,
+			Retailer:     stored.Receipt.Retailer,
+			PurchaseDate: stored.Receipt.PurchaseDate,
+			PurchaseTime: stored.Receipt.PurchaseTime,
+			Total:        stored.Receipt.Total,
+			Items:        len(stored.Receipt.Items),
+			Points:       stored.Points,
+			RulesVersion: stored.RulesVersion,
+			Variant:      stored.Variant,
+			Owner:        stored.Owner,
+			ProcessedAt:  stored.Receipt.ProcessedAt,
+		})
+	}
+	receiptsMu.RUnlock()
+
+	sort.Slice(exported, func(i, j int) bool {
+		a, b := exported[i].ProcessedAt, exported[j].ProcessedAt
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return exported[i].ID < exported[j].ID
+	})
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	for i, receipt := range exported {
+		if err := encoder.Encode(receipt); err != nil {
+			return
+		}
+		if i%100 == 99 {
+			c.Writer.Flush()
+		}
+	}
+	c.Writer.Flush()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	"github.com/google/cel-go/interpreter"
+)
+
+// Custom rules are written in the Common Expression Language (CEL), compiled with
+// cel-go against an environment declaring their variables. Expressions are parsed and
+// type-checked once by compileExpr and then evaluated many times with a cost limit.
+
+// exprError is a problem with an expression, located by line and column.
+type exprError struct {
+	line, column int
+	msg          string
+}
+
+func (e *exprError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.line, e.column, e.msg)
+}
+
+// errCostLimit is returned when evaluating an expression costs more than allowed.
+var errCostLimit = errors.New("cost limit exceeded")
+
+// mustExprEnv returns an environment with the CEL standard library, its string
+// extensions and options, which declare the variables and the types of their
+// values. It panics if the options are invalid.
+func mustExprEnv(options ...cel.EnvOption) *cel.Env {
+	options = append([]cel.EnvOption{
+		ext.Strings(),
+		// Catch at compile time what would otherwise fail on every evaluation.
+		cel.ASTValidators(cel.ValidateRegexLiterals(), cel.ValidateHomogeneousAggregateLiterals()),
+	}, options...)
+	env, err := cel.NewEnv(options...)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// compiledExpr is a parsed and type-checked expression.
+type compiledExpr struct {
+	source  string
+	typ     *cel.Type
+	program cel.Program
+}
+
+// compileExpr parses source and checks it against env. Evaluating it stops once it
+// has cost more than costLimit (0 for no limit).
+func compileExpr(env *cel.Env, source string, costLimit int) (*compiledExpr, error) {
+	checked, issues := env.Compile(source)
+	if issues.Err() != nil {
+		// Report the first problem, as the later ones often follow from it.
+		first := issues.Errors()[0]
+		return nil, &exprError{line: first.Location.Line(), column: first.Location.Column() + 1, msg: first.Message}
+	}
+	// Regular expressions given as literals are compiled once, here.
+	options := []cel.ProgramOption{cel.OptimizeRegex(interpreter.MatchesRegexOptimization)}
+	if costLimit > 0 {
+		options = append(options, cel.CostLimit(uint64(costLimit)))
+	}
+	program, err := env.Program(checked, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledExpr{source: source, typ: checked.OutputType(), program: program}, nil
+}
+
+// evaluate runs the expression with vars, the values of the variables its environment
+// declares.
+func (e *compiledExpr) evaluate(vars map[string]interface{}) (ref.Val, error) {
+	value, _, err := e.program.Eval(vars)
+	var cancelled interpreter.EvalCancelledError
+	if errors.As(err, &cancelled) && cancelled.Cause == interpreter.CostLimitExceeded {
+		return nil, errCostLimit
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+var exprTestEnv = mustExprEnv(
+	customRuleItems,
+	cel.Variable("n", cel.IntType),
+	cel.Variable("x", cel.DoubleType),
+	cel.Variable("s", cel.StringType),
+	cel.Variable("items", cel.ListType(customRuleItemType)),
+)
+
+var exprTestVars = map[string]interface{}{
+	"n": int64(7),
+	"x": 2.5,
+	"s": "Klarbrunn 12-PK",
+	"items": []customRuleItem{
+		{Description: "Mountain Dew 12PK", PriceCents: 649, Quantity: 1},
+		{Description: "Emils Cheese Pizza", PriceCents: 1225, Quantity: 2},
+	},
+}
+
+// native returns value as a Go value, with lists as []interface{}.
+func native(t *testing.T, value ref.Val) interface{} {
+	t.Helper()
+	if value.Type().TypeName() != "list" {
+		return value.Value()
+	}
+	list, err := value.ConvertToNative(reflect.TypeOf([]interface{}{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestEvaluateExpr(t *testing.T) {
+	testCases := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"n / 2 + n % 2", int64(4)},
+		{"-n", int64(-7)},
+		{"x * 2.0", 5.0},
+		{"1.5e1", 15.0},
+		{"n > 5 && x < 3.0", true},
+		{"!(n > 5) || s == 'other'", false},
+		{"n == 7 ? 'seven' : 'other'", "seven"},
+		{`s + "!"`, "Klarbrunn 12-PK!"},
+		{`"a\"b\n"`, "a\"b\n"},
+		{"s < 'Z'", true},
+		{"size(s)", int64(15)},
+		{"s.size()", int64(15)},
+		{"size(items)", int64(2)},
+		{"items[1].description", "Emils Cheese Pizza"},
+		{"n in [1, 7, 9]", true},
+		{"'x' in ['a', 'b']", false},
+		{"[1, 2] + [3]", []interface{}{int64(1), int64(2), int64(3)}},
+		{"[1, 2] == [1, 2]", true},
+		{"s.contains('12-PK') && s.startsWith('Klar') && !s.endsWith('OZ')", true},
+		{"s.matches('^[A-Za-z]+ [0-9]+-PK$')", true},
+		{"s.lowerAscii()", "klarbrunn 12-pk"},
+		{"s.split(' ')[0].upperAscii() + s.substring(9).trim()", "KLARBRUNN12-PK"},
+		{"int(x) + int('3')", int64(5)},
+		{"double(n) / 2.0", 3.5},
+		{"string(n) + string(true)", "7true"},
+		{"items.exists(i, i.quantity > 1)", true},
+		{"items.all(i, i.priceCents > 1000)", false},
+		{"items.exists_one(i, i.description.contains('Pizza'))", true},
+		{"items.filter(i, i.priceCents > 1000).size()", int64(1)},
+		{"items.map(i, i.priceCents * i.quantity)", []interface{}{int64(649), int64(2450)}},
+		{"items.filter(i, i.priceCents > 100000)", []interface{}{}},
+		{"[[1, 2], [3]].exists(l, l.all(v, v > 2))", true},
+		// Either side of && and || can decide the result, even if the other fails.
+		{"1 / 0 == 1 || true", true},
+		{"false && items[5].quantity > 0", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			compiled, err := compileExpr(exprTestEnv, tc.expr, 0)
+			if err != nil {
+				t.Fatalf("expected %s to compile but got %v", tc.expr, err)
+			}
+			value, err := compiled.evaluate(exprTestVars)
+			if err != nil {
+				t.Fatalf("expected %s to evaluate but got %v", tc.expr, err)
+			}
+			if got := native(t, value); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %#v but got %#v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	testCases := []struct {
+		expr     string
+		expected string
+	}{
+		{"n + x", "1:3: found no matching overload for '_+_' applied to '(int, double)'"},
+		{"n > '5'", "1:3: found no matching overload for '_>_' applied to '(int, string)'"},
+		{"s && true", "1:1: expected type 'bool' but found 'string'"},
+		{"total > 5", "1:1: undeclared reference to 'total' (in container '')"},
+		{"items[0].price", "1:9: undefined field 'price'"},
+		{"s.size", "1:2: type 'string' does not support field selection"},
+		{"items['0']", "1:6: found no matching overload for '_[_]' applied to '(list(receipt_api.customRuleItem), string)'"},
+		{"n ? 1 : 2", "1:3: found no matching overload for '_?_:_' applied to '(int, int, int)'"},
+		{"n > 1 ? 1 : 'one'", "1:7: found no matching overload for '_?_:_' applied to '(bool, int, string)'"},
+		{"[1, 'a']", "1:5: expected type 'int' but found 'string'"},
+		{"items.exists(i, i.quantity)", "1:18: expected type 'bool' but found 'int'"},
+		{"items.all(1, true)", "1:11: argument must be a simple name"},
+		{"n.exists(v, true)", "1:1: expression of type 'int' cannot be range of a comprehension (must be list, map, or dynamic)"},
+		{"contains(s, 'a')", "1:9: found no matching overload for 'contains' applied to '(string, string)'"},
+		{"s.shout()", "1:8: undeclared reference to 'shout' (in container '')"},
+		{"s.matches('[')", "1:11: invalid matches argument"},
+		{"n >", "1:4: Syntax error: mismatched input '<EOF>' expecting {'[', '{', '(', '.', '-', '!', 'true', 'false', 'null', NUM_FLOAT, NUM_INT, NUM_UINT, STRING, BYTES, IDENTIFIER}"},
+		{"(n > 1", "1:7: Syntax error: missing ')' at '<EOF>'"},
+		{"n > 1 n", "1:7: Syntax error: extraneous input 'n' expecting <EOF>"},
+		{"s == 'abc", "1:6: Syntax error: token recognition error at: ''abc'"},
+		{"n # 2", "1:3: Syntax error: token recognition error at: '#'"},
+		{"99999999999999999999", "1:1: invalid int literal"},
+		{"n >\n  s", "1:3: found no matching overload for '_>_' applied to '(int, string)'"},
+		{"n > 1 &&\n  s", "2:3: expected type 'bool' but found 'string'"},
+		{"n > 1 &&\n  total", "2:3: undeclared reference to 'total' (in container '')"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			_, err := compileExpr(exprTestEnv, tc.expr, 0)
+			if err == nil {
+				t.Fatalf("expected %s to be rejected", tc.expr)
+			}
+			if err.Error() != tc.expected {
+				t.Errorf("expected error %q but got %q", tc.expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestEvaluateExprErrors(t *testing.T) {
+	testCases := []struct {
+		expr     string
+		expected string
+	}{
+		{"n / (n - 7)", "division by zero"},
+		{"n % 0", "modulus by zero"},
+		{"9223372036854775807 + n", "integer overflow"},
+		{"items[2].quantity", "index out of bounds: 2"},
+		{"int(s)", "type conversion error from 'string' to 'int'"},
+		{"s.matches(s + '[')", "error parsing regexp: missing closing ]: `[`"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			compiled, err := compileExpr(exprTestEnv, tc.expr, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = compiled.evaluate(exprTestVars)
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("expected error %q but got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestExprCostLimit(t *testing.T) {
+	// Nested comprehensions over a long list are quadratic.
+	list := "[" + strings.TrimSuffix(strings.Repeat("1, ", 200), ", ") + "]"
+	source := list + ".all(a, " + list + ".all(b, a == b))"
+	limited, err := compileExpr(exprTestEnv, source, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limited.evaluate(exprTestVars); !errors.Is(err, errCostLimit) {
+		t.Errorf("expected the cost limit to stop evaluation but got %v", err)
+	}
+	unlimited, err := compileExpr(exprTestEnv, source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := unlimited.evaluate(exprTestVars); err != nil || got.Value() != true {
+		t.Errorf("expected true without a limit but got %v, %v", got, err)
+	}
+
+	// The cost limit is not an error either side of || can absorb.
+	limited, err = compileExpr(exprTestEnv, source+" || true", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limited.evaluate(exprTestVars); !errors.Is(err, errCostLimit) {
+		t.Errorf("expected the cost limit to stop evaluation but got %v", err)
+	}
+}
@@ -1,260 +1,900 @@
-package main
-
-import (
-	"net/http"
-	"strconv"
-	"strings"
-	"math"
-
-	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
-)
-
-type Receipt struct {
-	Retailer     string  `json:"retailer"`
-	Total        string  `json:"total"`
-	Items        []Item  `json:"items"`
-	PurchaseDate string  `json:"purchaseDate"`
-	PurchaseTime string  `json:"purchaseTime"`
-}
-
-type Item struct {
-	ShortDescription string  `json:"shortDescription"`
-	Price            string `json:"price"`
-}
-
-type ReceiptsMap map[string]int
-
-var receipts ReceiptsMap
-
-func main() {
-	receipts = make(ReceiptsMap)
-	router := gin.Default()
-	router.POST("/receipts/process", processReceipts)
-	router.GET("/receipts/:receipt_id/points", getPoints)
-	router.Run(":8080")
-}
-
-func TestProcessReceipts(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-
-	// Create a new Gin router
-	router := gin.Default()
-	router.POST("/receipts/process", processReceipts)
-
-	testCases := []struct {
-		name           string
-		payload        string
-		expectedStatus int
-		expectedBody   string
-	}{
-		{
-			name: "ValidInput",
-			payload: `{
-				"retailer": "Target",
-				"total": "35.35",
-				"items": [
-					{
-						"shortDescription": "Mountain Dew 12PK",
-						"price": "6.49"
-					},
-					{
-						"shortDescription": "Emils Cheese Pizza",
-						"price": "12.25"
-					},
-					{
-						"shortDescription": "Knorr Creamy Chicken",
-						"price": "1.26"
-					},
-					{
-						"shortDescription": "Doritos Nacho Cheese",
-						"price": "3.35"
-					},
-					{
-						"shortDescription": "Klarbrunn 12-PK 12 FL OZ",
-						"price": "12.00"
-					}
-				],
-				"purchaseDate": "2022-01-01",
-				"purchaseTime": "13:01"
-			}`,
-			expectedStatus: http.StatusOK,
-			expectedBody:   `{"id":"<generated-id>"}`,
-		},
-		{
-			name: "InvalidInput",
-			payload: `{
-				"retailer": "Target",
-				"total": "",
-				"items": [],
-				"purchaseDate": "",
-				"purchaseTime": "13:01"
-			}`,
-			expectedStatus: http.StatusBadRequest,
-			expectedBody:   `{"error":"Total amount is required"}`,
-		},
-		// Add more test cases here
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			req, err := http.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(tc.payload))
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			rr := httptest.NewRecorder()
-			router.ServeHTTP(rr, req)
-
-			// Check the response status code
-			if rr.Code != tc.expectedStatus {
-				t.Errorf("expected status %v but got %v", tc.expectedStatus, rr.Code)
-			}
-
-			// Check the response body
-			if rr.Body.String() != tc.expectedBody {
-				t.Errorf("expected response body %q but got %q", tc.expectedBody, rr.Body.String())
-			}
-		})
-	}
-}
-
-
-func processReceipts(c *gin.Context) {
-	var receipt Receipt
-	err := c.ShouldBindJSON(&receipt)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse the request body"})
-		return
-	}
-
-	// Validate retailer name
-	if receipt.Retailer == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Retailer name is required"})
-		return
-	}
-
-	// Validate total amount
-	if receipt.Total == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Total amount is required"})
-		return
-	}
-	total, err := strconv.ParseFloat(receipt.Total, 64)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid total amount"})
-		return
-	}
-
-	// Validate purchase date
-	if receipt.PurchaseDate == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase date is required"})
-		return
-	}
-
-	// Validate purchase time
-	if receipt.PurchaseTime == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase time is required"})
-		return
-	}
-
-	// Validate items
-	if len(receipt.Items) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Receipt should have at least one item"})
-		return
-	}
-	for _, item := range receipt.Items {
-		if item.ShortDescription == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Item short description is required"})
-			return
-		}
-		price, err := strconv.ParseFloat(item.Price, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item price"})
-			return
-		}
-		item.Price = fmt.Sprintf("%.2f", price) // Format item price to two decimal places
-	}
-
-	receiptID := uuid.New().String()
-	points := calculatePoints(receipt)
-	receipts[receiptID] = points
-
-	c.JSON(http.StatusOK, gin.H{"id": receiptID})
-}
-
-
-
-func getPoints(c *gin.Context) {
-	receiptID := c.Param("receipt_id")
-	points, ok := receipts[receiptID]
-	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt not found"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"points": points})
-}
-
-
-
-
-func calculatePoints(receipt Receipt) int {
-	points := 0
-
-	// Rule 1: One point for every alphanumeric character in the retailer name
-	points += countAlphanumeric(receipt.Retailer)
-
-	// Rule 2: 50 points if the total is a round dollar amount
-	total, err := strconv.ParseFloat(receipt.Total, 64)
-	if err == nil && total == float64(int(total)) {
-		points += 50
-	}
-
-	// Rule 3: 25 points if the total is a multiple of 0.25
-	if math.Mod(total*100, 25) == 0 {
-		points += 25
-	}
-
-	// Rule 4: 5 points for every two items on the receipt
-	if len(receipt.Items) > 0 {
-		points += len(receipt.Items) / 2 * 5
-	} else {
-		points = 0 // Set points to zero if there are no items
-	}
-
-	// Rule 5: Multiply the price by 0.2 and round up to the nearest integer if the trimmed length of
-	// the item description is a multiple of 3. The result is the number of points earned.
-	for _, item := range receipt.Items {
-		trimmedLength := len(strings.TrimSpace(item.ShortDescription))
-		if trimmedLength%3 == 0 {
-			price, err := strconv.ParseFloat(item.Price, 64)
-			if err == nil {
-				points += int(math.Ceil(price * 0.2))
-			}
-		}
-	}
-
-	// Rule 6: 6 points if the day in the purchase date is odd
-	day, err := strconv.Atoi(strings.Split(receipt.PurchaseDate, "-")[2])
-	if err == nil && day%2 != 0 {
-		points += 6
-	}
-
-	// Rule 7: 10 points if the time of purchase is after 2:00pm and before 4:00pm
-	hour, err := strconv.Atoi(strings.Split(receipt.PurchaseTime, ":")[0])
-	if err == nil && hour >= 14 && hour < 16 {
-		points += 10
-	}
-
-	return points
-}
-
-func countAlphanumeric(s string) int {
-	count := 0
-	for _, ch := range s {
-		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') {
-			count++
-		}
-	}
-	return count
-}
\ No newline at end of file
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+type Receipt struct {
+	Retailer     string `json:"retailer" yaml:"retailer"`
+	Total        string `json:"total" yaml:"total"`
+	Items        []Item `json:"items" yaml:"items"`
+	PurchaseDate string `json:"purchaseDate" yaml:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime" yaml:"purchaseTime"`
+	// Timezone is the IANA name of the zone the receipt was printed in, if known.
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	// ProcessedAt is when the receipt was processed. It is kept with the receipt so
+	// scoring it again gives the same result, but never exposed.
+	ProcessedAt time.Time `json:"-" yaml:"-"`
+	// Tier is the loyalty tier of the user who processed the receipt, if any, kept
+	// like ProcessedAt so changing the user's tier later doesn't change its score.
+	Tier string `json:"-" yaml:"-"`
+}
+
+type Item struct {
+	ShortDescription string `json:"shortDescription" yaml:"shortDescription"`
+	Price            string `json:"price" yaml:"price"`
+	// UPC identifies the product, if the receipt gives it. See skuBonusRule.
+	UPC string `json:"upc,omitempty" yaml:"upc,omitempty"`
+	// NormalizedDescription is the description as scored, see normalizeDescription.
+	// It is kept alongside the raw description but never exposed.
+	NormalizedDescription string `json:"-" yaml:"-"`
+}
+
+// StoredReceipt is a processed receipt together with the points it earned and the
+// version of the rules, the engine's config hash, that scored it. Variant is the
+// experiment variant it was assigned to, if an experiment was running.
+type StoredReceipt struct {
+	Receipt      Receipt
+	Points       int
+	Breakdown    []BreakdownEntry
+	RulesVersion string
+	Variant      string
+	// Owner is the user whose bearer token processed the receipt, if any.
+	Owner string
+}
+
+type ReceiptsMap map[string]StoredReceipt
+
+// receipts holds processed receipts by ID. Handlers run concurrently, so every access
+// goes through receiptsMu.
+var (
+	receipts   ReceiptsMap
+	receiptsMu sync.RWMutex
+)
+
+// maxBodyBytes limits the size of receipt submissions.
+var maxBodyBytes = byteSize(1 << 20)
+
+// registerFlags defines the command line options on fs, the rule flags overriding
+// fields of config among them.
+func registerFlags(fs *flag.FlagSet, config *RulesConfig) {
+	fs.BoolVar(&lenientMoney, "lenient-money", false, "accept currency symbols and thousands separators in amounts")
+	fs.StringVar(&seedName, "seed", "", "receipts built in to process at startup, for demos: examples")
+	fs.StringVar(&seedFile, "seed-file", "", "JSON array of receipts to process at startup, for demos and testing")
+	fs.BoolVar(&deterministic, "deterministic", false, "run as a reproducible fake for client test suites: a pinned clock, predictable IDs, and no authentication or rate limits")
+	fs.StringVar(&deterministicIDs, "deterministic-ids", deterministicIDs, "IDs handed out with --deterministic: sequential, numbered from 1 by kind, or content, naming receipts by their contents as --seed does")
+	fs.StringVar(&deterministicTime, "deterministic-time", deterministicTime, "RFC 3339 time the clock is pinned to with --deterministic")
+	fs.StringVar(&recordDir, "record-dir", "", "directory every request and response is written to, a JSON file each, with --deterministic")
+	fs.Var(&maxBodyBytes, "max-body-bytes", "maximum size of a receipt submission, e.g. 512KiB or 1MiB")
+	fs.IntVar(&maxBatchReceipts, "max-batch-receipts", maxBatchReceipts, "maximum number of receipts of a JSON array posted to /receipts/process, 0 for no limit")
+	fs.IntVar(&maxFormFields, "max-form-fields", maxFormFields, "maximum number of fields of a form-encoded receipt, 0 for no limit")
+	fs.IntVar(&maxFormItems, "max-form-items", maxFormItems, "maximum number of items of a form-encoded receipt, 0 for no limit")
+	fs.Var(&maxScanBytes, "max-scan-bytes", "maximum size of a receipt photo uploaded to POST /receipts/scan, e.g. 8MiB")
+	fs.StringVar(&extractorName, "extractor", "", "how POST /receipts/scan reads receipts from photos: fake, which returns the uploaded JSON sidecar, or empty to answer 501")
+	fs.IntVar(&jsonOptions.maxDepth, "max-json-depth", jsonOptions.maxDepth, "maximum nesting depth of JSON bodies (0 disables the check)")
+	fs.IntVar(&jsonOptions.maxTokens, "max-json-tokens", jsonOptions.maxTokens, "maximum number of tokens in JSON bodies (0 disables the check)")
+	fs.BoolVar(&jsonOptions.allowDuplicateKeys, "allow-duplicate-keys", false, "accept JSON objects that repeat a member name")
+	fs.StringVar(&rulesConfigPath, "rules-config", "", "YAML or JSON file overriding the scoring rule parameters")
+	fs.StringVar(&apiKeysFilePath, "api-keys-file", "", "file of API keys, one per line or a JSON array of names and keys, required in X-API-Key")
+	fs.StringVar(&signingSecretsFilePath, "signing-secrets-file", "", "file of secrets, one per line, one of which must have signed receipt submissions in X-Signature")
+	fs.DurationVar(&signatureWindow, "signature-window", signatureWindow, "how far X-Timestamp of signed submissions may be from the server's time, within which each X-Nonce is accepted once (0 signs the body alone)")
+	fs.StringVar(&jwksURL, "jwks-url", "", "JWKS URL of the identity provider whose RS256 bearer tokens authenticate users")
+	fs.StringVar(&jwtIssuer, "jwt-issuer", "", "iss claim bearer tokens must carry")
+	fs.StringVar(&jwtAudience, "jwt-audience", "", "aud claim bearer tokens must carry")
+	fs.StringVar(&jwtAdminRole, "jwt-admin-role", jwtAdminRole, "role in the roles claim of bearer tokens that can read every receipt")
+	fs.StringVar(&introspectionURL, "introspection-url", "", "RFC 7662 token introspection endpoint that checks the opaque bearer tokens of services")
+	fs.StringVar(&introspectionClientID, "introspection-client-id", "", "client ID this service authenticates to --introspection-url with")
+	fs.StringVar(&introspectionClientSecret, "introspection-client-secret", "", "client secret for --introspection-url")
+	fs.StringVar(&introspectionClientSecretFile, "introspection-client-secret-file", "", "file holding --introspection-client-secret, such as a mounted secret")
+	fs.StringVar(&listenAddr, "addr", listenAddr, "address the API listens on, host:port or a Unix domain socket such as unix:///var/run/fetch.sock")
+	fs.StringVar(&listenAddr, "listen", listenAddr, "same as --addr")
+	fs.BoolVar(&enableH2C, "enable-h2c", false, "serve HTTP/2 without TLS (h2c) next to HTTP/1.1 on the plain HTTP listeners")
+	fs.IntVar(&gzipLevel, "gzip-level", gzipLevel, "gzip level, 1 to 9, of JSON responses to clients that accept it (0 disables compression)")
+	fs.Var(&gzipMinBytes, "gzip-min-bytes", "smallest JSON response compressed, such as 512 or 4KiB")
+	fs.Var(&socketMode, "socket-mode", "permissions, in octal, of the Unix domain sockets listened on")
+	fs.StringVar(&adminAddr, "admin-addr", "", "separate address serving the /admin endpoints instead of --addr, e.g. 127.0.0.1:9090")
+	fs.DurationVar(&shutdownGrace, "shutdown-grace", shutdownGrace, "how long requests in flight may take to finish on SIGINT or SIGTERM")
+	fs.DurationVar(&shutdownGrace, "shutdown-timeout", shutdownGrace, "deprecated name of --shutdown-grace")
+	fs.DurationVar(&shutdownDelay, "shutdown-delay", 0, "how long to keep serving, with /ready reporting 503, on SIGINT or SIGTERM before refusing connections")
+	fs.DurationVar(&limits.readHeaderTimeout, "read-header-timeout", limits.readHeaderTimeout, "how long clients get to send the headers of a request (0 is no limit)")
+	fs.DurationVar(&limits.readTimeout, "read-timeout", limits.readTimeout, "how long clients get to send a whole request (0 is no limit)")
+	fs.DurationVar(&limits.writeTimeout, "write-timeout", limits.writeTimeout, "how long after its headers a request must be answered, at least --read-timeout (0 is no limit)")
+	fs.DurationVar(&limits.idleTimeout, "idle-timeout", limits.idleTimeout, "how long a keep-alive connection may wait for the next request (0 is no limit)")
+	fs.Var(&limits.maxHeaderBytes, "max-header-bytes", "maximum size of the headers of a request, e.g. 64KiB")
+	fs.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "how long API requests get before they are answered with a 504 (0 is no limit)")
+	fs.DurationVar(&adminWriteTimeout, "admin-write-timeout", adminWriteTimeout, "how long requests to the /admin endpoints get to be read and answered, instead of --read-timeout and --write-timeout (0 is no limit)")
+	fs.StringVar(&healthAddr, "health-addr", "", "separate address serving only /health and /version over plain HTTP, e.g. :8081")
+	fs.StringVar(&grpcAddr, "grpc-addr", "", "separate address serving ReceiptService over gRPC, with the TLS of --addr or else h2c, e.g. :9091")
+	fs.StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate file to serve TLS with")
+	fs.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key file of --tls-cert")
+	fs.StringVar(&tlsClientCAFile, "tls-client-ca", "", "PEM CA certificates that must have signed the client certificate of every connection")
+	fs.Var(&ipRate, "rate-limit", "requests each client IP may make, e.g. 100/s, 600/m or 3600/h (0 disables the limit)")
+	fs.IntVar(&ipBurst, "rate-burst", 0, "requests a client IP may make at once before --rate-limit applies (default one second's worth)")
+	fs.Var(&parsedValue{parse: func(s string) (err error) {
+		trustedProxies, err = parseTrustedProxies(s)
+		return err
+	}}, "trusted-proxies", "comma separated IP addresses and CIDR ranges of proxies whose X-Forwarded-For names the client")
+	fs.BoolVar(&trustAllProxies, "trust-all-proxies", false, "believe the X-Forwarded-For of every peer, only for when all traffic arrives through proxies that overwrite it")
+	fs.Var(&parsedValue{parse: func(s string) (err error) {
+		adminAllowedNets, err = parseCIDRs(s)
+		return err
+	}}, "admin-allowed-cidrs", "comma separated IPv4 and IPv6 CIDR ranges the /admin endpoints can be reached from")
+	fs.IntVar(&maxInFlight, "max-in-flight", 64*runtime.GOMAXPROCS(0), "requests handled at once before more are rejected with a 429 (0 disables the limit)")
+	fs.IntVar(&maxAdminInFlight, "max-admin-in-flight", runtime.GOMAXPROCS(0), "requests to the /admin endpoints handled at once before more are rejected with a 429 (0 disables the limit)")
+	fs.IntVar(&processClass.limit, "max-process-in-flight", 0, "receipt submissions handled at once before more wait --route-class-wait, then are rejected with a 503 (0 disables the limit)")
+	fs.IntVar(&simulateClass.limit, "max-simulate-in-flight", runtime.GOMAXPROCS(0), "rule simulations handled at once before more wait --route-class-wait, then are rejected with a 503 (0 disables the limit)")
+	fs.IntVar(&exportClass.limit, "max-export-in-flight", 2, "audit log and receipt exports handled at once before more wait --route-class-wait, then are rejected with a 503 (0 disables the limit)")
+	fs.DurationVar(&routeClassWait, "route-class-wait", 0, "how long a request over the limit of its route class waits for a slot before it is rejected (0 rejects it at once)")
+	fs.IntVar(&quotaResetHour, "quota-reset-hour", 0, "UTC hour at which the daily quotas of API keys start over")
+	fs.StringVar(&quotaStateFile, "quota-state-file", "", "file keeping the daily quota counters of API keys across restarts")
+	fs.Var(&cors.allowedOrigins, "cors-allowed-origins", "comma separated origins, or *, whose browser scripts may call the API (none disables CORS)")
+	fs.Var(&cors.allowedMethods, "cors-allowed-methods", "comma separated methods CORS preflights may request")
+	fs.Var(&cors.allowedHeaders, "cors-allowed-headers", "comma separated request headers CORS preflights may request")
+	fs.DurationVar(&cors.maxAge, "cors-max-age", cors.maxAge, "how long browsers may cache CORS preflight responses")
+	fs.BoolVar(&cors.allowCredentials, "cors-allow-credentials", false, "let browsers send cookies and Authorization headers on cross-origin requests")
+	fs.StringVar(&auditLogPath, "audit-log", "", "JSON-lines file every receipt processed and rules reload is recorded in")
+	fs.Var(&auditLogMaxBytes, "audit-log-max-bytes", "size at which --audit-log is rotated, e.g. 64MiB (0 never rotates)")
+	fs.StringVar(&metricsUsername, "metrics-username", "", "user scrapers of /metrics must authenticate as with HTTP Basic auth")
+	fs.StringVar(&metricsPassword, "metrics-password", "", "password of --metrics-username")
+	fs.StringVar(&metricsPasswordFile, "metrics-password-file", "", "file holding --metrics-password, such as a mounted secret")
+	fs.StringVar(&metricsHtpasswdPath, "metrics-htpasswd", "", "htpasswd file of {SHA} hashes, written with htpasswd -s, of further users that can scrape /metrics")
+	fs.Var(&pointsAwarded.buckets, "points-buckets", "comma separated upper bounds of the receipt_points_awarded histogram buckets")
+	fs.Var(&pointsPerDollar.buckets, "points-per-dollar-buckets", "comma separated upper bounds of the receipt_points_per_dollar histogram buckets")
+	fs.Var(&minLogLevel, "log-level", "least severe request logs written: debug, info, warn or error")
+	fs.Var(&readOnly, "read-only", "start in maintenance mode, rejecting changes with a 503 until POST /admin/maintenance turns it off")
+	fs.BoolVar(&validateOnly, "validate-only", false, "check the options and the files they name, report every problem and exit")
+	fs.StringVar(&runMode, "mode", "", "gin mode: debug, release or test (default $GIN_MODE, else release in release builds and debug otherwise)")
+	fs.BoolVar(&printRoutes, "print-routes", false, "log the routes each listener serves at startup")
+	fs.StringVar(&logFormat, "log-format", logFormat, "request log format: json, or console for reading in a terminal")
+	fs.BoolVar(&logSensitiveValues, "log-sensitive-values", false, "include the values, which can be receipt contents, in error logs; for debugging only")
+	fs.BoolVar(&disableLinks, "disable-links", false, "leave the _links out of receipt responses, for smaller payloads")
+	fs.BoolVar(&enableDocs, "enable-docs", false, "serve Swagger UI for /openapi.json at /docs")
+	fs.BoolVar(&enableUI, "enable-ui", false, "serve a page for submitting and looking up receipts at /")
+	fs.BoolVar(&enablePprof, "enable-pprof", false, "serve the pprof profiles under /debug/pprof and memory statistics at /debug/vars, with the /admin endpoints and behind the same checks")
+	fs.StringVar(&adminToken, "admin-token", "", "bearer token required by the /admin endpoints")
+	fs.StringVar(&adminTokenFile, "admin-token-file", "", "file holding --admin-token, such as a mounted secret")
+	fs.StringVar(&webhookURL, "webhook-url", "", "URL every receipt event is posted to, in the background")
+	fs.StringVar(&webhookSecret, "webhook-secret", "", "secret the X-Webhook-Signature of webhook deliveries is an HMAC-SHA256 under")
+	fs.StringVar(&webhookSecretFile, "webhook-secret-file", "", "file holding --webhook-secret, such as a mounted secret")
+	fs.StringVar(&webhookSubscriptionsFile, "webhook-subscriptions-file", "", "file keeping the webhook subscriptions made through /admin/webhooks across restarts")
+	fs.StringVar(&webhookStateFile, "webhook-state-file", "", "file keeping the webhook deliveries awaiting a retry and the dead letters across restarts")
+	fs.IntVar(&webhookMaxAttempts, "webhook-max-attempts", webhookMaxAttempts, "attempts at a webhook delivery before it is dead-lettered")
+	fs.DurationVar(&webhookMaxAge, "webhook-max-age", webhookMaxAge, "how long a failing webhook delivery is retried before it is dead-lettered (0 is no limit)")
+	fs.BoolVar(&allowInsecureWebhooks, "allow-insecure-webhooks", false, "let webhook subscriptions post to plain http URLs")
+	fs.StringVar(&eventPublisherName, "event-publisher", "none", "where receipt events are published: none, stdout or nats")
+	fs.StringVar(&natsURL, "nats-url", "", "nats:// URL of the NATS server events are published to with --event-publisher nats")
+	fs.StringVar(&natsSubjectPrefix, "nats-subject-prefix", natsSubjectPrefix, "prefix of the NATS subjects events are published to, followed by the event type")
+	fs.StringVar(&shadowRulesConfigPath, "shadow-rules-config", "", "YAML or JSON rules config to score every receipt with for comparison only")
+	fs.StringVar(&experimentRulesConfigPath, "experiment-rules-config", "", "YAML or JSON rules config to score --experiment-percent of new receipts with")
+	fs.IntVar(&experimentPercent, "experiment-percent", 10, "percentage of new receipts scored with --experiment-rules-config")
+	fs.IntVar(&pointsExpiryMonths, "points-expiry-months", 0, "months after the purchase date that a receipt's points expire (0 keeps them forever)")
+	fs.BoolVar(&expiredPointsGone, "expired-points-gone", false, "respond 410 Gone for the points of expired receipts instead of 0 points")
+	fs.StringVar(&configPath, "config", "", "YAML file of options, named as the flags, which flags and FETCH_* environment variables override (default $FETCH_CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective options, with secrets masked, and exit")
+	registerRuleFlags(fs, config)
+}
+
+func main() {
+	name, args := splitCommand(os.Args[1:])
+	if name != "serve" {
+		cmd, ok := commands[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+			runHelp(nil, os.Stderr, os.Stderr)
+			os.Exit(exitUsage)
+		}
+		os.Exit(cmd.run(args, os.Stdout, os.Stderr))
+	}
+
+	config := defaultRulesConfig()
+	registerFlags(flag.CommandLine, &config)
+	flag.CommandLine.Parse(args)
+	if configPath == "" {
+		configPath = os.Getenv("FETCH_CONFIG")
+	}
+	if err := applyConfig(flag.CommandLine, configPath, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	if err := readSecretFiles(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := writeEffectiveConfig(os.Stdout, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := validateOptions(flag.CommandLine); err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	if validateOnly {
+		log.Print("configuration is valid")
+		return
+	}
+	if err := applyDeterministicMode(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := resolveRulesConfig(rulesConfigPath, flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setRules(config)
+
+	mode, err := resolveMode(runMode, os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gin.SetMode(mode)
+	// Routes are listed by logRoutes with --print-routes, not by gin in debug mode.
+	gin.DebugPrintRouteFunc = func(string, string, string, int) {}
+	if auditLogPath != "" {
+		sink, err := openFileAuditSink(auditLogPath, int64(auditLogMaxBytes))
+		if err != nil {
+			log.Fatal(err)
+		}
+		auditLog.Store(newAuditor(sink))
+	}
+	if ipRate.count > 0 {
+		ipLimiter.Store(newRateLimiter(ipRate, ipBurst))
+	}
+	if receiptExtractor, err = newExtractor(extractorName); err != nil {
+		log.Fatal(err)
+	}
+	if maxInFlight > 0 {
+		apiSlots.Store(newConcurrencyLimiter(maxInFlight))
+	}
+	if maxAdminInFlight > 0 {
+		adminSlots.Store(newConcurrencyLimiter(maxAdminInFlight))
+	}
+	for _, class := range routeClasses {
+		if class.limit > 0 {
+			class.slots.Store(newConcurrencyLimiter(class.limit))
+		}
+	}
+
+	// background is cancelled to stop the work done outside requests on shutdown.
+	background, stopBackground := context.WithCancel(context.Background())
+	tlsConfig, certificate, err := newTLSConfig(tlsCertFile, tlsKeyFile, tlsClientCAFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if certificate != nil {
+		serverCertificate.Store(certificate)
+		go certificate.watch(certReloadInterval, background.Done())
+	}
+
+	if err := reloadAPIKeys(); err != nil {
+		log.Fatal(err)
+	}
+	if err := reloadSigningSecrets(); err != nil {
+		log.Fatal(err)
+	}
+	if metricsCredentials, err = resolveMetricsCredentials(metricsUsername, metricsPassword, metricsHtpasswdPath); err != nil {
+		log.Fatal(err)
+	}
+	if quotaStateFile != "" {
+		if quotaUsage, err = loadQuotaStore(quotaStateFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if jwksURL != "" {
+		cache := newJWKSCache(jwksURL)
+		// The identity provider may be briefly down, so start anyway; the first token
+		// fetches the keys again.
+		if err := cache.refresh(); err != nil {
+			log.Printf("fetching the JWKS failed, retrying on the first token: %v", err)
+		}
+		jwks.Store(cache)
+	}
+	if introspectionURL != "" {
+		introspection.Store(newIntrospector(introspectionURL, introspectionClientID, introspectionClientSecret))
+	}
+
+	if webhookSubscriptionsFile != "" {
+		if webhookSubscriptions, err = loadSubscriptionStore(webhookSubscriptionsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if webhookStateFile != "" {
+		d, err := loadWebhookDispatcher(webhookStateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhooks.Store(d)
+	} else {
+		webhooks.Store(newWebhookDispatcher())
+	}
+	publisher, err := newEventPublisher(eventPublisherName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventPublisher.Store(newAsyncPublisher(publisher, eventBufferSize))
+
+	if shadowRulesConfigPath != "" {
+		shadowConfig, err := loadRulesConfig(shadowRulesConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shadow.Store(newShadowScorer(newEngine(shadowConfig)))
+	}
+
+	if experimentRulesConfigPath != "" {
+		experimentConfig, err := loadRulesConfig(experimentRulesConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		e, err := newExperiment(newEngine(experimentConfig), experimentPercent)
+		if err != nil {
+			log.Fatal(err)
+		}
+		experiment.Store(e)
+	}
+
+	tracerProvider, err := newTracerFromEnv(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tracerProvider != nil {
+		tracing.Store(tracerProvider)
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go reloadOnSignal(hangups)
+	go func() {
+		<-background.Done()
+		signal.Stop(hangups)
+		close(hangups)
+	}()
+
+	receipts = make(ReceiptsMap)
+	if err := seedReceipts(background); err != nil {
+		log.Fatal(err)
+	}
+	api, err := listen(listenAddr, newServer(logRoutes(listenAddr, newRouter()), tlsConfig))
+	if err != nil {
+		log.Fatal(err)
+	}
+	endpoints := []endpoint{api}
+	if healthAddr != "" {
+		health, err := listen(healthAddr, newServer(logRoutes(healthAddr, newHealthRouter()), nil))
+		if err != nil {
+			log.Fatal(err)
+		}
+		endpoints = append(endpoints, health)
+	}
+	if adminAddr != "" {
+		admin, err := listen(adminAddr, newServer(logRoutes(adminAddr, newAdminRouter()), tlsConfig))
+		if err != nil {
+			log.Fatal(err)
+		}
+		endpoints = append(endpoints, admin)
+	}
+	if grpcAddr != "" {
+		grpc, err := listen(grpcAddr, newGRPCServer(logRoutes(grpcAddr, newGRPCRouter()), tlsConfig))
+		if err != nil {
+			log.Fatal(err)
+		}
+		endpoints = append(endpoints, grpc)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	err = serveAll(stop, endpoints...)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	closeState(ctx, stopBackground, tracerProvider)
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newRouter() *gin.Engine {
+	router := newGinEngine()
+	links := &linkRoutes{}
+	router.Use(recordClientCert(), linkReceipts(links))
+	if len(cors.allowedOrigins) > 0 {
+		router.Use(handleCORS(cors))
+	}
+	router.GET("/health", getHealth)
+	router.GET("/ready", getReady)
+	router.GET("/version", getVersion)
+	router.GET("/metrics", requireMetricsAuth(), metricsHandler)
+	docs := &openAPIDocument{}
+	router.GET("/openapi.json", docs.serve)
+	if enableDocs {
+		router.GET("/docs", serveDocs)
+	}
+	if enableUI {
+		router.GET("/", uiHeaders(), serveUI)
+		router.GET("/ui/*filepath", uiHeaders(), serveUIFile)
+	}
+
+	if adminAddr == "" {
+		addAdminRoutes(router)
+	}
+
+	// Receipts are counted against the quota once an Idempotency-Key has been checked,
+	// so a replayed response doesn't use up the quota.
+	write := router.Group("", rejectWrites(), limitRequestTime(requestTimeout), limitConcurrency(&apiSlots), limitRate(), authenticate(scopeWrite), limitAPIKey(false))
+	write.POST("/receipts/process",
+		limitRouteClass(processClass),
+		auditAction(auditReceiptProcessed),
+		limitBodySize(int64(maxBodyBytes)),
+		verifySignature(),
+		idempotent(),
+		countQuota(),
+		requireContentType(append(receiptMediaTypes(), uploadMediaType)...),
+		unpackUpload(),
+		guardJSON(jsonOptions),
+		processReceipts)
+	write.POST("/receipts/scan",
+		limitRouteClass(processClass),
+		auditAction(auditReceiptProcessed),
+		countQuota(),
+		limitBodySize(int64(maxScanBytes)),
+		requireContentType(uploadMediaType),
+		scanReceipt)
+
+	// The stream and the WebSocket last as long as the client stays, so they have no
+	// deadlines and hold no --max-in-flight slot.
+	router.GET("/receipts/stream", extendDeadlines(0), limitRate(), authenticate(scopeRead), limitAPIKey(false), streamReceipts)
+	router.GET("/ws", limitRate(), authenticate(scopeRead), limitAPIKey(false), serveLiveUpdates)
+
+	read := router.Group("", limitRequestTime(requestTimeout), limitConcurrency(&apiSlots), limitRate(), authenticate(scopeRead), limitAPIKey(false))
+	read.POST("/receipts/preview",
+		limitRouteClass(processClass),
+		limitBodySize(int64(maxBodyBytes)),
+		requireContentType(receiptMediaTypes()...),
+		guardJSON(jsonOptions),
+		previewReceipt)
+	read.GET("/receipts/:receipt_id", getReceipt)
+	read.GET("/receipts/:receipt_id/points", getPoints)
+	read.GET("/receipts/:receipt_id/breakdown", getBreakdown)
+	read.GET("/rules", getRules)
+	read.GET("/rules/versions", getRuleVersions)
+	docs.build(router.Routes())
+	links.build(router.Routes())
+	return router
+}
+
+// newAdminRouter serves only the /admin endpoints, and health and version, for the
+// --admin-addr.
+func newAdminRouter() *gin.Engine {
+	router := newGinEngine()
+	router.Use(recordClientCert())
+	router.GET("/health", getHealth)
+	router.GET("/ready", getReady)
+	router.GET("/version", getVersion)
+	addAdminRoutes(router)
+	return router
+}
+
+// adminGuards are the checks in front of the /admin endpoints.
+func adminGuards() []gin.HandlerFunc {
+	return []gin.HandlerFunc{extendDeadlines(adminWriteTimeout), limitRequestTime(adminWriteTimeout), requireAdminNetwork(), limitConcurrency(&adminSlots), limitRate(), requireAdminToken(), requireAPIKey(scopeAdmin), limitAPIKey(false)}
+}
+
+// addAdminRoutes adds the /admin endpoints, and the /debug ones if enabled, to router.
+func addAdminRoutes(router *gin.Engine) {
+	addDebugRoutes(router)
+	admin := router.Group("/admin", adminGuards()...)
+	admin.POST("/rules/reload", auditAction(auditRulesReloaded), reloadRulesHandler)
+	admin.POST("/rules/simulate",
+		limitRouteClass(simulateClass),
+		limitBodySize(int64(maxBodyBytes)),
+		requireContentType("application/json"),
+		guardJSON(jsonOptions),
+		simulateRules)
+	admin.GET("/shadow/summary", shadowSummaryHandler)
+	admin.GET("/experiment/summary", experimentSummaryHandler)
+	admin.GET("/api-keys", listAPIKeys)
+	admin.GET("/quotas", quotasHandler)
+	admin.GET("/load", loadHandler)
+	admin.GET("/audit", limitRouteClass(exportClass), auditHandler)
+	admin.PATCH("/users/:user_id",
+		auditAction(auditUserTierChanged),
+		limitBodySize(int64(maxBodyBytes)),
+		requireContentType("application/json"),
+		guardJSON(jsonOptions),
+		setUserTier)
+	admin.DELETE("/users/:user_id/data", rejectWrites(), auditAction(auditUserErased), eraseUserHandler)
+	admin.GET("/receipts/export", limitRouteClass(exportClass), exportReceipts)
+	admin.GET("/receipts/:receipt_id/trace", getReceiptTrace)
+	admin.POST("/webhooks",
+		auditAction(auditWebhookCreated),
+		limitBodySize(int64(maxBodyBytes)),
+		requireContentType("application/json"),
+		guardJSON(jsonOptions),
+		createSubscription)
+	admin.GET("/webhooks", listSubscriptions)
+	admin.GET("/webhooks/deadletter", deadLetterHandler)
+	admin.POST("/webhooks/deadletter", auditAction(auditWebhooksRedriven), limitBodySize(int64(maxBodyBytes)), redriveHandler)
+	admin.GET("/webhooks/:webhook_id", getSubscription)
+	admin.DELETE("/webhooks/:webhook_id", auditAction(auditWebhookDeleted), deleteSubscription)
+	admin.POST("/webhooks/:webhook_id/test", testSubscription)
+	admin.GET("/maintenance", getMaintenance)
+	admin.POST("/maintenance",
+		auditAction(auditMaintenanceChanged),
+		limitBodySize(int64(maxBodyBytes)),
+		requireContentType("application/json"),
+		setMaintenance)
+}
+
+func processReceipts(c *gin.Context) {
+	defer countSubmission(c)
+	// Score with the rules in effect when the request arrived, even if they are
+	// reloaded while it is being processed.
+	engine := currentEngine()
+
+	// A JSON array is a batch of receipts, which clients post here by mistake as
+	// often as not.
+	if requestFormat(c) == jsonFormat {
+		start, err := peekJSONStart(c)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			abortWithBodyTooLarge(c, maxBytesErr.Limit)
+			return
+		case err != nil:
+			rejectReceipt(c, reasonBodyInvalid, "Failed to parse the request body")
+			return
+		case start == '[':
+			processBatch(c, engine)
+			return
+		case start != '{':
+			rejectReceipt(c, reasonBodyInvalid, "Failed to parse the request body: expected a JSON object, or an array of them for a batch")
+			return
+		}
+	}
+
+	_, validation := startSpan(c.Request.Context(), "validate receipt")
+	receipt, ok := bindReceipt(c, engine)
+	if !ok {
+		validation.SetStatus(codes.Error, "invalid receipt")
+	}
+	validation.End()
+	if !ok {
+		return
+	}
+
+	receiptID := newReceiptID(receipt)
+	receipt.ProcessedAt = clock.Now()
+	points, err := scoreAndStore(c.Request.Context(), receiptID, receipt, engine, c.GetString("user"))
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+
+	c.Set("auditTarget", receiptID)
+	if c.GetBool("redirectToUI") {
+		c.Redirect(http.StatusSeeOther, uiReceiptPath(receiptID))
+	} else {
+		body := gin.H{"id": receiptID}
+		if links := receiptLinksFor(c, receiptID, c.GetString("user")); links != nil {
+			body["_links"] = links
+		}
+		respond(c, http.StatusOK, body)
+	}
+
+	if s := shadow.Load(); s != nil {
+		s.score(receiptID, c.GetString("requestID"), receipt, points)
+	}
+}
+
+// previewReceipt scores a receipt with the rules in effect without storing it, so
+// clients can show the points before submitting. Receipts in an experiment are
+// assigned a variant by their ID, so a preview is scored with the current rules.
+func previewReceipt(c *gin.Context) {
+	engine := currentEngine()
+	receipt, ok := bindReceipt(c, engine)
+	if !ok {
+		return
+	}
+	receipt.ProcessedAt = clock.Now()
+	receipt.Tier = userTiers.tier(c.GetString("user"))
+	points, breakdown, err := engine.ScoreReceiptContext(c.Request.Context(), receipt)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"points": points, "breakdown": breakdown, "rulesVersion": engine.hash})
+}
+
+// scoreAndStore scores a validated receipt as receiptID with engine, or the engine of
+// the experiment variant it is assigned, in the loyalty tier of owner, stores it for
+// owner and sends its webhook.
+func scoreAndStore(ctx context.Context, receiptID string, receipt Receipt, engine *Engine, owner string) (int, error) {
+	receipt.Tier = userTiers.tier(owner)
+	var variant string
+	if e := experiment.Load(); e != nil {
+		variant, engine = e.assign(receiptID, engine)
+	}
+	_, scoring := startSpan(ctx, "score receipt")
+	scoring.SetAttributes(
+		attribute.String("receipt.id", receiptID),
+		attribute.Int("rules.count", len(engine.rules)),
+		attribute.String("rules.version", engine.hash),
+	)
+	points, breakdown, err := engine.ScoreReceiptContext(ctx, receipt)
+	scoring.End()
+	if err != nil {
+		return 0, err
+	}
+	observePoints(points, receipt.Total)
+	_, storage := startSpan(ctx, "store receipt")
+	storage.SetAttributes(attribute.String("receipt.id", receiptID))
+	stored := StoredReceipt{Receipt: receipt, Points: points, Breakdown: breakdown, RulesVersion: engine.hash, Variant: variant, Owner: owner}
+	err = receiptsStore.put(ctx, receiptID, stored)
+	if err != nil {
+		storage.SetStatus(codes.Error, err.Error())
+	}
+	storage.End()
+	if err == nil {
+		notifyProcessed(receiptID, stored)
+	}
+	return points, err
+}
+
+// bindReceipt parses and validates the receipt in the request body, in any of the
+// bodyFormats, normalizing its amounts, or responds with why it is invalid.
+func bindReceipt(c *gin.Context, engine *Engine) (Receipt, bool) {
+	receipt, err := requestFormat(c).decodeReceipt(c.Request.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return receipt, false
+	}
+	var decodeErr *receiptDecodeError
+	if errors.As(err, &decodeErr) {
+		rejectReceipt(c, decodeErr.reason, decodeErr.message)
+		return receipt, false
+	}
+	if err != nil {
+		rejectReceipt(c, reasonBodyInvalid, "Failed to parse the request body")
+		return receipt, false
+	}
+	if reason, message := validateReceipt(&receipt, engine); reason != "" {
+		rejectReceipt(c, reason, message)
+		return receipt, false
+	}
+	return receipt, true
+}
+
+// validateReceipt checks a parsed receipt, normalizing its amounts, and returns why it
+// is invalid, or an empty reason if it isn't.
+func validateReceipt(receipt *Receipt, engine *Engine) (validationReason, string) {
+	// Validate retailer name
+	if receipt.Retailer == "" {
+		return reasonRetailerMissing, "Retailer name is required"
+	}
+
+	// Validate total amount
+	if receipt.Total == "" {
+		return reasonTotalMissing, "Total amount is required"
+	}
+	total, err := normalizeMoney(receipt.Total, lenientMoney)
+	if err != nil {
+		return reasonTotalInvalidFormat, "Invalid total amount"
+	}
+	receipt.Total = total
+
+	// Validate purchase date
+	if receipt.PurchaseDate == "" {
+		return reasonPurchaseDateMissing, "Purchase date is required"
+	}
+
+	// Validate purchase time
+	if receipt.PurchaseTime == "" {
+		return reasonPurchaseTimeMissing, "Purchase time is required"
+	}
+	if receipt.Timezone != "" {
+		if _, err := time.LoadLocation(receipt.Timezone); err != nil || receipt.Timezone == "Local" {
+			return reasonTimezoneInvalid, "Invalid timezone"
+		}
+	}
+
+	// Validate items
+	if len(receipt.Items) == 0 {
+		return reasonItemsMissing, "Receipt should have at least one item"
+	}
+	for i, item := range receipt.Items {
+		if item.ShortDescription == "" {
+			return reasonItemDescriptionMissing, "Item short description is required"
+		}
+		price, err := normalizeMoney(item.Price, lenientMoney)
+		if err != nil {
+			return reasonItemPriceInvalid, "Invalid item price"
+		}
+		receipt.Items[i].Price = price
+		receipt.Items[i].NormalizedDescription = normalizeDescription(item.ShortDescription, engine.config)
+	}
+	return "", ""
+}
+
+// lookupReceipt returns the receipt named in the path, or responds 404 if there is none
+// the caller can access. Other users' receipts are reported as missing so their IDs
+// aren't confirmed.
+func lookupReceipt(c *gin.Context) (StoredReceipt, bool) {
+	_, storage := startSpan(c.Request.Context(), "load receipt")
+	storage.SetAttributes(attribute.String("receipt.id", c.Param("receipt_id")))
+	stored, ok, err := receiptsStore.get(c.Request.Context(), c.Param("receipt_id"))
+	if err != nil {
+		storage.SetStatus(codes.Error, err.Error())
+		storage.End()
+		abortWithStoreError(c, err)
+		return StoredReceipt{}, false
+	}
+	storage.SetAttributes(attribute.Bool("receipt.found", ok))
+	storage.End()
+	if !ok || !canAccess(c, stored) {
+		receiptLookupsNotFound.inc()
+		abortWithError(c, http.StatusNotFound, "RECEIPT_NOT_FOUND", "Receipt not found")
+		return StoredReceipt{}, false
+	}
+	return stored, true
+}
+
+func getReceipt(c *gin.Context) {
+	stored, ok := lookupReceipt(c)
+	if !ok {
+		return
+	}
+
+	if jsonAPIRequested(c) {
+		respondResource(c, stored.Receipt)
+		return
+	}
+	if links := receiptLinksFor(c, c.Param("receipt_id"), stored.Owner); links != nil {
+		c.JSON(http.StatusOK, struct {
+			Receipt
+			Links *receiptLinks `json:"_links"`
+		}{stored.Receipt, links})
+		return
+	}
+	c.JSON(http.StatusOK, stored.Receipt)
+}
+
+func getPoints(c *gin.Context) {
+	stored, ok := lookupReceipt(c)
+	if !ok {
+		return
+	}
+
+	body := gin.H{"points": stored.Points, "rulesVersion": stored.RulesVersion}
+	if expiresAt, ok := pointsExpiry(stored.Receipt); ok {
+		expired := !clock.Now().Before(expiresAt)
+		if expired && expiredPointsGone {
+			abortWithProblem(c, http.StatusGone, "POINTS_EXPIRED", "the points of this receipt expired at "+expiresAt.Format(time.RFC3339))
+			return
+		}
+		body["expiresAt"] = expiresAt
+		body["expired"] = expired
+		if expired {
+			body["points"] = 0
+			body["originalPoints"] = stored.Points
+		}
+	}
+	if jsonAPIRequested(c) {
+		respondResource(c, body)
+		return
+	}
+	if links := receiptLinksFor(c, c.Param("receipt_id"), stored.Owner); links != nil {
+		body["_links"] = links
+	}
+	respond(c, http.StatusOK, body)
+}
+
+func getBreakdown(c *gin.Context) {
+	stored, ok := lookupReceipt(c)
+	if !ok {
+		return
+	}
+
+	body := gin.H{"points": stored.Points, "breakdown": stored.Breakdown, "rulesVersion": stored.RulesVersion}
+	if stored.Variant != "" {
+		body["variant"] = stored.Variant
+	}
+	if jsonAPIRequested(c) {
+		respondResource(c, body)
+		return
+	}
+	if links := receiptLinksFor(c, c.Param("receipt_id"), stored.Owner); links != nil {
+		body["_links"] = links
+	}
+	respond(c, http.StatusOK, body)
+}
+
+// version is the version of the service, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// getHealth reports the process alive, with a maintenance banner while read-only.
+func getHealth(c *gin.Context) {
+	if readOnly.Load() {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "maintenance": "read-only: changes are rejected until maintenance ends"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func getVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": version, "rulesVersion": currentEngine().hash})
+}
+
+func getRules(c *gin.Context) {
+	type ruleInfo struct {
+		Name    string      `json:"name"`
+		Enabled bool        `json:"enabled"`
+		Custom  *CustomRule `json:"custom,omitempty"`
+	}
+	engine := currentEngine()
+	infos := make([]ruleInfo, 0, len(engine.rules))
+	for _, rule := range engine.rules {
+		info := ruleInfo{Name: rule.Name(), Enabled: engine.config.ruleEnabled(rule.Name())}
+		if custom, ok := rule.(*customRule); ok {
+			info.Custom = &custom.definition
+		}
+		infos = append(infos, info)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": infos, "config": engine.config, "hash": engine.hash, "loadedAt": engine.loadedAt})
+}
+
+// getRuleVersions lists the rules versions that scored the stored receipts, with how
+// many receipts each scored, in version order.
+func getRuleVersions(c *gin.Context) {
+	type versionInfo struct {
+		Version  string `json:"version"`
+		Receipts int    `json:"receipts"`
+		Current  bool   `json:"current"`
+	}
+	counts := make(map[string]int)
+	receiptsMu.RLock()
+	for _, stored := range receipts {
+		counts[stored.RulesVersion]++
+	}
+	receiptsMu.RUnlock()
+
+	current := currentEngine().hash
+	versions := make([]versionInfo, 0, len(counts))
+	for version, count := range counts {
+		versions = append(versions, versionInfo{Version: version, Receipts: count, Current: version == current})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
+}
+
+func calculatePoints(receipt Receipt) int {
+	points, _ := currentEngine().ScoreReceipt(receipt)
+	return points
+}
+
+func countAlphanumeric(s string) int {
+	count := 0
+	for _, ch := range s {
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestProcessReceipts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+
+	// Create a new Gin router
+	router := newRouter()
+
+	testCases := []struct {
+		name           string
+		payload        string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name: "ValidInput",
+			payload: `{
+				"retailer": "Target",
+				"total": "35.35",
+				"items": [
+					{
+						"shortDescription": "Mountain Dew 12PK",
+						"price": "6.49"
+					},
+					{
+						"shortDescription": "Emils Cheese Pizza",
+						"price": "12.25"
+					},
+					{
+						"shortDescription": "Knorr Creamy Chicken",
+						"price": "1.26"
+					},
+					{
+						"shortDescription": "Doritos Nacho Cheese",
+						"price": "3.35"
+					},
+					{
+						"shortDescription": "Klarbrunn 12-PK 12 FL OZ",
+						"price": "12.00"
+					}
+				],
+				"purchaseDate": "2022-01-01",
+				"purchaseTime": "13:01"
+			}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"_links":{"self":{"href":"/receipts/<generated-id>"},"points":{"href":"/receipts/<generated-id>/points"},"breakdown":{"href":"/receipts/<generated-id>/breakdown"}},"id":"<generated-id>"}`,
+		},
+		{
+			name: "InvalidInput",
+			payload: `{
+				"retailer": "Target",
+				"total": "",
+				"items": [],
+				"purchaseDate": "",
+				"purchaseTime": "13:01"
+			}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"Total amount is required","requestId":"req-InvalidInput"}`,
+		},
+		// Add more test cases here
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(tc.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Request-ID", "req-"+tc.name)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v but got %v", tc.expectedStatus, rr.Code)
+			}
+
+			// Check the response body, substituting the generated ID which can't be known up front
+			expectedBody := tc.expectedBody
+			if strings.Contains(expectedBody, "<generated-id>") {
+				var response struct {
+					ID string `json:"id"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := uuid.Parse(response.ID); err != nil {
+					t.Errorf("expected a UUID receipt ID but got %q", response.ID)
+				}
+				expectedBody = strings.ReplaceAll(expectedBody, "<generated-id>", response.ID)
+			}
+			if rr.Body.String() != expectedBody {
+				t.Errorf("expected response body %q but got %q", expectedBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRulesVersions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	router := newRouter()
+
+	setRules(defaultRulesConfig())
+	oldVersion := currentEngine().hash
+	oldID, _ := processAndScore(t, router, validReceiptPayload)
+
+	config := defaultRulesConfig()
+	config.ItemPairPoints = 10
+	setRules(config)
+	newVersion := currentEngine().hash
+	if newVersion == oldVersion {
+		t.Fatal("expected a new rules version after changing the config")
+	}
+	processAndScore(t, router, validReceiptPayload)
+	processAndScore(t, router, validReceiptPayload)
+
+	// The old receipt keeps the version it was scored with.
+	for _, path := range []string{"/points", "/breakdown"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+oldID+path, nil))
+		var body struct {
+			RulesVersion string `json:"rulesVersion"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.RulesVersion != oldVersion {
+			t.Errorf("expected %s to report version %s but got %q", path, oldVersion, body.RulesVersion)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/rules/versions", nil))
+	var body struct {
+		Versions []struct {
+			Version  string `json:"version"`
+			Receipts int    `json:"receipts"`
+			Current  bool   `json:"current"`
+		} `json:"versions"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, v := range body.Versions {
+		counts[v.Version] = v.Receipts
+		if v.Current != (v.Version == newVersion) {
+			t.Errorf("expected only %s to be current but got %+v", newVersion, v)
+		}
+	}
+	if len(body.Versions) != 2 || counts[oldVersion] != 1 || counts[newVersion] != 2 {
+		t.Errorf("expected 1 receipt for the old version and 2 for the new but got %+v", body.Versions)
+	}
+}
+
+func TestPreviewReceipt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/receipts/preview", strings.NewReader(validReceiptPayload))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(rr, req)
+	var body breakdownResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected the preview but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if body.Points != 28 || len(body.Breakdown) == 0 || body.RulesVersion != currentEngine().hash {
+		t.Errorf("expected 28 points explained by the current rules but got %+v", body)
+	}
+	if len(receipts) != 0 {
+		t.Errorf("expected the preview not to be stored but %d receipts are", len(receipts))
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/receipts/preview", strings.NewReader(`{"retailer":"Target"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"error"`) {
+		t.Errorf("expected an invalid receipt to be rejected but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteSize is a flag.Value for sizes such as "512KiB", "1MiB" or a plain byte count.
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	for _, unit := range byteSizeUnits[:3] {
+		if *b != 0 && int64(*b)%unit.multiplier == 0 && int64(*b)/unit.multiplier < 1024 {
+			return fmt.Sprintf("%d%s", int64(*b)/unit.multiplier, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	number, multiplier := strings.TrimSpace(s), int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// rate is a flag.Value for request rates such as "100/s", "600/m" or "3600/h". "0"
+// disables whatever it limits.
+type rate struct {
+	count int
+	per   time.Duration
+}
+
+var rateUnits = []struct {
+	suffix string
+	per    time.Duration
+}{
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+}
+
+func (r *rate) String() string {
+	for _, unit := range rateUnits {
+		if r.count != 0 && r.per == unit.per {
+			return fmt.Sprintf("%d/%s", r.count, unit.suffix)
+		}
+	}
+	return "0"
+}
+
+func (r *rate) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if s == "0" {
+		*r = rate{}
+		return nil
+	}
+	number, suffix, ok := strings.Cut(s, "/")
+	if ok {
+		for _, unit := range rateUnits {
+			if suffix == unit.suffix {
+				n, err := strconv.Atoi(number)
+				if err != nil || n <= 0 {
+					break
+				}
+				*r = rate{count: n, per: unit.per}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid rate %q, expected a count per s, m or h such as 100/s", s)
+}
+
+// perSecond returns the rate in requests per second.
+func (r rate) perSecond() float64 {
+	if r.count == 0 {
+		return 0
+	}
+	return float64(r.count) / r.per.Seconds()
+}
+
+// stringList is a flag.Value for comma separated lists such as "GET, POST". Blank
+// entries are dropped.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// bucketList is a flag.Value for the ascending upper bounds of histogram buckets, such
+// as "0,10,25,50". Observations above the last bound are counted in +Inf.
+type bucketList []float64
+
+func (l *bucketList) String() string {
+	bounds := make([]string, len(*l))
+	for i, bound := range *l {
+		bounds[i] = strconv.FormatFloat(bound, 'g', -1, 64)
+	}
+	return strings.Join(bounds, ",")
+}
+
+func (l *bucketList) Set(s string) error {
+	var bounds bucketList
+	for _, item := range strings.Split(s, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil || math.IsInf(bound, 0) || math.IsNaN(bound) {
+			return fmt.Errorf("invalid bucket bound %q", strings.TrimSpace(item))
+		}
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return fmt.Errorf("bucket bounds must be ascending but %v follows %v", bound, bounds[len(bounds)-1])
+		}
+		bounds = append(bounds, bound)
+	}
+	*l = bounds
+	return nil
+}
+
+// fileMode is a flag.Value for permission bits in octal, such as 0660.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m).Perm())
+}
+
+func (m *fileMode) Set(s string) error {
+	bits, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil || bits > 0o777 {
+		return fmt.Errorf("invalid permissions %q, expected octal such as 0660", s)
+	}
+	*m = fileMode(bits)
+	return nil
+}
+
+// parsedValue is a flag.Value that parses its value with parse and reports it as it was
+// given, for options kept in a form that doesn't print back.
+type parsedValue struct {
+	value string
+	parse func(string) error
+}
+
+func (v *parsedValue) String() string {
+	return v.value
+}
+
+func (v *parsedValue) Set(s string) error {
+	if err := v.parse(s); err != nil {
+		return err
+	}
+	v.value = s
+	return nil
+}
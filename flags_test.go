@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestByteSizeSet(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected byteSize
+		valid    bool
+	}{
+		{input: "1024", expected: 1024, valid: true},
+		{input: "512B", expected: 512, valid: true},
+		{input: "64KiB", expected: 64 << 10, valid: true},
+		{input: "1MiB", expected: 1 << 20, valid: true},
+		{input: "2 GiB", expected: 2 << 30, valid: true},
+		{input: "10MB", expected: 10 * 1000 * 1000, valid: true},
+		{input: "-1"},
+		{input: "1.5MiB"},
+		{input: "MiB"},
+		{input: "1TiB"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			var size byteSize
+			err := size.Set(tc.input)
+			if tc.valid && err != nil {
+				t.Fatalf("expected %q to be accepted but got %v", tc.input, err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("expected %q to be rejected but got %v", tc.input, size)
+			}
+			if size != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, size)
+			}
+		})
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	testCases := map[byteSize]string{
+		0:       "0",
+		100:     "100",
+		1 << 20: "1MiB",
+		1536:    "1536",
+		4 << 10: "4KiB",
+	}
+	for size, expected := range testCases {
+		if got := size.String(); got != expected {
+			t.Errorf("expected %q but got %q", expected, got)
+		}
+	}
+}
+
+func TestRateSet(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected rate
+		valid    bool
+	}{
+		{input: "100/s", expected: rate{100, time.Second}, valid: true},
+		{input: "600/m", expected: rate{600, time.Minute}, valid: true},
+		{input: " 3600/h ", expected: rate{3600, time.Hour}, valid: true},
+		{input: "0", valid: true},
+		{input: "100"},
+		{input: "0/s"},
+		{input: "-5/s"},
+		{input: "1.5/s"},
+		{input: "100/d"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			var r rate
+			err := r.Set(tc.input)
+			if tc.valid && err != nil {
+				t.Fatalf("expected %q to be accepted but got %v", tc.input, err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("expected %q to be rejected but got %v", tc.input, r)
+			}
+			if r != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, r)
+			}
+		})
+	}
+
+	r := rate{600, time.Minute}
+	if got := r.String(); got != "600/m" {
+		t.Errorf("expected 600/m but got %q", got)
+	}
+	if got := r.perSecond(); got != 10 {
+		t.Errorf("expected 10 per second but got %v", got)
+	}
+}
+
+func TestStringListSet(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected stringList
+	}{
+		{input: "GET, POST", expected: stringList{"GET", "POST"}},
+		{input: " https://a.example ,,https://b.example, ", expected: stringList{"https://a.example", "https://b.example"}},
+		{input: ""},
+	}
+
+	for _, tc := range testCases {
+		l := stringList{"previous"}
+		if err := l.Set(tc.input); err != nil {
+			t.Fatalf("expected %q to be accepted but got %v", tc.input, err)
+		}
+		if !reflect.DeepEqual(l, tc.expected) {
+			t.Errorf("%q: expected %q but got %q", tc.input, tc.expected, l)
+		}
+	}
+
+	l := stringList{"GET", "POST"}
+	if got := l.String(); got != "GET, POST" {
+		t.Errorf("expected \"GET, POST\" but got %q", got)
+	}
+}
+
+func TestBucketListSet(t *testing.T) {
+	testCases := []struct {
+		input         string
+		expected      bucketList
+		expectedError bool
+	}{
+		{input: "0,10,25,50,100,250,500", expected: bucketList{0, 10, 25, 50, 100, 250, 500}},
+		{input: " 0.5, 1 ,2.5", expected: bucketList{0.5, 1, 2.5}},
+		{input: "-1", expected: bucketList{-1}},
+		{input: "10,5", expectedError: true},
+		{input: "1,1", expectedError: true},
+		{input: "1,,2", expectedError: true},
+		{input: "1,+Inf", expectedError: true},
+		{input: "NaN", expectedError: true},
+		{input: "", expectedError: true},
+	}
+
+	for _, tc := range testCases {
+		l := bucketList{42}
+		err := l.Set(tc.input)
+		if tc.expectedError {
+			if err == nil || !reflect.DeepEqual(l, bucketList{42}) {
+				t.Errorf("%q: expected an error leaving the buckets unchanged but got %v, %v", tc.input, l, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(l, tc.expected) {
+			t.Errorf("%q: expected %v but got %v, %v", tc.input, tc.expected, l, err)
+		}
+	}
+
+	l := bucketList{0, 0.5, 500}
+	if got := l.String(); got != "0,0.5,500" {
+		t.Errorf("expected \"0,0.5,500\" but got %q", got)
+	}
+}
+
+func TestFileModeSet(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected fileMode
+		valid    bool
+	}{
+		{input: "0660", expected: 0o660, valid: true},
+		{input: "600", expected: 0o600, valid: true},
+		{input: "0777", expected: 0o777, valid: true},
+		{input: "0680"},
+		{input: "1777"},
+		{input: "rw-rw----"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			var mode fileMode
+			err := mode.Set(tc.input)
+			if tc.valid && err != nil {
+				t.Fatalf("expected %q to be accepted but got %v", tc.input, err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("expected %q to be rejected but got %v", tc.input, mode.String())
+			}
+			if mode != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, mode)
+			}
+			if tc.valid && mode.String() != fmt.Sprintf("%#o", tc.expected) {
+				t.Errorf("expected %#o to print back but got %s", tc.expected, mode.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// bodyFormat is an encoding request and response bodies can be in: the media types
+// that name it, how a receipt is decoded from it, and how a response is encoded in it.
+type bodyFormat struct {
+	mediaTypes []string
+	// binary formats are sent without a charset parameter.
+	binary        bool
+	decodeReceipt func(io.Reader) (Receipt, error)
+	// encode is nil for formats receipts can be submitted in but responses aren't
+	// sent in.
+	encode func(gin.H) ([]byte, error)
+}
+
+var (
+	jsonFormat = &bodyFormat{
+		mediaTypes:    []string{gin.MIMEJSON},
+		decodeReceipt: decodeJSONReceipt,
+		encode:        func(body gin.H) ([]byte, error) { return json.Marshal(body) },
+	}
+	yamlFormat = &bodyFormat{
+		mediaTypes:    []string{"application/yaml", "text/yaml"},
+		decodeReceipt: decodeYAMLReceipt,
+		encode:        func(body gin.H) ([]byte, error) { return yaml.Marshal(body) },
+	}
+	xmlFormat = &bodyFormat{
+		mediaTypes:    []string{"application/xml", "text/xml"},
+		decodeReceipt: decodeXMLReceipt,
+		encode:        marshalXMLResponse,
+	}
+	cborFormat = &bodyFormat{
+		mediaTypes:    []string{"application/cbor"},
+		binary:        true,
+		decodeReceipt: cbor.decodeReceipt,
+		encode:        cbor.encode,
+	}
+	msgpackFormat = &bodyFormat{
+		mediaTypes:    []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+		binary:        true,
+		decodeReceipt: msgpack.decodeReceipt,
+		encode:        msgpack.encode,
+	}
+	protobufFormat = &bodyFormat{
+		mediaTypes:    []string{"application/x-protobuf"},
+		binary:        true,
+		decodeReceipt: decodeProtoReceipt,
+		encode:        marshalProtoResponse,
+	}
+	formFormat = &bodyFormat{
+		mediaTypes:    []string{"application/x-www-form-urlencoded"},
+		decodeReceipt: decodeFormReceipt,
+	}
+)
+
+// bodyFormats are the formats negotiateFormats chooses from, JSON, the default,
+// first. Adding a format here makes it available to every endpoint that submits
+// receipts, and, if it encodes, that responds with respond.
+var bodyFormats = []*bodyFormat{jsonFormat, yamlFormat, xmlFormat, cborFormat, msgpackFormat, protobufFormat, formFormat}
+
+// formatFor returns the format mediaType names, or nil if none does.
+func formatFor(mediaType string) *bodyFormat {
+	for _, format := range bodyFormats {
+		if containsString(format.mediaTypes, mediaType) {
+			return format
+		}
+	}
+	return nil
+}
+
+// receiptMediaTypes are the media types receipts can be submitted in.
+func receiptMediaTypes() []string {
+	var mediaTypes []string
+	for _, format := range bodyFormats {
+		mediaTypes = append(mediaTypes, format.mediaTypes...)
+	}
+	return mediaTypes
+}
+
+// responseMediaTypes are the media types responses can be sent in.
+func responseMediaTypes() []string {
+	var mediaTypes []string
+	for _, format := range bodyFormats {
+		if format.encode != nil {
+			mediaTypes = append(mediaTypes, format.mediaTypes...)
+		}
+	}
+	return mediaTypes
+}
+
+// negotiateFormats records the format of the request body, by its Content-Type, and
+// the media type to respond in, by the Accept header, JSON unless the client asks
+// for another format. Handlers read them with requestFormat and respond. The
+// jsonAPIRoutes also offer JSON:API.
+func negotiateFormats() gin.HandlerFunc {
+	offered := responseMediaTypes()
+	withJSONAPI := append(responseMediaTypes(), jsonAPIMediaType)
+	return func(c *gin.Context) {
+		if format := formatFor(c.ContentType()); format != nil {
+			c.Set("requestFormat", format)
+		}
+		if c.Request.Method == http.MethodGet && jsonAPIRoutes[c.FullPath()] {
+			c.Set("responseType", c.NegotiateFormat(withJSONAPI...))
+		} else {
+			c.Set("responseType", c.NegotiateFormat(offered...))
+		}
+		c.Next()
+	}
+}
+
+// requestFormat is the format of the request body, JSON unless negotiateFormats found
+// another.
+func requestFormat(c *gin.Context) *bodyFormat {
+	if format, ok := c.Get("requestFormat"); ok {
+		return format.(*bodyFormat)
+	}
+	return jsonFormat
+}
+
+// respond writes body with status in the format negotiateFormats chose.
+func respond(c *gin.Context, status int, body gin.H) {
+	mediaType := c.GetString("responseType")
+	format := formatFor(mediaType)
+	if format == nil || format.encode == nil {
+		format, mediaType = jsonFormat, gin.MIMEJSON
+	}
+	data, err := format.encode(body)
+	if err != nil {
+		abortWithProblem(c, http.StatusInternalServerError, "RESPONSE_UNENCODABLE", err.Error())
+		return
+	}
+	if !format.binary {
+		mediaType += "; charset=utf-8"
+	}
+	c.Data(status, mediaType, data)
+}
+
+// receiptDecodeError reports a receipt that couldn't be decoded, with the validation
+// reason to reject it for.
+type receiptDecodeError struct {
+	reason  validationReason
+	message string
+}
+
+func (e *receiptDecodeError) Error() string {
+	return e.message
+}
+
+// decodeJSONReceipt decodes a JSON receipt. Its errors are reported without detail.
+func decodeJSONReceipt(r io.Reader) (Receipt, error) {
+	var receipt Receipt
+	err := json.NewDecoder(r).Decode(&receipt)
+	return receipt, err
+}
+
+// marshalXMLResponse renders body as a <response> element with an element for each
+// key, in key order, such as <response><id>...</id></response>.
+func marshalXMLResponse(body gin.H) ([]byte, error) {
+	keys := make([]string, 0, len(body))
+	for key := range body {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+	response := xml.StartElement{Name: xml.Name{Local: "response"}}
+	if err := encoder.EncodeToken(response); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := encoder.EncodeElement(body[key], xml.StartElement{Name: xml.Name{Local: key}}); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.EncodeToken(response.End()); err != nil {
+		return nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
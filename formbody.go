@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The --max-form-fields and --max-form-items limits of form-encoded receipts.
+var (
+	maxFormFields = 1000
+	maxFormItems  = 100
+)
+
+// parseFormItemField parses the name of an item field, such as items[0].price, into
+// its index and field.
+func parseFormItemField(name string) (index int, field string, ok bool) {
+	rest, found := strings.CutPrefix(name, "items[")
+	if !found {
+		return 0, "", false
+	}
+	digits, field, found := strings.Cut(rest, "].")
+	if !found || digits == "" || (len(digits) > 1 && digits[0] == '0') {
+		return 0, "", false
+	}
+	index, err := strconv.Atoi(digits)
+	if err != nil || index < 0 {
+		return 0, "", false
+	}
+	return index, field, true
+}
+
+// decodeFormReceipt decodes an application/x-www-form-urlencoded receipt, for devices
+// that can only post forms. The fields of a Receipt are fields of the form, and each
+// item's are indexed, such as items[0].shortDescription and items[0].price, numbered
+// from 0 without gaps. Errors name the field at fault.
+func decodeFormReceipt(r io.Reader) (Receipt, error) {
+	var receipt Receipt
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return receipt, err
+	}
+	invalid := func(format string, args ...any) error {
+		return &receiptDecodeError{reason: reasonBodyInvalid, message: "Failed to parse the request body: " + fmt.Sprintf(format, args...)}
+	}
+	// Count the fields before parsing them, so a huge form isn't held in a map.
+	if fields := strings.Count(string(data), "&") + 1; maxFormFields > 0 && fields > maxFormFields {
+		return receipt, invalid("the form has %d fields, more than the %d allowed", fields, maxFormFields)
+	}
+
+	seen := map[string]bool{}
+	items := map[int]*Item{}
+	for _, pair := range strings.Split(string(data), "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, rawValue, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			return receipt, invalid("the field name %q is not URL-encoded", rawName)
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return receipt, invalid("the value of %s is not URL-encoded", name)
+		}
+		if seen[name] {
+			return receipt, invalid("%s is given more than once", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "retailer":
+			receipt.Retailer = value
+		case "total":
+			receipt.Total = value
+		case "purchaseDate":
+			receipt.PurchaseDate = value
+		case "purchaseTime":
+			receipt.PurchaseTime = value
+		case "timezone":
+			receipt.Timezone = value
+		default:
+			index, field, ok := parseFormItemField(name)
+			if !ok {
+				return receipt, invalid("%s is not a receipt field", name)
+			}
+			if maxFormItems > 0 && index >= maxFormItems {
+				return receipt, invalid("%s is past the %d items allowed", name, maxFormItems)
+			}
+			item := items[index]
+			if item == nil {
+				item = &Item{}
+				items[index] = item
+			}
+			switch field {
+			case "shortDescription":
+				item.ShortDescription = value
+			case "price":
+				item.Price = value
+			case "upc":
+				item.UPC = value
+			default:
+				return receipt, invalid("%s is not an item field", name)
+			}
+		}
+	}
+
+	for index := 0; index < len(items); index++ {
+		item := items[index]
+		if item == nil {
+			return receipt, invalid("items[%d] is missing; items are numbered from 0 without gaps", index)
+		}
+		if !seen[fmt.Sprintf("items[%d].shortDescription", index)] {
+			return receipt, &receiptDecodeError{reason: reasonItemDescriptionMissing, message: fmt.Sprintf("items[%d].shortDescription is required", index)}
+		}
+		if !seen[fmt.Sprintf("items[%d].price", index)] {
+			return receipt, &receiptDecodeError{reason: reasonItemPriceInvalid, message: fmt.Sprintf("items[%d].price is required", index)}
+		}
+		receipt.Items = append(receipt.Items, *item)
+	}
+	return receipt, nil
+}
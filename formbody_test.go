@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const formContentType = "application/x-www-form-urlencoded"
+
+// twoItemForm is a form-encoded receipt with two items.
+func twoItemForm() url.Values {
+	return url.Values{
+		"retailer":                  {"M&M Corner Market"},
+		"total":                     {"9.00"},
+		"purchaseDate":              {"2022-03-20"},
+		"purchaseTime":              {"14:33"},
+		"items[0].shortDescription": {"Gatorade"},
+		"items[0].price":            {"2.25"},
+		"items[1].shortDescription": {"Gatorade"},
+		"items[1].price":            {"2.25"},
+		"items[1].upc":              {"012345678905"},
+	}
+}
+
+func TestProcessFormReceipts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	for _, contentType := range []string{formContentType, formContentType + "; charset=UTF-8"} {
+		rr := serveBody(router, http.MethodPost, "/receipts/process", contentType, formContentType+", */*", []byte(twoItemForm().Encode()))
+		var response struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), gin.MIMEJSON) {
+			t.Fatalf("%s: expected a JSON 200 but got %v %s: %s", contentType, rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+		}
+		receiptsMu.RLock()
+		stored := receipts[response.ID]
+		receiptsMu.RUnlock()
+		if stored.Receipt.Retailer != "M&M Corner Market" || len(stored.Receipt.Items) != 2 || stored.Receipt.Items[1].UPC != "012345678905" {
+			t.Errorf("%s: expected the form's receipt but got %+v", contentType, stored.Receipt)
+		}
+		// 14 for the retailer, 50 and 25 for the round total, 5 for the pair of items,
+		// and 10 for the time.
+		if stored.Points != 104 {
+			t.Errorf("%s: expected 104 points but got %d", contentType, stored.Points)
+		}
+	}
+}
+
+func TestFormReceiptErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(fields, items int) { maxFormFields, maxFormItems = fields, items }(maxFormFields, maxFormItems)
+	maxFormFields, maxFormItems = 12, 3
+	router := newRouter()
+
+	without := func(name string) string {
+		form := twoItemForm()
+		form.Del(name)
+		return form.Encode()
+	}
+	with := func(name, value string) string {
+		form := twoItemForm()
+		form.Add(name, value)
+		return form.Encode()
+	}
+	testCases := []struct {
+		name     string
+		body     string
+		code     string
+		contains string
+	}{
+		{"MissingPrice", without("items[1].price"), "ITEM_PRICE_INVALID", "items[1].price is required"},
+		{"MissingDescription", without("items[0].shortDescription"), "ITEM_DESCRIPTION_MISSING", "items[0].shortDescription is required"},
+		{"MissingItem", strings.ReplaceAll(twoItemForm().Encode(), "items%5B1%5D", "items%5B2%5D"), "BODY_INVALID", "items[1] is missing"},
+		{"MissingTotal", without("total"), "TOTAL_MISSING", "Total amount is required"},
+		{"UnknownField", with("tip", "1.00"), "BODY_INVALID", "tip is not a receipt field"},
+		{"UnknownItemField", with("items[0].quantity", "2"), "BODY_INVALID", "items[0].quantity is not an item field"},
+		{"LeadingZero", with("items[01].price", "2.25"), "BODY_INVALID", "items[01].price is not a receipt field"},
+		{"Repeated", with("retailer", "Target"), "BODY_INVALID", "retailer is given more than once"},
+		{"TooManyItems", with("items[3].price", "2.25"), "BODY_INVALID", "items[3].price is past the 3 items allowed"},
+		{"TooManyFields", twoItemForm().Encode() + "&a=1&b=2&c=3&d=4", "BODY_INVALID", "13 fields, more than the 12 allowed"},
+		{"BadEscape", "retailer=%zz", "BODY_INVALID", "the value of retailer is not URL-encoded"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := receiptValidationFailures.value(tc.code)
+			rr := serveBody(router, http.MethodPost, "/receipts/process", formContentType, "", []byte(tc.body))
+			if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tc.contains) {
+				t.Errorf("expected a 400 containing %q but got %v %s", tc.contains, rr.Code, rr.Body.String())
+			}
+			if receiptValidationFailures.value(tc.code) != before+1 {
+				t.Errorf("expected the form rejected for %s", tc.code)
+			}
+		})
+	}
+	if len(receipts) != 0 {
+		t.Errorf("expected no receipts stored but got %d", len(receipts))
+	}
+}
+
+func TestFormContentType(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	body := []byte(twoItemForm().Encode())
+
+	// Forms are held to the same charset as other receipts.
+	rr := serveBody(router, http.MethodPost, "/receipts/process", formContentType+"; charset=iso-8859-1", "", body)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415 for a Latin-1 form but got %v", rr.Code)
+	}
+	// Only receipt submissions take forms.
+	rr = serveBody(router, http.MethodPost, "/receipts/scan", formContentType, "", body)
+	if rr.Code != http.StatusUnsupportedMediaType || !strings.Contains(rr.Body.String(), "multipart/form-data") {
+		t.Errorf("expected status 415 for a form scan but got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = serveBody(router, http.MethodPost, "/admin/rules/simulate", formContentType, "", body)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415 for a form simulation but got %v", rr.Code)
+	}
+	// The form is not JSON, so the JSON guard lets it through.
+	rr = serveBody(router, http.MethodPost, "/receipts/process", formContentType, "", []byte(strings.Repeat("[", 100)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "is not a receipt field") {
+		t.Errorf("expected the form decoder to reject the body but got %v %s", rr.Code, rr.Body.String())
+	}
+}
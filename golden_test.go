@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	updateGolden = flag.Bool("update", false, "rewrite the golden files of TestGolden with the current output")
+	goldenDir    = flag.String("golden-dir", filepath.Join("testdata", "golden"), "directory of golden fixture sets for TestGolden")
+)
+
+// goldenResult is the content of a golden file.
+type goldenResult struct {
+	Points    int              `json:"points"`
+	Breakdown []BreakdownEntry `json:"breakdown"`
+}
+
+// TestGolden processes every fixture receipt and compares its points and breakdown with
+// its golden file. Each subdirectory of -golden-dir is a set of fixtures, NAME.json
+// with the golden output in NAME.golden.json, scored with the set's rules.yaml if it
+// has one and the default rules otherwise. Run with -update to rewrite the golden files
+// after an intended change.
+func TestGolden(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer setRules(currentEngine().config)
+	useFakeClock(t, time.Date(2022, 1, 2, 12, 0, 0, 0, time.UTC))
+
+	sets, err := os.ReadDir(*goldenDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range sets {
+		if set.IsDir() {
+			dir := filepath.Join(*goldenDir, set.Name())
+			t.Run(set.Name(), func(t *testing.T) { runGoldenSet(t, dir) })
+		}
+	}
+}
+
+func runGoldenSet(t *testing.T, dir string) {
+	config := defaultRulesConfig()
+	if path := filepath.Join(dir, "rules.yaml"); fileExists(path) {
+		var err error
+		if config, err = loadRulesConfig(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setRules(config)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		if strings.HasSuffix(fixture, ".golden.json") {
+			continue
+		}
+		fixture := fixture
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		t.Run(name, func(t *testing.T) {
+			payload, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ := processAndScore(t, router, string(payload))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/breakdown", nil))
+			var result goldenResult
+			if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := strings.TrimSuffix(fixture, ".json") + ".golden.json"
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s (run with -update to accept it)\n--- want\n%s--- got\n%s", goldenPath, want, got)
+			}
+		})
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
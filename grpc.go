@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"receipt_api/receiptpb"
+)
+
+// grpcAddr is --grpc-addr, the address ReceiptService of proto/receipt.proto is served
+// on over gRPC, with the TLS settings of --addr, or h2c without them. Empty disables it.
+var grpcAddr string
+
+// grpcCodeFor maps the HTTP status a handler answered with to the status of the call.
+func grpcCodeFor(status int) codes.Code {
+	switch status {
+	case http.StatusOK:
+		return codes.OK
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound, http.StatusGone:
+		return codes.NotFound
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if status >= http.StatusInternalServerError {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// receiptService is the path prefix of the methods of ReceiptService.
+const receiptService = "/fetch.receipts.v1.ReceiptService/"
+
+// newGRPCRouter routes the calls of ReceiptService, by their full method names, to the
+// handlers of the HTTP API behind the same checks. receiptServer dispatches each call
+// to it as a request with the call's message as a protobuf body.
+func newGRPCRouter() *gin.Engine {
+	router := newGinEngine()
+	router.Use(recordClientCert(), serveGRPC())
+
+	write := router.Group(receiptService, rejectWrites(), limitConcurrency(&apiSlots), limitRate(), authenticate(scopeWrite))
+	write.POST("ProcessReceipt",
+		limitRequestTime(requestTimeout),
+		limitAPIKey(true),
+		limitRouteClass(processClass),
+		auditAction(auditReceiptProcessed),
+		verifySignature(),
+		processReceipts)
+	write.POST("ProcessReceipts", limitAPIKey(false), limitRouteClass(processClass), processReceiptStream)
+
+	read := router.Group(receiptService, limitRequestTime(requestTimeout), limitConcurrency(&apiSlots), limitRate(), authenticate(scopeRead), limitAPIKey(false))
+	read.POST("GetPoints", grpcReceiptID(func() receiptIDRequest { return &receiptpb.GetPointsRequest{} }), getPoints)
+	read.POST("GetBreakdown", grpcReceiptID(func() receiptIDRequest { return &receiptpb.GetBreakdownRequest{} }), getBreakdown)
+	return router
+}
+
+// newGRPCServer returns a server for the --grpc-addr like newServer, serving
+// ReceiptService with the calls dispatched to handler, the standard health service and
+// server reflection. It serves h2c without TLS whether or not --enable-h2c is given,
+// since gRPC needs HTTP/2. Compressed messages are refused, as no compressor is
+// registered.
+func newGRPCServer(handler http.Handler, config *tls.Config) *http.Server {
+	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(int(maxBodyBytes)))
+	receiptpb.RegisterReceiptServiceServer(grpcServer, &receiptServer{handler: handler})
+	healthpb.RegisterHealthServer(grpcServer, newGRPCHealth())
+	reflection.Register(grpcServer)
+
+	// The gRPC server answers the requests of the http.Server, so the listener shares
+	// its TLS settings, limits and graceful shutdown with the others.
+	server := newServer(grpcServer, config)
+	if config == nil && !enableH2C {
+		serveH2C(server)
+	}
+	return server
+}
+
+// grpcHealth serves grpc.health.v1.Health: SERVING for the server as a whole, named by
+// the empty service, and for ReceiptService. Check reports NOT_SERVING once shutdown
+// has begun, as /ready does.
+type grpcHealth struct {
+	*health.Server
+}
+
+func newGRPCHealth() grpcHealth {
+	server := health.NewServer()
+	server.SetServingStatus(receiptpb.ReceiptService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	return grpcHealth{server}
+}
+
+func (h grpcHealth) Check(ctx context.Context, request *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	response, err := h.Server.Check(ctx, request)
+	if err == nil && shuttingDown.Load() {
+		response.Status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return response, err
+}
+
+// receiptServer serves ReceiptService by dispatching each call to the gRPC router.
+type receiptServer struct {
+	receiptpb.UnimplementedReceiptServiceServer
+	handler http.Handler
+}
+
+func (s *receiptServer) ProcessReceipt(ctx context.Context, request *receiptpb.Receipt) (*receiptpb.ProcessResponse, error) {
+	response := &receiptpb.ProcessResponse{}
+	return response, s.dispatch(ctx, receiptpb.ReceiptService_ProcessReceipt_FullMethodName, request, response, &grpcCall{})
+}
+
+func (s *receiptServer) GetPoints(ctx context.Context, request *receiptpb.GetPointsRequest) (*receiptpb.PointsResponse, error) {
+	response := &receiptpb.PointsResponse{}
+	return response, s.dispatch(ctx, receiptpb.ReceiptService_GetPoints_FullMethodName, request, response, &grpcCall{})
+}
+
+func (s *receiptServer) GetBreakdown(ctx context.Context, request *receiptpb.GetBreakdownRequest) (*receiptpb.BreakdownResponse, error) {
+	response := &receiptpb.BreakdownResponse{}
+	return response, s.dispatch(ctx, receiptpb.ReceiptService_GetBreakdown_FullMethodName, request, response, &grpcCall{})
+}
+
+func (s *receiptServer) ProcessReceipts(stream receiptpb.ReceiptService_ProcessReceiptsServer) error {
+	return s.dispatch(stream.Context(), receiptpb.ReceiptService_ProcessReceipts_FullMethodName, nil, nil, &grpcCall{stream: stream})
+}
+
+// grpcCall is a call being answered by the handlers of the gRPC router, which find it
+// in the context of their request.
+type grpcCall struct {
+	// stream is the stream of ProcessReceipts, nil for unary calls.
+	stream receiptpb.ReceiptService_ProcessReceiptsServer
+	// errorCode is the code of the error the handlers answered with, if any.
+	errorCode string
+	// err is the error the stream failed with, which the call ends with as it is.
+	err error
+}
+
+type grpcCallKey struct{}
+
+// dispatch answers the call of method with the handlers of the gRPC router. request,
+// if any, is sent as the body of the request, which carries the call's metadata as
+// headers and its peer's address and certificates. A 200 response is decoded into
+// response; any other ends the call with the matching status, the message of the
+// error and its code in a fetch-error-code trailer.
+func (s *receiptServer) dispatch(ctx context.Context, method string, request, response proto.Message, call *grpcCall) error {
+	var body []byte
+	if request != nil {
+		var err error
+		if body, err = proto.Marshal(request); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, grpcCallKey{}, call), http.MethodPost, method, bytes.NewReader(body))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		// Leave out the headers of the gRPC protocol, and binary metadata.
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") || strings.HasSuffix(key, "-bin") || key == "content-type" || key == "te" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Accept", "application/x-protobuf")
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &info.State
+		}
+	}
+
+	w := &grpcResponse{header: make(http.Header)}
+	s.handler.ServeHTTP(w, req)
+
+	header := metadata.MD{}
+	for name, values := range w.header {
+		if name != "Content-Type" && name != "Content-Length" {
+			header.Append(name, values...)
+		}
+	}
+	grpc.SetHeader(ctx, header)
+	if call.err != nil {
+		return call.err
+	}
+	if w.status != http.StatusOK {
+		if call.errorCode != "" {
+			grpc.SetTrailer(ctx, metadata.Pairs("fetch-error-code", call.errorCode))
+		}
+		return status.Error(grpcCodeFor(w.status), grpcErrorMessage(w.header.Get("Content-Type"), w.body.Bytes()))
+	}
+	if response != nil {
+		if err := proto.Unmarshal(w.body.Bytes(), response); err != nil {
+			return status.Error(codes.Internal, "malformed response: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// serveGRPC has the handlers after it read and answer protobuf, and records the code
+// of the error they answered with, if any, for the call.
+func serveGRPC() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("requestFormat", protobufFormat)
+		c.Set("responseType", "application/x-protobuf")
+		c.Next()
+		if call, ok := c.Request.Context().Value(grpcCallKey{}).(*grpcCall); ok {
+			call.errorCode = c.GetString("errorCode")
+		}
+	}
+}
+
+// grpcResponse holds the response the handlers of the gRPC router write for a call.
+type grpcResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *grpcResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *grpcResponse) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *grpcResponse) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+// grpcErrorMessage is the message of an error response: the detail of a problem, or
+// the error of an errorBody, in protobuf or JSON.
+func grpcErrorMessage(contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/problem+json":
+		var p problem
+		if json.Unmarshal(body, &p) == nil {
+			return p.Detail
+		}
+	case "application/x-protobuf":
+		var e receiptpb.Error
+		if proto.Unmarshal(body, &e) == nil {
+			return e.Error
+		}
+	case gin.MIMEJSON:
+		var e errorBody
+		if json.Unmarshal(body, &e) == nil {
+			return e.Error
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// receiptIDRequest is a request naming a receipt by its ID.
+type receiptIDRequest interface {
+	proto.Message
+	GetId() string
+}
+
+// grpcReceiptID decodes the request of a unary call, made by newRequest, and gives the
+// ID it names as the receipt_id parameter the HTTP handlers look receipts up by.
+func grpcReceiptID(newRequest func() receiptIDRequest) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := io.ReadAll(c.Request.Body)
+		request := newRequest()
+		if err == nil {
+			err = proto.Unmarshal(data, request)
+		}
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, "GRPC_MESSAGE_INVALID", "malformed protobuf: "+err.Error())
+			return
+		}
+		c.Params = append(c.Params, gin.Param{Key: "receipt_id", Value: request.GetId()})
+		c.Next()
+	}
+}
+
+// processReceiptStream serves ProcessReceipts: each receipt of the request is
+// validated, scored and stored as POST /receipts/process does, and answered with a
+// ProcessResult as soon as it is. A receipt that isn't valid is answered with its
+// error. Each stored receipt counts against the API key's quota, and the call ends
+// with RESOURCE_EXHAUSTED once it is used up.
+func processReceiptStream(c *gin.Context) {
+	call := c.Request.Context().Value(grpcCallKey{}).(*grpcCall)
+	key, hasKey := authenticatedKey(c)
+	for {
+		message, err := call.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			call.err = err
+			c.Abort()
+			return
+		}
+
+		engine := currentEngine()
+		result := &receiptpb.ProcessResult{}
+		receipt, err := receiptFromProto(message)
+		var reason validationReason
+		var detail string
+		var decodeErr *receiptDecodeError
+		if errors.As(err, &decodeErr) {
+			reason, detail = decodeErr.reason, decodeErr.message
+		} else {
+			reason, detail = validateReceipt(&receipt, engine)
+		}
+		audit := auditEvent{Actor: actor(c), Action: auditReceiptProcessed, Outcome: "failure", Status: http.StatusBadRequest, RequestID: c.GetString("requestID"), ClientIP: c.ClientIP()}
+		if reason != "" {
+			receiptValidationFailures.inc(string(reason))
+			result.Error = &receiptpb.Error{Error: detail, RequestId: c.GetString("requestID"), Code: string(reason)}
+		} else {
+			var resetAt time.Time
+			if hasKey {
+				var ok bool
+				if resetAt, ok = quotaUsage.reserve(key.ID, key.DailyQuota); !ok {
+					abortWithLimit(c, "QUOTA_EXHAUSTED", fmt.Sprintf("API key %s has processed its %d receipts for the day", key.ID, key.DailyQuota), resetAt)
+					return
+				}
+			}
+			result.Id = newReceiptID(receipt)
+			receipt.ProcessedAt = clock.Now()
+			points, err := scoreAndStore(c.Request.Context(), result.Id, receipt, engine, c.GetString("user"))
+			if err != nil {
+				if hasKey {
+					quotaUsage.release(key.ID, resetAt)
+				}
+				abortWithStoreError(c, err)
+				return
+			}
+			receiptsProcessed.inc()
+			audit.Target, audit.Outcome, audit.Status = result.Id, "success", http.StatusOK
+			if s := shadow.Load(); s != nil {
+				s.score(result.Id, c.GetString("requestID"), receipt, points)
+			}
+		}
+		recordAudit(audit)
+
+		if err := call.stream.Send(result); err != nil {
+			// The client is gone.
+			call.err = err
+			c.Abort()
+			return
+		}
+	}
+}
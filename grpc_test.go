@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"receipt_api/receiptpb"
+)
+
+// startGRPCServer serves newGRPCRouter over h2c and returns its address.
+func startGRPCServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newGRPCServer(newGRPCRouter(), nil)
+	go serve(server, listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// dialGRPC returns a gRPC client of the server at addr, over h2c.
+func dialGRPC(t *testing.T, addr string) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// grpcStatus is the status a call ended with.
+type grpcStatus struct {
+	code      codes.Code
+	message   string
+	errorCode string
+}
+
+// grpcStatusOf returns the status of a call that returned err with trailer.
+func grpcStatusOf(err error, trailer metadata.MD) grpcStatus {
+	s := status.Convert(err)
+	var errorCode string
+	if values := trailer.Get("fetch-error-code"); len(values) > 0 {
+		errorCode = values[0]
+	}
+	return grpcStatus{s.Code(), s.Message(), errorCode}
+}
+
+// withAPIKey sends key as x-api-key metadata.
+func withAPIKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+}
+
+func TestGRPCReceiptService(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	grpcAddr, httpAddr := startGRPCServer(t), startServer(t, newRouter(), nil)
+	client := receiptpb.NewReceiptServiceClient(dialGRPC(t, grpcAddr))
+	ctx := context.Background()
+
+	processed, err := client.ProcessReceipt(ctx, canonicalReceiptProto(t))
+	if err != nil || processed.Id == "" {
+		t.Fatalf("expected an ID but got %v", err)
+	}
+
+	// The receipt is stored where the HTTP API reads it.
+	resp, err := http.Get("http://" + httpAddr + "/receipts/" + processed.Id + "/points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overHTTP struct {
+		Points int `json:"points"`
+	}
+	json.NewDecoder(resp.Body).Decode(&overHTTP)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || overHTTP.Points != 28 {
+		t.Errorf("expected 28 points over HTTP but got %v %d", resp.StatusCode, overHTTP.Points)
+	}
+
+	if points, err := client.GetPoints(ctx, &receiptpb.GetPointsRequest{Id: processed.Id}); err != nil || points.Points != 28 {
+		t.Errorf("expected 28 points but got %v %v", err, points)
+	}
+	if breakdown, err := client.GetBreakdown(ctx, &receiptpb.GetBreakdownRequest{Id: processed.Id}); err != nil || breakdown.Points != 28 || len(breakdown.Breakdown) == 0 {
+		t.Errorf("expected a breakdown of 28 points but got %v %v", err, breakdown)
+	}
+
+	noTotal := canonicalReceiptProto(t)
+	noTotal.Total = ""
+	testCases := []struct {
+		name    string
+		method  string
+		request proto.Message
+		code    codes.Code
+		message string
+	}{
+		{"Invalid", "ProcessReceipt", noTotal, codes.InvalidArgument, "Total amount is required"},
+		{"UnknownReceipt", "GetPoints", &receiptpb.GetPointsRequest{Id: "0b0b0b0b-0000-0000-0000-000000000000"}, codes.NotFound, "Receipt not found"},
+		{"UnknownMethod", "DeleteReceipt", &receiptpb.GetPointsRequest{}, codes.Unimplemented, "unknown method DeleteReceipt"},
+	}
+	conn := dialGRPC(t, grpcAddr)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var trailer metadata.MD
+			err := conn.Invoke(ctx, receiptService+tc.method, tc.request, &receiptpb.ProcessResponse{}, grpc.Trailer(&trailer))
+			if s := grpcStatusOf(err, trailer); s.code != tc.code || !strings.Contains(s.message, tc.message) {
+				t.Errorf("expected status %v with %q but got %+v", tc.code, tc.message, s)
+			}
+		})
+	}
+
+	// Requests that aren't gRPC calls are refused.
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err = h2c.Post("http://"+grpcAddr+receiptService+"ProcessReceipt", "application/json", strings.NewReader(validReceiptPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415 but got %v", resp.StatusCode)
+	}
+}
+
+func TestGRPCAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useQuotaStore(t, newQuotaStore(""))
+	useAPIKeys(t, []apiKey{{ID: "partner-a", Key: "k-a", Scopes: defaultScopes, DailyQuota: 1}})
+	client := receiptpb.NewReceiptServiceClient(dialGRPC(t, startGRPCServer(t)))
+
+	var trailer metadata.MD
+	_, err := client.ProcessReceipt(context.Background(), canonicalReceiptProto(t), grpc.Trailer(&trailer))
+	if s := grpcStatusOf(err, trailer); s.code != codes.Unauthenticated || s.errorCode != "API_KEY_REQUIRED" {
+		t.Errorf("expected UNAUTHENTICATED without a key but got %+v", s)
+	}
+	processed, err := client.ProcessReceipt(withAPIKey("k-a"), canonicalReceiptProto(t))
+	if err != nil {
+		t.Fatalf("expected the receipt processed but got %v", err)
+	}
+	var header metadata.MD
+	_, err = client.ProcessReceipt(withAPIKey("k-a"), canonicalReceiptProto(t), grpc.Header(&header), grpc.Trailer(&trailer))
+	if s := grpcStatusOf(err, trailer); s.code != codes.ResourceExhausted || s.errorCode != "QUOTA_EXHAUSTED" {
+		t.Errorf("expected RESOURCE_EXHAUSTED over the quota but got %+v", s)
+	}
+	// The headers of the response are sent as the call's.
+	if len(header.Get("retry-after")) != 1 {
+		t.Errorf("expected a retry-after header but got %v", header)
+	}
+	// Reads don't count against the quota.
+	if points, err := client.GetPoints(withAPIKey("k-a"), &receiptpb.GetPointsRequest{Id: processed.Id}); err != nil || points.Points != 28 {
+		t.Errorf("expected 28 points but got %v %v", err, points)
+	}
+}
+
+func TestGRPCProcessReceiptsStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useQuotaStore(t, newQuotaStore(""))
+	useAPIKeys(t, []apiKey{{ID: "partner-a", Key: "k-a", Scopes: defaultScopes, DailyQuota: 2}})
+	client := receiptpb.NewReceiptServiceClient(dialGRPC(t, startGRPCServer(t)))
+
+	var trailer metadata.MD
+	stream, err := client.ProcessReceipts(withAPIKey("k-a"), grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	process := func(receipt *receiptpb.Receipt) *receiptpb.ProcessResult {
+		t.Helper()
+		if err := stream.Send(receipt); err != nil {
+			t.Fatal(err)
+		}
+		result, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("expected a result but got %v", err)
+		}
+		return result
+	}
+
+	// Each receipt is answered before the next is sent.
+	if result := process(canonicalReceiptProto(t)); result.Id == "" || result.Error != nil {
+		t.Fatalf("expected an ID but got %v", result)
+	}
+	noTotal := canonicalReceiptProto(t)
+	noTotal.Total = ""
+	if result := process(noTotal); result.Id != "" || result.Error.GetCode() != string(reasonTotalMissing) || result.Error.GetError() != "Total amount is required" {
+		t.Errorf("expected the receipt rejected but got %v", result)
+	}
+	if result := process(canonicalReceiptProto(t)); result.Id == "" {
+		t.Fatalf("expected an ID but got %v", result)
+	}
+	receiptsMu.RLock()
+	if len(receipts) != 2 {
+		t.Errorf("expected 2 receipts stored but got %d", len(receipts))
+	}
+	receiptsMu.RUnlock()
+
+	// The call ends once the quota is used up.
+	if err := stream.Send(canonicalReceiptProto(t)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	if s := grpcStatusOf(err, trailer); s.code != codes.ResourceExhausted || s.errorCode != "QUOTA_EXHAUSTED" {
+		t.Errorf("expected RESOURCE_EXHAUSTED but got %+v", s)
+	}
+}
+
+func TestGRPCCodeFor(t *testing.T) {
+	testCases := []struct {
+		status int
+		code   codes.Code
+	}{
+		{http.StatusOK, codes.OK},
+		{http.StatusBadRequest, codes.InvalidArgument},
+		{http.StatusUnauthorized, codes.Unauthenticated},
+		{http.StatusForbidden, codes.PermissionDenied},
+		{http.StatusGone, codes.NotFound},
+		{http.StatusTooManyRequests, codes.ResourceExhausted},
+		{http.StatusServiceUnavailable, codes.Unavailable},
+		{http.StatusGatewayTimeout, codes.DeadlineExceeded},
+		{http.StatusInternalServerError, codes.Internal},
+		{http.StatusTeapot, codes.Unknown},
+	}
+	for _, tc := range testCases {
+		if code := grpcCodeFor(tc.status); code != tc.code {
+			t.Errorf("%d: expected status %v but got %v", tc.status, tc.code, code)
+		}
+	}
+}
+
+func TestGRPCHealth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client := healthpb.NewHealthClient(dialGRPC(t, startGRPCServer(t)))
+	check := func(service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+		t.Helper()
+		response, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		return response.GetStatus(), err
+	}
+
+	for _, service := range []string{"", "fetch.receipts.v1.ReceiptService"} {
+		if s, err := check(service); s != healthpb.HealthCheckResponse_SERVING || err != nil {
+			t.Errorf("%q: expected SERVING but got %v %v", service, s, err)
+		}
+	}
+	if _, err := check("fetch.receipts.v1.Other"); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NOT_FOUND for an unknown service but got %v", err)
+	}
+
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	if s, _ := check(""); s != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expected NOT_SERVING while shutting down but got %v", s)
+	}
+}
+
+func TestGRPCReflection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client := reflectionpb.NewServerReflectionClient(dialGRPC(t, startGRPCServer(t)))
+	stream, err := client.ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ask := func(request *reflectionpb.ServerReflectionRequest) *reflectionpb.ServerReflectionResponse {
+		t.Helper()
+		if err := stream.Send(request); err != nil {
+			t.Fatal(err)
+		}
+		response, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("expected a response but got %v", err)
+		}
+		return response
+	}
+	files := func(response *reflectionpb.ServerReflectionResponse) []*descriptorpb.FileDescriptorProto {
+		t.Helper()
+		var files []*descriptorpb.FileDescriptorProto
+		for _, data := range response.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			var file descriptorpb.FileDescriptorProto
+			unmarshalProto(t, data, &file)
+			files = append(files, &file)
+		}
+		return files
+	}
+
+	var services []string
+	for _, service := range ask(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{ListServices: "*"}}).GetListServicesResponse().GetService() {
+		services = append(services, service.Name)
+	}
+	if !containsString(services, "fetch.receipts.v1.ReceiptService") || !containsString(services, "grpc.health.v1.Health") {
+		t.Errorf("expected ReceiptService and the health service listed but got %v", services)
+	}
+
+	// A file comes with the files it imports.
+	found := files(ask(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "fetch.receipts.v1.ReceiptService"}}))
+	if len(found) != 2 || found[0].GetName() != "proto/receipt.proto" || found[1].GetName() != "google/protobuf/timestamp.proto" {
+		t.Fatalf("expected receipt.proto and its import but got %d files", len(found))
+	}
+	methods := found[0].GetService()[0].GetMethod()
+	if len(methods) != 4 || !methods[3].GetClientStreaming() || !methods[3].GetServerStreaming() {
+		t.Errorf("expected 4 methods, the last streaming both ways, but got %v", methods)
+	}
+
+	response := ask(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "fetch.receipts.v1.Missing"}})
+	if code := response.GetErrorResponse().GetErrorCode(); codes.Code(code) != codes.NotFound {
+		t.Errorf("expected NOT_FOUND for an unknown symbol but got %v", response)
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("expected the stream to end OK but got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyTTL is how long the response to a request with an Idempotency-Key is
+// replayed to retries of it.
+var idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key, and so the memory keys take.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyKeys remembers the responses to submissions sent with an
+// Idempotency-Key.
+var idempotencyKeys = newIdempotencyStore()
+
+var (
+	errIdempotencyKeyInUse  = errors.New("a request with this Idempotency-Key is still being processed")
+	errIdempotencyKeyReused = errors.New("this Idempotency-Key was used for a different request")
+)
+
+// idempotentResponse is the response to a request with an Idempotency-Key, or a
+// placeholder for it while the request is processed.
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// idempotencyStore holds idempotentResponses by key, dropping expired ones at most
+// once a minute.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	lastSweep time.Time
+}
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{responses: make(map[string]*idempotentResponse)}
+}
+
+// begin claims key for a request with fingerprint. It returns the response to
+// replay if the request was already answered, errIdempotencyKeyInUse while it is
+// being processed and errIdempotencyKeyReused if the key came with another request.
+func (s *idempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, error) {
+	now := clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= time.Minute {
+		s.lastSweep = now
+		for k, response := range s.responses {
+			if response.done && !now.Before(response.expiresAt) {
+				delete(s.responses, k)
+			}
+		}
+	}
+	if response, ok := s.responses[key]; ok && (!response.done || now.Before(response.expiresAt)) {
+		switch {
+		case response.fingerprint != fingerprint:
+			return nil, errIdempotencyKeyReused
+		case !response.done:
+			return nil, errIdempotencyKeyInUse
+		}
+		return response, nil
+	}
+	s.responses[key] = &idempotentResponse{fingerprint: fingerprint}
+	return nil, nil
+}
+
+// finish records the response to the request that claimed key. Only successes are
+// kept; after a failure the key is free for a retry to be processed afresh.
+func (s *idempotencyStore) finish(key string, status int, contentType string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response, ok := s.responses[key]
+	if !ok {
+		return
+	}
+	if status < http.StatusOK || status >= http.StatusMultipleChoices {
+		delete(s.responses, key)
+		return
+	}
+	response.done = true
+	response.status, response.contentType, response.body = status, contentType, body
+	response.expiresAt = clock.Now().Add(idempotencyTTL)
+}
+
+// forget frees key after the request that claimed it failed without a response.
+func (s *idempotencyStore) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.responses, key)
+}
+
+// len returns the number of keys remembered.
+func (s *idempotencyStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.responses)
+}
+
+// recordingResponseWriter keeps a copy of the body it writes.
+type recordingResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingResponseWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent makes a request with an Idempotency-Key safe to retry: the first one
+// is processed, and for idempotencyTTL after it succeeds, the same request with the
+// same key from the same caller gets the same response, marked Idempotent-Replayed,
+// rather than storing the receipt again. A retry while the first is still processed
+// gets a 409 with the IDEMPOTENCY_KEY_IN_USE code, and the key with another body a
+// 422 with IDEMPOTENCY_KEY_REUSED.
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			abortWithProblem(c, http.StatusBadRequest, "IDEMPOTENCY_KEY_INVALID", fmt.Sprintf("Idempotency-Key is longer than %d characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		data, err := io.ReadAll(c.Request.Body)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			abortWithBodyTooLarge(c, maxBytesErr.Limit)
+			return
+		}
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, "BODY_UNREADABLE", "Failed to read the request body")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+
+		// Keys are the caller's own, so no one is replayed another's response.
+		scoped := actor(c) + " " + key
+		fingerprint := sha256.Sum256(append([]byte(c.GetHeader("Content-Type")+"\n"), data...))
+		replay, err := idempotencyKeys.begin(scoped, fingerprint)
+		switch {
+		case errors.Is(err, errIdempotencyKeyInUse):
+			abortWithProblem(c, http.StatusConflict, "IDEMPOTENCY_KEY_IN_USE", err.Error())
+			return
+		case errors.Is(err, errIdempotencyKeyReused):
+			abortWithProblem(c, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED", err.Error())
+			return
+		case replay != nil:
+			// Nothing was processed, so there is nothing new to audit.
+			c.Set("audited", true)
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(replay.status, replay.contentType, replay.body)
+			c.Abort()
+			return
+		}
+
+		recorder := &recordingResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		finished := false
+		defer func() {
+			if !finished {
+				idempotencyKeys.forget(scoped)
+			}
+		}()
+		c.Next()
+		idempotencyKeys.finish(scoped, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		finished = true
+	}
+}
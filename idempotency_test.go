@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useIdempotencyKeys gives the test a fresh idempotency store.
+func useIdempotencyKeys(t *testing.T) *idempotencyStore {
+	t.Helper()
+	previous := idempotencyKeys
+	idempotencyKeys = newIdempotencyStore()
+	t.Cleanup(func() { idempotencyKeys = previous })
+	return idempotencyKeys
+}
+
+// postIdempotent posts body to /receipts/process with key as its Idempotency-Key.
+func postIdempotent(router *gin.Engine, key, apiKey, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	fake := useFakeClock(t, time.Date(2022, 1, 1, 13, 1, 0, 0, time.UTC))
+	store := useIdempotencyKeys(t)
+	router := newRouter()
+
+	first := postIdempotent(router, "order-1", "", validReceiptPayload)
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected the receipt to be processed but got %v %v: %s", first.Code, first.Header(), first.Body.String())
+	}
+	retry := postIdempotent(router, "order-1", "", validReceiptPayload)
+	if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected the first response replayed but got %v %v: %s", retry.Code, retry.Header(), retry.Body.String())
+	}
+	if retry.Header().Get("Content-Type") != first.Header().Get("Content-Type") {
+		t.Errorf("expected the replay to be %s but got %s", first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	}
+	if len(receipts) != 1 {
+		t.Fatalf("expected the receipt stored once but %d are", len(receipts))
+	}
+
+	// The same key with another body is a mistake, not a retry.
+	other := strings.Replace(validReceiptPayload, `"Target"`, `"Walgreens"`, 1)
+	if rr := postIdempotent(router, "order-1", "", other); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "IDEMPOTENCY_KEY_REUSED") {
+		t.Errorf("expected a reused key to be rejected but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postIdempotent(router, "order-2", "", validReceiptPayload); rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected another key to process the receipt again but got %v %v", rr.Code, rr.Header())
+	}
+
+	// Once the response expires the key is processed afresh.
+	fake.Advance(idempotencyTTL + time.Minute)
+	if rr := postIdempotent(router, "order-1", "", validReceiptPayload); rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected an expired key to process the receipt again but got %v %v", rr.Code, rr.Header())
+	}
+	// order-2 expired too, and was swept.
+	if len(receipts) != 3 || store.len() != 1 {
+		t.Errorf("expected 3 receipts and 1 key but got %d and %d", len(receipts), store.len())
+	}
+}
+
+func TestIdempotencyKeyReplaysDontCountAgainstQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useIdempotencyKeys(t)
+	useQuotaStore(t, newQuotaStore(""))
+	useAPIKeys(t, []apiKey{{ID: "partner", Key: "k-partner", Scopes: defaultScopes, DailyQuota: 1}})
+	router := newRouter()
+
+	first := postIdempotent(router, "order-1", "k-partner", validReceiptPayload)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected the receipt to be processed but got %v: %s", first.Code, first.Body.String())
+	}
+	// The key has used its quota, but a retry gets the receipt it already stored.
+	for i := 0; i < 2; i++ {
+		if rr := postIdempotent(router, "order-1", "k-partner", validReceiptPayload); rr.Code != http.StatusOK || rr.Body.String() != first.Body.String() {
+			t.Errorf("expected the retry to be replayed but got %v: %s", rr.Code, rr.Body.String())
+		}
+	}
+	if used, _, _ := quotaUsage.usage(); used["partner"] != 1 {
+		t.Errorf("expected 1 receipt counted but got %d", used["partner"])
+	}
+	if rr := postIdempotent(router, "order-2", "k-partner", validReceiptPayload); rr.Code != http.StatusTooManyRequests || !strings.Contains(rr.Body.String(), "QUOTA_EXHAUSTED") {
+		t.Errorf("expected another receipt to be over the quota but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestIdempotencyKeyForgetsFailures(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	store := useIdempotencyKeys(t)
+	router := newRouter()
+
+	invalid := strings.Replace(validReceiptPayload, `"total": "35.35"`, `"total": ""`, 1)
+	if rr := postIdempotent(router, "order-1", "", invalid); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected the invalid receipt to be rejected but got %v", rr.Code)
+	}
+	if store.len() != 0 {
+		t.Fatalf("expected the failure to free the key but %d are kept", store.len())
+	}
+	if rr := postIdempotent(router, "order-1", "", validReceiptPayload); rr.Code != http.StatusOK {
+		t.Errorf("expected the key to be reusable after a failure but got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := postIdempotent(router, strings.Repeat("k", maxIdempotencyKeyLength+1), "", validReceiptPayload); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "IDEMPOTENCY_KEY_INVALID") {
+		t.Errorf("expected a long key to be rejected but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestIdempotencyKeysArePerCaller(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useIdempotencyKeys(t)
+	useAPIKeys(t, []apiKey{{ID: "a", Key: "key-a", Scopes: []string{scopeWrite}}, {ID: "b", Key: "key-b", Scopes: []string{scopeWrite}}})
+	router := newRouter()
+
+	ids := make(map[string]bool)
+	for _, key := range []string{"key-a", "key-b", "key-a"} {
+		rr := postIdempotent(router, "order-1", key, validReceiptPayload)
+		var body processResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); rr.Code != http.StatusOK || err != nil {
+			t.Fatalf("expected %s's receipt to be processed but got %v: %s", key, rr.Code, rr.Body.String())
+		}
+		ids[body.ID] = true
+	}
+	if len(ids) != 2 || len(receipts) != 2 {
+		t.Errorf("expected each caller's key to store the receipt once but got IDs %v", ids)
+	}
+}
+
+func TestIdempotencyKeyInUse(t *testing.T) {
+	store := useIdempotencyKeys(t)
+	fingerprint := [32]byte{1}
+	if replay, err := store.begin("k", fingerprint); replay != nil || err != nil {
+		t.Fatalf("expected the key to be claimed but got %v, %v", replay, err)
+	}
+	if _, err := store.begin("k", fingerprint); err != errIdempotencyKeyInUse {
+		t.Errorf("expected the key to be in use but got %v", err)
+	}
+
+	// Concurrent retries of a request in flight are all turned away.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.begin("k", fingerprint)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != errIdempotencyKeyInUse {
+			t.Errorf("expected the key to be in use but got %v", err)
+		}
+	}
+
+	store.finish("k", http.StatusOK, "application/json", []byte(`{"id":"r-1"}`))
+	if replay, err := store.begin("k", fingerprint); err != nil || replay == nil || string(replay.body) != `{"id":"r-1"}` {
+		t.Errorf("expected the response to be replayed but got %v, %v", replay, err)
+	}
+}
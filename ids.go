@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// idKind is what an ID names. Sequential IDs carry it so IDs of different kinds
+// never collide.
+type idKind int
+
+const (
+	idReceipt idKind = iota + 1
+	idRequest
+	idEvent
+	idDelivery
+	idSubscription
+	idKinds
+)
+
+// idGenerator makes the IDs the service hands out: of receipts, requests without a
+// usable X-Request-ID, events, webhook deliveries and webhook subscriptions.
+type idGenerator interface {
+	newID(kind idKind) string
+	// receiptID is the ID receipt is stored under once processed.
+	receiptID(receipt Receipt) string
+}
+
+// randomIDs are random UUIDs, the IDs the service normally hands out.
+type randomIDs struct{}
+
+func (randomIDs) newID(idKind) string      { return uuid.New().String() }
+func (randomIDs) receiptID(Receipt) string { return uuid.New().String() }
+
+// sequentialIDs numbers the IDs of each kind from 1, in UUIDs with the kind in the
+// first group and the number in the last, such as
+// 00000001-0000-4000-8000-000000000001 for the first receipt.
+type sequentialIDs struct {
+	next [idKinds]atomic.Uint64
+}
+
+func (s *sequentialIDs) newID(kind idKind) string {
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", int(kind), s.next[kind].Add(1))
+}
+
+func (s *sequentialIDs) receiptID(Receipt) string { return s.newID(idReceipt) }
+
+// contentIDs gives each receipt the ID it would be seeded under, so the same receipt
+// always gets the same ID, and numbers other IDs as sequentialIDs does.
+type contentIDs struct {
+	sequentialIDs
+}
+
+func (c *contentIDs) receiptID(receipt Receipt) string { return seedID(receipt) }
+
+// ids is the idGenerator the service runs on, replaced by --deterministic.
+var ids idGenerator = randomIDs{}
+
+// newID returns a new ID of kind.
+func newID(kind idKind) string { return ids.newID(kind) }
+
+// newReceiptID returns the ID to store the processed receipt under.
+func newReceiptID(receipt Receipt) string { return ids.receiptID(receipt) }
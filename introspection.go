@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// introspection checks the opaque bearer tokens of services, issued by the identity
+// provider with the client credentials grant, at the --introspection-url. It is nil
+// unless the flag is set.
+var introspection atomic.Pointer[introspector]
+
+// The --introspection-url and the credentials this service authenticates to it with.
+var (
+	introspectionURL          string
+	introspectionClientID     string
+	introspectionClientSecret string
+)
+
+var (
+	// introspectionTimeout bounds each introspection request.
+	introspectionTimeout = 5 * time.Second
+	// introspectionMaxTTL caps how long an active token is cached, and is how long one
+	// without an exp claim is.
+	introspectionMaxTTL = 5 * time.Minute
+	// introspectionNegativeTTL is how long an inactive token is cached.
+	introspectionNegativeTTL = 10 * time.Second
+	// introspectionRetryAfter is the Retry-After sent when the endpoint fails.
+	introspectionRetryAfter = 5 * time.Second
+)
+
+// maxIntrospectionCacheEntries bounds the token cache. Expired entries are dropped
+// when it fills up, and the whole cache if that isn't enough.
+const maxIntrospectionCacheEntries = 10000
+
+var errIntrospectionUnavailable = errors.New("the token could not be introspected")
+
+// clientIdentity is the service a token was issued to and the scopes it was granted.
+// An inactive token has an empty identity.
+type clientIdentity struct {
+	ClientID string
+	Scopes   []string
+}
+
+func (id *clientIdentity) active() bool {
+	return id.ClientID != ""
+}
+
+func (id *clientIdentity) hasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type introspectionEntry struct {
+	identity clientIdentity
+	expires  time.Time
+}
+
+// introspector checks tokens with an RFC 7662 introspection endpoint and caches the
+// answers, keyed by a hash of the token.
+type introspector struct {
+	url              string
+	clientID, secret string
+	client           *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionEntry
+}
+
+// newIntrospector returns an introspector for the endpoint at url that authenticates
+// with HTTP basic auth when clientID is set.
+func newIntrospector(url, clientID, secret string) *introspector {
+	return &introspector{
+		url:      url,
+		clientID: clientID,
+		secret:   secret,
+		client:   &http.Client{Timeout: introspectionTimeout},
+		cache:    make(map[[sha256.Size]byte]introspectionEntry),
+	}
+}
+
+// identify returns the identity a token was issued to. Active tokens are cached until
+// they expire, at most introspectionMaxTTL, and inactive ones for
+// introspectionNegativeTTL. Endpoint failures return errIntrospectionUnavailable. The
+// ID of the request the token came with is passed on to the endpoint.
+func (i *introspector) identify(token, requestID string) (clientIdentity, error) {
+	key := sha256.Sum256([]byte(token))
+	now := clock.Now()
+	i.mu.Lock()
+	entry, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.identity, nil
+	}
+
+	identity, expires, err := i.introspect(token, requestID)
+	if err != nil {
+		log.Printf("token introspection failed: %v request_id=%s", err, requestID)
+		return clientIdentity{}, errIntrospectionUnavailable
+	}
+	entry = introspectionEntry{identity: identity, expires: now.Add(introspectionNegativeTTL)}
+	if identity.active() {
+		entry.expires = now.Add(introspectionMaxTTL)
+		if !expires.IsZero() && expires.Before(entry.expires) {
+			entry.expires = expires
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.cache) >= maxIntrospectionCacheEntries {
+		for k, e := range i.cache {
+			if !now.Before(e.expires) {
+				delete(i.cache, k)
+			}
+		}
+		if len(i.cache) >= maxIntrospectionCacheEntries {
+			i.cache = make(map[[sha256.Size]byte]introspectionEntry)
+		}
+	}
+	i.cache[key] = entry
+	return identity, nil
+}
+
+// introspect asks the endpoint about a token and returns who it was issued to and when
+// it expires, or an empty identity if it isn't active.
+func (i *introspector) introspect(token, requestID string) (clientIdentity, time.Time, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return clientIdentity{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if requestID != "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+	if i.clientID != "" {
+		req.SetBasicAuth(i.clientID, i.secret)
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return clientIdentity{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return clientIdentity{}, time.Time{}, fmt.Errorf("%s responded %s", i.url, resp.Status)
+	}
+
+	var body struct {
+		Active   bool     `json:"active"`
+		ClientID string   `json:"client_id"`
+		Scope    string   `json:"scope"`
+		Exp      *float64 `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return clientIdentity{}, time.Time{}, fmt.Errorf("%s: %w", i.url, err)
+	}
+	// A token without a client can't be attributed to a caller, so it is treated as
+	// inactive.
+	if !body.Active || body.ClientID == "" {
+		return clientIdentity{}, time.Time{}, nil
+	}
+	var expires time.Time
+	if body.Exp != nil {
+		expires = time.Unix(int64(*body.Exp), 0)
+		if !clock.Now().Before(expires) {
+			return clientIdentity{}, time.Time{}, nil
+		}
+	}
+	identity := clientIdentity{ClientID: body.ClientID}
+	for _, scope := range strings.Fields(body.Scope) {
+		if scope == scopeRead || scope == scopeWrite || scope == scopeAdmin {
+			identity.Scopes = append(identity.Scopes, scope)
+		}
+	}
+	return identity, expires, nil
+}
+
+// authenticateClient lets a request with an opaque token through if the token is active
+// and was granted scope, recording the client ID under "client" in the context in
+// place of the identity of any client certificate.
+// Introspection failures reject it with a 503, since the token can't be trusted
+// without an answer.
+func authenticateClient(c *gin.Context, i *introspector, token, scope string) {
+	identity, err := i.identify(token, c.GetString("requestID"))
+	if err != nil {
+		c.Header("Retry-After", strconv.Itoa(int(introspectionRetryAfter/time.Second)))
+		abortWithProblem(c, http.StatusServiceUnavailable, "INTROSPECTION_UNAVAILABLE", err.Error())
+		return
+	}
+	if !identity.active() {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		abortWithProblem(c, http.StatusUnauthorized, "TOKEN_INVALID", "the token is not active")
+		return
+	}
+	if !identity.hasScope(scope) {
+		logRequestf(c, "%s %s rejected: client %s lacks the %s scope", c.Request.Method, route(c), identity.ClientID, scope)
+		abortWithProblem(c, http.StatusForbidden, "TOKEN_SCOPE_MISSING", fmt.Sprintf("the token lacks the %q scope", scope))
+		return
+	}
+
+	logRequestf(c, "%s %s authenticated as client %s", c.Request.Method, route(c), identity.ClientID)
+	// The token, not the connection, identifies the caller, and clients see every
+	// receipt.
+	c.Set("user", "")
+	c.Set("client", identity.ClientID)
+	c.Next()
+}
+
+// looksLikeJWT reports whether a bearer token has the three dot separated segments of a
+// signed JWT rather than being opaque.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
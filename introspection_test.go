@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testIntrospectionServer answers RFC 7662 requests from a table of active tokens.
+type testIntrospectionServer struct {
+	mu       sync.Mutex
+	active   map[string]map[string]any
+	down     bool
+	requests atomic.Int32
+	// requestID is the X-Request-ID of the last request.
+	requestID string
+}
+
+func (s *testIntrospectionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requestID = r.Header.Get("X-Request-ID")
+	if s.down {
+		http.Error(w, "unavailable", http.StatusBadGateway)
+		return
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != "receipts" || secret != "s3cret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	response, ok := s.active[r.PostFormValue("token")]
+	if !ok {
+		response = map[string]any{"active": false}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *testIntrospectionServer) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// useIntrospection makes the service introspect tokens with a fake server knowing the
+// active tokens for the rest of the test.
+func useIntrospection(t *testing.T, active map[string]map[string]any) *testIntrospectionServer {
+	t.Helper()
+	fake := &testIntrospectionServer{active: active}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	introspection.Store(newIntrospector(server.URL, "receipts", "s3cret"))
+	t.Cleanup(func() { introspection.Store(nil) })
+	return fake
+}
+
+// requestWithToken sends a request with a bearer token.
+func requestWithToken(router *gin.Engine, method, path, token string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if method == http.MethodPost {
+		req = httptest.NewRequest(method, path, strings.NewReader(validReceiptPayload))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIntrospection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, jwtNow)
+	router := newRouter()
+	exp := jwtNow.Add(time.Hour).Unix()
+	useIntrospection(t, map[string]map[string]any{
+		"importer-token": {"active": true, "client_id": "batch-importer", "scope": "read write", "exp": exp},
+		"reader-token":   {"active": true, "client_id": "dashboard", "scope": "read profile", "exp": exp},
+		"orphan-token":   {"active": true, "scope": "read write", "exp": exp},
+		"expired-token":  {"active": true, "client_id": "batch-importer", "scope": "read write", "exp": jwtNow.Unix()},
+	})
+
+	rr := requestWithToken(router, http.MethodPost, "/receipts/process", "importer-token")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v: %s", rr.Code, rr.Body.String())
+	}
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil {
+		t.Fatal(err)
+	}
+	points := "/receipts/" + processed.ID + "/points"
+
+	testCases := []struct {
+		name           string
+		method, path   string
+		token          string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "Read", method: http.MethodGet, path: points, token: "importer-token", expectedStatus: http.StatusOK},
+		{name: "ReadOnlyReads", method: http.MethodGet, path: points, token: "reader-token", expectedStatus: http.StatusOK},
+		{name: "ReadOnlyWrites", method: http.MethodPost, path: "/receipts/process", token: "reader-token", expectedStatus: http.StatusForbidden, expectedCode: "TOKEN_SCOPE_MISSING"},
+		{name: "Inactive", method: http.MethodGet, path: points, token: "revoked-token", expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_INVALID"},
+		{name: "NoClient", method: http.MethodGet, path: points, token: "orphan-token", expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_INVALID"},
+		{name: "Expired", method: http.MethodGet, path: points, token: "expired-token", expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_INVALID"},
+		{name: "NoToken", method: http.MethodGet, path: points, expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_REQUIRED"},
+	}
+	for _, tc := range testCases {
+		rr := requestWithToken(router, tc.method, tc.path, tc.token)
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: expected status %v but got %v: %s", tc.name, tc.expectedStatus, rr.Code, rr.Body.String())
+		}
+		if tc.expectedCode != "" && !strings.Contains(rr.Body.String(), tc.expectedCode) {
+			t.Errorf("%s: expected the %s code but got %s", tc.name, tc.expectedCode, rr.Body.String())
+		}
+	}
+}
+
+func TestIntrospectionCache(t *testing.T) {
+	fake := useFakeClock(t, jwtNow)
+	server := useIntrospection(t, map[string]map[string]any{
+		"importer-token": {"active": true, "client_id": "batch-importer", "scope": "read write", "exp": jwtNow.Add(time.Minute).Unix()},
+	})
+	i := introspection.Load()
+
+	for n := 0; n < 3; n++ {
+		if identity, err := i.identify("importer-token", "req-1"); err != nil || identity.ClientID != "batch-importer" {
+			t.Fatalf("expected batch-importer but got %+v, %v", identity, err)
+		}
+		if identity, err := i.identify("revoked-token", ""); err != nil || identity.active() {
+			t.Fatalf("expected an inactive token but got %+v, %v", identity, err)
+		}
+	}
+	if requests := server.requests.Load(); requests != 2 {
+		t.Errorf("expected one introspection per token but got %v", requests)
+	}
+	server.mu.Lock()
+	if server.requestID != "" {
+		t.Errorf("expected no X-Request-ID without a request but got %q", server.requestID)
+	}
+	server.mu.Unlock()
+
+	// Inactive tokens are cached briefly and active ones until they expire.
+	fake.Advance(introspectionNegativeTTL)
+	i.identify("importer-token", "")
+	i.identify("revoked-token", "")
+	if requests := server.requests.Load(); requests != 3 {
+		t.Errorf("expected the inactive token to be introspected again but got %v requests", requests)
+	}
+	fake.Advance(time.Minute)
+	if identity, _ := i.identify("importer-token", "req-2"); identity.active() {
+		t.Errorf("expected the token to be inactive once expired but got %+v", identity)
+	}
+	if requests := server.requests.Load(); requests != 4 {
+		t.Errorf("expected the expired token to be introspected again but got %v requests", requests)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.requestID != "req-2" {
+		t.Errorf("expected the request ID to be passed on but got %q", server.requestID)
+	}
+}
+
+func TestIntrospectionUnavailable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, jwtNow)
+	router := newRouter()
+	server := useIntrospection(t, map[string]map[string]any{
+		"importer-token": {"active": true, "client_id": "batch-importer", "scope": "read write"},
+	})
+
+	server.setDown(true)
+	rr := requestWithToken(router, http.MethodGet, "/rules", "importer-token")
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "INTROSPECTION_UNAVAILABLE") {
+		t.Errorf("expected 503 INTROSPECTION_UNAVAILABLE but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "5" {
+		t.Errorf("expected Retry-After 5 but got %q", retry)
+	}
+
+	// Failures aren't cached, so the token works as soon as the endpoint is back.
+	server.setDown(false)
+	if rr := requestWithToken(router, http.MethodGet, "/rules", "importer-token"); rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestIntrospectionWithJWT(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, jwtNow)
+	router := newRouter()
+	key := generateKey(t)
+	useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+	server := useIntrospection(t, map[string]map[string]any{
+		"importer-token": {"active": true, "client_id": "batch-importer", "scope": "read write"},
+	})
+
+	// JWTs are verified locally and opaque tokens introspected.
+	if rr := requestWithToken(router, http.MethodGet, "/rules", userToken(t, key, "k1", "alice")); rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 with a JWT but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if requests := server.requests.Load(); requests != 0 {
+		t.Errorf("expected the JWT not to be introspected but got %v requests", requests)
+	}
+	if rr := requestWithToken(router, http.MethodGet, "/rules", "importer-token"); rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 with an opaque token but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if requests := server.requests.Load(); requests != 1 {
+		t.Errorf("expected the opaque token to be introspected once but got %v requests", requests)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jsonAPIMediaType is JSON:API, which the receipt endpoints in jsonAPIRoutes answer in,
+// errors included, when the client asks for it in Accept. Other clients get the
+// usual JSON.
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// jsonAPIRoutes are the GET routes that can respond in JSON:API.
+var jsonAPIRoutes = map[string]bool{
+	"/receipts/:receipt_id":           true,
+	"/receipts/:receipt_id/points":    true,
+	"/receipts/:receipt_id/breakdown": true,
+}
+
+// jsonAPIResourceType is the type of the resources the receipt endpoints render.
+const jsonAPIResourceType = "receipts"
+
+// jsonAPIDocument is a JSON:API top-level document, with either data or errors.
+type jsonAPIDocument struct {
+	Data    *jsonAPIResource  `json:"data,omitempty"`
+	Errors  []jsonAPIError    `json:"errors,omitempty"`
+	Links   map[string]string `json:"links,omitempty"`
+	JSONAPI jsonAPIObject     `json:"jsonapi"`
+}
+
+// jsonAPIObject describes the JSON:API version the document follows.
+type jsonAPIObject struct {
+	Version string `json:"version"`
+}
+
+// jsonAPIResource is a resource object. Its attributes are the body the endpoint
+// answers in plain JSON.
+type jsonAPIResource struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Attributes any               `json:"attributes"`
+	Links      map[string]string `json:"links"`
+}
+
+// jsonAPIError is a JSON:API error object, mapped from a problem: its code is the
+// problem's code and its ID the request ID.
+type jsonAPIError struct {
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+	Meta   gin.H  `json:"meta,omitempty"`
+}
+
+// jsonAPIRequested reports whether negotiateFormats chose JSON:API for the response.
+func jsonAPIRequested(c *gin.Context) bool {
+	return c.GetString("responseType") == jsonAPIMediaType
+}
+
+// respondResource answers with a JSON:API document of the receipt named in the path,
+// with attributes, the body the endpoint answers other clients with.
+func respondResource(c *gin.Context, attributes any) {
+	id := c.Param("receipt_id")
+	c.Header("Content-Type", jsonAPIMediaType)
+	c.JSON(http.StatusOK, jsonAPIDocument{
+		Data: &jsonAPIResource{
+			Type:       jsonAPIResourceType,
+			ID:         id,
+			Attributes: attributes,
+			Links:      map[string]string{"self": "/receipts/" + id},
+		},
+		Links:   map[string]string{"self": c.Request.URL.RequestURI()},
+		JSONAPI: jsonAPIObject{Version: "1.0"},
+	})
+}
+
+// abortWithJSONAPIError stops the handler chain and responds with p as a JSON:API
+// error, with meta for the members the problem adds.
+func abortWithJSONAPIError(c *gin.Context, p problem, meta gin.H) {
+	if p.IncidentCode != "" {
+		if meta == nil {
+			meta = gin.H{}
+		}
+		meta["incidentCode"] = p.IncidentCode
+	}
+	c.Header("Content-Type", jsonAPIMediaType)
+	c.AbortWithStatusJSON(p.Status, jsonAPIDocument{
+		Errors: []jsonAPIError{{
+			ID:     p.RequestID,
+			Status: strconv.Itoa(p.Status),
+			Code:   p.Code,
+			Title:  p.Title,
+			Detail: p.Detail,
+			Meta:   meta,
+		}},
+		JSONAPI: jsonAPIObject{Version: "1.0"},
+	})
+}
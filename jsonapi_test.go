@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readJSONAPI decodes a JSON:API document, failing unless it has the members the
+// spec requires: data or errors but not both, resources with a type, ID and
+// attributes, and errors with their status as a string.
+func readJSONAPI(t *testing.T, body []byte) map[string]any {
+	t.Helper()
+	var doc map[string]any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("expected a JSON:API document but got %v: %s", err, body)
+	}
+	for member := range doc {
+		switch member {
+		case "data", "errors", "links", "jsonapi", "meta":
+		default:
+			t.Errorf("expected only JSON:API members but got %q", member)
+		}
+	}
+	_, hasData := doc["data"]
+	_, hasErrors := doc["errors"]
+	if hasData == hasErrors {
+		t.Fatalf("expected either data or errors but got %s", body)
+	}
+	if lookup(doc, "jsonapi", "version") != "1.0" {
+		t.Errorf("expected JSON:API 1.0 but got %v", doc["jsonapi"])
+	}
+	if hasData {
+		data, _ := doc["data"].(map[string]any)
+		if data["type"] != jsonAPIResourceType || data["id"] == "" || lookup(data, "attributes") == nil || lookup(data, "links", "self") == nil {
+			t.Errorf("expected a receipts resource but got %v", doc["data"])
+		}
+	}
+	errs, _ := doc["errors"].([]any)
+	for _, e := range errs {
+		if _, ok := lookup(e, "status").(string); !ok || lookup(e, "title") == nil {
+			t.Errorf("expected an error object with a status and title but got %v", e)
+		}
+	}
+	if hasErrors && len(errs) == 0 {
+		t.Errorf("expected at least one error but got %s", body)
+	}
+	return doc
+}
+
+func TestJSONAPIResources(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	id, _ := processAndScore(t, router, validReceiptPayload)
+
+	rr := serveBody(router, http.MethodGet, "/receipts/"+id, "", jsonAPIMediaType, nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != jsonAPIMediaType {
+		t.Fatalf("expected a JSON:API 200 but got %v %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	doc := readJSONAPI(t, rr.Body.Bytes())
+	if lookup(doc, "data", "id") != id || lookup(doc, "data", "attributes", "retailer") != "Target" {
+		t.Errorf("expected the receipt as attributes but got %v", doc["data"])
+	}
+	if lookup(doc, "links", "self") != "/receipts/"+id || lookup(doc, "data", "links", "self") != "/receipts/"+id {
+		t.Errorf("expected links to the receipt but got %v %v", doc["links"], lookup(doc, "data", "links"))
+	}
+
+	rr = serveBody(router, http.MethodGet, "/receipts/"+id+"/points", "", "application/vnd.api+json, application/json;q=0.5", nil)
+	doc = readJSONAPI(t, rr.Body.Bytes())
+	if lookup(doc, "data", "attributes", "points") != float64(28) || lookup(doc, "data", "attributes", "rulesVersion") == nil {
+		t.Errorf("expected 28 points as attributes but got %v", doc["data"])
+	}
+	if lookup(doc, "links", "self") != "/receipts/"+id+"/points" {
+		t.Errorf("expected a link to the points but got %v", doc["links"])
+	}
+
+	rr = serveBody(router, http.MethodGet, "/receipts/"+id+"/breakdown", "", jsonAPIMediaType, nil)
+	doc = readJSONAPI(t, rr.Body.Bytes())
+	if breakdown, _ := lookup(doc, "data", "attributes", "breakdown").([]any); len(breakdown) == 0 {
+		t.Errorf("expected the breakdown as attributes but got %v", doc["data"])
+	}
+
+	// Other clients get the JSON they always have.
+	for _, accept := range []string{"", "application/json", "*/*"} {
+		rr = serveBody(router, http.MethodGet, "/receipts/"+id+"/points", "", accept, nil)
+		if !strings.HasPrefix(rr.Header().Get("Content-Type"), gin.MIMEJSON) || !strings.Contains(rr.Body.String(), `"points":28,`) || strings.Contains(rr.Body.String(), `"data"`) {
+			t.Errorf("%q: expected plain JSON but got %s %s", accept, rr.Header().Get("Content-Type"), rr.Body.String())
+		}
+	}
+	// Only the receipt endpoints respond in JSON:API.
+	rr = serveBody(router, http.MethodGet, "/rules", "", jsonAPIMediaType, nil)
+	if strings.Contains(rr.Body.String(), `"jsonapi"`) {
+		t.Errorf("expected /rules in plain JSON but got %s", rr.Body.String())
+	}
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	rr := serveBody(router, http.MethodGet, "/receipts/unknown/points", "", jsonAPIMediaType, nil)
+	if rr.Code != http.StatusNotFound || rr.Header().Get("Content-Type") != jsonAPIMediaType {
+		t.Fatalf("expected a JSON:API 404 but got %v %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	doc := readJSONAPI(t, rr.Body.Bytes())
+	e := doc["errors"].([]any)[0]
+	if lookup(e, "status") != "404" || lookup(e, "code") != "RECEIPT_NOT_FOUND" || lookup(e, "title") != "Not Found" || lookup(e, "detail") != "Receipt not found" {
+		t.Errorf("expected the RECEIPT_NOT_FOUND error but got %v", e)
+	}
+
+	// Errors from before the handler follow the mode too.
+	useAPIKeys(t, []apiKey{{ID: "web", Key: "secret"}})
+	rr = serveBody(router, http.MethodGet, "/receipts/unknown", "", jsonAPIMediaType, nil)
+	doc = readJSONAPI(t, rr.Body.Bytes())
+	if rr.Code != http.StatusUnauthorized || lookup(doc["errors"].([]any)[0], "status") != "401" {
+		t.Errorf("expected a JSON:API 401 but got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// The default error shape is untouched.
+	rr = serveBody(router, http.MethodGet, "/receipts/unknown", "", "", nil)
+	if rr.Code != http.StatusUnauthorized || strings.Contains(rr.Body.String(), "errors") {
+		t.Errorf("expected the usual error but got %v %s", rr.Code, rr.Body.String())
+	}
+}
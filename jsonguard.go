@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jsonScanOptions are the structural checks applied to JSON bodies before they are
+// decoded into a Receipt.
+type jsonScanOptions struct {
+	maxDepth           int
+	maxTokens          int
+	allowDuplicateKeys bool
+}
+
+var jsonOptions = jsonScanOptions{maxDepth: 20, maxTokens: 10000}
+
+// jsonStructureError reports a document rejected by scanJSON.
+type jsonStructureError struct {
+	code   string
+	detail string
+}
+
+func (e *jsonStructureError) Error() string {
+	return e.detail
+}
+
+// jsonFrame is an object or array the scanner is currently inside of.
+type jsonFrame struct {
+	object    bool
+	expectKey bool
+	key       string
+	index     int
+	keys      map[string]string
+}
+
+// jsonPath renders the location described by frames, e.g. "items[1]".
+func jsonPath(frames []*jsonFrame) string {
+	var path strings.Builder
+	for i, frame := range frames[:len(frames)-1] {
+		if frame.object {
+			if i > 0 {
+				path.WriteByte('.')
+			}
+			path.WriteString(frame.key)
+		} else {
+			path.WriteString("[" + strconv.Itoa(frame.index) + "]")
+		}
+	}
+	if path.Len() == 0 {
+		return "the top-level object"
+	}
+	return path.String()
+}
+
+// foldKey is the member name key matches a struct field by. encoding/json ignores
+// case, folding the Kelvin sign to k and the long s to s as well, so "total" and
+// "Total" set the same field.
+func foldKey(key string) string {
+	return strings.ToLower(strings.ToUpper(key))
+}
+
+// scanJSON walks the tokens of data and rejects documents nested deeper than maxDepth,
+// made of more than maxTokens tokens, or, unless allowDuplicateKeys is set, containing
+// an object with the same member name twice, ignoring case as encoding/json does.
+// encoding/json silently keeps the last duplicate, so a proxy inspecting the first one
+// could be shown a different receipt.
+// Pathological input is refused before anything is allocated for it. A limit of zero
+// disables the corresponding check. Syntax errors are not reported here; they are left
+// for the binder to describe.
+func scanJSON(data []byte, options jsonScanOptions) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var frames []*jsonFrame
+	valueDone := func() {
+		if len(frames) == 0 {
+			return
+		}
+		if top := frames[len(frames)-1]; top.object {
+			top.expectKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	tokens := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+
+		tokens++
+		if options.maxTokens > 0 && tokens > options.maxTokens {
+			return &jsonStructureError{
+				code:   "JSON_TOO_MANY_TOKENS",
+				detail: fmt.Sprintf("JSON document exceeds the limit of %d tokens", options.maxTokens),
+			}
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			if options.maxDepth > 0 && len(frames) >= options.maxDepth {
+				return &jsonStructureError{
+					code:   "JSON_TOO_DEEP",
+					detail: fmt.Sprintf("JSON document exceeds the maximum nesting depth of %d", options.maxDepth),
+				}
+			}
+			frame := &jsonFrame{object: token == json.Delim('{'), expectKey: true}
+			if frame.object && !options.allowDuplicateKeys {
+				frame.keys = make(map[string]string)
+			}
+			frames = append(frames, frame)
+		case json.Delim('}'), json.Delim(']'):
+			frames = frames[:len(frames)-1]
+			valueDone()
+		default:
+			if len(frames) > 0 {
+				if top := frames[len(frames)-1]; top.object && top.expectKey {
+					top.key, top.expectKey = token.(string), false
+					if top.keys == nil {
+						continue
+					}
+					folded := foldKey(top.key)
+					if seen, ok := top.keys[folded]; ok {
+						detail := fmt.Sprintf("duplicate key %q in %s", top.key, jsonPath(frames))
+						if seen != top.key {
+							detail += fmt.Sprintf(", a case variant of %q", seen)
+						}
+						return &jsonStructureError{code: "JSON_DUPLICATE_KEY", detail: detail}
+					}
+					top.keys[folded] = top.key
+					continue
+				}
+			}
+			valueDone()
+		}
+	}
+}
+
+// guardJSON buffers the (already size-limited) request body and runs scanJSON over it
+// before handing an identical body on to the handler. Bodies in other formats are
+// passed through, since they are decoded strictly into a Receipt, which bounds their
+// structure.
+func guardJSON(options jsonScanOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if requestFormat(c) != jsonFormat {
+			c.Next()
+			return
+		}
+		data, err := io.ReadAll(c.Request.Body)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			abortWithBodyTooLarge(c, maxBytesErr.Limit)
+			return
+		}
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, "BODY_UNREADABLE", "Failed to read the request body")
+			return
+		}
+
+		var structureErr *jsonStructureError
+		if errors.As(scanJSON(data, options), &structureErr) {
+			abortWithProblem(c, http.StatusBadRequest, structureErr.code, structureErr.detail)
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+		c.Next()
+	}
+}
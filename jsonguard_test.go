@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestScanJSON(t *testing.T) {
+	testCases := []struct {
+		name         string
+		input        string
+		maxDepth     int
+		maxTokens    int
+		expectedCode string
+	}{
+		{name: "Receipt", input: validReceiptPayload, maxDepth: 20, maxTokens: 10000},
+		{name: "AtDepth", input: strings.Repeat("[", 20) + strings.Repeat("]", 20), maxDepth: 20},
+		{name: "OverDepth", input: strings.Repeat("[", 21) + strings.Repeat("]", 21), maxDepth: 20, expectedCode: "JSON_TOO_DEEP"},
+		{name: "OverDepthObjects", input: strings.Repeat(`{"a":`, 4) + "1" + strings.Repeat("}", 4), maxDepth: 3, expectedCode: "JSON_TOO_DEEP"},
+		{name: "UnterminatedOverDepth", input: strings.Repeat("[", 100000), maxDepth: 20, expectedCode: "JSON_TOO_DEEP"},
+		{name: "BracketsInStrings", input: `{"retailer": "[[[[[[[[[[{{{{{{{{"}`, maxDepth: 2},
+		{name: "DepthDisabled", input: strings.Repeat("[", 50) + strings.Repeat("]", 50)},
+		{name: "AtTokens", input: `[1,2,3]`, maxTokens: 5},
+		{name: "OverTokens", input: `[1,2,3,4]`, maxTokens: 5, expectedCode: "JSON_TOO_MANY_TOKENS"},
+		{name: "SyntaxErrorLeftToBinder", input: `{"retailer": }`, maxDepth: 20, maxTokens: 10},
+		{name: "Empty", input: ``, maxDepth: 20, maxTokens: 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := scanJSON([]byte(tc.input), jsonScanOptions{maxDepth: tc.maxDepth, maxTokens: tc.maxTokens})
+			if tc.expectedCode == "" {
+				if err != nil {
+					t.Errorf("expected the document to be accepted but got %v", err)
+				}
+				return
+			}
+			structureErr, ok := err.(*jsonStructureError)
+			if !ok {
+				t.Fatalf("expected a %s error but got %v", tc.expectedCode, err)
+			}
+			if structureErr.code != tc.expectedCode {
+				t.Errorf("expected code %s but got %s", tc.expectedCode, structureErr.code)
+			}
+		})
+	}
+}
+
+func TestGuardJSONRejectsDeepNesting(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	testCases := []struct {
+		name           string
+		payload        string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "NestedArrays", payload: strings.Repeat("[", 100000) + strings.Repeat("]", 100000), expectedStatus: http.StatusBadRequest, expectedCode: "JSON_TOO_DEEP"},
+		{name: "NestedItems", payload: `{"items": [` + strings.Repeat("[", 30) + strings.Repeat("]", 30) + `]}`, expectedStatus: http.StatusBadRequest, expectedCode: "JSON_TOO_DEEP"},
+		{name: "ManyTokens", payload: "[" + strings.Repeat("0,", jsonOptions.maxTokens) + "0]", expectedStatus: http.StatusBadRequest, expectedCode: "JSON_TOO_MANY_TOKENS"},
+		{name: "Receipt", payload: validReceiptPayload, expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(tc.payload))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v but got %v: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tc.expectedCode == "" {
+				return
+			}
+			var body problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tc.expectedCode {
+				t.Errorf("expected code %s but got %s", tc.expectedCode, body.Code)
+			}
+		})
+	}
+}
+
+func TestScanJSONDuplicateKeys(t *testing.T) {
+	testCases := []struct {
+		name           string
+		input          string
+		allow          bool
+		expectedDetail string
+	}{
+		{name: "TopLevel", input: `{"total": "1.00", "total": "999.00"}`, expectedDetail: `duplicate key "total" in the top-level object`},
+		{name: "InItem", input: `{"items": [{"price": "1.00"}, {"price": "1.00", "shortDescription": "x", "price": "2.00"}]}`, expectedDetail: `duplicate key "price" in items[1]`},
+		{name: "InNestedObject", input: `{"a": {"b": {"c": 1, "c": 2}}}`, expectedDetail: `duplicate key "c" in a.b`},
+		{name: "AfterNestedValue", input: `{"items": [], "retailer": "x", "items": []}`, expectedDetail: `duplicate key "items" in the top-level object`},
+		{name: "CaseVariant", input: `{"total": "1.00", "Total": "999.00"}`, expectedDetail: `duplicate key "Total" in the top-level object, a case variant of "total"`},
+		{name: "CaseVariantInItem", input: `{"items": [{"price": "1.00", "PRICE": "2.00"}]}`, expectedDetail: `duplicate key "PRICE" in items[0], a case variant of "price"`},
+		{name: "KelvinSign", input: `{"k": 1, "\u212a": 2}`, expectedDetail: `duplicate key "K" in the top-level object, a case variant of "k"`},
+		{name: "SameKeyInSiblings", input: `{"items": [{"price": "1.00"}, {"price": "2.00"}]}`},
+		{name: "KeyMatchesValue", input: `{"retailer": "total", "total": "retailer"}`},
+		{name: "SameKeyAtDifferentLevels", input: `{"price": {"price": 1}}`},
+		{name: "Receipt", input: validReceiptPayload},
+		{name: "Allowed", input: `{"total": "1.00", "total": "999.00"}`, allow: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := scanJSON([]byte(tc.input), jsonScanOptions{allowDuplicateKeys: tc.allow})
+			if tc.expectedDetail == "" {
+				if err != nil {
+					t.Errorf("expected the document to be accepted but got %v", err)
+				}
+				return
+			}
+			structureErr, ok := err.(*jsonStructureError)
+			if !ok {
+				t.Fatalf("expected a duplicate key error but got %v", err)
+			}
+			if structureErr.code != "JSON_DUPLICATE_KEY" {
+				t.Errorf("expected code JSON_DUPLICATE_KEY but got %s", structureErr.code)
+			}
+			if structureErr.detail != tc.expectedDetail {
+				t.Errorf("expected detail %q but got %q", tc.expectedDetail, structureErr.detail)
+			}
+		})
+	}
+}
+
+func TestGuardJSONRejectsDuplicateKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	// encoding/json would keep the last total of either, whatever its case.
+	for _, duplicate := range []string{`"total": "1.00", "total": "35.35",`, `"total": "1.00", "Total": "35.35",`} {
+		payload := strings.Replace(validReceiptPayload, `"total": "35.35",`, duplicate, 1)
+		req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %v but got %v", duplicate, http.StatusBadRequest, rr.Code)
+		}
+		var body problem
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != "JSON_DUPLICATE_KEY" || !strings.Contains(body.Detail, `"total"`) {
+			t.Errorf("%s: expected a JSON_DUPLICATE_KEY problem naming total but got %+v", duplicate, body)
+		}
+	}
+	if len(receipts) != 0 {
+		t.Errorf("expected no receipt to be stored but %d were", len(receipts))
+	}
+}
+
+// nestingDepth computes the maximum bracket depth of a document independently of the
+// decoder, skipping over string contents.
+func nestingDepth(data []byte) int {
+	depth, deepest, inString, escaped := 0, 0, false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && b == '\\':
+			escaped = true
+		case b == '"':
+			inString = !inString
+		case inString:
+		case b == '[' || b == '{':
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case b == ']' || b == '}':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// FuzzScanJSON checks that scanJSON never lets a valid document deeper than the limit
+// through. Inputs found while fuzzing are kept in testdata/fuzz/FuzzScanJSON.
+func FuzzScanJSON(f *testing.F) {
+	f.Add([]byte(validReceiptPayload))
+	f.Add([]byte(strings.Repeat("[", 1000)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const maxDepth = 5
+		err := scanJSON(data, jsonScanOptions{maxDepth: maxDepth, allowDuplicateKeys: true})
+		if err == nil && json.Valid(data) && nestingDepth(data) > maxDepth {
+			t.Errorf("accepted a document nested %d deep", nestingDepth(data))
+		}
+		if err != nil && nestingDepth(data) <= maxDepth {
+			t.Errorf("rejected a document nested %d deep: %v", nestingDepth(data), err)
+		}
+	})
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jwks verifies the bearer tokens of users, signed by the identity provider with a key
+// from the --jwks-url. It is nil unless the flag is set.
+var jwks atomic.Pointer[jwksCache]
+
+// The --jwks-url and the claims tokens must carry. An empty issuer or audience isn't
+// checked. Users whose roles claim holds jwtAdminRole can read every receipt.
+var (
+	jwksURL      string
+	jwtIssuer    string
+	jwtAudience  string
+	jwtAdminRole = "admin"
+)
+
+var (
+	// jwksTimeout bounds each fetch of the JWKS.
+	jwksTimeout = 5 * time.Second
+	// jwksRefreshInterval is how long a fetch of the JWKS, successful or not, is
+	// reused before a token signed with an unknown key fetches it again.
+	jwksRefreshInterval = 10 * time.Second
+)
+
+var (
+	errJWKSUnavailable = errors.New("the signing keys could not be fetched")
+	errTokenExpired    = errors.New("the token has expired")
+)
+
+// missingClaimError reports a token without a claim users must have.
+type missingClaimError struct {
+	claim string
+}
+
+func (e *missingClaimError) Error() string {
+	return fmt.Sprintf("the token has no %q claim", e.claim)
+}
+
+// jwksCache holds the RSA public keys of a JWKS by key ID. The JWKS is fetched
+// without holding mu, so tokens signed with a cached key are verified while a fetch
+// waits on the identity provider.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	lastAttempt time.Time
+	fetching    *jwksFetch
+}
+
+// jwksFetch is a fetch of the JWKS under way. Callers needing the JWKS meanwhile wait
+// for done rather than fetching it again.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// newJWKSCache returns an empty cache of the JWKS at url. Keys are fetched on the first
+// call to refresh or key.
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: jwksTimeout}}
+}
+
+// refresh fetches the JWKS again, or waits for the fetch under way. On error the
+// current keys are kept.
+func (c *jwksCache) refresh() error {
+	_, err := c.update(true)
+	return err
+}
+
+// update fetches the JWKS again if force is set or jwksRefreshInterval has passed
+// since the last attempt, swapping in its keys. If a fetch is already under way it
+// waits for that one instead. It reports whether it fetched the JWKS itself, with the
+// error of the fetch it made or waited for.
+func (c *jwksCache) update(force bool) (bool, error) {
+	c.mu.Lock()
+	if f := c.fetching; f != nil {
+		c.mu.Unlock()
+		<-f.done
+		return false, f.err
+	}
+	if !force && !c.lastAttempt.IsZero() && clock.Now().Sub(c.lastAttempt) < jwksRefreshInterval {
+		c.mu.Unlock()
+		return false, nil
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	c.fetching, c.lastAttempt = f, clock.Now()
+	c.mu.Unlock()
+
+	keys, err := c.fetch()
+	c.mu.Lock()
+	if err == nil {
+		c.keys = keys
+	}
+	c.fetching = nil
+	c.mu.Unlock()
+	f.err = err
+	close(f.done)
+	return true, err
+}
+
+// fetch fetches and parses the JWKS.
+func (c *jwksCache) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded %s", c.url, resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.url, err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		// Keys of other types can't sign RS256 tokens.
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: modulus: %w", c.url, k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: exponent: %w", c.url, k.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 2 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("%s: key %q: exponent is out of range", c.url, k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+	return keys, nil
+}
+
+// key returns the key with an ID. A key missing from the cache fetches the JWKS again,
+// so a rotated key is picked up without a restart. Tokens naming unknown keys fetch it
+// at most once every jwksRefreshInterval, however many arrive, and share the fetch
+// under way.
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if fetched, err := c.update(false); fetched && err != nil {
+		log.Printf("fetching the JWKS failed: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		return nil, errJWKSUnavailable
+	}
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key has the ID %q", kid)
+}
+
+// audience is the aud claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtClaims are the claims of a user's token this service reads.
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	Roles     []string `json:"roles"`
+}
+
+// isAdmin reports whether the roles claim holds jwtAdminRole.
+func (c *jwtClaims) isAdmin() bool {
+	for _, role := range c.Roles {
+		if role == jwtAdminRole {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url JSON segment of a token into v.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verify checks the RS256 signature, expiry, issuer and audience of a token and
+// returns its claims. Tokens without a subject or expiry fail with a
+// *missingClaimError.
+func (c *jwksCache) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the token is not a signed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("the token header is malformed: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("the token is signed with %q instead of RS256", header.Alg)
+	}
+	key, err := c.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("the token signature is malformed: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("the token signature is invalid")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("the token claims are malformed: %w", err)
+	}
+	now := clock.Now()
+	if claims.ExpiresAt != nil && !now.Before(time.Unix(int64(*claims.ExpiresAt), 0)) {
+		return nil, errTokenExpired
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return nil, errors.New("the token is not valid yet")
+	}
+	if jwtIssuer != "" && claims.Issuer != jwtIssuer {
+		return nil, fmt.Errorf("the token was issued by %q instead of %q", claims.Issuer, jwtIssuer)
+	}
+	if jwtAudience != "" && !claims.Audience.contains(jwtAudience) {
+		return nil, fmt.Errorf("the token is not meant for %q", jwtAudience)
+	}
+	if claims.Subject == "" {
+		return nil, &missingClaimError{claim: "sub"}
+	}
+	if claims.ExpiresAt == nil {
+		return nil, &missingClaimError{claim: "exp"}
+	}
+	return &claims, nil
+}
+
+// authenticate lets requests through with a valid bearer token from the identity
+// provider. A user's JWT records its subject under "user" in the context, in place of
+// the identity of any client certificate, and whether it has the admin role under
+// "admin"; a service's opaque token needs scope and is checked by
+// authenticateClient. Requests without a bearer token need an API key with scope, as
+// checked by requireAPIKey. Without --jwks-url or --introspection-url it is
+// requireAPIKey.
+func authenticate(scope string) gin.HandlerFunc {
+	requireKey := requireAPIKey(scope)
+	return func(c *gin.Context) {
+		cache, introspector := jwks.Load(), introspection.Load()
+		if cache == nil && introspector == nil {
+			requireKey(c)
+			return
+		}
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			if len(currentAPIKeys()) == 0 {
+				c.Header("WWW-Authenticate", `Bearer`)
+				abortWithProblem(c, http.StatusUnauthorized, "TOKEN_REQUIRED", "requests require a bearer token")
+				return
+			}
+			requireKey(c)
+			return
+		}
+		if introspector != nil && (cache == nil || !looksLikeJWT(token)) {
+			authenticateClient(c, introspector, token, scope)
+			return
+		}
+		if cache == nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			abortWithProblem(c, http.StatusUnauthorized, "TOKEN_INVALID", "the token is not an opaque access token")
+			return
+		}
+
+		claims, err := cache.verify(token)
+		var missing *missingClaimError
+		switch {
+		case err == nil:
+		case errors.Is(err, errJWKSUnavailable):
+			abortWithProblem(c, http.StatusServiceUnavailable, "JWKS_UNAVAILABLE", err.Error())
+			return
+		case errors.As(err, &missing):
+			abortWithProblem(c, http.StatusForbidden, "TOKEN_CLAIM_MISSING", err.Error())
+			return
+		case errors.Is(err, errTokenExpired):
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			abortWithProblem(c, http.StatusUnauthorized, "TOKEN_EXPIRED", err.Error())
+			return
+		default:
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			abortWithProblem(c, http.StatusUnauthorized, "TOKEN_INVALID", err.Error())
+			return
+		}
+
+		c.Set("user", claims.Subject)
+		c.Set("admin", claims.isAdmin())
+		c.Next()
+	}
+}
+
+// canAccess reports whether the caller may see a stored receipt: users see the
+// receipts they processed, and admins and API key callers see every receipt.
+func canAccess(c *gin.Context, stored StoredReceipt) bool {
+	return mayAccess(c.GetString("user"), c.GetBool("admin"), stored.Owner)
+}
+
+// mayAccess reports whether user, an admin if admin, may see a receipt of owner.
+func mayAccess(user string, admin bool, owner string) bool {
+	return user == "" || admin || owner == user
+}
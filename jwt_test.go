@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var jwtNow = time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+
+// testIdP serves a JWKS of the public halves of its signing keys.
+type testIdP struct {
+	mu    sync.Mutex
+	keys  map[string]*rsa.PrivateKey
+	down  bool
+	delay time.Duration
+	// hold, if set, holds each response until it is closed.
+	hold    chan struct{}
+	fetches atomic.Int32
+}
+
+func (p *testIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.fetches.Add(1)
+	p.mu.Lock()
+	down, delay, hold := p.down, p.delay, p.hold
+	type jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{{Kty: "EC", Kid: "ignored"}}}
+	for kid, key := range p.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	p.mu.Unlock()
+
+	time.Sleep(delay)
+	if hold != nil {
+		<-hold
+	}
+	if down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+// setKeys replaces the signing keys the IdP publishes.
+func (p *testIdP) setKeys(keys map[string]*rsa.PrivateKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+}
+
+func (p *testIdP) setDown(down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = down
+}
+
+// useIdP starts an IdP publishing keys and makes the service trust it for the rest of
+// the test.
+func useIdP(t *testing.T, keys map[string]*rsa.PrivateKey) (*testIdP, *jwksCache) {
+	t.Helper()
+	idp := &testIdP{keys: keys}
+	server := httptest.NewServer(idp)
+	t.Cleanup(server.Close)
+	cache := newJWKSCache(server.URL)
+	jwks.Store(cache)
+	t.Cleanup(func() { jwks.Store(nil) })
+	return idp, cache
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signToken returns a token with header and claims signed with key using RS256,
+// whatever alg the header names.
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// userToken returns a token for user valid for an hour, signed with key under kid.
+func userToken(t *testing.T, key *rsa.PrivateKey, kid, user string, roles ...string) string {
+	t.Helper()
+	claims := map[string]any{"sub": user, "exp": jwtNow.Add(time.Hour).Unix()}
+	if len(roles) > 0 {
+		claims["roles"] = roles
+	}
+	return signToken(t, key, map[string]any{"alg": "RS256", "kid": kid}, claims)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	useFakeClock(t, jwtNow)
+	key, other := generateKey(t), generateKey(t)
+	_, cache := useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+	defer func(issuer, aud string) { jwtIssuer, jwtAudience = issuer, aud }(jwtIssuer, jwtAudience)
+	jwtIssuer, jwtAudience = "https://idp.example.com", "receipts"
+
+	header := map[string]any{"alg": "RS256", "kid": "k1"}
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": jwtIssuer, "aud": []string{"receipts", "other"}, "exp": jwtNow.Add(time.Hour).Unix()}
+		for name, value := range overrides {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	testCases := []struct {
+		name     string
+		token    string
+		expected string
+		missing  string
+	}{
+		{name: "Valid", token: signToken(t, key, header, claims(nil))},
+		{name: "SingleAudience", token: signToken(t, key, header, claims(map[string]any{"aud": "receipts"}))},
+		{name: "Expired", token: signToken(t, key, header, claims(map[string]any{"exp": jwtNow.Unix()})), expected: "the token has expired"},
+		{name: "NotYetValid", token: signToken(t, key, header, claims(map[string]any{"nbf": jwtNow.Add(time.Minute).Unix()})), expected: "the token is not valid yet"},
+		{name: "WrongIssuer", token: signToken(t, key, header, claims(map[string]any{"iss": "https://evil.example.com"})), expected: `the token was issued by "https://evil.example.com" instead of "https://idp.example.com"`},
+		{name: "WrongAudience", token: signToken(t, key, header, claims(map[string]any{"aud": "other"})), expected: `the token is not meant for "receipts"`},
+		{name: "WrongKey", token: signToken(t, other, header, claims(nil)), expected: "the token signature is invalid"},
+		{name: "HS256", token: signToken(t, key, map[string]any{"alg": "HS256", "kid": "k1"}, claims(nil)), expected: `the token is signed with "HS256" instead of RS256`},
+		{name: "None", token: signToken(t, key, map[string]any{"alg": "none", "kid": "k1"}, claims(nil)), expected: `the token is signed with "none" instead of RS256`},
+		{name: "UnknownKey", token: signToken(t, key, map[string]any{"alg": "RS256", "kid": "k9"}, claims(nil)), expected: `no signing key has the ID "k9"`},
+		{name: "NotAJWT", token: "abc.def", expected: "the token is not a signed JWT"},
+		{name: "NoSubject", token: signToken(t, key, header, claims(map[string]any{"sub": nil})), missing: "sub"},
+		{name: "NoExpiry", token: signToken(t, key, header, claims(map[string]any{"exp": nil})), missing: "exp"},
+	}
+	for _, tc := range testCases {
+		claims, err := cache.verify(tc.token)
+		var missing *missingClaimError
+		switch {
+		case tc.missing != "":
+			if !errors.As(err, &missing) || missing.claim != tc.missing {
+				t.Errorf("%s: expected the %q claim to be missing but got %v", tc.name, tc.missing, err)
+			}
+		case tc.expected != "":
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("%s: expected %q but got %v", tc.name, tc.expected, err)
+			}
+		case err != nil:
+			t.Errorf("%s: expected the token to verify but got %v", tc.name, err)
+		case claims.Subject != "alice":
+			t.Errorf("%s: expected the subject alice but got %q", tc.name, claims.Subject)
+		}
+	}
+}
+
+func TestJWTReceiptOwnership(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, jwtNow)
+	router := newRouter()
+	key := generateKey(t)
+	useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		var req *http.Request
+		if method == http.MethodPost {
+			req = httptest.NewRequest(method, path, strings.NewReader(validReceiptPayload))
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req = httptest.NewRequest(method, path, nil)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	alice := userToken(t, key, "k1", "alice")
+	rr := request(http.MethodPost, "/receipts/process", alice)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v: %s", rr.Code, rr.Body.String())
+	}
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil {
+		t.Fatal(err)
+	}
+	receiptsMu.RLock()
+	owner := receipts[processed.ID].Owner
+	receiptsMu.RUnlock()
+	if owner != "alice" {
+		t.Errorf("expected the receipt to be attributed to alice but got %q", owner)
+	}
+
+	points := "/receipts/" + processed.ID + "/points"
+	expired := signToken(t, key, map[string]any{"alg": "RS256", "kid": "k1"}, map[string]any{"sub": "alice", "exp": jwtNow.Add(-time.Minute).Unix()})
+	noSubject := signToken(t, key, map[string]any{"alg": "RS256", "kid": "k1"}, map[string]any{"exp": jwtNow.Add(time.Hour).Unix()})
+	testCases := []struct {
+		name           string
+		path, token    string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "Owner", path: points, token: alice, expectedStatus: http.StatusOK},
+		{name: "OwnerBreakdown", path: "/receipts/" + processed.ID + "/breakdown", token: alice, expectedStatus: http.StatusOK},
+		{name: "OtherUser", path: points, token: userToken(t, key, "k1", "bob"), expectedStatus: http.StatusNotFound},
+		{name: "OtherUserReceipt", path: "/receipts/" + processed.ID, token: userToken(t, key, "k1", "bob"), expectedStatus: http.StatusNotFound},
+		{name: "Admin", path: points, token: userToken(t, key, "k1", "carol", "admin"), expectedStatus: http.StatusOK},
+		{name: "NoToken", path: points, expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_REQUIRED"},
+		{name: "Expired", path: points, token: expired, expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_EXPIRED"},
+		{name: "Invalid", path: points, token: alice[:len(alice)-4] + "AAAA", expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_INVALID"},
+		{name: "MissingClaim", path: points, token: noSubject, expectedStatus: http.StatusForbidden, expectedCode: "TOKEN_CLAIM_MISSING"},
+	}
+	for _, tc := range testCases {
+		rr := request(http.MethodGet, tc.path, tc.token)
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: expected status %v but got %v: %s", tc.name, tc.expectedStatus, rr.Code, rr.Body.String())
+		}
+		if tc.expectedCode != "" && !strings.Contains(rr.Body.String(), tc.expectedCode) {
+			t.Errorf("%s: expected the %s code but got %s", tc.name, tc.expectedCode, rr.Body.String())
+		}
+	}
+
+	// Callers with an API key aren't users and see every receipt.
+	useAPIKeys(t, []apiKey{{ID: "backend", Key: "k-backend", Scopes: defaultScopes}})
+	if rr := requestWithKey(router, http.MethodGet, points, "k-backend"); rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 with an API key but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestJWKSRefreshOnKeyMiss(t *testing.T) {
+	fake := useFakeClock(t, jwtNow)
+	k1, k2 := generateKey(t), generateKey(t)
+	idp, cache := useIdP(t, map[string]*rsa.PrivateKey{"k1": k1})
+
+	if _, err := cache.verify(userToken(t, k1, "k1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.verify(userToken(t, k1, "k1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if fetches := idp.fetches.Load(); fetches != 1 {
+		t.Errorf("expected the JWKS to be fetched once but got %v fetches", fetches)
+	}
+
+	// The IdP rotates to k2. A token signed with it fetches the JWKS again, but only once
+	// per refresh interval.
+	fake.Advance(jwksRefreshInterval)
+	idp.setKeys(map[string]*rsa.PrivateKey{"k2": k2})
+	if _, err := cache.verify(userToken(t, k2, "k2", "alice")); err != nil {
+		t.Errorf("expected the rotated key to be fetched but got %v", err)
+	}
+	if _, err := cache.verify(userToken(t, k1, "k3", "alice")); err == nil {
+		t.Error("expected a token with an unknown key to be rejected")
+	}
+	if fetches := idp.fetches.Load(); fetches != 2 {
+		t.Errorf("expected 2 fetches but got %v", fetches)
+	}
+	fake.Advance(jwksRefreshInterval)
+	cache.verify(userToken(t, k1, "k3", "alice"))
+	if fetches := idp.fetches.Load(); fetches != 3 {
+		t.Errorf("expected 3 fetches after the refresh interval but got %v", fetches)
+	}
+}
+
+func TestJWKSFetchDoesNotBlockVerification(t *testing.T) {
+	fake := useFakeClock(t, jwtNow)
+	k1, k2 := generateKey(t), generateKey(t)
+	idp, cache := useIdP(t, map[string]*rsa.PrivateKey{"k1": k1})
+	if err := cache.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The IdP rotates to k2 but is slow to answer. Tokens signed with k2 wait for a
+	// single fetch, while tokens signed with k1 are verified meanwhile.
+	fake.Advance(jwksRefreshInterval)
+	hold := make(chan struct{})
+	idp.mu.Lock()
+	idp.keys, idp.hold = map[string]*rsa.PrivateKey{"k1": k1, "k2": k2}, hold
+	idp.mu.Unlock()
+	cached, rotated := userToken(t, k1, "k1", "alice"), userToken(t, k2, "k2", "alice")
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, err := cache.verify(rotated)
+			results <- err
+		}()
+	}
+	for idp.fetches.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	verified := make(chan error, 1)
+	go func() {
+		_, err := cache.verify(cached)
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("expected the cached key to verify but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a token signed with a cached key not to wait for the fetch")
+	}
+
+	close(hold)
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err != nil {
+			t.Errorf("expected the rotated key to be fetched but got %v", err)
+		}
+	}
+	if fetches := idp.fetches.Load(); fetches != 2 {
+		t.Errorf("expected the waiting tokens to share one fetch but got %v fetches", fetches)
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	fake := useFakeClock(t, jwtNow)
+	router := newRouter()
+	key := generateKey(t)
+	idp, cache := useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+	token := userToken(t, key, "k1", "alice")
+
+	// The IdP is down at startup, so tokens can't be checked until it is back.
+	idp.setDown(true)
+	if err := cache.refresh(); err == nil {
+		t.Fatal("expected the fetch to fail")
+	}
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/rules", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "JWKS_UNAVAILABLE") {
+		t.Errorf("expected 503 JWKS_UNAVAILABLE but got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	idp.setDown(false)
+	fake.Advance(jwksRefreshInterval)
+	if _, err := cache.verify(token); err != nil {
+		t.Errorf("expected the token to verify once the IdP is back but got %v", err)
+	}
+
+	// A slow IdP fails the fetch after the timeout and keeps the current keys.
+	defer func(previous time.Duration) { jwksTimeout = previous }(jwksTimeout)
+	jwksTimeout = 50 * time.Millisecond
+	slow := newJWKSCache(cache.url)
+	idp.mu.Lock()
+	idp.delay = 500 * time.Millisecond
+	idp.mu.Unlock()
+	started := time.Now()
+	if err := slow.refresh(); err == nil {
+		t.Error("expected a slow fetch to time out")
+	}
+	if elapsed := time.Since(started); elapsed > 400*time.Millisecond {
+		t.Errorf("expected the fetch to give up after 50ms but it took %v", elapsed)
+	}
+}
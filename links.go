@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// disableLinks is --disable-links, which leaves the _links out of receipt responses.
+var disableLinks bool
+
+// link is a URL in _links.
+type link struct {
+	Href string `json:"href" yaml:"href" xml:"href,attr"`
+}
+
+// receiptLinks are the _links of a receipt response: the receipt itself, its points
+// and breakdown, and the data of the user who owns it. A link is left out when its
+// route isn't served by the router that answered.
+type receiptLinks struct {
+	Self      *link `json:"self,omitempty" yaml:"self,omitempty" xml:"self,omitempty"`
+	Points    *link `json:"points,omitempty" yaml:"points,omitempty" xml:"points,omitempty"`
+	Breakdown *link `json:"breakdown,omitempty" yaml:"breakdown,omitempty" xml:"breakdown,omitempty"`
+	Owner     *link `json:"owner,omitempty" yaml:"owner,omitempty" xml:"owner,omitempty"`
+}
+
+// linkRoutes are the paths of the routes _links point to, as a router registered
+// them.
+type linkRoutes struct {
+	self, points, breakdown, owner string
+}
+
+// handlerName is the name gin reports for a route whose last handler is handler.
+func handlerName(handler gin.HandlerFunc) string {
+	return runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+}
+
+// build finds the routes by their handlers, so links follow the paths they are
+// registered at.
+func (l *linkRoutes) build(routes gin.RoutesInfo) {
+	paths := map[string]*string{
+		handlerName(getReceipt):       &l.self,
+		handlerName(getPoints):        &l.points,
+		handlerName(getBreakdown):     &l.breakdown,
+		handlerName(eraseUserHandler): &l.owner,
+	}
+	for _, route := range routes {
+		if path, ok := paths[route.Handler]; ok {
+			*path = route.Path
+		}
+	}
+}
+
+// linkReceipts makes the routes of l available to the handlers for _links.
+func linkReceipts(l *linkRoutes) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("linkRoutes", l)
+		c.Next()
+	}
+}
+
+// receiptLinksFor returns the _links of the receipt id owned by owner, or nil with
+// --disable-links or on routers without linkReceipts.
+func receiptLinksFor(c *gin.Context, id, owner string) *receiptLinks {
+	value, ok := c.Get("linkRoutes")
+	if disableLinks || !ok {
+		return nil
+	}
+	routes := value.(*linkRoutes)
+	base := linkBase(c.Request)
+	href := func(path string) *link {
+		if path == "" {
+			return nil
+		}
+		path = strings.Replace(path, ":receipt_id", url.PathEscape(id), 1)
+		path = strings.Replace(path, ":user_id", url.PathEscape(owner), 1)
+		return &link{Href: base + path}
+	}
+	links := &receiptLinks{Self: href(routes.self), Points: href(routes.points), Breakdown: href(routes.breakdown)}
+	if owner != "" {
+		links.Owner = href(routes.owner)
+	}
+	return links
+}
+
+// linkBase is the scheme, host and path prefix clients reach the server at. Behind a
+// trusted proxy they are taken from its X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Prefix headers, such as /v1 for a proxy that serves the API there.
+// Without a host, links are relative.
+func linkBase(r *http.Request) string {
+	scheme, host, prefix := "http", r.Host, ""
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if fromTrustedProxy(r) {
+		if proto := firstForwarded(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := firstForwarded(r.Header.Get("X-Forwarded-Host")); forwardedHost != "" {
+			host = forwardedHost
+		}
+		if forwardedPrefix := firstForwarded(r.Header.Get("X-Forwarded-Prefix")); strings.HasPrefix(forwardedPrefix, "/") {
+			prefix = strings.TrimRight(forwardedPrefix, "/")
+		}
+	}
+	if host == "" {
+		return prefix
+	}
+	return scheme + "://" + host + prefix
+}
+
+// firstForwarded is the value the proxy nearest the client set in a forwarded header
+// that proxies append to.
+func firstForwarded(header string) string {
+	first, _, _ := strings.Cut(header, ",")
+	return strings.TrimSpace(first)
+}
+
+// fromTrustedProxy reports whether the peer of r is one of the proxiesToTrust.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxiesToTrust() {
+		if _, ipNet, err := net.ParseCIDR(proxy); err == nil {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
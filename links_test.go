@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getLinks sends a request for path from remoteAddr with headers, and returns the
+// _links of the response.
+func getLinks(t *testing.T, router http.Handler, method, path, remoteAddr string, headers map[string]string) map[string]string {
+	t.Helper()
+	var body *strings.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(validReceiptPayload)
+	} else {
+		body = strings.NewReader("")
+	}
+	req := httptest.NewRequest(method, path, body)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var response struct {
+		Links map[string]link `json:"_links"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected a 200 but got %v %s", rr.Code, rr.Body.String())
+	}
+	hrefs := map[string]string{}
+	for rel, l := range response.Links {
+		hrefs[rel] = l.Href
+	}
+	return hrefs
+}
+
+func TestReceiptLinks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous []string) { trustedProxies = previous }(trustedProxies)
+	trustedProxies = []string{"10.0.0.0/8"}
+	router := newRouter()
+	id, _ := processAndScore(t, router, validReceiptPayload)
+	receiptURL := "http://example.com/receipts/" + id
+
+	// Every receipt response links to the receipt and its resources.
+	want := map[string]string{"self": receiptURL, "points": receiptURL + "/points", "breakdown": receiptURL + "/breakdown"}
+	for _, path := range []string{"/receipts/" + id, "/receipts/" + id + "/points", "/receipts/" + id + "/breakdown"} {
+		if got := getLinks(t, router, http.MethodGet, path, "192.0.2.1:1234", nil); !equalJSON(got, want) {
+			t.Errorf("%s: expected %v but got %v", path, want, got)
+		}
+	}
+	got := getLinks(t, router, http.MethodPost, "/receipts/process", "192.0.2.1:1234", nil)
+	if !strings.HasPrefix(got["self"], "http://example.com/receipts/") || got["points"] != got["self"]+"/points" {
+		t.Errorf("expected links to the processed receipt but got %v", got)
+	}
+
+	// Behind a trusted proxy, links are to where the proxy serves the API.
+	proxied := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "api.example.com, proxy.internal", "X-Forwarded-Prefix": "/v1/"}
+	got = getLinks(t, router, http.MethodGet, "/receipts/"+id+"/points", "10.1.2.3:1234", proxied)
+	if want := "https://api.example.com/v1/receipts/" + id + "/breakdown"; got["breakdown"] != want {
+		t.Errorf("expected %s behind the proxy but got %v", want, got)
+	}
+	// Anyone else's forwarded headers are ignored.
+	got = getLinks(t, router, http.MethodGet, "/receipts/"+id+"/points", "192.0.2.1:1234", proxied)
+	if got["self"] != receiptURL {
+		t.Errorf("expected %s from an untrusted peer but got %v", receiptURL, got)
+	}
+
+	// A receipt with an owner links to their data, while the admin routes are served.
+	receiptsMu.Lock()
+	stored := receipts[id]
+	stored.Owner = "user 1"
+	receipts[id] = stored
+	receiptsMu.Unlock()
+	got = getLinks(t, router, http.MethodGet, "/receipts/"+id, "192.0.2.1:1234", nil)
+	if want := "http://example.com/admin/users/user%201/data"; got["owner"] != want {
+		t.Errorf("expected the owner link %s but got %v", want, got)
+	}
+	defer func(previous string) { adminAddr = previous }(adminAddr)
+	adminAddr = "127.0.0.1:0"
+	got = getLinks(t, newRouter(), http.MethodGet, "/receipts/"+id, "192.0.2.1:1234", nil)
+	if _, ok := got["owner"]; ok || got["self"] != receiptURL {
+		t.Errorf("expected no owner link without the admin routes but got %v", got)
+	}
+}
+
+func TestDisableLinks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous bool) { disableLinks = previous }(disableLinks)
+	disableLinks = true
+	router := newRouter()
+
+	rr := serveBody(router, http.MethodPost, "/receipts/process", "application/json", "", []byte(validReceiptPayload))
+	var processed struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &processed)
+	if rr.Body.String() != `{"id":"`+processed.ID+`"}` {
+		t.Errorf("expected only the ID but got %s", rr.Body.String())
+	}
+	rr = serveBody(router, http.MethodGet, "/receipts/"+processed.ID, "", "", nil)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "_links") {
+		t.Errorf("expected the receipt without links but got %v %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsPingInterval is how often /ws pings each client. A client that hasn't answered
+// within two intervals is disconnected.
+var wsPingInterval = 30 * time.Second
+
+const (
+	// wsWriteTimeout is how long writing a message to a client may take.
+	wsWriteTimeout = 10 * time.Second
+	// wsQueueSize is how many messages may wait to be written to a client before it
+	// is disconnected for falling behind.
+	wsQueueSize = 64
+	// wsMaxSubscriptions bounds the receipts and users one connection subscribes to.
+	wsMaxSubscriptions = 1000
+)
+
+var (
+	wsConnections = &gaugeFunc{name: "websocket_connections",
+		help:  "Clients connected to /ws.",
+		value: func() float64 { return float64(liveUpdates.clientCount()) }}
+	wsOverflows = newCounterVec("websocket_overflow_disconnects_total",
+		"Clients of /ws disconnected because their queue of messages was full.")
+)
+
+// liveUpdates sends the events of the receipts /ws clients subscribe to.
+var liveUpdates = newLiveHub()
+
+// liveMessage is a message a /ws client sends.
+type liveMessage struct {
+	Type       string   `json:"type"`
+	ReceiptIDs []string `json:"receiptIds"`
+	UserID     string   `json:"userId"`
+}
+
+// liveSubscribed confirms a subscribe message, with everything the connection is
+// subscribed to.
+type liveSubscribed struct {
+	Type       string   `json:"type"`
+	ReceiptIDs []string `json:"receiptIds"`
+	UserIDs    []string `json:"userIds"`
+}
+
+// liveError answers a message that couldn't be handled; the connection stays open.
+type liveError struct {
+	Type   string `json:"type"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// liveClient is a /ws connection and what it subscribes to. Messages go through its
+// queue to a goroutine of its own, so a slow client never holds up the others or
+// the request sending the event.
+type liveClient struct {
+	ws *websocket.Conn
+	// user and admin are who authenticated the upgrade, limiting the receipts the
+	// client is sent as GET /receipts/{id} does.
+	user  string
+	admin bool
+
+	mu         sync.Mutex
+	receiptIDs map[string]bool
+	userIDs    map[string]bool
+
+	queue chan []byte
+	// done is closed when the client must go.
+	done     chan struct{}
+	doneOnce sync.Once
+	// closeCode is the close code it is sent once done.
+	closeCode int
+}
+
+// liveHub holds the connected clients.
+type liveHub struct {
+	mu      sync.Mutex
+	clients map[*liveClient]struct{}
+	closed  bool
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{clients: make(map[*liveClient]struct{})}
+}
+
+func (h *liveHub) add(client *liveClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	h.clients[client] = struct{}{}
+	return true
+}
+
+func (h *liveHub) remove(client *liveClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+}
+
+func (h *liveHub) clientCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// push sends event, about the receipt id owned by owner, to the clients subscribed to
+// either that may see the receipt.
+func (h *liveHub) push(event Event, id, owner string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("encoding the %s event of %s failed: %v", event.Type, id, err)
+		return
+	}
+	for client := range h.clients {
+		if client.wants(id, owner) && !client.send(message) {
+			wsOverflows.inc()
+		}
+	}
+}
+
+// close disconnects every client and refuses new ones, since shutdown doesn't wait for
+// hijacked connections.
+func (h *liveHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for client := range h.clients {
+		client.stop(websocket.CloseGoingAway)
+	}
+}
+
+func newLiveClient(ws *websocket.Conn, user string, admin bool) *liveClient {
+	return &liveClient{ws: ws, user: user, admin: admin, receiptIDs: make(map[string]bool), userIDs: make(map[string]bool),
+		queue: make(chan []byte, wsQueueSize), done: make(chan struct{})}
+}
+
+// wants reports whether the client subscribes to the receipt id of owner, and may
+// see it.
+func (c *liveClient) wants(id, owner string) bool {
+	if !mayAccess(c.user, c.admin, owner) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.receiptIDs[id] || (owner != "" && c.userIDs[owner])
+}
+
+// send queues message, stopping the client instead if its queue is full, and reports
+// whether it was queued.
+func (c *liveClient) send(message []byte) bool {
+	select {
+	case c.queue <- message:
+		return true
+	default:
+		c.stop(websocket.ClosePolicyViolation)
+		return false
+	}
+}
+
+func (c *liveClient) sendJSON(v any) {
+	message, err := json.Marshal(v)
+	if err == nil {
+		c.send(message)
+	}
+}
+
+// stop has the client disconnected with code, the first time it is called.
+func (c *liveClient) stop(code int) {
+	c.doneOnce.Do(func() {
+		c.closeCode = code
+		close(c.done)
+	})
+}
+
+// subscribe adds what message names to the subscriptions. Users may only subscribe to
+// themselves; admins and API key callers to anyone.
+func (c *liveClient) subscribe(message liveMessage) error {
+	if len(message.ReceiptIDs) == 0 && message.UserID == "" {
+		return errors.New("subscribe names no receiptIds or userId")
+	}
+	if message.UserID != "" && c.user != "" && !c.admin && message.UserID != c.user {
+		return fmt.Errorf("user %s may not subscribe to the receipts of user %s", c.user, message.UserID)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.receiptIDs)+len(c.userIDs)+len(message.ReceiptIDs)+1 > wsMaxSubscriptions {
+		return fmt.Errorf("a connection may subscribe to at most %d receipts and users", wsMaxSubscriptions)
+	}
+	for _, id := range message.ReceiptIDs {
+		c.receiptIDs[id] = true
+	}
+	if message.UserID != "" {
+		c.userIDs[message.UserID] = true
+	}
+	return nil
+}
+
+// handle acts on a message from the client, answering it.
+func (c *liveClient) handle(data []byte) {
+	var message liveMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		c.sendJSON(liveError{Type: "error", Code: "MESSAGE_INVALID", Detail: err.Error()})
+		return
+	}
+	if message.Type != "subscribe" {
+		c.sendJSON(liveError{Type: "error", Code: "MESSAGE_INVALID", Detail: fmt.Sprintf("unknown message type %q", message.Type)})
+		return
+	}
+	if err := c.subscribe(message); err != nil {
+		c.sendJSON(liveError{Type: "error", Code: "SUBSCRIPTION_INVALID", Detail: err.Error()})
+		return
+	}
+	c.mu.Lock()
+	subscribed := liveSubscribed{Type: "subscribed", ReceiptIDs: sortedKeys(c.receiptIDs), UserIDs: sortedKeys(c.userIDs)}
+	c.mu.Unlock()
+	c.sendJSON(subscribed)
+}
+
+// write sends the queued messages and a ping every interval until the client is
+// stopped or a write fails, then closes the connection.
+func (c *liveClient) write(interval time.Duration) {
+	ping := time.NewTicker(interval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-c.done:
+			closeWebSocket(c.ws, c.closeCode, "")
+			return
+		case message := <-c.queue:
+			c.ws.SetWriteDeadline(deadlineClock.Now().Add(wsWriteTimeout))
+			err = c.ws.WriteMessage(websocket.TextMessage, message)
+		case <-ping.C:
+			err = c.ws.WriteControl(websocket.PingMessage, nil, deadlineClock.Now().Add(wsWriteTimeout))
+		}
+		if err != nil {
+			c.stop(websocket.CloseGoingAway)
+			closeWebSocket(c.ws, websocket.CloseGoingAway, "")
+			return
+		}
+	}
+}
+
+// serveLiveUpdates upgrades the request to a WebSocket, on which the client subscribes
+// to receipts by ID or by the user who processed them and is sent their events as
+// they happen.
+func serveLiveUpdates(c *gin.Context) {
+	ws, ok := acceptWebSocket(c)
+	if !ok {
+		return
+	}
+	hub, interval := liveUpdates, wsPingInterval
+	client := newLiveClient(ws, c.GetString("user"), c.GetBool("admin"))
+	if !hub.add(client) {
+		closeWebSocket(ws, websocket.CloseGoingAway, "shutting down")
+		return
+	}
+	defer hub.remove(client)
+
+	extend := func() { ws.SetReadDeadline(deadlineClock.Now().Add(2 * interval)) }
+	extend()
+	// Pings are answered by the connection as messages are read.
+	ws.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		client.write(interval)
+	}()
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		client.handle(data)
+	}
+	client.stop(websocket.CloseNormalClosure)
+	<-written
+}
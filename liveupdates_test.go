@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// serveLive serves a router with a new /ws hub until the test ends.
+func serveLive(t *testing.T) *httptest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	liveUpdates = newLiveHub()
+	server := httptest.NewServer(newRouter())
+	hub := liveUpdates
+	t.Cleanup(func() {
+		hub.close()
+		server.Close()
+	})
+	return server
+}
+
+// dialLive opens a WebSocket to /ws authenticated by header.
+func dialLive(t *testing.T, server *httptest.Server, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receiveLive returns the next message sent over conn, decoded.
+func receiveLive(t *testing.T, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message map[string]any
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatalf("expected a message but got %v", err)
+	}
+	return message
+}
+
+// liveToken returns a token for user valid for an hour of real time, since /ws
+// deadlines are.
+func liveToken(t *testing.T, key *rsa.PrivateKey, user string, roles ...string) http.Header {
+	t.Helper()
+	claims := map[string]any{"sub": user, "exp": time.Now().Add(time.Hour).Unix()}
+	if len(roles) > 0 {
+		claims["roles"] = roles
+	}
+	return http.Header{"Authorization": {"Bearer " + signToken(t, key, map[string]any{"alg": "RS256", "kid": "k1"}, claims)}}
+}
+
+func TestLiveUpdates(t *testing.T) {
+	server := serveLive(t)
+	key := generateKey(t)
+	useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+	alice, bob, admin := liveToken(t, key, "alice"), liveToken(t, key, "bob"), liveToken(t, key, "ops", jwtAdminRole)
+
+	process := func(header http.Header) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/receipts/process", strings.NewReader(validReceiptPayload))
+		req.Header = header.Clone()
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var response struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 but got %v", resp.StatusCode)
+		}
+		return response.ID
+	}
+
+	aliceConn := dialLive(t, server, alice)
+	aliceConn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","userId":"bob"}`))
+	if message := receiveLive(t, aliceConn); message["type"] != "error" || message["code"] != "SUBSCRIPTION_INVALID" {
+		t.Errorf("expected alice to be refused bob's receipts but got %v", message)
+	}
+	aliceConn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","userId":"alice"}`))
+	if message := receiveLive(t, aliceConn); message["type"] != "subscribed" {
+		t.Fatalf("expected the subscription to be confirmed but got %v", message)
+	}
+
+	// Bob's receipt isn't sent to alice; hers is.
+	process(bob)
+	id := process(alice)
+	message := receiveLive(t, aliceConn)
+	data, _ := message["data"].(map[string]any)
+	if message["type"] != eventReceiptProcessed || message["version"] != float64(eventVersion) || data["id"] != id || data["points"] != float64(28) {
+		t.Errorf("expected the receipt.processed event of %s but got %v", id, message)
+	}
+
+	// An admin may follow any receipt by its ID.
+	adminConn := dialLive(t, server, admin)
+	adminConn.WriteJSON(liveMessage{Type: "subscribe", ReceiptIDs: []string{id}})
+	if message := receiveLive(t, adminConn); message["type"] != "subscribed" || len(message["receiptIds"].([]any)) != 1 {
+		t.Fatalf("expected the subscription to be confirmed but got %v", message)
+	}
+	if _, err := eraseUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for name, conn := range map[string]*websocket.Conn{"alice": aliceConn, "the admin": adminConn} {
+		message := receiveLive(t, conn)
+		data, _ := message["data"].(map[string]any)
+		if message["type"] != eventReceiptDeleted || data["id"] != id {
+			t.Errorf("expected %s to be sent the receipt.deleted event of %s but got %v", name, id, message)
+		}
+	}
+}
+
+func TestLiveUpdatesKeepalive(t *testing.T) {
+	saved := wsPingInterval
+	wsPingInterval = 20 * time.Millisecond
+	t.Cleanup(func() { wsPingInterval = saved })
+	server := serveLive(t)
+	useAPIKeys(t, []apiKey{{ID: "kiosk", Key: "k-kiosk", Scopes: []string{scopeRead}}})
+	header := http.Header{"X-API-Key": {"k-kiosk"}}
+
+	// The client answers pings as it reads, so one that reads stays connected.
+	reading := dialLive(t, server, header)
+	go func() {
+		for {
+			if _, _, err := reading.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	dialLive(t, server, header)
+	waitFor(t, "the clients to connect", func() bool { return liveUpdates.clientCount() == 2 })
+	waitFor(t, "the silent client to be disconnected", func() bool { return liveUpdates.clientCount() == 1 })
+	time.Sleep(10 * wsPingInterval)
+	if liveUpdates.clientCount() != 1 {
+		t.Errorf("expected the client answering pings to stay connected but %d are", liveUpdates.clientCount())
+	}
+
+	// Shutting down closes the rest.
+	liveUpdates.close()
+	waitFor(t, "the client to be disconnected", func() bool { return liveUpdates.clientCount() == 0 })
+}
+
+func TestLiveUpdatesOverflow(t *testing.T) {
+	hub := newLiveHub()
+	slow := newLiveClient(nil, "", false)
+	slow.subscribe(liveMessage{Type: "subscribe", ReceiptIDs: []string{"r-1"}})
+	hub.add(slow)
+	overflows := wsOverflows.value()
+
+	for i := 0; i <= wsQueueSize; i++ {
+		hub.push(newEvent(eventReceiptProcessed, eventSubject{ID: "r-1"}), "r-1", "")
+	}
+	select {
+	case <-slow.done:
+	default:
+		t.Error("expected the client whose queue filled to be stopped")
+	}
+	if slow.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("expected close code %d but got %d", websocket.ClosePolicyViolation, slow.closeCode)
+	}
+	if got := wsOverflows.value(); got != overflows+1 {
+		t.Errorf("expected one more overflow but got %v", got-overflows)
+	}
+}
+
+func TestLiveUpdatesHandshake(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newRouter()
+	useAPIKeys(t, []apiKey{{ID: "kiosk", Key: "k-kiosk", Scopes: []string{scopeRead}}})
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		status int
+		code   string
+	}{
+		{"no key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusUnauthorized, "API_KEY_REQUIRED"},
+		{"not an upgrade", map[string]string{"X-API-Key": "k-kiosk"}, http.StatusUpgradeRequired, "WEBSOCKET_REQUIRED"},
+		{"old version", map[string]string{"X-API-Key": "k-kiosk", "Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusUpgradeRequired, "WEBSOCKET_REQUIRED"},
+		{"bad key", map[string]string{"X-API-Key": "k-kiosk", "Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, http.StatusBadRequest, "WEBSOCKET_INVALID"},
+		{"foreign origin", map[string]string{"X-API-Key": "k-kiosk", "Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Origin": "https://evil.example.com"}, http.StatusForbidden, "ORIGIN_NOT_ALLOWED"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		for name, value := range tc.header {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tc.status || !strings.Contains(rr.Body.String(), tc.code) {
+			t.Errorf("%s: expected status %d with %s but got %v %s", tc.name, tc.status, tc.code, rr.Code, rr.Body.String())
+		}
+	}
+}
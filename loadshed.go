@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The --max-in-flight requests to the API and --max-admin-in-flight requests to the
+// more expensive /admin endpoints. 0 disables a limit.
+var (
+	maxInFlight      int
+	maxAdminInFlight int
+)
+
+// apiSlots and adminSlots limit the requests handled at once. They are nil while
+// unlimited.
+var (
+	apiSlots   atomic.Pointer[concurrencyLimiter]
+	adminSlots atomic.Pointer[concurrencyLimiter]
+)
+
+// busyRetryAfter is the Retry-After, in seconds, of requests shed while saturated.
+const busyRetryAfter = 1
+
+// concurrencyLimiter is a semaphore of requests in flight, counting the requests it
+// admits and rejects.
+type concurrencyLimiter struct {
+	slots chan struct{}
+
+	admitted atomic.Int64
+	rejected atomic.Int64
+}
+
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	return &concurrencyLimiter{slots: make(chan struct{}, limit)}
+}
+
+// acquire takes a slot if one is free, without waiting.
+func (l *concurrencyLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.admitted.Add(1)
+		return true
+	default:
+		l.rejected.Add(1)
+		return false
+	}
+}
+
+// acquireWithin takes a slot, waiting up to wait for one to be freed unless ctx is
+// done first.
+func (l *concurrencyLimiter) acquireWithin(ctx context.Context, wait time.Duration) bool {
+	if wait <= 0 {
+		return l.acquire()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.admitted.Add(1)
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.rejected.Add(1)
+	return false
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+// loadStats is the state of a concurrencyLimiter reported by GET /admin/load.
+type loadStats struct {
+	Limit    int   `json:"limit"`
+	InFlight int   `json:"inFlight"`
+	Admitted int64 `json:"admitted"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (l *concurrencyLimiter) stats() loadStats {
+	return loadStats{Limit: cap(l.slots), InFlight: len(l.slots), Admitted: l.admitted.Load(), Rejected: l.rejected.Load()}
+}
+
+// limitConcurrency sheds requests beyond the slots of the limiter in limiters with an
+// immediate 429 and a Retry-After, rather than queueing them while latency grows. A
+// slot is freed when the handler returns or the client goes away, whichever is first,
+// so abandoned requests don't hold the server saturated.
+func limitConcurrency(limiters *atomic.Pointer[concurrencyLimiter]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := limiters.Load()
+		if limiter == nil {
+			c.Next()
+			return
+		}
+		if !limiter.acquire() {
+			c.Header("Retry-After", strconv.Itoa(busyRetryAfter))
+			abortWithProblem(c, http.StatusTooManyRequests, "SERVER_BUSY",
+				fmt.Sprintf("the server is handling its limit of %d requests, retry shortly", cap(limiter.slots)))
+			return
+		}
+		holdSlot(c, limiter)
+	}
+}
+
+// holdSlot runs the rest of the handler chain in an acquired slot of limiter.
+func holdSlot(c *gin.Context, limiter *concurrencyLimiter) {
+	var once sync.Once
+	release := func() { once.Do(limiter.release) }
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-c.Request.Context().Done():
+			release()
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		release()
+	}()
+	c.Next()
+}
+
+// routeClass is a kind of expensive request with a budget of its own, so a burst of
+// one kind can't hold every slot and store lock while cheap lookups wait behind it.
+type routeClass struct {
+	name string
+	// limit is the --max-<name>-in-flight requests of the class handled at once, 0
+	// unlimited.
+	limit int
+	slots atomic.Pointer[concurrencyLimiter]
+}
+
+// The route classes: receipt submissions, rule simulations and audit log exports.
+var (
+	processClass  = &routeClass{name: "process"}
+	simulateClass = &routeClass{name: "simulate"}
+	exportClass   = &routeClass{name: "export"}
+	routeClasses  = []*routeClass{processClass, simulateClass, exportClass}
+)
+
+// routeClassWait is --route-class-wait, how long a request waits for a slot of its
+// class before it is rejected.
+var routeClassWait time.Duration
+
+// limitRouteClass admits requests of class while it has a slot free, or one is freed
+// within routeClassWait, and otherwise rejects them with 503 and a Retry-After.
+func limitRouteClass(class *routeClass) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := class.slots.Load()
+		if limiter == nil {
+			c.Next()
+			return
+		}
+		if !limiter.acquireWithin(c.Request.Context(), routeClassWait) {
+			c.Header("Retry-After", strconv.Itoa(busyRetryAfter))
+			abortWithProblem(c, http.StatusServiceUnavailable, "ROUTE_CLASS_BUSY",
+				fmt.Sprintf("the server is handling its limit of %d %s requests", cap(limiter.slots), class.name))
+			return
+		}
+		holdSlot(c, limiter)
+	}
+}
+
+// routeClassesInFlight returns the requests of each limited route class in flight.
+func routeClassesInFlight() map[string]float64 {
+	inFlight := make(map[string]float64)
+	for _, class := range routeClasses {
+		if limiter := class.slots.Load(); limiter != nil {
+			inFlight[class.name] = float64(len(limiter.slots))
+		}
+	}
+	return inFlight
+}
+
+// loadHandler reports the requests admitted and shed by each concurrency limit.
+func loadHandler(c *gin.Context) {
+	load := gin.H{}
+	if limiter := apiSlots.Load(); limiter != nil {
+		load["api"] = limiter.stats()
+	}
+	if limiter := adminSlots.Load(); limiter != nil {
+		load["admin"] = limiter.stats()
+	}
+	for _, class := range routeClasses {
+		if limiter := class.slots.Load(); limiter != nil {
+			load[class.name] = limiter.stats()
+		}
+	}
+	c.JSON(http.StatusOK, load)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useConcurrencyLimit limits the requests in limiters to limit for the rest of the test.
+func useConcurrencyLimit(t *testing.T, limiters *atomic.Pointer[concurrencyLimiter], limit int) *concurrencyLimiter {
+	t.Helper()
+	limiter := newConcurrencyLimiter(limit)
+	limiters.Store(limiter)
+	t.Cleanup(func() { limiters.Store(nil) })
+	return limiter
+}
+
+// slowServer serves /slow, which blocks until unblock is closed whatever the client
+// does, and /fast, both behind limitConcurrency(limiters).
+func slowServer(t *testing.T, limiters *atomic.Pointer[concurrencyLimiter]) (server *httptest.Server, started <-chan struct{}, unblock chan struct{}) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	starts := make(chan struct{}, 10)
+	unblock = make(chan struct{})
+	router := gin.New()
+	router.Use(limitConcurrency(limiters))
+	router.GET("/slow", func(c *gin.Context) {
+		starts <- struct{}{}
+		<-unblock
+		c.Status(http.StatusOK)
+	})
+	router.GET("/fast", func(c *gin.Context) { c.Status(http.StatusOK) })
+	server = httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, starts, unblock
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	var limiters atomic.Pointer[concurrencyLimiter]
+	limiter := useConcurrencyLimit(t, &limiters, 3)
+	server, started, unblock := slowServer(t, &limiters)
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL + "/slow")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	// With every slot held the overflow is shed at once instead of waiting.
+	began := time.Now()
+	resp, err := http.Get(server.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("expected 429 with Retry-After 1 but got %v with %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if elapsed := time.Since(began); elapsed > time.Second {
+		t.Errorf("expected the overflow to be rejected immediately but it took %v", elapsed)
+	}
+
+	close(unblock)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("expected the admitted requests to succeed but got %v", status)
+		}
+	}
+	if stats := limiter.stats(); stats != (loadStats{Limit: 3, InFlight: 0, Admitted: 3, Rejected: 1}) {
+		t.Errorf("expected 3 admitted and 1 rejected with none in flight but got %+v", stats)
+	}
+}
+
+func TestConcurrencyLimitReleasesOnDisconnect(t *testing.T) {
+	var limiters atomic.Pointer[concurrencyLimiter]
+	useConcurrencyLimit(t, &limiters, 1)
+	server, started, unblock := slowServer(t, &limiters)
+	defer close(unblock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	if resp, err := http.Get(server.URL + "/fast"); err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the slow request to hold the only slot but got %v, %v", resp, err)
+	}
+
+	// The handler is still blocked, but the client hung up, so its slot is free.
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(server.URL + "/fast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the slot to be released after the client disconnected but still got %v", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouterConcurrencyLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	api := useConcurrencyLimit(t, &apiSlots, 1)
+	useConcurrencyLimit(t, &adminSlots, 1)
+
+	if !api.acquire() {
+		t.Fatal("expected the only slot to be free")
+	}
+	rr := requestWithKey(router, http.MethodGet, "/rules", "")
+	var body problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusTooManyRequests || body.Code != "SERVER_BUSY" {
+		t.Errorf("expected 429 SERVER_BUSY but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := requestWithKey(router, http.MethodGet, "/health", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected health checks to be exempt but got %v", rr.Code)
+	}
+
+	// The admin endpoints have their own limit, free while the API is saturated.
+	rr = requestWithKey(router, http.MethodGet, "/admin/load", "")
+	var load map[string]loadStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &load); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK ||
+		load["api"] != (loadStats{Limit: 1, InFlight: 1, Admitted: 1, Rejected: 1}) ||
+		load["admin"] != (loadStats{Limit: 1, InFlight: 1, Admitted: 1}) {
+		t.Errorf("expected the API to be saturated and the admin request in flight but got %v: %s", rr.Code, rr.Body.String())
+	}
+	api.release()
+}
+
+func TestRouteClassBudgets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous time.Duration) { routeClassWait = previous }(routeClassWait)
+	routeClassWait = 0
+	exports := useConcurrencyLimit(t, &exportClass.slots, 2)
+	router := newRouter()
+	id, _ := processAndScore(t, router, validReceiptPayload)
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	router.GET("/admin/slow-export", limitRouteClass(exportClass), func(c *gin.Context) {
+		started <- struct{}{}
+		<-unblock
+		c.Status(http.StatusOK)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// Saturate the export budget.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := http.Get(server.URL + "/admin/slow-export"); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		<-started
+	}
+	defer func() {
+		close(unblock)
+		wg.Wait()
+	}()
+
+	rr := requestWithKey(router, http.MethodGet, "/admin/audit", "")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" || !strings.Contains(rr.Body.String(), "ROUTE_CLASS_BUSY") {
+		t.Errorf("expected a 503 ROUTE_CLASS_BUSY with a Retry-After but got %v %v: %s", rr.Code, rr.Header(), rr.Body.String())
+	}
+	if metrics, _ := scrapeMetrics(t, router); metrics[`route_class_in_flight{class="export"}`] != 2 {
+		t.Errorf("expected 2 exports in flight but got %v", metrics[`route_class_in_flight{class="export"}`])
+	}
+
+	// Points lookups still answer within their latency budget.
+	const latencyBudget = 250 * time.Millisecond
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/receipts/" + id + "/points")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || elapsed > latencyBudget {
+			t.Fatalf("expected a points lookup within %v but got %v after %v", latencyBudget, resp.StatusCode, elapsed)
+		}
+	}
+
+	// With a wait, a request over the budget takes the first slot freed, and one whose
+	// client gives up first is rejected.
+	routeClassWait = 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/admin/audit", nil).WithContext(ctx)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a request whose client gave up to be rejected but got %v", rr.Code)
+	}
+	queued := make(chan int)
+	go func() { queued <- requestWithKey(router, http.MethodGet, "/admin/audit", "").Code }()
+	time.Sleep(20 * time.Millisecond)
+	unblock <- struct{}{}
+	if status := <-queued; status == http.StatusServiceUnavailable {
+		t.Errorf("expected the queued export to take the freed slot but got %v", status)
+	}
+	if stats := exports.stats(); stats.Rejected != 2 {
+		t.Errorf("expected 2 exports rejected but got %+v", stats)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logSensitiveValues is the --log-sensitive-values debugging switch that lets error
+// logs include the values they are about. Without it they name fields at most, since
+// values can be receipt contents.
+var logSensitiveValues bool
+
+// logLevel is the severity of a request log, and a flag.Value for --log-level.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l *logLevel) String() string {
+	return logLevelNames[*l]
+}
+
+func (l *logLevel) Set(s string) error {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			*l = logLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", s)
+}
+
+// minLogLevel is the --log-level below which requests aren't logged. Requests that
+// succeed are logged at info, those answered 4xx at warn and 5xx at error.
+var minLogLevel = levelInfo
+
+// The --log-format values: JSON lines for log pipelines, or key=value lines that are
+// easier to read in a terminal.
+const (
+	logFormatJSON    = "json"
+	logFormatConsole = "console"
+)
+
+var logFormat = logFormatJSON
+
+// logField is a key and value of a structured log line.
+type logField struct {
+	key   string
+	value any
+}
+
+// writeLog writes a structured line with the time, level and msg followed by fields,
+// in logFormat, to the output of the log package.
+func writeLog(level logLevel, msg string, fields ...logField) {
+	now := clock.Now().UTC()
+	var b strings.Builder
+	if logFormat == logFormatConsole {
+		fmt.Fprintf(&b, "%s %-5s %s", now.Format("2006-01-02T15:04:05.000Z"), strings.ToUpper(level.String()), msg)
+		for _, field := range fields {
+			value := fmt.Sprint(field.value)
+			if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&b, " %s=%s", field.key, value)
+		}
+	} else {
+		fields = append([]logField{{"time", now.Format(time.RFC3339Nano)}, {"level", level.String()}, {"msg", msg}}, fields...)
+		b.WriteByte('{')
+		for i, field := range fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			key, _ := json.Marshal(field.key)
+			value, err := json.Marshal(field.value)
+			if err != nil {
+				value, _ = json.Marshal(fmt.Sprint(field.value))
+			}
+			b.Write(key)
+			b.WriteByte(':')
+			b.Write(value)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	log.Writer().Write([]byte(b.String()))
+}
+
+// validRequestID matches the X-Request-ID of a client worth keeping.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newGinEngine returns a gin engine that logs, measures and traces requests by route
+// template rather than raw path, recovers from panics without logging their values,
+// compresses JSON responses for clients that accept gzip, and negotiates the format of
+// request and response bodies. With --record-dir, every exchange is recorded too.
+func newGinEngine() *gin.Engine {
+	router := gin.New()
+	// The proxies were validated by parseTrustedProxies. Without any, gin uses the peer
+	// address and ignores X-Forwarded-For.
+	router.SetTrustedProxies(proxiesToTrust())
+	if exchanges != nil {
+		// First, so exchanges are recorded as they were sent and received.
+		router.Use(exchanges.record())
+	}
+	router.Use(tagRequest(), logRequests(), observeRequests(), traceRequests(), recoverPanics(), compressResponses(), negotiateFormats())
+	return router
+}
+
+// tagRequest gives each request an ID, the client's X-Request-ID if it sent a sensible
+// one, under "requestID" in the context and in the X-Request-ID response header.
+func tagRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newID(idRequest)
+		}
+		c.Set("requestID", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// logRequests logs each request with its ID, method, route, status, latency, the bytes
+// written, the client IP and who made it, and the code of the error it was answered
+// with if any. The route is the template, such as /receipts/:receipt_id, so IDs never
+// reach the log.
+func logRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := clock.Now()
+		c.Next()
+		status := c.Writer.Status()
+		level := levelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = levelError
+		case status >= http.StatusBadRequest:
+			level = levelWarn
+		}
+		if level < minLogLevel {
+			return
+		}
+		written := c.Writer.Size()
+		if written < 0 {
+			written = 0
+		}
+		fields := []logField{
+			{"request_id", c.GetString("requestID")},
+			{"method", c.Request.Method},
+			{"route", route(c)},
+			{"status", status},
+			{"latency_ms", float64(clock.Now().Sub(start).Microseconds()) / 1000},
+			{"bytes", written},
+			{"client_ip", c.ClientIP()},
+		}
+		for _, identity := range []struct{ contextKey, field string }{{"apiKey", "api_key"}, {"user", "user"}, {"client", "client"}} {
+			if value := c.GetString(identity.contextKey); value != "" {
+				fields = append(fields, logField{identity.field, value})
+			}
+		}
+		if code := c.GetString("errorCode"); code != "" {
+			fields = append(fields, logField{"error_code", code})
+		}
+		writeLog(level, "request", fields...)
+	}
+}
+
+// logRequestf logs a line about the request in c, tagged with its ID.
+func logRequestf(c *gin.Context, format string, args ...any) {
+	log.Printf(format+" request_id=%s", append(args, c.GetString("requestID"))...)
+}
+
+// recoverPanics responds 500 to a request whose handler panicked, logging the stack,
+// the request ID and, only with --log-sensitive-values, the panic value, and counting
+// it in http_panics_total. If the response had started the client can't be told, so
+// the connection is dropped instead. A client that went away mid-response isn't a
+// panic worth logging.
+func recoverPanics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			if err, ok := recovered.(error); ok && (errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)) {
+				c.Set("errorCode", "CLIENT_GONE")
+				c.Abort()
+				return
+			}
+
+			httpPanics.inc(route(c))
+			writeLog(levelError, "panic",
+				logField{"request_id", c.GetString("requestID")},
+				logField{"method", c.Request.Method},
+				logField{"route", route(c)},
+				logField{"panic", sensitive(recovered)},
+				logField{"stack", string(debug.Stack())})
+			if c.Writer.Written() {
+				c.Abort()
+				panic(http.ErrAbortHandler)
+			}
+			abortWithProblem(c, http.StatusInternalServerError, "UNHANDLED_PANIC", "the handler panicked, see the panic logged with the request ID")
+		}()
+		c.Next()
+	}
+}
+
+// route returns the route template of the request, or "(unmatched)" if no route
+// matched.
+func route(c *gin.Context) string {
+	if path := c.FullPath(); path != "" {
+		return path
+	}
+	return "(unmatched)"
+}
+
+// sensitive formats a value that may hold receipt contents for logging, as
+// "[redacted]" unless --log-sensitive-values is set.
+func sensitive(v any) string {
+	if !logSensitiveValues {
+		return "[redacted]"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sentinel stands for receipt contents that must never be logged.
+const sentinel = "SENTINEL-RETAILER-7f3a"
+
+// lockedBuffer is a bytes.Buffer safe to log to from several goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// captureLogs collects everything logged, by the log package and by gin, for the rest
+// of the test.
+func captureLogs(t *testing.T) *lockedBuffer {
+	t.Helper()
+	logs := &lockedBuffer{}
+	previousWriter, previousErrorWriter := gin.DefaultWriter, gin.DefaultErrorWriter
+	log.SetOutput(logs)
+	gin.DefaultWriter, gin.DefaultErrorWriter = logs, logs
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		gin.DefaultWriter, gin.DefaultErrorWriter = previousWriter, previousErrorWriter
+	})
+	return logs
+}
+
+// requestLogs parses the request logs written so far, failing the test on any that
+// isn't a well-formed JSON object.
+func requestLogs(t *testing.T, logs *lockedBuffer) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected a JSON log line but got %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// findRequestLog returns the first request log of method and route answered status.
+func findRequestLog(entries []map[string]any, method, route string, status int) map[string]any {
+	for _, entry := range entries {
+		if entry["method"] == method && entry["route"] == route && entry["status"] == float64(status) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// findPanicLog returns the first log of a panic handling route.
+func findPanicLog(entries []map[string]any, route string) map[string]any {
+	for _, entry := range entries {
+		if entry["msg"] == "panic" && entry["route"] == route {
+			return entry
+		}
+	}
+	return nil
+}
+
+func TestLogsRedactReceiptContents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	logs := captureLogs(t)
+	router := newRouter()
+	shadow.Store(newShadowScorer(currentEngine()))
+	defer shadow.Store(nil)
+
+	payload := strings.Replace(validReceiptPayload, "Target", sentinel, 1)
+	id, _ := processAndScore(t, router, payload)
+	invalid := []string{
+		strings.Replace(payload, `"35.35"`, `"`+sentinel+`"`, 1),
+		strings.Replace(payload, `"6.49"`, `"`+sentinel+`"`, 1),
+		`{"retailer": "` + sentinel + `", "retailer": "` + sentinel + `"}`,
+		`{"retailer": "` + sentinel,
+	}
+	for _, body := range invalid {
+		req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	output := logs.String()
+	if strings.Contains(output, sentinel) {
+		t.Errorf("expected the logs never to contain receipt contents but got:\n%s", output)
+	}
+	entries := requestLogs(t, logs)
+	if findRequestLog(entries, "GET", "/receipts/:receipt_id/points", 200) == nil || strings.Contains(output, "/receipts/"+id) {
+		t.Errorf("expected requests to be logged by route template, without the receipt ID %s, but got:\n%s", id, output)
+	}
+	if findRequestLog(entries, "POST", "/receipts/process", 400) == nil {
+		t.Errorf("expected the rejected submissions to be logged but got:\n%s", output)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	logs := captureLogs(t)
+	router := newRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/rules", nil)
+	req.Header.Set("X-Request-ID", "req-42.a_b")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if got := rr.Header().Get("X-Request-ID"); got != "req-42.a_b" {
+		t.Errorf("expected the client's request ID to be kept but got %q", got)
+	}
+	if entry := findRequestLog(requestLogs(t, logs), "GET", "/rules", 200); entry == nil || entry["request_id"] != "req-42.a_b" {
+		t.Errorf("expected the request to be logged with its ID but got:\n%s", logs.String())
+	}
+
+	// IDs that could smuggle anything into the log are replaced.
+	for _, id := range []string{"", "with space", strings.Repeat("a", 65), "line\nbreak"} {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("X-Request-ID", id)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if got := rr.Header().Get("X-Request-ID"); got == id || !validRequestID.MatchString(got) {
+			t.Errorf("expected %q to be replaced by a generated ID but got %q", id, got)
+		}
+	}
+
+	// Every line logged about the request carries its ID.
+	useAPIKeys(t, []apiKey{{ID: "partner", Key: "k-partner", Scopes: defaultScopes}})
+	req = httptest.NewRequest(http.MethodGet, "/rules", nil)
+	req.Header.Set("X-API-Key", "k-partner")
+	req.Header.Set("X-Request-ID", "req-43")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(logs.String(), "authenticated with API key partner request_id=req-43") {
+		t.Errorf("expected the authentication to be logged with the request ID but got:\n%s", logs.String())
+	}
+	useAPIKeys(t, nil)
+
+	if rr := requestWithKey(router, http.MethodGet, "/receipts/"+sentinel+"/nowhere", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 but got %v", rr.Code)
+	}
+	if findRequestLog(requestLogs(t, logs), "GET", "(unmatched)", 404) == nil || strings.Contains(logs.String(), sentinel) {
+		t.Errorf("expected an unmatched path to be logged without the path but got:\n%s", logs.String())
+	}
+}
+
+func TestLogSensitiveValues(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logs := captureLogs(t)
+	defer func() { logSensitiveValues = false }()
+	router := newGinEngine()
+	router.GET("/panic", func(c *gin.Context) { panic("cannot convert " + sentinel) })
+
+	for _, enabled := range []bool{false, true} {
+		logSensitiveValues = enabled
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/panic", nil))
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("expected a panic to respond 500 but got %v", rr.Code)
+		}
+		if logged := strings.Contains(logs.String(), sentinel); logged != enabled {
+			t.Errorf("with --log-sensitive-values %v: expected the panic value logged to be %v but got:\n%s", enabled, enabled, logs.String())
+		}
+		if findPanicLog(requestLogs(t, logs), "/panic") == nil {
+			t.Errorf("expected the panic to be logged with its route but got:\n%s", logs.String())
+		}
+	}
+
+	var value struct{ Retailer string }
+	json.Unmarshal([]byte(`{"Retailer": "`+sentinel+`"}`), &value)
+	logSensitiveValues = false
+	if got := sensitive(value); got != "[redacted]" {
+		t.Errorf("expected [redacted] but got %q", got)
+	}
+	logSensitiveValues = true
+	if got := sensitive(value); got != "{"+sentinel+"}" {
+		t.Errorf("expected the value but got %q", got)
+	}
+}
+
+func TestStructuredRequestLogs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	logs := captureLogs(t)
+	router := newRouter()
+	useAPIKeys(t, []apiKey{{ID: "partner", Key: "k-partner", Scopes: defaultScopes}})
+
+	requestWithKey(router, http.MethodGet, "/rules", "k-partner")
+	requestWithKey(router, http.MethodGet, "/rules", "wrong")
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(`{"retailer": "Target", "total": "x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "k-partner")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := requestLogs(t, logs)
+	ok := findRequestLog(entries, "GET", "/rules", 200)
+	if ok == nil {
+		t.Fatalf("expected the request to be logged but got:\n%s", logs.String())
+	}
+	for _, key := range []string{"time", "level", "msg", "request_id", "method", "route", "status", "latency_ms", "bytes", "client_ip"} {
+		if _, found := ok[key]; !found {
+			t.Errorf("expected the %s key but got %v", key, ok)
+		}
+	}
+	if ok["time"] != "2025-01-30T12:00:00Z" || ok["level"] != "info" || ok["msg"] != "request" || ok["api_key"] != "partner" ||
+		ok["client_ip"] != "192.0.2.1" || ok["bytes"].(float64) <= 0 || ok["error_code"] != nil {
+		t.Errorf("expected an info log of the partner's request but got %v", ok)
+	}
+
+	// Errors are logged at warn with their code.
+	if unauthorized := findRequestLog(entries, "GET", "/rules", 401); unauthorized == nil || unauthorized["level"] != "warn" || unauthorized["error_code"] != "API_KEY_REQUIRED" {
+		t.Errorf("expected a warning with the API_KEY_REQUIRED code but got %v", unauthorized)
+	}
+	if invalid := findRequestLog(entries, "POST", "/receipts/process", 400); invalid == nil || invalid["level"] != "warn" || invalid["error_code"] != string(reasonTotalInvalidFormat) {
+		t.Errorf("expected a warning with the validation reason but got %v", invalid)
+	}
+}
+
+func TestLogLevelAndFormat(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	logs := captureLogs(t)
+	defer func() { minLogLevel, logFormat = levelInfo, logFormatJSON }()
+	router := newRouter()
+
+	if err := minLogLevel.Set("WARN"); err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/rules", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/receipts/unknown", nil))
+	entries := requestLogs(t, logs)
+	if len(entries) != 1 || entries[0]["status"] != float64(404) {
+		t.Errorf("expected only the 404 to be logged at warn but got %v", entries)
+	}
+
+	minLogLevel, logFormat = levelDebug, logFormatConsole
+	req := httptest.NewRequest(http.MethodGet, "/rules", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(logs.String(), "2025-01-30T12:00:00.000Z INFO  request request_id=req-1 method=GET route=/rules status=200 latency_ms=0 bytes=") {
+		t.Errorf("expected a console line but got:\n%s", logs.String())
+	}
+
+	for _, name := range []string{"verbose", ""} {
+		if err := minLogLevel.Set(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+	if level := levelWarn; level.String() != "warn" {
+		t.Errorf("expected warn but got %q", level.String())
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logs := captureLogs(t)
+	router := newRouter()
+	router.GET("/panic", func(c *gin.Context) { panic("nil map in " + sentinel) })
+	router.GET("/panic-mid-response", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		c.Writer.Flush()
+		panic("after the response started")
+	})
+	router.GET("/client-gone", func(c *gin.Context) {
+		panic(&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)})
+	})
+	panics := func() float64 {
+		metrics, _ := scrapeMetrics(t, router)
+		return metrics[`http_panics_total{route="/panic"}`] + metrics[`http_panics_total{route="/panic-mid-response"}`]
+	}
+	before := panics()
+
+	// A panic is answered with a problem naming only the request ID and a generic detail.
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set("X-Request-ID", "id-recovered")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var body map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected a JSON body but got %q", rr.Body.String())
+	}
+	if rr.Code != http.StatusInternalServerError || rr.Header().Get("Content-Type") != "application/problem+json" ||
+		body["requestId"] != "id-recovered" || body["detail"] != internalErrorDetail || strings.Contains(rr.Body.String(), sentinel) {
+		t.Errorf("expected a generic 500 problem with the request ID but got %v %v: %s", rr.Code, rr.Header(), rr.Body.String())
+	}
+	entry := findPanicLog(requestLogs(t, logs), "/panic")
+	if entry == nil || entry["level"] != "error" || entry["request_id"] != "id-recovered" || entry["panic"] != "[redacted]" {
+		t.Errorf("expected a structured error log of the panic but got %v", entry)
+	}
+	if count := panics() - before; count != 1 {
+		t.Errorf("expected 1 panic counted but got %v", count)
+	}
+
+	// After the response started, the connection is dropped.
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	if resp, err := http.Get(server.URL + "/panic-mid-response"); err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("expected the connection to be dropped mid-response but got a complete %v response", resp.StatusCode)
+		}
+	}
+	if findPanicLog(requestLogs(t, logs), "/panic-mid-response") == nil {
+		t.Errorf("expected the panic mid-response to be logged")
+	}
+	if count := panics() - before; count != 2 {
+		t.Errorf("expected 2 panics counted but got %v", count)
+	}
+
+	// A client that went away isn't logged as a panic.
+	logs.Reset()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/client-gone", nil))
+	if entry := findPanicLog(requestLogs(t, logs), "/client-gone"); entry != nil {
+		t.Errorf("expected a broken pipe not to be logged as a panic but got %v", entry)
+	}
+	if entry := findRequestLog(requestLogs(t, logs), http.MethodGet, "/client-gone", http.StatusOK); entry == nil || entry["error_code"] != "CLIENT_GONE" {
+		t.Errorf("expected the request logged as CLIENT_GONE but got %v", requestLogs(t, logs))
+	}
+}
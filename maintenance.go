@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditMaintenanceChanged is the audited action of POST /admin/maintenance.
+const auditMaintenanceChanged = "maintenance.changed"
+
+// maintenanceRetryAfter is the Retry-After, in seconds, of writes rejected while
+// read-only.
+const maintenanceRetryAfter = 60
+
+// readOnlyMode is a switch that is a boolean flag, so --read-only sets it at startup.
+type readOnlyMode struct {
+	atomic.Bool
+}
+
+func (m *readOnlyMode) String() string {
+	return strconv.FormatBool(m.Load())
+}
+
+func (m *readOnlyMode) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", s)
+	}
+	m.Store(on)
+	return nil
+}
+
+func (m *readOnlyMode) IsBoolFlag() bool {
+	return true
+}
+
+// readOnly is --read-only, then whatever POST /admin/maintenance last set it to until
+// the process exits. While it is on, requests that change data are rejected, so a
+// migration can run with the receipts still readable.
+var readOnly readOnlyMode
+
+// rejectWrites rejects the request with 503 and a Retry-After while read-only.
+func rejectWrites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if readOnly.Load() {
+			c.Header("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+			abortWithProblem(c, http.StatusServiceUnavailable, "READ_ONLY",
+				"the service is read-only for maintenance and rejects changes")
+			return
+		}
+		c.Next()
+	}
+}
+
+// maintenanceState is the body of the /admin/maintenance endpoints.
+type maintenanceState struct {
+	ReadOnly *bool `json:"readOnly"`
+}
+
+// getMaintenance reports whether the service is read-only.
+func getMaintenance(c *gin.Context) {
+	on := readOnly.Load()
+	c.JSON(http.StatusOK, maintenanceState{ReadOnly: &on})
+}
+
+// setMaintenance turns read-only mode on or off, as {"readOnly": true} says.
+func setMaintenance(c *gin.Context) {
+	var state maintenanceState
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&state)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return
+	}
+	if err == nil && state.ReadOnly == nil {
+		err = errors.New("readOnly is required")
+	}
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "MAINTENANCE_INVALID", err.Error())
+		return
+	}
+
+	readOnly.Store(*state.ReadOnly)
+	c.Set("auditTarget", "readOnly="+strconv.FormatBool(*state.ReadOnly))
+	c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	t.Cleanup(func() { readOnly.Store(false) })
+	router := newRouter()
+	id, _ := processAndScore(t, router, validReceiptPayload)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	setReadOnly := func(on bool) {
+		body := `{"readOnly": false}`
+		if on {
+			body = `{"readOnly": true}`
+		}
+		if rr := serve(http.MethodPost, "/admin/maintenance", body); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200 turning read-only %v but got %v: %s", on, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Reads keep working while the mode is flipped under traffic, and writes are either
+	// processed or rejected as read-only.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	unexpected := make(chan string, 8)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(write bool) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var rr *httptest.ResponseRecorder
+				if write {
+					rr = serve(http.MethodPost, "/receipts/process", validReceiptPayload)
+				} else {
+					rr = serve(http.MethodGet, "/receipts/"+id+"/points", "")
+				}
+				if rr.Code != http.StatusOK && (!write || rr.Code != http.StatusServiceUnavailable) {
+					select {
+					case unexpected <- rr.Body.String():
+					default:
+					}
+				}
+			}
+		}(i == 0)
+	}
+	for i := 0; i < 50; i++ {
+		setReadOnly(i%2 == 0)
+	}
+	close(stop)
+	wg.Wait()
+	close(unexpected)
+	for body := range unexpected {
+		t.Errorf("expected reads to succeed and writes to succeed or be rejected as read-only but got %s", body)
+	}
+
+	setReadOnly(true)
+	rr := serve(http.MethodPost, "/receipts/process", validReceiptPayload)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "60" || !strings.Contains(rr.Body.String(), `"code":"READ_ONLY"`) {
+		t.Errorf("expected a 503 READ_ONLY problem with a Retry-After but got %v %v: %s", rr.Code, rr.Header(), rr.Body.String())
+	}
+	if rr := serve(http.MethodDelete, "/admin/users/someone/data", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected erasure to be rejected while read-only but got %v", rr.Code)
+	}
+	if rr := serve(http.MethodGet, "/receipts/"+id+"/points", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected reads to work while read-only but got %v", rr.Code)
+	}
+	if rr := serve(http.MethodGet, "/ready", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the service to stay ready while read-only but got %v", rr.Code)
+	}
+	var health map[string]string
+	if err := json.Unmarshal(serve(http.MethodGet, "/health", "").Body.Bytes(), &health); err != nil || !strings.HasPrefix(health["maintenance"], "read-only") {
+		t.Errorf("expected a maintenance banner in /health but got %v, %v", health, err)
+	}
+	if rr := serve(http.MethodGet, "/admin/maintenance", ""); rr.Body.String() != `{"readOnly":true}` {
+		t.Errorf("expected read-only to be reported but got %s", rr.Body.String())
+	}
+	if metrics, _ := scrapeMetrics(t, router); metrics["read_only_mode"] != 1 {
+		t.Errorf("expected the read_only_mode gauge at 1 but got %v", metrics["read_only_mode"])
+	}
+
+	setReadOnly(false)
+	processAndScore(t, router, validReceiptPayload)
+	if rr := serve(http.MethodGet, "/health", ""); rr.Body.String() != `{"status":"ok"}` {
+		t.Errorf("expected no banner after maintenance but got %s", rr.Body.String())
+	}
+	if metrics, _ := scrapeMetrics(t, router); metrics["read_only_mode"] != 0 {
+		t.Errorf("expected the read_only_mode gauge at 0 but got %v", metrics["read_only_mode"])
+	}
+
+	for _, body := range []string{`{}`, `{"readOnly": "yes"}`, `{"readOnly": true, "until": "noon"}`} {
+		if rr := serve(http.MethodPost, "/admin/maintenance", body); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "MAINTENANCE_INVALID") {
+			t.Errorf("%s: expected a 400 MAINTENANCE_INVALID but got %v: %s", body, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The metrics are written in the Prometheus text exposition format, version 0.0.4.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricFamily is a metric with all its label combinations, written as one family.
+type metricFamily interface {
+	writeTo(w io.Writer)
+}
+
+// labelKey joins label values into a map key. Values can't hold the separator, since
+// it is not valid UTF-8.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels formats label names and values as {name="value",...}, escaping the
+// values as the exposition format requires.
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, escaper.Replace(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extra[i], escaper.Replace(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// counterVec is a counter with a value per combination of label values.
+type counterVec struct {
+	name, help string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	return &counterVec{name: name, help: help, labelNames: labelNames, values: make(map[string]float64), labels: make(map[string][]string)}
+}
+
+// add adds delta, which must not be negative, to the counter of labelValues.
+func (v *counterVec) add(delta float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.labels[key]; !ok {
+		v.labels[key] = labelValues
+	}
+	v.values[key] += delta
+}
+
+func (v *counterVec) inc(labelValues ...string) {
+	v.add(1, labelValues...)
+}
+
+// value returns the counter of labelValues.
+func (v *counterVec) value(labelValues ...string) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[labelKey(labelValues)]
+}
+
+func (v *counterVec) writeTo(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.labelNames) == 0 {
+		// A counter without labels is reported from the start, at 0.
+		fmt.Fprintf(w, "%s %s\n", v.name, formatValue(v.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(v.labels) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, v.labels[key]), formatValue(v.values[key]))
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are scraped.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+// gaugeVecFunc is a gauge with a value per value of one label, read when the metrics
+// are scraped.
+type gaugeVecFunc struct {
+	name, help, labelName string
+	values                func() map[string]float64
+}
+
+func (g *gaugeVecFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.values()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels([]string{g.labelName}, []string{key}), formatValue(values[key]))
+	}
+}
+
+// histogramVec is a histogram with a series per combination of label values.
+type histogramVec struct {
+	name, help string
+	labelNames []string
+	// buckets are the ascending upper bounds of the buckets, without +Inf. Flags can
+	// set them until the first observation.
+	buckets bucketList
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	// counts holds the observations in each bucket, not cumulated, and beyond the
+	// last bound.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets bucketList, labelNames ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labelNames: labelNames, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{labels: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = series
+	}
+	series.counts[sort.SearchFloat64s(h.buckets, v)]++
+	series.sum += v
+	series.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		var cumulative uint64
+		for i, count := range series.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, series.labels, "le", formatValue(bound)), cumulative)
+		}
+		labels := formatLabels(h.labelNames, series.labels)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, series.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// durationBuckets are the bounds, in seconds, of request duration histograms.
+var durationBuckets = bucketList{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounterVec("http_requests_total",
+		"Requests handled, by route template, method and status.", "route", "method", "status")
+	httpPanics = newCounterVec("http_panics_total",
+		"Handler panics recovered, by route template.", "route")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds",
+		"Time taken to handle requests, by route template, method and status.", durationBuckets, "route", "method", "status")
+	receiptsProcessed = newCounterVec("receipts_processed_total",
+		"Receipts accepted and scored.")
+	receiptValidationFailures = newValidationFailures()
+	receiptLookupsNotFound    = newCounterVec("receipt_lookups_not_found_total",
+		"Receipt lookups answered 404, for unknown receipts and receipts of other users.")
+	pointsAwarded = newHistogramVec("receipt_points_awarded",
+		"Points awarded per receipt.", bucketList{0, 10, 25, 50, 100, 250, 500})
+	pointsPerDollar = newHistogramVec("receipt_points_per_dollar",
+		"Points awarded per dollar of receipt total, for receipts with a total above 0.", bucketList{0.5, 1, 2, 5, 10, 25, 50, 100})
+	pointsIssued = newCounterVec("receipt_points_issued_total",
+		"Points issued across all receipts. Receipts scoring below 0 issue none.")
+	receiptsStored = &gaugeFunc{name: "receipts_stored",
+		help: "Receipts in the store.",
+		value: func() float64 {
+			receiptsMu.RLock()
+			defer receiptsMu.RUnlock()
+			return float64(len(receipts))
+		}}
+	routeClassInFlight = &gaugeVecFunc{name: "route_class_in_flight",
+		help:      "Requests in flight of each route class with a concurrency budget.",
+		labelName: "class",
+		values:    routeClassesInFlight}
+	readOnlyGauge = &gaugeFunc{name: "read_only_mode",
+		help: "1 while the service is read-only for maintenance, else 0.",
+		value: func() float64 {
+			if readOnly.Load() {
+				return 1
+			}
+			return 0
+		}}
+)
+
+// validationReason is the machine-readable reason a receipt submission was rejected,
+// the reason label of receipt_validation_failures_total.
+type validationReason string
+
+const (
+	reasonBodyInvalid            validationReason = "BODY_INVALID"
+	reasonRetailerMissing        validationReason = "RETAILER_MISSING"
+	reasonTotalMissing           validationReason = "TOTAL_MISSING"
+	reasonTotalInvalidFormat     validationReason = "TOTAL_INVALID_FORMAT"
+	reasonPurchaseDateMissing    validationReason = "PURCHASE_DATE_MISSING"
+	reasonPurchaseTimeMissing    validationReason = "PURCHASE_TIME_MISSING"
+	reasonTimezoneInvalid        validationReason = "TIMEZONE_INVALID"
+	reasonItemsMissing           validationReason = "ITEMS_MISSING"
+	reasonItemDescriptionMissing validationReason = "ITEM_DESCRIPTION_MISSING"
+	reasonItemPriceInvalid       validationReason = "ITEM_PRICE_INVALID"
+	reasonUploadMissing          validationReason = "UPLOAD_MISSING"
+	reasonUploadMultiple         validationReason = "UPLOAD_MULTIPLE"
+	reasonUploadNotJSON          validationReason = "UPLOAD_NOT_JSON"
+)
+
+// validationReasons are all the reasons, so the labels of the failures counter are a
+// fixed set.
+var validationReasons = []validationReason{
+	reasonBodyInvalid,
+	reasonRetailerMissing,
+	reasonTotalMissing,
+	reasonTotalInvalidFormat,
+	reasonPurchaseDateMissing,
+	reasonPurchaseTimeMissing,
+	reasonTimezoneInvalid,
+	reasonItemsMissing,
+	reasonItemDescriptionMissing,
+	reasonItemPriceInvalid,
+	reasonUploadMissing,
+	reasonUploadMultiple,
+	reasonUploadNotJSON,
+}
+
+// newValidationFailures returns the failures counter with every reason at 0, so each
+// is reported before it first happens.
+func newValidationFailures() *counterVec {
+	failures := newCounterVec("receipt_validation_failures_total",
+		"Receipt submissions rejected as invalid, by the first reason found.", "reason")
+	for _, reason := range validationReasons {
+		failures.add(0, string(reason))
+	}
+	return failures
+}
+
+// rejectReceipt responds 400 to an invalid receipt submission and counts it by reason.
+func rejectReceipt(c *gin.Context, reason validationReason, message string) {
+	receiptValidationFailures.inc(string(reason))
+	abortWithError(c, http.StatusBadRequest, string(reason), message)
+}
+
+// metricFamilies are the metrics /metrics reports, in order.
+var metricFamilies = []metricFamily{
+	httpRequests,
+	httpRequestDuration,
+	httpPanics,
+	receiptsProcessed,
+	receiptValidationFailures,
+	receiptLookupsNotFound,
+	pointsAwarded,
+	pointsPerDollar,
+	pointsIssued,
+	receiptsStored,
+	routeClassInFlight,
+	readOnlyGauge,
+	webhookDeliveryAttempts,
+	webhookDeliveries,
+	webhookEventsDropped,
+	webhookDeadLetters,
+	eventsPublished,
+	eventsDropped,
+	streamClients,
+	streamDisconnects,
+	wsConnections,
+	wsOverflows,
+}
+
+// observeRequests counts each request and its duration by route template, so receipt
+// IDs don't become label values.
+func observeRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := clock.Now()
+		c.Next()
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.inc(route(c), c.Request.Method, status)
+		httpRequestDuration.observe(clock.Now().Sub(start).Seconds(), route(c), c.Request.Method, status)
+	}
+}
+
+// countSubmission counts a receipt submission as processed if it succeeded. Invalid ones
+// are counted by rejectReceipt.
+func countSubmission(c *gin.Context) {
+	if c.Writer.Status() == http.StatusOK {
+		receiptsProcessed.inc()
+	}
+}
+
+// observePoints records the points awarded to a receipt with a total of total, which
+// must be normalized.
+func observePoints(points int, total string) {
+	pointsAwarded.observe(float64(points))
+	if dollars, err := strconv.ParseFloat(total, 64); err == nil && dollars > 0 {
+		pointsPerDollar.observe(float64(points) / dollars)
+	}
+	if points > 0 {
+		pointsIssued.add(float64(points))
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(c *gin.Context) {
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", metricsContentType)
+	for _, family := range metricFamilies {
+		family.writeTo(c.Writer)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scrapeMetrics scrapes /metrics, returning the samples by name and labels, such as
+// `http_requests_total{route="/rules",method="GET",status="200"}`, and the families by
+// their TYPE.
+func scrapeMetrics(t *testing.T, router *gin.Engine) (map[string]float64, map[string]string) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != metricsContentType {
+		t.Fatalf("expected the metrics but got %v %q: %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	samples, types := make(map[string]float64), make(map[string]string)
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("expected a sample but got %q", line)
+		}
+		samples[line[:i]] = value
+	}
+	return samples, types
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	before, _ := scrapeMetrics(t, router)
+
+	id, _ := processAndScore(t, router, validReceiptPayload)
+	processAndScore(t, router, validReceiptPayload)
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(`{"retailer": "Target"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	for _, path := range []string{"/receipts/" + id, "/receipts/unknown/points", "/receipts/unknown"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	after, types := scrapeMetrics(t, router)
+	for family, kind := range map[string]string{
+		"http_requests_total":               "counter",
+		"http_request_duration_seconds":     "histogram",
+		"receipts_processed_total":          "counter",
+		"receipt_validation_failures_total": "counter",
+		"receipt_lookups_not_found_total":   "counter",
+		"receipts_stored":                   "gauge",
+		"read_only_mode":                    "gauge",
+	} {
+		if types[family] != kind {
+			t.Errorf("expected the %s family to be a %s but got %q", family, kind, types[family])
+		}
+	}
+
+	deltas := map[string]float64{
+		`http_requests_total{route="/receipts/process",method="POST",status="200"}`:                 2,
+		`http_requests_total{route="/receipts/process",method="POST",status="400"}`:                 1,
+		`http_requests_total{route="/receipts/:receipt_id/points",method="GET",status="200"}`:       2,
+		`http_requests_total{route="/receipts/:receipt_id/points",method="GET",status="404"}`:       1,
+		`http_requests_total{route="/receipts/:receipt_id",method="GET",status="404"}`:              1,
+		`http_request_duration_seconds_count{route="/receipts/process",method="POST",status="200"}`: 2,
+		`receipts_processed_total`:                                  2,
+		`receipt_validation_failures_total{reason="TOTAL_MISSING"}`: 1,
+		`receipt_lookups_not_found_total`:                           2,
+	}
+	for sample, delta := range deltas {
+		if got := after[sample] - before[sample]; got != delta {
+			t.Errorf("expected %s to grow by %v but got %v", sample, delta, got)
+		}
+	}
+	if after["receipts_stored"] != 2 {
+		t.Errorf("expected 2 receipts stored but got %v", after["receipts_stored"])
+	}
+	bucket := `http_request_duration_seconds_bucket{route="/receipts/process",method="POST",status="200",le="+Inf"}`
+	if after[bucket] != after[`http_request_duration_seconds_count{route="/receipts/process",method="POST",status="200"}`] {
+		t.Errorf("expected the +Inf bucket to hold every observation but got %v", after[bucket])
+	}
+	// IDs never become label values.
+	for sample := range after {
+		if strings.Contains(sample, id) || strings.Contains(sample, "unknown") {
+			t.Errorf("expected no receipt IDs in labels but got %s", sample)
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogramVec("size", "Sizes.", []float64{1, 5}, "kind")
+	for _, v := range []float64{0.5, 1, 3, 5, 7} {
+		h.observe(v, `a"b`)
+	}
+	var b strings.Builder
+	h.writeTo(&b)
+	expected := `# HELP size Sizes.
+# TYPE size histogram
+size_bucket{kind="a\"b",le="1"} 2
+size_bucket{kind="a\"b",le="5"} 4
+size_bucket{kind="a\"b",le="+Inf"} 5
+size_sum{kind="a\"b"} 16.5
+size_count{kind="a\"b"} 5
+`
+	if b.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, b.String())
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newRouter()
+	useMetricsCredentials(t, "prometheus", "s3cret", "")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 but got %v", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("prometheus", "s3cret")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 but got %v", rr.Code)
+	}
+}
+
+func TestValidationFailureReasons(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	before := make(map[validationReason]float64)
+	for _, reason := range validationReasons {
+		before[reason] = receiptValidationFailures.value(string(reason))
+	}
+
+	for _, payload := range []string{
+		strings.Replace(validReceiptPayload, `"35.35"`, `"35.35.35"`, 1),
+		strings.Replace(validReceiptPayload, `"35.35"`, `"abc"`, 1),
+		strings.Replace(validReceiptPayload, `"6.49"`, `"six"`, 1),
+		strings.Replace(validReceiptPayload, `"Target"`, `""`, 1),
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 but got %v: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	expected := map[validationReason]float64{reasonTotalInvalidFormat: 2, reasonItemPriceInvalid: 1, reasonRetailerMissing: 1}
+	for _, reason := range validationReasons {
+		if got := receiptValidationFailures.value(string(reason)) - before[reason]; got != expected[reason] {
+			t.Errorf("expected %s to grow by %v but got %v", reason, expected[reason], got)
+		}
+	}
+
+	// Every reason is reported, and nothing else.
+	samples, _ := scrapeMetrics(t, router)
+	reported := 0
+	for sample := range samples {
+		if strings.HasPrefix(sample, "receipt_validation_failures_total{") {
+			reported++
+		}
+	}
+	if reported != len(validationReasons) {
+		t.Errorf("expected a series for each of the %d reasons but got %d", len(validationReasons), reported)
+	}
+}
+
+func TestPointsMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	before, _ := scrapeMetrics(t, router)
+
+	// Target scores 28 points for $35.35, M&M Corner Market 109 for $9.00.
+	for _, name := range []string{"target.json", "mm-corner-market.json"} {
+		payload, err := os.ReadFile(filepath.Join("testdata", "golden", "default", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		processAndScore(t, router, string(payload))
+	}
+
+	after, types := scrapeMetrics(t, router)
+	if types["receipt_points_awarded"] != "histogram" || types["receipt_points_per_dollar"] != "histogram" || types["receipt_points_issued_total"] != "counter" {
+		t.Errorf("expected two histograms and a counter but got %v", types)
+	}
+	deltas := map[string]float64{
+		`receipt_points_awarded_bucket{le="25"}`:     0,
+		`receipt_points_awarded_bucket{le="50"}`:     1,
+		`receipt_points_awarded_bucket{le="100"}`:    1,
+		`receipt_points_awarded_bucket{le="250"}`:    2,
+		`receipt_points_awarded_bucket{le="+Inf"}`:   2,
+		`receipt_points_awarded_sum`:                 137,
+		`receipt_points_awarded_count`:               2,
+		`receipt_points_per_dollar_bucket{le="0.5"}`: 0,
+		`receipt_points_per_dollar_bucket{le="1"}`:   1,
+		`receipt_points_per_dollar_bucket{le="10"}`:  1,
+		`receipt_points_per_dollar_bucket{le="25"}`:  2,
+		`receipt_points_per_dollar_count`:            2,
+		`receipt_points_issued_total`:                137,
+	}
+	for sample, delta := range deltas {
+		if got := after[sample] - before[sample]; got != delta {
+			t.Errorf("expected %s to grow by %v but got %v", sample, delta, got)
+		}
+	}
+}
+
+func TestPointsBucketsFlag(t *testing.T) {
+	h := newHistogramVec("points", "Points.", bucketList{0, 10})
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&h.buckets, "points-buckets", "")
+	if err := flags.Parse([]string{"--points-buckets", "100, 1000"}); err != nil {
+		t.Fatal(err)
+	}
+	h.observe(500)
+	var b strings.Builder
+	h.writeTo(&b)
+	if !strings.Contains(b.String(), `points_bucket{le="100"} 0`) || !strings.Contains(b.String(), `points_bucket{le="1000"} 1`) {
+		t.Errorf("expected the buckets of the flag but got\n%s", b.String())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// metricsUsername and metricsPassword are the --metrics-username and
+	// --metrics-password scrapers authenticate to /metrics with.
+	metricsUsername, metricsPassword string
+	// metricsHtpasswdPath is the --metrics-htpasswd file of further scrapers.
+	metricsHtpasswdPath string
+)
+
+// htpasswdSHAPrefix starts the password hashes of `htpasswd -s`, the base64 SHA-1 of
+// the password. It is the only scheme of htpasswd the standard library can check.
+const htpasswdSHAPrefix = "{SHA}"
+
+// metricsCredentials maps the users allowed to scrape /metrics to the SHA-1 of their
+// password. Empty leaves /metrics open.
+var metricsCredentials map[string][sha1.Size]byte
+
+// loadHtpasswd reads an htpasswd file of user:{SHA}hash lines, as written by
+// `htpasswd -s`. Blank lines and lines starting with # are ignored.
+func loadHtpasswd(path string) (map[string][sha1.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string][sha1.Size]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, &configError{path: path, line: n, msg: "expected user:{SHA}hash"}
+		}
+		encoded, ok := strings.CutPrefix(hash, htpasswdSHAPrefix)
+		if !ok {
+			return nil, &configError{path: path, line: n, msg: fmt.Sprintf("user %q: only {SHA} hashes are supported, write them with htpasswd -s", user)}
+		}
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(digest) != sha1.Size {
+			return nil, &configError{path: path, line: n, msg: fmt.Sprintf("user %q: invalid {SHA} hash", user)}
+		}
+		if _, ok := credentials[user]; ok {
+			return nil, &configError{path: path, line: n, msg: fmt.Sprintf("user %q is listed more than once", user)}
+		}
+		credentials[user] = *(*[sha1.Size]byte)(digest)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, &configError{path: path, msg: "has no users"}
+	}
+	return credentials, nil
+}
+
+// resolveMetricsCredentials combines --metrics-username and --metrics-password with
+// the users of --metrics-htpasswd.
+func resolveMetricsCredentials(username, password, htpasswdPath string) (map[string][sha1.Size]byte, error) {
+	if (username == "") != (password == "") {
+		return nil, fmt.Errorf("--metrics-username and --metrics-password must be given together")
+	}
+	credentials := make(map[string][sha1.Size]byte)
+	if htpasswdPath != "" {
+		var err error
+		if credentials, err = loadHtpasswd(htpasswdPath); err != nil {
+			return nil, err
+		}
+	}
+	if username != "" {
+		if _, ok := credentials[username]; ok {
+			return nil, fmt.Errorf("--metrics-username %q is also in --metrics-htpasswd", username)
+		}
+		credentials[username] = sha1.Sum([]byte(password))
+	}
+	return credentials, nil
+}
+
+// requireMetricsAuth rejects scrapes without HTTP Basic credentials in
+// metricsCredentials with a 401 challenge. The password is compared in constant time,
+// against a dummy for unknown users too. It lets everything through while no
+// credentials are configured.
+func requireMetricsAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(metricsCredentials) == 0 {
+			c.Next()
+			return
+		}
+		user, password, ok := c.Request.BasicAuth()
+		expected, known := metricsCredentials[user]
+		given := sha1.Sum([]byte(password))
+		if subtle.ConstantTimeCompare(given[:], expected[:]) != 1 || !ok || !known {
+			c.Header("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+			abortWithProblem(c, http.StatusUnauthorized, "METRICS_AUTH_REQUIRED", "metrics require valid basic auth credentials")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useMetricsCredentials protects /metrics with credentials for the rest of the test.
+func useMetricsCredentials(t *testing.T, username, password, htpasswd string) {
+	t.Helper()
+	path := ""
+	if htpasswd != "" {
+		path = filepath.Join(t.TempDir(), "htpasswd")
+		if err := os.WriteFile(path, []byte(htpasswd), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	credentials, err := resolveMetricsCredentials(username, password, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsCredentials = credentials
+	t.Cleanup(func() { metricsCredentials = nil })
+}
+
+func TestRequireMetricsAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/metrics", requireMetricsAuth(), func(c *gin.Context) { c.String(http.StatusOK, "up 1") })
+	scrape := func(username, password string, withAuth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if withAuth {
+			req.SetBasicAuth(username, password)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Without credentials the endpoint stays open.
+	if rr := scrape("", "", false); rr.Code != http.StatusOK {
+		t.Errorf("expected an open /metrics without credentials but got %v", rr.Code)
+	}
+
+	// "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=" is the hash of "password".
+	useMetricsCredentials(t, "prometheus", "s3cret", "# scrapers\ngrafana:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	testCases := []struct {
+		name           string
+		username       string
+		password       string
+		withAuth       bool
+		expectedStatus int
+	}{
+		{"flag credentials", "prometheus", "s3cret", true, http.StatusOK},
+		{"htpasswd credentials", "grafana", "password", true, http.StatusOK},
+		{"wrong password", "prometheus", "s3cret!", true, http.StatusUnauthorized},
+		{"password of another user", "prometheus", "password", true, http.StatusUnauthorized},
+		{"unknown user", "nobody", "s3cret", true, http.StatusUnauthorized},
+		{"empty credentials", "", "", true, http.StatusUnauthorized},
+		{"missing credentials", "", "", false, http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		rr := scrape(tc.username, tc.password, tc.withAuth)
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: expected status %v but got %v", tc.name, tc.expectedStatus, rr.Code)
+		}
+		if tc.expectedStatus != http.StatusUnauthorized {
+			continue
+		}
+		if challenge := rr.Header().Get("WWW-Authenticate"); !strings.HasPrefix(challenge, `Basic realm="metrics"`) {
+			t.Errorf("%s: expected a basic auth challenge but got %q", tc.name, challenge)
+		}
+		if !strings.Contains(rr.Body.String(), "METRICS_AUTH_REQUIRED") {
+			t.Errorf("%s: expected the METRICS_AUTH_REQUIRED code but got %s", tc.name, rr.Body.String())
+		}
+	}
+}
+
+func TestResolveMetricsCredentials(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name          string
+		username      string
+		password      string
+		htpasswd      string
+		expectedUsers int
+		expectedError string
+	}{
+		{"none", "", "", "", 0, ""},
+		{"flags", "prometheus", "s3cret", "", 1, ""},
+		{"flags and file", "prometheus", "s3cret", "grafana:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", 2, ""},
+		{"username without password", "prometheus", "", "", 0, "given together"},
+		{"password without username", "", "s3cret", "", 0, "given together"},
+		{"user in both", "grafana", "s3cret", "grafana:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", 0, "also in --metrics-htpasswd"},
+		{"bcrypt hash", "", "", "grafana:$2y$05$abcdefghijklmnopqrstuu\n", 0, ":1: user \"grafana\": only {SHA} hashes"},
+		{"invalid hash", "", "", "\ngrafana:{SHA}not-base64\n", 0, ":2: user \"grafana\": invalid {SHA} hash"},
+		{"no colon", "", "", "grafana\n", 0, ":1: expected user:{SHA}hash"},
+		{"repeated user", "", "", "a:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\na:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", 0, "listed more than once"},
+		{"empty file", "", "", "# nobody yet\n", 0, "has no users"},
+	}
+	for i, tc := range testCases {
+		path := ""
+		if tc.htpasswd != "" {
+			path = filepath.Join(dir, tc.name)
+			if err := os.WriteFile(path, []byte(tc.htpasswd), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		credentials, err := resolveMetricsCredentials(tc.username, tc.password, path)
+		if tc.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("%d %s: expected an error containing %q but got %v", i, tc.name, tc.expectedError, err)
+			}
+			continue
+		}
+		if err != nil || len(credentials) != tc.expectedUsers {
+			t.Errorf("%d %s: expected %d users but got %v, %v", i, tc.name, tc.expectedUsers, credentials, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireContentType rejects request bodies whose Content-Type isn't one of mediaTypes
+// with a 415. Only a UTF-8 charset parameter is accepted. Requests without a body
+// (GET, HEAD, ...) are passed through.
+func requireContentType(mediaTypes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			c.Next()
+			return
+		}
+
+		header := c.GetHeader("Content-Type")
+		if header == "" {
+			abortWithProblem(c, http.StatusUnsupportedMediaType, "CONTENT_TYPE_MISSING",
+				"Content-Type must be one of: "+strings.Join(mediaTypes, ", "))
+			return
+		}
+		mediaType, params, err := mime.ParseMediaType(header)
+		if err == nil && !isAllowedCharset(params["charset"]) {
+			err = mime.ErrInvalidMediaParameter
+		}
+		if err == nil {
+			for _, allowed := range mediaTypes {
+				if mediaType == allowed {
+					c.Next()
+					return
+				}
+			}
+		}
+		abortWithProblem(c, http.StatusUnsupportedMediaType, "CONTENT_TYPE_UNSUPPORTED",
+			"Content-Type "+header+" is not supported, expected one of: "+strings.Join(mediaTypes, ", "))
+	}
+}
+
+func isAllowedCharset(charset string) bool {
+	return charset == "" || strings.EqualFold(charset, "utf-8")
+}
+
+// limitBodySize caps how much of the request body handlers can read. Bodies that declare
+// a larger Content-Length are rejected up front; streamed bodies fail with an
+// *http.MaxBytesError once the limit is crossed, which handlers report as a 413.
+//
+// Bodies sent with Content-Encoding: gzip are decompressed before the handlers see
+// them, and the limit applies to them decompressed as well as compressed, so a small
+// body can't expand without bound. Other encodings are rejected with a 415.
+func limitBodySize(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			abortWithBodyTooLarge(c, limit)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		switch encoding := c.GetHeader("Content-Encoding"); strings.ToLower(strings.TrimSpace(encoding)) {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			if !decompressBody(c, limit) {
+				return
+			}
+		default:
+			c.Header("Accept-Encoding", "gzip")
+			abortWithProblem(c, http.StatusUnsupportedMediaType, "CONTENT_ENCODING_UNSUPPORTED",
+				"Content-Encoding "+encoding+" is not supported, expected gzip or identity")
+			return
+		}
+		c.Next()
+	}
+}
+
+// decompressBody replaces a gzip request body with its decompressed contents, or
+// responds 413 if they exceed limit and 400 if they aren't valid gzip.
+func decompressBody(c *gin.Context, limit int64) bool {
+	reader, err := gzip.NewReader(c.Request.Body)
+	var data []byte
+	if err == nil {
+		// Read one byte past the limit to tell a body at the limit from a larger one.
+		data, err = io.ReadAll(io.LimitReader(reader, limit+1))
+	}
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr), int64(len(data)) > limit:
+		abortWithBodyTooLarge(c, limit)
+		return false
+	case err != nil:
+		abortWithProblem(c, http.StatusBadRequest, "BODY_ENCODING_INVALID", "the request body is not valid gzip data: "+err.Error())
+		return false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	c.Request.ContentLength = int64(len(data))
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.Header.Del("Content-Length")
+	return true
+}
+
+func abortWithBodyTooLarge(c *gin.Context, limit int64) {
+	abortWithProblem(c, http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE",
+		"request body exceeds the limit of "+strconv.FormatInt(limit, 10)+" bytes")
+}
+
+// adminToken is the bearer token admin endpoints require. Empty leaves them open.
+var adminToken string
+
+// requireAdminToken rejects requests without an "Authorization: Bearer" header carrying
+// adminToken with a 401. It lets everything through while no token is configured.
+func requireAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			c.Next()
+			return
+		}
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			abortWithProblem(c, http.StatusUnauthorized, "ADMIN_TOKEN_REQUIRED", "admin endpoints require a valid bearer token")
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminAllowedNets are the --admin-allowed-cidrs the /admin endpoints can be reached
+// from. None leaves them reachable from anywhere.
+var adminAllowedNets []*net.IPNet
+
+// parseCIDRs parses a comma separated list of IPv4 and IPv6 CIDR ranges.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q, expected e.g. 10.0.0.0/8 or fd00::/8", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// requireAdminNetwork rejects requests from client IPs outside adminAllowedNets with a
+// 403, so a leaked token or key can't be used from elsewhere. The client IP is taken
+// from X-Forwarded-For only behind trusted proxies. It lets everything through while
+// no ranges are configured.
+func requireAdminNetwork() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(adminAllowedNets) == 0 {
+			c.Next()
+			return
+		}
+		clientIP := c.ClientIP()
+		if ip := net.ParseIP(clientIP); ip != nil {
+			for _, ipNet := range adminAllowedNets {
+				if ipNet.Contains(ip) {
+					c.Next()
+					return
+				}
+			}
+		}
+		logRequestf(c, "denied %s %s from %s, outside --admin-allowed-cidrs", c.Request.Method, route(c), clientIP)
+		abortWithProblem(c, http.StatusForbidden, "ADMIN_NETWORK_DENIED", "admin endpoints can't be reached from "+clientIP)
+	}
+}
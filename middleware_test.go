@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const validReceiptPayload = `{
+	"retailer": "Target",
+	"total": "35.35",
+	"items": [
+		{"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+		{"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+		{"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+		{"shortDescription": "Doritos Nacho Cheese", "price": "3.35"},
+		{"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+	],
+	"purchaseDate": "2022-01-01",
+	"purchaseTime": "13:01"
+}`
+
+func TestRequireContentType(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	testCases := []struct {
+		name           string
+		contentType    string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "Missing", expectedStatus: http.StatusUnsupportedMediaType, expectedCode: "CONTENT_TYPE_MISSING"},
+		{name: "TextPlain", contentType: "text/plain", expectedStatus: http.StatusUnsupportedMediaType, expectedCode: "CONTENT_TYPE_UNSUPPORTED"},
+		{name: "Malformed", contentType: "application/", expectedStatus: http.StatusUnsupportedMediaType, expectedCode: "CONTENT_TYPE_UNSUPPORTED"},
+		{name: "Latin1", contentType: "application/json; charset=iso-8859-1", expectedStatus: http.StatusUnsupportedMediaType, expectedCode: "CONTENT_TYPE_UNSUPPORTED"},
+		{name: "JSON", contentType: "application/json", expectedStatus: http.StatusOK},
+		{name: "JSONWithCharset", contentType: "application/json;charset=utf-8", expectedStatus: http.StatusOK},
+		{name: "JSONWithUpperCharset", contentType: "application/json; charset=UTF-8", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(validReceiptPayload))
+			req.Header.Set("X-Request-ID", "req-"+tc.name)
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v but got %v", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedCode == "" {
+				return
+			}
+
+			if contentType := rr.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("expected problem content type but got %q", contentType)
+			}
+			var body problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			expected := problem{
+				Type:   "about:blank",
+				Title:  "Unsupported Media Type",
+				Status: http.StatusUnsupportedMediaType,
+				Detail: body.Detail,
+				Code:   tc.expectedCode,
+				// The request ID links the response to the logs.
+				RequestID: "req-" + tc.name,
+			}
+			if body != expected || body.Detail == "" {
+				t.Errorf("expected problem body %+v but got %+v", expected, body)
+			}
+		})
+	}
+}
+
+func TestRequireContentTypeIgnoresGet(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = ReceiptsMap{"abc": {Points: 28}}
+	router := newRouter()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/abc/points", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %v but got %v", http.StatusOK, rr.Code)
+	}
+}
+
+// endlessJSON streams a receipt whose retailer name never ends, without a Content-Length.
+type endlessJSON struct {
+	prefix    []byte
+	remaining int64
+}
+
+func (r *endlessJSON) Read(p []byte) (int, error) {
+	if len(r.prefix) > 0 {
+		n := copy(p, r.prefix)
+		r.prefix = r.prefix[n:]
+		return n, nil
+	}
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+func TestLimitBodySize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(limit byteSize) { maxBodyBytes = limit }(maxBodyBytes)
+	maxBodyBytes = byteSize(len(validReceiptPayload))
+	router := newRouter()
+
+	testCases := []struct {
+		name           string
+		body           io.Reader
+		contentLength  int64
+		expectedStatus int
+	}{
+		{name: "AtLimit", body: strings.NewReader(validReceiptPayload), contentLength: int64(len(validReceiptPayload)), expectedStatus: http.StatusOK},
+		{name: "DeclaredOverLimit", body: strings.NewReader(" " + validReceiptPayload), contentLength: int64(len(validReceiptPayload)) + 1, expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "StreamedOverLimit", body: strings.NewReader(" " + validReceiptPayload), contentLength: -1, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/receipts/process", tc.body)
+			req.ContentLength = tc.contentLength
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v but got %v: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tc.expectedStatus != http.StatusRequestEntityTooLarge {
+				return
+			}
+			var body problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != "BODY_TOO_LARGE" {
+				t.Errorf("expected code BODY_TOO_LARGE but got %q", body.Code)
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLimitBodySizeGzip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(limit byteSize) { maxBodyBytes = limit }(maxBodyBytes)
+	maxBodyBytes = 128 << 10
+	router := newRouter()
+
+	compressed := gzipped(t, []byte(validReceiptPayload))
+	// The bomb is well within the limit compressed, so only the decompressed limit stops it.
+	bomb := gzipped(t, make([]byte, 32<<20))
+	if len(bomb) >= int(maxBodyBytes) {
+		t.Fatalf("expected the bomb to be under the limit compressed but it is %d bytes", len(bomb))
+	}
+
+	testCases := []struct {
+		name           string
+		encoding       string
+		body           []byte
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "Gzipped", encoding: "gzip", body: compressed, expectedStatus: http.StatusOK},
+		{name: "GzippedUpperCase", encoding: "GZIP", body: compressed, expectedStatus: http.StatusOK},
+		{name: "Identity", encoding: "identity", body: []byte(validReceiptPayload), expectedStatus: http.StatusOK},
+		{name: "ExpandsOverLimit", encoding: "gzip", body: gzipped(t, []byte(validReceiptPayload+strings.Repeat(" ", int(maxBodyBytes)))), expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: "BODY_TOO_LARGE"},
+		{name: "ZipBomb", encoding: "gzip", body: bomb, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: "BODY_TOO_LARGE"},
+		{name: "Truncated", encoding: "gzip", body: compressed[:len(compressed)/2], expectedStatus: http.StatusBadRequest, expectedCode: "BODY_ENCODING_INVALID"},
+		{name: "BadChecksum", encoding: "gzip", body: append(append([]byte{}, compressed[:len(compressed)-8]...), 0, 0, 0, 0, 0, 0, 0, 0), expectedStatus: http.StatusBadRequest, expectedCode: "BODY_ENCODING_INVALID"},
+		{name: "NotGzip", encoding: "gzip", body: []byte(validReceiptPayload), expectedStatus: http.StatusBadRequest, expectedCode: "BODY_ENCODING_INVALID"},
+		{name: "Empty", encoding: "gzip", body: nil, expectedStatus: http.StatusBadRequest, expectedCode: "BODY_ENCODING_INVALID"},
+		{name: "UnknownEncoding", encoding: "br", body: []byte(validReceiptPayload), expectedStatus: http.StatusUnsupportedMediaType, expectedCode: "CONTENT_ENCODING_UNSUPPORTED"},
+		{name: "StackedEncodings", encoding: "gzip, gzip", body: gzipped(t, compressed), expectedStatus: http.StatusUnsupportedMediaType, expectedCode: "CONTENT_ENCODING_UNSUPPORTED"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", tc.encoding)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v but got %v: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tc.expectedCode == "" {
+				return
+			}
+			var body problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tc.expectedCode {
+				t.Errorf("expected code %s but got %q", tc.expectedCode, body.Code)
+			}
+			if tc.expectedStatus == http.StatusUnsupportedMediaType && rr.Header().Get("Accept-Encoding") != "gzip" {
+				t.Errorf("expected Accept-Encoding: gzip but got %q", rr.Header().Get("Accept-Encoding"))
+			}
+		})
+	}
+}
+
+func TestLimitBodySizeBoundsMemory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(limit byteSize) { maxBodyBytes = limit }(maxBodyBytes)
+	maxBodyBytes = 1 << 20
+	router := newRouter()
+
+	const streamed = 256 << 20
+	body := &endlessJSON{prefix: []byte(`{"retailer": "`), remaining: streamed}
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", body)
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	router.ServeHTTP(rr, req)
+	runtime.ReadMemStats(&after)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %v but got %v", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+	if body.remaining < streamed-2*int64(maxBodyBytes) {
+		t.Errorf("expected reading to stop near the limit but %d bytes were consumed", streamed-body.remaining)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("expected bounded allocations but %d bytes were allocated", allocated)
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	previousToken := adminToken
+	defer func() { adminToken = previousToken }()
+	router := newRouter()
+
+	testCases := []struct {
+		name           string
+		token          string
+		authorization  string
+		expectedStatus int
+	}{
+		{name: "NoTokenConfigured", token: "", authorization: "", expectedStatus: http.StatusOK},
+		{name: "Missing", token: "s3cret", authorization: "", expectedStatus: http.StatusUnauthorized},
+		{name: "Wrong", token: "s3cret", authorization: "Bearer s3cre", expectedStatus: http.StatusUnauthorized},
+		{name: "NotBearer", token: "s3cret", authorization: "Basic s3cret", expectedStatus: http.StatusUnauthorized},
+		{name: "Valid", token: "s3cret", authorization: "Bearer s3cret", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			adminToken = tc.token
+			shadow.Store(newShadowScorer(currentEngine()))
+			defer shadow.Store(nil)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/admin/shadow/summary", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			router.ServeHTTP(rr, req)
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v but got %v", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedStatus == http.StatusUnauthorized && !strings.Contains(rr.Body.String(), "ADMIN_TOKEN_REQUIRED") {
+				t.Errorf("expected the ADMIN_TOKEN_REQUIRED code but got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireAdminNetwork(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous []*net.IPNet) { adminAllowedNets = previous }(adminAllowedNets)
+	defer func(previous []string) { trustedProxies = previous }(trustedProxies)
+	var err error
+	if adminAllowedNets, err = parseCIDRs("10.8.0.0/16, 2001:db8:1::/48"); err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = []string{"192.168.0.1"}
+	router := newRouter()
+
+	testCases := []struct {
+		name, remoteAddr, forwardedFor string
+		expectedStatus                 int
+	}{
+		{"IPv4 inside", "10.8.3.4:5000", "", http.StatusOK},
+		{"IPv4 outside", "10.9.3.4:5000", "", http.StatusForbidden},
+		{"IPv6 inside", "[2001:db8:1:42::7]:5000", "", http.StatusOK},
+		{"IPv6 outside", "[2001:db8:2::7]:5000", "", http.StatusForbidden},
+		{"through a trusted proxy", "192.168.0.1:443", "10.8.0.9", http.StatusOK},
+		{"outside through a trusted proxy", "192.168.0.1:443", "203.0.113.9", http.StatusForbidden},
+		{"the trusted proxy itself", "192.168.0.1:443", "", http.StatusForbidden},
+		{"spoofed by an untrusted peer", "203.0.113.9:443", "10.8.0.9", http.StatusForbidden},
+		{"spoofed IPv6 by an untrusted peer", "[2001:db8:2::7]:443", "2001:db8:1::1", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		rr := requestFrom(router, "/admin/quotas", tc.remoteAddr, tc.forwardedFor)
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: expected status %v but got %v", tc.name, tc.expectedStatus, rr.Code)
+		}
+		if tc.expectedStatus == http.StatusForbidden && !strings.Contains(rr.Body.String(), "ADMIN_NETWORK_DENIED") {
+			t.Errorf("%s: expected the ADMIN_NETWORK_DENIED code but got %s", tc.name, rr.Body.String())
+		}
+	}
+
+	// Only the admin endpoints are restricted.
+	if rr := requestFrom(router, "/rules", "203.0.113.9:443", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the API to be reachable from anywhere but got %v", rr.Code)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs(" 10.0.0.0/8,, fd00::/8 ")
+	if err != nil || len(nets) != 2 || nets[0].String() != "10.0.0.0/8" || nets[1].String() != "fd00::/8" {
+		t.Errorf("expected 10.0.0.0/8 and fd00::/8 but got %v, %v", nets, err)
+	}
+	if nets, err := parseCIDRs(""); err != nil || nets != nil {
+		t.Errorf("expected no ranges but got %v, %v", nets, err)
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "10.0.0.1", "fd00::/129", "office"} {
+		if _, err := parseCIDRs(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
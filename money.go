@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// lenientMoney enables the relaxed parsing of totals and prices, see normalizeMoney.
+var lenientMoney bool
+
+// currencySymbols lists the leading symbols accepted in lenient mode.
+var currencySymbols = []string{"$", "€", "£", "¥", "₹"}
+
+// groupedAmount matches an amount with optional comma thousands separators, e.g. "1,234.50".
+var groupedAmount = regexp.MustCompile(`^[0-9]{1,3}(,[0-9]{3})*(\.[0-9]+)?$`)
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// normalizeMoney validates an amount and returns the form that should be stored.
+// In strict mode the value must already parse as a number and is returned unchanged.
+// In lenient mode a single leading currency symbol and comma thousands separators are
+// stripped first, and the canonical two-decimal form (e.g. "1234.50") is returned.
+func normalizeMoney(s string, lenient bool) (string, error) {
+	if !lenient {
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return "", errInvalidAmount
+		}
+		return s, nil
+	}
+
+	s = strings.TrimSpace(s)
+	for _, symbol := range currencySymbols {
+		if strings.HasPrefix(s, symbol) {
+			s = strings.TrimSpace(s[len(symbol):])
+			break
+		}
+	}
+
+	// Only comma grouping in blocks of three is understood. Anything else with a comma,
+	// such as the European "1.234,50", is ambiguous and rejected.
+	if strings.Contains(s, ",") {
+		if !groupedAmount.MatchString(s) {
+			return "", errInvalidAmount
+		}
+		s = strings.ReplaceAll(s, ",", "")
+	}
+
+	// More than two decimals would be silently rounded away, and "1.234" is as likely
+	// to mean 1234 as 1.234, so reject it.
+	if dot := strings.IndexByte(s, '.'); dot >= 0 && len(s)-dot-1 > 2 {
+		return "", errInvalidAmount
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", errInvalidAmount
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64), nil
+}
+
+// plainDecimal matches amounts written as digits with an optional fraction.
+var plainDecimal = regexp.MustCompile(`^([+-]?)([0-9]*)(?:\.([0-9]*))?$`)
+
+// amountCents converts a validated amount to whole cents, rounding half away from zero.
+// Plain decimals are converted digit by digit so "1.005" is 101 cents rather than the
+// 100 that float64 arithmetic would give.
+func amountCents(s string) (int64, error) {
+	match := plainDecimal.FindStringSubmatch(s)
+	if match == nil || match[2]+match[3] == "" || len(match[2]) > 15 {
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0, errInvalidAmount
+		}
+		return int64(math.Round(value * 100)), nil
+	}
+
+	fraction := match[3] + "000"
+	cents, _ := strconv.ParseInt(match[2]+fraction[:2], 10, 64)
+	if fraction[2] >= '5' {
+		cents++
+	}
+	if match[1] == "-" {
+		cents = -cents
+	}
+	return cents, nil
+}
+
+// formatCents renders cents as a two-decimal amount, e.g. 1234 as "12.34".
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizeMoney(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		lenient  bool
+		expected string
+		valid    bool
+	}{
+		{name: "StrictPlain", input: "35.35", expected: "35.35", valid: true},
+		{name: "StrictUnchanged", input: "6.5", expected: "6.5", valid: true},
+		{name: "StrictRejectsSymbol", input: "$35.35"},
+		{name: "StrictRejectsSeparator", input: "1,234.50"},
+		{name: "LenientPlain", input: "35.35", lenient: true, expected: "35.35", valid: true},
+		{name: "LenientPadsDecimals", input: "6.5", lenient: true, expected: "6.50", valid: true},
+		{name: "LenientWhole", input: "12", lenient: true, expected: "12.00", valid: true},
+		{name: "LenientDollar", input: "$1,234.50", lenient: true, expected: "1234.50", valid: true},
+		{name: "LenientSymbolSpace", input: "$ 9.99", lenient: true, expected: "9.99", valid: true},
+		{name: "LenientEuro", input: "€5.00", lenient: true, expected: "5.00", valid: true},
+		{name: "LenientPound", input: "£0.25", lenient: true, expected: "0.25", valid: true},
+		{name: "LenientMillions", input: "1,234,567.89", lenient: true, expected: "1234567.89", valid: true},
+		{name: "LenientEuropean", input: "1.234,50", lenient: true},
+		{name: "LenientThreeDecimals", input: "1.234", lenient: true},
+		{name: "LenientBadGrouping", input: "12,34.50", lenient: true},
+		{name: "LenientTrailingComma", input: "1234,", lenient: true},
+		{name: "LenientTwoSymbols", input: "$$5.00", lenient: true},
+		{name: "LenientSymbolOnly", input: "$", lenient: true},
+		{name: "LenientTrailingSymbol", input: "5.00$", lenient: true},
+		{name: "LenientEmpty", input: "", lenient: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizeMoney(tc.input, tc.lenient)
+			if tc.valid && err != nil {
+				t.Fatalf("expected %q to be accepted but got %v", tc.input, err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("expected %q to be rejected but got %q", tc.input, got)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLenientMoneyPointsMatchCanonical(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	lenientMoney = true
+	defer func() { lenientMoney = false }()
+
+	router := newRouter()
+
+	pointsFor := func(total, price string) int {
+		payload := `{
+			"retailer": "M&M Corner Market",
+			"total": "` + total + `",
+			"items": [
+				{"shortDescription": "Gatorade", "price": "` + price + `"},
+				{"shortDescription": "Gatorade", "price": "` + price + `"}
+			],
+			"purchaseDate": "2022-03-20",
+			"purchaseTime": "14:33"
+		}`
+		req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %v but got %v: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var processed struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil {
+			t.Fatal(err)
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+processed.ID+"/points", nil))
+		var points struct {
+			Points int `json:"points"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &points); err != nil {
+			t.Fatal(err)
+		}
+		return points.Points
+	}
+
+	canonical := pointsFor("1234.00", "617.00")
+	if canonical != 104 {
+		t.Fatalf("expected 104 points for the canonical payload but got %v", canonical)
+	}
+	if lenient := pointsFor("$1,234", "$617.00"); lenient != canonical {
+		t.Errorf("expected %v points for the lenient payload but got %v", canonical, lenient)
+	}
+}
+
+func TestAmountCents(t *testing.T) {
+	testCases := map[string]int64{
+		"0.99":    99,
+		"1.00":    100,
+		"1":       100,
+		"35.35":   3535,
+		"1234.50": 123450,
+		"0.29":    29,
+		"1.005":   101,
+	}
+	for input, expected := range testCases {
+		got, err := amountCents(input)
+		if err != nil {
+			t.Errorf("expected %q to be accepted but got %v", input, err)
+		}
+		if got != expected {
+			t.Errorf("expected %q to be %v cents but got %v", input, expected, got)
+		}
+	}
+
+	if _, err := amountCents("abc"); err == nil {
+		t.Error("expected an invalid amount to be rejected")
+	}
+}
+
+func TestFormatCents(t *testing.T) {
+	testCases := map[int64]string{0: "0.00", 5: "0.05", 100: "1.00", 123450: "1234.50", -250: "-2.50"}
+	for cents, expected := range testCases {
+		if got := formatCents(cents); got != expected {
+			t.Errorf("expected %v cents to format as %q but got %q", cents, expected, got)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "github.com/ugorji/go/codec"
+
+// msgpack is MessagePack, in the current spec, which tells text strings from binary
+// ones and has a timestamp type for times. Responses are encoded canonically, and
+// receipts are decoded without fields a Receipt doesn't have.
+var msgpack = codecFormat{
+	handle: func() *codec.MsgpackHandle {
+		h := &codec.MsgpackHandle{}
+		h.WriteExt = true
+		h.Canonical = true
+		h.ErrorIfNoField = true
+		return h
+	}(),
+	name:  "MessagePack",
+	value: "object",
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+)
+
+func encodeMsgpack(tb testing.TB, value any) []byte {
+	tb.Helper()
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, msgpack.handle).Encode(value); err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// decodeMsgpack decodes a MessagePack response body, a map.
+func decodeMsgpack(t *testing.T, rr *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/msgpack" {
+		t.Fatalf("expected a MessagePack response but got %q: %q", contentType, rr.Body.String())
+	}
+	var body map[string]any
+	if err := codec.NewDecoderBytes(rr.Body.Bytes(), msgpack.handle).Decode(&body); err != nil {
+		t.Fatalf("expected a MessagePack response but got %v: %x", err, rr.Body.Bytes())
+	}
+	return body
+}
+
+func serveBody(router http.Handler, method, path, contentType, accept string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestProcessMsgpackReceipts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(validReceiptPayload), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := serveBody(router, http.MethodPost, "/receipts/process", "application/msgpack", "application/msgpack", encodeMsgpack(t, payload))
+	id, _ := decodeMsgpack(t, rr)["id"].(string)
+	if rr.Code != http.StatusOK || id == "" {
+		t.Fatalf("expected a 200 with an ID but got %v %x", rr.Code, rr.Body.Bytes())
+	}
+
+	// The receipt reads back as it was sent.
+	rr = serveBody(router, http.MethodGet, "/receipts/"+id, "", "", nil)
+	var stored map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	delete(stored, "id")
+	delete(stored, "_links")
+	if got, want := fmt.Sprint(stored), fmt.Sprint(payload); got != want {
+		t.Errorf("expected the receipt\n%s\nbut got\n%s", want, got)
+	}
+
+	rr = serveBody(router, http.MethodGet, "/receipts/"+id+"/points", "", "application/msgpack", nil)
+	if points := decodeMsgpack(t, rr)["points"]; points != int64(28) {
+		t.Errorf("expected 28 points but got %v", points)
+	}
+
+	// A client that sends MessagePack but accepts JSON gets JSON.
+	rr = serveBody(router, http.MethodPost, "/receipts/process", "application/x-msgpack", "application/json", encodeMsgpack(t, payload))
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK || response.ID == "" {
+		t.Errorf("expected a JSON 200 but got %v %v: %s", rr.Code, rr.Header(), rr.Body.String())
+	}
+}
+
+func TestMsgpackReceiptErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	receipt := func(change func(map[string]any)) map[string]any {
+		var r map[string]any
+		json.Unmarshal([]byte(validReceiptPayload), &r)
+		change(r)
+		return r
+	}
+	// Receipts that fail validation are rejected as they are in JSON, in the
+	// negotiated format.
+	invalid := []map[string]any{
+		receipt(func(r map[string]any) { delete(r, "total") }),
+		receipt(func(r map[string]any) { r["items"] = []any{} }),
+		receipt(func(r map[string]any) { delete(r, "purchaseDate") }),
+		receipt(func(r map[string]any) { r["items"].([]any)[0].(map[string]any)["price"] = "6,49" }),
+	}
+	for _, r := range invalid {
+		asJSON, _ := json.Marshal(r)
+		want := serveBody(router, http.MethodPost, "/receipts/process", "application/json", "", asJSON)
+		var wantBody errorBody
+		json.Unmarshal(want.Body.Bytes(), &wantBody)
+
+		rr := serveBody(router, http.MethodPost, "/receipts/process", "application/msgpack", "application/msgpack", encodeMsgpack(t, r))
+		if got := decodeMsgpack(t, rr)["error"]; rr.Code != want.Code || got != wantBody.Error || wantBody.Error == "" {
+			t.Errorf("expected %v %q as in JSON but got %v %q", want.Code, wantBody.Error, rr.Code, got)
+		}
+	}
+
+	valid := encodeMsgpack(t, receipt(func(map[string]any) {}))
+	testCases := []struct {
+		name     string
+		payload  []byte
+		reason   validationReason
+		contains string
+	}{
+		{"Malformed", []byte{0xc1}, reasonBodyInvalid, "malformed MessagePack"},
+		{"Truncated", valid[:len(valid)/2], reasonBodyInvalid, "malformed MessagePack: it ends early"},
+		{"Empty", nil, reasonBodyInvalid, "it is empty"},
+		{"TwoObjects", append(append([]byte{}, valid...), valid...), reasonBodyInvalid, "more than one MessagePack object"},
+		{"NotAMap", encodeMsgpack(t, []any{"Target"}), reasonBodyInvalid, "the receipt must be a map, not an array"},
+		{"UnknownField", encodeMsgpack(t, receipt(func(r map[string]any) { r["cashier"] = "Sam" })), reasonBodyInvalid, `the receipt has no field "cashier"`},
+		{"NumericPrice", encodeMsgpack(t, receipt(func(r map[string]any) { r["items"].([]any)[1].(map[string]any)["price"] = 12.25 })), reasonItemPriceInvalid, `items[1].price must be a text string, such as "6.49", not a float`},
+		{"Binary", encodeMsgpack(t, receipt(func(r map[string]any) { r["retailer"] = []byte("Target") })), reasonBodyInvalid, "retailer must be a text string, not a byte string"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			failures := `receipt_validation_failures_total{reason="` + string(tc.reason) + `"}`
+			before, _ := scrapeMetrics(t, router)
+			rr := serveBody(router, http.MethodPost, "/receipts/process", "application/msgpack", "application/msgpack", tc.payload)
+			message, _ := decodeMsgpack(t, rr)["error"].(string)
+			if rr.Code != http.StatusBadRequest || !strings.Contains(message, tc.contains) {
+				t.Errorf("expected a 400 containing %q but got %v %q", tc.contains, rr.Code, message)
+			}
+			if after, _ := scrapeMetrics(t, router); after[failures] != before[failures]+1 {
+				t.Errorf("expected the receipt rejected for %s but got %v", tc.reason, after[failures]-before[failures])
+			}
+		})
+	}
+}
+
+// largeReceipt is the canonical receipt with 100 items.
+func largeReceipt() Receipt {
+	receipt := exampleReceipts["target"]
+	items := receipt.Items
+	receipt.Items = nil
+	for i := 0; i < 100; i++ {
+		receipt.Items = append(receipt.Items, items[i%len(items)])
+	}
+	return receipt
+}
+
+// BenchmarkReceiptFormats compares decoding and encoding a 100-item receipt in JSON
+// and MessagePack, reporting the size of each encoding.
+func BenchmarkReceiptFormats(b *testing.B) {
+	receipt := largeReceipt()
+	asJSON, err := json.Marshal(receipt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	formats := []struct {
+		name   string
+		data   []byte
+		format *bodyFormat
+		encode func() ([]byte, error)
+	}{
+		{"JSON", asJSON, jsonFormat, func() ([]byte, error) { return json.Marshal(receipt) }},
+		{"MessagePack", encodeMsgpack(b, receipt), msgpackFormat, func() ([]byte, error) {
+			var data []byte
+			err := codec.NewEncoderBytes(&data, msgpack.handle).Encode(receipt)
+			return data, err
+		}},
+	}
+	for _, f := range formats {
+		b.Run(f.name+"/Decode", func(b *testing.B) {
+			b.SetBytes(int64(len(f.data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.format.decodeReceipt(bytes.NewReader(f.data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(f.data)), "body-bytes")
+		})
+		b.Run(f.name+"/Encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.encode(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(f.data)), "body-bytes")
+		})
+	}
+}
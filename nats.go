@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// The --nats-url events are published to with --event-publisher nats, and the
+// --nats-subject-prefix of their subjects.
+var (
+	natsURL           string
+	natsSubjectPrefix = "fetch"
+)
+
+// parseNATSURL checks raw is a nats:// URL of a server, with a user and password or a
+// token as its user info if the server wants them.
+func parseNATSURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "nats" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("--nats-url %q is not a nats://host:port URL", raw)
+	}
+	return u, nil
+}
+
+// validateNATSSubjectPrefix checks prefix is made of NATS subject tokens, without
+// wildcards, so the subjects events are published to are valid.
+func validateNATSSubjectPrefix(prefix string) error {
+	for _, token := range strings.Split(prefix, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return fmt.Errorf("--nats-subject-prefix %q is not a NATS subject", prefix)
+		}
+	}
+	return nil
+}
+
+// natsPublisher publishes each event to <prefix>.<type> on a NATS server with the
+// nats.go client, with the event ID as its Nats-Msg-Id header that JetStream drops
+// duplicates by, if the server takes headers. It connects on the first event, and
+// again on a later one if that fails; once connected, the client reconnects by
+// itself, holding what is published meanwhile in its reconnect buffer. One connection
+// publishes every event in order, so a receipt's events arrive in order.
+type natsPublisher struct {
+	url    string
+	prefix string
+
+	mu     sync.Mutex
+	conn   *nats.Conn
+	closed bool
+}
+
+func newNATSPublisher(rawURL, prefix string) (*natsPublisher, error) {
+	if _, err := parseNATSURL(rawURL); err != nil {
+		return nil, err
+	}
+	if err := validateNATSSubjectPrefix(prefix); err != nil {
+		return nil, err
+	}
+	return &natsPublisher{url: rawURL, prefix: prefix}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("the NATS publisher is closed")
+	}
+	if p.conn == nil {
+		if p.conn, err = p.connect(); err != nil {
+			return err
+		}
+	}
+	message := &nats.Msg{Subject: p.prefix + "." + event.Type, Data: payload}
+	if p.conn.HeadersSupported() {
+		message.Header = nats.Header{nats.MsgIdHdr: []string{event.ID}}
+	}
+	return p.conn.PublishMsg(message)
+}
+
+// connect connects to the server, logging when the connection is lost and the errors
+// the server sends.
+func (p *natsPublisher) connect() (*nats.Conn, error) {
+	conn, err := nats.Connect(p.url,
+		nats.Name("fetch"),
+		nats.NoEcho(),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("the NATS connection was lost: %v", err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Printf("NATS server error: %v", err)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to NATS: %w", err)
+	}
+	return conn, nil
+}
+
+// Close publishes what the client buffered and closes the connection; nothing can be
+// published afterwards.
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return nil
+}
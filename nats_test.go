@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsConnect is the part of the CONNECT a client answers INFO with that the tests
+// check.
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Name      string `json:"name"`
+	Headers   bool   `json:"headers"`
+	Echo      bool   `json:"echo"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// natsMessage is a message the fake NATS server received.
+type natsMessage struct {
+	subject, header string
+	payload         []byte
+}
+
+// fakeNATS speaks enough of the NATS protocol to take CONNECT, PING, PUB and HPUB. It
+// pings every client once connected, and refuses those without its token.
+type fakeNATS struct {
+	listener net.Listener
+	headers  bool
+	token    string
+	messages chan natsMessage
+	connects chan natsConnect
+	pongs    chan struct{}
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeNATS(t *testing.T, headers bool, token string) *fakeNATS {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATS{listener: listener, headers: headers, token: token,
+		messages: make(chan natsMessage, 100), connects: make(chan natsConnect, 10), pongs: make(chan struct{}, 10)}
+	t.Cleanup(func() {
+		listener.Close()
+		s.disconnect()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// url is the server's URL, with token as its user info if given.
+func (s *fakeNATS) url(token string) string {
+	if token != "" {
+		return "nats://" + token + "@" + s.listener.Addr().String()
+	}
+	return "nats://" + s.listener.Addr().String()
+}
+
+// disconnect closes every client connection.
+func (s *fakeNATS) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"proto\":1,\"headers\":%t,\"max_payload\":1048576}\r\n", s.headers)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		fields := strings.Fields(args)
+		switch op {
+		case "CONNECT":
+			var connect natsConnect
+			json.Unmarshal([]byte(args), &connect)
+			s.connects <- connect
+			if connect.AuthToken != s.token {
+				io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			io.WriteString(conn, "PONG\r\nPING\r\n")
+		case "PONG":
+			s.pongs <- struct{}{}
+		case "PUB", "HPUB":
+			message := natsMessage{subject: fields[0]}
+			headerSize := 0
+			if op == "HPUB" {
+				headerSize, _ = strconv.Atoi(fields[1])
+			}
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			message.header, message.payload = string(data[:headerSize]), data[headerSize:size]
+			s.messages <- message
+		default:
+			io.WriteString(conn, "-ERR 'Unknown Protocol Operation'\r\n")
+			return
+		}
+	}
+}
+
+func (s *fakeNATS) receive(t *testing.T) natsMessage {
+	t.Helper()
+	select {
+	case message := <-s.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return natsMessage{}
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	server := newFakeNATS(t, true, "s3cret")
+	publisher, err := newNATSPublisher(server.url("s3cret"), "fetch.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := usePublisher(t, publisher, eventBufferSize)
+
+	// The events of a receipt arrive in the order they happened.
+	var sent []Event
+	for i := 0; i < 20; i++ {
+		eventType := eventReceiptProcessed
+		if i%2 == 1 {
+			eventType = eventReceiptDeleted
+		}
+		event := newEvent(eventType, eventSubject{ID: "r" + strconv.Itoa(i/2)})
+		sent = append(sent, event)
+		p.send(event)
+	}
+	for _, event := range sent {
+		message := server.receive(t)
+		if message.subject != "fetch.test."+event.Type {
+			t.Errorf("expected the subject fetch.test.%s but got %s", event.Type, message.subject)
+		}
+		if expected := "NATS/1.0\r\nNats-Msg-Id: " + event.ID + "\r\n\r\n"; message.header != expected {
+			t.Errorf("expected the header %q but got %q", expected, message.header)
+		}
+		expected, _ := json.Marshal(event)
+		if string(message.payload) != string(expected) {
+			t.Errorf("expected the payload\n%s\nbut got\n%s", expected, message.payload)
+		}
+	}
+
+	connect := <-server.connects
+	if connect.AuthToken != "s3cret" || !connect.Headers || connect.Echo || connect.Verbose || connect.Name != "fetch" {
+		t.Errorf("expected a CONNECT with the token and headers but got %+v", connect)
+	}
+	select {
+	case <-server.pongs:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the server's PING to be answered")
+	}
+}
+
+func TestNATSPublisherWithoutHeaders(t *testing.T) {
+	server := newFakeNATS(t, false, "")
+	publisher, err := newNATSPublisher(server.url(""), "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	event := newEvent(eventReceiptDeleted, eventSubject{ID: "r1"})
+	if err := publisher.Publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	message := server.receive(t)
+	if message.subject != "fetch.receipt.deleted" || message.header != "" {
+		t.Errorf("expected a PUB to fetch.receipt.deleted but got %q with the header %q", message.subject, message.header)
+	}
+}
+
+func TestNATSPublisherReconnects(t *testing.T) {
+	server := newFakeNATS(t, true, "")
+	publisher, err := newNATSPublisher(server.url(""), "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	if err := publisher.Publish(context.Background(), newEvent(eventReceiptProcessed, eventSubject{ID: "r1"})); err != nil {
+		t.Fatal(err)
+	}
+	server.receive(t)
+	server.disconnect()
+	waitFor(t, "the connection to be lost", func() bool {
+		publisher.mu.Lock()
+		defer publisher.mu.Unlock()
+		return publisher.conn.IsReconnecting()
+	})
+
+	// What is published while reconnecting is sent once the client has reconnected.
+	event := newEvent(eventReceiptDeleted, eventSubject{ID: "r1"})
+	if err := publisher.Publish(context.Background(), event); err != nil {
+		t.Fatalf("expected the event to be held until the client reconnects but got %v", err)
+	}
+	if message := server.receive(t); !strings.Contains(string(message.payload), event.ID) {
+		t.Errorf("expected the event after reconnecting but got %s", message.payload)
+	}
+	if len(server.connects) != 2 {
+		t.Errorf("expected two connections but got %d", len(server.connects))
+	}
+}
+
+func TestNATSPublisherRefused(t *testing.T) {
+	server := newFakeNATS(t, true, "s3cret")
+	publisher, err := newNATSPublisher(server.url("wrong"), "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	err = publisher.Publish(context.Background(), newEvent(eventReceiptProcessed, eventSubject{ID: "r1"}))
+	if !errors.Is(err, nats.ErrAuthorization) {
+		t.Errorf("expected the server's refusal but got %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// enableDocs is --enable-docs, which serves Swagger UI for /openapi.json at /docs.
+var enableDocs bool
+
+// routeDoc describes a route for the OpenAPI document.
+type routeDoc struct {
+	summary string
+	// scope is the scope of the API key or token the route needs: scopeRead,
+	// scopeWrite or scopeAdmin, "metrics" for the metrics credentials, or empty if the
+	// route is open.
+	scope string
+	// request is a value of the type of the JSON request body, if the route takes one.
+	request any
+	// response is a value of the type of the 200 response body, or nil for an object
+	// the document doesn't detail.
+	response any
+	// status is the status of a successful response, 200 if 0. A 204 has no body.
+	status int
+	// responseType is the media type of the response, JSON if empty.
+	responseType string
+	// negotiated routes take receipts in any of the bodyFormats, and respond in any
+	// that encodes.
+	negotiated bool
+	// receiptErrors routes answer invalid receipts and unknown ones with an errorBody,
+	// and their other errors with a problem.
+	receiptErrors bool
+	// errors are the statuses of errors the route answers besides the common ones.
+	errors []int
+	// batch is a value of the type of the 207 response to a batch, if the route
+	// takes batches.
+	batch any
+}
+
+// Response bodies built as gin.H, as the document describes them.
+type (
+	processResponse struct {
+		ID    string        `json:"id"`
+		Links *receiptLinks `json:"_links,omitempty"`
+	}
+	batchResponse struct {
+		Results []batchResult `json:"results"`
+	}
+	receiptResponse struct {
+		Receipt
+		Links *receiptLinks `json:"_links,omitempty"`
+	}
+	pointsResponse struct {
+		Points         int           `json:"points"`
+		RulesVersion   string        `json:"rulesVersion"`
+		ExpiresAt      *time.Time    `json:"expiresAt,omitempty"`
+		Expired        *bool         `json:"expired,omitempty"`
+		OriginalPoints *int          `json:"originalPoints,omitempty"`
+		Links          *receiptLinks `json:"_links,omitempty"`
+	}
+	breakdownResponse struct {
+		Points       int              `json:"points"`
+		Breakdown    []BreakdownEntry `json:"breakdown"`
+		RulesVersion string           `json:"rulesVersion"`
+		Variant      string           `json:"variant,omitempty"`
+		Links        *receiptLinks    `json:"_links,omitempty"`
+	}
+	scanResponse struct {
+		ID      string        `json:"id"`
+		Points  int           `json:"points"`
+		Receipt Receipt       `json:"receipt"`
+		Links   *receiptLinks `json:"_links,omitempty"`
+	}
+	healthResponse struct {
+		Status      string `json:"status"`
+		Maintenance string `json:"maintenance,omitempty"`
+	}
+	versionResponse struct {
+		Version      string `json:"version"`
+		RulesVersion string `json:"rulesVersion"`
+	}
+)
+
+// routeDocs describes every route, by method and path. A route without a description
+// is left out of the document; TestOpenAPICoversRoutes fails if one is.
+var routeDocs = map[string]routeDoc{
+	"GET /health":       {summary: "Report that the process is alive", response: healthResponse{}},
+	"GET /ready":        {summary: "Report whether the server takes requests", response: healthResponse{}, errors: []int{http.StatusServiceUnavailable}},
+	"GET /version":      {summary: "Report the build and rules versions", response: versionResponse{}},
+	"GET /metrics":      {summary: "Prometheus metrics", scope: "metrics", responseType: "text/plain"},
+	"GET /openapi.json": {summary: "This OpenAPI document"},
+	"GET /docs":         {summary: "Swagger UI for this document", responseType: "text/html"},
+	"GET /":             {summary: "A page for submitting and looking up receipts", responseType: "text/html"},
+	"GET /ui/*filepath": {summary: "The scripts and styles of the page at /", responseType: "application/octet-stream", errors: []int{http.StatusNotFound}},
+
+	"POST /receipts/process": {summary: "Score and store a receipt, or a JSON array of them", scope: scopeWrite, request: Receipt{}, response: processResponse{}, negotiated: true, receiptErrors: true, batch: batchResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	"POST /receipts/scan": {summary: "Read, score and store the receipt in a photo", scope: scopeWrite, response: scanResponse{}, receiptErrors: true,
+		errors: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusNotImplemented}},
+	"POST /receipts/preview": {summary: "Score a receipt without storing it", scope: scopeRead, request: Receipt{}, response: breakdownResponse{}, negotiated: true, receiptErrors: true,
+		errors: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	"GET /receipts/stream":                {summary: "Stream the receipts processed as Server-Sent Events", scope: scopeRead, responseType: "text/event-stream", errors: []int{http.StatusServiceUnavailable}},
+	"GET /receipts/:receipt_id":           {summary: "Get a receipt", scope: scopeRead, response: receiptResponse{}, receiptErrors: true, errors: []int{http.StatusNotFound}},
+	"GET /receipts/:receipt_id/points":    {summary: "Get the points of a receipt", scope: scopeRead, response: pointsResponse{}, negotiated: true, receiptErrors: true, errors: []int{http.StatusNotFound, http.StatusGone}},
+	"GET /receipts/:receipt_id/breakdown": {summary: "Explain the points of a receipt", scope: scopeRead, response: breakdownResponse{}, negotiated: true, receiptErrors: true, errors: []int{http.StatusNotFound}},
+	"GET /ws":                             {summary: "Subscribe to receipt events over a WebSocket", scope: scopeRead, status: http.StatusSwitchingProtocols, errors: []int{http.StatusBadRequest, http.StatusUpgradeRequired}},
+	"GET /rules":                          {summary: "Get the scoring rules in effect", scope: scopeRead},
+	"GET /rules/versions":                 {summary: "List the rules versions receipts were scored with", scope: scopeRead},
+
+	"POST /admin/rules/reload":              {summary: "Reload the rules config", scope: scopeAdmin, errors: []int{http.StatusUnprocessableEntity}},
+	"POST /admin/rules/simulate":            {summary: "Score stored receipts with a candidate rules config", scope: scopeAdmin, request: simulationRequest{}, response: simulatedReceipt{}, responseType: "application/x-ndjson", errors: []int{http.StatusBadRequest}},
+	"GET /admin/shadow/summary":             {summary: "Summarize shadow scoring", scope: scopeAdmin, response: shadowSummary{}, errors: []int{http.StatusNotFound}},
+	"GET /admin/experiment/summary":         {summary: "Summarize the rules experiment", scope: scopeAdmin, errors: []int{http.StatusNotFound}},
+	"GET /admin/api-keys":                   {summary: "List the API keys, without their secrets", scope: scopeAdmin},
+	"GET /admin/quotas":                     {summary: "Report the quota and use of each API key", scope: scopeAdmin},
+	"GET /admin/load":                       {summary: "Report the requests in flight and shed", scope: scopeAdmin},
+	"GET /admin/audit":                      {summary: "Export audit events", scope: scopeAdmin},
+	"GET /admin/receipts/export":            {summary: "Export the stored receipts", scope: scopeAdmin, response: exportedReceipt{}, responseType: "application/x-ndjson"},
+	"PATCH /admin/users/:user_id":           {summary: "Set the loyalty tier of a user", scope: scopeAdmin, request: userTierRequest{}, response: userTierResponse{}, errors: []int{http.StatusBadRequest}},
+	"DELETE /admin/users/:user_id/data":     {summary: "Erase the receipts of a user", scope: scopeAdmin},
+	"GET /admin/receipts/:receipt_id/trace": {summary: "Trace how a receipt is scored", scope: scopeAdmin, errors: []int{http.StatusNotFound}},
+	"POST /admin/webhooks":                  {summary: "Subscribe a URL to receipt events", scope: scopeAdmin, request: subscriptionRequest{}, response: subscriptionInfo{}, status: http.StatusCreated, errors: []int{http.StatusBadRequest}},
+	"GET /admin/webhooks":                   {summary: "List the webhook subscriptions, without their secrets", scope: scopeAdmin},
+	"GET /admin/webhooks/deadletter":        {summary: "List the webhook deliveries given up on", scope: scopeAdmin},
+	"POST /admin/webhooks/deadletter":       {summary: "Deliver dead-lettered webhooks again", scope: scopeAdmin, request: redriveRequest{}, errors: []int{http.StatusBadRequest}},
+	"GET /admin/webhooks/:webhook_id":       {summary: "Get a webhook subscription, without its secret", scope: scopeAdmin, response: subscriptionInfo{}, errors: []int{http.StatusNotFound}},
+	"DELETE /admin/webhooks/:webhook_id":    {summary: "Delete a webhook subscription", scope: scopeAdmin, status: http.StatusNoContent, errors: []int{http.StatusNotFound}},
+	"POST /admin/webhooks/:webhook_id/test": {summary: "Send a test event to a webhook subscription", scope: scopeAdmin, errors: []int{http.StatusNotFound, http.StatusBadGateway}},
+	"GET /admin/maintenance":                {summary: "Report whether the service is read-only", scope: scopeAdmin, response: maintenanceState{}},
+	"POST /admin/maintenance":               {summary: "Turn read-only maintenance on or off", scope: scopeAdmin, request: maintenanceState{}, response: maintenanceState{}, errors: []int{http.StatusBadRequest}},
+	"GET /debug/pprof/*profile":             {summary: "Get a pprof profile", scope: scopeAdmin, responseType: "application/octet-stream"},
+	"POST /debug/pprof/symbol":              {summary: "Look up program counters", scope: scopeAdmin, responseType: "text/plain"},
+	"GET /debug/vars":                       {summary: "Report memory statistics", scope: scopeAdmin},
+}
+
+// openAPIDocument serves the OpenAPI document of the routes of a router, built from
+// routeDocs and the Go types of the bodies once the routes are registered.
+type openAPIDocument struct {
+	data []byte
+}
+
+// build describes routes.
+func (d *openAPIDocument) build(routes gin.RoutesInfo) {
+	// The document is maps, slices, strings and numbers, which always encode.
+	d.data, _ = json.Marshal(newOpenAPI(routes))
+}
+
+func (d *openAPIDocument) serve(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", d.data)
+}
+
+// newOpenAPI returns the OpenAPI 3.0 document of the routes routeDocs describes.
+func newOpenAPI(routes gin.RoutesInfo) map[string]any {
+	b := &schemaBuilder{schemas: map[string]any{}}
+	paths := map[string]any{}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	for _, route := range routes {
+		doc, ok := routeDocs[route.Method+" "+route.Path]
+		if !ok {
+			continue
+		}
+		path, params := openAPIPath(route.Path)
+		operations, _ := paths[path].(map[string]any)
+		if operations == nil {
+			operations = map[string]any{}
+			paths[path] = operations
+		}
+		operations[strings.ToLower(route.Method)] = b.operation(route.Method, route.Path, doc, params)
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Receipt Processor",
+			"description": "Scores receipts by the points rules. Without --api-keys-file, --jwks-url or --introspection-url the API endpoints are open.",
+			"version":     version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]any{
+				"apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "A JWT from the identity provider, an opaque client credentials token, or for the admin endpoints the --admin-token."},
+				"basicAuth":  map[string]any{"type": "http", "scheme": "basic", "description": "The --metrics-username and --metrics-password, if set."},
+			},
+		},
+	}
+}
+
+// openAPIPath converts a gin path to an OpenAPI one, returning the names of its
+// parameters.
+func openAPIPath(path string) (string, []string) {
+	segments := strings.Split(path, "/")
+	var params []string
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func (b *schemaBuilder) operation(method, path string, doc routeDoc, params []string) map[string]any {
+	operation := map[string]any{
+		"summary":     doc.summary,
+		"operationId": operationID(method, path),
+		"responses":   b.responses(doc, method == http.MethodGet && jsonAPIRoutes[path]),
+	}
+	if tag, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/"); tag != "" {
+		operation["tags"] = []string{tag}
+	}
+	var parameters []any
+	for _, name := range params {
+		parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	if parameters != nil {
+		operation["parameters"] = parameters
+	}
+	switch doc.scope {
+	case "":
+		operation["security"] = []any{}
+	case "metrics":
+		operation["security"] = []any{map[string]any{"basicAuth": []string{}}, map[string]any{}}
+	default:
+		operation["security"] = []any{map[string]any{"apiKey": []string{}}, map[string]any{"bearerAuth": []string{}}}
+		operation["description"] = "Needs the `" + doc.scope + "` scope."
+	}
+
+	switch {
+	case method+" "+path == "POST /receipts/scan":
+		operation["requestBody"] = map[string]any{"required": true, "content": map[string]any{uploadMediaType: map[string]any{"schema": map[string]any{
+			"type":     "object",
+			"required": []string{scanImageField},
+			"properties": map[string]any{
+				scanImageField:   map[string]any{"type": "string", "format": "binary", "description": "A JPEG or PNG photo of the receipt."},
+				scanSidecarField: map[string]any{"type": "string", "format": "binary", "description": "The receipt as JSON, read by --extractor fake in place of the photo."},
+			},
+		}}}}
+	case doc.request != nil:
+		schema := b.schema(reflect.TypeOf(doc.request))
+		content := map[string]any{gin.MIMEJSON: map[string]any{"schema": schema}}
+		if doc.negotiated {
+			for _, mediaType := range receiptMediaTypes() {
+				content[mediaType] = map[string]any{"schema": schema}
+			}
+			if doc.batch != nil {
+				content[gin.MIMEJSON] = map[string]any{"schema": map[string]any{"oneOf": []any{schema, map[string]any{"type": "array", "items": schema}}}}
+			}
+			content[uploadMediaType] = map[string]any{"schema": map[string]any{
+				"type":       "object",
+				"required":   []string{uploadField},
+				"properties": map[string]any{uploadField: map[string]any{"type": "string", "format": "binary", "description": "The receipt as a JSON file."}},
+			}}
+		}
+		operation["requestBody"] = map[string]any{"required": true, "content": content}
+	}
+	return operation
+}
+
+// operationID names an operation by its method and path, such as
+// getReceiptsReceiptIdPoints.
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// responses describes the responses of a route, in JSON:API too for jsonAPI ones.
+func (b *schemaBuilder) responses(doc routeDoc, jsonAPI bool) map[string]any {
+	schema := map[string]any{"type": "object"}
+	if doc.response != nil {
+		schema = b.schema(reflect.TypeOf(doc.response))
+	}
+	content := map[string]any{}
+	switch {
+	case doc.responseType == "text/plain", doc.responseType == "text/html", doc.responseType == "application/octet-stream":
+		content[doc.responseType] = map[string]any{"schema": map[string]any{"type": "string"}}
+	case doc.responseType != "":
+		content[doc.responseType] = map[string]any{"schema": schema}
+	case doc.negotiated:
+		for _, mediaType := range responseMediaTypes() {
+			content[mediaType] = map[string]any{"schema": schema}
+		}
+	default:
+		content[gin.MIMEJSON] = map[string]any{"schema": schema}
+	}
+	if jsonAPI {
+		content[jsonAPIMediaType] = map[string]any{"schema": b.schema(reflect.TypeOf(jsonAPIDocument{}))}
+	}
+	status, success := http.StatusOK, map[string]any{"description": "OK", "content": content}
+	if doc.status != 0 {
+		status, success["description"] = doc.status, http.StatusText(doc.status)
+	}
+	if status == http.StatusNoContent || status == http.StatusSwitchingProtocols {
+		delete(success, "content")
+	}
+	responses := map[string]any{
+		strconv.Itoa(status): success,
+		"default":            b.errorResponse("An error", problem{}),
+	}
+	if doc.batch != nil {
+		responses["207"] = map[string]any{"description": "The result of each receipt of a batch", "content": map[string]any{
+			gin.MIMEJSON: map[string]any{"schema": b.schema(reflect.TypeOf(doc.batch))},
+		}}
+	}
+	statuses := append([]int{}, doc.errors...)
+	if doc.scope != "" {
+		statuses = append(statuses, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests)
+	}
+	for _, status := range statuses {
+		bodies := []any{problem{}}
+		switch {
+		case status == http.StatusTooManyRequests:
+			bodies = []any{limitProblem{}}
+		case doc.receiptErrors && (status == http.StatusBadRequest || status == http.StatusNotFound):
+			bodies = append(bodies, errorBody{})
+		}
+		if jsonAPI {
+			bodies = append(bodies, jsonAPIDocument{})
+		}
+		responses[strconv.Itoa(status)] = b.errorResponse(http.StatusText(status), bodies...)
+	}
+	return responses
+}
+
+// errorResponse describes an error response with any of bodies, each in its media
+// type.
+func (b *schemaBuilder) errorResponse(description string, bodies ...any) map[string]any {
+	content := map[string]any{}
+	for _, body := range bodies {
+		mediaType := "application/problem+json"
+		switch body.(type) {
+		case errorBody:
+			mediaType = gin.MIMEJSON
+		case jsonAPIDocument:
+			mediaType = jsonAPIMediaType
+		}
+		content[mediaType] = map[string]any{"schema": b.schema(reflect.TypeOf(body))}
+	}
+	return map[string]any{"description": description, "content": content}
+}
+
+// schemaBuilder describes Go types as OpenAPI schemas, collecting the named structs in
+// schemas to refer to.
+type schemaBuilder struct {
+	schemas map[string]any
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema describes values of t as encoding/json encodes them.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		name := []rune(t.Name())
+		name[0] = unicode.ToUpper(name[0])
+		if _, ok := b.schemas[string(name)]; !ok {
+			// Claim the name first, for types that refer to themselves.
+			b.schemas[string(name)] = nil
+			b.schemas[string(name)] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + string(name)}
+	}
+	return map[string]any{}
+}
+
+// object describes the fields of the struct t, and those of the structs it embeds.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	var add func(reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if field.Anonymous && tag == "" {
+				add(field.Type)
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = b.schema(field.Type)
+			if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+	object := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		object["required"] = required
+	}
+	return object
+}
+
+// swaggerUIPage loads Swagger UI for /openapi.json from a CDN.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Receipt Processor API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// serveDocs serves Swagger UI, with --enable-docs.
+func serveDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getOpenAPI returns the document router serves at /openapi.json.
+func getOpenAPI(t *testing.T, router http.Handler) map[string]any {
+	t.Helper()
+	rr := serveBody(router, http.MethodGet, "/openapi.json", "", "", nil)
+	var doc map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected an OpenAPI document but got %v %v: %s", rr.Code, err, rr.Body.String())
+	}
+	return doc
+}
+
+// lookup follows keys through nested objects of doc, returning nil if one is missing.
+func lookup(doc any, keys ...string) any {
+	for _, key := range keys {
+		object, ok := doc.(map[string]any)
+		if !ok {
+			return nil
+		}
+		doc = object[key]
+	}
+	return doc
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(pprof, docs, ui bool) { enablePprof, enableDocs, enableUI = pprof, docs, ui }(enablePprof, enableDocs, enableUI)
+	enablePprof, enableDocs, enableUI = true, true, true
+	router := newRouter()
+	doc := getOpenAPI(t, router)
+
+	registered := map[string]bool{}
+	for _, route := range router.Routes() {
+		registered[route.Method+" "+route.Path] = true
+		path, _ := openAPIPath(route.Path)
+		if lookup(doc, "paths", path, strings.ToLower(route.Method)) == nil {
+			t.Errorf("expected %s %s in /openapi.json; describe it in routeDocs", route.Method, route.Path)
+		}
+	}
+	for route := range routeDocs {
+		if !registered[route] {
+			t.Errorf("expected a route for %s, which routeDocs describes", route)
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	doc := getOpenAPI(t, newRouter())
+
+	if doc["openapi"] != "3.0.3" || lookup(doc, "info", "version") != version {
+		t.Errorf("expected an OpenAPI 3.0 document of version %s but got %v %v", version, doc["openapi"], doc["info"])
+	}
+	if lookup(doc, "paths", "/docs") != nil {
+		t.Error("expected no /docs without --enable-docs")
+	}
+
+	// Schemas are built from the Go types, with only the fields they encode.
+	receipt := lookup(doc, "components", "schemas", "Receipt")
+	if got := lookup(receipt, "required"); !equalJSON(got, []string{"retailer", "total", "items", "purchaseDate", "purchaseTime"}) {
+		t.Errorf("expected the required fields of a receipt but got %v", got)
+	}
+	if lookup(receipt, "properties", "timezone") == nil || lookup(receipt, "properties", "ProcessedAt") != nil {
+		t.Errorf("expected the encoded fields of a receipt but got %v", lookup(receipt, "properties"))
+	}
+	if got := lookup(doc, "components", "schemas", "Item", "properties", "upc", "type"); got != "string" {
+		t.Errorf("expected a string upc but got %v", got)
+	}
+	// Embedded structs are flattened.
+	if lookup(doc, "components", "schemas", "LimitProblem", "properties", "code") == nil || lookup(doc, "components", "schemas", "LimitProblem", "properties", "resetAt", "format") != "date-time" {
+		t.Errorf("expected the fields of a limit problem but got %v", lookup(doc, "components", "schemas", "LimitProblem"))
+	}
+
+	process := lookup(doc, "paths", "/receipts/process", "post")
+	for _, mediaType := range []string{"application/json", "application/x-protobuf", "multipart/form-data"} {
+		if lookup(process, "requestBody", "content", mediaType) == nil {
+			t.Errorf("expected receipts submitted as %s", mediaType)
+		}
+	}
+	if got := lookup(process, "responses", "200", "content", "application/json", "schema", "$ref"); got != "#/components/schemas/ProcessResponse" {
+		t.Errorf("expected a ProcessResponse but got %v", got)
+	}
+	if got := lookup(process, "responses", "400", "content", "application/json", "schema", "$ref"); got != "#/components/schemas/ErrorBody" {
+		t.Errorf("expected invalid receipts answered with an ErrorBody but got %v", got)
+	}
+	if got := lookup(process, "responses", "429", "content", "application/problem+json", "schema", "$ref"); got != "#/components/schemas/LimitProblem" {
+		t.Errorf("expected limits answered with a LimitProblem but got %v", got)
+	}
+	if got := lookup(doc, "paths", "/receipts/{receipt_id}/points", "get", "parameters"); !equalJSON(got, []any{map[string]any{"name": "receipt_id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}}) {
+		t.Errorf("expected the receipt ID as a path parameter but got %v", got)
+	}
+
+	// Open routes need no credentials, and the others an API key or a token.
+	if got := lookup(doc, "paths", "/health", "get", "security"); !equalJSON(got, []any{}) {
+		t.Errorf("expected /health open but got %v", got)
+	}
+	if got := lookup(process, "security"); !equalJSON(got, []any{map[string]any{"apiKey": []any{}}, map[string]any{"bearerAuth": []any{}}}) {
+		t.Errorf("expected an API key or bearer token but got %v", got)
+	}
+	if lookup(doc, "components", "securitySchemes", "apiKey", "name") != "X-API-Key" {
+		t.Errorf("expected the X-API-Key scheme but got %v", lookup(doc, "components", "securitySchemes"))
+	}
+}
+
+func equalJSON(got, want any) bool {
+	a, _ := json.Marshal(got)
+	b, _ := json.Marshal(want)
+	return string(a) == string(b)
+}
+
+func TestServeDocs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(previous bool) { enableDocs = previous }(enableDocs)
+	enableDocs = true
+	rr := serveBody(newRouter(), http.MethodGet, "/docs", "", "", nil)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") || !strings.Contains(rr.Body.String(), `url: "/openapi.json"`) {
+		t.Errorf("expected Swagger UI for /openapi.json but got %v %s", rr.Code, rr.Body.String())
+	}
+}
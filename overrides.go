@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RetailerOverride changes the rules for receipts from matching retailers. It matches
+// either by Name or by Pattern, a regular expression that must match the whole name.
+// Both are compared with the retailer name trimmed, with internal whitespace collapsed
+// and case ignored. Parameters that are omitted keep the value of the base config.
+//
+// Overrides are tried in order and the first match wins, so a specific override
+// should come before a broader pattern it overlaps with.
+type RetailerOverride struct {
+	Name    string `json:"name,omitempty" yaml:"name"`
+	Pattern string `json:"pattern,omitempty" yaml:"pattern"`
+
+	MinimumTotalCents     *int64   `json:"minimumTotalCents,omitempty" yaml:"minimumTotalCents"`
+	RoundTotalPoints      *int     `json:"roundTotalPoints,omitempty" yaml:"roundTotalPoints"`
+	QuarterMultiplePoints *int     `json:"quarterMultiplePoints,omitempty" yaml:"quarterMultiplePoints"`
+	ItemPairPoints        *int     `json:"itemPairPoints,omitempty" yaml:"itemPairPoints"`
+	DescriptionMultiplier *float64 `json:"descriptionMultiplier,omitempty" yaml:"descriptionMultiplier"`
+	OddDayPoints          *int     `json:"oddDayPoints,omitempty" yaml:"oddDayPoints"`
+	// AfternoonBonus replaces the fields of the base window that are set. An override
+	// that sets either bound also decides whether the window crosses midnight.
+	AfternoonBonus *TimeWindow `json:"afternoonBonus,omitempty" yaml:"afternoonBonus"`
+
+	// EnableRules turns on rules, such as custom rules, that the base config leaves
+	// off. DisableRules turns rules off for the matching retailers.
+	EnableRules  []string `json:"enableRules,omitempty" yaml:"enableRules"`
+	DisableRules []string `json:"disableRules,omitempty" yaml:"disableRules"`
+}
+
+// normalizeRetailer returns the form of a retailer name that overrides are matched
+// against.
+func normalizeRetailer(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// label describes the override in the breakdown.
+func (o RetailerOverride) label() string {
+	if o.Pattern != "" {
+		return fmt.Sprintf("pattern %q", o.Pattern)
+	}
+	return fmt.Sprintf("name %q", o.Name)
+}
+
+// compilePattern returns the regular expression an override with a Pattern matches
+// normalized names with.
+func (o RetailerOverride) compilePattern() (*regexp.Regexp, error) {
+	return regexp.Compile(`(?i)^(?:` + o.Pattern + `)$`)
+}
+
+// apply returns config with the override's parameters and rule changes applied. The
+// result has no overrides of its own.
+func (o RetailerOverride) apply(config RulesConfig) RulesConfig {
+	config.Retailers = nil
+	if o.MinimumTotalCents != nil {
+		config.MinimumTotalCents = *o.MinimumTotalCents
+	}
+	if o.RoundTotalPoints != nil {
+		config.RoundTotalPoints = *o.RoundTotalPoints
+	}
+	if o.QuarterMultiplePoints != nil {
+		config.QuarterMultiplePoints = *o.QuarterMultiplePoints
+	}
+	if o.ItemPairPoints != nil {
+		config.ItemPairPoints = *o.ItemPairPoints
+	}
+	if o.DescriptionMultiplier != nil {
+		config.DescriptionMultiplier = *o.DescriptionMultiplier
+	}
+	if o.OddDayPoints != nil {
+		config.OddDayPoints = *o.OddDayPoints
+	}
+	if window := o.AfternoonBonus; window != nil {
+		if window.Start != "" {
+			config.AfternoonBonus.Start = window.Start
+		}
+		if window.End != "" {
+			config.AfternoonBonus.End = window.End
+		}
+		if window.Points != 0 {
+			config.AfternoonBonus.Points = window.Points
+		}
+		if window.Start != "" || window.End != "" {
+			config.AfternoonBonus.CrossesMidnight = window.CrossesMidnight
+		}
+	}
+
+	// Copy the lists so the base config is left alone.
+	disabled := make([]string, 0, len(config.DisabledRules)+len(o.DisableRules))
+	for _, name := range config.DisabledRules {
+		if !containsString(o.EnableRules, name) {
+			disabled = append(disabled, name)
+		}
+	}
+	config.DisabledRules = append(disabled, o.DisableRules...)
+	if len(config.EnabledRules) > 0 {
+		config.EnabledRules = append(append([]string(nil), config.EnabledRules...), o.EnableRules...)
+	}
+	return config
+}
+
+// validateRetailerOverride returns the first invalid field of o, relative to the
+// override, given the base config and the names of all rules.
+func validateRetailerOverride(config RulesConfig, o RetailerOverride, known []string) (field, msg string) {
+	if (o.Name == "") == (o.Pattern == "") {
+		return "", "needs either a name or a pattern"
+	}
+	if o.Pattern != "" {
+		if _, err := o.compilePattern(); err != nil {
+			return "pattern", "is invalid: " + strings.TrimPrefix(err.Error(), "error parsing regexp: ")
+		}
+	}
+
+	lists := []struct {
+		field string
+		names []string
+	}{
+		{"enableRules", o.EnableRules},
+		{"disableRules", o.DisableRules},
+	}
+	for _, list := range lists {
+		for _, name := range list.names {
+			if !containsString(known, name) {
+				return list.field, fmt.Sprintf("names unknown rule %q (known rules: %s)", name, strings.Join(known, ", "))
+			}
+		}
+	}
+
+	// The base config is valid, so anything wrong with the result comes from a field
+	// the override sets.
+	return validateRulesConfig(o.apply(config))
+}
+
+// retailerOverride is an override with the engine that scores matching receipts.
+type retailerOverride struct {
+	definition RetailerOverride
+	pattern    *regexp.Regexp
+	engine     *Engine
+}
+
+// matches reports whether the override applies to a retailer name.
+func (o *retailerOverride) matches(retailer string) bool {
+	normalized := normalizeRetailer(retailer)
+	if o.pattern != nil {
+		return o.pattern.MatchString(normalized)
+	}
+	return normalized == normalizeRetailer(o.definition.Name)
+}
+
+// retailerOverrides builds the overrides of config, which must have been validated.
+func retailerOverrides(config RulesConfig) []*retailerOverride {
+	var overrides []*retailerOverride
+	for _, definition := range config.Retailers {
+		override := &retailerOverride{definition: definition, engine: newEngine(definition.apply(config))}
+		if definition.Pattern != "" {
+			override.pattern, _ = definition.compilePattern()
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const retailerOverridesConfig = `
+customRules:
+  - name: weekend
+    expression: dayOfWeek == 0 || dayOfWeek == 6
+    points: 5
+disabledRules: [weekend]
+retailers:
+  - name: "  TARGET "
+    itemPairPoints: 10
+    enableRules: [weekend]
+  - pattern: "walmart( supercenter)?"
+    oddDayPoints: 0
+    afternoonBonus:
+      start: "13:00"
+  - pattern: "wal.*"
+    roundTotalPoints: 0
+`
+
+func TestRetailerOverrides(t *testing.T) {
+	config, err := loadRulesConfig(writeConfig(t, "rules.yaml", retailerOverridesConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withRetailer := func(retailer string) Receipt {
+		receipt := exampleReceipts["target"]
+		receipt.Retailer = retailer
+		return receipt
+	}
+
+	testCases := []struct {
+		name           string
+		receipt        Receipt
+		expectedPoints int
+		expectedDetail string
+	}{
+		// 28 by default, plus 2 pairs at 5 more points each and the weekend bonus.
+		{name: "MatchingName", receipt: exampleReceipts["target"], expectedPoints: 28 + 10 + 5, expectedDetail: `"Target" matched the retailer override with name "  TARGET "`},
+		{name: "CaseAndWhitespace", receipt: withRetailer("  target  "), expectedPoints: 28 + 10 + 5, expectedDetail: `"  target  " matched the retailer override with name "  TARGET "`},
+		{name: "NonMatching", receipt: withRetailer("Targetx"), expectedPoints: 28 + 1},
+		{name: "OtherExample", receipt: exampleReceipts["m&m"], expectedPoints: 109},
+		// 18 for the name and 10 for the 13:01 purchase in the moved window, but no
+		// 6 for the odd day. The broader pattern below isn't used.
+		{name: "Pattern", receipt: withRetailer("Walmart  Supercenter"), expectedPoints: 28 - 6 + 18 - 6 + 10, expectedDetail: `"Walmart  Supercenter" matched the retailer override with pattern "walmart( supercenter)?"`},
+		{name: "PatternMatchesWholeName", receipt: withRetailer("Walmart Supercenter Express"), expectedPoints: 28 - 6 + 25, expectedDetail: `"Walmart Supercenter Express" matched the retailer override with pattern "wal.*"`},
+		{name: "NoPatternMatch", receipt: withRetailer("The Walmart"), expectedPoints: 28 - 6 + 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			points, breakdown := scoreReceipt(tc.receipt, config)
+			if points != tc.expectedPoints {
+				t.Errorf("expected %v points but got %v: %+v", tc.expectedPoints, points, breakdown)
+			}
+
+			applied := breakdown[0].Rule == "retailer_override"
+			if applied != (tc.expectedDetail != "") {
+				t.Fatalf("expected an override to apply: %v, but got breakdown %+v", tc.expectedDetail != "", breakdown)
+			}
+			if applied && breakdown[0].Detail != tc.expectedDetail {
+				t.Errorf("expected detail %q but got %q", tc.expectedDetail, breakdown[0].Detail)
+			}
+		})
+	}
+
+	// The base config is unchanged by the overrides built from it.
+	if len(config.DisabledRules) != 1 || config.ItemPairPoints != 5 {
+		t.Errorf("expected the base config to be left alone but got %+v", config)
+	}
+}
+
+func TestRetailerOverrideConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			name:     "NameAndPattern",
+			contents: "retailers:\n  - name: Target\n    pattern: target.*\n",
+			expected: "rules.yaml:2: retailers[0] needs either a name or a pattern",
+		},
+		{
+			name:     "Neither",
+			contents: "retailers:\n  - name: Target\n  - itemPairPoints: 10\n",
+			expected: "rules.yaml:3: retailers[1] needs either a name or a pattern",
+		},
+		{
+			name:     "BadPattern",
+			contents: "retailers:\n  - pattern: \"(target\"\n",
+			expected: "rules.yaml:2: retailers[0].pattern is invalid: missing closing ): `(?i)^(?:(target)$`",
+		},
+		{
+			name:     "NegativePoints",
+			contents: "retailers:\n  - name: Target\n    itemPairPoints: -10\n",
+			expected: "rules.yaml:3: retailers[0].itemPairPoints must not be negative",
+		},
+		{
+			name:     "WindowAgainstBase",
+			contents: "retailers:\n  - name: Target\n    afternoonBonus:\n      start: \"17:00\"\n",
+			expected: "rules.yaml:3: retailers[0].afternoonBonus.end 16:00 must be after start 17:00",
+		},
+		{
+			name:     "UnknownRule",
+			contents: "retailers:\n  - name: Target\n    disableRules: [odd_days]\n",
+			expected: `rules.yaml:3: retailers[0].disableRules names unknown rule "odd_days" (known rules: retailer_name, round_total, quarter_multiple, item_pairs, description_length, odd_day, afternoon_purchase, day_of_week, holiday, sku_bonus, prompt_submission, item_count)`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "rules.yaml", tc.contents)
+			_, err := loadRulesConfig(path)
+			if err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+			if got := strings.TrimPrefix(err.Error(), filepath.Dir(path)+string(filepath.Separator)); got != tc.expected {
+				t.Errorf("expected error %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
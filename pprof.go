@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/gin-gonic/gin"
+)
+
+// enablePprof is --enable-pprof, which serves the net/http/pprof profiles and
+// /debug/vars next to the /admin endpoints, behind the same checks.
+var enablePprof bool
+
+// addDebugRoutes adds /debug/pprof and /debug/vars to router if --enable-pprof is given.
+func addDebugRoutes(router *gin.Engine) {
+	if !enablePprof {
+		return
+	}
+	debug := router.Group("/debug", adminGuards()...)
+	debug.GET("/pprof/*profile", servePprof)
+	// pprof.Symbol looks up the addresses in a POST body too.
+	debug.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/vars", debugVarsHandler)
+}
+
+// servePprof serves the pprof index and the profile it names, such as heap or goroutine.
+func servePprof(c *gin.Context) {
+	switch c.Param("profile") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// Index serves the named profiles itself, from the path after /debug/pprof/.
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// debugVarsHandler reports the memory figures of runtime.MemStats worth watching for
+// growth, with the number of goroutines and receipts stored.
+func debugVarsHandler(c *gin.Context) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	receiptsMu.RLock()
+	stored := len(receipts)
+	receiptsMu.RUnlock()
+	c.JSON(http.StatusOK, gin.H{
+		"goroutines":     runtime.NumGoroutine(),
+		"receiptsStored": stored,
+		"memstats": gin.H{
+			"heapAlloc":    stats.HeapAlloc,
+			"heapInuse":    stats.HeapInuse,
+			"heapObjects":  stats.HeapObjects,
+			"heapSys":      stats.HeapSys,
+			"stackInuse":   stats.StackInuse,
+			"sys":          stats.Sys,
+			"totalAlloc":   stats.TotalAlloc,
+			"mallocs":      stats.Mallocs,
+			"frees":        stats.Frees,
+			"numGC":        stats.NumGC,
+			"pauseTotalNs": stats.PauseTotalNs,
+			"nextGC":       stats.NextGC,
+		},
+	})
+}
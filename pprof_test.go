@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(previous bool) { enablePprof = previous }(enablePprof)
+	defer func(previous string) { adminToken = previous }(adminToken)
+	get := func(router *gin.Engine, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	enablePprof = false
+	router := newRouter()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/vars"} {
+		if rr := get(router, path, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected %s to be 404 while disabled but got %v", path, rr.Code)
+		}
+	}
+
+	enablePprof = true
+	adminToken = "s3cret"
+	router = newRouter()
+	if rr := get(router, "/debug/pprof/heap", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the profiles to require the admin token but got %v", rr.Code)
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap?debug=1", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		if rr := get(router, path, "s3cret"); rr.Code != http.StatusOK || rr.Body.Len() == 0 {
+			t.Errorf("expected %s to respond with a profile but got %v", path, rr.Code)
+		}
+	}
+	rr := get(router, "/debug/vars", "s3cret")
+	var vars struct {
+		Goroutines     int            `json:"goroutines"`
+		ReceiptsStored *int           `json:"receiptsStored"`
+		MemStats       map[string]int `json:"memstats"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &vars); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected the debug vars but got %v %s", rr.Code, rr.Body.String())
+	}
+	if vars.Goroutines == 0 || vars.ReceiptsStored == nil || vars.MemStats["heapAlloc"] == 0 {
+		t.Errorf("expected goroutines, receipts stored and heap statistics but got %s", rr.Body.String())
+	}
+
+	// With an admin listener they move there, with /admin.
+	defer func(previous string) { adminAddr = previous }(adminAddr)
+	adminAddr = "127.0.0.1:0"
+	if rr := get(newRouter(), "/debug/vars", "s3cret"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected /debug/vars to be 404 on the main listener but got %v", rr.Code)
+	}
+	if rr := get(newAdminRouter(), "/debug/vars", "s3cret"); rr.Code != http.StatusOK {
+		t.Errorf("expected /debug/vars on the admin listener but got %v", rr.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// problem is an RFC 7807 problem details body. Code is a stable machine-readable
+// identifier clients can switch on without parsing Detail.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code,omitempty"`
+	// RequestID is the X-Request-ID of the request, for support tickets.
+	RequestID string `json:"requestId,omitempty"`
+	// IncidentCode names the kind of server error of a 5xx, the same for every
+	// occurrence, so reports of it can be grouped.
+	IncidentCode string `json:"incidentCode,omitempty"`
+}
+
+// internalErrorDetail replaces the detail of 500 problems, which can name internals.
+const internalErrorDetail = "the request failed on our side; quote the requestId when reporting it"
+
+// newProblem returns the problem body for a response to c. The code is kept as
+// "errorCode" for the request log. A 5xx is logged with its detail and the request ID
+// and given an incidentCode. The detail of a 500, an internal failure such as a panic
+// or a broken store, is logged instead of being returned; other 5xx, such as a 503 in
+// maintenance, keep theirs, since it tells the client what to do.
+func newProblem(c *gin.Context, status int, code, detail string) problem {
+	c.Set("errorCode", code)
+	body := problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Code:      code,
+		RequestID: c.GetString("requestID"),
+	}
+	if status >= http.StatusInternalServerError {
+		logRequestf(c, "%s %s failed with %s: %s", c.Request.Method, route(c), code, detail)
+		body.IncidentCode = code
+		if status == http.StatusInternalServerError {
+			body.Detail = internalErrorDetail
+		}
+	}
+	return body
+}
+
+// abortWithProblem stops the handler chain and responds with a problem details body,
+// or a JSON:API error to clients that asked for JSON:API.
+func abortWithProblem(c *gin.Context, status int, code, detail string) {
+	if jsonAPIRequested(c) {
+		abortWithJSONAPIError(c, newProblem(c, status, code, detail), nil)
+		return
+	}
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(status, newProblem(c, status, code, detail))
+}
+
+// errorBody is the {"error": message} body the receipt endpoints have always answered
+// errors with, which clients already parse.
+type errorBody struct {
+	Error     string `json:"error"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// abortWithError stops the handler chain and responds with an errorBody, in the
+// format negotiateFormats chose. The code isn't in the body but is kept as
+// "errorCode" for the request log. Clients that asked for JSON:API get a JSON:API
+// error with the code.
+func abortWithError(c *gin.Context, status int, code, message string) {
+	if jsonAPIRequested(c) {
+		abortWithJSONAPIError(c, newProblem(c, status, code, message), nil)
+		return
+	}
+	c.Set("errorCode", code)
+	c.Abort()
+	body := gin.H{"error": message}
+	if requestID := c.GetString("requestID"); requestID != "" {
+		body["requestId"] = requestID
+	}
+	respond(c, status, body)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestErrorResponsesCarryRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	logs := captureLogs(t)
+	router := newRouter()
+	router.GET("/panic", func(c *gin.Context) { panic("receipt store corrupted") })
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		payload        string
+		expectedStatus int
+	}{
+		{"invalid receipt", http.MethodPost, "/receipts/process", `{"retailer": "Target"}`, http.StatusBadRequest},
+		{"unknown receipt", http.MethodGet, "/receipts/unknown/points", "", http.StatusNotFound},
+		{"panic", http.MethodGet, "/panic", "", http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-ID", "id-"+strings.ReplaceAll(tc.name, " ", "-"))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tc.expectedStatus {
+			t.Fatalf("%s: expected status %v but got %v: %s", tc.name, tc.expectedStatus, rr.Code, rr.Body.String())
+		}
+		var body struct {
+			RequestID    string `json:"requestId"`
+			IncidentCode string `json:"incidentCode"`
+			Detail       string `json:"detail"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: expected a JSON body but got %q", tc.name, rr.Body.String())
+		}
+		if body.RequestID != req.Header.Get("X-Request-ID") {
+			t.Errorf("%s: expected requestId %q but got %s", tc.name, req.Header.Get("X-Request-ID"), rr.Body.String())
+		}
+		if tc.expectedStatus < http.StatusInternalServerError {
+			continue
+		}
+		if body.IncidentCode != "UNHANDLED_PANIC" || body.Detail != internalErrorDetail {
+			t.Errorf("%s: expected a generic UNHANDLED_PANIC incident but got %s", tc.name, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), "corrupted") || strings.Contains(rr.Body.String(), "goroutine") {
+			t.Errorf("%s: expected no panic details in the response but got %s", tc.name, rr.Body.String())
+		}
+	}
+
+	// The stack of the panic is logged with the request ID the client was given.
+	if entry := findPanicLog(requestLogs(t, logs), "/panic"); entry == nil ||
+		entry["request_id"] != "id-panic" || !strings.Contains(fmt.Sprint(entry["stack"]), "goroutine") {
+		t.Errorf("expected the panic and its stack to be logged with the request ID but got %v", entry)
+	}
+	if entry := findRequestLog(requestLogs(t, logs), http.MethodGet, "/panic", http.StatusInternalServerError); entry == nil ||
+		entry["request_id"] != "id-panic" || entry["error_code"] != "UNHANDLED_PANIC" {
+		t.Errorf("expected the request log to link the incident to the request ID but got %v", entry)
+	}
+}
+
+func TestUnavailableProblemsKeepTheirDetail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newRouter()
+	readOnly.Store(true)
+	t.Cleanup(func() { readOnly.Store(false) })
+
+	// A 503 tells the client why and when to come back, unlike an internal failure.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(validReceiptPayload))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(rr, req)
+	var body problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusServiceUnavailable || body.IncidentCode != "READ_ONLY" || !strings.Contains(body.Detail, "read-only for maintenance") {
+		t.Errorf("expected a READ_ONLY problem saying why but got %v %s", rr.Code, rr.Body.String())
+	}
+}
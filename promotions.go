@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Promotion multiplies the points of receipts purchased from Start up to, but not
+// including, End. Both are local times like the receipt's own, written
+// "YYYY-MM-DDTHH:MM" with optional seconds, or "YYYY-MM-DD" for midnight. Retailer, if
+// set, limits the promotion to one retailer, matched like a RetailerOverride name.
+type Promotion struct {
+	Name       string  `json:"name" yaml:"name"`
+	Start      string  `json:"start" yaml:"start"`
+	End        string  `json:"end" yaml:"end"`
+	Retailer   string  `json:"retailer,omitempty" yaml:"retailer"`
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+}
+
+// Ways of combining the multipliers of overlapping promotions.
+const (
+	stackMax     = "max"
+	stackProduct = "product"
+)
+
+var promotionTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parsePromotionTime parses a promotion start or end.
+func parsePromotionTime(s string) (time.Time, error) {
+	for _, layout := range promotionTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a YYYY-MM-DDTHH:MM time", s)
+}
+
+// validatePromotion returns the first invalid field of p, relative to the promotion.
+func validatePromotion(p Promotion) (field, msg string) {
+	if !customRuleName.MatchString(p.Name) {
+		return "name", fmt.Sprintf("%q must be lowercase letters, digits and underscores, starting with a letter", p.Name)
+	}
+	start, err := parsePromotionTime(p.Start)
+	if err != nil {
+		return "start", err.Error()
+	}
+	end, err := parsePromotionTime(p.End)
+	if err != nil {
+		return "end", err.Error()
+	}
+	if !end.After(start) {
+		return "end", fmt.Sprintf("%s must be after start %s", p.End, p.Start)
+	}
+	if p.Multiplier <= 0 {
+		return "multiplier", "must be positive"
+	}
+	return "", ""
+}
+
+// activePromotion is a validated Promotion with its window parsed.
+type activePromotion struct {
+	definition Promotion
+	start, end time.Time
+}
+
+// promotions parses the promotions of config, which must have been validated.
+func promotions(config RulesConfig) []activePromotion {
+	var active []activePromotion
+	for _, p := range config.Promotions {
+		start, _ := parsePromotionTime(p.Start)
+		end, _ := parsePromotionTime(p.End)
+		active = append(active, activePromotion{definition: p, start: start, end: end})
+	}
+	return active
+}
+
+// applies reports whether the promotion covers a receipt.
+func (p activePromotion) applies(receipt ParsedReceipt) bool {
+	if !receipt.PurchasedAtOK || receipt.PurchasedAt.Before(p.start) || !receipt.PurchasedAt.Before(p.end) {
+		return false
+	}
+	return p.definition.Retailer == "" || normalizeRetailer(p.definition.Retailer) == normalizeRetailer(receipt.Retailer)
+}
+
+// applyPromotions multiplies points by the promotions covering the receipt and
+// returns the new total with a breakdown entry for the extra points, if any apply.
+func (e *Engine) applyPromotions(receipt ParsedReceipt, points int) (int, *BreakdownEntry) {
+	var applied []activePromotion
+	for _, p := range e.promotions {
+		if p.applies(receipt) {
+			applied = append(applied, p)
+		}
+	}
+	if len(applied) == 0 {
+		return points, nil
+	}
+
+	if e.config.PromotionStacking != stackProduct {
+		best := applied[0]
+		for _, p := range applied[1:] {
+			if p.definition.Multiplier > best.definition.Multiplier {
+				best = p
+			}
+		}
+		applied = []activePromotion{best}
+	}
+
+	multiplier := 1.0
+	factors := make([]string, len(applied))
+	for i, p := range applied {
+		multiplier *= p.definition.Multiplier
+		factors[i] = fmt.Sprintf("x%g (%s)", p.definition.Multiplier, p.definition.Name)
+	}
+	total := int(math.Round(float64(points) * multiplier))
+	return total, &BreakdownEntry{
+		Rule:   "promotion",
+		Points: total - points,
+		Detail: fmt.Sprintf("%d base points %s = %d", points, strings.Join(factors, " "), total),
+	}
+}
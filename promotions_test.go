@@ -0,0 +1,141 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromotions(t *testing.T) {
+	// The Target example earns 28 points and was purchased on 2022-01-01 at 13:01.
+	weekend := Promotion{Name: "double_points_weekend", Start: "2022-01-01", End: "2022-01-03", Multiplier: 2}
+	now := time.Now()
+
+	testCases := []struct {
+		name           string
+		promotions     []Promotion
+		stacking       string
+		expectedPoints int
+		expectedDetail string
+	}{
+		{name: "None", expectedPoints: 28},
+		{name: "Covering", promotions: []Promotion{weekend}, expectedPoints: 56, expectedDetail: "28 base points x2 (double_points_weekend) = 56"},
+		{name: "StartIsInclusive", promotions: []Promotion{{Name: "p", Start: "2022-01-01T13:01", End: "2022-01-02", Multiplier: 2}}, expectedPoints: 56, expectedDetail: "28 base points x2 (p) = 56"},
+		{name: "EndIsExclusive", promotions: []Promotion{{Name: "p", Start: "2022-01-01", End: "2022-01-01T13:01", Multiplier: 2}}, expectedPoints: 28},
+		{name: "EndOneMinuteLater", promotions: []Promotion{{Name: "p", Start: "2022-01-01", End: "2022-01-01T13:02", Multiplier: 2}}, expectedPoints: 56, expectedDetail: "28 base points x2 (p) = 56"},
+		{name: "EndOneSecondLater", promotions: []Promotion{{Name: "p", Start: "2022-01-01", End: "2022-01-01T13:01:01", Multiplier: 2}}, expectedPoints: 56, expectedDetail: "28 base points x2 (p) = 56"},
+		{name: "StartOneSecondLater", promotions: []Promotion{{Name: "p", Start: "2022-01-01T13:01:01", End: "2022-01-02", Multiplier: 2}}, expectedPoints: 28},
+		{name: "MatchingRetailer", promotions: []Promotion{{Name: "p", Start: "2022-01-01", End: "2022-01-02", Retailer: " TARGET", Multiplier: 1.5}}, expectedPoints: 42, expectedDetail: "28 base points x1.5 (p) = 42"},
+		{name: "OtherRetailer", promotions: []Promotion{{Name: "p", Start: "2022-01-01", End: "2022-01-02", Retailer: "Walmart", Multiplier: 2}}, expectedPoints: 28},
+		{
+			// Promotions follow the purchase time, so one running now doesn't apply.
+			name:           "ProcessingTimeIgnored",
+			promotions:     []Promotion{{Name: "p", Start: now.Add(-time.Hour).Format("2006-01-02T15:04"), End: now.Add(time.Hour).Format("2006-01-02T15:04"), Multiplier: 2}},
+			expectedPoints: 28,
+		},
+		{
+			name:           "OverlapUsesMax",
+			promotions:     []Promotion{{Name: "a", Start: "2022-01-01", End: "2022-01-02", Multiplier: 1.5}, weekend, {Name: "c", Start: "2021-12-01", End: "2022-02-01", Multiplier: 1.25}},
+			expectedPoints: 56,
+			expectedDetail: "28 base points x2 (double_points_weekend) = 56",
+		},
+		{
+			name:           "OverlapProduct",
+			promotions:     []Promotion{{Name: "a", Start: "2022-01-01", End: "2022-01-02", Multiplier: 1.5}, weekend},
+			stacking:       stackProduct,
+			expectedPoints: 84,
+			expectedDetail: "28 base points x1.5 (a) x2 (double_points_weekend) = 84",
+		},
+		{
+			// 28 * 1.1 = 30.8 rounds to 31.
+			name:           "Rounded",
+			promotions:     []Promotion{{Name: "p", Start: "2022-01-01", End: "2022-01-02", Multiplier: 1.1}},
+			expectedPoints: 31,
+			expectedDetail: "28 base points x1.1 (p) = 31",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := defaultRulesConfig()
+			config.Promotions = tc.promotions
+			config.PromotionStacking = tc.stacking
+			if field, msg := validateRulesConfig(config); msg != "" {
+				t.Fatalf("expected a valid config but got %s %s", field, msg)
+			}
+
+			points, breakdown := scoreReceipt(exampleReceipts["target"], config)
+			if points != tc.expectedPoints {
+				t.Errorf("expected %v points but got %v", tc.expectedPoints, points)
+			}
+
+			last := breakdown[len(breakdown)-1]
+			if (last.Rule == "promotion") != (tc.expectedDetail != "") {
+				t.Fatalf("expected a promotion entry: %v, but got %+v", tc.expectedDetail != "", breakdown)
+			}
+			if tc.expectedDetail == "" {
+				return
+			}
+			if last.Detail != tc.expectedDetail || last.Points != tc.expectedPoints-28 {
+				t.Errorf("expected a promotion entry worth %v with detail %q but got %+v", tc.expectedPoints-28, tc.expectedDetail, last)
+			}
+
+			// The rule entries still add up to the base points.
+			base := 0
+			for _, entry := range breakdown[:len(breakdown)-1] {
+				base += entry.Points
+			}
+			if base != 28 {
+				t.Errorf("expected the rule entries to add up to 28 but got %v", base)
+			}
+		})
+	}
+}
+
+func TestPromotionConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			name:     "BadStart",
+			contents: "promotions:\n  - name: weekend\n    start: 2022-01-01 09:00\n    end: 2022-01-03\n    multiplier: 2\n",
+			expected: `rules.yaml:3: promotions[0].start "2022-01-01 09:00" is not a YYYY-MM-DDTHH:MM time`,
+		},
+		{
+			name:     "EndBeforeStart",
+			contents: "promotions:\n  - name: weekend\n    start: 2022-01-03\n    end: 2022-01-01\n    multiplier: 2\n",
+			expected: "rules.yaml:4: promotions[0].end 2022-01-01 must be after start 2022-01-03",
+		},
+		{
+			name:     "ZeroMultiplier",
+			contents: "promotions:\n  - name: weekend\n    start: 2022-01-01\n    end: 2022-01-03\n",
+			expected: "rules.yaml:2: promotions[0].multiplier must be positive",
+		},
+		{
+			name:     "DuplicateName",
+			contents: "promotions:\n  - {name: weekend, start: 2022-01-01, end: 2022-01-03, multiplier: 2}\n  - {name: weekend, start: 2022-01-08, end: 2022-01-10, multiplier: 2}\n",
+			expected: `rules.yaml:3: promotions[1].name "weekend" is already the name of a promotion`,
+		},
+		{
+			name:     "Stacking",
+			contents: "promotionStacking: sum\n",
+			expected: `rules.yaml:1: promotionStacking must be "max" or "product", not "sum"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "rules.yaml", tc.contents)
+			_, err := loadRulesConfig(path)
+			if err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+			if got := strings.TrimPrefix(err.Error(), filepath.Dir(path)+string(filepath.Separator)); got != tc.expected {
+				t.Errorf("expected error %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
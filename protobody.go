@@ -0,0 +1,124 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=receipt_api --go-grpc_out=. --go-grpc_opt=module=receipt_api proto/receipt.proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"receipt_api/receiptpb"
+)
+
+// decodeProtoReceipt decodes a receiptpb.Receipt, rejecting fields the schema in
+// proto/receipt.proto doesn't have, which protobuf would otherwise keep as unknown
+// fields and ignore. Errors reading r are returned as they are.
+func decodeProtoReceipt(r io.Reader) (Receipt, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Receipt{}, err
+	}
+	var message receiptpb.Receipt
+	if err := proto.Unmarshal(data, &message); err != nil {
+		return Receipt{}, protoDecodeError("malformed protobuf: %s", err)
+	}
+	return receiptFromProto(&message)
+}
+
+// receiptFromProto converts a decoded receiptpb.Receipt, rejecting its unknown fields
+// as decodeProtoReceipt does.
+func receiptFromProto(message *receiptpb.Receipt) (Receipt, error) {
+	if err := checkProtoFields("the receipt", message.ProtoReflect()); err != nil {
+		return Receipt{}, err
+	}
+	receipt := Receipt{
+		Retailer:     message.Retailer,
+		Total:        message.Total,
+		PurchaseDate: message.PurchaseDate,
+		PurchaseTime: message.PurchaseTime,
+		Timezone:     message.Timezone,
+	}
+	for _, item := range message.Items {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: item.ShortDescription, Price: item.Price, UPC: item.Upc})
+	}
+	return receipt, nil
+}
+
+func protoDecodeError(format string, args ...any) error {
+	return &receiptDecodeError{reason: reasonBodyInvalid, message: "Failed to parse the request body: " + fmt.Sprintf(format, args...)}
+}
+
+// checkProtoFields rejects unknown fields in m and the messages it holds.
+func checkProtoFields(path string, m protoreflect.Message) error {
+	if unknown := m.GetUnknown(); len(unknown) > 0 {
+		return protoDecodeError("%s has no field %d", path, protoFieldNumber(unknown))
+	}
+	var err error
+	m.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if field.Kind() != protoreflect.MessageKind {
+			return true
+		}
+		name := string(field.Name())
+		if field.IsList() {
+			list := value.List()
+			for i := 0; i < list.Len() && err == nil; i++ {
+				err = checkProtoFields(fmt.Sprintf("%s[%d]", name, i), list.Get(i).Message())
+			}
+		} else {
+			err = checkProtoFields(name, value.Message())
+		}
+		return err == nil
+	})
+	return err
+}
+
+// protoFieldNumber is the number of the first field in raw protobuf fields.
+func protoFieldNumber(raw protoreflect.RawFields) int64 {
+	var number, shift uint64
+	for _, b := range raw {
+		number |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			break
+		}
+		shift += 7
+	}
+	return int64(number >> 3)
+}
+
+// protoResponses gives the message a response body is sent as in protobuf, by a key
+// only that body has, checked in order.
+var protoResponses = []struct {
+	key     string
+	message func() proto.Message
+}{
+	{"error", func() proto.Message { return &receiptpb.Error{} }},
+	{"breakdown", func() proto.Message { return &receiptpb.BreakdownResponse{} }},
+	{"points", func() proto.Message { return &receiptpb.PointsResponse{} }},
+	{"id", func() proto.Message { return &receiptpb.ProcessResponse{} }},
+}
+
+// marshalProtoResponse encodes body as the message protoResponses gives it. The body
+// is converted through JSON, whose names the messages share, so a key the message
+// doesn't have is an error rather than left out.
+func marshalProtoResponse(body gin.H) ([]byte, error) {
+	for _, response := range protoResponses {
+		if _, ok := body[response.key]; !ok {
+			continue
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		message := response.message()
+		if err := protojson.Unmarshal(data, message); err != nil {
+			return nil, err
+		}
+		return proto.Marshal(message)
+	}
+	return nil, fmt.Errorf("no protobuf message for a response with %d keys", len(body))
+}
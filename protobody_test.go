@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"receipt_api/receiptpb"
+)
+
+// canonicalReceiptProto is validReceiptPayload as a receiptpb.Receipt.
+func canonicalReceiptProto(t *testing.T) *receiptpb.Receipt {
+	t.Helper()
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(validReceiptPayload), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	message := &receiptpb.Receipt{
+		Retailer:     receipt.Retailer,
+		Total:        receipt.Total,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+	}
+	for _, item := range receipt.Items {
+		message.Items = append(message.Items, &receiptpb.Item{ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+	return message
+}
+
+func marshalProto(t *testing.T, message proto.Message) []byte {
+	t.Helper()
+	data, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func unmarshalProto(t *testing.T, data []byte, message proto.Message) {
+	t.Helper()
+	if err := proto.Unmarshal(data, message); err != nil {
+		t.Fatalf("expected a protobuf %T but got %v: %x", message, err, data)
+	}
+}
+
+func TestProcessProtoReceipts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	rr := serveBody(router, http.MethodPost, "/receipts/process", "application/x-protobuf", "application/x-protobuf", marshalProto(t, canonicalReceiptProto(t)))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("expected a protobuf 200 but got %v %v: %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+	var processed receiptpb.ProcessResponse
+	unmarshalProto(t, rr.Body.Bytes(), &processed)
+
+	// The receipt scores and reads back as it does in JSON.
+	jsonID, want := processAndScore(t, router, validReceiptPayload)
+	rr = serveBody(router, http.MethodGet, "/receipts/"+processed.Id+"/points", "", "application/x-protobuf", nil)
+	var points receiptpb.PointsResponse
+	unmarshalProto(t, rr.Body.Bytes(), &points)
+	if points.Points != int64(want) || points.RulesVersion != currentEngine().hash {
+		t.Errorf("expected %d points with the current rules like the JSON receipt but got %v", want, &points)
+	}
+	fromProto := serveBody(router, http.MethodGet, "/receipts/"+processed.Id, "", "", nil).Body.String()
+	fromJSON := serveBody(router, http.MethodGet, "/receipts/"+jsonID, "", "", nil).Body.String()
+	if strings.ReplaceAll(fromProto, processed.Id, jsonID) != fromJSON {
+		t.Errorf("expected the protobuf receipt to read back as the JSON one\n%s\nbut got\n%s", fromJSON, fromProto)
+	}
+
+	rr = serveBody(router, http.MethodGet, "/receipts/"+processed.Id+"/breakdown", "", "application/x-protobuf", nil)
+	var breakdown receiptpb.BreakdownResponse
+	unmarshalProto(t, rr.Body.Bytes(), &breakdown)
+	total := int64(0)
+	for _, entry := range breakdown.Breakdown {
+		total += entry.Points
+	}
+	if len(breakdown.Breakdown) == 0 || total != breakdown.Points || breakdown.Points != int64(want) {
+		t.Errorf("expected a breakdown adding up to %d points but got %v", want, &breakdown)
+	}
+}
+
+func TestProtoReceiptErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	noTotal := canonicalReceiptProto(t)
+	noTotal.Total = ""
+	badPrice := canonicalReceiptProto(t)
+	badPrice.Items[1].Price = "12,25"
+	extraField := protowire.AppendString(protowire.AppendTag(marshalProto(t, canonicalReceiptProto(t)), 9, protowire.BytesType), "cash")
+	extraItemField := canonicalReceiptProto(t)
+	extraItemField.Items[2].ProtoReflect().SetUnknown(protowire.AppendVarint(protowire.AppendTag(nil, 7, protowire.VarintType), 1))
+
+	testCases := []struct {
+		name     string
+		payload  []byte
+		reason   validationReason
+		contains string
+	}{
+		{"TotalMissing", marshalProto(t, noTotal), reasonTotalMissing, "Total amount is required"},
+		{"ItemPriceInvalid", marshalProto(t, badPrice), reasonItemPriceInvalid, "Invalid item price"},
+		{"Malformed", []byte{0x0a, 0x10, 'T'}, reasonBodyInvalid, "malformed protobuf"},
+		{"UnknownField", extraField, reasonBodyInvalid, "the receipt has no field 9"},
+		{"UnknownItemField", marshalProto(t, extraItemField), reasonBodyInvalid, "items[2] has no field 7"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			failures := `receipt_validation_failures_total{reason="` + string(tc.reason) + `"}`
+			before, _ := scrapeMetrics(t, router)
+			rr := serveBody(router, http.MethodPost, "/receipts/process", "application/x-protobuf", "application/x-protobuf", tc.payload)
+			var body receiptpb.Error
+			unmarshalProto(t, rr.Body.Bytes(), &body)
+			if rr.Code != http.StatusBadRequest || !strings.Contains(body.Error, tc.contains) {
+				t.Errorf("expected a 400 containing %q but got %v %q", tc.contains, rr.Code, body.Error)
+			}
+			if after, _ := scrapeMetrics(t, router); after[failures] != before[failures]+1 {
+				t.Errorf("expected the receipt rejected for %s but got %v", tc.reason, after[failures]-before[failures])
+			}
+		})
+	}
+}
+
+func TestMarshalProtoResponse(t *testing.T) {
+	expiresAt := time.Date(2023, 1, 1, 0, 0, 0, 0, time.FixedZone("EST", -5*3600))
+	data, err := marshalProtoResponse(gin.H{"points": 0, "rulesVersion": "abc", "expiresAt": expiresAt, "expired": true, "originalPoints": 28})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var points receiptpb.PointsResponse
+	unmarshalProto(t, data, &points)
+	if !points.ExpiresAt.AsTime().Equal(expiresAt) || !points.Expired || points.OriginalPoints != 28 || points.RulesVersion != "abc" {
+		t.Errorf("expected expired points but got %v", &points)
+	}
+
+	if _, err := marshalProtoResponse(gin.H{"points": 28, "cashier": "Sam"}); err == nil {
+		t.Error("expected an error for a key PointsResponse doesn't have but got none")
+	}
+	if _, err := marshalProtoResponse(gin.H{"status": "ok"}); err == nil {
+		t.Error("expected an error for a response without a message but got none")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// quotaResetHour is the --quota-reset-hour, the UTC hour daily quotas start over.
+var quotaResetHour int
+
+// quotaStateFile is the --quota-state-file the quota counters are kept in, so they
+// survive restarts. Without it they are kept in memory only.
+var quotaStateFile string
+
+// quotaUsage counts the receipts each API key processed in the current quota period.
+var quotaUsage = newQuotaStore("")
+
+// keyLimiters holds the rate limiter of each API key ID with a rate limit.
+var keyLimiters sync.Map
+
+// quotaPeriod returns the start of the quota period containing now and of the next.
+func quotaPeriod(now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	start = time.Date(now.Year(), now.Month(), now.Day(), quotaResetHour, 0, 0, 0, time.UTC)
+	if now.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+// quotaStore counts receipts per key ID for the current quota period, saving the
+// counts to path after every change when path is set.
+type quotaStore struct {
+	path string
+
+	mu     sync.Mutex
+	period time.Time
+	used   map[string]int
+}
+
+// quotaState is the content of a --quota-state-file.
+type quotaState struct {
+	PeriodStart time.Time      `json:"periodStart"`
+	Used        map[string]int `json:"used"`
+}
+
+func newQuotaStore(path string) *quotaStore {
+	return &quotaStore{path: path, used: make(map[string]int)}
+}
+
+// loadQuotaStore returns a store saving to path, with the counts saved there if it
+// exists.
+func loadQuotaStore(path string) (*quotaStore, error) {
+	store := newQuotaStore(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state quotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, &configError{path: path, msg: err.Error()}
+	}
+	store.period = state.PeriodStart
+	for id, n := range state.Used {
+		store.used[id] = n
+	}
+	return store, nil
+}
+
+// rollOver starts a new period if now is past the current one. It must be called with
+// mu held.
+func (s *quotaStore) rollOver(now time.Time) time.Time {
+	start, end := quotaPeriod(now)
+	if !s.period.Equal(start) {
+		s.period = start
+		s.used = make(map[string]int)
+	}
+	return end
+}
+
+// reserve counts a receipt against the quota of id if it has any left, and returns
+// when the quota resets. A quota of 0 is unlimited.
+func (s *quotaStore) reserve(id string, quota int) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resetAt := s.rollOver(clock.Now())
+	if quota > 0 && s.used[id] >= quota {
+		return resetAt, false
+	}
+	s.used[id]++
+	s.saveLocked()
+	return resetAt, true
+}
+
+// release gives back a reservation for a receipt that wasn't processed. Reservations
+// from an earlier period are gone already.
+func (s *quotaStore) release(id string, resetAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, end := quotaPeriod(s.period); !end.Equal(resetAt) || s.used[id] == 0 {
+		return
+	}
+	s.used[id]--
+	s.saveLocked()
+}
+
+// usage returns the counts of the current period and when it started and ends.
+func (s *quotaStore) usage() (used map[string]int, start, end time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end = s.rollOver(clock.Now())
+	used = make(map[string]int, len(s.used))
+	for id, n := range s.used {
+		used[id] = n
+	}
+	return used, s.period, end
+}
+
+// saveLocked writes the counts to the state file, replacing it in one rename so a crash
+// never leaves it half written. Failures are logged; the counts in memory still apply.
+func (s *quotaStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(quotaState{PeriodStart: s.period, Used: s.used})
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		log.Printf("saving the quota counters failed: %v", err)
+	}
+}
+
+// keyLimiter returns the rate limiter of key, replacing it if the key's rate changed.
+func keyLimiter(key *apiKey) *rateLimiter {
+	if existing, ok := keyLimiters.Load(key.ID); ok && existing.(*rateLimiter).rate == key.rate {
+		return existing.(*rateLimiter)
+	}
+	limiter := newRateLimiter(key.rate, 0)
+	keyLimiters.Store(key.ID, limiter)
+	return limiter
+}
+
+// authenticatedKey returns the current configuration of the API key that authenticated
+// the request, if one did.
+func authenticatedKey(c *gin.Context) (*apiKey, bool) {
+	id := c.GetString("apiKey")
+	if id == "" {
+		return nil, false
+	}
+	keys := currentAPIKeys()
+	for i := range keys {
+		if keys[i].ID == id {
+			return &keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// limitProblem is a problem with the time the limit that was hit resets.
+type limitProblem struct {
+	problem
+	ResetAt time.Time `json:"resetAt"`
+}
+
+// abortWithLimit responds 429 with code and the time the limit resets, also given in
+// seconds by Retry-After.
+func abortWithLimit(c *gin.Context, code, detail string, resetAt time.Time) {
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(resetAt.Sub(clock.Now()))))
+	if jsonAPIRequested(c) {
+		abortWithJSONAPIError(c, newProblem(c, http.StatusTooManyRequests, code, detail), gin.H{"resetAt": resetAt})
+		return
+	}
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, limitProblem{
+		problem: newProblem(c, http.StatusTooManyRequests, code, detail),
+		ResetAt: resetAt,
+	})
+}
+
+// limitAPIKey enforces the rate limit of the API key that authenticated the request,
+// and counts it against the key's daily quota, as countQuota does, when countsQuota
+// is set. Requests that exceed the rate get a 429 with the RATE_LIMITED code.
+func limitAPIKey(countsQuota bool) gin.HandlerFunc {
+	limitQuota := countQuota()
+	return func(c *gin.Context) {
+		key, ok := authenticatedKey(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		if key.rate.count > 0 {
+			if decision := keyLimiter(key).take(""); !decision.allowed {
+				abortWithLimit(c, "RATE_LIMITED", fmt.Sprintf("API key %s is limited to %s requests", key.ID, key.rate.String()),
+					clock.Now().Add(decision.retryAfter))
+				return
+			}
+		}
+		if countsQuota {
+			limitQuota(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// countQuota counts the request against the daily quota of the API key that
+// authenticated it. Requests over the quota get a 429 with the QUOTA_EXHAUSTED code.
+// Only successful requests are counted, for every key so GET /admin/quotas can report
+// them. Routes that answer some requests without storing a receipt, such as replays
+// of an Idempotency-Key, count them after deciding so.
+func countQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := authenticatedKey(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		store := quotaUsage
+		resetAt, ok := store.reserve(key.ID, key.DailyQuota)
+		if !ok {
+			abortWithLimit(c, "QUOTA_EXHAUSTED", fmt.Sprintf("API key %s has processed its %d receipts for the day", key.ID, key.DailyQuota), resetAt)
+			return
+		}
+		c.Set("quotaReservation", resetAt)
+		c.Next()
+		if c.Writer.Status() != http.StatusOK && !c.GetBool("quotaReleased") {
+			store.release(key.ID, resetAt)
+		}
+	}
+}
+
+// releaseQuota gives back the receipt limitAPIKey reserved for the request, for
+// handlers that reserve one for each receipt they store.
+func releaseQuota(c *gin.Context) {
+	resetAt, ok := c.Get("quotaReservation")
+	key, hasKey := authenticatedKey(c)
+	if !ok || !hasKey || c.GetBool("quotaReleased") {
+		return
+	}
+	quotaUsage.release(key.ID, resetAt.(time.Time))
+	c.Set("quotaReleased", true)
+}
+
+// quotasHandler reports each API key's quota and use in the current period.
+func quotasHandler(c *gin.Context) {
+	type keyQuota struct {
+		ID         string `json:"id"`
+		RateLimit  string `json:"rateLimit,omitempty"`
+		DailyQuota int    `json:"dailyQuota,omitempty"`
+		Used       int    `json:"used"`
+		Remaining  *int   `json:"remaining,omitempty"`
+	}
+	used, start, end := quotaUsage.usage()
+	keys := currentAPIKeys()
+	quotas := make([]keyQuota, 0, len(keys))
+	for _, key := range keys {
+		quota := keyQuota{ID: key.ID, RateLimit: key.RateLimit, DailyQuota: key.DailyQuota, Used: used[key.ID]}
+		if key.DailyQuota > 0 {
+			remaining := key.DailyQuota - quota.Used
+			if remaining < 0 {
+				remaining = 0
+			}
+			quota.Remaining = &remaining
+		}
+		quotas = append(quotas, quota)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].ID < quotas[j].ID })
+
+	c.JSON(http.StatusOK, gin.H{"periodStart": start, "resetAt": end, "keys": quotas})
+}
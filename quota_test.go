@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useQuotaStore counts quotas in store for the rest of the test.
+func useQuotaStore(t *testing.T, store *quotaStore) {
+	t.Helper()
+	previous := quotaUsage
+	quotaUsage = store
+	t.Cleanup(func() { quotaUsage = previous })
+}
+
+func TestQuotaPeriod(t *testing.T) {
+	defer func(previous int) { quotaResetHour = previous }(quotaResetHour)
+	quotaResetHour = 6
+
+	testCases := []struct {
+		now, start string
+	}{
+		{"2025-01-30T05:59:59Z", "2025-01-29T06:00:00Z"},
+		{"2025-01-30T06:00:00Z", "2025-01-30T06:00:00Z"},
+		{"2025-01-30T23:00:00Z", "2025-01-30T06:00:00Z"},
+		// The hour is in UTC whatever the zone of the time.
+		{"2025-01-30T07:30:00+02:00", "2025-01-29T06:00:00Z"},
+	}
+	for _, tc := range testCases {
+		now, _ := time.Parse(time.RFC3339, tc.now)
+		start, end := quotaPeriod(now)
+		if got := start.Format(time.RFC3339); got != tc.start || !end.Equal(start.AddDate(0, 0, 1)) {
+			t.Errorf("%s: expected the period to start at %s but got %s to %s", tc.now, tc.start, got, end)
+		}
+	}
+}
+
+func TestAPIKeyLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	router := newRouter()
+	useQuotaStore(t, newQuotaStore(""))
+	useAPIKeys(t, []apiKey{
+		{ID: "partner-a", Key: "k-a", Scopes: defaultScopes, RateLimit: "2/s", rate: rate{2, time.Second}, DailyQuota: 3},
+		{ID: "partner-b", Key: "k-b", Scopes: defaultScopes},
+		{ID: "ops", Key: "k-ops", Scopes: []string{scopeAdmin}},
+	})
+	midnight := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	var body limitProblem
+	decode := func(rr *httptest.ResponseRecorder) {
+		t.Helper()
+		body = limitProblem{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Failed submissions don't use the quota.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(`{"retailer": ""}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "k-a")
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 but got %v", rr.Code)
+	}
+	for i := 0; i < 3; i++ {
+		fake.Advance(time.Second)
+		if rr := requestWithKey(router, http.MethodPost, "/receipts/process", "k-a"); rr.Code != http.StatusOK {
+			t.Fatalf("expected receipt %d within the quota to be processed but got %v: %s", i+1, rr.Code, rr.Body.String())
+		}
+	}
+	fake.Advance(time.Second)
+	rr = requestWithKey(router, http.MethodPost, "/receipts/process", "k-a")
+	decode(rr)
+	if rr.Code != http.StatusTooManyRequests || body.Code != "QUOTA_EXHAUSTED" || !body.ResetAt.Equal(midnight) {
+		t.Errorf("expected 429 QUOTA_EXHAUSTED until %v but got %v: %s", midnight, rr.Code, rr.Body.String())
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "43196" {
+		t.Errorf("expected Retry-After 43196 but got %q", retry)
+	}
+	// The quota only limits processing, and only for keys that have one.
+	if rr := requestWithKey(router, http.MethodGet, "/rules", "k-a"); rr.Code != http.StatusOK {
+		t.Errorf("expected reads to be allowed over the quota but got %v", rr.Code)
+	}
+	if rr := requestWithKey(router, http.MethodPost, "/receipts/process", "k-b"); rr.Code != http.StatusOK {
+		t.Errorf("expected a key without a quota to be unlimited but got %v", rr.Code)
+	}
+
+	// Two requests a second, in bursts of two.
+	fake.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if rr := requestWithKey(router, http.MethodGet, "/rules", "k-a"); rr.Code != http.StatusOK {
+			t.Fatalf("expected request %d within the rate to be allowed but got %v", i+1, rr.Code)
+		}
+	}
+	rr = requestWithKey(router, http.MethodGet, "/rules", "k-a")
+	decode(rr)
+	if rr.Code != http.StatusTooManyRequests || body.Code != "RATE_LIMITED" || !body.ResetAt.Equal(clock.Now().Add(500*time.Millisecond)) {
+		t.Errorf("expected 429 RATE_LIMITED for 500ms but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("expected Retry-After 1 but got %q", retry)
+	}
+
+	rr = requestWithKey(router, http.MethodGet, "/admin/quotas", "k-ops")
+	var quotas struct {
+		ResetAt time.Time `json:"resetAt"`
+		Keys    []struct {
+			ID         string `json:"id"`
+			DailyQuota int    `json:"dailyQuota"`
+			Used       int    `json:"used"`
+			Remaining  *int   `json:"remaining"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &quotas); err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas.Keys) != 3 || !quotas.ResetAt.Equal(midnight) ||
+		quotas.Keys[1].ID != "partner-a" || quotas.Keys[1].Used != 3 || quotas.Keys[1].Remaining == nil || *quotas.Keys[1].Remaining != 0 ||
+		quotas.Keys[2].ID != "partner-b" || quotas.Keys[2].Used != 1 || quotas.Keys[2].Remaining != nil {
+		t.Errorf("expected partner-a to have used its 3 receipts and partner-b 1 without a quota but got %s", rr.Body.String())
+	}
+
+	// The quota starts over at the reset hour.
+	fake.Set(midnight)
+	if rr := requestWithKey(router, http.MethodPost, "/receipts/process", "k-a"); rr.Code != http.StatusOK {
+		t.Errorf("expected the quota to reset at midnight but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestQuotaStatePersists(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	store, err := loadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		store.reserve("partner-a", 10)
+	}
+	resetAt, _ := store.reserve("partner-b", 10)
+	store.release("partner-b", resetAt)
+
+	// A restart picks up the counts.
+	restarted, err := loadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := restarted.usage(); used["partner-a"] != 2 || used["partner-b"] != 0 {
+		t.Errorf("expected partner-a to have used 2 and partner-b none after a restart but got %v", used)
+	}
+	if _, ok := restarted.reserve("partner-a", 2); ok {
+		t.Error("expected partner-a's quota of 2 to be exhausted after a restart")
+	}
+
+	// Counts saved in an earlier period are stale.
+	fake.Advance(24 * time.Hour)
+	restarted, err = loadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := restarted.usage(); len(used) != 0 {
+		t.Errorf("expected the counts to start over the next day but got %v", used)
+	}
+
+	if _, err := loadQuotaStore(writeConfig(t, "quotas.json", "{")); err == nil {
+		t.Error("expected a corrupt state file to be rejected")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The --rate-limit and --rate-burst of each client IP.
+var (
+	ipRate  rate
+	ipBurst int
+)
+
+// trustedProxies are the --trusted-proxies whose X-Forwarded-For header names the
+// client. Requests from anywhere else are attributed to their peer address.
+// trustAllProxies is --trust-all-proxies, for when every peer is a proxy that
+// overwrites the header.
+var (
+	trustedProxies  []string
+	trustAllProxies bool
+)
+
+// proxiesToTrust returns the proxies whose X-Forwarded-For header the routers believe.
+func proxiesToTrust() []string {
+	if trustAllProxies {
+		return []string{"0.0.0.0/0", "::/0"}
+	}
+	return trustedProxies
+}
+
+// ipLimiter limits the requests of each client IP. It is nil unless --rate-limit is set.
+var ipLimiter atomic.Pointer[rateLimiter]
+
+// rateLimitSweepInterval is how often buckets that have refilled are dropped.
+var rateLimitSweepInterval = time.Minute
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(s string) ([]string, error) {
+	var proxies []string
+	for _, proxy := range strings.Split(s, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q, expected an IP address or CIDR range", proxy)
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+// tokenBucket holds the tokens a client has left as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per key, refilled at perSecond up to burst tokens.
+type rateLimiter struct {
+	rate      rate
+	perSecond float64
+	burst     int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a limiter allowing r with bursts of up to burst requests. A
+// burst below 1 allows one second's worth of requests, and at least one.
+func newRateLimiter(r rate, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(r.perSecond())))
+	}
+	return &rateLimiter{rate: r, perSecond: r.perSecond(), burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// rateDecision is the outcome of a request against a limiter.
+type rateDecision struct {
+	allowed   bool
+	remaining int
+	// retryAfter is how long until the next request is allowed, and reset how long
+	// until the bucket is full again.
+	retryAfter, reset time.Duration
+}
+
+// take spends a token from the bucket of key if it has one.
+func (l *rateLimiter) take(key string) rateDecision {
+	now := clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = l.refill(bucket, now)
+	bucket.last = now
+
+	decision := rateDecision{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		decision.allowed = true
+	} else {
+		decision.retryAfter = l.wait(1 - bucket.tokens)
+	}
+	decision.remaining = int(bucket.tokens)
+	decision.reset = l.wait(float64(l.burst) - bucket.tokens)
+	return decision
+}
+
+// refill returns the tokens of bucket at now.
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	return math.Min(float64(l.burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.perSecond)
+}
+
+// wait returns how long the bucket takes to gain tokens.
+func (l *rateLimiter) wait(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.perSecond * float64(time.Second)))
+}
+
+// sweep drops the buckets that have refilled, at most every rateLimitSweepInterval. A
+// full bucket is the same as none, so memory is bounded by the clients active within
+// the time it takes to refill one.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if l.refill(bucket, now) >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// len returns the number of clients tracked.
+func (l *rateLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// limitRate rejects requests from client IPs over ipLimiter's rate with a 429. Every
+// response reports the client's allowance in X-RateLimit-Limit, X-RateLimit-Remaining
+// and X-RateLimit-Reset, the seconds until it is fully restored.
+func limitRate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := ipLimiter.Load()
+		if limiter == nil {
+			c.Next()
+			return
+		}
+		decision := limiter.take(c.ClientIP())
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limiter.burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(decision.remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.reset)))
+		if !decision.allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(decision.retryAfter)))
+			abortWithProblem(c, http.StatusTooManyRequests, "RATE_LIMITED",
+				fmt.Sprintf("more than %s requests from %s", limiter.rate.String(), c.ClientIP()))
+			return
+		}
+		c.Next()
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
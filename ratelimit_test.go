@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useRateLimit limits each client IP to r with bursts of burst for the rest of the
+// test.
+func useRateLimit(t *testing.T, r rate, burst int) *rateLimiter {
+	t.Helper()
+	limiter := newRateLimiter(r, burst)
+	ipLimiter.Store(limiter)
+	t.Cleanup(func() { ipLimiter.Store(nil) })
+	return limiter
+}
+
+// requestFrom sends a GET request from a client address, with an X-Forwarded-For
+// header if forwardedFor isn't empty.
+func requestFrom(router *gin.Engine, path, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	router := newRouter()
+	useRateLimit(t, rate{2, time.Second}, 3)
+
+	type headers struct {
+		status                         int
+		limit, remaining, reset, retry string
+	}
+	check := func(step string, rr *httptest.ResponseRecorder, expected headers) {
+		t.Helper()
+		got := headers{rr.Code, rr.Header().Get("X-RateLimit-Limit"), rr.Header().Get("X-RateLimit-Remaining"), rr.Header().Get("X-RateLimit-Reset"), rr.Header().Get("Retry-After")}
+		if got != expected {
+			t.Errorf("%s: expected %+v but got %+v: %s", step, expected, got, rr.Body.String())
+		}
+	}
+
+	// A burst of 3, refilled at 2 a second.
+	check("first", requestFrom(router, "/rules", "10.0.0.1:1234", ""), headers{200, "3", "2", "1", ""})
+	check("second", requestFrom(router, "/rules", "10.0.0.1:1234", ""), headers{200, "3", "1", "1", ""})
+	check("third", requestFrom(router, "/rules", "10.0.0.1:1234", ""), headers{200, "3", "0", "2", ""})
+	check("over", requestFrom(router, "/rules", "10.0.0.1:1234", ""), headers{429, "3", "0", "2", "1"})
+	check("other client", requestFrom(router, "/rules", "10.0.0.2:1234", ""), headers{200, "3", "2", "1", ""})
+
+	// Health checks are never limited.
+	for i := 0; i < 10; i++ {
+		if rr := requestFrom(router, "/health", "10.0.0.1:1234", ""); rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Limit") != "" {
+			t.Fatalf("expected health checks to be exempt but got %v", rr.Code)
+		}
+	}
+
+	fake.Advance(500 * time.Millisecond)
+	check("refilled one", requestFrom(router, "/rules", "10.0.0.1:1234", ""), headers{200, "3", "0", "2", ""})
+	check("over again", requestFrom(router, "/rules", "10.0.0.1:1234", ""), headers{429, "3", "0", "2", "1"})
+	fake.Advance(2 * time.Second)
+	check("recovered", requestFrom(router, "/rules", "10.0.0.1:1234", ""), headers{200, "3", "2", "1", ""})
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	defer func(previous []string) { trustedProxies = previous }(trustedProxies)
+	var err error
+	if trustedProxies, err = parseTrustedProxies("10.1.0.0/16, 192.168.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter()
+	useRateLimit(t, rate{1, time.Minute}, 1)
+
+	// Through the trusted proxy, each forwarded client has its own allowance.
+	for _, client := range []string{"203.0.113.1", "203.0.113.2"} {
+		if rr := requestFrom(router, "/rules", "10.1.2.3:443", client); rr.Code != http.StatusOK {
+			t.Errorf("expected %s's first request through the proxy to be allowed but got %v", client, rr.Code)
+		}
+	}
+	if rr := requestFrom(router, "/rules", "192.168.0.1:443", "203.0.113.1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 203.0.113.1 to be limited through either proxy but got %v", rr.Code)
+	}
+
+	// An untrusted peer can't pick its identity with the header.
+	if rr := requestFrom(router, "/rules", "198.51.100.7:443", "203.0.113.3"); rr.Code != http.StatusOK {
+		t.Errorf("expected the first request from 198.51.100.7 to be allowed but got %v", rr.Code)
+	}
+	if rr := requestFrom(router, "/rules", "198.51.100.7:443", "203.0.113.4"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a forged X-Forwarded-For from an untrusted peer to be ignored but got %v", rr.Code)
+	}
+
+	for _, invalid := range []string{"10.1.0.0/33", "proxy.internal"} {
+		if _, err := parseTrustedProxies(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	limiter := newRateLimiter(rate{10, time.Second}, 20)
+	limiter.take("warm-up")
+	for i := 0; i < 1000; i++ {
+		limiter.take(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	fake.Advance(rateLimitSweepInterval - time.Second)
+	for i := 0; i < 20; i++ {
+		limiter.take("active")
+	}
+	if n := limiter.len(); n != 1002 {
+		t.Errorf("expected 1002 clients before the sweep but got %v", n)
+	}
+
+	// By the next sweep every idle bucket has refilled and is dropped, while the active
+	// client, which emptied its bucket a second ago, still has tokens to recover.
+	fake.Advance(time.Second)
+	limiter.take("active")
+	if n := limiter.len(); n != 1 {
+		t.Errorf("expected only the active client after the sweep but got %v", n)
+	}
+}
+
+func TestClientIPBehindProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	logs := captureLogs(t)
+	_, sink := useAuditLog(t, 0)
+	defer func(previous []string, all bool) { trustedProxies, trustAllProxies = previous, all }(trustedProxies, trustAllProxies)
+	var err error
+	if trustedProxies, err = parseTrustedProxies("10.0.0.0/8, fd00::/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name, remoteAddr, forwardedFor string
+		trustAll                       bool
+		expectedIP                     string
+	}{
+		{"direct", "203.0.113.7:5000", "", false, "203.0.113.7"},
+		{"through the load balancer", "10.0.3.4:443", "203.0.113.7", false, "203.0.113.7"},
+		{"through an IPv6 load balancer", "[fd00::1]:443", "2001:db8::7", false, "2001:db8::7"},
+		{"through two proxies", "10.0.3.4:443", "203.0.113.7, 10.0.9.9", false, "203.0.113.7"},
+		{"spoofed by an untrusted peer", "198.51.100.9:443", "203.0.113.7", false, "198.51.100.9"},
+		{"spoofed behind the load balancer", "10.0.3.4:443", "203.0.113.7, 198.51.100.9", false, "198.51.100.9"},
+		{"every peer trusted", "198.51.100.9:443", "203.0.113.7", true, "203.0.113.7"},
+	}
+	for _, tc := range testCases {
+		trustAllProxies = tc.trustAll
+		router := newRouter()
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodPost, "/admin/rules/reload", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		entry := findRequestLog(requestLogs(t, logs), http.MethodPost, "/admin/rules/reload", http.StatusOK)
+		if entry == nil || entry["client_ip"] != tc.expectedIP {
+			t.Errorf("%s: expected the request to be logged from %s but got %v", tc.name, tc.expectedIP, entry)
+		}
+		auditLog.Load().flush()
+		events, err := sink.query(time.Time{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := events[len(events)-1]; last.ClientIP != tc.expectedIP || last.Actor != "ip:"+tc.expectedIP {
+			t.Errorf("%s: expected the audit event to name %s but got %+v", tc.name, tc.expectedIP, last)
+		}
+	}
+
+	// The health listener doesn't believe the header from untrusted peers either.
+	trustAllProxies = false
+	logs.Reset()
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.RemoteAddr = "198.51.100.9:443"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	newHealthRouter().ServeHTTP(httptest.NewRecorder(), req)
+	if entry := findRequestLog(requestLogs(t, logs), http.MethodGet, "/health", http.StatusOK); entry == nil || entry["client_ip"] != "198.51.100.9" {
+		t.Errorf("expected the health check to be logged from its peer but got %v", entry)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamHeartbeat is how often an idle stream is sent a comment, so proxies and
+// clients can tell it from a dead connection.
+var streamHeartbeat = 15 * time.Second
+
+const (
+	// streamReplaySize is how many recent events a client reconnecting with a
+	// Last-Event-ID can be sent again.
+	streamReplaySize = 256
+	// streamBufferSize is how many events a client may fall behind by before it is
+	// disconnected, to catch up by reconnecting.
+	streamBufferSize = 64
+)
+
+var (
+	streamClients = &gaugeFunc{name: "receipt_stream_clients",
+		help:  "Clients connected to /receipts/stream.",
+		value: func() float64 { return float64(receiptStream.clientCount()) }}
+	streamDisconnects = newCounterVec("receipt_stream_slow_disconnects_total",
+		"Clients of /receipts/stream disconnected for falling too far behind.")
+)
+
+// errStreamClosed is returned to clients connecting once the server shuts down.
+var errStreamClosed = errors.New("the receipt stream is closed")
+
+// receiptStream sends the processed receipts to the clients of /receipts/stream.
+var receiptStream = newStream(streamReplaySize)
+
+// streamReceipt is a processed receipt as /receipts/stream sends it.
+type streamReceipt struct {
+	ID          string    `json:"id"`
+	Retailer    string    `json:"retailer"`
+	Points      int       `json:"points"`
+	ProcessedAt time.Time `json:"processedAt"`
+	// Owner is the user who processed the receipt, who, with admins and callers
+	// without a user, may see it.
+	Owner string `json:"-"`
+}
+
+// streamEvent is a receipt numbered by when it was processed, the event ID clients
+// resume from.
+type streamEvent struct {
+	id      uint64
+	receipt streamReceipt
+}
+
+// stream fans events out to its clients, each through a buffer of its own, so one
+// slow client never holds up the others or the request publishing the event. It
+// keeps the most recent events in a ring, for clients resuming from one of them.
+type stream struct {
+	mu      sync.Mutex
+	seq     uint64
+	recent  []streamEvent
+	next    int
+	clients map[*streamClient]struct{}
+	closed  bool
+}
+
+// streamClient is a connected client, sent the receipts its user and admin may
+// see. done is closed when it must go: it fell behind, or the stream closed.
+type streamClient struct {
+	user   string
+	admin  bool
+	events chan streamEvent
+	done   chan struct{}
+}
+
+// sees reports whether the client may be sent event.
+func (c *streamClient) sees(event streamEvent) bool {
+	return mayAccess(c.user, c.admin, event.receipt.Owner)
+}
+
+func newStream(size int) *stream {
+	return &stream{recent: make([]streamEvent, 0, size), clients: make(map[*streamClient]struct{})}
+}
+
+// publish sends receipt to every client that may see it, disconnecting those whose
+// buffer is full.
+func (s *stream) publish(receipt streamReceipt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	event := streamEvent{id: s.seq, receipt: receipt}
+	if len(s.recent) < cap(s.recent) {
+		s.recent = append(s.recent, event)
+	} else {
+		s.recent[s.next] = event
+		s.next = (s.next + 1) % len(s.recent)
+	}
+	for client := range s.clients {
+		if !client.sees(event) {
+			continue
+		}
+		select {
+		case client.events <- event:
+		default:
+			streamDisconnects.inc()
+			s.removeLocked(client)
+		}
+	}
+}
+
+// subscribe connects a client of user, an admin if admin, returning it with the
+// recent events after lastID it may see, or none without a lastID this process
+// numbered.
+func (s *stream) subscribe(lastID, user string, admin bool) (*streamClient, []streamEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil, errStreamClosed
+	}
+	client := &streamClient{user: user, admin: admin, events: make(chan streamEvent, streamBufferSize), done: make(chan struct{})}
+	var replay []streamEvent
+	if after, err := strconv.ParseUint(lastID, 10, 64); err == nil && after <= s.seq {
+		for i := range s.recent {
+			if event := s.recent[(s.next+i)%len(s.recent)]; event.id > after && client.sees(event) {
+				replay = append(replay, event)
+			}
+		}
+	}
+	s.clients[client] = struct{}{}
+	return client, replay, nil
+}
+
+// unsubscribe disconnects client, if it is still connected.
+func (s *stream) unsubscribe(client *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(client)
+}
+
+func (s *stream) removeLocked(client *streamClient) {
+	if _, ok := s.clients[client]; ok {
+		delete(s.clients, client)
+		close(client.done)
+	}
+}
+
+// close disconnects every client and refuses new ones, so shutdown needn't wait for
+// streams that never end.
+func (s *stream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for client := range s.clients {
+		s.removeLocked(client)
+	}
+}
+
+func (s *stream) clientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// streamReceipts holds the connection open and sends each receipt processed that the
+// caller may see, as canAccess decides, as a Server-Sent Event, starting with those after the Last-Event-ID the client resumes
+// from, and a comment after every streamHeartbeat without one. It returns when the
+// client goes away, falls behind or the server shuts down.
+func streamReceipts(c *gin.Context) {
+	client, replay, err := receiptStream.subscribe(c.GetHeader("Last-Event-ID"), c.GetString("user"), c.GetBool("admin"))
+	if err != nil {
+		abortWithProblem(c, http.StatusServiceUnavailable, "SHUTTING_DOWN", err.Error())
+		return
+	}
+	defer receiptStream.unsubscribe(client)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Stops nginx buffering the events.
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	for _, event := range replay {
+		if writeStreamEvent(c, event) != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-client.done:
+			return
+		case event := <-client.events:
+			err = writeStreamEvent(c, event)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(c.Writer, ": heartbeat\n\n")
+		}
+		if err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeStreamEvent(c *gin.Context, event streamEvent) error {
+	data, err := json.Marshal(event.receipt)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: receipt\ndata: %s\n\n", event.id, data)
+	return err
+}
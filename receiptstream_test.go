@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveStream serves a router with a new receipt stream until the test ends, ending
+// the stream first so the server needn't wait on its clients.
+func serveStream(t *testing.T) *httptest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useAPIKeys(t, []apiKey{{ID: "dashboard", Key: "k-dashboard", Scopes: []string{scopeRead}}, {ID: "client", Key: "k-client", Scopes: []string{scopeWrite}}})
+	receiptStream = newStream(streamReplaySize)
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		receiptStream.close()
+		server.Close()
+		receiptStream = newStream(streamReplaySize)
+	})
+	return server
+}
+
+// sseEvent is an event or comment read from a stream.
+type sseEvent struct {
+	id, event, data, comment string
+}
+
+// openStream connects to /receipts/stream, resuming after lastID if given, and
+// returns the events read from it; the channel is closed when the stream ends.
+func openStream(t *testing.T, server *httptest.Server, lastID string) <-chan sseEvent {
+	t.Helper()
+	return openStreamAs(t, server, lastID, "X-API-Key", "k-dashboard")
+}
+
+// openStreamAs is openStream for the caller the credentials header names.
+func openStreamAs(t *testing.T, server *httptest.Server, lastID, header, credentials string) <-chan sseEvent {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/receipts/stream", nil)
+	req.Header.Set(header, credentials)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected a 200 event stream but got %v %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				events <- event
+				event = sseEvent{}
+				continue
+			}
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "":
+				event.comment = value
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				event.data = value
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent returns the next event of a stream, skipping heartbeats.
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("the stream ended")
+			}
+			if event.comment == "" {
+				return event
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+}
+
+// postReceipt processes the receipt with retailer over server, returning its ID.
+func postReceipt(t *testing.T, server *httptest.Server, retailer string) string {
+	t.Helper()
+	return postReceiptAs(t, server, retailer, "X-API-Key", "k-client")
+}
+
+// postReceiptAs is postReceipt for the caller the credentials header names.
+func postReceiptAs(t *testing.T, server *httptest.Server, retailer, header, credentials string) string {
+	t.Helper()
+	payload := strings.Replace(validReceiptPayload, `"Target"`, `"`+retailer+`"`, 1)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/receipts/process", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(header, credentials)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	defer resp.Body.Close()
+	var response struct {
+		ID string `json:"id"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&response) != nil {
+		t.Errorf("expected status 200 with an ID but got %v", resp.StatusCode)
+	}
+	return response.ID
+}
+
+func TestReceiptStream(t *testing.T) {
+	server := serveStream(t)
+	events := openStream(t, server, "")
+
+	var wg sync.WaitGroup
+	ids := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- postReceipt(t, server, "Target")
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	posted := make(map[string]bool)
+	for id := range ids {
+		posted[id] = true
+	}
+
+	for i := 1; i <= 10; i++ {
+		event := nextEvent(t, events)
+		var receipt streamReceipt
+		if err := json.Unmarshal([]byte(event.data), &receipt); err != nil {
+			t.Fatalf("expected a receipt but got %q", event.data)
+		}
+		if event.event != "receipt" || event.id != strconv.Itoa(i) {
+			t.Errorf("expected receipt event %d but got %+v", i, event)
+		}
+		if !posted[receipt.ID] || receipt.Retailer != "Target" || receipt.Points != 28 || receipt.ProcessedAt.IsZero() {
+			t.Errorf("expected a posted receipt but got %+v", receipt)
+		}
+		delete(posted, receipt.ID)
+	}
+	if len(posted) != 0 {
+		t.Errorf("expected every receipt to be streamed but %d weren't", len(posted))
+	}
+}
+
+func TestReceiptStreamResumes(t *testing.T) {
+	server := serveStream(t)
+	for _, retailer := range []string{"First", "Second", "Third"} {
+		postReceipt(t, server, retailer)
+	}
+
+	events := openStream(t, server, "1")
+	for _, expected := range []string{"Second", "Third"} {
+		var receipt streamReceipt
+		json.Unmarshal([]byte(nextEvent(t, events).data), &receipt)
+		if receipt.Retailer != expected {
+			t.Errorf("expected the %s receipt to be replayed but got %q", expected, receipt.Retailer)
+		}
+	}
+	postReceipt(t, server, "Fourth")
+	if event := nextEvent(t, events); event.id != "4" {
+		t.Errorf("expected event 4 after the replay but got %+v", event)
+	}
+
+	// An ID this process never gave out replays nothing.
+	events = openStream(t, server, "99")
+	postReceipt(t, server, "Fifth")
+	if event := nextEvent(t, events); event.id != "5" {
+		t.Errorf("expected only the new event but got %+v", event)
+	}
+}
+
+func TestReceiptStreamHeartbeat(t *testing.T) {
+	saved := streamHeartbeat
+	streamHeartbeat = 10 * time.Millisecond
+	t.Cleanup(func() { streamHeartbeat = saved })
+	server := serveStream(t)
+
+	events := openStream(t, server, "")
+	select {
+	case event := <-events:
+		if event.comment != "heartbeat" {
+			t.Errorf("expected a heartbeat but got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a heartbeat")
+	}
+}
+
+func TestReceiptStreamDisconnectsSlowClients(t *testing.T) {
+	s := newStream(streamReplaySize)
+	slow, _, _ := s.subscribe("", "", false)
+	fast, _, _ := s.subscribe("", "", false)
+	disconnects := streamDisconnects.value()
+
+	for i := 0; i <= streamBufferSize; i++ {
+		s.publish(streamReceipt{ID: strconv.Itoa(i)})
+		<-fast.events
+	}
+	select {
+	case <-slow.done:
+	default:
+		t.Error("expected the client that fell behind to be disconnected")
+	}
+	select {
+	case <-fast.done:
+		t.Error("expected the client that kept up to stay connected")
+	default:
+	}
+	if got := streamDisconnects.value(); got != disconnects+1 {
+		t.Errorf("expected one more slow disconnect but got %v", got-disconnects)
+	}
+	if s.clientCount() != 1 {
+		t.Errorf("expected one client left but got %d", s.clientCount())
+	}
+}
+
+func TestReceiptStreamEnds(t *testing.T) {
+	server := serveStream(t)
+	events := openStream(t, server, "")
+
+	// A client going away is disconnected.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/receipts/stream", nil)
+	req.Header.Set("X-API-Key", "k-dashboard")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "both clients to connect", func() bool { return receiptStream.clientCount() == 2 })
+	cancel()
+	resp.Body.Close()
+	waitFor(t, "the client to be disconnected", func() bool { return receiptStream.clientCount() == 1 })
+
+	// Shutting down ends the others.
+
+	receiptStream.close()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected the stream to end without an event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream to end")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/receipts/stream", nil)
+	req.Header.Set("X-API-Key", "k-dashboard")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 once the stream is closed but got %v", resp.StatusCode)
+	}
+}
+
+func TestReceiptStreamIsScopedToUsers(t *testing.T) {
+	server := serveStream(t)
+	useFakeClock(t, jwtNow)
+	key := generateKey(t)
+	useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+	alice := "Bearer " + userToken(t, key, "k1", "alice")
+	bob := "Bearer " + userToken(t, key, "k1", "bob")
+	aliceEvents := openStreamAs(t, server, "", "Authorization", alice)
+	bobEvents := openStreamAs(t, server, "", "Authorization", bob)
+	everything := openStream(t, server, "")
+
+	aliceID := postReceiptAs(t, server, "Alice Mart", "Authorization", alice)
+	bobID := postReceiptAs(t, server, "Bob Mart", "Authorization", bob)
+	aliceSecondID := postReceiptAs(t, server, "Alice Mart", "Authorization", alice)
+
+	// Each user is sent only their own receipts; an API key caller every one.
+	expected := map[string][]string{"alice": {aliceID, aliceSecondID}, "bob": {bobID}, "API key": {aliceID, bobID, aliceSecondID}}
+	for name, events := range map[string]<-chan sseEvent{"alice": aliceEvents, "bob": bobEvents, "API key": everything} {
+		for _, id := range expected[name] {
+			if event := nextEvent(t, events); !strings.Contains(event.data, `"id":"`+id+`"`) {
+				t.Errorf("%s: expected receipt %s but got %s", name, id, event.data)
+			}
+		}
+	}
+
+	// A user resuming is sent again only their own receipts: bob's next event after
+	// his replayed receipt is his new one, not either of alice's.
+	bobEvents = openStreamAs(t, server, "0", "Authorization", bob)
+	if event := nextEvent(t, bobEvents); !strings.Contains(event.data, `"id":"`+bobID+`"`) {
+		t.Errorf("expected bob's replay to start with his receipt but got %s", event.data)
+	}
+	bobSecondID := postReceiptAs(t, server, "Bob Mart", "Authorization", bob)
+	if event := nextEvent(t, bobEvents); !strings.Contains(event.data, `"id":"`+bobSecondID+`"`) {
+		t.Errorf("expected bob to be sent his new receipt next but got %s", event.data)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// activeEngine is the engine receipts are scored with. It is replaced as a whole on
+// reload, so a request that has loaded it finishes with the rules it started with.
+var activeEngine atomic.Pointer[Engine]
+
+func init() {
+	setRules(defaultRulesConfig())
+}
+
+// currentEngine returns the engine new requests should score with.
+func currentEngine() *Engine {
+	return activeEngine.Load()
+}
+
+// setRules builds an engine from config, which must have been validated, and makes it
+// the current engine.
+func setRules(config RulesConfig) *Engine {
+	engine := newEngine(config)
+	activeEngine.Store(engine)
+	return engine
+}
+
+// rulesConfigPath is the --rules-config file, read again on every reload.
+var rulesConfigPath string
+
+// reloadMu serializes reloads so the last one to read the config is the one in effect.
+var reloadMu sync.Mutex
+
+// reloadRules reads the rules config again, with the same environment and command
+// line overrides as at startup, and swaps in a new engine. On error the current
+// engine is kept.
+func reloadRules() (*Engine, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	config, err := resolveRulesConfig(rulesConfigPath, flag.CommandLine)
+	if err != nil {
+		return nil, err
+	}
+	return setRules(config), nil
+}
+
+// reloadOnSignal reloads the rules, the API keys, the signing secrets and the TLS
+// certificate each time a signal arrives on signals.
+func reloadOnSignal(signals <-chan os.Signal) {
+	for range signals {
+		if engine, err := reloadRules(); err != nil {
+			log.Printf("rules reload failed, keeping the current rules: %v", err)
+			recordAudit(auditEvent{Actor: "signal:SIGHUP", Action: auditRulesReloaded, Outcome: "failure"})
+		} else {
+			log.Printf("rules reloaded, config hash %s", engine.hash)
+			recordAudit(auditEvent{Actor: "signal:SIGHUP", Action: auditRulesReloaded, Target: engine.hash, Outcome: "success"})
+		}
+		if err := reloadAPIKeys(); err != nil {
+			log.Printf("API keys reload failed, keeping the current keys: %v", err)
+		} else if apiKeysFilePath != "" {
+			log.Printf("API keys reloaded, %d keys", len(currentAPIKeys()))
+		}
+		if err := reloadSigningSecrets(); err != nil {
+			log.Printf("signing secrets reload failed, keeping the current secrets: %v", err)
+		} else if signingSecretsFilePath != "" {
+			log.Printf("signing secrets reloaded, %d secrets", len(currentSigningSecrets()))
+		}
+		if certificate := serverCertificate.Load(); certificate != nil {
+			if err := certificate.reload(); err != nil {
+				log.Printf("TLS certificate reload failed, keeping the current certificate: %v", err)
+			} else {
+				log.Printf("TLS certificate reloaded from %s", certificate.certFile)
+			}
+		}
+	}
+}
+
+func reloadRulesHandler(c *gin.Context) {
+	engine, err := reloadRules()
+	if err != nil {
+		abortWithProblem(c, http.StatusUnprocessableEntity, "RULES_RELOAD_FAILED", err.Error())
+		return
+	}
+
+	c.Set("auditTarget", engine.hash)
+	c.JSON(http.StatusOK, gin.H{"hash": engine.hash, "loadedAt": engine.loadedAt})
+}
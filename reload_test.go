@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useRulesConfig points reloads at a config file with contents for the rest of the test.
+func useRulesConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := writeConfig(t, "rules.yaml", contents)
+	previousPath, previousConfig := rulesConfigPath, currentEngine().config
+	t.Cleanup(func() {
+		rulesConfigPath = previousPath
+		setRules(previousConfig)
+	})
+	rulesConfigPath = path
+	return path
+}
+
+func TestReloadRulesEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	path := useRulesConfig(t, "itemPairPoints: 10\n")
+	router := newRouter()
+	before := currentEngine()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/rules/reload", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %v but got %v: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var reloaded struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Hash == before.hash || reloaded.Hash != currentEngine().hash {
+		t.Errorf("expected a new config hash but got %q (was %q)", reloaded.Hash, before.hash)
+	}
+	if _, points := processAndScore(t, router, validReceiptPayload); points != 38 {
+		t.Errorf("expected 38 points with the reloaded rules but got %v", points)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/rules", nil))
+	var rulesBody struct {
+		Hash     string `json:"hash"`
+		LoadedAt string `json:"loadedAt"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &rulesBody); err != nil {
+		t.Fatal(err)
+	}
+	if rulesBody.Hash != reloaded.Hash || rulesBody.LoadedAt == "" {
+		t.Errorf("expected /rules to report hash %q and a load time but got %+v", reloaded.Hash, rulesBody)
+	}
+
+	// A broken config is reported and the rules loaded above stay in effect.
+	if err := os.WriteFile(path, []byte("itemPairPoints: 10\noddDayPoints: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/rules/reload", nil))
+	var body problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusUnprocessableEntity || body.Code != "RULES_RELOAD_FAILED" || !strings.HasSuffix(body.Detail, "rules.yaml:2: oddDayPoints must not be negative") {
+		t.Errorf("expected a RULES_RELOAD_FAILED problem naming the bad line but got %v %+v", rr.Code, body)
+	}
+	if currentEngine().hash != reloaded.Hash {
+		t.Errorf("expected the previous rules to be kept after a failed reload")
+	}
+	if _, points := processAndScore(t, router, validReceiptPayload); points != 38 {
+		t.Errorf("expected 38 points after a failed reload but got %v", points)
+	}
+}
+
+func TestReloadRulesOnSignal(t *testing.T) {
+	useRulesConfig(t, "disabledRules: [odd_day]\n")
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGHUP
+	close(signals)
+	reloadOnSignal(signals)
+
+	if currentEngine().config.ruleEnabled("odd_day") {
+		t.Errorf("expected odd_day to be disabled after SIGHUP")
+	}
+}
+
+// TestReloadUnderTraffic swaps the rules back and forth while receipts are being
+// scored. Run it with -race: every receipt must be scored entirely by one version of
+// the rules.
+func TestReloadUnderTraffic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	path := useRulesConfig(t, "itemPairPoints: 5\n")
+	router := newRouter()
+
+	// The example receipt has two item pairs, so it scores 28 with 5 points per pair
+	// and 38 with 10, and nothing in between.
+	expectedPairPoints := map[int]int{28: 10, 38: 20}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		contents := []string{"itemPairPoints: 10\n", "itemPairPoints: 5\n"}
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := os.WriteFile(path, []byte(contents[i%2]), 0o600); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := reloadRules(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := 0; j < 25; j++ {
+				rr := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(validReceiptPayload))
+				req.Header.Set("Content-Type", "application/json")
+				router.ServeHTTP(rr, req)
+				var created struct {
+					ID string `json:"id"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil || created.ID == "" {
+					t.Errorf("expected a receipt ID but got %s", rr.Body.String())
+					return
+				}
+
+				receiptsMu.RLock()
+				stored := receipts[created.ID]
+				receiptsMu.RUnlock()
+				pairPoints, ok := expectedPairPoints[stored.Points]
+				if !ok {
+					t.Errorf("expected 28 or 38 points but got %v", stored.Points)
+					continue
+				}
+				for _, entry := range stored.Breakdown {
+					if entry.Rule == "item_pairs" && entry.Points != pairPoints {
+						t.Errorf("expected item_pairs to be worth %v in a %v point receipt but got %v", pairPoints, stored.Points, entry.Points)
+					}
+				}
+
+				rr = httptest.NewRecorder()
+				router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/rules", nil))
+				if rr.Code != http.StatusOK {
+					t.Errorf("expected status %v from /rules but got %v", http.StatusOK, rr.Code)
+				}
+			}
+		}()
+	}
+	clients.Wait()
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BreakdownEntry explains the points one rule contributed to a receipt.
+type BreakdownEntry struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+	Detail string `json:"detail"`
+}
+
+// logicalItem is a line item as the rules see it. Without consolidation every receipt
+// line is its own logicalItem with a quantity of 1.
+type logicalItem struct {
+	Description string
+	Price       float64
+	PriceCents  int64
+	Quantity    int
+	UPC         string
+}
+
+// normalizeDescription returns the form of an item description used for scoring.
+func normalizeDescription(description string, config RulesConfig) string {
+	if !config.NormalizeDescriptions {
+		return description
+	}
+	description = strings.Join(strings.Fields(description), " ")
+	if config.UppercaseDescriptions {
+		description = strings.ToUpper(description)
+	}
+	return description
+}
+
+// logicalItems turns receipt lines into the items the rules score, consolidating
+// identical lines when the config asks for it. Order follows first appearance.
+func logicalItems(items []Item, config RulesConfig) []logicalItem {
+	logical := make([]logicalItem, 0, len(items))
+	seen := make(map[string]int)
+	for _, item := range items {
+		description := normalizeDescription(item.ShortDescription, config)
+		price, err := strconv.ParseFloat(item.Price, 64)
+		if err != nil {
+			// An unparseable price earns nothing, as before, but the line still counts.
+			logical = append(logical, logicalItem{Description: description, Quantity: 1, UPC: item.UPC})
+			continue
+		}
+
+		key := description + "\x00" + strconv.FormatFloat(price, 'f', 2, 64) + "\x00" + normalizeUPC(item.UPC)
+		if i, ok := seen[key]; ok && config.ConsolidateItems {
+			logical[i].Quantity++
+			continue
+		}
+		seen[key] = len(logical)
+		cents, _ := amountCents(item.Price)
+		logical = append(logical, logicalItem{Description: description, Price: price, PriceCents: cents, Quantity: 1, UPC: item.UPC})
+	}
+	return logical
+}
+
+// Rule 1: One point for every alphanumeric character in the retailer name.
+type retailerNameRule struct{}
+
+func (retailerNameRule) Name() string { return "retailer_name" }
+
+func (retailerNameRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	count := countAlphanumeric(receipt.Retailer)
+	if tr := receipt.trace; tr != nil {
+		tr.input("retailer", receipt.Retailer)
+		tr.step("alphanumericCharacters", count)
+	}
+	return count, fmt.Sprintf("%d alphanumeric characters in %q", count, receipt.Retailer)
+}
+
+// Rule 2: 50 points if the total is a round dollar amount.
+type roundTotalRule struct {
+	points int
+}
+
+func (roundTotalRule) Name() string { return "round_total" }
+
+func (r roundTotalRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	round := receipt.TotalOK && receipt.TotalValue == float64(int(receipt.TotalValue))
+	if tr := receipt.trace; tr != nil {
+		tr.input("total", receipt.Total)
+		tr.step("totalValue", receipt.TotalValue)
+		tr.step("totalParsed", receipt.TotalOK)
+		tr.step("roundDollarAmount", round)
+	}
+	if round {
+		return r.points, receipt.Total + " is a round dollar amount"
+	}
+	return 0, receipt.Total + " is not a round dollar amount"
+}
+
+// Rule 3: 25 points if the total is a multiple of 0.25.
+type quarterMultipleRule struct {
+	points int
+}
+
+func (quarterMultipleRule) Name() string { return "quarter_multiple" }
+
+func (r quarterMultipleRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	remainder := math.Mod(receipt.TotalValue*100, 25)
+	if tr := receipt.trace; tr != nil {
+		tr.input("total", receipt.Total)
+		tr.step("totalValue * 100 mod 25", remainder)
+	}
+	if remainder == 0 {
+		return r.points, receipt.Total + " is a multiple of 0.25"
+	}
+	return 0, receipt.Total + " is not a multiple of 0.25"
+}
+
+// Rule 4: 5 points for every two items on the receipt.
+type itemPairsRule struct {
+	pointsPerPair int
+}
+
+func (itemPairsRule) Name() string { return "item_pairs" }
+
+func (r itemPairsRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	pairs := len(receipt.Items) / 2
+	if tr := receipt.trace; tr != nil {
+		tr.input("items", len(receipt.Items))
+		tr.step("pairs", pairs)
+	}
+	return pairs * r.pointsPerPair, fmt.Sprintf("%d items make %d pairs", len(receipt.Items), pairs)
+}
+
+// Ways of rounding the description-length bonus to whole points.
+const (
+	roundCeil     = "ceil"
+	roundFloor    = "floor"
+	roundHalfUp   = "half-up"
+	roundHalfEven = "half-even"
+)
+
+var roundingModes = []string{roundCeil, roundFloor, roundHalfUp, roundHalfEven}
+
+// roundRat rounds x to an integer by mode. half-up rounds ties toward positive
+// infinity and half-even to the even neighbour.
+func roundRat(x *big.Rat, mode string) int64 {
+	floor, rem := new(big.Int).DivMod(x.Num(), x.Denom(), new(big.Int))
+	if rem.Sign() == 0 {
+		return floor.Int64()
+	}
+	// rem is now in (0, denom), so compare twice the remainder with the denominator to
+	// tell which side of the half x is on.
+	half := new(big.Int).Lsh(rem, 1).Cmp(x.Denom())
+	up := false
+	switch mode {
+	case roundFloor:
+	case roundHalfUp:
+		up = half >= 0
+	case roundHalfEven:
+		up = half > 0 || half == 0 && floor.Bit(0) == 1
+	default:
+		up = true
+	}
+	if up {
+		floor.Add(floor, big.NewInt(1))
+	}
+	return floor.Int64()
+}
+
+// Rule 5: Multiply the price by 0.2 and round up to the nearest integer if the trimmed
+// length of the item description is a multiple of 3. The result is the number of points
+// earned. The multiplier and rounding mode are configurable. The product is computed
+// exactly from the price in cents, so 35.00 * 0.2 is exactly 7 and rounds up to 7.
+type descriptionLengthRule struct {
+	multiplier float64
+	// factor is multiplier as the exact decimal it is written as, divided by 100 to
+	// apply to cents.
+	factor   *big.Rat
+	rounding string
+}
+
+// newDescriptionLengthRule builds the description-length rule from a validated
+// multiplier and rounding mode.
+func newDescriptionLengthRule(multiplier float64, rounding string) descriptionLengthRule {
+	factor, _ := new(big.Rat).SetString(strconv.FormatFloat(multiplier, 'g', -1, 64))
+	if factor == nil {
+		factor = new(big.Rat)
+	}
+	if rounding == "" {
+		rounding = roundCeil
+	}
+	return descriptionLengthRule{multiplier: multiplier, factor: factor.Quo(factor, big.NewRat(100, 1)), rounding: rounding}
+}
+
+func (descriptionLengthRule) Name() string { return "description_length" }
+
+func (r descriptionLengthRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	tr := receipt.trace
+	if tr != nil {
+		tr.input("multiplier", r.multiplier)
+		tr.input("rounding", r.rounding)
+	}
+	points := 0
+	var details []string
+	for i, item := range receipt.Items {
+		trimmedLength := len(strings.TrimSpace(item.Description))
+		if tr != nil {
+			prefix := fmt.Sprintf("items[%d].", i)
+			tr.input(prefix+"description", item.Description)
+			tr.input(prefix+"priceCents", item.PriceCents)
+			tr.input(prefix+"quantity", item.Quantity)
+			tr.step(prefix+"trimmedLength", trimmedLength)
+			tr.step(prefix+"trimmedLength mod 3", trimmedLength%3)
+		}
+		if trimmedLength%3 != 0 {
+			continue
+		}
+		cents := item.PriceCents * int64(item.Quantity)
+		product := new(big.Rat).Mul(big.NewRat(cents, 1), r.factor)
+		earned := int(roundRat(product, r.rounding))
+		if tr != nil {
+			prefix := fmt.Sprintf("items[%d].", i)
+			tr.step(prefix+"cents", cents)
+			tr.step(prefix+"product", product.FloatString(4))
+			tr.step(prefix+"points", earned)
+		}
+		points += earned
+		details = append(details, fmt.Sprintf("%q has %d characters: %s(%s * %g) = %d", item.Description, trimmedLength, r.rounding, formatCents(cents), r.multiplier, earned))
+	}
+	if len(details) == 0 {
+		return 0, "no description length is a multiple of 3"
+	}
+	return points, strings.Join(details, "; ")
+}
+
+// Rule 6: 6 points if the day in the purchase date is odd.
+type oddDayRule struct {
+	points int
+}
+
+func (oddDayRule) Name() string { return "odd_day" }
+
+func (r oddDayRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	if tr := receipt.trace; tr != nil {
+		tr.input("purchaseDate", receipt.PurchaseDate)
+		tr.step("dayParsed", receipt.DayOK)
+		if receipt.DayOK {
+			tr.step("day mod 2", receipt.Day%2)
+		}
+	}
+	if !receipt.DayOK {
+		return 0, fmt.Sprintf("no day in purchase date %q", receipt.PurchaseDate)
+	}
+	if receipt.Day%2 != 0 {
+		return r.points, fmt.Sprintf("day %d is odd", receipt.Day)
+	}
+	return 0, fmt.Sprintf("day %d is not odd", receipt.Day)
+}
+
+// Rule 7: 10 points if the time of purchase is after 2:00pm and before 4:00pm, or in
+// the configured window, which may cross midnight. start and end are the window's
+// bounds in minutes after midnight.
+type afternoonPurchaseRule struct {
+	window     TimeWindow
+	start, end int
+}
+
+func (afternoonPurchaseRule) Name() string { return "afternoon_purchase" }
+
+func (r afternoonPurchaseRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	between := " between " + r.window.Start + " and " + r.window.End
+	inWindow := receipt.TimeOK && r.window.contains(receipt.PurchaseMinutes, r.start, r.end)
+	if tr := receipt.trace; tr != nil {
+		tr.input("purchaseTime", receipt.PurchaseTime)
+		tr.step("timeParsed", receipt.TimeOK)
+		tr.step("purchaseMinutes", receipt.PurchaseMinutes)
+		tr.step("windowStartMinutes", r.start)
+		tr.step("windowEndMinutes", r.end)
+		tr.step("crossesMidnight", r.window.CrossesMidnight)
+		tr.step("inWindow", inWindow)
+	}
+	if inWindow {
+		return r.window.Points, receipt.PurchaseTime + " is" + between
+	}
+	return 0, receipt.PurchaseTime + " is not" + between
+}
+
+// Rule 8: Configurable points if the purchase falls on one of the bonus days of the
+// week. The weekday is that of the purchase date as printed, unless the bonus has its
+// own time zone and the receipt says which zone it was printed in.
+type dayOfWeekRule struct {
+	points   int
+	days     map[time.Weekday]bool
+	location *time.Location
+}
+
+func (dayOfWeekRule) Name() string { return "day_of_week" }
+
+func (r dayOfWeekRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	tr := receipt.trace
+	if tr != nil {
+		tr.input("purchaseDate", receipt.PurchaseDate)
+		tr.input("purchaseTime", receipt.PurchaseTime)
+		if receipt.Location != nil {
+			tr.input("timezone", receipt.Location.String())
+		}
+	}
+	if len(r.days) == 0 || r.points == 0 {
+		return 0, "no bonus days are configured"
+	}
+	if !receipt.WeekdayOK {
+		return 0, fmt.Sprintf("%q is not a valid date", receipt.PurchaseDate)
+	}
+
+	day := receipt.Weekday
+	if r.location != nil && receipt.Location != nil && receipt.PurchasedAtOK {
+		local := receipt.PurchasedAt
+		instant := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), 0, 0, receipt.Location)
+		day = instant.In(r.location).Weekday()
+		if tr != nil {
+			tr.step("convertedTo", r.location.String())
+		}
+	}
+	if tr != nil {
+		tr.step("weekday", day.String())
+	}
+	if r.days[day] {
+		return r.points, fmt.Sprintf("%s is a bonus day", day)
+	}
+	return 0, fmt.Sprintf("%s is not a bonus day", day)
+}
+
+// parseWeekday parses an English day name such as "SATURDAY", ignoring case.
+func parseWeekday(name string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// Rule 9: Configurable points if the purchase date is a holiday, either one of the
+// listed dates or a recurring month and day.
+type holidayRule struct {
+	bonus HolidayBonus
+}
+
+func (holidayRule) Name() string { return "holiday" }
+
+func (r holidayRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	if len(r.bonus.Dates)+len(r.bonus.Recurring) == 0 || r.bonus.Points == 0 {
+		return 0, "no holidays are configured"
+	}
+
+	matched := ""
+	if containsString(r.bonus.Dates, receipt.PurchaseDate) {
+		matched = receipt.PurchaseDate
+	} else if receipt.WeekdayOK && containsString(r.bonus.Recurring, receipt.PurchaseDate[5:]) {
+		matched = receipt.PurchaseDate[5:]
+	}
+	if tr := receipt.trace; tr != nil {
+		tr.input("purchaseDate", receipt.PurchaseDate)
+		tr.step("matched", matched)
+	}
+	if matched == "" {
+		return 0, receipt.PurchaseDate + " is not a holiday"
+	}
+	if name := r.bonus.Names[matched]; name != "" {
+		return r.bonus.Points, fmt.Sprintf("%s is a holiday: %s", receipt.PurchaseDate, name)
+	}
+	return r.bonus.Points, receipt.PurchaseDate + " is a holiday"
+}
+
+// Rule 11: Configurable points if the receipt was processed within a window, such as
+// 24 hours, of its purchase. location is the zone of purchase times for receipts that
+// don't give one.
+type promptSubmissionRule struct {
+	points   int
+	window   time.Duration
+	location *time.Location
+}
+
+func (promptSubmissionRule) Name() string { return "prompt_submission" }
+
+func (r promptSubmissionRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	if r.points == 0 {
+		return 0, "no prompt submission bonus is configured"
+	}
+	if !receipt.PurchasedAtOK {
+		return 0, fmt.Sprintf("%q %q is not a valid purchase time", receipt.PurchaseDate, receipt.PurchaseTime)
+	}
+	if receipt.ProcessedAt.IsZero() {
+		return 0, "the processing time is unknown"
+	}
+
+	location := r.location
+	if receipt.Location != nil {
+		location = receipt.Location
+	}
+	local := receipt.PurchasedAt
+	purchased := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), 0, 0, location)
+	elapsed := receipt.ProcessedAt.Sub(purchased)
+	if tr := receipt.trace; tr != nil {
+		tr.input("purchasedAt", purchased.Format(time.RFC3339))
+		tr.input("processedAt", receipt.ProcessedAt.Format(time.RFC3339))
+		tr.step("elapsed", elapsed.String())
+	}
+
+	switch {
+	case elapsed < 0:
+		return 0, fmt.Sprintf("purchased %s after processing", (-elapsed).Round(time.Second))
+	case elapsed <= r.window:
+		return r.points, fmt.Sprintf("processed %s after purchase, within %s", elapsed.Round(time.Second), r.window)
+	default:
+		return 0, fmt.Sprintf("processed %s after purchase, not within %s", elapsed.Round(time.Second), r.window)
+	}
+}
+
+// Rule 12: Configurable points for the highest item-count threshold the receipt
+// reaches. Consolidated items count once per unit.
+type itemCountRule struct {
+	bonuses []ItemCountBonus
+}
+
+func (itemCountRule) Name() string { return "item_count" }
+
+func (r itemCountRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	if len(r.bonuses) == 0 {
+		return 0, "no item count bonuses are configured"
+	}
+
+	count := 0
+	for _, item := range receipt.Items {
+		count += item.Quantity
+	}
+	// The thresholds are validated to be increasing, so the last one reached is the
+	// highest.
+	matched := -1
+	for i, bonus := range r.bonuses {
+		if count >= bonus.MinItems {
+			matched = i
+		}
+	}
+	tr := receipt.trace
+	if tr != nil {
+		tr.input("items", count)
+	}
+
+	if matched < 0 {
+		return 0, fmt.Sprintf("%d items are below the first threshold of %d", count, r.bonuses[0].MinItems)
+	}
+	bonus := r.bonuses[matched]
+	if tr != nil {
+		tr.step("threshold", bonus.MinItems)
+	}
+	return bonus.Points, fmt.Sprintf("%d items reach the threshold of %d items", count, bonus.MinItems)
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizeDescription(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		config   RulesConfig
+		expected string
+	}{
+		{name: "Clean", input: "Klarbrunn 12-PK 12 FL OZ", config: defaultRulesConfig(), expected: "Klarbrunn 12-PK 12 FL OZ"},
+		{name: "Padded", input: "   Klarbrunn 12-PK 12 FL OZ  ", config: defaultRulesConfig(), expected: "Klarbrunn 12-PK 12 FL OZ"},
+		{name: "InternalRuns", input: "  Klarbrunn  12-PK   12 FL OZ ", config: defaultRulesConfig(), expected: "Klarbrunn 12-PK 12 FL OZ"},
+		{name: "TabsAndNewlines", input: "Klarbrunn\t12-PK\n12 FL OZ", config: defaultRulesConfig(), expected: "Klarbrunn 12-PK 12 FL OZ"},
+		{name: "Uppercase", input: " Emils  Cheese Pizza", config: RulesConfig{NormalizeDescriptions: true, UppercaseDescriptions: true}, expected: "EMILS CHEESE PIZZA"},
+		{name: "Disabled", input: "  Klarbrunn  12-PK ", config: RulesConfig{}, expected: "  Klarbrunn  12-PK "},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeDescription(tc.input, tc.config); got != tc.expected {
+				t.Errorf("expected %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// processAndScore posts a receipt through the router and returns its ID and points.
+func processAndScore(t *testing.T, router *gin.Engine, payload string) (string, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %v but got %v: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+processed.ID+"/points", nil))
+	var points struct {
+		Points int `json:"points"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &points); err != nil {
+		t.Fatal(err)
+	}
+	return processed.ID, points.Points
+}
+
+func TestNormalizedDescriptionsScoreLikeCleanOnes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	receiptWith := func(description string) string {
+		return `{
+			"retailer": "Target",
+			"total": "12.00",
+			"items": [{"shortDescription": "` + description + `", "price": "12.00"}],
+			"purchaseDate": "2022-01-02",
+			"purchaseTime": "13:01"
+		}`
+	}
+
+	testCases := []struct {
+		messy string
+		clean string
+	}{
+		{messy: `  Klarbrunn  12-PK   12 FL OZ `, clean: `Klarbrunn 12-PK 12 FL OZ`},
+		{messy: `Emils   Cheese Pizza`, clean: `Emils Cheese Pizza`},
+		{messy: `\tDoritos \n Nacho  Cheese`, clean: `Doritos Nacho Cheese`},
+		{messy: `Mountain    Dew`, clean: `Mountain Dew`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.clean, func(t *testing.T) {
+			_, cleanPoints := processAndScore(t, router, receiptWith(tc.clean))
+			id, messyPoints := processAndScore(t, router, receiptWith(tc.messy))
+			if messyPoints != cleanPoints {
+				t.Errorf("expected %v points for %q but got %v", cleanPoints, tc.messy, messyPoints)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+id, nil))
+			var stored Receipt
+			if err := json.Unmarshal(rr.Body.Bytes(), &stored); err != nil {
+				t.Fatal(err)
+			}
+			var raw string
+			if err := json.Unmarshal([]byte(`"`+tc.messy+`"`), &raw); err != nil {
+				t.Fatal(err)
+			}
+			if stored.Items[0].ShortDescription != raw {
+				t.Errorf("expected the raw description %q but got %q", raw, stored.Items[0].ShortDescription)
+			}
+			if strings.Contains(rr.Body.String(), "ormalized") {
+				t.Errorf("expected the normalized description to stay internal but got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestNormalizationCanBeDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	router := newRouter()
+
+	// "Klarbrunn  12-PK" is 16 characters as sent but 15 once collapsed, which makes it
+	// eligible for the description bonus of ceil(12.00 * 0.2) = 3 points.
+	payload := `{
+		"retailer": "Target",
+		"total": "12.00",
+		"items": [{"shortDescription": "Klarbrunn  12-PK", "price": "12.00"}],
+		"purchaseDate": "2022-01-02",
+		"purchaseTime": "13:01"
+	}`
+
+	_, normalized := processAndScore(t, router, payload)
+	config := defaultRulesConfig()
+	config.NormalizeDescriptions = false
+	setRules(config)
+	_, raw := processAndScore(t, router, payload)
+	if normalized-raw != 3 {
+		t.Errorf("expected normalization to be worth 3 points but got %v vs %v", normalized, raw)
+	}
+}
+
+func TestConsolidateItems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	router := newRouter()
+
+	items := strings.Repeat(`{"shortDescription": "BANANA", "price": "0.23"},`, 10)
+	payload := `{
+		"retailer": "Target",
+		"total": "3.30",
+		"items": [` + items + `{"shortDescription": "  banana ", "price": "1.00"}],
+		"purchaseDate": "2022-01-02",
+		"purchaseTime": "13:01"
+	}`
+
+	// Raw: 6 (retailer) + 5 pairs * 5 + 10 * ceil(0.23 * 0.2) + ceil(1.00 * 0.2) = 42.
+	_, raw := processAndScore(t, router, payload)
+	if raw != 42 {
+		t.Errorf("expected 42 points without consolidation but got %v", raw)
+	}
+
+	// Consolidated: 6 (retailer) + 1 pair * 5 + ceil(2.30 * 0.2) + ceil(1.00 * 0.2) = 13.
+	config := defaultRulesConfig()
+	config.ConsolidateItems = true
+	setRules(config)
+	id, consolidated := processAndScore(t, router, payload)
+	if consolidated != 13 {
+		t.Errorf("expected 13 points with consolidation but got %v", consolidated)
+	}
+
+	receiptsMu.RLock()
+	stored := receipts[id]
+	receiptsMu.RUnlock()
+	if len(stored.Receipt.Items) != 11 {
+		t.Errorf("expected the stored receipt to keep all 11 lines but got %v", len(stored.Receipt.Items))
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/breakdown", nil))
+	var breakdown struct {
+		Points    int              `json:"points"`
+		Breakdown []BreakdownEntry `json:"breakdown"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &breakdown); err != nil {
+		t.Fatal(err)
+	}
+	expected := BreakdownEntry{Rule: "consolidated_items", Points: 0, Detail: "11 lines consolidated into 2 items"}
+	if len(breakdown.Breakdown) == 0 || breakdown.Breakdown[0] != expected {
+		t.Errorf("expected the breakdown to start with %+v but got %+v", expected, breakdown.Breakdown)
+	}
+}
+
+func TestBreakdownAddsUpToPoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	id, points := processAndScore(t, router, validReceiptPayload)
+	if points != 28 {
+		t.Errorf("expected 28 points but got %v", points)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/breakdown", nil))
+	var breakdown struct {
+		Points    int              `json:"points"`
+		Breakdown []BreakdownEntry `json:"breakdown"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &breakdown); err != nil {
+		t.Fatal(err)
+	}
+	sum := 0
+	for _, entry := range breakdown.Breakdown {
+		sum += entry.Points
+	}
+	if breakdown.Points != points || sum != points {
+		t.Errorf("expected a breakdown adding up to %v but got %v summing to %v", points, breakdown.Points, sum)
+	}
+	if len(breakdown.Breakdown) != 12 {
+		t.Errorf("expected one entry per rule but got %+v", breakdown.Breakdown)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/unknown/breakdown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %v but got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestMinimumTotal(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	config := defaultRulesConfig()
+	config.MinimumTotalCents = 100
+	setRules(config)
+	router := newRouter()
+
+	receiptWith := func(total string) string {
+		return `{
+			"retailer": "Target",
+			"total": "` + total + `",
+			"items": [{"shortDescription": "Gum", "price": "` + total + `"}],
+			"purchaseDate": "2022-01-02",
+			"purchaseTime": "13:01"
+		}`
+	}
+
+	testCases := []struct {
+		total          string
+		expectedPoints int
+	}{
+		{total: "0.99", expectedPoints: 0},
+		// 6 (retailer) + 50 (round) + 25 (quarter) + ceil(1.00 * 0.2)
+		{total: "1.00", expectedPoints: 82},
+		// 6 (retailer) + ceil(1.01 * 0.2)
+		{total: "1.01", expectedPoints: 7},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.total, func(t *testing.T) {
+			id, points := processAndScore(t, router, receiptWith(tc.total))
+			if points != tc.expectedPoints {
+				t.Errorf("expected %v points but got %v", tc.expectedPoints, points)
+			}
+
+			receiptsMu.RLock()
+			stored, ok := receipts[id]
+			receiptsMu.RUnlock()
+			if !ok {
+				t.Fatal("expected the receipt to be stored")
+			}
+			belowMinimum := len(stored.Breakdown) == 1 && stored.Breakdown[0].Rule == "below_minimum_total"
+			if belowMinimum != (tc.expectedPoints == 0) {
+				t.Errorf("expected a below_minimum_total entry only below the minimum but got %+v", stored.Breakdown)
+			}
+		})
+	}
+}
+
+func TestMaxPointsPerReceipt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	router := newRouter()
+
+	payload, err := json.Marshal(exampleReceipts["target"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The target receipt scores 28 points.
+	testCases := []struct {
+		name           string
+		limit          int
+		expectedPoints int
+		expectedCap    *BreakdownEntry
+	}{
+		{name: "Unlimited", limit: 0, expectedPoints: 28},
+		{name: "AtCap", limit: 28, expectedPoints: 28},
+		{name: "OverCap", limit: 27, expectedPoints: 27, expectedCap: &BreakdownEntry{
+			Rule:   "cap_applied",
+			Points: -1,
+			Detail: "28 points capped at the maximum of 27 per receipt",
+		}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			config := defaultRulesConfig()
+			config.MaxPointsPerReceipt = tc.limit
+			setRules(config)
+
+			id, points := processAndScore(t, router, string(payload))
+			if points != tc.expectedPoints {
+				t.Errorf("expected %v points but got %v", tc.expectedPoints, points)
+			}
+
+			receiptsMu.RLock()
+			stored := receipts[id]
+			receiptsMu.RUnlock()
+			if stored.Points != tc.expectedPoints {
+				t.Errorf("expected %v stored points but got %v", tc.expectedPoints, stored.Points)
+			}
+			last := stored.Breakdown[len(stored.Breakdown)-1]
+			if tc.expectedCap == nil && last.Rule == "cap_applied" {
+				t.Errorf("expected no cap_applied entry but got %+v", last)
+			}
+			if tc.expectedCap != nil && last != *tc.expectedCap {
+				t.Errorf("expected %+v but got %+v", *tc.expectedCap, last)
+			}
+		})
+	}
+
+	// Scoring again uses the cap in effect at the time.
+	config := defaultRulesConfig()
+	config.MaxPointsPerReceipt = 10
+	setRules(config)
+	if points := calculatePoints(exampleReceipts["target"]); points != 10 {
+		t.Errorf("expected the current cap of 10 points but got %v", points)
+	}
+}
+
+// evaluate runs the named rule, configured with the defaults, over a receipt parsed
+// with the default config.
+func evaluate(name string, receipt Receipt) int {
+	return evaluateWith(defaultRulesConfig(), name, receipt)
+}
+
+// evaluateWith runs the named rule configured by config over a receipt parsed with it.
+func evaluateWith(config RulesConfig, name string, receipt Receipt) int {
+	for _, rule := range newEngine(config).rules {
+		if rule.Name() == name {
+			points, _ := rule.Evaluate(parseReceipt(receipt, config))
+			return points
+		}
+	}
+	panic("no rule named " + name)
+}
+
+func TestRetailerNameRule(t *testing.T) {
+	testCases := map[string]int{"Target": 6, "M&M Corner Market": 14, "": 0, "7-Eleven": 7, "Café": 3}
+	for retailer, expected := range testCases {
+		if got := evaluate("retailer_name", Receipt{Retailer: retailer}); got != expected {
+			t.Errorf("expected %v points for %q but got %v", expected, retailer, got)
+		}
+	}
+}
+
+func TestRoundTotalRule(t *testing.T) {
+	testCases := map[string]int{"9.00": 50, "9": 50, "9.01": 0, "0.00": 50, "abc": 0}
+	for total, expected := range testCases {
+		if got := evaluate("round_total", Receipt{Total: total}); got != expected {
+			t.Errorf("expected %v points for %q but got %v", expected, total, got)
+		}
+	}
+}
+
+func TestQuarterMultipleRule(t *testing.T) {
+	testCases := map[string]int{"9.00": 25, "9.25": 25, "9.50": 25, "9.75": 25, "9.10": 0, "35.35": 0}
+	for total, expected := range testCases {
+		if got := evaluate("quarter_multiple", Receipt{Total: total}); got != expected {
+			t.Errorf("expected %v points for %q but got %v", expected, total, got)
+		}
+	}
+}
+
+func TestItemPairsRule(t *testing.T) {
+	for count, expected := range map[int]int{1: 0, 2: 5, 3: 5, 4: 10, 5: 10} {
+		items := make([]Item, count)
+		for i := range items {
+			items[i] = Item{ShortDescription: "x", Price: "1.00"}
+		}
+		if got := evaluate("item_pairs", Receipt{Items: items}); got != expected {
+			t.Errorf("expected %v points for %v items but got %v", expected, count, got)
+		}
+	}
+}
+
+func TestDescriptionLengthRule(t *testing.T) {
+	testCases := []struct {
+		item     Item
+		expected int
+	}{
+		{item: Item{ShortDescription: "Emils Cheese Pizza", Price: "12.25"}, expected: 3},
+		{item: Item{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"}, expected: 3},
+		{item: Item{ShortDescription: "Gatorade", Price: "2.25"}, expected: 0},
+		{item: Item{ShortDescription: "Gum", Price: "0.01"}, expected: 1},
+		{item: Item{ShortDescription: "Gum", Price: "5.00"}, expected: 1},
+	}
+	for _, tc := range testCases {
+		if got := evaluate("description_length", Receipt{Items: []Item{tc.item}}); got != tc.expected {
+			t.Errorf("expected %v points for %+v but got %v", tc.expected, tc.item, got)
+		}
+	}
+}
+
+func TestDescriptionRounding(t *testing.T) {
+	// Points for one "Gum" item under ceil, floor, half-up and half-even.
+	testCases := []struct {
+		price    string
+		expected [4]int
+	}{
+		// 0.5 exactly.
+		{price: "2.50", expected: [4]int{1, 0, 1, 0}},
+		// 0.498 is just under the half.
+		{price: "2.49", expected: [4]int{1, 0, 0, 0}},
+		// 0.502 is just over it.
+		{price: "2.51", expected: [4]int{1, 0, 1, 1}},
+		// 2.45.
+		{price: "12.25", expected: [4]int{3, 2, 2, 2}},
+		// 2.5 rounds to the even 2, 1.5 to the even 2.
+		{price: "12.50", expected: [4]int{3, 2, 3, 2}},
+		{price: "7.50", expected: [4]int{2, 1, 2, 2}},
+		// float64 makes 35.00 * 0.2 7.000000000000001, which would ceil to 8.
+		{price: "35.00", expected: [4]int{7, 7, 7, 7}},
+		{price: "0.01", expected: [4]int{1, 0, 0, 0}},
+	}
+
+	for i, mode := range roundingModes {
+		mode, i := mode, i
+		t.Run(mode, func(t *testing.T) {
+			config := defaultRulesConfig()
+			config.DescriptionRounding = mode
+			for _, tc := range testCases {
+				receipt := Receipt{Items: []Item{{ShortDescription: "Gum", Price: tc.price}}}
+				if got := evaluateWith(config, "description_length", receipt); got != tc.expected[i] {
+					t.Errorf("expected %v points for %s but got %v", tc.expected[i], tc.price, got)
+				}
+			}
+		})
+	}
+
+	config := defaultRulesConfig()
+	config.DescriptionRounding = roundHalfEven
+	_, breakdown := scoreReceipt(Receipt{Items: []Item{{ShortDescription: "Gum", Price: "12.50"}}}, config)
+	expected := BreakdownEntry{Rule: "description_length", Points: 2, Detail: `"Gum" has 3 characters: half-even(12.50 * 0.2) = 2`}
+	if breakdown[4] != expected {
+		t.Errorf("expected %+v but got %+v", expected, breakdown[4])
+	}
+
+	gin.SetMode(gin.TestMode)
+	defer setRules(currentEngine().config)
+	setRules(config)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/rules", nil))
+	var body struct {
+		Config struct {
+			DescriptionRounding string `json:"descriptionRounding"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Config.DescriptionRounding != roundHalfEven {
+		t.Errorf("expected /rules to report half-even but got %q", body.Config.DescriptionRounding)
+	}
+}
+
+func TestOddDayRule(t *testing.T) {
+	testCases := map[string]int{"2022-01-01": 6, "2022-03-20": 0, "2022-12-31": 6, "2022-01": 0, "": 0}
+	for date, expected := range testCases {
+		if got := evaluate("odd_day", Receipt{PurchaseDate: date}); got != expected {
+			t.Errorf("expected %v points for %q but got %v", expected, date, got)
+		}
+	}
+}
+
+func TestAfternoonPurchaseRule(t *testing.T) {
+	testCases := map[string]int{"13:59": 0, "14:00": 10, "14:33": 10, "15:59": 10, "16:00": 0, "": 0, "14": 0}
+	for purchaseTime, expected := range testCases {
+		if got := evaluate("afternoon_purchase", Receipt{PurchaseTime: purchaseTime}); got != expected {
+			t.Errorf("expected %v points for %q but got %v", expected, purchaseTime, got)
+		}
+	}
+}
+
+func TestConfiguredPurchaseWindow(t *testing.T) {
+	testCases := []struct {
+		name     string
+		window   TimeWindow
+		expected map[string]int
+	}{
+		{
+			name:     "MorningRush",
+			window:   TimeWindow{Start: "07:00", End: "09:30", Points: 12},
+			expected: map[string]int{"06:59": 0, "07:00": 12, "08:15": 12, "09:29": 12, "09:30": 0, "14:30": 0},
+		},
+		{
+			name:     "CrossesMidnight",
+			window:   TimeWindow{Start: "22:00", End: "02:00", Points: 10, CrossesMidnight: true},
+			expected: map[string]int{"21:59": 0, "22:00": 10, "23:59": 10, "00:00": 10, "01:59": 10, "02:00": 0, "14:30": 0},
+		},
+		{
+			name:     "EndsAtMidnight",
+			window:   TimeWindow{Start: "23:00", End: "00:00", Points: 10, CrossesMidnight: true},
+			expected: map[string]int{"22:59": 0, "23:00": 10, "23:59": 10, "00:00": 0, "00:01": 0},
+		},
+		{
+			name:     "StartsAtMidnight",
+			window:   TimeWindow{Start: "00:00", End: "01:00", Points: 10},
+			expected: map[string]int{"23:59": 0, "00:00": 10, "00:59": 10, "01:00": 0},
+		},
+		{
+			name:     "AllButOneMinute",
+			window:   TimeWindow{Start: "00:01", End: "00:00", Points: 10, CrossesMidnight: true},
+			expected: map[string]int{"00:00": 0, "00:01": 10, "12:00": 10, "23:59": 10},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := defaultRulesConfig()
+			config.AfternoonBonus = tc.window
+			if field, msg := validateRulesConfig(config); msg != "" {
+				t.Fatalf("expected a valid window but got %s %s", field, msg)
+			}
+			for purchaseTime, expected := range tc.expected {
+				if got := evaluateWith(config, "afternoon_purchase", Receipt{PurchaseTime: purchaseTime}); got != expected {
+					t.Errorf("expected %v points for %s but got %v", expected, purchaseTime, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDayOfWeekRule(t *testing.T) {
+	// 2022-01-02 is a Sunday.
+	dates := []string{"2022-01-02", "2022-01-03", "2022-01-04", "2022-01-05", "2022-01-06", "2022-01-07", "2022-01-08"}
+	days := []string{"SUNDAY", "MONDAY", "TUESDAY", "WEDNESDAY", "THURSDAY", "FRIDAY", "SATURDAY"}
+
+	for i, bonusDay := range days {
+		t.Run(bonusDay, func(t *testing.T) {
+			config := defaultRulesConfig()
+			config.DayOfWeekBonus = DayOfWeekBonus{Days: []string{bonusDay}, Points: 15}
+			for j, date := range dates {
+				expected := 0
+				if i == j {
+					expected = 15
+				}
+				if got := evaluateWith(config, "day_of_week", Receipt{PurchaseDate: date, PurchaseTime: "12:00"}); got != expected {
+					t.Errorf("expected %v points for %s but got %v", expected, date, got)
+				}
+			}
+		})
+	}
+
+	weekend := defaultRulesConfig()
+	weekend.DayOfWeekBonus = DayOfWeekBonus{Days: []string{"saturday", "Sunday"}, Points: 15}
+	for date, expected := range map[string]int{"2022-01-01": 15, "2022-01-02": 15, "2022-01-03": 0, "2022-01": 0, "": 0} {
+		if got := evaluateWith(weekend, "day_of_week", Receipt{PurchaseDate: date, PurchaseTime: "12:00"}); got != expected {
+			t.Errorf("expected %v weekend points for %q but got %v", expected, date, got)
+		}
+	}
+
+	// The default config has no bonus days.
+	for _, date := range dates {
+		if got := evaluate("day_of_week", Receipt{PurchaseDate: date, PurchaseTime: "12:00"}); got != 0 {
+			t.Errorf("expected no points for %s by default but got %v", date, got)
+		}
+	}
+}
+
+func TestDayOfWeekRuleTimezone(t *testing.T) {
+	// 20:00 on Saturday 2022-01-01 in New York is 01:00 on Sunday in UTC.
+	saturdayEvening := Receipt{PurchaseDate: "2022-01-01", PurchaseTime: "20:00", Timezone: "America/New_York"}
+	noZone := Receipt{PurchaseDate: "2022-01-01", PurchaseTime: "20:00"}
+
+	testCases := []struct {
+		name     string
+		bonus    DayOfWeekBonus
+		receipt  Receipt
+		expected int
+	}{
+		{name: "LocalSaturday", bonus: DayOfWeekBonus{Days: []string{"SATURDAY"}, Points: 15}, receipt: saturdayEvening, expected: 15},
+		{name: "LocalNotSunday", bonus: DayOfWeekBonus{Days: []string{"SUNDAY"}, Points: 15}, receipt: saturdayEvening, expected: 0},
+		{name: "UTCSunday", bonus: DayOfWeekBonus{Days: []string{"SUNDAY"}, Points: 15, Timezone: "UTC"}, receipt: saturdayEvening, expected: 15},
+		{name: "UTCNotSaturday", bonus: DayOfWeekBonus{Days: []string{"SATURDAY"}, Points: 15, Timezone: "UTC"}, receipt: saturdayEvening, expected: 0},
+		{name: "NoReceiptZone", bonus: DayOfWeekBonus{Days: []string{"SATURDAY"}, Points: 15, Timezone: "UTC"}, receipt: noZone, expected: 15},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := defaultRulesConfig()
+			config.DayOfWeekBonus = tc.bonus
+			if got := evaluateWith(config, "day_of_week", tc.receipt); got != tc.expected {
+				t.Errorf("expected %v points but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestInvalidReceiptTimezone(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	for zone, expected := range map[string]int{"America/New_York": http.StatusOK, "UTC": http.StatusOK, "Mars/Olympus_Mons": http.StatusBadRequest, "Local": http.StatusBadRequest} {
+		payload := strings.Replace(validReceiptPayload, `"retailer"`, `"timezone": "`+zone+`", "retailer"`, 1)
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(rr, req)
+		if rr.Code != expected {
+			t.Errorf("expected status %v for %q but got %v: %s", expected, zone, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestPromptSubmissionRule(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	fake := useFakeClock(t, time.Time{})
+	config := defaultRulesConfig()
+	config.PromptSubmissionBonus.Points = 15
+	setRules(config)
+	router := newRouter()
+
+	// The receipt is purchased at 2022-01-01 13:01, in UTC unless it says otherwise.
+	purchased := time.Date(2022, 1, 1, 13, 1, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		timezone string
+		clock    time.Time
+		points   int
+		detail   string
+	}{
+		{name: "Within", clock: purchased.Add(23*time.Hour + 59*time.Minute), points: 15, detail: "processed 23h59m0s after purchase, within 24h0m0s"},
+		{name: "AtWindow", clock: purchased.Add(24 * time.Hour), points: 15, detail: "processed 24h0m0s after purchase, within 24h0m0s"},
+		{name: "Late", clock: purchased.Add(24*time.Hour + time.Minute), points: 0, detail: "processed 24h1m0s after purchase, not within 24h0m0s"},
+		{name: "Future", clock: purchased.Add(-time.Hour), points: 0, detail: "purchased 1h0m0s after processing"},
+		// 13:01 in New York is 18:01 UTC.
+		{name: "ReceiptTimezone", timezone: "America/New_York", clock: purchased.Add(28*time.Hour + 59*time.Minute), points: 15, detail: "processed 23h59m0s after purchase, within 24h0m0s"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fake.Set(tc.clock)
+			receipt := exampleReceipts["target"]
+			receipt.Timezone = tc.timezone
+			payload, err := json.Marshal(receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ := processAndScore(t, router, string(payload))
+
+			receiptsMu.RLock()
+			stored := receipts[id]
+			receiptsMu.RUnlock()
+			expected := BreakdownEntry{Rule: "prompt_submission", Points: tc.points, Detail: tc.detail}
+			var entry BreakdownEntry
+			for _, entry = range stored.Breakdown {
+				if entry.Rule == "prompt_submission" {
+					break
+				}
+			}
+			if entry != expected {
+				t.Errorf("expected %+v but got %+v", expected, entry)
+			}
+
+			// Scoring the stored receipt again uses its processing time, not the clock.
+			fake.Advance(1000 * time.Hour)
+			if entry := findEntry(currentEngine(), stored.Receipt, "prompt_submission"); entry != expected {
+				t.Errorf("expected rescoring to give %+v but got %+v", expected, entry)
+			}
+		})
+	}
+
+	// Without a processing time, as when scoring outside a request, there is no bonus.
+	if got := evaluateWith(config, "prompt_submission", exampleReceipts["target"]); got != 0 {
+		t.Errorf("expected no points without a processing time but got %v", got)
+	}
+}
+
+func TestHolidayRule(t *testing.T) {
+	config := defaultRulesConfig()
+	config.HolidayBonus = HolidayBonus{
+		Dates:     []string{"2024-07-04", "2024-11-28"},
+		Recurring: []string{"12-25", "02-29"},
+		Names:     map[string]string{"2024-07-04": "Independence Day", "12-25": "Christmas"},
+		Points:    25,
+	}
+
+	testCases := []struct {
+		date   string
+		points int
+		detail string
+	}{
+		{"2024-07-04", 25, "2024-07-04 is a holiday: Independence Day"},
+		{"2024-11-28", 25, "2024-11-28 is a holiday"},
+		{"2023-07-04", 0, "2023-07-04 is not a holiday"},
+		{"2023-12-25", 25, "2023-12-25 is a holiday: Christmas"},
+		{"2031-12-25", 25, "2031-12-25 is a holiday: Christmas"},
+		{"2028-02-29", 25, "2028-02-29 is a holiday"},
+		{"2024-12-24", 0, "2024-12-24 is not a holiday"},
+		// The date is compared as sent.
+		{"2024-7-4", 0, "2024-7-4 is not a holiday"},
+		{"12-25", 0, "12-25 is not a holiday"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.date, func(t *testing.T) {
+			engine := newEngine(config)
+			_, breakdown := engine.ScoreReceipt(Receipt{PurchaseDate: tc.date, PurchaseTime: "12:00"})
+			for _, entry := range breakdown {
+				if entry.Rule != "holiday" {
+					continue
+				}
+				if entry.Points != tc.points || entry.Detail != tc.detail {
+					t.Errorf("expected %v points (%s) but got %v (%s)", tc.points, tc.detail, entry.Points, entry.Detail)
+				}
+				return
+			}
+			t.Errorf("expected a holiday entry but got %+v", breakdown)
+		})
+	}
+
+	// The default config has no holidays.
+	if got := evaluate("holiday", Receipt{PurchaseDate: "2024-12-25", PurchaseTime: "12:00"}); got != 0 {
+		t.Errorf("expected no points by default but got %v", got)
+	}
+}
+
+func TestItemCountRule(t *testing.T) {
+	config := defaultRulesConfig()
+	config.ItemCountBonuses = []ItemCountBonus{{MinItems: 3, Points: 20}, {MinItems: 5, Points: 50}}
+	items := func(n int) []Item {
+		var items []Item
+		for i := 0; i < n; i++ {
+			items = append(items, Item{ShortDescription: fmt.Sprintf("Item %d", i), Price: "1.00"})
+		}
+		return items
+	}
+
+	testCases := []struct {
+		name     string
+		items    []Item
+		expected BreakdownEntry
+	}{
+		{"BelowFirst", items(2), BreakdownEntry{Rule: "item_count", Points: 0, Detail: "2 items are below the first threshold of 3"}},
+		{"First", items(3), BreakdownEntry{Rule: "item_count", Points: 20, Detail: "3 items reach the threshold of 3 items"}},
+		{"Between", items(4), BreakdownEntry{Rule: "item_count", Points: 20, Detail: "4 items reach the threshold of 3 items"}},
+		{"Top", items(5), BreakdownEntry{Rule: "item_count", Points: 50, Detail: "5 items reach the threshold of 5 items"}},
+		{"AboveTop", items(12), BreakdownEntry{Rule: "item_count", Points: 50, Detail: "12 items reach the threshold of 5 items"}},
+	}
+	for _, tc := range testCases {
+		receipt := exampleReceipts["target"]
+		receipt.Items = tc.items
+		if entry := findEntry(newEngine(config), receipt, "item_count"); entry != tc.expected {
+			t.Errorf("%s: expected %+v but got %+v", tc.name, tc.expected, entry)
+		}
+	}
+
+	// The four Gatorade lines consolidate into one item with a quantity of 4, which
+	// still counts as four items.
+	config.ConsolidateItems = true
+	expected := BreakdownEntry{Rule: "item_count", Points: 20, Detail: "4 items reach the threshold of 3 items"}
+	if entry := findEntry(newEngine(config), exampleReceipts["m&m"], "item_count"); entry != expected {
+		t.Errorf("expected %+v for consolidated items but got %+v", expected, entry)
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RulesConfig holds the tunable parts of the scoring rules. It can be loaded from a
+// YAML or JSON file with --rules-config; omitted fields keep their defaults.
+type RulesConfig struct {
+	// NormalizeDescriptions trims item descriptions and collapses internal runs of
+	// whitespace before they are scored. Turn it off to match implementations that
+	// score the raw description.
+	NormalizeDescriptions bool `json:"normalizeDescriptions" yaml:"normalizeDescriptions"`
+	// UppercaseDescriptions additionally uppercases normalized descriptions.
+	UppercaseDescriptions bool `json:"uppercaseDescriptions" yaml:"uppercaseDescriptions"`
+	// ConsolidateItems merges lines with the same normalized description and price into
+	// one item with a quantity before scoring, so a POS that prints ten identical lines
+	// doesn't earn more item pairs than one that prints a quantity.
+	ConsolidateItems bool `json:"consolidateItems" yaml:"consolidateItems"`
+	// MinimumTotalCents is the smallest total that earns points. Receipts below it are
+	// still accepted but score zero. 0 disables the minimum.
+	MinimumTotalCents int64 `json:"minimumTotalCents" yaml:"minimumTotalCents"`
+	// MaxPointsPerReceipt caps the points of one receipt, after promotions and tier
+	// multipliers, so an
+	// outsized receipt can't mint unbounded points. 0 means no cap.
+	MaxPointsPerReceipt int `json:"maxPointsPerReceipt" yaml:"maxPointsPerReceipt"`
+
+	RoundTotalPoints      int     `json:"roundTotalPoints" yaml:"roundTotalPoints"`
+	QuarterMultiplePoints int     `json:"quarterMultiplePoints" yaml:"quarterMultiplePoints"`
+	ItemPairPoints        int     `json:"itemPairPoints" yaml:"itemPairPoints"`
+	DescriptionMultiplier float64 `json:"descriptionMultiplier" yaml:"descriptionMultiplier"`
+	// DescriptionRounding is how the description-length bonus is rounded to whole
+	// points: ceil, floor, half-up or half-even.
+	DescriptionRounding string     `json:"descriptionRounding" yaml:"descriptionRounding"`
+	OddDayPoints        int        `json:"oddDayPoints" yaml:"oddDayPoints"`
+	AfternoonBonus      TimeWindow `json:"afternoonBonus" yaml:"afternoonBonus"`
+	// DayOfWeekBonus is off unless days and points are configured.
+	DayOfWeekBonus DayOfWeekBonus `json:"dayOfWeekBonus" yaml:"dayOfWeekBonus"`
+	// HolidayBonus is off unless dates and points are configured.
+	HolidayBonus HolidayBonus `json:"holidayBonus" yaml:"holidayBonus"`
+	// PromptSubmissionBonus is off unless points are configured.
+	PromptSubmissionBonus PromptSubmissionBonus `json:"promptSubmissionBonus" yaml:"promptSubmissionBonus"`
+	// ItemCountBonuses award points at item-count thresholds, in increasing order of
+	// MinItems. Only the highest threshold a receipt reaches applies.
+	ItemCountBonuses []ItemCountBonus `json:"itemCountBonuses,omitempty" yaml:"itemCountBonuses"`
+	// SkuBonusFile is a CSV file of bonus points by item UPC, see loadSkuBonuses. A
+	// relative path is relative to the directory of the rules config file. It is read
+	// along with the config, into skuBonuses.
+	SkuBonusFile string         `json:"skuBonusFile,omitempty" yaml:"skuBonusFile"`
+	skuBonuses   *skuBonusTable `json:"-" yaml:"-"`
+
+	// EnabledRules, when not empty, lists the only rules that run. DisabledRules are
+	// skipped even if enabled. Both hold rule names as shown in the breakdown.
+	EnabledRules  []string `json:"enabledRules,omitempty" yaml:"enabledRules"`
+	DisabledRules []string `json:"disabledRules,omitempty" yaml:"disabledRules"`
+
+	// CustomRules run after the standard rules, in order.
+	CustomRules []CustomRule `json:"customRules,omitempty" yaml:"customRules"`
+	// Retailers override the parameters above for matching retailers, see
+	// RetailerOverride.
+	Retailers []RetailerOverride `json:"retailers,omitempty" yaml:"retailers"`
+
+	// Promotions multiply the points of receipts purchased while they run. Where they
+	// overlap, PromotionStacking picks the highest multiplier ("max", the default) or
+	// multiplies them all ("product").
+	Promotions        []Promotion `json:"promotions,omitempty" yaml:"promotions"`
+	PromotionStacking string      `json:"promotionStacking,omitempty" yaml:"promotionStacking"`
+	// TierMultipliers multiply the points of receipts processed by users in a loyalty
+	// tier, after any promotion, by tier name. Tiers without one earn no multiplier.
+	TierMultipliers map[string]float64 `json:"tierMultipliers,omitempty" yaml:"tierMultipliers"`
+
+	// CustomRuleCostLimit bounds the CEL evaluation cost of each custom rule per receipt.
+	// 0 uses defaultCustomRuleCostLimit.
+	CustomRuleCostLimit int `json:"customRuleCostLimit,omitempty" yaml:"customRuleCostLimit"`
+}
+
+func (config RulesConfig) customRuleCostLimit() int {
+	if config.CustomRuleCostLimit == 0 {
+		return defaultCustomRuleCostLimit
+	}
+	return config.CustomRuleCostLimit
+}
+
+// ruleEnabled reports whether the rule called name runs under config.
+func (config RulesConfig) ruleEnabled(name string) bool {
+	for _, disabled := range config.DisabledRules {
+		if disabled == name {
+			return false
+		}
+	}
+	if len(config.EnabledRules) == 0 {
+		return true
+	}
+	for _, enabled := range config.EnabledRules {
+		if enabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DayOfWeekBonus awards Points to purchases made on one of Days, English day names
+// such as "SATURDAY" in any case. The day is the one printed on the receipt. When
+// Timezone is set and a receipt gives its own time zone, the purchase is converted to
+// Timezone first, so a Saturday evening purchase in New York counts as Sunday in UTC.
+type DayOfWeekBonus struct {
+	Days     []string `json:"days,omitempty" yaml:"days"`
+	Points   int      `json:"points" yaml:"points"`
+	Timezone string   `json:"timezone,omitempty" yaml:"timezone"`
+}
+
+// HolidayBonus awards Points to purchases whose date is one of Dates, "YYYY-MM-DD", or
+// falls in any year on one of Recurring, "MM-DD". Dates are compared with the
+// receipt's purchaseDate as sent. Names optionally labels dates and recurring dates
+// for the breakdown, e.g. {"12-25": "Christmas"}.
+type HolidayBonus struct {
+	Dates     []string          `json:"dates,omitempty" yaml:"dates"`
+	Recurring []string          `json:"recurring,omitempty" yaml:"recurring"`
+	Names     map[string]string `json:"names,omitempty" yaml:"names"`
+	Points    int               `json:"points" yaml:"points"`
+}
+
+// PromptSubmissionBonus awards Points to receipts processed within Window, a duration
+// such as "24h", of their purchase. A receipt's purchase time is read in its own time
+// zone if it gives one and in Timezone, UTC by default, otherwise. Receipts purchased
+// after they were processed get no bonus.
+type PromptSubmissionBonus struct {
+	Window   string `json:"window" yaml:"window"`
+	Points   int    `json:"points" yaml:"points"`
+	Timezone string `json:"timezone,omitempty" yaml:"timezone"`
+}
+
+// ItemCountBonus awards Points to receipts with at least MinItems items, counting each
+// unit of a consolidated item.
+type ItemCountBonus struct {
+	MinItems int `json:"minItems" yaml:"minItems"`
+	Points   int `json:"points" yaml:"points"`
+}
+
+// TimeWindow awards Points to purchases made from Start up to, but not including, End.
+// Both are "HH:MM" times of day. End must be after Start unless CrossesMidnight is set,
+// in which case it must be before it, as in 22:00 to 02:00.
+type TimeWindow struct {
+	Start           string `json:"start" yaml:"start"`
+	End             string `json:"end" yaml:"end"`
+	Points          int    `json:"points" yaml:"points"`
+	CrossesMidnight bool   `json:"crossesMidnight,omitempty" yaml:"crossesMidnight"`
+}
+
+// contains reports whether a time of day, in minutes after midnight, falls in the
+// window whose bounds are start and end.
+func (w TimeWindow) contains(minutes, start, end int) bool {
+	if w.CrossesMidnight {
+		return minutes >= start || minutes < end
+	}
+	return minutes >= start && minutes < end
+}
+
+func defaultRulesConfig() RulesConfig {
+	return RulesConfig{
+		NormalizeDescriptions: true,
+		RoundTotalPoints:      50,
+		QuarterMultiplePoints: 25,
+		ItemPairPoints:        5,
+		DescriptionMultiplier: 0.2,
+		DescriptionRounding:   roundCeil,
+		OddDayPoints:          6,
+		AfternoonBonus:        TimeWindow{Start: "14:00", End: "16:00", Points: 10},
+		PromptSubmissionBonus: PromptSubmissionBonus{Window: "24h"},
+	}
+}
+
+// configError is a problem with a rules config file, located by line when possible.
+type configError struct {
+	path string
+	line int
+	msg  string
+}
+
+func (e *configError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.path, e.line, e.msg)
+	}
+	return e.path + ": " + e.msg
+}
+
+// loadRulesConfig reads a YAML or JSON rules config on top of the defaults and
+// validates it. An empty path returns the defaults.
+func loadRulesConfig(path string) (RulesConfig, error) {
+	config := defaultRulesConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return config, &configError{path: path, msg: strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	if len(root.Content) == 0 {
+		return config, nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return config, &configError{path: path, msg: strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	if field, msg := validateRulesConfig(config); msg != "" {
+		return config, &configError{path: path, line: nodeLine(root.Content[0], fieldPath(field)...), msg: field + " " + msg}
+	}
+
+	if config.SkuBonusFile != "" {
+		skuPath := config.SkuBonusFile
+		if !filepath.IsAbs(skuPath) {
+			skuPath = filepath.Join(filepath.Dir(path), skuPath)
+		}
+		if config.skuBonuses, err = loadSkuBonuses(skuPath); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// validateRulesConfig returns the first invalid field of config, named by its path in
+// the config file, and what is wrong with it.
+func validateRulesConfig(config RulesConfig) (field, msg string) {
+	points := []struct {
+		field string
+		value int
+	}{
+		{"roundTotalPoints", config.RoundTotalPoints},
+		{"quarterMultiplePoints", config.QuarterMultiplePoints},
+		{"itemPairPoints", config.ItemPairPoints},
+		{"oddDayPoints", config.OddDayPoints},
+		{"afternoonBonus.points", config.AfternoonBonus.Points},
+		{"dayOfWeekBonus.points", config.DayOfWeekBonus.Points},
+		{"holidayBonus.points", config.HolidayBonus.Points},
+		{"promptSubmissionBonus.points", config.PromptSubmissionBonus.Points},
+	}
+	for _, p := range points {
+		if p.value < 0 {
+			return p.field, "must not be negative"
+		}
+	}
+	if config.DescriptionMultiplier < 0 {
+		return "descriptionMultiplier", "must not be negative"
+	}
+	if !containsString(roundingModes, config.DescriptionRounding) {
+		return "descriptionRounding", fmt.Sprintf("%q is not one of %s", config.DescriptionRounding, strings.Join(roundingModes, ", "))
+	}
+	if config.MinimumTotalCents < 0 {
+		return "minimumTotalCents", "must not be negative"
+	}
+	if config.MaxPointsPerReceipt < 0 {
+		return "maxPointsPerReceipt", "must not be negative"
+	}
+	if config.CustomRuleCostLimit < 0 {
+		return "customRuleCostLimit", "must not be negative"
+	}
+
+	start, err := parseClock(config.AfternoonBonus.Start)
+	if err != nil {
+		return "afternoonBonus.start", err.Error()
+	}
+	end, err := parseClock(config.AfternoonBonus.End)
+	if err != nil {
+		return "afternoonBonus.end", err.Error()
+	}
+	if config.AfternoonBonus.CrossesMidnight && end >= start {
+		return "afternoonBonus.end", fmt.Sprintf("%s must be before start %s for a window that crosses midnight", config.AfternoonBonus.End, config.AfternoonBonus.Start)
+	}
+	if !config.AfternoonBonus.CrossesMidnight && end <= start {
+		return "afternoonBonus.end", fmt.Sprintf("%s must be after start %s", config.AfternoonBonus.End, config.AfternoonBonus.Start)
+	}
+
+	for _, name := range config.DayOfWeekBonus.Days {
+		if _, ok := parseWeekday(name); !ok {
+			return "dayOfWeekBonus.days", fmt.Sprintf("names unknown day %q", name)
+		}
+	}
+	if zone := config.DayOfWeekBonus.Timezone; zone != "" {
+		if _, err := time.LoadLocation(zone); err != nil {
+			return "dayOfWeekBonus.timezone", fmt.Sprintf("names unknown time zone %q", zone)
+		}
+	}
+
+	if window, err := time.ParseDuration(config.PromptSubmissionBonus.Window); err != nil || window <= 0 {
+		return "promptSubmissionBonus.window", fmt.Sprintf("%q is not a positive duration such as 24h", config.PromptSubmissionBonus.Window)
+	}
+	if zone := config.PromptSubmissionBonus.Timezone; zone != "" {
+		if _, err := time.LoadLocation(zone); err != nil {
+			return "promptSubmissionBonus.timezone", fmt.Sprintf("names unknown time zone %q", zone)
+		}
+	}
+
+	if field, msg := validateHolidayBonus(config.HolidayBonus); msg != "" {
+		return "holidayBonus." + field, msg
+	}
+
+	for i, bonus := range config.ItemCountBonuses {
+		prefix := fmt.Sprintf("itemCountBonuses[%d]", i)
+		if bonus.MinItems < 1 {
+			return prefix + ".minItems", "must be at least 1"
+		}
+		if i > 0 && bonus.MinItems <= config.ItemCountBonuses[i-1].MinItems {
+			return prefix + ".minItems", fmt.Sprintf("%d must be greater than the previous threshold %d", bonus.MinItems, config.ItemCountBonuses[i-1].MinItems)
+		}
+		if bonus.Points < 0 {
+			return prefix + ".points", "must not be negative"
+		}
+	}
+
+	known := ruleNames()
+	for i, definition := range config.CustomRules {
+		prefix := fmt.Sprintf("customRules[%d]", i)
+		if _, field, err := compileCustomRule(definition, config.customRuleCostLimit()); err != nil {
+			var exprErr *exprError
+			if errors.As(err, &exprErr) {
+				return prefix + "." + field, "is invalid: " + err.Error()
+			}
+			return prefix + "." + field, err.Error()
+		}
+		if containsString(known, definition.Name) {
+			return prefix + ".name", fmt.Sprintf("%q is already the name of a rule", definition.Name)
+		}
+		known = append(known, definition.Name)
+	}
+
+	lists := []struct {
+		field string
+		names []string
+	}{
+		{"enabledRules", config.EnabledRules},
+		{"disabledRules", config.DisabledRules},
+	}
+	for _, list := range lists {
+		for _, name := range list.names {
+			if !containsString(known, name) {
+				return list.field, fmt.Sprintf("names unknown rule %q (known rules: %s)", name, strings.Join(known, ", "))
+			}
+		}
+	}
+
+	if config.PromotionStacking != "" && config.PromotionStacking != stackMax && config.PromotionStacking != stackProduct {
+		return "promotionStacking", fmt.Sprintf("must be %q or %q, not %q", stackMax, stackProduct, config.PromotionStacking)
+	}
+	promotionNames := make(map[string]bool)
+	for i, promotion := range config.Promotions {
+		prefix := fmt.Sprintf("promotions[%d]", i)
+		if field, msg := validatePromotion(promotion); msg != "" {
+			return prefix + "." + field, msg
+		}
+		if promotionNames[promotion.Name] {
+			return prefix + ".name", fmt.Sprintf("%q is already the name of a promotion", promotion.Name)
+		}
+		promotionNames[promotion.Name] = true
+	}
+	if field, msg := validateTierMultipliers(config.TierMultipliers); msg != "" {
+		return "tierMultipliers." + field, msg
+	}
+
+	for i, override := range config.Retailers {
+		if field, msg := validateRetailerOverride(config, override, known); msg != "" {
+			prefix := fmt.Sprintf("retailers[%d]", i)
+			if field == "" {
+				return prefix, msg
+			}
+			return prefix + "." + field, msg
+		}
+	}
+	return "", ""
+}
+
+// validateHolidayBonus returns the first invalid field of a holiday bonus, relative to
+// the bonus.
+func validateHolidayBonus(bonus HolidayBonus) (field, msg string) {
+	for _, date := range bonus.Dates {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return "dates", fmt.Sprintf("%q is not a YYYY-MM-DD date", date)
+		}
+	}
+	for _, date := range bonus.Recurring {
+		// Check against a leap year so 02-29 is accepted.
+		if len(date) != 5 {
+			return "recurring", fmt.Sprintf("%q is not an MM-DD date", date)
+		}
+		if _, err := time.Parse("2006-01-02", "2000-"+date); err != nil {
+			return "recurring", fmt.Sprintf("%q is not an MM-DD date", date)
+		}
+	}
+	for date := range bonus.Names {
+		if !containsString(bonus.Dates, date) && !containsString(bonus.Recurring, date) {
+			return "names", fmt.Sprintf("%q is not one of the dates or recurring dates", date)
+		}
+	}
+	return "", ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldPath splits a field name such as "customRules[1].expression" into the keys and
+// indexes nodeLine follows.
+func fieldPath(field string) []string {
+	return strings.FieldsFunc(field, func(r rune) bool { return r == '.' || r == '[' || r == ']' })
+}
+
+// nodeLine finds the line of the key at path in a YAML mapping, falling back to the
+// closest enclosing key that exists. Numeric path elements index into sequences.
+func nodeLine(node *yaml.Node, path ...string) int {
+	line := node.Line
+	for _, key := range path {
+		if node.Kind == yaml.SequenceNode {
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node.Content) {
+				break
+			}
+			node = node.Content[i]
+			line = node.Line
+			continue
+		}
+		if node.Kind != yaml.MappingNode {
+			break
+		}
+		found := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				line, node, found = node.Content[i].Line, node.Content[i+1], true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return line
+}
+
+// parseClock parses an "HH:MM" time of day into minutes after midnight.
+func parseClock(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, err := strconv.Atoi(hours)
+	if !ok || err != nil || len(minutes) != 2 || h < 0 || h > 23 {
+		return 0, fmt.Errorf("%q is not an HH:MM time", s)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("%q is not an HH:MM time", s)
+	}
+	return h*60 + m, nil
+}
+
+// registerRuleFlags defines the command line flags that override fields of config.
+func registerRuleFlags(fs *flag.FlagSet, config *RulesConfig) {
+	fs.BoolVar(&config.NormalizeDescriptions, "normalize-descriptions", config.NormalizeDescriptions, "trim and collapse whitespace in item descriptions before scoring")
+	fs.BoolVar(&config.UppercaseDescriptions, "uppercase-descriptions", config.UppercaseDescriptions, "uppercase normalized item descriptions before scoring")
+	fs.BoolVar(&config.ConsolidateItems, "consolidate-items", config.ConsolidateItems, "merge identical line items into one item with a quantity before scoring")
+	fs.Int64Var(&config.MinimumTotalCents, "minimum-total-cents", config.MinimumTotalCents, "smallest receipt total in cents that earns points (0 disables the minimum)")
+}
+
+// Environment variables that replace the enabledRules and disabledRules lists of the
+// rules config file with a comma-separated list of rule names.
+const (
+	enabledRulesEnv  = "FETCH_ENABLED_RULES"
+	disabledRulesEnv = "FETCH_DISABLED_RULES"
+)
+
+// splitRuleNames splits a comma-separated list of rule names, ignoring blanks.
+func splitRuleNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveRulesConfig loads the rules config file at path, replaces its rule lists with
+// the environment variables that are set, and applies the rule flags explicitly set on
+// fs on top, so the command line wins over the environment and the file.
+func resolveRulesConfig(path string, fs *flag.FlagSet) (RulesConfig, error) {
+	config, err := loadRulesConfig(path)
+	if err != nil {
+		return config, err
+	}
+
+	if value, ok := os.LookupEnv(enabledRulesEnv); ok {
+		config.EnabledRules = splitRuleNames(value)
+	}
+	if value, ok := os.LookupEnv(disabledRulesEnv); ok {
+		config.DisabledRules = splitRuleNames(value)
+	}
+
+	overrides := flag.NewFlagSet("rules", flag.ContinueOnError)
+	registerRuleFlags(overrides, &config)
+	fs.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) != nil && err == nil {
+			err = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return config, err
+	}
+
+	if field, msg := validateRulesConfig(config); msg != "" {
+		return config, fmt.Errorf("rules config: %s %s", field, msg)
+	}
+	return config, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeConfig writes contents to a file named name in a temporary directory.
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRulesConfig(t *testing.T) {
+	defaults := defaultRulesConfig()
+
+	config, err := loadRulesConfig("")
+	if err != nil || !reflect.DeepEqual(config, defaults) {
+		t.Errorf("expected the defaults without a file but got %+v, %v", config, err)
+	}
+
+	yamlConfig, err := loadRulesConfig(writeConfig(t, "rules.yaml", "itemPairPoints: 10\nafternoonBonus:\n  points: 20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaults
+	expected.ItemPairPoints = 10
+	expected.AfternoonBonus.Points = 20
+	if !reflect.DeepEqual(yamlConfig, expected) {
+		t.Errorf("expected %+v but got %+v", expected, yamlConfig)
+	}
+
+	jsonConfig, err := loadRulesConfig(writeConfig(t, "rules.json", `{"itemPairPoints": 10, "afternoonBonus": {"points": 20}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jsonConfig, expected) {
+		t.Errorf("expected %+v but got %+v", expected, jsonConfig)
+	}
+
+	emptyConfig, err := loadRulesConfig(writeConfig(t, "rules.yaml", "# nothing overridden\n"))
+	if err != nil || !reflect.DeepEqual(emptyConfig, defaults) {
+		t.Errorf("expected the defaults for an empty file but got %+v, %v", emptyConfig, err)
+	}
+}
+
+func TestLoadRulesConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			name:     "NegativePoints",
+			contents: "roundTotalPoints: 50\noddDayPoints: -6\n",
+			expected: "rules.yaml:2: oddDayPoints must not be negative",
+		},
+		{
+			name:     "NegativeNestedPoints",
+			contents: "afternoonBonus:\n  start: \"14:00\"\n  points: -1\n",
+			expected: "rules.yaml:3: afternoonBonus.points must not be negative",
+		},
+		{
+			name:     "EndBeforeStart",
+			contents: "afternoonBonus:\n  start: \"16:00\"\n  end: \"14:00\"\n",
+			expected: `rules.yaml:3: afternoonBonus.end 14:00 must be after start 16:00`,
+		},
+		{
+			name:     "EndBeforeDefaultStart",
+			contents: "itemPairPoints: 5\nafternoonBonus:\n  end: \"13:00\"\n",
+			expected: `rules.yaml:3: afternoonBonus.end 13:00 must be after start 14:00`,
+		},
+		{
+			name:     "CrossesMidnightWithoutFlag",
+			contents: "afternoonBonus:\n  start: \"22:00\"\n  end: \"02:00\"\n",
+			expected: `rules.yaml:3: afternoonBonus.end 02:00 must be after start 22:00`,
+		},
+		{
+			name:     "FlagWithoutCrossingMidnight",
+			contents: "afternoonBonus:\n  start: \"07:00\"\n  end: \"09:00\"\n  crossesMidnight: true\n",
+			expected: `rules.yaml:3: afternoonBonus.end 09:00 must be before start 07:00 for a window that crosses midnight`,
+		},
+		{
+			name:     "EmptyWindow",
+			contents: "afternoonBonus:\n  start: \"22:00\"\n  end: \"22:00\"\n  crossesMidnight: true\n",
+			expected: `rules.yaml:3: afternoonBonus.end 22:00 must be before start 22:00 for a window that crosses midnight`,
+		},
+		{
+			name:     "MalformedTime",
+			contents: "afternoonBonus:\n  start: \"2pm\"\n",
+			expected: `rules.yaml:2: afternoonBonus.start "2pm" is not an HH:MM time`,
+		},
+		{
+			name:     "UnknownDay",
+			contents: "dayOfWeekBonus:\n  points: 15\n  days: [SATURDAY, FUNDAY]\n",
+			expected: `rules.yaml:3: dayOfWeekBonus.days names unknown day "FUNDAY"`,
+		},
+		{
+			name:     "UnknownTimezone",
+			contents: "dayOfWeekBonus:\n  timezone: Mars/Olympus_Mons\n",
+			expected: `rules.yaml:2: dayOfWeekBonus.timezone names unknown time zone "Mars/Olympus_Mons"`,
+		},
+		{
+			name:     "UnknownRounding",
+			contents: "descriptionRounding: bankers\n",
+			expected: `rules.yaml:1: descriptionRounding "bankers" is not one of ceil, floor, half-up, half-even`,
+		},
+		{
+			name:     "NegativeMaxPoints",
+			contents: "maxPointsPerReceipt: -1\n",
+			expected: `rules.yaml:1: maxPointsPerReceipt must not be negative`,
+		},
+		{
+			name:     "ItemCountThresholdsNotIncreasing",
+			contents: "itemCountBonuses:\n  - minItems: 10\n    points: 20\n  - minItems: 10\n    points: 50\n",
+			expected: `rules.yaml:4: itemCountBonuses[1].minItems 10 must be greater than the previous threshold 10`,
+		},
+		{
+			name:     "ItemCountThresholdZero",
+			contents: "itemCountBonuses:\n  - minItems: 0\n    points: 20\n",
+			expected: `rules.yaml:2: itemCountBonuses[0].minItems must be at least 1`,
+		},
+		{
+			name:     "NegativeItemCountPoints",
+			contents: "itemCountBonuses:\n  - minItems: 10\n    points: -20\n",
+			expected: `rules.yaml:3: itemCountBonuses[0].points must not be negative`,
+		},
+		{
+			name:     "MalformedSubmissionWindow",
+			contents: "promptSubmissionBonus:\n  points: 10\n  window: 1d\n",
+			expected: `rules.yaml:3: promptSubmissionBonus.window "1d" is not a positive duration such as 24h`,
+		},
+		{
+			name:     "MalformedHolidayDate",
+			contents: "holidayBonus:\n  points: 25\n  dates: [\"2024-07-04\", \"2024-13-01\"]\n",
+			expected: `rules.yaml:3: holidayBonus.dates "2024-13-01" is not a YYYY-MM-DD date`,
+		},
+		{
+			name:     "MalformedRecurringHoliday",
+			contents: "holidayBonus:\n  points: 25\n  recurring: [\"12-25\", \"2024-12-31\"]\n",
+			expected: `rules.yaml:3: holidayBonus.recurring "2024-12-31" is not an MM-DD date`,
+		},
+		{
+			name:     "UnknownHolidayName",
+			contents: "holidayBonus:\n  points: 25\n  recurring: [\"12-25\"]\n  names:\n    \"12-26\": Boxing Day\n",
+			expected: `rules.yaml:4: holidayBonus.names "12-26" is not one of the dates or recurring dates`,
+		},
+		{
+			name:     "UnknownDisabledRule",
+			contents: "itemPairPoints: 5\ndisabledRules:\n  - odd_days\n",
+			expected: `rules.yaml:2: disabledRules names unknown rule "odd_days" (known rules: retailer_name, round_total, quarter_multiple, item_pairs, description_length, odd_day, afternoon_purchase, day_of_week, holiday, sku_bonus, prompt_submission, item_count)`,
+		},
+		{
+			name:     "UnknownEnabledRule",
+			contents: "enabledRules: [retailer_name, bonus]\n",
+			expected: `rules.yaml:1: enabledRules names unknown rule "bonus" (known rules: retailer_name, round_total, quarter_multiple, item_pairs, description_length, odd_day, afternoon_purchase, day_of_week, holiday, sku_bonus, prompt_submission, item_count)`,
+		},
+		{
+			name:     "UnknownField",
+			contents: "itemPairPoints: 5\npairBonus: 10\n",
+			expected: "rules.yaml: unmarshal errors:\n  line 2: field pairBonus not found in type main.RulesConfig",
+		},
+		{
+			name:     "WrongType",
+			contents: "itemPairPoints: five\n",
+			expected: "rules.yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `five` into int",
+		},
+		{
+			name:     "Malformed",
+			contents: "itemPairPoints: 5\n  oddDayPoints: 6\n",
+			expected: "rules.yaml: line 2: mapping values are not allowed in this context",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "rules.yaml", tc.contents)
+			_, err := loadRulesConfig(path)
+			if err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+			if got := strings.TrimPrefix(err.Error(), filepath.Dir(path)+string(filepath.Separator)); got != tc.expected {
+				t.Errorf("expected error %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolveRulesConfigFlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, "rules.yaml", "consolidateItems: true\nminimumTotalCents: 100\nitemPairPoints: 7\n")
+
+	var config RulesConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerRuleFlags(fs, &config)
+	if err := fs.Parse([]string{"--minimum-total-cents=250"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := resolveRulesConfig(path, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.MinimumTotalCents != 250 || !resolved.ConsolidateItems || resolved.ItemPairPoints != 7 {
+		t.Errorf("expected the flag to override only minimumTotalCents but got %+v", resolved)
+	}
+
+	if err := fs.Parse([]string{"--minimum-total-cents=-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveRulesConfig(path, fs); err == nil {
+		t.Error("expected a negative minimum from the command line to be rejected")
+	}
+}
+
+func TestResolveRulesConfigEnvironment(t *testing.T) {
+	path := writeConfig(t, "rules.yaml", "disabledRules: [odd_day]\nenabledRules: [odd_day, item_pairs]\n")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	t.Setenv(disabledRulesEnv, " round_total, ,afternoon_purchase ")
+	config, err := resolveRulesConfig(path, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.DisabledRules, []string{"round_total", "afternoon_purchase"}) {
+		t.Errorf("expected the environment to replace disabledRules but got %q", config.DisabledRules)
+	}
+	if !reflect.DeepEqual(config.EnabledRules, []string{"odd_day", "item_pairs"}) {
+		t.Errorf("expected enabledRules from the file but got %q", config.EnabledRules)
+	}
+
+	t.Setenv(enabledRulesEnv, "")
+	if config, err := resolveRulesConfig(path, fs); err != nil || config.EnabledRules != nil {
+		t.Errorf("expected an empty variable to clear enabledRules but got %q, %v", config.EnabledRules, err)
+	}
+
+	t.Setenv(disabledRulesEnv, "odd_days")
+	if _, err := resolveRulesConfig(path, fs); err == nil || !strings.Contains(err.Error(), `unknown rule "odd_days"`) {
+		t.Errorf("expected an unknown rule in the environment to be rejected but got %v", err)
+	}
+}
+
+func TestRulesConfigChangesScoring(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+
+	config, err := loadRulesConfig(writeConfig(t, "rules.yaml", "itemPairPoints: 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRules(config)
+	router := newRouter()
+
+	// The example receipt has two pairs, worth 10 more points than with the default 5 per pair.
+	if _, points := processAndScore(t, router, validReceiptPayload); points != 38 {
+		t.Errorf("expected 38 points but got %v", points)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/rules", nil))
+	var body struct {
+		Rules []struct {
+			Name string `json:"name"`
+		} `json:"rules"`
+		Config RulesConfig `json:"config"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(body.Config, config) {
+		t.Errorf("expected /rules to report %+v but got %+v", config, body.Config)
+	}
+	if len(body.Rules) != 12 || body.Rules[0].Name != "retailer_name" {
+		t.Errorf("expected the twelve rules in order but got %+v", body.Rules)
+	}
+}
+
+func TestGetRulesEnabledState(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer setRules(currentEngine().config)
+	config := defaultRulesConfig()
+	config.DisabledRules = []string{"odd_day"}
+	setRules(config)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/rules", nil))
+	var body struct {
+		Rules []struct {
+			Name    string `json:"name"`
+			Enabled bool   `json:"enabled"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range body.Rules {
+		if rule.Enabled != (rule.Name != "odd_day") {
+			t.Errorf("expected %s to have enabled=%v but got %v", rule.Name, rule.Name != "odd_day", rule.Enabled)
+		}
+	}
+}
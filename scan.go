@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// The --extractor that reads receipts from the photos POST /receipts/scan takes, and
+// the --max-scan-bytes limit of the uploads.
+var (
+	extractorName string
+	maxScanBytes  = byteSize(8 << 20)
+)
+
+// receiptImage is a photo of a receipt.
+type receiptImage struct {
+	data []byte
+	// mediaType is image/jpeg or image/png, by the content of data.
+	mediaType string
+	// sidecar is the JSON receipt uploaded with the photo, if any, which the fake
+	// extractor returns in place of reading the photo.
+	sidecar []byte
+}
+
+// extractor reads the receipt in a photo. It is where an OCR service plugs in; the
+// receipt it returns is validated and scored like a submitted one.
+type extractor interface {
+	extract(ctx context.Context, image receiptImage) (Receipt, error)
+}
+
+// errExtractorUnavailable is returned when no extractor is configured.
+var errExtractorUnavailable = errors.New("reading receipts from photos is not available on this server")
+
+// unavailableExtractor is the extractor without --extractor: none.
+type unavailableExtractor struct{}
+
+func (unavailableExtractor) extract(context.Context, receiptImage) (Receipt, error) {
+	return Receipt{}, errExtractorUnavailable
+}
+
+// fakeExtractor returns the sidecar of a photo rather than reading it, for testing the
+// scan flow without an OCR service.
+type fakeExtractor struct{}
+
+func (fakeExtractor) extract(ctx context.Context, image receiptImage) (Receipt, error) {
+	if err := ctx.Err(); err != nil {
+		return Receipt{}, err
+	}
+	if len(image.sidecar) == 0 {
+		return Receipt{}, errors.New("the fake extractor needs the receipt as a JSON sidecar")
+	}
+	receipt, err := decodeJSONReceipt(bytes.NewReader(image.sidecar))
+	if err != nil {
+		return Receipt{}, fmt.Errorf("the sidecar is not a JSON receipt: %w", err)
+	}
+	return receipt, nil
+}
+
+// newExtractor returns the extractor --extractor names: "" for none, or "fake".
+func newExtractor(name string) (extractor, error) {
+	switch name {
+	case "":
+		return unavailableExtractor{}, nil
+	case "fake":
+		return fakeExtractor{}, nil
+	}
+	return nil, fmt.Errorf("--extractor %q is not fake", name)
+}
+
+// receiptExtractor is the extractor scanReceipt uses.
+var receiptExtractor extractor = unavailableExtractor{}
+
+// The form fields of a scan: the photo, and the receipt it shows for the fake
+// extractor.
+const (
+	scanImageField   = "image"
+	scanSidecarField = "sidecar"
+)
+
+// scanReceipt reads the receipt in a photo uploaded as multipart/form-data, then
+// validates, scores and stores it as processReceipts does, answering with the
+// receipt as read, its ID and its points so the user can check what was read.
+func scanReceipt(c *gin.Context) {
+	defer countSubmission(c)
+	engine := currentEngine()
+
+	image, err := readScan(c.Request)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return
+	case errors.Is(err, errScanImageMissing):
+		abortWithProblem(c, http.StatusBadRequest, "SCAN_IMAGE_MISSING", err.Error())
+		return
+	case errors.Is(err, errScanImageUnsupported):
+		abortWithProblem(c, http.StatusUnsupportedMediaType, "SCAN_IMAGE_UNSUPPORTED", err.Error())
+		return
+	case err != nil:
+		abortWithProblem(c, http.StatusBadRequest, "SCAN_FORM_INVALID", "malformed multipart form: "+err.Error())
+		return
+	}
+
+	_, extraction := startSpan(c.Request.Context(), "extract receipt")
+	receipt, err := receiptExtractor.extract(c.Request.Context(), image)
+	if err != nil {
+		extraction.SetStatus(codes.Error, err.Error())
+	}
+	extraction.End()
+	switch {
+	case errors.Is(err, errExtractorUnavailable):
+		abortWithProblem(c, http.StatusNotImplemented, "EXTRACTOR_UNAVAILABLE", err.Error())
+		return
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		abortWithStoreError(c, err)
+		return
+	case err != nil:
+		abortWithProblem(c, http.StatusUnprocessableEntity, "EXTRACTION_FAILED", err.Error())
+		return
+	}
+	if reason, message := validateReceipt(&receipt, engine); reason != "" {
+		rejectReceipt(c, reason, message)
+		return
+	}
+
+	receiptID := newReceiptID(receipt)
+	receipt.ProcessedAt = clock.Now()
+	points, err := scoreAndStore(c.Request.Context(), receiptID, receipt, engine, c.GetString("user"))
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+
+	c.Set("auditTarget", receiptID)
+	body := gin.H{"id": receiptID, "points": points, "receipt": receipt}
+	if links := receiptLinksFor(c, receiptID, c.GetString("user")); links != nil {
+		body["_links"] = links
+	}
+	c.JSON(http.StatusOK, body)
+
+	if s := shadow.Load(); s != nil {
+		s.score(receiptID, c.GetString("requestID"), receipt, points)
+	}
+}
+
+var (
+	errScanImageMissing     = errors.New("the form has no image file")
+	errScanImageUnsupported = errors.New("the image must be a JPEG or PNG photo")
+)
+
+// readScan reads the photo and sidecar of a scan. The type of the photo is sniffed
+// from its content, whatever it was labeled.
+func readScan(r *http.Request) (receiptImage, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return receiptImage{}, err
+	}
+	form := multipart.NewReader(r.Body, params["boundary"])
+	var image receiptImage
+	for {
+		part, err := form.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return receiptImage{}, err
+		}
+		switch part.FormName() {
+		case scanImageField:
+			if image.data, err = io.ReadAll(part); err != nil {
+				return receiptImage{}, err
+			}
+		case scanSidecarField:
+			if image.sidecar, err = io.ReadAll(part); err != nil {
+				return receiptImage{}, err
+			}
+		}
+	}
+	if len(image.data) == 0 {
+		return receiptImage{}, errScanImageMissing
+	}
+	switch image.mediaType = http.DetectContentType(image.data); image.mediaType {
+	case "image/jpeg", "image/png":
+		return image, nil
+	}
+	return receiptImage{}, errScanImageUnsupported
+}
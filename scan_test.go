@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pngPhoto is enough of a PNG for its type to be sniffed.
+const pngPhoto = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+// useExtractor reads receipts from photos with e for the rest of the test.
+func useExtractor(t *testing.T, e extractor) {
+	t.Helper()
+	previous := receiptExtractor
+	receiptExtractor = e
+	t.Cleanup(func() { receiptExtractor = previous })
+}
+
+func TestScanReceipt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useExtractor(t, fakeExtractor{})
+	router := newRouter()
+
+	body, formType := uploadForm(t, uploadFile{"image", "image/png", pngPhoto}, uploadFile{"sidecar", "application/json", validReceiptPayload})
+	rr := serveBody(router, http.MethodPost, "/receipts/scan", formType, "", body)
+	var scanned struct {
+		ID      string  `json:"id"`
+		Points  int     `json:"points"`
+		Receipt Receipt `json:"receipt"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &scanned); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v %s", rr.Code, rr.Body.String())
+	}
+	if scanned.ID == "" || scanned.Points != 28 || scanned.Receipt.Retailer != "Target" || len(scanned.Receipt.Items) != 5 {
+		t.Errorf("expected the receipt, its ID and 28 points but got %+v", scanned)
+	}
+
+	// The receipt is stored like a submitted one.
+	rr = serveBody(router, http.MethodGet, "/receipts/"+scanned.ID+"/points", "", "", nil)
+	if !strings.Contains(rr.Body.String(), `"points":28`) {
+		t.Errorf("expected 28 points but got %s", rr.Body.String())
+	}
+
+	// What the extractor reads is validated.
+	invalid := strings.Replace(validReceiptPayload, `"35.35"`, `""`, 1)
+	body, formType = uploadForm(t, uploadFile{"image", "image/png", pngPhoto}, uploadFile{"sidecar", "application/json", invalid})
+	rr = serveBody(router, http.MethodPost, "/receipts/scan", formType, "", body)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Total amount is required") {
+		t.Errorf("expected status 400 but got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestScanReceiptErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous byteSize) { maxScanBytes = previous }(maxScanBytes)
+	maxScanBytes = 4096
+	useExtractor(t, fakeExtractor{})
+	router := newRouter()
+	sidecar := uploadFile{"sidecar", "application/json", validReceiptPayload}
+
+	testCases := []struct {
+		name   string
+		files  []uploadFile
+		status int
+		code   string
+	}{
+		{"NoImage", []uploadFile{sidecar}, http.StatusBadRequest, "SCAN_IMAGE_MISSING"},
+		{"NotAnImage", []uploadFile{{"image", "image/png", "%PDF-1.7\n"}, sidecar}, http.StatusUnsupportedMediaType, "SCAN_IMAGE_UNSUPPORTED"},
+		{"GIF", []uploadFile{{"image", "image/gif", "GIF89a"}, sidecar}, http.StatusUnsupportedMediaType, "SCAN_IMAGE_UNSUPPORTED"},
+		{"TooLarge", []uploadFile{{"image", "image/jpeg", "\xff\xd8\xff" + strings.Repeat("\x00", 8192)}, sidecar}, http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE"},
+		{"NoSidecar", []uploadFile{{"image", "image/png", pngPhoto}}, http.StatusUnprocessableEntity, "EXTRACTION_FAILED"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, formType := uploadForm(t, tc.files...)
+			rr := serveBody(router, http.MethodPost, "/receipts/scan", formType, "", body)
+			var p problem
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			if rr.Code != tc.status || p.Code != tc.code {
+				t.Errorf("expected %v %s but got %v %s", tc.status, tc.code, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	rr := serveBody(router, http.MethodPost, "/receipts/scan", "application/json", "", []byte(validReceiptPayload))
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415 for a JSON body but got %v", rr.Code)
+	}
+
+	// Without an extractor, scanning isn't available.
+	useExtractor(t, unavailableExtractor{})
+	body, formType := uploadForm(t, uploadFile{"image", "image/png", pngPhoto}, sidecar)
+	rr = serveBody(router, http.MethodPost, "/receipts/scan", formType, "", body)
+	var p problem
+	json.Unmarshal(rr.Body.Bytes(), &p)
+	if rr.Code != http.StatusNotImplemented || p.Code != "EXTRACTOR_UNAVAILABLE" {
+		t.Errorf("expected status 501 but got %v %s", rr.Code, rr.Body.String())
+	}
+	if len(receipts) != 0 {
+		t.Errorf("expected no receipts stored but got %d", len(receipts))
+	}
+}
+
+func TestNewExtractor(t *testing.T) {
+	if e, err := newExtractor(""); err != nil || e != (unavailableExtractor{}) {
+		t.Errorf("expected no extractor by default but got %v, %v", e, err)
+	}
+	if e, err := newExtractor("fake"); err != nil || e != (fakeExtractor{}) {
+		t.Errorf("expected the fake extractor but got %v, %v", e, err)
+	}
+	if _, err := newExtractor("tesseract"); err == nil {
+		t.Error("expected an error for an unknown extractor but got none")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// exampleSeed is the receipts of --seed examples, the two from the README.
+//
+//go:embed examples/receipts.json
+var exampleSeed []byte
+
+// namedSeeds are the seeds --seed names.
+var namedSeeds = map[string][]byte{"examples": exampleSeed}
+
+// seedName is --seed, a seed built in, and seedFile --seed-file, a JSON array of
+// receipts, processed at startup so demos and tests don't start with an empty store.
+var (
+	seedName string
+	seedFile string
+)
+
+// seedNamespace is the namespace of the IDs of seeded receipts.
+var seedNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/ItsmeBlackOps/Fetch/seed"))
+
+// seededReceipt is a validated receipt of a seed, and the ID it will be stored under.
+type seededReceipt struct {
+	source  string
+	id      string
+	receipt Receipt
+}
+
+// seedSources returns the seeds to process, --seed before --seed-file, by name.
+func seedSources() ([]string, map[string][]byte, error) {
+	var names []string
+	sources := make(map[string][]byte)
+	if seedName != "" {
+		data, ok := namedSeeds[seedName]
+		if !ok {
+			known := make([]string, 0, len(namedSeeds))
+			for name := range namedSeeds {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, nil, fmt.Errorf("--seed %q is not one of %s", seedName, strings.Join(known, ", "))
+		}
+		names = append(names, "--seed "+seedName)
+		sources["--seed "+seedName] = data
+	}
+	if seedFile != "" {
+		data, err := os.ReadFile(seedFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading --seed-file: %w", err)
+		}
+		names = append(names, seedFile)
+		sources[seedFile] = data
+	}
+	return names, sources, nil
+}
+
+// prepareSeeds parses and validates the receipts of --seed and --seed-file as
+// submissions are, with engine's config, naming the first invalid entry by its index.
+func prepareSeeds(engine *Engine) ([]seededReceipt, error) {
+	names, sources, err := seedSources()
+	if err != nil {
+		return nil, err
+	}
+	var seeded []seededReceipt
+	for _, name := range names {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(sources[name], &entries); err != nil {
+			return nil, fmt.Errorf("seed %s is not a JSON array of receipts: %w", name, err)
+		}
+		for i, entry := range entries {
+			var receipt Receipt
+			if err := json.Unmarshal(entry, &receipt); err != nil {
+				return nil, fmt.Errorf("seed %s[%d]: %w", name, i, err)
+			}
+			id := seedID(receipt)
+			if reason, message := validateReceipt(&receipt, engine); reason != "" {
+				return nil, fmt.Errorf("seed %s[%d]: %s (%s)", name, i, message, reason)
+			}
+			seeded = append(seeded, seededReceipt{source: fmt.Sprintf("%s[%d]", name, i), id: id, receipt: receipt})
+		}
+	}
+	return seeded, nil
+}
+
+// seedID is the ID a seeded receipt is stored under, a name-based UUID of the receipt
+// as given, so the same receipt gets the same ID on every start and docs can refer to
+// it. Formatting and key order don't change it.
+func seedID(receipt Receipt) string {
+	data, _ := json.Marshal(receipt)
+	return uuid.NewSHA1(seedNamespace, data).String()
+}
+
+// seedReceipts scores and stores the receipts of --seed and --seed-file with the
+// current rules, logging the ID each is stored under.
+func seedReceipts(ctx context.Context) error {
+	engine := currentEngine()
+	seeded, err := prepareSeeds(engine)
+	if err != nil {
+		return err
+	}
+	for _, s := range seeded {
+		s.receipt.ProcessedAt = clock.Now()
+		points, err := scoreAndStore(ctx, s.id, s.receipt, engine, "")
+		if err != nil {
+			return fmt.Errorf("seed %s: %w", s.source, err)
+		}
+		log.Printf("seeded receipt %s from %s with %d points", s.id, s.source, points)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The IDs of the receipts of --seed examples, which the README refers to.
+const (
+	seededTargetID = "9b511766-3a28-559f-b48e-42ba0580f975"
+	seededMMID     = "2d89cf76-2b81-5e0a-98b9-56c2e2af54b9"
+)
+
+// useSeed sets --seed and --seed-file for the rest of the test.
+func useSeed(t *testing.T, name, file string) {
+	t.Helper()
+	previousName, previousFile := seedName, seedFile
+	seedName, seedFile = name, file
+	t.Cleanup(func() { seedName, seedFile = previousName, previousFile })
+}
+
+func TestSeedExamples(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useSeed(t, "examples", "")
+	if err := seedReceipts(context.Background()); err != nil {
+		t.Fatalf("expected the examples to be seeded but got %v", err)
+	}
+	router := newRouter()
+
+	for id, want := range map[string]int{seededTargetID: 28, seededMMID: 109} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/points", nil))
+		var body struct{ Points int }
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK || body.Points != want {
+			t.Errorf("%s: expected %d points but got %v: %s", id, want, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Seeding again, as on a restart, stores the same receipts under the same IDs.
+	if err := seedReceipts(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 2 {
+		t.Errorf("expected the 2 examples once each but got %d receipts", len(receipts))
+	}
+}
+
+func TestSeedFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// The ID doesn't depend on formatting or key order.
+	reordered := `[{"total": "35.35", "retailer": "Target", "purchaseTime": "13:01", "purchaseDate": "2022-01-01", "items": [
+		{"price": "6.49", "shortDescription": "Mountain Dew 12PK"},
+		{"price": "12.25", "shortDescription": "Emils Cheese Pizza"},
+		{"price": "1.26", "shortDescription": "Knorr Creamy Chicken"},
+		{"price": "3.35", "shortDescription": "Doritos Nacho Cheese"},
+		{"price": "12.00", "shortDescription": "   Klarbrunn 12-PK 12 FL OZ  "}]}]`
+	useSeed(t, "", write("reordered.json", reordered))
+	if err := seedReceipts(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	receiptsMu.RLock()
+	_, ok := receipts[seededTargetID]
+	count := len(receipts)
+	receiptsMu.RUnlock()
+	if !ok || count != 1 {
+		t.Errorf("expected the receipt stored as %s but got %d receipts", seededTargetID, count)
+	}
+
+	invalid := write("invalid.json", `[`+validReceiptPayload+`, {"retailer": "Target", "total": "lots", "items": [{"shortDescription": "x", "price": "1.00"}], "purchaseDate": "2022-01-01", "purchaseTime": "13:01"}]`)
+	for _, tc := range []struct {
+		name, seed, file, want string
+	}{
+		{"invalid entry", "", invalid, "seed " + invalid + "[1]: Invalid total amount"},
+		{"not an array", "", write("object.json", validReceiptPayload), "is not a JSON array of receipts"},
+		{"not a receipt", "", write("strings.json", `["receipt"]`), "strings.json[0]"},
+		{"missing file", "", filepath.Join(dir, "missing.json"), "reading --seed-file"},
+		{"unknown seed", "demo", "", `--seed "demo" is not one of examples`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			receipts = make(ReceiptsMap)
+			useSeed(t, tc.seed, tc.file)
+			err := seedReceipts(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected an error containing %q but got %v", tc.want, err)
+			}
+			if len(receipts) != 0 {
+				t.Errorf("expected nothing stored from a failed seed but got %d receipts", len(receipts))
+			}
+			fs := resettableOptions(t)("--seed", tc.seed, "--seed-file", tc.file)
+			if err := validateOptions(fs); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected --validate-only to report %q but got %v", tc.want, err)
+			}
+		})
+	}
+}
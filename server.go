@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// The address the API listens on, the optional separate addresses of the health and
+// version endpoints and of the admin endpoints, and the TLS files of the --tls-* flags.
+var (
+	listenAddr      = ":8080"
+	healthAddr      string
+	adminAddr       string
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+)
+
+// shutdownGrace is how long requests in flight are given to finish on shutdown, and
+// shutdownDelay how long the listeners keep serving, while reporting they aren't
+// ready, before they stop accepting connections.
+var (
+	shutdownGrace = 30 * time.Second
+	shutdownDelay time.Duration
+)
+
+// shuttingDown is set once shutdown begins, turning /ready to 503 so load balancers
+// stop sending requests.
+var shuttingDown atomic.Bool
+
+// serverLimits are the timeouts and header size limit of every listener, set by the
+// --*-timeout flags and --max-header-bytes. A timeout of 0 is no timeout.
+type serverLimits struct {
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    byteSize
+}
+
+var limits = serverLimits{
+	readHeaderTimeout: 5 * time.Second,
+	readTimeout:       10 * time.Second,
+	writeTimeout:      30 * time.Second,
+	idleTimeout:       60 * time.Second,
+	maxHeaderBytes:    64 << 10,
+}
+
+// adminWriteTimeout is the --admin-write-timeout the /admin endpoints get instead of
+// --write-timeout and --read-timeout, for exports and simulations that take longer.
+var adminWriteTimeout = 5 * time.Minute
+
+// validate rejects negative limits, and a write timeout shorter than the read timeout,
+// which would cut off responses to requests that took long to arrive.
+func (l serverLimits) validate() error {
+	for _, timeout := range []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"--read-header-timeout", l.readHeaderTimeout},
+		{"--read-timeout", l.readTimeout},
+		{"--write-timeout", l.writeTimeout},
+		{"--idle-timeout", l.idleTimeout},
+	} {
+		if timeout.value < 0 {
+			return fmt.Errorf("%s %v is negative", timeout.flag, timeout.value)
+		}
+	}
+	if l.maxHeaderBytes < 0 {
+		return fmt.Errorf("--max-header-bytes %v is negative", l.maxHeaderBytes)
+	}
+	if l.writeTimeout > 0 && l.writeTimeout < l.readTimeout {
+		return fmt.Errorf("--write-timeout %v is shorter than --read-timeout %v", l.writeTimeout, l.readTimeout)
+	}
+	return nil
+}
+
+// extendDeadlines gives the request until timeout from now to be read and answered,
+// past the --read-timeout and --write-timeout of the listener, for routes that are
+// slow by design.
+func extendDeadlines(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deadline := time.Time{}
+		if timeout > 0 {
+			deadline = deadlineClock.Now().Add(timeout)
+		}
+		controller := http.NewResponseController(c.Writer)
+		err := controller.SetReadDeadline(deadline)
+		if err == nil {
+			err = controller.SetWriteDeadline(deadline)
+		}
+		// Writers without a connection, such as test recorders, have no deadlines.
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logRequestf(c, "extending the deadlines of %s %s failed: %v", c.Request.Method, route(c), err)
+		}
+		c.Next()
+	}
+}
+
+// serverCertificate is the certificate the server is serving, nil without TLS.
+var serverCertificate atomic.Pointer[certificateReloader]
+
+// certReloadInterval is how often the certificate files are checked for changes.
+var certReloadInterval = time.Minute
+
+// certificateReloader serves the certificate in a pair of PEM files and loads it again
+// when they change, so a renewed certificate is served without a restart.
+type certificateReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+
+	mu    sync.Mutex
+	files [2]fileVersion
+}
+
+// fileVersion identifies the content of a file by its modification time and size.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statVersion(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// newCertificateReloader loads the certificate in certFile and keyFile.
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate files again. On error the current certificate is kept.
+func (r *certificateReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked()
+}
+
+func (r *certificateReloader) reloadLocked() error {
+	// Record the versions before reading, so a write during the read is seen as a
+	// change next time.
+	var files [2]fileVersion
+	for i, path := range []string{r.certFile, r.keyFile} {
+		version, err := statVersion(path)
+		if err != nil {
+			return err
+		}
+		files[i] = version
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	r.files = files
+	return nil
+}
+
+// reloadIfChanged reloads the certificate if either file changed since it was last
+// loaded, and reports whether it did.
+func (r *certificateReloader) reloadIfChanged() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, path := range []string{r.certFile, r.keyFile} {
+		version, err := statVersion(path)
+		if err != nil {
+			return false, err
+		}
+		if version != r.files[i] {
+			return true, r.reloadLocked()
+		}
+	}
+	return false, nil
+}
+
+// watch checks the files for changes every interval until stop is closed.
+func (r *certificateReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if changed, err := r.reloadIfChanged(); err != nil {
+			log.Printf("TLS certificate reload failed, keeping the current certificate: %v", err)
+		} else if changed {
+			log.Printf("TLS certificate reloaded from %s", r.certFile)
+		}
+	}
+}
+
+// getCertificate is the tls.Config GetCertificate callback.
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// newTLSConfig returns the server's TLS config, serving the certificate of the
+// returned reloader, or nil when no certificate is given. It allows TLS 1.2 with
+// forward secret AEAD cipher suites and TLS 1.3. With a client CA, connections must
+// present a client certificate it signed; others fail the handshake.
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, *certificateReloader, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, nil, errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("--tls-cert and --tls-key must be given together")
+	}
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		GetCertificate:   reloader.getCertificate,
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+	if clientCAFile != "" {
+		data, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("%s: has no PEM certificates", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, reloader, nil
+}
+
+// buildMode is the gin mode used without --mode or GIN_MODE. Release builds set it
+// with -ldflags "-X main.buildMode=release".
+var buildMode = gin.DebugMode
+
+// runMode is --mode, and printRoutes --print-routes, which logs the routes of each
+// listener at startup in any mode instead of gin printing them in debug mode.
+var (
+	runMode     string
+	printRoutes bool
+)
+
+// resolveMode returns the gin mode to run in: --mode, else GIN_MODE, else buildMode.
+func resolveMode(flagMode string, getenv func(string) string) (string, error) {
+	mode, source := buildMode, "the build mode"
+	if env := getenv("GIN_MODE"); env != "" {
+		mode, source = env, "GIN_MODE"
+	}
+	if flagMode != "" {
+		mode, source = flagMode, "--mode"
+	}
+	switch mode {
+	case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+		return mode, nil
+	}
+	return "", fmt.Errorf("%s %q is not debug, release or test", source, mode)
+}
+
+// logRoutes logs the routes of router, served on addr, if --print-routes is given.
+func logRoutes(addr string, router *gin.Engine) *gin.Engine {
+	if printRoutes {
+		for _, r := range router.Routes() {
+			log.Printf("%s serves %s %s", addr, r.Method, r.Path)
+		}
+	}
+	return router
+}
+
+// enableH2C is --enable-h2c, which serves HTTP/2 without TLS, h2c, next to HTTP/1.1 on
+// the plain HTTP listeners, for meshes that multiplex requests to backends. Over TLS,
+// HTTP/2 is always negotiated.
+var enableH2C bool
+
+// newServer returns a server for handler with the limits of the flags, serving TLS when
+// config isn't nil, and h2c when it is and --enable-h2c is given.
+func newServer(handler http.Handler, config *tls.Config) *http.Server {
+	server := &http.Server{
+		Handler:           handler,
+		TLSConfig:         config,
+		ReadHeaderTimeout: limits.readHeaderTimeout,
+		ReadTimeout:       limits.readTimeout,
+		WriteTimeout:      limits.writeTimeout,
+		IdleTimeout:       limits.idleTimeout,
+		MaxHeaderBytes:    int(limits.maxHeaderBytes),
+	}
+	if enableH2C && config == nil {
+		serveH2C(server)
+	}
+	return server
+}
+
+// serveH2C has the plain HTTP server serve h2c as well as HTTP/1.1.
+func serveH2C(server *http.Server) {
+	h2 := &http2.Server{}
+	// ConfigureServer has Shutdown send the h2 connections a GOAWAY. It only fails for
+	// TLS configs, and the one it makes up is for h2 over TLS, so it is dropped.
+	_ = http2.ConfigureServer(server, h2)
+	server.TLSConfig = nil
+	server.Handler = &h2cHandler{Handler: h2c.NewHandler(server.Handler, h2)}
+}
+
+// h2cHandler serves h2c, counting the requests it is serving. An h2c connection is
+// served within the request that started it, after the http.Server has stopped
+// tracking the connection, so shutdown waits for the count to drain as well.
+type h2cHandler struct {
+	http.Handler
+	active sync.WaitGroup
+}
+
+func (h *h2cHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.active.Add(1)
+	defer h.active.Done()
+	h.Handler.ServeHTTP(w, r)
+}
+
+// shutdown shuts server down gracefully, also waiting for its h2c connections to
+// finish their streams, until ctx is done.
+func shutdown(ctx context.Context, server *http.Server) error {
+	err := server.Shutdown(ctx)
+	if h, ok := server.Handler.(*h2cHandler); ok {
+		drained := make(chan struct{})
+		go func() {
+			h.active.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+	return err
+}
+
+// serve serves connections from listener until the server is closed.
+func serve(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// endpoint is a server and the listener it serves.
+type endpoint struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// unixScheme starts the addresses of Unix domain sockets, such as
+// unix:///var/run/fetch.sock.
+const unixScheme = "unix://"
+
+// socketMode is --socket-mode, the permissions Unix domain sockets are created with.
+var socketMode = fileMode(0o660)
+
+// listen listens on addr for server: a host:port, or a Unix domain socket path after
+// unixScheme.
+func listen(addr string, server *http.Server) (endpoint, error) {
+	var listener net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		listener, err = listenUnix(path, os.FileMode(socketMode))
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return endpoint{}, err
+	}
+	return endpoint{server: server, listener: listener}, nil
+}
+
+// listenUnix listens on a Unix domain socket at path with the permissions of mode. A
+// socket left at path by a process that is gone is replaced, but not one something
+// still listens on, nor any other file. The socket is removed when the listener is
+// closed, as on shutdown.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("the address of a Unix domain socket needs a path, e.g. unix:///var/run/fetch.sock")
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing the stale socket %s: %w", path, err)
+		}
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(true)
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return localListener{listener}, nil
+}
+
+// localListener reports the peers of a Unix domain socket, which have no address of
+// their own, as 127.0.0.1, so client IPs, rate limits and --trusted-proxies treat a
+// proxy on the socket like one on the loopback interface.
+type localListener struct {
+	net.Listener
+}
+
+func (l localListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return localConn{conn}, nil
+}
+
+// localConn is a connection to a localListener.
+type localConn struct {
+	net.Conn
+}
+
+func (localConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// serveAll serves every endpoint until a signal arrives on stop or one of them fails,
+// then shuts all of them down together. After a signal, /ready reports 503 for
+// shutdownDelay before the listeners close, and requests in flight are given
+// shutdownGrace to finish, but for the receipt streams and WebSockets, which are
+// ended. It returns the error the failing endpoint or the shutdown met.
+func serveAll(stop <-chan os.Signal, endpoints ...endpoint) error {
+	errs := make(chan error, len(endpoints))
+	for _, e := range endpoints {
+		e := e
+		go func() { errs <- serve(e.server, e.listener) }()
+	}
+	var err error
+	select {
+	case sig := <-stop:
+		shuttingDown.Store(true)
+		log.Printf("%v received, shutting down in %v", sig, shutdownDelay)
+		select {
+		case <-time.After(shutdownDelay):
+		case err = <-errs:
+		}
+	case err = <-errs:
+		shuttingDown.Store(true)
+	}
+
+	// Streams never finish on their own, so they are ended for the shutdown to wait on
+	// the other requests only. It doesn't wait on WebSockets, which are closed too.
+	receiptStream.close()
+	liveUpdates.close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	for _, e := range endpoints {
+		if shutdownErr := shutdown(ctx, e.server); err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// closeState stops what runs in the background once the listeners are shut down, and
+// closes the audit log, the webhooks, the event publisher and the tracer provider,
+// which buffer what they write.
+func closeState(ctx context.Context, stopBackground context.CancelFunc, tracerProvider *sdktrace.TracerProvider) {
+	stopBackground()
+	if a := auditLog.Swap(nil); a != nil {
+		if err := a.close(); err != nil {
+			log.Printf("closing the audit log failed: %v", err)
+		}
+	}
+	if d := webhooks.Swap(nil); d != nil {
+		d.close(ctx)
+	}
+	if p := eventPublisher.Swap(nil); p != nil {
+		p.close(ctx)
+	}
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			log.Printf("exporting the queued spans failed: %v", err)
+		}
+	}
+}
+
+// newHealthRouter serves only the health, readiness and version endpoints, for the
+// --health-addr that probes reach without a client certificate.
+func newHealthRouter() *gin.Engine {
+	router := newGinEngine()
+	router.GET("/health", getHealth)
+	router.GET("/ready", getReady)
+	router.GET("/version", getVersion)
+	return router
+}
+
+// getReady reports whether the server takes requests: 503 once shutdown has begun,
+// while /health still reports the process alive.
+func getReady(c *gin.Context) {
+	if shuttingDown.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// certIdentity names the subject of a client certificate: its common name, or else its
+// first DNS, URI or email subject alternative name.
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// recordClientCert records the identity of the verified client certificate, if the
+// connection has one, as the "user" in the context, the caller receipts are owned by
+// and scoped to, and logs it. A bearer token takes precedence: authenticate replaces
+// the certificate's identity with the token's user or client.
+func recordClientCert() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if state := c.Request.TLS; state != nil && len(state.VerifiedChains) > 0 {
+			if identity := certIdentity(state.VerifiedChains[0][0]); identity != "" {
+				logRequestf(c, "%s %s from client certificate %s", c.Request.Method, route(c), identity)
+				c.Set("user", identity)
+			}
+		}
+		c.Next()
+	}
+}
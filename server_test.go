@@ -0,0 +1,953 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+)
+
+// selfSignedCerts are two self-signed server certificates for 127.0.0.1, with the
+// common names first.test and second.test, generated by TestMain.
+var selfSignedCerts [2]struct{ certPEM, keyPEM []byte }
+
+func TestMain(m *testing.M) {
+	for i, name := range []string{"first.test", "second.test"} {
+		certPEM, keyPEM, err := selfSignedCert(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		selfSignedCerts[i].certPEM, selfSignedCerts[i].keyPEM = certPEM, keyPEM
+	}
+	os.Exit(m.Run())
+}
+
+// selfSignedCert returns a self-signed certificate for 127.0.0.1 with a common name,
+// and its key, as PEM.
+func selfSignedCert(name string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// testCA is a certificate authority for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a certificate for template and returns it with its key as PEM.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert issues a client certificate for template.
+func (ca *testCA) clientCert(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	certPEM, keyPEM := ca.issue(t, template)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writePEM writes data to a file named name in a temporary directory.
+func writePEM(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startServer serves handler on a local port until the end of the test and returns its
+// address.
+func startServer(t *testing.T, handler http.Handler, config *tls.Config) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(handler, config)
+	go serve(server, listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}})
+	certFile, keyFile := writePEM(t, "cert.pem", certPEM), writePEM(t, "key.pem", keyPEM)
+	caFile := writePEM(t, "ca.pem", ca.pem)
+
+	if config, _, err := newTLSConfig("", "", ""); config != nil || err != nil {
+		t.Errorf("expected no TLS without a certificate but got %v, %v", config, err)
+	}
+	config, _, err := newTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 or later but got %x", config.MinVersion)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("expected client certificates to be required but got %v", config.ClientAuth)
+	}
+
+	testCases := []struct {
+		name          string
+		cert, key, ca string
+		expected      string
+	}{
+		{"ClientCAWithoutTLS", "", "", caFile, "--tls-client-ca requires --tls-cert and --tls-key"},
+		{"CertWithoutKey", certFile, "", "", "--tls-cert and --tls-key must be given together"},
+		{"KeyWithoutCert", "", keyFile, "", "--tls-cert and --tls-key must be given together"},
+		{"NoCertificates", certFile, keyFile, keyFile, keyFile + ": has no PEM certificates"},
+	}
+	for _, tc := range testCases {
+		if _, _, err := newTLSConfig(tc.cert, tc.key, tc.ca); err == nil || err.Error() != tc.expected {
+			t.Errorf("%s: expected %q but got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	ca, otherCA := newTestCA(t, "Test CA"), newTestCA(t, "Other CA")
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	config, _, err := newTLSConfig(writePEM(t, "cert.pem", certPEM), writePEM(t, "key.pem", keyPEM), writePEM(t, "ca.pem", ca.pem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter()
+	router.GET("/test/caller", func(c *gin.Context) { c.String(http.StatusOK, c.GetString("user")) })
+	addr := startServer(t, router, config)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	get := func(path string, certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + addr + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	spiffe, _ := url.Parse("spiffe://internal/batch-importer")
+	testCases := []struct {
+		name     string
+		cert     *x509.Certificate
+		expected string
+	}{
+		{"CommonName", &x509.Certificate{Subject: pkix.Name{CommonName: "batch-importer"}}, "batch-importer"},
+		{"DNSName", &x509.Certificate{DNSNames: []string{"importer.internal"}}, "importer.internal"},
+		{"URI", &x509.Certificate{URIs: []*url.URL{spiffe}}, "spiffe://internal/batch-importer"},
+	}
+	for _, tc := range testCases {
+		body, err := get("/test/caller", ca.clientCert(t, tc.cert))
+		if err != nil {
+			t.Errorf("%s: expected the handshake to succeed but got %v", tc.name, err)
+		} else if body != tc.expected {
+			t.Errorf("%s: expected the caller to be %q but got %q", tc.name, tc.expected, body)
+		}
+	}
+	if body, err := get("/rules", ca.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "dashboard"}})); err != nil || !strings.Contains(body, "hash") {
+		t.Errorf("expected the rules but got %q, %v", body, err)
+	}
+
+	// Connections without a certificate from the client CA fail the handshake, before
+	// any handler runs.
+	if _, err := get("/health"); err == nil {
+		t.Error("expected a connection without a client certificate to be rejected")
+	}
+	if _, err := get("/health", otherCA.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "intruder"}})); err == nil {
+		t.Error("expected a certificate from another CA to be rejected")
+	}
+
+	// The health port is plain HTTP without client certificates.
+	health := startServer(t, newHealthRouter(), nil)
+	resp, err := http.Get("http://" + health + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 from the health port but got %v", resp.StatusCode)
+	}
+	resp, err = http.Get("http://" + health + "/rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected only health and version on the health port but got %v for /rules", resp.StatusCode)
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	router.GET("/test/caller", authenticate(scopeRead), func(c *gin.Context) {
+		c.String(http.StatusOK, "user=%s client=%s", c.GetString("user"), c.GetString("client"))
+	})
+	// request sends a request over a connection whose client certificate names cn.
+	request := func(method, path, cn, token string) *httptest.ResponseRecorder {
+		body := ""
+		if method == http.MethodPost {
+			body = validReceiptPayload
+		}
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The certificate is the caller the receipts it processes are scoped to.
+	rr := request(http.MethodPost, "/receipts/process", "batch-importer", "")
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected the receipt to be processed but got %v: %s", rr.Code, rr.Body.String())
+	}
+	receiptsMu.RLock()
+	owner := receipts[processed.ID].Owner
+	receiptsMu.RUnlock()
+	if owner != "batch-importer" {
+		t.Errorf("expected the receipt to be owned by the certificate's identity but got %q", owner)
+	}
+	points := "/receipts/" + processed.ID + "/points"
+	if rr := request(http.MethodGet, points, "batch-importer", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the owner to read its receipt but got %v", rr.Code)
+	}
+	if rr := request(http.MethodGet, points, "dashboard", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected another certificate not to see the receipt but got %v", rr.Code)
+	}
+
+	// A bearer token identifies the caller instead of the certificate.
+	useFakeClock(t, jwtNow)
+	key := generateKey(t)
+	useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+	useIntrospection(t, map[string]map[string]any{
+		"reporting-token": {"active": true, "client_id": "reporting", "scope": "read", "exp": jwtNow.Add(time.Hour).Unix()},
+	})
+	testCases := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{"UserToken", userToken(t, key, "k1", "alice"), "user=alice client="},
+		{"ClientToken", "reporting-token", "user= client=reporting"},
+	}
+	for _, tc := range testCases {
+		if rr := request(http.MethodGet, "/test/caller", "batch-importer", tc.token); rr.Code != http.StatusOK || rr.Body.String() != tc.expected {
+			t.Errorf("%s: expected %q but got %v %q", tc.name, tc.expected, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := request(http.MethodGet, points, "batch-importer", "reporting-token"); rr.Code != http.StatusOK {
+		t.Errorf("expected a client token to see every receipt but got %v", rr.Code)
+	}
+	if rr := request(http.MethodGet, points, "batch-importer", userToken(t, key, "k1", "alice")); rr.Code != http.StatusNotFound {
+		t.Errorf("expected alice not to see the certificate's receipt but got %v", rr.Code)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	// install writes one of the self-signed certificates to the files, dating them
+	// later each time so the change is seen whatever the file system's time resolution.
+	installed := time.Now()
+	install := func(i int, keyPEM []byte) {
+		t.Helper()
+		installed = installed.Add(time.Minute)
+		for path, data := range map[string][]byte{certFile: selfSignedCerts[i].certPEM, keyFile: keyPEM} {
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, installed, installed); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	install(0, selfSignedCerts[0].keyPEM)
+
+	config, certificate, err := newTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, newHealthRouter(), config)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(selfSignedCerts[0].certPEM)
+	roots.AppendCertsFromPEM(selfSignedCerts[1].certPEM)
+	served := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if name := served(); name != "first.test" {
+		t.Fatalf("expected first.test but got %s", name)
+	}
+
+	if changed, err := certificate.reloadIfChanged(); changed || err != nil {
+		t.Errorf("expected no reload without a change but got %v, %v", changed, err)
+	}
+	install(1, selfSignedCerts[1].keyPEM)
+	if changed, err := certificate.reloadIfChanged(); !changed || err != nil {
+		t.Errorf("expected a reload after the files changed but got %v, %v", changed, err)
+	}
+	if name := served(); name != "second.test" {
+		t.Errorf("expected the renewed certificate second.test but got %s", name)
+	}
+
+	// A broken renewal keeps the current certificate.
+	install(0, []byte("not a key"))
+	if _, err := certificate.reloadIfChanged(); err == nil {
+		t.Error("expected a mismatched key to fail the reload")
+	}
+	if name := served(); name != "second.test" {
+		t.Errorf("expected second.test to still be served but got %s", name)
+	}
+
+	// SIGHUP reloads it too.
+	install(0, selfSignedCerts[0].keyPEM)
+	serverCertificate.Store(certificate)
+	defer serverCertificate.Store(nil)
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGHUP
+	close(signals)
+	reloadOnSignal(signals)
+	if name := served(); name != "first.test" {
+		t.Errorf("expected first.test after SIGHUP but got %s", name)
+	}
+
+	// And so does the watcher.
+	stop := make(chan struct{})
+	defer close(stop)
+	go certificate.watch(10*time.Millisecond, stop)
+	install(1, selfSignedCerts[1].keyPEM)
+	for deadline := time.Now().Add(5 * time.Second); served() != "second.test"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the watcher to serve second.test")
+		}
+	}
+}
+
+// statusOf returns the status of a GET of url.
+func statusOf(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminListener(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous string) { adminAddr = previous }(adminAddr)
+	adminAddr = "127.0.0.1:0"
+
+	api, err := listen("127.0.0.1:0", newServer(newRouter(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := listen(adminAddr, newServer(newAdminRouter(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- serveAll(stop, api, admin) }()
+	apiURL, adminURL := "http://"+api.listener.Addr().String(), "http://"+admin.listener.Addr().String()
+
+	testCases := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{apiURL + "/rules", http.StatusOK},
+		{apiURL + "/admin/quotas", http.StatusNotFound},
+		{apiURL + "/admin/load", http.StatusNotFound},
+		{adminURL + "/admin/quotas", http.StatusOK},
+		{adminURL + "/admin/load", http.StatusOK},
+		{adminURL + "/health", http.StatusOK},
+		{adminURL + "/rules", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		if status := statusOf(t, tc.url); status != tc.expectedStatus {
+			t.Errorf("%s: expected status %v but got %v", tc.url, tc.expectedStatus, status)
+		}
+	}
+
+	// Both listeners see the same receipts.
+	resp, err := http.Post(apiURL+"/receipts/process", "application/json", strings.NewReader(validReceiptPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var processed struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(body, &processed)
+	id := processed.ID
+	if status := statusOf(t, adminURL+"/admin/receipts/"+id+"/trace"); status != http.StatusOK {
+		t.Errorf("expected the admin listener to trace the receipt %s but got %v", id, status)
+	}
+
+	stop <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown but got %v", err)
+	}
+	for _, url := range []string{apiURL, adminURL} {
+		if _, err := http.Get(url + "/health"); err == nil {
+			t.Errorf("expected %s to be shut down", url)
+		}
+	}
+}
+
+func TestServeAllShutsDownTogether(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	first, err := listen("127.0.0.1:0", newServer(slow, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := listen("127.0.0.1:0", newServer(http.NotFoundHandler(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- serveAll(stop, first, second) }()
+
+	statuses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + first.listener.Addr().String())
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+	<-started
+
+	// Shutdown waits for the request in flight.
+	stop <- syscall.SIGINT
+	select {
+	case err := <-done:
+		t.Fatalf("expected the shutdown to wait for the request in flight but it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if status := <-statuses; status != http.StatusOK {
+		t.Errorf("expected the request in flight to finish but got %v", status)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown but got %v", err)
+	}
+	if _, err := http.Get("http://" + second.listener.Addr().String()); err == nil {
+		t.Error("expected the other server to be shut down too")
+	}
+
+	// A server that fails takes the others down with it.
+	third, err := listen("127.0.0.1:0", newServer(http.NotFoundHandler(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := listen("127.0.0.1:0", newServer(http.NotFoundHandler(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.listener.Close()
+	if err := serveAll(make(chan os.Signal), third, broken); err == nil {
+		t.Error("expected the failure of a server to be returned")
+	}
+	if _, err := http.Get("http://" + third.listener.Addr().String()); err == nil {
+		t.Error("expected the other server to be shut down after the failure")
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	// Earlier tests shut servers down too.
+	shuttingDown.Store(false)
+	defer shuttingDown.Store(false)
+	defer func(previous time.Duration) { shutdownDelay = previous }(shutdownDelay)
+	shutdownDelay = 200 * time.Millisecond
+	_, sink := useAuditLog(t, 0)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	router := newRouter()
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusOK)
+	})
+	api, err := listen("127.0.0.1:0", newServer(router, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- serveAll(stop, api) }()
+	apiURL := "http://" + api.listener.Addr().String()
+	if status := statusOf(t, apiURL+"/ready"); status != http.StatusOK {
+		t.Fatalf("expected /ready to be 200 while serving but got %v", status)
+	}
+
+	statuses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(apiURL + "/slow")
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+	<-started
+
+	// Readiness fails as soon as the signal arrives, while requests are still taken.
+	stop <- syscall.SIGTERM
+	deadline := time.Now().Add(shutdownDelay)
+	for !shuttingDown.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if status := statusOf(t, apiURL+"/ready"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected /ready to be 503 once shutdown began but got %v", status)
+	}
+	if status := statusOf(t, apiURL+"/health"); status != http.StatusOK {
+		t.Errorf("expected /health to stay 200 during shutdown but got %v", status)
+	}
+
+	close(release)
+	if status := <-statuses; status != http.StatusOK {
+		t.Errorf("expected the slow request to finish but got %v", status)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown but got %v", err)
+	}
+
+	// The background work stops and the audit log is closed.
+	background, stopBackground := context.WithCancel(context.Background())
+	closeState(context.Background(), stopBackground, nil)
+	if background.Err() == nil {
+		t.Error("expected the background work to be stopped")
+	}
+	if auditLog.Load() != nil {
+		t.Error("expected the audit log to be closed")
+	}
+	if _, err := sink.file.Write([]byte("{}\n")); err == nil {
+		t.Error("expected the audit log file to be closed")
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	testCases := []struct {
+		name     string
+		limits   serverLimits
+		expected string
+	}{
+		{"defaults", limits, ""},
+		{"no timeouts", serverLimits{}, ""},
+		{"no write timeout", serverLimits{readTimeout: time.Minute}, ""},
+		{"negative read header timeout", serverLimits{readHeaderTimeout: -time.Second}, "--read-header-timeout -1s is negative"},
+		{"negative idle timeout", serverLimits{idleTimeout: -time.Second}, "--idle-timeout -1s is negative"},
+		{"negative header size", serverLimits{maxHeaderBytes: -1}, "--max-header-bytes -1 is negative"},
+		{"write before read", serverLimits{readTimeout: time.Minute, writeTimeout: time.Second}, "--write-timeout 1s is shorter than --read-timeout 1m0s"},
+	}
+	for _, tc := range testCases {
+		err := tc.limits.validate()
+		if tc.expected == "" && err != nil || tc.expected != "" && (err == nil || err.Error() != tc.expected) {
+			t.Errorf("%s: expected %q but got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestSlowHeadersAreCutOff(t *testing.T) {
+	defer func(previous serverLimits) { limits = previous }(limits)
+	limits.readHeaderTimeout = 200 * time.Millisecond
+	addr := startServer(t, http.NotFoundHandler(), nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	// Send a header every 50ms, never finishing the request.
+	start := time.Now()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n")
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			if elapsed := time.Since(start); elapsed < limits.readHeaderTimeout {
+				t.Errorf("expected the connection to be closed after %v but it was after %v", limits.readHeaderTimeout, elapsed)
+			}
+			return
+		case <-ticker.C:
+			if time.Since(start) > 10*limits.readHeaderTimeout {
+				t.Fatal("expected the connection dribbling headers to be closed")
+			}
+			fmt.Fprint(conn, "X-Dribble: 1\r\n")
+		}
+	}
+}
+
+func TestExtendDeadlines(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(previous serverLimits) { limits = previous }(limits)
+	limits.readTimeout, limits.writeTimeout = 100*time.Millisecond, 100*time.Millisecond
+	slow := func(c *gin.Context) {
+		time.Sleep(300 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	}
+	router := gin.New()
+	router.GET("/slow", slow)
+	router.GET("/export", extendDeadlines(time.Second), slow)
+	addr := startServer(t, router, nil)
+
+	// Past the write timeout the connection is closed without a response.
+	if resp, err := http.Get("http://" + addr + "/slow"); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected the slow response to be cut off but got %v", resp.StatusCode)
+	}
+	if status := statusOf(t, "http://"+addr+"/export"); status != http.StatusOK {
+		t.Errorf("expected the route with extended deadlines to respond but got %v", status)
+	}
+}
+
+func TestResolveMode(t *testing.T) {
+	defer func(previous string) { buildMode = previous }(buildMode)
+	testCases := []struct {
+		name, buildMode, env, flag string
+		expected                   string
+		expectedError              string
+	}{
+		{"development build", gin.DebugMode, "", "", gin.DebugMode, ""},
+		{"release build", gin.ReleaseMode, "", "", gin.ReleaseMode, ""},
+		{"environment over build", gin.ReleaseMode, gin.DebugMode, "", gin.DebugMode, ""},
+		{"flag over environment", gin.DebugMode, gin.DebugMode, gin.ReleaseMode, gin.ReleaseMode, ""},
+		{"flag over build", gin.ReleaseMode, "", gin.TestMode, gin.TestMode, ""},
+		{"invalid flag", gin.DebugMode, gin.ReleaseMode, "prod", "", `--mode "prod" is not debug, release or test`},
+		{"invalid environment", gin.DebugMode, "production", "", "", `GIN_MODE "production" is not debug, release or test`},
+		{"flag overrides invalid environment", gin.DebugMode, "production", gin.ReleaseMode, gin.ReleaseMode, ""},
+	}
+	for _, tc := range testCases {
+		buildMode = tc.buildMode
+		env := tc.env
+		mode, err := resolveMode(tc.flag, func(name string) string {
+			if name == "GIN_MODE" {
+				return env
+			}
+			return ""
+		})
+		if tc.expectedError != "" {
+			if err == nil || err.Error() != tc.expectedError {
+				t.Errorf("%s: expected %q but got %q, %v", tc.name, tc.expectedError, mode, err)
+			}
+			continue
+		}
+		if err != nil || mode != tc.expected {
+			t.Errorf("%s: expected %q but got %q, %v", tc.name, tc.expected, mode, err)
+		}
+	}
+}
+
+func TestLogRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logs := captureLogs(t)
+	defer func(previous bool) { printRoutes = previous }(printRoutes)
+
+	printRoutes = false
+	logRoutes(":8081", newHealthRouter())
+	if logs.String() != "" {
+		t.Errorf("expected no routes logged without --print-routes but got %s", logs.String())
+	}
+	printRoutes = true
+	logRoutes(":8081", newHealthRouter())
+	for _, route := range []string{":8081 serves GET /health", ":8081 serves GET /ready", ":8081 serves GET /version"} {
+		if !strings.Contains(logs.String(), route) {
+			t.Errorf("expected %q to be logged but got %s", route, logs.String())
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	shuttingDown.Store(false)
+	defer shuttingDown.Store(false)
+	path := filepath.Join(t.TempDir(), "fetch.sock")
+
+	// A socket left behind by a process that is gone is replaced.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	api, err := listen("unix://"+path, newServer(newRouter(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o660 {
+		t.Fatalf("expected a socket with permissions 0660 but got %v, %v", info, err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- serveAll(stop, api) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Post("http://fetch/receipts/process", "application/json", strings.NewReader(validReceiptPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || created.ID == "" {
+		t.Fatalf("expected the receipt to be processed over the socket but got %v", resp.StatusCode)
+	}
+	resp, err = client.Get("http://fetch/receipts/" + created.ID + "/points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the points over the socket but got %v", resp.StatusCode)
+	}
+
+	// A socket in use, or a file that isn't a socket, is left alone.
+	if _, err := listen("unix://"+path, newServer(newRouter(), nil)); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("expected a socket in use to be refused but got %v", err)
+	}
+	notSocket := filepath.Join(t.TempDir(), "fetch.sock")
+	if err := os.WriteFile(notSocket, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix://"+notSocket, newServer(newRouter(), nil)); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("expected a file that isn't a socket to be refused but got %v", err)
+	}
+
+	// Shutting down removes the socket.
+	stop <- os.Interrupt
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on shutdown but got %v", err)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	shuttingDown.Store(false)
+	defer shuttingDown.Store(false)
+	defer func(previous bool) { enableH2C = previous }(enableH2C)
+	enableH2C = true
+
+	started, release := make(chan struct{}), make(chan struct{})
+	router := newRouter()
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusOK)
+	})
+	api, err := listen("127.0.0.1:0", newServer(router, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- serveAll(stop, api) }()
+	url := "http://" + api.listener.Addr().String()
+
+	// A client with prior knowledge speaks HTTP/2 without TLS.
+	h2Client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := h2Client.Post(url+"/receipts/process", "application/json", strings.NewReader(validReceiptPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 || created.ID == "" {
+		t.Fatalf("expected the receipt processed over HTTP/2 but got %v over %s", resp.StatusCode, resp.Proto)
+	}
+
+	// HTTP/1.1 keeps working on the same port.
+	resp, err = http.Get(url + "/receipts/" + created.ID + "/points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+		t.Errorf("expected the points over HTTP/1.1 but got %v over %s", resp.StatusCode, resp.Proto)
+	}
+
+	// Shutdown waits for the streams of h2c connections to finish.
+	statuses := make(chan int, 1)
+	go func() {
+		resp, err := h2Client.Get(url + "/slow")
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+	<-started
+	stop <- os.Interrupt
+	select {
+	case err := <-done:
+		t.Fatalf("expected shutdown to wait for the h2 stream but it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if status := <-statuses; status != http.StatusOK {
+		t.Errorf("expected the h2 stream in flight to finish but got %v", status)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown but got %v", err)
+	}
+}
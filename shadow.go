@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shadow scores every processed receipt a second time with a candidate rule set, so
+// its impact can be measured before it goes live. It is nil unless
+// --shadow-rules-config is set. Shadow scores are logged and summarized but never
+// stored or returned as a receipt's points.
+var shadow atomic.Pointer[shadowScorer]
+
+// shadowRulesConfigPath is the --shadow-rules-config file.
+var shadowRulesConfigPath string
+
+// deltaBucketBounds are the inclusive upper bounds of the delta histogram buckets. A
+// last bucket counts the deltas above the highest bound.
+var deltaBucketBounds = []int{-100, -50, -20, -10, -1, 0, 10, 20, 50, 100}
+
+// shadowMaxDivergences is how many of the largest divergences the summary keeps.
+const shadowMaxDivergences = 10
+
+// shadowDivergence is a receipt the shadow rules scored differently.
+type shadowDivergence struct {
+	ReceiptID    string `json:"receiptId"`
+	Points       int    `json:"points"`
+	ShadowPoints int    `json:"shadowPoints"`
+	Delta        int    `json:"delta"`
+}
+
+// deltaBucket is one bucket of a delta histogram. Le is nil for the last bucket.
+type deltaBucket struct {
+	Le    *int `json:"le"`
+	Count int  `json:"count"`
+}
+
+// deltaStats summarizes differences in points between two rule sets.
+type deltaStats struct {
+	count   int
+	total   int64
+	buckets []int
+}
+
+func newDeltaStats() deltaStats {
+	return deltaStats{buckets: make([]int, len(deltaBucketBounds)+1)}
+}
+
+func (s *deltaStats) add(delta int) {
+	s.count++
+	s.total += int64(delta)
+	bucket := len(deltaBucketBounds)
+	for i, bound := range deltaBucketBounds {
+		if delta <= bound {
+			bucket = i
+			break
+		}
+	}
+	s.buckets[bucket]++
+}
+
+func (s *deltaStats) mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return float64(s.total) / float64(s.count)
+}
+
+func (s *deltaStats) histogram() []deltaBucket {
+	histogram := make([]deltaBucket, len(s.buckets))
+	for i, count := range s.buckets {
+		histogram[i].Count = count
+		if i < len(deltaBucketBounds) {
+			histogram[i].Le = &deltaBucketBounds[i]
+		}
+	}
+	return histogram
+}
+
+// shadowSummary is the body of GET /admin/shadow/summary.
+type shadowSummary struct {
+	Hash      string             `json:"hash"`
+	Count     int                `json:"count"`
+	Failures  int                `json:"failures"`
+	MeanDelta float64            `json:"meanDelta"`
+	Histogram []deltaBucket      `json:"histogram"`
+	Largest   []shadowDivergence `json:"largest"`
+}
+
+// shadowScorer is a shadow engine with the statistics of its deltas, shadow points
+// minus official points.
+type shadowScorer struct {
+	engine *Engine
+
+	mu       sync.Mutex
+	deltas   deltaStats
+	failures int
+	// largest is ordered by decreasing absolute delta.
+	largest []shadowDivergence
+}
+
+func newShadowScorer(engine *Engine) *shadowScorer {
+	return &shadowScorer{engine: engine, deltas: newDeltaStats()}
+}
+
+// score scores a receipt with the shadow engine and records the delta from the official
+// points. A failing shadow engine is logged and counted, never propagated. requestID
+// tags the log lines.
+func (s *shadowScorer) score(receiptID, requestID string, receipt Receipt, points int) {
+	shadowPoints, err := scoreSafely(s.engine, receipt)
+	if err != nil {
+		s.mu.Lock()
+		s.failures++
+		s.mu.Unlock()
+		log.Printf("shadow scoring of receipt %s failed: %s request_id=%s", receiptID, sensitive(err), requestID)
+		return
+	}
+
+	delta := shadowPoints - points
+	s.record(shadowDivergence{ReceiptID: receiptID, Points: points, ShadowPoints: shadowPoints, Delta: delta})
+	log.Printf("shadow score of receipt %s: %d, official %d, delta %+d request_id=%s", receiptID, shadowPoints, points, delta, requestID)
+}
+
+// scoreSafely scores a receipt with a candidate engine, turning a panic into an error.
+func scoreSafely(engine *Engine, receipt Receipt) (points int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	points, _ = engine.ScoreReceipt(receipt)
+	return points, nil
+}
+
+func (s *shadowScorer) record(d shadowDivergence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deltas.add(d.Delta)
+	if d.Delta == 0 {
+		return
+	}
+	i := len(s.largest)
+	for i > 0 && abs(s.largest[i-1].Delta) < abs(d.Delta) {
+		i--
+	}
+	if i >= shadowMaxDivergences {
+		return
+	}
+	s.largest = append(s.largest, shadowDivergence{})
+	copy(s.largest[i+1:], s.largest[i:])
+	s.largest[i] = d
+	if len(s.largest) > shadowMaxDivergences {
+		s.largest = s.largest[:shadowMaxDivergences]
+	}
+}
+
+func (s *shadowScorer) summary() shadowSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return shadowSummary{
+		Hash:      s.engine.hash,
+		Count:     s.deltas.count,
+		Failures:  s.failures,
+		MeanDelta: s.deltas.mean(),
+		Histogram: s.deltas.histogram(),
+		Largest:   append([]shadowDivergence{}, s.largest...),
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func shadowSummaryHandler(c *gin.Context) {
+	s := shadow.Load()
+	if s == nil {
+		abortWithProblem(c, http.StatusNotFound, "SHADOW_NOT_CONFIGURED", "no --shadow-rules-config was given")
+		return
+	}
+
+	c.JSON(http.StatusOK, s.summary())
+}
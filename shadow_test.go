@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useShadowRules scores with a shadow engine for the rest of the test.
+func useShadowRules(t *testing.T, engine *Engine) *shadowScorer {
+	t.Helper()
+	s := newShadowScorer(engine)
+	shadow.Store(s)
+	t.Cleanup(func() { shadow.Store(nil) })
+	return s
+}
+
+func getShadowSummary(t *testing.T, router *gin.Engine) (int, shadowSummary) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/shadow/summary", nil))
+	var summary shadowSummary
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, summary
+}
+
+func TestShadowScoring(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	setRules(defaultRulesConfig())
+	router := newRouter()
+
+	if code, _ := getShadowSummary(t, router); code != http.StatusNotFound {
+		t.Errorf("expected 404 without shadow rules but got %v", code)
+	}
+
+	// The example receipt has two pairs, worth 10 more points at 10 per pair.
+	config := defaultRulesConfig()
+	config.ItemPairPoints = 10
+	useShadowRules(t, newEngine(config))
+
+	id, points := processAndScore(t, router, validReceiptPayload)
+	if points != 28 {
+		t.Errorf("expected the official 28 points but got %v", points)
+	}
+	receiptsMu.RLock()
+	stored := receipts[id]
+	receiptsMu.RUnlock()
+	if stored.Points != 28 || stored.RulesVersion != currentEngine().hash {
+		t.Errorf("expected the official score to be stored but got %+v", stored)
+	}
+	processAndScore(t, router, validReceiptPayload)
+
+	code, summary := getShadowSummary(t, router)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 but got %v", code)
+	}
+	if summary.Count != 2 || summary.Failures != 0 || summary.MeanDelta != 10 || summary.Hash != configHash(config) {
+		t.Errorf("expected 2 receipts with a mean delta of 10 but got %+v", summary)
+	}
+	if len(summary.Largest) != 2 || summary.Largest[0] != (shadowDivergence{ReceiptID: id, Points: 28, ShadowPoints: 38, Delta: 10}) {
+		t.Errorf("expected the first receipt to be the largest divergence but got %+v", summary.Largest)
+	}
+	for _, bucket := range summary.Histogram {
+		expected := 0
+		if bucket.Le != nil && *bucket.Le == 10 {
+			expected = 2
+		}
+		if bucket.Count != expected {
+			t.Errorf("expected %v deltas up to %v but got %v", expected, bucket.Le, bucket.Count)
+		}
+	}
+}
+
+func TestShadowDivergences(t *testing.T) {
+	s := newShadowScorer(newEngine(defaultRulesConfig()))
+	for i, delta := range []int{3, -50, 0, 200, 7, -1, 12, 4, -9, 30, 2, 1, -80} {
+		s.record(shadowDivergence{ReceiptID: string(rune('a' + i)), Delta: delta})
+	}
+
+	summary := s.summary()
+	if summary.Count != 13 || summary.MeanDelta != 119.0/13 {
+		t.Errorf("expected 13 deltas with a mean of 119/13 but got %+v", summary)
+	}
+	var deltas []int
+	for _, d := range summary.Largest {
+		deltas = append(deltas, d.Delta)
+	}
+	expected := []int{200, -80, -50, 30, 12, -9, 7, 4, 3, 2}
+	if len(deltas) != len(expected) {
+		t.Fatalf("expected the largest divergences %v but got %v", expected, deltas)
+	}
+	for i := range expected {
+		if deltas[i] != expected[i] {
+			t.Fatalf("expected the largest divergences %v but got %v", expected, deltas)
+		}
+	}
+
+	counts := []int{0, 2, 0, 0, 2, 1, 5, 1, 1, 0, 1}
+	for i, bucket := range summary.Histogram {
+		if bucket.Count != counts[i] {
+			t.Errorf("expected %v deltas in bucket %v but got %v", counts[i], bucket.Le, bucket.Count)
+		}
+	}
+}
+
+// panicRule fails the way a broken rule might.
+type panicRule struct{}
+
+func (panicRule) Name() string { return "panic" }
+
+func (panicRule) Evaluate(ParsedReceipt) (int, string) { panic("broken rule") }
+
+func TestShadowFailureIsIsolated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	setRules(defaultRulesConfig())
+	router := newRouter()
+
+	broken := newEngine(defaultRulesConfig())
+	broken.rules = append(broken.rules, panicRule{})
+	useShadowRules(t, broken)
+
+	if _, points := processAndScore(t, router, validReceiptPayload); points != 28 {
+		t.Errorf("expected the official 28 points but got %v", points)
+	}
+	if _, summary := getShadowSummary(t, router); summary.Count != 0 || summary.Failures != 1 {
+		t.Errorf("expected one failure and no deltas but got %+v", summary)
+	}
+}
+
+func BenchmarkShadowScore(b *testing.B) {
+	config := defaultRulesConfig()
+	config.ItemPairPoints = 10
+	s := newShadowScorer(newEngine(config))
+	receipt := exampleReceipts["target"]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.score("bench", "", receipt, 28)
+	}
+}
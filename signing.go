@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// signingSecretsFilePath is the --signing-secrets-file of secrets receipt submissions
+// must be signed with.
+var signingSecretsFilePath string
+
+// signingSecrets holds the secrets accepted by verifySignature, read from
+// --signing-secrets-file at startup and again on SIGHUP. Any of them may have signed a
+// request, so a secret can be rotated without a restart. None leaves submissions
+// unsigned.
+var signingSecrets atomic.Pointer[[][]byte]
+
+// signatureWindow is the --signature-window: how far the X-Timestamp of a signed request
+// may be from the server's time, and how long its X-Nonce is remembered. 0 leaves
+// the signature covering the body alone, without replay protection.
+var signatureWindow = 5 * time.Minute
+
+// nonces remembers the X-Nonce of each signed request within signatureWindow.
+var nonces nonceStore = newMemoryNonceStore()
+
+// maxNonceLength bounds the X-Nonce, and so the memory nonces take.
+const maxNonceLength = 128
+
+// signaturePrefix starts the X-Signature header, followed by the hex HMAC-SHA256 of the
+// signedPayload.
+const signaturePrefix = "sha256="
+
+// currentSigningSecrets returns the accepted secrets.
+func currentSigningSecrets() [][]byte {
+	if secrets := signingSecrets.Load(); secrets != nil {
+		return *secrets
+	}
+	return nil
+}
+
+// loadSigningSecrets reads a secrets file of one secret per line. Blank lines and lines
+// starting with # are ignored.
+func loadSigningSecrets(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var secrets [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		secret := strings.TrimSpace(scanner.Text())
+		if secret == "" || strings.HasPrefix(secret, "#") {
+			continue
+		}
+		secrets = append(secrets, []byte(secret))
+	}
+	if len(secrets) == 0 {
+		return nil, &configError{path: path, msg: "no signing secrets"}
+	}
+	return secrets, nil
+}
+
+// reloadSigningSecrets reads --signing-secrets-file again, if one was given. On error
+// the current secrets are kept.
+func reloadSigningSecrets() error {
+	if signingSecretsFilePath == "" {
+		return nil
+	}
+	secrets, err := loadSigningSecrets(signingSecretsFilePath)
+	if err != nil {
+		return err
+	}
+	signingSecrets.Store(&secrets)
+	return nil
+}
+
+// nonceStore remembers the nonces of signed requests so each is accepted once. The
+// memory store only sees the requests of one instance; deployments with several can
+// back it with a shared store such as Redis.
+type nonceStore interface {
+	// remember records nonce until expiresAt, reporting false if it is already
+	// recorded.
+	remember(nonce string, expiresAt time.Time) (bool, error)
+}
+
+// memoryNonceStore is a nonceStore in memory, dropping expired nonces at most once a
+// minute.
+type memoryNonceStore struct {
+	mu        sync.Mutex
+	expiries  map[string]time.Time
+	lastSweep time.Time
+}
+
+func newMemoryNonceStore() *memoryNonceStore {
+	return &memoryNonceStore{expiries: make(map[string]time.Time)}
+}
+
+func (s *memoryNonceStore) remember(nonce string, expiresAt time.Time) (bool, error) {
+	now := clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= time.Minute {
+		s.lastSweep = now
+		for n, expiry := range s.expiries {
+			if !now.Before(expiry) {
+				delete(s.expiries, n)
+			}
+		}
+	}
+	if expiry, ok := s.expiries[nonce]; ok && now.Before(expiry) {
+		return false, nil
+	}
+	s.expiries[nonce] = expiresAt
+	return true, nil
+}
+
+// len returns the number of nonces remembered.
+func (s *memoryNonceStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.expiries)
+}
+
+// signedPayload returns what a request's signature covers: with replay protection,
+// "<X-Timestamp>.<X-Nonce>.<body>", and otherwise the body alone.
+func signedPayload(timestamp, nonce string, body []byte) []byte {
+	if signatureWindow == 0 {
+		return body
+	}
+	return append([]byte(timestamp+"."+nonce+"."), body...)
+}
+
+// validSignature reports whether header is the "sha256=<hex>" HMAC of body under one of
+// secrets. Every secret is tried, and each compared in constant time.
+func validSignature(body []byte, header string, secrets [][]byte) bool {
+	signature, ok := strings.CutPrefix(header, signaturePrefix)
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) != sha256.Size {
+		return false
+	}
+	valid := false
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// verifySignature rejects request bodies without an X-Signature header carrying their
+// HMAC-SHA256 under one of the signing secrets with a 401. It reads the (already
+// size-limited) body to check it and hands an identical body on to the handler. It
+// lets everything through while no secrets are configured.
+//
+// Unless signatureWindow is 0, the signature also covers an X-Timestamp in unix
+// seconds within signatureWindow of the server's time and an X-Nonce. A nonce is
+// accepted once while its timestamp is fresh, and replays get a 401 with the
+// REPLAY_DETECTED code.
+func verifySignature() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secrets := currentSigningSecrets()
+		if len(secrets) == 0 {
+			c.Next()
+			return
+		}
+		header := c.GetHeader("X-Signature")
+		if header == "" {
+			abortWithProblem(c, http.StatusUnauthorized, "SIGNATURE_MISSING", "the X-Signature header is required")
+			return
+		}
+		timestamp, nonce := c.GetHeader("X-Timestamp"), c.GetHeader("X-Nonce")
+		var expiresAt time.Time
+		if signatureWindow != 0 {
+			if timestamp == "" || nonce == "" {
+				abortWithProblem(c, http.StatusUnauthorized, "SIGNATURE_MISSING", "the X-Timestamp and X-Nonce headers are required")
+				return
+			}
+			if len(nonce) > maxNonceLength {
+				abortWithProblem(c, http.StatusUnauthorized, "NONCE_INVALID", fmt.Sprintf("X-Nonce is longer than %d characters", maxNonceLength))
+				return
+			}
+			seconds, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				abortWithProblem(c, http.StatusUnauthorized, "TIMESTAMP_INVALID", "X-Timestamp must be in unix seconds")
+				return
+			}
+			now, signedAt := clock.Now(), time.Unix(seconds, 0)
+			if signedAt.Before(now.Add(-signatureWindow)) || signedAt.After(now.Add(signatureWindow)) {
+				abortWithProblem(c, http.StatusUnauthorized, "TIMESTAMP_STALE",
+					fmt.Sprintf("X-Timestamp is more than %s from the server's time", signatureWindow))
+				return
+			}
+			// Remember the nonce for as long as its timestamp would be accepted.
+			expiresAt = now
+			if signedAt.After(now) {
+				expiresAt = signedAt
+			}
+			expiresAt = expiresAt.Add(signatureWindow)
+		}
+
+		data, err := io.ReadAll(c.Request.Body)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			abortWithBodyTooLarge(c, maxBytesErr.Limit)
+			return
+		}
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, "BODY_UNREADABLE", "Failed to read the request body")
+			return
+		}
+		if !validSignature(signedPayload(timestamp, nonce, data), header, secrets) {
+			abortWithProblem(c, http.StatusUnauthorized, "SIGNATURE_INVALID", "X-Signature is not a valid sha256 signature of the request")
+			return
+		}
+		// Only nonces of genuine requests are remembered, so forgeries can't burn them.
+		if signatureWindow != 0 {
+			fresh, err := nonces.remember(nonce, expiresAt)
+			if err != nil {
+				abortWithProblem(c, http.StatusServiceUnavailable, "NONCE_STORE_UNAVAILABLE", "the nonce store could not be reached")
+				return
+			}
+			if !fresh {
+				abortWithProblem(c, http.StatusUnauthorized, "REPLAY_DETECTED", "X-Nonce "+nonce+" was already used")
+				return
+			}
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+		c.Next()
+	}
+}
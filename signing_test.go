@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useSigningSecrets reads the signing secrets from a file of contents for the rest of
+// the test, returning its path.
+func useSigningSecrets(t *testing.T, contents string) string {
+	t.Helper()
+	previousPath, previous := signingSecretsFilePath, signingSecrets.Load()
+	signingSecretsFilePath = writeConfig(t, "signing-secrets", contents)
+	t.Cleanup(func() {
+		signingSecretsFilePath = previousPath
+		signingSecrets.Store(previous)
+	})
+	if err := reloadSigningSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	return signingSecretsFilePath
+}
+
+// useSignatureWindow sets signatureWindow and a fresh nonce store for the rest of the
+// test.
+func useSignatureWindow(t *testing.T, window time.Duration) *memoryNonceStore {
+	t.Helper()
+	previousWindow, previous := signatureWindow, nonces
+	store := newMemoryNonceStore()
+	signatureWindow, nonces = window, store
+	t.Cleanup(func() { signatureWindow, nonces = previousWindow, previous })
+	return store
+}
+
+// sign returns the X-Signature of body under secret.
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// submitSigned posts a receipt with an X-Signature header, if signature isn't empty.
+func submitSigned(router *gin.Engine, body, signature string) *httptest.ResponseRecorder {
+	return submitStamped(router, body, signature, "", "")
+}
+
+// submitStamped posts a receipt with X-Signature, X-Timestamp and X-Nonce headers, each
+// if it isn't empty.
+func submitStamped(router *gin.Engine, body, signature, timestamp, nonce string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range map[string]string{"X-Signature": signature, "X-Timestamp": timestamp, "X-Nonce": nonce} {
+		if value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestValidSignature(t *testing.T) {
+	// RFC 4231 test cases 1 and 2.
+	key1, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	secrets := [][]byte{key1, []byte("Jefe")}
+	testCases := []struct {
+		body, header string
+		valid        bool
+	}{
+		{"Hi There", "sha256=b0344c61d8db38535ca8afceaf0bf12b881dc200c9833da726e9376c2e32cff7", true},
+		{"what do ya want for nothing?", "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843", true},
+		{"what do ya want for nothing?", "sha256=5BDCC146BF60754E6A042426089575C75A003F089D2739839DEC58B964EC3843", true},
+		{"what do ya want for nothing!", "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843", false},
+		{"what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843", false},
+		{"what do ya want for nothing?", "sha1=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843", false},
+		{"what do ya want for nothing?", "sha256=5bdcc146bf60754e6a042426089575c7", false},
+		{"what do ya want for nothing?", "sha256=not hex", false},
+	}
+	for _, tc := range testCases {
+		if valid := validSignature([]byte(tc.body), tc.header, secrets); valid != tc.valid {
+			t.Errorf("%q over %q: expected %v but got %v", tc.header, tc.body, tc.valid, valid)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	useSigningSecrets(t, "# partner\nold-secret\n")
+	// Without a window the signature covers the body alone.
+	useSignatureWindow(t, 0)
+
+	check := func(step string, rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var body problem
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if rr.Code != status || body.Code != code {
+			t.Errorf("%s: expected %v %s but got %v: %s", step, status, code, rr.Code, rr.Body.String())
+		}
+	}
+	check("missing", submitSigned(router, validReceiptPayload, ""), http.StatusUnauthorized, "SIGNATURE_MISSING")
+	check("wrong secret", submitSigned(router, validReceiptPayload, sign("other-secret", validReceiptPayload)), http.StatusUnauthorized, "SIGNATURE_INVALID")
+	check("tampered", submitSigned(router, validReceiptPayload, sign("old-secret", strings.Replace(validReceiptPayload, "35.35", "3535.00", 1))), http.StatusUnauthorized, "SIGNATURE_INVALID")
+
+	// The verified body still reaches the JSON checks and the handler intact.
+	rr := submitSigned(router, validReceiptPayload, sign("old-secret", validReceiptPayload))
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected a signed receipt to be processed but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := requestWithKey(router, http.MethodGet, "/receipts/"+processed.ID+"/points", ""); !strings.Contains(rr.Body.String(), `"points":28`) {
+		t.Errorf("expected the signed receipt to score 28 points but got %s", rr.Body.String())
+	}
+	duplicate := `{"retailer": "Target", "retailer": "Walmart"}`
+	check("duplicate keys", submitSigned(router, duplicate, sign("old-secret", duplicate)), http.StatusBadRequest, "JSON_DUPLICATE_KEY")
+
+	// Reads aren't signed.
+	if rr := requestWithKey(router, http.MethodGet, "/rules", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected reads to need no signature but got %v", rr.Code)
+	}
+}
+
+func TestSigningSecretRotation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	path := useSigningSecrets(t, "old-secret\n")
+	useSignatureWindow(t, 0)
+
+	// While both secrets are configured, the partner can switch over at any time.
+	if err := os.WriteFile(path, []byte("old-secret\nnew-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadSigningSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"old-secret", "new-secret"} {
+		if rr := submitSigned(router, validReceiptPayload, sign(secret, validReceiptPayload)); rr.Code != http.StatusOK {
+			t.Errorf("expected %s to be accepted during the rotation but got %v", secret, rr.Code)
+		}
+	}
+
+	// Once the old secret is removed, only the new one is accepted.
+	if err := os.WriteFile(path, []byte("new-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadSigningSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if rr := submitSigned(router, validReceiptPayload, sign("old-secret", validReceiptPayload)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the retired secret to be rejected but got %v", rr.Code)
+	}
+	if rr := submitSigned(router, validReceiptPayload, sign("new-secret", validReceiptPayload)); rr.Code != http.StatusOK {
+		t.Errorf("expected the new secret to be accepted but got %v", rr.Code)
+	}
+
+	// A file without secrets keeps the current ones.
+	if err := os.WriteFile(path, []byte("# empty\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadSigningSecrets(); err == nil {
+		t.Error("expected a file without secrets to be rejected")
+	}
+	if rr := submitSigned(router, validReceiptPayload, sign("new-secret", validReceiptPayload)); rr.Code != http.StatusOK {
+		t.Errorf("expected the new secret to still be accepted but got %v", rr.Code)
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	router := newRouter()
+	useSigningSecrets(t, "secret\n")
+	store := useSignatureWindow(t, 5*time.Minute)
+
+	now := strconv.FormatInt(fake.Now().Unix(), 10)
+	stamped := func(timestamp, nonce string) string {
+		return sign("secret", timestamp+"."+nonce+"."+validReceiptPayload)
+	}
+	check := func(step string, rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var body problem
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if rr.Code != status || body.Code != code {
+			t.Errorf("%s: expected %v %s but got %v: %s", step, status, code, rr.Code, rr.Body.String())
+		}
+	}
+
+	check("body alone", submitSigned(router, validReceiptPayload, sign("secret", validReceiptPayload)), http.StatusUnauthorized, "SIGNATURE_MISSING")
+	check("no nonce", submitStamped(router, validReceiptPayload, stamped(now, ""), now, ""), http.StatusUnauthorized, "SIGNATURE_MISSING")
+	check("not unix seconds", submitStamped(router, validReceiptPayload, stamped("2025-01-30", "n0"), "2025-01-30", "n0"), http.StatusUnauthorized, "TIMESTAMP_INVALID")
+	check("long nonce", submitStamped(router, validReceiptPayload, stamped(now, strings.Repeat("n", 129)), now, strings.Repeat("n", 129)), http.StatusUnauthorized, "NONCE_INVALID")
+	for _, offset := range []time.Duration{-5*time.Minute - time.Second, 5*time.Minute + time.Second} {
+		stale := strconv.FormatInt(fake.Now().Add(offset).Unix(), 10)
+		check("stale "+offset.String(), submitStamped(router, validReceiptPayload, stamped(stale, "n1"), stale, "n1"), http.StatusUnauthorized, "TIMESTAMP_STALE")
+	}
+	// The timestamp and nonce are signed, so they can't be swapped for fresh ones.
+	check("resigned nonce", submitStamped(router, validReceiptPayload, stamped(now, "n1"), now, "n2"), http.StatusUnauthorized, "SIGNATURE_INVALID")
+
+	check("first", submitStamped(router, validReceiptPayload, stamped(now, "n1"), now, "n1"), http.StatusOK, "")
+	fake.Advance(4 * time.Minute)
+	check("replay", submitStamped(router, validReceiptPayload, stamped(now, "n1"), now, "n1"), http.StatusUnauthorized, "REPLAY_DETECTED")
+	// A forged request doesn't burn the nonce of a later genuine one.
+	later := strconv.FormatInt(fake.Now().Unix(), 10)
+	check("forged", submitStamped(router, validReceiptPayload, stamped(later, "n3")+"0", later, "n3"), http.StatusUnauthorized, "SIGNATURE_INVALID")
+	check("genuine after forgery", submitStamped(router, validReceiptPayload, stamped(later, "n3"), later, "n3"), http.StatusOK, "")
+
+	// Once the first request's timestamp is stale, the replay is rejected as such and a
+	// retry signed anew with the same nonce is legitimate.
+	fake.Advance(2 * time.Minute)
+	check("stale replay", submitStamped(router, validReceiptPayload, stamped(now, "n1"), now, "n1"), http.StatusUnauthorized, "TIMESTAMP_STALE")
+	retry := strconv.FormatInt(fake.Now().Unix(), 10)
+	check("retry", submitStamped(router, validReceiptPayload, stamped(retry, "n1"), retry, "n1"), http.StatusOK, "")
+
+	// Nonces are forgotten once their timestamps are stale.
+	fake.Advance(10 * time.Minute)
+	check("much later", submitStamped(router, validReceiptPayload, stamped(strconv.FormatInt(fake.Now().Unix(), 10), "n4"), strconv.FormatInt(fake.Now().Unix(), 10), "n4"), http.StatusOK, "")
+	if n := store.len(); n != 1 {
+		t.Errorf("expected only the latest nonce to be remembered but got %v", n)
+	}
+}
+
+func TestReplayProtectionFutureTimestamp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	fake := useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	router := newRouter()
+	useSigningSecrets(t, "secret\n")
+	useSignatureWindow(t, time.Minute)
+
+	// A timestamp ahead of the server's clock stays fresh for longer, and so does its
+	// nonce.
+	ahead := strconv.FormatInt(fake.Now().Add(time.Minute).Unix(), 10)
+	signature := sign("secret", ahead+".n1."+validReceiptPayload)
+	if rr := submitStamped(router, validReceiptPayload, signature, ahead, "n1"); rr.Code != http.StatusOK {
+		t.Fatalf("expected a timestamp a window ahead to be accepted but got %v: %s", rr.Code, rr.Body.String())
+	}
+	fake.Advance(90 * time.Second)
+	if rr := submitStamped(router, validReceiptPayload, signature, ahead, "n1"); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "REPLAY_DETECTED") {
+		t.Errorf("expected the replay to be detected while its timestamp is fresh but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
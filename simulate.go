@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSimulationReceipts is the most stored receipts one simulation scores, and the
+// sample size when the request doesn't give one.
+const maxSimulationReceipts = 10000
+
+// simulationTimeout bounds how long one simulation runs. Receipts left when it runs
+// out are not scored and the summary says the simulation is incomplete.
+var simulationTimeout = 30 * time.Second
+
+// simulationRequest is the body of POST /admin/rules/simulate. Config is a rules config
+// in the JSON form of a --rules-config file. From and To are inclusive "YYYY-MM-DD"
+// purchase dates, Retailer matches retailer names as overrides do, and SampleSize
+// limits the simulation to the most recently processed matching receipts.
+type simulationRequest struct {
+	Config     json.RawMessage `json:"config"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Retailer   string          `json:"retailer"`
+	SampleSize int             `json:"sampleSize"`
+}
+
+// simulatedReceipt is one line of the simulation response.
+type simulatedReceipt struct {
+	ID           string `json:"id"`
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	OldPoints    int    `json:"oldPoints"`
+	NewPoints    int    `json:"newPoints"`
+	Delta        int    `json:"delta"`
+	Error        string `json:"error,omitempty"`
+}
+
+// simulationSummary is the last line of the simulation response. Matched counts the
+// receipts passing the filters, Receipts those scored. StoppedBy is "timeout" or
+// "canceled" when the simulation is not Complete.
+type simulationSummary struct {
+	Hash           string        `json:"hash"`
+	Matched        int           `json:"matched"`
+	SampleSize     int           `json:"sampleSize"`
+	Receipts       int           `json:"receipts"`
+	Failures       int           `json:"failures"`
+	TotalOldPoints int64         `json:"totalOldPoints"`
+	TotalNewPoints int64         `json:"totalNewPoints"`
+	TotalDelta     int64         `json:"totalDelta"`
+	MeanDelta      float64       `json:"meanDelta"`
+	Histogram      []deltaBucket `json:"histogram"`
+	Complete       bool          `json:"complete"`
+	StoppedBy      string        `json:"stoppedBy,omitempty"`
+}
+
+// parseSimulationRequest validates a simulation request and builds its candidate
+// engine. It returns the problem code and detail of an invalid request.
+func parseSimulationRequest(request *simulationRequest) (engine *Engine, code, detail string) {
+	if len(request.Config) == 0 || string(request.Config) == "null" {
+		return nil, "SIMULATION_INVALID", "config is required"
+	}
+	config := defaultRulesConfig()
+	decoder := json.NewDecoder(bytes.NewReader(request.Config))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, "RULES_CONFIG_INVALID", err.Error()
+	}
+	if field, msg := validateRulesConfig(config); msg != "" {
+		return nil, "RULES_CONFIG_INVALID", field + " " + msg
+	}
+	// A request must not make the server read files, so SKU bonuses are only
+	// available to the rules loaded from --rules-config.
+	if config.SkuBonusFile != "" {
+		return nil, "RULES_CONFIG_INVALID", "skuBonusFile is not supported in simulations"
+	}
+
+	for _, date := range []struct{ name, value string }{{"from", request.From}, {"to", request.To}} {
+		if _, err := time.Parse("2006-01-02", date.value); date.value != "" && err != nil {
+			return nil, "SIMULATION_INVALID", fmt.Sprintf("%s %q is not a YYYY-MM-DD date", date.name, date.value)
+		}
+	}
+	if request.From != "" && request.To != "" && request.To < request.From {
+		return nil, "SIMULATION_INVALID", fmt.Sprintf("to %s is before from %s", request.To, request.From)
+	}
+	if request.SampleSize < 0 {
+		return nil, "SIMULATION_INVALID", "sampleSize must not be negative"
+	}
+	if request.SampleSize == 0 || request.SampleSize > maxSimulationReceipts {
+		request.SampleSize = maxSimulationReceipts
+	}
+	return newEngine(config), "", ""
+}
+
+// simulationReceipts returns the stored receipts matching the request's filters, most
+// recently processed first, and how many matched before sampling.
+func simulationReceipts(request simulationRequest) ([]simulatedReceipt, []Receipt, int) {
+	retailer := normalizeRetailer(request.Retailer)
+	type match struct {
+		id     string
+		stored StoredReceipt
+	}
+	var matches []match
+	receiptsMu.RLock()
+	for id, stored := range receipts {
+		date := stored.Receipt.PurchaseDate
+		if request.From != "" && date < request.From || request.To != "" && date > request.To {
+			continue
+		}
+		if retailer != "" && normalizeRetailer(stored.Receipt.Retailer) != retailer {
+			continue
+		}
+		matches = append(matches, match{id, stored})
+	}
+	receiptsMu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i].stored.Receipt.ProcessedAt, matches[j].stored.Receipt.ProcessedAt
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return matches[i].id < matches[j].id
+	})
+	matched := len(matches)
+	if len(matches) > request.SampleSize {
+		matches = matches[:request.SampleSize]
+	}
+
+	results := make([]simulatedReceipt, len(matches))
+	sample := make([]Receipt, len(matches))
+	for i, m := range matches {
+		results[i] = simulatedReceipt{
+			ID:           m.id,
+			Retailer:     m.stored.Receipt.Retailer,
+			PurchaseDate: m.stored.Receipt.PurchaseDate,
+			OldPoints:    m.stored.Points,
+		}
+		sample[i] = m.stored.Receipt
+	}
+	return results, sample, matched
+}
+
+// simulateRules scores stored receipts with a candidate rules config and streams the
+// old and new points of each as a line of JSON, followed by a summary line. Stored
+// points are never changed. The simulation stops early when the client goes away or
+// it runs longer than simulationTimeout.
+func simulateRules(c *gin.Context) {
+	var request simulationRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return
+	}
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "SIMULATION_INVALID", err.Error())
+		return
+	}
+	engine, code, detail := parseSimulationRequest(&request)
+	if code != "" {
+		abortWithProblem(c, http.StatusBadRequest, code, detail)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), simulationTimeout)
+	defer cancel()
+
+	results, sample, matched := simulationReceipts(request)
+	summary := simulationSummary{Hash: engine.hash, Matched: matched, SampleSize: request.SampleSize, Complete: true}
+	deltas := newDeltaStats()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	for i, result := range results {
+		if err := ctx.Err(); err != nil {
+			summary.Complete = false
+			summary.StoppedBy = "canceled"
+			if errors.Is(err, context.DeadlineExceeded) {
+				summary.StoppedBy = "timeout"
+			}
+			break
+		}
+
+		points, err := scoreSafely(engine, sample[i])
+		if err != nil {
+			result.Error = err.Error()
+			summary.Failures++
+		} else {
+			result.NewPoints = points
+			result.Delta = points - result.OldPoints
+			summary.TotalOldPoints += int64(result.OldPoints)
+			summary.TotalNewPoints += int64(points)
+			deltas.add(result.Delta)
+		}
+		summary.Receipts++
+		if err := encoder.Encode(result); err != nil {
+			return
+		}
+		if i%100 == 99 {
+			c.Writer.Flush()
+		}
+	}
+
+	summary.TotalDelta = deltas.total
+	summary.MeanDelta = deltas.mean()
+	summary.Histogram = deltas.histogram()
+	encoder.Encode(gin.H{"summary": summary})
+	c.Writer.Flush()
+}
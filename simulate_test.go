@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// simulate posts a simulation request and returns the status, the receipt lines and
+// the summary.
+func simulate(t *testing.T, router *gin.Engine, ctx context.Context, body string) (int, []simulatedReceipt, simulationSummary) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/admin/rules/simulate", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		return rr.Code, nil, simulationSummary{}
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("expected application/x-ndjson but got %q", contentType)
+	}
+
+	var lines []simulatedReceipt
+	var summary simulationSummary
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var line struct {
+			simulatedReceipt
+			Summary *simulationSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Summary != nil {
+			summary = *line.Summary
+			continue
+		}
+		lines = append(lines, line.simulatedReceipt)
+	}
+	return rr.Code, lines, summary
+}
+
+func TestSimulateRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer setRules(currentEngine().config)
+	setRules(defaultRulesConfig())
+	router := newRouter()
+
+	// Three stored receipts, processed an hour apart: Target, M&M, then Target again.
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	receipts = make(ReceiptsMap)
+	for i, stored := range []struct{ id, name string }{{"a", "target"}, {"b", "m&m"}, {"c", "target"}} {
+		receipt := exampleReceipts[stored.name]
+		receipt.ProcessedAt = start.Add(time.Duration(i) * time.Hour)
+		points, breakdown := scoreReceipt(receipt, defaultRulesConfig())
+		receipts[stored.id] = StoredReceipt{Receipt: receipt, Points: points, Breakdown: breakdown, RulesVersion: currentEngine().hash}
+	}
+	before := make(ReceiptsMap)
+	for id, stored := range receipts {
+		before[id] = stored
+	}
+
+	// Both receipts have two item pairs, worth 10 more points at 10 per pair.
+	config := `"config": {"itemPairPoints": 10}`
+	code, lines, summary := simulate(t, router, context.Background(), "{"+config+"}")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 but got %v", code)
+	}
+	var ids []string
+	for _, line := range lines {
+		ids = append(ids, line.ID)
+		if line.Delta != 10 || line.NewPoints != line.OldPoints+10 {
+			t.Errorf("expected 10 more points but got %+v", line)
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"c", "b", "a"}) {
+		t.Errorf("expected the most recently processed receipts first but got %v", ids)
+	}
+	if summary.Matched != 3 || summary.Receipts != 3 || summary.SampleSize != maxSimulationReceipts || summary.TotalDelta != 30 ||
+		summary.MeanDelta != 10 || summary.TotalNewPoints != summary.TotalOldPoints+30 || !summary.Complete || summary.StoppedBy != "" {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if summary.Histogram[6].Count != 3 || *summary.Histogram[6].Le != 10 {
+		t.Errorf("expected every delta in the bucket up to 10 but got %+v", summary.Histogram)
+	}
+	if !reflect.DeepEqual(receipts, before) {
+		t.Error("expected the simulation to leave the stored receipts unchanged")
+	}
+
+	filters := []struct {
+		filters  string
+		expected []string
+		matched  int
+	}{
+		{`"retailer": "  TARGET "`, []string{"c", "a"}, 2},
+		{`"from": "2022-03-01"`, []string{"b"}, 1},
+		{`"to": "2022-01-01"`, []string{"c", "a"}, 2},
+		{`"from": "2022-01-02", "to": "2022-03-19"`, nil, 0},
+		{`"retailer": "Target", "sampleSize": 1`, []string{"c"}, 2},
+	}
+	for _, tc := range filters {
+		_, lines, summary := simulate(t, router, context.Background(), "{"+config+", "+tc.filters+"}")
+		ids = nil
+		for _, line := range lines {
+			ids = append(ids, line.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.expected) || summary.Matched != tc.matched {
+			t.Errorf("expected %v of %v matching receipts for %s but got %v of %v", tc.expected, tc.matched, tc.filters, ids, summary.Matched)
+		}
+	}
+
+	invalid := []struct {
+		body string
+		code string
+	}{
+		{`{}`, "SIMULATION_INVALID"},
+		{`{"config": {}, "limit": 5}`, "SIMULATION_INVALID"},
+		{`{"config": {}, "from": "2024-13-01"}`, "SIMULATION_INVALID"},
+		{`{"config": {}, "from": "2024-02-01", "to": "2024-01-01"}`, "SIMULATION_INVALID"},
+		{`{"config": {}, "sampleSize": -1}`, "SIMULATION_INVALID"},
+		{`{"config": {"itemPairPoint": 10}}`, "RULES_CONFIG_INVALID"},
+		{`{"config": {"roundTotalPoints": -1}}`, "RULES_CONFIG_INVALID"},
+		{`{"config": {"skuBonusFile": "/etc/passwd"}}`, "RULES_CONFIG_INVALID"},
+	}
+	for _, tc := range invalid {
+		req := httptest.NewRequest(http.MethodPost, "/admin/rules/simulate", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var body problem
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if rr.Code != http.StatusBadRequest || body.Code != tc.code {
+			t.Errorf("expected 400 %s for %s but got %v: %s", tc.code, tc.body, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestSimulateRulesStopsEarly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newRouter()
+	receipts = make(ReceiptsMap)
+	points, _ := scoreReceipt(exampleReceipts["target"], defaultRulesConfig())
+	receipts["a"] = StoredReceipt{Receipt: exampleReceipts["target"], Points: points}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, lines, summary := simulate(t, router, ctx, `{"config": {}}`)
+	if len(lines) != 0 || summary.Complete || summary.StoppedBy != "canceled" || summary.Matched != 1 {
+		t.Errorf("expected a canceled simulation to score nothing but got %v and %+v", lines, summary)
+	}
+
+	previous := simulationTimeout
+	defer func() { simulationTimeout = previous }()
+	simulationTimeout = 0
+	_, lines, summary = simulate(t, router, context.Background(), `{"config": {}}`)
+	if len(lines) != 0 || summary.Complete || summary.StoppedBy != "timeout" {
+		t.Errorf("expected a timed out simulation to score nothing but got %v and %+v", lines, summary)
+	}
+}
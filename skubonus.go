@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSkuBonusErrors is how many row errors loading a SKU bonus file reports.
+const maxSkuBonusErrors = 20
+
+// skuBonus is one row of a SKU bonus file. start and end are inclusive "YYYY-MM-DD"
+// dates, empty when the bonus is open-ended.
+type skuBonus struct {
+	points     int
+	start, end string
+}
+
+// skuBonusTable maps normalized UPCs to their bonuses in file order.
+type skuBonusTable struct {
+	bonuses map[string][]skuBonus
+	rows    int
+	// digest is the SHA-256 of the file, so the config hash changes with it.
+	digest string
+}
+
+// normalizeUPC returns the form of a UPC that bonuses are looked up by.
+func normalizeUPC(upc string) string {
+	return strings.ToUpper(strings.TrimSpace(upc))
+}
+
+// lookup returns the bonus for a UPC on a purchase date, the first row in file order
+// that covers the date. Rows with dates never apply to receipts without a valid date.
+func (t *skuBonusTable) lookup(upc, date string, dateOK bool) (skuBonus, bool) {
+	for _, bonus := range t.bonuses[normalizeUPC(upc)] {
+		if bonus.start == "" && bonus.end == "" {
+			return bonus, true
+		}
+		if dateOK && (bonus.start == "" || date >= bonus.start) && (bonus.end == "" || date <= bonus.end) {
+			return bonus, true
+		}
+	}
+	return skuBonus{}, false
+}
+
+// loadSkuBonuses reads a SKU bonus CSV file. Its header names the columns: upc and
+// bonus_points are required, start and end are optional. Invalid rows are reported
+// together, each as a configError with its line.
+func loadSkuBonuses(path string) (*skuBonusTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	table := &skuBonusTable{bonuses: make(map[string][]skuBonus), digest: hex.EncodeToString(sum[:])}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, &configError{path: path, msg: "is empty, expected a header naming the upc and bonus_points columns"}
+	}
+	if err != nil {
+		return nil, &configError{path: path, line: 1, msg: "header: " + err.Error()}
+	}
+	columns := map[string]int{"upc": -1, "bonus_points": -1, "start": -1, "end": -1}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if index, ok := columns[name]; !ok || index >= 0 {
+			return nil, &configError{path: path, line: 1, msg: fmt.Sprintf("header has unknown or repeated column %q", name)}
+		}
+		columns[name] = i
+	}
+	if columns["upc"] < 0 || columns["bonus_points"] < 0 {
+		return nil, &configError{path: path, line: 1, msg: "header must name the upc and bonus_points columns"}
+	}
+
+	var errs []error
+	failed := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var line int
+		var msg string
+		var bonus skuBonus
+		var upc string
+		if err != nil {
+			msg = err.Error()
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line, msg = parseErr.Line, parseErr.Err.Error()
+			}
+		} else {
+			line, _ = reader.FieldPos(0)
+			upc, bonus, msg = parseSkuBonusRow(record, columns)
+		}
+		if msg != "" {
+			failed++
+			if len(errs) < maxSkuBonusErrors {
+				errs = append(errs, &configError{path: path, line: line, msg: msg})
+			}
+			continue
+		}
+		table.bonuses[upc] = append(table.bonuses[upc], bonus)
+		table.rows++
+	}
+	if failed > len(errs) {
+		errs = append(errs, fmt.Errorf("%s: %d more invalid rows", path, failed-len(errs)))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return table, nil
+}
+
+// parseSkuBonusRow parses one row, returning what is wrong with it if it is invalid.
+func parseSkuBonusRow(record []string, columns map[string]int) (upc string, bonus skuBonus, msg string) {
+	field := func(name string) string {
+		if i := columns[name]; i >= 0 && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	upc = normalizeUPC(field("upc"))
+	if upc == "" {
+		return "", bonus, "upc is required"
+	}
+	points, err := strconv.Atoi(field("bonus_points"))
+	if err != nil || points < 0 {
+		return "", bonus, fmt.Sprintf("bonus_points %q is not a non-negative whole number", field("bonus_points"))
+	}
+	bonus = skuBonus{points: points, start: field("start"), end: field("end")}
+	for _, date := range []struct{ name, value string }{{"start", bonus.start}, {"end", bonus.end}} {
+		if _, err := time.Parse("2006-01-02", date.value); date.value != "" && err != nil {
+			return "", bonus, fmt.Sprintf("%s %q is not a YYYY-MM-DD date", date.name, date.value)
+		}
+	}
+	if bonus.start != "" && bonus.end != "" && bonus.end < bonus.start {
+		return "", bonus, fmt.Sprintf("end %s is before start %s", bonus.end, bonus.start)
+	}
+	return upc, bonus, ""
+}
+
+// Rule 10: Bonus points for each item whose UPC is in the SKU bonus file, times the
+// item's quantity.
+type skuBonusRule struct {
+	table *skuBonusTable
+}
+
+func (skuBonusRule) Name() string { return "sku_bonus" }
+
+func (r skuBonusRule) Evaluate(receipt ParsedReceipt) (int, string) {
+	if r.table == nil || r.table.rows == 0 {
+		return 0, "no SKU bonuses are configured"
+	}
+
+	tr := receipt.trace
+	points := 0
+	var details []string
+	for i, item := range receipt.Items {
+		if item.UPC == "" {
+			continue
+		}
+		bonus, ok := r.table.lookup(item.UPC, receipt.PurchaseDate, receipt.WeekdayOK)
+		if tr != nil {
+			tr.input(fmt.Sprintf("items[%d].upc", i), item.UPC)
+			tr.step(fmt.Sprintf("items[%d].bonus", i), bonus.points)
+		}
+		if !ok {
+			continue
+		}
+		earned := bonus.points * item.Quantity
+		points += earned
+		if item.Quantity > 1 {
+			details = append(details, fmt.Sprintf("item %d UPC %s: %d x %d = %d", i, item.UPC, bonus.points, item.Quantity, earned))
+		} else {
+			details = append(details, fmt.Sprintf("item %d UPC %s: %d", i, item.UPC, earned))
+		}
+	}
+	if len(details) == 0 {
+		return 0, "no item has a bonus UPC"
+	}
+	return points, strings.Join(details, "; ")
+}
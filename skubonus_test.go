@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSkuBonusesLargeFile(t *testing.T) {
+	var csv strings.Builder
+	csv.WriteString("upc,bonus_points\n")
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&csv, "%012d,%d\n", i, i%50)
+	}
+	table, err := loadSkuBonuses(writeConfig(t, "skus.csv", csv.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.rows != 10000 || len(table.bonuses) != 10000 {
+		t.Fatalf("expected 10000 rows but got %v", table.rows)
+	}
+	for _, i := range []int{0, 1, 4999, 9999} {
+		bonus, ok := table.lookup(fmt.Sprintf("%012d", i), "", false)
+		if !ok || bonus.points != i%50 {
+			t.Errorf("expected %v points for row %v but got %+v", i%50, i, bonus)
+		}
+	}
+	if _, ok := table.lookup("000000010000", "", false); ok {
+		t.Error("expected no bonus for an unknown UPC")
+	}
+}
+
+func TestSkuBonusDates(t *testing.T) {
+	table, err := loadSkuBonuses(writeConfig(t, "skus.csv", `upc,bonus_points,start,end
+KLARBRUNN12PK,30,2024-07-01,2024-07-07
+KLARBRUNN12PK,20,,
+DORITOS,10,2024-01-01,
+PIZZA,15,,2023-12-31
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		upc      string
+		date     string
+		expected int
+	}{
+		// The first row covering the date wins, then the open-ended row applies.
+		{"KLARBRUNN12PK", "2024-07-01", 30},
+		{"KLARBRUNN12PK", "2024-07-07", 30},
+		{"KLARBRUNN12PK", "2024-07-08", 20},
+		{"klarbrunn12pk ", "2024-06-30", 20},
+		{"DORITOS", "2023-12-31", 0},
+		{"DORITOS", "2024-01-01", 10},
+		{"DORITOS", "not a date", 0},
+		{"PIZZA", "2023-12-31", 15},
+		{"PIZZA", "2024-01-01", 0},
+	}
+	for _, tc := range testCases {
+		parsed := parseReceipt(Receipt{PurchaseDate: tc.date}, defaultRulesConfig())
+		bonus, _ := table.lookup(tc.upc, parsed.PurchaseDate, parsed.WeekdayOK)
+		if bonus.points != tc.expected {
+			t.Errorf("expected %v points for %q on %s but got %v", tc.expected, tc.upc, tc.date, bonus.points)
+		}
+	}
+}
+
+func TestSkuBonusErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			name:     "Empty",
+			contents: "",
+			expected: "skus.csv: is empty, expected a header naming the upc and bonus_points columns",
+		},
+		{
+			name:     "MissingColumn",
+			contents: "upc,start\nA,2024-01-01\n",
+			expected: "skus.csv:1: header must name the upc and bonus_points columns",
+		},
+		{
+			name:     "UnknownColumn",
+			contents: "upc,bonus_points,expires\n",
+			expected: `skus.csv:1: header has unknown or repeated column "expires"`,
+		},
+		{
+			name:     "Rows",
+			contents: "upc,bonus_points,start,end\nA,5,,\n,5,,\nB,five,,\nC,-1,,\nD,5,2024-02-30,\nE,5,2024-03-01,2024-02-01\nF,5\n",
+			expected: strings.Join([]string{
+				"skus.csv:3: upc is required",
+				`skus.csv:4: bonus_points "five" is not a non-negative whole number`,
+				`skus.csv:5: bonus_points "-1" is not a non-negative whole number`,
+				`skus.csv:6: start "2024-02-30" is not a YYYY-MM-DD date`,
+				"skus.csv:7: end 2024-02-01 is before start 2024-03-01",
+				"skus.csv:8: wrong number of fields",
+			}, "\n"),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "skus.csv", tc.contents)
+			_, err := loadSkuBonuses(path)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			got := strings.ReplaceAll(err.Error(), filepath.Dir(path)+string(filepath.Separator), "")
+			if got != tc.expected {
+				t.Errorf("expected %q but got %q", tc.expected, got)
+			}
+		})
+	}
+
+	var csv strings.Builder
+	csv.WriteString("upc,bonus_points\n")
+	for i := 0; i < 25; i++ {
+		csv.WriteString("X,bad\n")
+	}
+	_, err := loadSkuBonuses(writeConfig(t, "skus.csv", csv.String()))
+	if lines := strings.Split(err.Error(), "\n"); len(lines) != maxSkuBonusErrors+1 || !strings.HasSuffix(lines[maxSkuBonusErrors], ": 5 more invalid rows") {
+		t.Errorf("expected %v errors and a count of the rest but got %v", maxSkuBonusErrors, err)
+	}
+}
+
+func TestSkuBonusRule(t *testing.T) {
+	path := useRulesConfig(t, "skuBonusFile: skus.csv\nconsolidateItems: true\n")
+	csvPath := filepath.Join(filepath.Dir(path), "skus.csv")
+	if err := os.WriteFile(csvPath, []byte("upc,bonus_points\nKLARBRUNN12PK,20\nDEW12PK,5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := reloadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt := Receipt{
+		Retailer: "Target",
+		Total:    "30.49",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49", UPC: "DEW12PK"},
+			{ShortDescription: "Gum", Price: "1.00"},
+			{ShortDescription: "Klarbrunn 12-PK 12 FL OZ", Price: "12.00", UPC: "KLARBRUNN12PK"},
+			{ShortDescription: "Klarbrunn 12-PK 12 FL OZ", Price: "12.00", UPC: "KLARBRUNN12PK"},
+			{ShortDescription: "Chips", Price: "1.00", UPC: "CHIPS"},
+		},
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "12:00",
+	}
+	expected := BreakdownEntry{Rule: "sku_bonus", Points: 45, Detail: "item 0 UPC DEW12PK: 5; item 2 UPC KLARBRUNN12PK: 20 x 2 = 40"}
+	if entry := findEntry(engine, receipt, "sku_bonus"); entry != expected {
+		t.Errorf("expected %+v but got %+v", expected, entry)
+	}
+
+	// Reloading picks up changes to the file.
+	if err := os.WriteFile(csvPath, []byte("upc,bonus_points\nKLARBRUNN12PK,25\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := reloadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.hash == engine.hash {
+		t.Error("expected a changed SKU bonus file to change the rules version")
+	}
+	expected = BreakdownEntry{Rule: "sku_bonus", Points: 50, Detail: "item 2 UPC KLARBRUNN12PK: 25 x 2 = 50"}
+	if entry := findEntry(reloaded, receipt, "sku_bonus"); entry != expected {
+		t.Errorf("expected %+v after reloading but got %+v", expected, entry)
+	}
+
+	// An invalid file keeps the current rules.
+	if err := os.WriteFile(csvPath, []byte("upc,bonus_points\nKLARBRUNN12PK,lots\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadRules(); err == nil || !strings.HasSuffix(err.Error(), `skus.csv:2: bonus_points "lots" is not a non-negative whole number`) {
+		t.Errorf("expected the row error but got %v", err)
+	}
+	if currentEngine() != reloaded {
+		t.Error("expected a failed reload to keep the current rules")
+	}
+}
+
+// findEntry scores a receipt with engine and returns the breakdown entry of a rule.
+func findEntry(engine *Engine, receipt Receipt, rule string) BreakdownEntry {
+	_, breakdown := engine.ScoreReceipt(receipt)
+	for _, entry := range breakdown {
+		if entry.Rule == rule {
+			return entry
+		}
+	}
+	return BreakdownEntry{}
+}
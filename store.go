@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// receiptStore keeps the scored receipts the request handlers submit and look up.
+// Its calls take the request's context, so a slow store gives up when the request's
+// deadline passes instead of holding the client.
+type receiptStore interface {
+	put(ctx context.Context, id string, stored StoredReceipt) error
+	get(ctx context.Context, id string) (StoredReceipt, bool, error)
+}
+
+// memoryStore is the receipts map.
+type memoryStore struct{}
+
+func (memoryStore) put(ctx context.Context, id string, stored StoredReceipt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	receiptsMu.Lock()
+	receipts[id] = stored
+	receiptsMu.Unlock()
+	return nil
+}
+
+func (memoryStore) get(ctx context.Context, id string) (StoredReceipt, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return StoredReceipt{}, false, err
+	}
+	receiptsMu.RLock()
+	stored, ok := receipts[id]
+	receiptsMu.RUnlock()
+	return stored, ok, nil
+}
+
+// receiptsStore is the store the request handlers use.
+var receiptsStore receiptStore = memoryStore{}
+
+// abortWithStoreError responds to a request the store or engine failed: 504 if the
+// request ran out of time, else 500.
+func abortWithStoreError(c *gin.Context, err error) {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		abortWithProblem(c, http.StatusGatewayTimeout, "REQUEST_TIMEOUT", err.Error())
+		return
+	}
+	abortWithProblem(c, http.StatusInternalServerError, "STORE_FAILED", err.Error())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Loyalty tiers users can be put in. Users without a tier, and callers without a user,
+// earn no tier multiplier.
+const (
+	tierBronze = "bronze"
+	tierSilver = "silver"
+	tierGold   = "gold"
+)
+
+var loyaltyTiers = []string{tierBronze, tierSilver, tierGold}
+
+// auditUserTierChanged is the action of setting or clearing a user's tier.
+const auditUserTierChanged = "user.tier_changed"
+
+// tierStore holds the loyalty tiers of users by user ID.
+type tierStore struct {
+	mu    sync.RWMutex
+	tiers map[string]string
+}
+
+func newTierStore() *tierStore {
+	return &tierStore{tiers: make(map[string]string)}
+}
+
+// userTiers are the tiers set through PATCH /admin/users/{user_id}. They live as long
+// as the process, like the receipts.
+var userTiers = newTierStore()
+
+// tier returns the tier of user, or "" if they have none.
+func (s *tierStore) tier(user string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tiers[user]
+}
+
+// setTier puts user in tier, or takes them out of theirs if tier is "".
+func (s *tierStore) setTier(user, tier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tier == "" {
+		delete(s.tiers, user)
+		return
+	}
+	s.tiers[user] = tier
+}
+
+// forget drops the tier of user, returning 1 if they had one and 0 otherwise.
+func (s *tierStore) forget(user string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tiers[user]; !ok {
+		return 0
+	}
+	delete(s.tiers, user)
+	return 1
+}
+
+// validateTierMultipliers returns the first invalid field of the tier multipliers of
+// a rules config, relative to tierMultipliers.
+func validateTierMultipliers(multipliers map[string]float64) (field, msg string) {
+	tiers := make([]string, 0, len(multipliers))
+	for tier := range multipliers {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers)
+	for _, tier := range tiers {
+		if !containsString(loyaltyTiers, tier) {
+			return tier, fmt.Sprintf("is not a tier, expected one of %s", strings.Join(loyaltyTiers, ", "))
+		}
+		if multipliers[tier] <= 0 {
+			return tier, "must be positive"
+		}
+	}
+	return "", ""
+}
+
+// applyTier multiplies points by the multiplier of the tier the receipt was processed
+// in, returning the new total with a breakdown entry for the extra points if the tier
+// has one.
+func (e *Engine) applyTier(receipt ParsedReceipt, points int) (int, *BreakdownEntry) {
+	multiplier, ok := e.config.TierMultipliers[receipt.Tier]
+	if receipt.Tier == "" || !ok {
+		return points, nil
+	}
+	total := int(math.Round(float64(points) * multiplier))
+	return total, &BreakdownEntry{
+		Rule:   "tier_multiplier",
+		Points: total - points,
+		Detail: fmt.Sprintf("%d base points x%g (%s tier) = %d", points, multiplier, receipt.Tier, total),
+	}
+}
+
+// userTierRequest is the body of PATCH /admin/users/{user_id}. An empty tier takes the
+// user out of theirs.
+type userTierRequest struct {
+	Tier *string `json:"tier"`
+}
+
+// userTierResponse is a user with their tier, if any.
+type userTierResponse struct {
+	ID   string `json:"id"`
+	Tier string `json:"tier,omitempty"`
+}
+
+// setUserTier sets the loyalty tier of a user. Receipts they processed before keep the
+// points they earned; only receipts processed afterwards are scored with the new tier.
+func setUserTier(c *gin.Context) {
+	user := c.Param("user_id")
+	c.Set("auditTarget", pseudonym(user))
+	var request userTierRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return
+	}
+	switch {
+	case err != nil:
+	case request.Tier == nil:
+		err = errors.New("tier is required")
+	case *request.Tier != "" && !containsString(loyaltyTiers, *request.Tier):
+		err = fmt.Errorf("tier %q must be one of %s, or empty to clear it", *request.Tier, strings.Join(loyaltyTiers, ", "))
+	}
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "USER_TIER_INVALID", err.Error())
+		return
+	}
+
+	userTiers.setTier(user, *request.Tier)
+	c.JSON(http.StatusOK, userTierResponse{ID: user, Tier: *request.Tier})
+}
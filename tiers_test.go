@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTierMultipliers(t *testing.T) {
+	config := defaultRulesConfig()
+	config.TierMultipliers = map[string]float64{tierBronze: 1, tierSilver: 1.2, tierGold: 1.5}
+	engine := newEngine(config)
+
+	// The Target example scores 28 points without a tier.
+	testCases := []struct {
+		tier     string
+		expected int
+		detail   string
+	}{
+		{tier: "", expected: 28},
+		{tier: tierBronze, expected: 28, detail: "28 base points x1 (bronze tier) = 28"},
+		{tier: tierSilver, expected: 34, detail: "28 base points x1.2 (silver tier) = 34"},
+		{tier: tierGold, expected: 42, detail: "28 base points x1.5 (gold tier) = 42"},
+	}
+	for _, tc := range testCases {
+		receipt := exampleReceipts["target"]
+		receipt.Tier = tc.tier
+		points, breakdown := engine.ScoreReceipt(receipt)
+		if points != tc.expected {
+			t.Errorf("%q: expected %d points but got %d", tc.tier, tc.expected, points)
+		}
+		last := breakdown[len(breakdown)-1]
+		if tc.detail == "" && last.Rule == "tier_multiplier" {
+			t.Errorf("%q: expected no tier multiplier but got %+v", tc.tier, last)
+		}
+		if tc.detail != "" && (last.Rule != "tier_multiplier" || last.Points != tc.expected-28 || last.Detail != tc.detail) {
+			t.Errorf("%q: expected the tier multiplier to add %d points but got %+v", tc.tier, tc.expected-28, last)
+		}
+	}
+
+	// A tier without a multiplier earns nothing extra.
+	config.TierMultipliers = map[string]float64{tierGold: 1.5}
+	receipt := exampleReceipts["target"]
+	receipt.Tier = tierSilver
+	if points, _ := newEngine(config).ScoreReceipt(receipt); points != 28 {
+		t.Errorf("expected silver to earn no multiplier but got %d points", points)
+	}
+}
+
+func TestTierMultiplierConfigErrors(t *testing.T) {
+	testCases := []struct {
+		contents string
+		expected string
+	}{
+		{"tierMultipliers:\n  gold: 1.5\n  platinum: 2\n", "rules.yaml:3: tierMultipliers.platinum is not a tier, expected one of bronze, silver, gold"},
+		{"tierMultipliers:\n  gold: 0\n", "rules.yaml:2: tierMultipliers.gold must be positive"},
+	}
+	for _, tc := range testCases {
+		_, err := loadRulesConfig(writeConfig(t, "rules.yaml", tc.contents))
+		if err == nil || !strings.HasSuffix(err.Error(), tc.expected) {
+			t.Errorf("expected error %q but got %v", tc.expected, err)
+		}
+	}
+}
+
+// setTier patches the tier of user with body using the API key key.
+func setTier(router *gin.Engine, user, body, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, "/admin/users/"+user, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", key)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestUserTiers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, jwtNow)
+	previous := userTiers
+	userTiers = newTierStore()
+	defer func() { userTiers = previous }()
+	config := defaultRulesConfig()
+	config.TierMultipliers = map[string]float64{tierSilver: 1.2, tierGold: 1.5}
+	defer setRules(currentEngine().config)
+	setRules(config)
+	router := newRouter()
+	key := generateKey(t)
+	useIdP(t, map[string]*rsa.PrivateKey{"k1": key})
+	useAPIKeys(t, []apiKey{{ID: "ops", Key: "k-ops", Scopes: []string{scopeAdmin}}, {ID: "backend", Key: "k-backend", Scopes: defaultScopes}})
+
+	// process posts the Target example as token, or with the backend's API key without
+	// one, and returns the points it was stored with.
+	process := func(token string) (int, []BreakdownEntry) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(validReceiptPayload))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			req.Header.Set("X-API-Key", "k-backend")
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var processed struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %v: %s", rr.Code, rr.Body.String())
+		}
+		receiptsMu.RLock()
+		defer receiptsMu.RUnlock()
+		stored := receipts[processed.ID]
+		return stored.Points, stored.Breakdown
+	}
+
+	for user, tier := range map[string]string{"alice": tierGold, "bob": tierSilver} {
+		rr := setTier(router, user, `{"tier":"`+tier+`"}`, "k-ops")
+		if want := `{"id":"` + user + `","tier":"` + tier + `"}`; rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Fatalf("expected %s but got %v %s", want, rr.Code, rr.Body.String())
+		}
+	}
+	alice := userToken(t, key, "k1", "alice")
+	testCases := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{name: "Gold", token: alice, expected: 42},
+		{name: "Silver", token: userToken(t, key, "k1", "bob"), expected: 34},
+		{name: "NoTier", token: userToken(t, key, "k1", "carol"), expected: 28},
+		// A caller with an API key isn't a user, so has no tier.
+		{name: "Anonymous", expected: 28},
+	}
+	for _, tc := range testCases {
+		if points, _ := process(tc.token); points != tc.expected {
+			t.Errorf("%s: expected %d points but got %d", tc.name, tc.expected, points)
+		}
+	}
+
+	// Taking Alice out of her tier changes the points of her receipts from now on, not
+	// those she already earned.
+	points, breakdown := process(alice)
+	if rr := setTier(router, "alice", `{"tier":""}`, "k-ops"); rr.Code != http.StatusOK || rr.Body.String() != `{"id":"alice"}` {
+		t.Fatalf("expected Alice's tier to be cleared but got %v %s", rr.Code, rr.Body.String())
+	}
+	if again, _ := process(alice); again != 28 {
+		t.Errorf("expected 28 points without a tier but got %d", again)
+	}
+	if last := breakdown[len(breakdown)-1]; points != 42 || last.Rule != "tier_multiplier" || last.Detail != "28 base points x1.5 (gold tier) = 42" {
+		t.Errorf("expected the earlier receipt to keep its 42 points but got %d with %+v", points, last)
+	}
+	receiptsMu.RLock()
+	for id, stored := range receipts {
+		if stored.Owner == "alice" && stored.Receipt.Tier == tierGold && stored.Points != 42 {
+			t.Errorf("expected %s to keep its 42 points but got %d", id, stored.Points)
+		}
+	}
+	receiptsMu.RUnlock()
+
+	for _, body := range []string{`{"tier":"platinum"}`, `{}`, `{"tier":"gold","points":5}`} {
+		rr := setTier(router, "alice", body, "k-ops")
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "USER_TIER_INVALID") {
+			t.Errorf("%s: expected 400 USER_TIER_INVALID but got %v %s", body, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := setTier(router, "alice", `{"tier":"gold"}`, "k-backend"); rr.Code != http.StatusForbidden {
+		t.Errorf("expected a caller without the admin scope to be refused but got %v", rr.Code)
+	}
+	if tier := userTiers.tier("alice"); tier != "" {
+		t.Errorf("expected rejected requests to leave Alice without a tier but got %q", tier)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTimeout is --request-timeout, how long API requests get before they are
+// answered 504. The /admin endpoints get --admin-write-timeout instead.
+var requestTimeout = 10 * time.Second
+
+// limitRequestTime gives the rest of the handler chain a context that ends after
+// timeout, which the store and engine give up on. If it ends before the handlers
+// return, and the client is still waiting, whatever they wrote is discarded and the
+// request is answered 504, so a late write can't reach the client. Responses are
+// buffered until the handlers return or flush; a flushed response is the client's,
+// and is no longer replaced.
+func limitRequestTime(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		client := c.Request.Context()
+		ctx, cancel := context.WithTimeout(client, timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		header := c.Writer.Header().Clone()
+		w := &deadlineWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = w
+		// Put the writer back even if a handler panics, so the recovery can respond.
+		defer func() { c.Writer = w.ResponseWriter }()
+		c.Next()
+
+		c.Writer = w.ResponseWriter
+		if !w.flushed && errors.Is(ctx.Err(), context.DeadlineExceeded) && client.Err() == nil {
+			for key := range c.Writer.Header() {
+				delete(c.Writer.Header(), key)
+			}
+			for key, values := range header {
+				c.Writer.Header()[key] = values
+			}
+			abortWithProblem(c, http.StatusGatewayTimeout, "REQUEST_TIMEOUT",
+				fmt.Sprintf("the request took longer than %s", timeout))
+			return
+		}
+		w.commit()
+	}
+}
+
+// deadlineWriter holds the status and body handlers write until they are committed
+// to the ResponseWriter it wraps, or dropped.
+type deadlineWriter struct {
+	gin.ResponseWriter
+	status  int
+	body    bytes.Buffer
+	written bool
+	flushed bool
+}
+
+func (w *deadlineWriter) WriteHeader(code int) {
+	if w.flushed {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code > 0 && !w.written {
+		w.status = code
+	}
+}
+
+func (w *deadlineWriter) WriteHeaderNow() {
+	if w.flushed {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.written = true
+}
+
+func (w *deadlineWriter) Write(data []byte) (int, error) {
+	if w.flushed {
+		return w.ResponseWriter.Write(data)
+	}
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *deadlineWriter) Status() int {
+	if w.flushed {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *deadlineWriter) Size() int {
+	if w.flushed {
+		return w.ResponseWriter.Size()
+	}
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *deadlineWriter) Written() bool {
+	return w.written || w.flushed
+}
+
+// Flush commits what was written so far, for streamed responses.
+func (w *deadlineWriter) Flush() {
+	w.commit()
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// commit writes the held status and body to the wrapped writer, after which writes go
+// straight through.
+func (w *deadlineWriter) commit() {
+	if w.flushed {
+		return
+	}
+	w.flushed = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.written {
+		w.ResponseWriter.WriteHeaderNow()
+		w.ResponseWriter.Write(w.body.Bytes())
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// slowStore is a receiptStore that takes delay to answer, or until the request gives up.
+type slowStore struct {
+	memoryStore
+	delay time.Duration
+}
+
+func (s slowStore) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s slowStore) put(ctx context.Context, id string, stored StoredReceipt) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.memoryStore.put(ctx, id, stored)
+}
+
+func (s slowStore) get(ctx context.Context, id string) (StoredReceipt, bool, error) {
+	if err := s.wait(ctx); err != nil {
+		return StoredReceipt{}, false, err
+	}
+	return s.memoryStore.get(ctx, id)
+}
+
+// useStore makes the handlers use store for the rest of the test.
+func useStore(t *testing.T, store receiptStore) {
+	t.Helper()
+	previous := receiptsStore
+	receiptsStore = store
+	t.Cleanup(func() { receiptsStore = previous })
+}
+
+func TestRequestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	logs := captureLogs(t)
+	defer func(previous time.Duration) { requestTimeout = previous }(requestTimeout)
+	requestTimeout = 50 * time.Millisecond
+	router := newRouter()
+	id, _ := processAndScore(t, router, validReceiptPayload)
+
+	// A store slower than the deadline is given up on, and the client answered 504
+	// at the deadline rather than when the store gets round to it.
+	useStore(t, slowStore{delay: 5 * time.Second})
+	for _, tc := range []struct{ method, path, route string }{
+		{http.MethodGet, "/receipts/" + id + "/points", "/receipts/:receipt_id/points"},
+		{http.MethodPost, "/receipts/process", "/receipts/process"},
+	} {
+		start := time.Now()
+		rr := requestWithKey(router, tc.method, tc.path, "")
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s %s: expected an answer at the deadline but took %v", tc.method, tc.path, elapsed)
+		}
+		if rr.Code != http.StatusGatewayTimeout || !strings.Contains(rr.Body.String(), `"code":"REQUEST_TIMEOUT"`) {
+			t.Errorf("%s %s: expected a 504 REQUEST_TIMEOUT problem but got %v: %s", tc.method, tc.path, rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("Content-Type") != "application/problem+json" || rr.Header().Get("X-Request-ID") == "" {
+			t.Errorf("%s %s: expected a problem with the request ID but got %v", tc.method, tc.path, rr.Header())
+		}
+		if entry := findRequestLog(requestLogs(t, logs), tc.method, tc.route, http.StatusGatewayTimeout); entry == nil {
+			t.Errorf("%s %s: expected the 504 in the request log", tc.method, tc.path)
+		}
+	}
+	if len(receipts) != 1 {
+		t.Errorf("expected the timed out receipt not to be stored but got %d receipts", len(receipts))
+	}
+
+	// A store within the deadline answers as usual.
+	useStore(t, slowStore{delay: time.Millisecond})
+	if rr := requestWithKey(router, http.MethodGet, "/receipts/"+id+"/points", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"points"`) {
+		t.Errorf("expected the points within the deadline but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRequestTimeoutDropsLateWrites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	captureLogs(t)
+	router := newRouter()
+	router.GET("/late", func(c *gin.Context) { c.Header("X-Before", "kept") }, limitRequestTime(20*time.Millisecond), func(c *gin.Context) {
+		// A handler that doesn't watch the context writes after the deadline.
+		time.Sleep(60 * time.Millisecond)
+		c.Header("X-Late", "yes")
+		c.JSON(http.StatusOK, gin.H{"late": true})
+	})
+	router.GET("/streamed", limitRequestTime(20*time.Millisecond), func(c *gin.Context) {
+		c.String(http.StatusOK, "first ")
+		c.Writer.Flush()
+		time.Sleep(60 * time.Millisecond)
+		c.String(http.StatusOK, "second")
+	})
+	router.GET("/panic", limitRequestTime(time.Second), func(c *gin.Context) { panic("store corrupted") })
+
+	rr := requestWithKey(router, http.MethodGet, "/late", "")
+	if rr.Code != http.StatusGatewayTimeout || strings.Contains(rr.Body.String(), "late") {
+		t.Errorf("expected a 504 without the late body but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("X-Late") != "" || rr.Header().Get("X-Before") != "kept" {
+		t.Errorf("expected the late header dropped and the earlier one kept but got %v", rr.Header())
+	}
+
+	// Once flushed, the response is the client's and isn't replaced.
+	if rr := requestWithKey(router, http.MethodGet, "/streamed", ""); rr.Code != http.StatusOK || rr.Body.String() != "first second" {
+		t.Errorf("expected the streamed response in full but got %v: %q", rr.Code, rr.Body.String())
+	}
+
+	// A panic still reaches the recovery, which can respond.
+	if rr := requestWithKey(router, http.MethodGet, "/panic", ""); rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "UNHANDLED_PANIC") {
+		t.Errorf("expected a 500 UNHANDLED_PANIC but got %v: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TraceStep is one value a rule read from the receipt or computed from it.
+type TraceStep struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// RuleTrace records how one rule evaluated a receipt. Rules that didn't run are
+// Skipped, with the Reason.
+type RuleTrace struct {
+	Rule       string      `json:"rule"`
+	Skipped    bool        `json:"skipped,omitempty"`
+	Reason     string      `json:"reason,omitempty"`
+	Inputs     []TraceStep `json:"inputs,omitempty"`
+	Steps      []TraceStep `json:"steps,omitempty"`
+	Points     int         `json:"points"`
+	Detail     string      `json:"detail,omitempty"`
+	DurationNs int64       `json:"durationNs"`
+}
+
+// Trace is a rule by rule record of scoring a receipt, see Engine.Trace. Override is
+// the label of the retailer override that scored it, if any.
+type Trace struct {
+	Override string      `json:"override,omitempty"`
+	Rules    []RuleTrace `json:"rules"`
+}
+
+// ruleTracer collects the trace of the rule being evaluated. Rules find it in
+// ParsedReceipt.trace, which is nil unless the engine is tracing, and must check for
+// nil before recording so scoring without a trace does no extra work.
+type ruleTracer struct {
+	trace *RuleTrace
+}
+
+// input records a value the rule read.
+func (t *ruleTracer) input(name string, value interface{}) {
+	t.trace.Inputs = append(t.trace.Inputs, TraceStep{Name: name, Value: value})
+}
+
+// step records a value the rule computed.
+func (t *ruleTracer) step(name string, value interface{}) {
+	t.trace.Steps = append(t.trace.Steps, TraceStep{Name: name, Value: value})
+}
+
+// skip records that none of the rules ran, for the reason given.
+func (t *Trace) skip(rules []Rule, reason string) {
+	for _, rule := range rules {
+		t.Rules = append(t.Rules, RuleTrace{Rule: rule.Name(), Skipped: true, Reason: reason})
+	}
+}
+
+// evaluate runs a rule with a tracer and records the result and how long it took.
+func (t *Trace) evaluate(rule Rule, receipt ParsedReceipt) (int, string) {
+	ruleTrace := RuleTrace{Rule: rule.Name()}
+	receipt.trace = &ruleTracer{trace: &ruleTrace}
+	start := clock.Now()
+	points, detail := rule.Evaluate(receipt)
+	ruleTrace.DurationNs = clock.Now().Sub(start).Nanoseconds()
+	ruleTrace.Points, ruleTrace.Detail = points, detail
+	t.Rules = append(t.Rules, ruleTrace)
+	return points, detail
+}
+
+// getReceiptTrace scores a stored receipt again with the current rules, tracing every
+// rule, so support can see exactly how a disputed score comes about.
+func getReceiptTrace(c *gin.Context) {
+	receiptID := c.Param("receipt_id")
+	receiptsMu.RLock()
+	stored, ok := receipts[receiptID]
+	receiptsMu.RUnlock()
+	if !ok {
+		abortWithError(c, http.StatusNotFound, "RECEIPT_NOT_FOUND", "Receipt not found")
+		return
+	}
+
+	engine := currentEngine()
+	points, breakdown, trace := engine.Trace(stored.Receipt)
+	c.JSON(http.StatusOK, gin.H{
+		"id":                 receiptID,
+		"points":             points,
+		"rulesVersion":       engine.hash,
+		"storedPoints":       stored.Points,
+		"storedRulesVersion": stored.RulesVersion,
+		"override":           trace.Override,
+		"rules":              trace.Rules,
+		"breakdown":          breakdown,
+	})
+}
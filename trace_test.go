@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type traceBody struct {
+	Points             int              `json:"points"`
+	RulesVersion       string           `json:"rulesVersion"`
+	StoredPoints       int              `json:"storedPoints"`
+	StoredRulesVersion string           `json:"storedRulesVersion"`
+	Rules              []RuleTrace      `json:"rules"`
+	Breakdown          []BreakdownEntry `json:"breakdown"`
+}
+
+// stepValue returns the value of the named step, as decoded from JSON.
+func stepValue(steps []TraceStep, name string) interface{} {
+	for _, step := range steps {
+		if step.Name == name {
+			return step.Value
+		}
+	}
+	return nil
+}
+
+func TestReceiptTrace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer setRules(currentEngine().config)
+	config := defaultRulesConfig()
+	config.DisabledRules = []string{"holiday"}
+	setRules(config)
+	previousToken := adminToken
+	defer func() { adminToken = previousToken }()
+	adminToken = "s3cret"
+	router := newRouter()
+
+	id, _ := processAndScore(t, router, validReceiptPayload)
+	path := "/admin/receipts/" + id + "/trace"
+
+	for _, header := range []string{"", "Bearer wrong", "s3cret"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for Authorization %q but got %v", header, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %v: %s", rr.Code, rr.Body.String())
+	}
+	var body traceBody
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Points != 28 || body.StoredPoints != 28 || body.RulesVersion != body.StoredRulesVersion {
+		t.Errorf("expected the stored 28 points under the same rules but got %+v", body)
+	}
+	_, breakdown := scoreReceipt(exampleReceipts["target"], config)
+	if !reflect.DeepEqual(body.Breakdown, breakdown) {
+		t.Errorf("expected the traced breakdown to match scoring but got %+v", body.Breakdown)
+	}
+
+	names := ruleNames()
+	if len(body.Rules) != len(names) {
+		t.Fatalf("expected a trace for each of %v but got %+v", names, body.Rules)
+	}
+	byName := make(map[string]RuleTrace)
+	for i, rule := range body.Rules {
+		if rule.Rule != names[i] {
+			t.Errorf("expected rule %d to be %s but got %s", i, names[i], rule.Rule)
+		}
+		if rule.DurationNs < 0 {
+			t.Errorf("expected a duration for %s but got %v", rule.Rule, rule.DurationNs)
+		}
+		byName[rule.Rule] = rule
+	}
+
+	if holiday := byName["holiday"]; !holiday.Skipped || holiday.Reason != "disabled" || holiday.Inputs != nil {
+		t.Errorf("expected the disabled holiday rule to be skipped but got %+v", holiday)
+	}
+
+	retailer := byName["retailer_name"]
+	if retailer.Points != 6 || stepValue(retailer.Inputs, "retailer") != "Target" || stepValue(retailer.Steps, "alphanumericCharacters") != 6.0 {
+		t.Errorf("expected Target to have 6 alphanumeric characters but got %+v", retailer)
+	}
+
+	quarter := byName["quarter_multiple"]
+	if stepValue(quarter.Steps, "totalValue * 100 mod 25") != 10.0 {
+		t.Errorf("expected 3535 mod 25 = 10 but got %+v", quarter.Steps)
+	}
+
+	// "Emils Cheese Pizza" is the second item: 18 characters, 12.25 * 0.2 = 2.45, ceil 3.
+	description := byName["description_length"]
+	expected := map[string]interface{}{
+		"items[1].trimmedLength":       18.0,
+		"items[1].trimmedLength mod 3": 0.0,
+		"items[1].cents":               1225.0,
+		"items[1].product":             "2.4500",
+		"items[1].points":              3.0,
+		"items[0].trimmedLength mod 3": 2.0,
+		"items[0].cents":               nil,
+	}
+	for name, value := range expected {
+		if got := stepValue(description.Steps, name); got != value {
+			t.Errorf("expected step %s to be %v but got %v", name, value, got)
+		}
+	}
+	if description.Points != 6 || stepValue(description.Inputs, "rounding") != "ceil" {
+		t.Errorf("expected 6 points rounded up but got %+v", description)
+	}
+
+	afternoon := byName["afternoon_purchase"]
+	if stepValue(afternoon.Steps, "purchaseMinutes") != 781.0 || stepValue(afternoon.Steps, "inWindow") != false {
+		t.Errorf("expected 13:01 to be minute 781 outside the window but got %+v", afternoon.Steps)
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/admin/receipts/unknown/trace", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown receipt but got %v", rr.Code)
+	}
+}
+
+func TestTraceMinimumTotal(t *testing.T) {
+	config := defaultRulesConfig()
+	config.MinimumTotalCents = 10000
+	points, _, trace := newEngine(config).Trace(exampleReceipts["target"])
+	if points != 0 || len(trace.Rules) != len(ruleNames()) {
+		t.Fatalf("expected every rule to be skipped but got %+v", trace)
+	}
+	for _, rule := range trace.Rules {
+		if !rule.Skipped || rule.Reason != "below_minimum_total" {
+			t.Errorf("expected %s to be skipped below the minimum but got %+v", rule.Rule, rule)
+		}
+	}
+}
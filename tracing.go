@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracing is the provider spans are recorded with, nil while tracing is off, which
+// makes every span a no-op. Span attributes must never hold receipt contents; receipt
+// IDs are fine.
+var tracing atomic.Pointer[sdktrace.TracerProvider]
+
+// tracerName is the instrumentation scope of the spans.
+const tracerName = "receipt_api"
+
+// traceContext reads the W3C traceparent header of requests.
+var traceContext = propagation.TraceContext{}
+
+// startSpan starts a span named name as a child of the span of ctx. Without a
+// recorded one, the operation isn't part of a traced request and the span returned
+// is a no-op.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, parent
+	}
+	return parent.TracerProvider().Tracer(tracerName).Start(ctx, name)
+}
+
+// traceRequests records a server span for each request, named by method and route
+// template, continuing the trace of the client's traceparent header. Requests the
+// client chose not to sample aren't recorded.
+func traceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider := tracing.Load()
+		if provider == nil {
+			c.Next()
+			return
+		}
+		ctx := traceContext.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, s := provider.Tracer(tracerName).Start(ctx, c.Request.Method+" "+route(c),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route(c)),
+				attribute.String("request.id", c.GetString("requestID")),
+			))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		status := c.Writer.Status()
+		s.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			s.SetStatus(codes.Error, http.StatusText(status))
+		}
+		s.End()
+	}
+}
+
+// newTracerProvider returns a provider that samples what the client sampled, or every
+// trace it starts, and hands finished spans to processor.
+func newTracerProvider(processor sdktrace.SpanProcessor, serviceName string) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", version),
+		)),
+	)
+}
+
+// newTracerFromEnv configures tracing from the standard OTEL_ environment variables,
+// returning nil, which turns tracing off, unless an OTLP endpoint is set. Spans are
+// exported with the OTLP/HTTP exporter, which reads the endpoint, headers, timeout
+// and TLS settings itself; only the http/protobuf protocol is supported.
+func newTracerFromEnv(getenv func(string) string) (*sdktrace.TracerProvider, error) {
+	if strings.EqualFold(getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil, nil
+	}
+	switch exporter := getenv("OTEL_TRACES_EXPORTER"); exporter {
+	case "", "otlp":
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER %q is not supported, expected otlp or none", exporter)
+	}
+
+	endpoint := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+
+	protocol := getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "http/protobuf" {
+		return nil, fmt.Errorf("OTLP protocol %q is not supported, expected http/protobuf", protocol)
+	}
+
+	// The exporter only connects when spans are exported, so this doesn't block.
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	serviceName := getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "fetch-points"
+	}
+	// Spans are exported in batches, and dropped when the backend can't keep up rather
+	// than slowing requests.
+	return newTracerProvider(sdktrace.NewBatchSpanProcessor(exporter), serviceName), nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// useTracing records spans in memory for the rest of the test, in the order they
+// finished.
+func useTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tracing.Store(newTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), "fetch-points"))
+	t.Cleanup(func() { tracing.Store(nil) })
+	return exporter
+}
+
+// takeSpans returns the spans exported so far and forgets them.
+func takeSpans(exporter *tracetest.InMemoryExporter) tracetest.SpanStubs {
+	spans := exporter.GetSpans()
+	exporter.Reset()
+	return spans
+}
+
+// spanAttributes returns the attributes of s by key.
+func spanAttributes(s tracetest.SpanStub) map[string]any {
+	attributes := make(map[string]any, len(s.Attributes))
+	for _, kv := range s.Attributes {
+		attributes[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return attributes
+}
+
+const (
+	clientTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	clientSpanID  = "00f067aa0ba902b7"
+)
+
+func TestTraceProcessRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	exporter := useTracing(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(validReceiptPayload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-"+clientTraceID+"-"+clientSpanID+"-01")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &processed); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := takeSpans(exporter)
+	expectedNames := []string{"validate receipt", "score receipt", "store receipt", "POST /receipts/process"}
+	if len(spans) != len(expectedNames) {
+		t.Fatalf("expected %d spans but got %d", len(expectedNames), len(spans))
+	}
+	for i, name := range expectedNames {
+		if spans[i].Name != name {
+			t.Errorf("span %d: expected %q but got %q", i, name, spans[i].Name)
+		}
+	}
+
+	server := spans[3]
+	if server.SpanContext.TraceID().String() != clientTraceID || server.Parent.SpanID().String() != clientSpanID || !server.Parent.IsRemote() {
+		t.Errorf("expected the server span to continue the client's trace but got trace %s, parent %s", server.SpanContext.TraceID(), server.Parent.SpanID())
+	}
+	attributes := spanAttributes(server)
+	if server.SpanKind != trace.SpanKindServer || attributes["http.route"] != "/receipts/process" || attributes["http.response.status_code"] != int64(http.StatusOK) {
+		t.Errorf("expected a server span for the route with status 200 but got %v %v", server.SpanKind, attributes)
+	}
+	for _, child := range spans[:3] {
+		if child.SpanContext.TraceID() != server.SpanContext.TraceID() || child.Parent.SpanID() != server.SpanContext.SpanID() || child.SpanKind != trace.SpanKindInternal {
+			t.Errorf("expected %q to be a child of the server span but got trace %s, parent %s", child.Name, child.SpanContext.TraceID(), child.Parent.SpanID())
+		}
+		if child.StartTime.Before(server.StartTime) || child.EndTime.After(server.EndTime) {
+			t.Errorf("expected %q to happen within the server span", child.Name)
+		}
+	}
+	scoring := spanAttributes(spans[1])
+	if scoring["rules.count"] != int64(len(currentEngine().rules)) || scoring["receipt.id"] != processed.ID {
+		t.Errorf("expected the rule count and receipt ID on the score span but got %v", scoring)
+	}
+
+	// Receipt contents never become attributes.
+	for _, s := range spans {
+		for key, value := range spanAttributes(s) {
+			if v := fmt.Sprint(value); strings.Contains(v, "Target") || strings.Contains(v, "35.35") || strings.Contains(v, "Mountain Dew") {
+				t.Errorf("expected no receipt contents in %q but got %s=%v", s.Name, key, value)
+			}
+		}
+	}
+}
+
+func TestTraceLookupsAndFailures(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	exporter := useTracing(t)
+
+	// Without a traceparent, or with an invalid one, a new trace is started.
+	req := httptest.NewRequest(http.MethodGet, "/receipts/unknown", nil)
+	req.Header.Set("traceparent", "00-"+strings.Repeat("0", 32)+"-"+clientSpanID+"-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	spans := takeSpans(exporter)
+	if len(spans) != 2 || spans[0].Name != "load receipt" || spans[1].Name != "GET /receipts/:receipt_id" {
+		t.Fatalf("expected a load span within the server span but got %d spans", len(spans))
+	}
+	if spans[1].Parent.IsValid() || !spans[1].SpanContext.TraceID().IsValid() {
+		t.Errorf("expected a new root trace but got trace %s, parent %s", spans[1].SpanContext.TraceID(), spans[1].Parent.SpanID())
+	}
+	if attributes := spanAttributes(spans[0]); attributes["receipt.found"] != false || attributes["receipt.id"] != "unknown" {
+		t.Errorf("expected the lookup of a missing receipt but got %v", attributes)
+	}
+
+	// Invalid receipts mark the validation span as failed.
+	req = httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(`{"retailer": ""}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	spans = takeSpans(exporter)
+	if len(spans) != 2 || spans[0].Name != "validate receipt" || spans[0].Status.Code != codes.Error {
+		t.Errorf("expected only a failed validation span within the server span but got %d spans", len(spans))
+	}
+
+	// Requests the client chose not to sample aren't recorded.
+	req = httptest.NewRequest(http.MethodGet, "/rules", nil)
+	req.Header.Set("traceparent", "00-"+clientTraceID+"-"+clientSpanID+"-00")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if spans := takeSpans(exporter); len(spans) != 0 {
+		t.Errorf("expected no spans for an unsampled request but got %d", len(spans))
+	}
+
+	// Without tracing, spans are no-ops.
+	tracing.Store(nil)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/receipts/unknown", nil))
+	if spans := takeSpans(exporter); len(spans) != 0 {
+		t.Errorf("expected no spans with tracing off but got %d", len(spans))
+	}
+}
+
+func TestNewTracerFromEnv(t *testing.T) {
+	testCases := []struct {
+		name           string
+		env            map[string]string
+		expectedTracer bool
+		expectedError  string
+	}{
+		{"unset", nil, false, ""},
+		{"endpoint", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, true, ""},
+		{"traces endpoint", map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/v1/traces"}, true, ""},
+		{"protobuf protocol", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf"}, true, ""},
+		{"none exporter", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_EXPORTER": "none"}, false, ""},
+		{"disabled", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_SDK_DISABLED": "true"}, false, ""},
+		{"grpc", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, false, "expected http/protobuf"},
+		{"json", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "http/json"}, false, "expected http/protobuf"},
+		{"zipkin", map[string]string{"OTEL_TRACES_EXPORTER": "zipkin"}, false, "expected otlp or none"},
+		{"bad endpoint", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "collector"}, false, "invalid OTLP endpoint"},
+	}
+	for _, tc := range testCases {
+		tr, err := newTracerFromEnv(func(name string) string { return tc.env[name] })
+		if tr != nil {
+			defer tr.Shutdown(context.Background())
+		}
+		if tc.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("%s: expected an error containing %q but got %v", tc.name, tc.expectedError, err)
+			}
+			continue
+		}
+		if err != nil || (tr != nil) != tc.expectedTracer {
+			t.Errorf("%s: expected a tracer %v but got %v, %v", tc.name, tc.expectedTracer, tr, err)
+		}
+	}
+}
+
+// TestOTLPExport exports spans to a collector and decodes them as an OTLP collector
+// would, to check the exporter speaks the protocol.
+func TestOTLPExport(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []*http.Request
+		bodies   [][]byte
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	// The exporter reads the endpoint and headers from the environment itself.
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL+"/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "api-key=s3cret%3D,x-tenant = fetch")
+	t.Setenv("OTEL_SERVICE_NAME", "points")
+	tr, err := newTracerFromEnv(os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, parent := tr.Tracer(tracerName).Start(context.Background(), "GET /rules", trace.WithSpanKind(trace.SpanKindServer))
+	_, child := startSpan(ctx, "load rules")
+	child.SetAttributes(attribute.Int("rules.count", 7))
+	child.SetStatus(codes.Error, "boom")
+	child.End()
+	parent.End()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("expected one export but got %d", len(requests))
+	}
+	header := requests[0].Header
+	if requests[0].URL.Path != "/v1/traces" || header.Get("Api-Key") != "s3cret=" || header.Get("X-Tenant") != "fetch" || header.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("expected the configured headers on /v1/traces but got %s %v", requests[0].URL.Path, header)
+	}
+	var body coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(bodies[0], &body); err != nil {
+		t.Fatal(err)
+	}
+	var serviceName string
+	for _, kv := range body.ResourceSpans[0].Resource.Attributes {
+		if kv.Key == "service.name" {
+			serviceName = kv.Value.GetStringValue()
+		}
+	}
+	if serviceName != "points" {
+		t.Errorf("expected the service name but got %v", body.ResourceSpans[0].Resource.Attributes)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans but got %v", spans)
+	}
+	exportedChild, exportedParent := spans[0], spans[1]
+	if exportedChild.Name != "load rules" || exportedChild.Kind != tracepb.Span_SPAN_KIND_INTERNAL || string(exportedChild.ParentSpanId) != string(exportedParent.SpanId) || string(exportedChild.TraceId) != string(exportedParent.TraceId) {
+		t.Errorf("expected the child of %v but got %v", exportedParent, exportedChild)
+	}
+	if len(exportedParent.ParentSpanId) != 0 || exportedParent.Kind != tracepb.Span_SPAN_KIND_SERVER || len(exportedParent.TraceId) != 16 {
+		t.Errorf("expected a root server span but got %v", exportedParent)
+	}
+	if len(exportedChild.Attributes) != 1 || exportedChild.Attributes[0].Value.GetIntValue() != 7 || exportedChild.Status.Code != tracepb.Status_STATUS_CODE_ERROR || exportedChild.Status.Message != "boom" {
+		t.Errorf("expected the rule count and error but got %v", exportedChild)
+	}
+}
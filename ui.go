@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+)
+
+// enableUI is --enable-ui, which serves a page for submitting and looking up receipts
+// at /, for demos and manual testing.
+var enableUI bool
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiPage is the page at /; the scripts and styles it loads are served from /ui/.
+var uiPage = template.Must(template.ParseFS(uiFiles, "ui/index.html"))
+
+// uiContentSecurityPolicy lets the page load only its own scripts and styles and call
+// only the API it is served by, and keeps it out of frames.
+const uiContentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; img-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'"
+
+// uiHeaders sets the headers that keep browsers from running anything but the UI's
+// own files on its pages.
+func uiHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Security-Policy", uiContentSecurityPolicy)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("X-Frame-Options", "DENY")
+		c.Header("Referrer-Policy", "no-referrer")
+		c.Next()
+	}
+}
+
+// serveUI renders the page with the build and rules versions.
+func serveUI(c *gin.Context) {
+	var page bytes.Buffer
+	data := struct{ Version, RulesVersion string }{version, currentEngine().hash}
+	if err := uiPage.Execute(&page, data); err != nil {
+		abortWithProblem(c, http.StatusInternalServerError, "UI_UNAVAILABLE", err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// serveUIFile serves the scripts and styles under ui/, other than the page itself.
+func serveUIFile(c *gin.Context) {
+	name := path.Clean("ui/" + c.Param("filepath"))
+	data, err := fs.ReadFile(uiFiles, name)
+	if err != nil || name == "ui/index.html" {
+		abortWithProblem(c, http.StatusNotFound, "UI_FILE_NOT_FOUND", "no UI file "+c.Param("filepath"))
+		return
+	}
+	contentType := "application/octet-stream"
+	switch path.Ext(name) {
+	case ".js":
+		contentType = "text/javascript; charset=utf-8"
+	case ".css":
+		contentType = "text/css; charset=utf-8"
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
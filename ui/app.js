@@ -0,0 +1,94 @@
+"use strict";
+
+// The page talks to the API it is served by, sending the API key, if one is given,
+// as X-API-Key. The key is kept for the browser session only.
+
+const apiKey = document.getElementById("api-key");
+apiKey.value = sessionStorage.getItem("apiKey") || "";
+apiKey.addEventListener("change", () => sessionStorage.setItem("apiKey", apiKey.value));
+
+async function api(method, path, body) {
+  const headers = {"Accept": "application/json"};
+  if (apiKey.value) {
+    headers["X-API-Key"] = apiKey.value;
+  }
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+  const response = await fetch(path, {method, headers, body: body === undefined ? undefined : JSON.stringify(body)});
+  const data = await response.json().catch(() => ({}));
+  if (!response.ok) {
+    // Errors are problem details; the code and detail say what went wrong.
+    throw new Error(`${response.status} ${data.code || response.statusText}: ${data.detail || ""}`);
+  }
+  return data;
+}
+
+function show(output, text, failed) {
+  output.textContent = text;
+  output.classList.toggle("error", Boolean(failed));
+}
+
+const items = document.getElementById("items");
+const itemRow = document.getElementById("item-row");
+
+function addItem() {
+  const row = itemRow.content.cloneNode(true);
+  row.querySelector(".remove-item").addEventListener("click", (event) => {
+    if (items.rows.length > 1) {
+      event.target.closest("tr").remove();
+    }
+  });
+  items.appendChild(row);
+}
+
+document.getElementById("add-item").addEventListener("click", addItem);
+addItem();
+
+document.getElementById("receipt-form").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  const output = document.getElementById("submit-result");
+  const receipt = {
+    retailer: form.retailer.value,
+    purchaseDate: form.purchaseDate.value,
+    purchaseTime: form.purchaseTime.value,
+    total: form.total.value,
+    items: Array.from(items.rows, (row) => ({
+      shortDescription: row.querySelector("[name=shortDescription]").value,
+      price: row.querySelector("[name=price]").value,
+    })),
+  };
+  try {
+    const {id} = await api("POST", "/receipts/process", receipt);
+    const {points} = await api("GET", `/receipts/${encodeURIComponent(id)}/points`);
+    show(output, `Receipt ${id} scored ${points} points.`);
+  } catch (err) {
+    show(output, err.message, true);
+  }
+});
+
+const lookupForm = document.getElementById("lookup-form");
+
+async function lookup(id) {
+  const output = document.getElementById("lookup-result");
+  try {
+    const {points, breakdown} = await api("GET", `/receipts/${encodeURIComponent(id)}/breakdown`);
+    const lines = breakdown.map((entry) => `${entry.rule}: ${entry.points} (${entry.detail})`);
+    show(output, [`Receipt ${id} scored ${points} points.`, ...lines].join("\n"));
+  } catch (err) {
+    show(output, err.message, true);
+  }
+}
+
+lookupForm.addEventListener("submit", (event) => {
+  event.preventDefault();
+  lookup(lookupForm.id.value.trim());
+});
+
+// A receipt uploaded from a browser form is redirected here as /?id=<id>.
+const uploaded = new URLSearchParams(window.location.search).get("id");
+if (uploaded) {
+  lookupForm.id.value = uploaded;
+  lookup(uploaded);
+}
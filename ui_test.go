@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestServeUI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(previous bool) { enableUI = previous }(enableUI)
+	get := func(router *gin.Engine, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	enableUI = false
+	for _, path := range []string{"/", "/ui/app.js"} {
+		if rr := get(newRouter(), path); rr.Code != http.StatusNotFound {
+			t.Errorf("expected %s to be 404 without --enable-ui but got %v", path, rr.Code)
+		}
+	}
+
+	enableUI = true
+	router := newRouter()
+	rr := get(router, "/")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("expected the page but got %v %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if csp := rr.Header().Get("Content-Security-Policy"); csp != uiContentSecurityPolicy || rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expected the UI's security headers but got %v", rr.Header())
+	}
+	page := rr.Body.String()
+	if !strings.Contains(page, "Version "+version+", rules "+currentEngine().hash) {
+		t.Errorf("expected the page to give the versions but got %s", page)
+	}
+
+	// Every script and stylesheet the page loads is served.
+	assets := regexp.MustCompile(`(?:src|href)="(/ui/[^"]+)"`).FindAllStringSubmatch(page, -1)
+	if len(assets) != 2 {
+		t.Fatalf("expected the page to load a script and a stylesheet but found %v", assets)
+	}
+	expectedTypes := map[string]string{"/ui/app.js": "text/javascript; charset=utf-8", "/ui/style.css": "text/css; charset=utf-8"}
+	for _, asset := range assets {
+		rr := get(router, asset[1])
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != expectedTypes[asset[1]] || rr.Body.Len() == 0 {
+			t.Errorf("expected %s to be served as %s but got %v %s", asset[1], expectedTypes[asset[1]], rr.Code, rr.Header().Get("Content-Type"))
+		}
+		if rr.Header().Get("Content-Security-Policy") != uiContentSecurityPolicy {
+			t.Errorf("expected %s to be served with the UI's policy", asset[1])
+		}
+	}
+
+	for _, path := range []string{"/ui/missing.js", "/ui/index.html", "/ui/../go.mod", "/ui/"} {
+		if rr := get(router, path); rr.Code != http.StatusNotFound {
+			t.Errorf("expected %s not to be served but got %v", path, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadMediaType is the media type of receipts uploaded as a file from a browser
+// form, rather than sent as the request body.
+const uploadMediaType = "multipart/form-data"
+
+// uploadField is the name of the form field the receipt file is uploaded in.
+const uploadField = "receipt"
+
+// unpackUpload takes the receipt of a multipart/form-data request from its receipt
+// file, which must be a JSON document, and has the handlers after it read the file as
+// a JSON request body. Other fields of the form are ignored. The file counts against
+// the size limit of the body it is in. With --enable-ui, an upload from a browser,
+// which accepts HTML, is answered with a redirect to the receipt on the UI's page.
+// Requests in other formats are passed through.
+func unpackUpload() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mediaType, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err != nil || mediaType != uploadMediaType {
+			c.Next()
+			return
+		}
+		data, err := readUpload(multipart.NewReader(c.Request.Body, params["boundary"]))
+		var maxBytesErr *http.MaxBytesError
+		var decodeErr *receiptDecodeError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			abortWithBodyTooLarge(c, maxBytesErr.Limit)
+			return
+		case errors.As(err, &decodeErr):
+			rejectReceipt(c, decodeErr.reason, decodeErr.message)
+			return
+		case err != nil:
+			rejectReceipt(c, reasonBodyInvalid, "Failed to parse the request body: malformed multipart form: "+err.Error())
+			return
+		}
+		c.Set("requestFormat", jsonFormat)
+		c.Set("redirectToUI", enableUI && acceptsHTML(c))
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+		c.Request.ContentLength = int64(len(data))
+		c.Next()
+	}
+}
+
+// acceptsHTML reports whether the client names text/html in its Accept header, as
+// browsers do for a form they submit. A wildcard doesn't count, so API clients that
+// accept anything still get JSON.
+func acceptsHTML(c *gin.Context) bool {
+	for _, accepted := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accepted)
+		if err == nil && mediaType == gin.MIMEHTML {
+			return true
+		}
+	}
+	return false
+}
+
+// uiReceiptPath is the UI's page showing the receipt id.
+func uiReceiptPath(id string) string {
+	return "/?id=" + url.QueryEscape(id)
+}
+
+// readUpload returns the content of the one receipt file of form.
+func readUpload(form *multipart.Reader) ([]byte, error) {
+	var data []byte
+	found := false
+	for {
+		part, err := form.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() != uploadField {
+			continue
+		}
+		if found {
+			return nil, &receiptDecodeError{reason: reasonUploadMultiple, message: "the form has more than one receipt file"}
+		}
+		found = true
+		if data, err = io.ReadAll(part); err != nil {
+			return nil, err
+		}
+		// Editors on Windows can start a file with a byte order mark.
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+		if !isJSONUpload(part.Header.Get("Content-Type"), data) {
+			return nil, &receiptDecodeError{reason: reasonUploadNotJSON, message: "the receipt file must be a JSON document"}
+		}
+	}
+	if !found {
+		return nil, &receiptDecodeError{reason: reasonUploadMissing, message: "the form has no receipt file"}
+	}
+	return data, nil
+}
+
+// isJSONUpload reports whether an uploaded file of contentType looks like a JSON
+// object. Browsers label files by their extension, so a file without a JSON type is
+// accepted when it is text, as a .json file of an unknown extension is labeled, and
+// sniffs as an object.
+func isJSONUpload(contentType string, data []byte) bool {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return false
+		}
+		switch mediaType {
+		case gin.MIMEJSON, "application/octet-stream", "text/plain":
+		default:
+			return false
+		}
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "text/plain") {
+		return false
+	}
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("{"))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadFile is a file part of a multipart form.
+type uploadFile struct {
+	field, contentType, content string
+}
+
+// uploadForm builds a multipart/form-data body with files, and returns it with its
+// content type.
+func uploadForm(t *testing.T, files ...uploadFile) ([]byte, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("note", "uploaded from the back office")
+	for _, file := range files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+file.field+`"; filename="receipt.json"`)
+		if file.contentType != "" {
+			header.Set("Content-Type", file.contentType)
+		}
+		part, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(file.content))
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes(), form.FormDataContentType()
+}
+
+func TestUploadReceipt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	for _, contentType := range []string{"application/json", "application/octet-stream", ""} {
+		body, formType := uploadForm(t, uploadFile{"receipt", contentType, "\xef\xbb\xbf" + validReceiptPayload})
+		rr := serveBody(router, http.MethodPost, "/receipts/process", formType, "text/html,application/xhtml+xml,*/*;q=0.8", body)
+		var response struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK || response.ID == "" {
+			t.Fatalf("%q: expected a JSON 200 with an ID but got %v %s", contentType, rr.Code, rr.Body.String())
+		}
+		rr = serveBody(router, http.MethodGet, "/receipts/"+response.ID+"/points", "", "", nil)
+		if !strings.Contains(rr.Body.String(), `"points":28`) {
+			t.Errorf("%q: expected 28 points but got %s", contentType, rr.Body.String())
+		}
+	}
+}
+
+func TestUploadReceiptRedirectsToUI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous bool) { enableUI = previous }(enableUI)
+	enableUI = true
+	router := newRouter()
+
+	// A browser is sent to the receipt on the UI's page.
+	body, formType := uploadForm(t, uploadFile{"receipt", "application/json", validReceiptPayload})
+	rr := serveBody(router, http.MethodPost, "/receipts/process", formType, "text/html,application/xhtml+xml,*/*;q=0.8", body)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if rr.Code != http.StatusSeeOther || err != nil || location.Path != "/" {
+		t.Fatalf("expected a 303 to the UI but got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+	id := location.Query().Get("id")
+	receiptsMu.RLock()
+	_, ok := receipts[id]
+	receiptsMu.RUnlock()
+	if !ok {
+		t.Errorf("expected the receipt to be stored as %q", id)
+	}
+	if rr := serveBody(router, http.MethodGet, location.String(), "", "text/html", nil); rr.Code != http.StatusOK {
+		t.Errorf("expected the UI's page at %s but got %v", location, rr.Code)
+	}
+
+	// Clients that don't ask for HTML, and receipts that aren't uploaded, get the ID.
+	for _, accept := range []string{"*/*", "application/json", ""} {
+		body, formType := uploadForm(t, uploadFile{"receipt", "application/json", validReceiptPayload})
+		if rr := serveBody(router, http.MethodPost, "/receipts/process", formType, accept, body); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"id":`) {
+			t.Errorf("%q: expected a JSON 200 but got %v %s", accept, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := serveBody(router, http.MethodPost, "/receipts/process", "application/json", "text/html", []byte(validReceiptPayload)); rr.Code != http.StatusOK || rr.Header().Get("Location") != "" {
+		t.Errorf("expected a JSON body to get its ID but got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestUploadReceiptErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	defer func(previous byteSize) { maxBodyBytes = previous }(maxBodyBytes)
+
+	invalid := strings.Replace(validReceiptPayload, `"35.35"`, `""`, 1)
+	testCases := []struct {
+		name     string
+		files    []uploadFile
+		status   int
+		code     string
+		contains string
+	}{
+		{"Missing", []uploadFile{{"file", "application/json", validReceiptPayload}}, http.StatusBadRequest, "UPLOAD_MISSING", "no receipt file"},
+		{"Multiple", []uploadFile{{"receipt", "application/json", validReceiptPayload}, {"receipt", "application/json", validReceiptPayload}}, http.StatusBadRequest, "UPLOAD_MULTIPLE", "more than one receipt file"},
+		{"Image", []uploadFile{{"receipt", "image/png", "\x89PNG\r\n\x1a\n"}}, http.StatusBadRequest, "UPLOAD_NOT_JSON", "must be a JSON document"},
+		{"Binary", []uploadFile{{"receipt", "application/octet-stream", "\x00\x01\x02{}"}}, http.StatusBadRequest, "UPLOAD_NOT_JSON", "must be a JSON document"},
+		{"CSV", []uploadFile{{"receipt", "", "retailer,total\nTarget,35.35\n"}}, http.StatusBadRequest, "UPLOAD_NOT_JSON", "must be a JSON document"},
+		{"Invalid", []uploadFile{{"receipt", "application/json", invalid}}, http.StatusBadRequest, "TOTAL_MISSING", "Total amount is required"},
+		{"TooLarge", []uploadFile{{"receipt", "application/json", validReceiptPayload + strings.Repeat(" ", 2048)}}, http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, formType := uploadForm(t, tc.files...)
+			maxBodyBytes = byteSize(1 << 20)
+			if tc.status == http.StatusRequestEntityTooLarge {
+				maxBodyBytes = byteSize(len(body) - 100)
+			}
+			// The limit is read when the routes are set up.
+			router := newRouter()
+			before := receiptValidationFailures.value(tc.code)
+			rr := serveBody(router, http.MethodPost, "/receipts/process", formType, "", body)
+			if rr.Code != tc.status || !strings.Contains(rr.Body.String(), tc.contains) {
+				t.Fatalf("expected %v containing %q but got %v %s", tc.status, tc.contains, rr.Code, rr.Body.String())
+			}
+			if tc.status == http.StatusBadRequest && receiptValidationFailures.value(tc.code) != before+1 {
+				t.Errorf("expected the upload rejected for %s", tc.code)
+			}
+		})
+	}
+
+	// A form that isn't well formed is a body that can't be parsed.
+	body, formType := uploadForm(t, uploadFile{"receipt", "application/json", validReceiptPayload})
+	rr := serveBody(newRouter(), http.MethodPost, "/receipts/process", formType, "", body[:len(body)/2])
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "malformed multipart form") {
+		t.Errorf("expected a 400 for a malformed form but got %v %s", rr.Code, rr.Body.String())
+	}
+}
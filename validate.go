@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// validateOnly is --validate-only, which checks the options and the files they name
+// and exits without serving, for deployment pipelines to run before a rollout.
+var validateOnly bool
+
+// validateOptions checks the options of fs, each on its own and against the others,
+// and loads the files they name, so a mistake stops startup rather than the first
+// request that needs it. It returns every problem found, joined, not just the first.
+func validateOptions(fs *flag.FlagSet) error {
+	var problems []error
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	checkf := func(failed bool, format string, args ...any) {
+		if failed {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, err := resolveMode(runMode, os.Getenv)
+	check(err)
+	checkf(logFormat != logFormatJSON && logFormat != logFormatConsole, "--log-format %q is not json or console", logFormat)
+	check(cors.validate())
+	checkf(trustAllProxies && len(trustedProxies) > 0, "--trust-all-proxies and --trusted-proxies can't be given together")
+	check(limits.validate())
+	checkf(requestTimeout < 0, "--request-timeout %v is negative", requestTimeout)
+	checkf(adminWriteTimeout < 0, "--admin-write-timeout %v is negative", adminWriteTimeout)
+	checkf(signatureWindow < 0, "--signature-window %s is negative", signatureWindow)
+	checkf(quotaResetHour < 0 || quotaResetHour > 23, "--quota-reset-hour %d is not between 0 and 23", quotaResetHour)
+	checkf(maxInFlight < 0, "--max-in-flight %d is negative", maxInFlight)
+	checkf(maxAdminInFlight < 0, "--max-admin-in-flight %d is negative", maxAdminInFlight)
+	for _, class := range routeClasses {
+		checkf(class.limit < 0, "--max-%s-in-flight %d is negative", class.name, class.limit)
+	}
+	checkf(routeClassWait < 0, "--route-class-wait %s is negative", routeClassWait)
+	checkf(pointsExpiryMonths < 0, "--points-expiry-months %d is negative", pointsExpiryMonths)
+	checkf(maxFormFields < 0, "--max-form-fields %d is negative", maxFormFields)
+	checkf(maxFormItems < 0, "--max-form-items %d is negative", maxFormItems)
+	checkf(maxBatchReceipts < 0, "--max-batch-receipts %d is negative", maxBatchReceipts)
+	for _, other := range []string{listenAddr, adminAddr, healthAddr} {
+		checkf(grpcAddr != "" && grpcAddr == other, "--grpc-addr %s is already served by another listener", grpcAddr)
+	}
+	_, err = newExtractor(extractorName)
+	check(err)
+	if webhookURL != "" {
+		check(validateWebhookURL(webhookURL))
+		checkf(webhookSecret == "", "--webhook-url requires --webhook-secret")
+	}
+	if eventPublisherName == "nats" && natsURL == "" {
+		problems = append(problems, errors.New("--event-publisher nats requires --nats-url"))
+	} else {
+		_, err = newEventPublisher(eventPublisherName)
+		check(err)
+	}
+	checkf(gzipLevel < 0 || gzipLevel > 9, "--gzip-level %d is not between 0 and 9", gzipLevel)
+	checkf(experimentPercent < 0 || experimentPercent > 100, "--experiment-percent %d is not between 0 and 100", experimentPercent)
+	problems = append(problems, validateDeterministic()...)
+
+	// A burst below a second's worth of the rate would cap clients under the rate.
+	switch {
+	case ipBurst < 0:
+		problems = append(problems, fmt.Errorf("--rate-burst %d is negative", ipBurst))
+	case ipBurst > 0 && ipRate.count == 0:
+		problems = append(problems, errors.New("--rate-burst requires --rate-limit"))
+	case ipBurst > 0 && float64(ipBurst) < ipRate.perSecond():
+		problems = append(problems, fmt.Errorf("--rate-burst %d is below the %s of --rate-limit", ipBurst, ipRate.String()))
+	}
+
+	_, _, err = newTLSConfig(tlsCertFile, tlsKeyFile, tlsClientCAFile)
+	check(err)
+	config, err := resolveRulesConfig(rulesConfigPath, fs)
+	check(err)
+	if err == nil {
+		_, err = prepareSeeds(newEngine(config))
+		check(err)
+	}
+	if shadowRulesConfigPath != "" {
+		_, err = loadRulesConfig(shadowRulesConfigPath)
+		check(err)
+	}
+	if experimentRulesConfigPath != "" {
+		_, err = loadRulesConfig(experimentRulesConfigPath)
+		check(err)
+	}
+	if apiKeysFilePath != "" {
+		_, err = loadAPIKeys(apiKeysFilePath)
+		check(err)
+	}
+	checkf(webhookMaxAttempts < 1, "--webhook-max-attempts %d is below 1", webhookMaxAttempts)
+	checkf(webhookMaxAge < 0, "--webhook-max-age %s is negative", webhookMaxAge)
+	if webhookStateFile != "" {
+		_, err = loadWebhookState(webhookStateFile)
+		check(err)
+	}
+	if webhookSubscriptionsFile != "" {
+		_, err = loadSubscriptionStore(webhookSubscriptionsFile)
+		check(err)
+	}
+	if signingSecretsFilePath != "" {
+		_, err = loadSigningSecrets(signingSecretsFilePath)
+		check(err)
+	}
+	_, err = resolveMetricsCredentials(metricsUsername, metricsPassword, metricsHtpasswdPath)
+	check(err)
+	return errors.Join(problems...)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resettableOptions returns a function that sets the options back to their values
+// when it was called and then parses args as the command line. The options are set
+// back again when the test ends.
+func resettableOptions(t *testing.T) func(args ...string) *flag.FlagSet {
+	t.Helper()
+	saved := make(map[string]string)
+	newOptions := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("fetch-points", flag.ContinueOnError)
+		config := defaultRulesConfig()
+		registerFlags(fs, &config)
+		return fs
+	}
+	newOptions().VisitAll(func(f *flag.Flag) { saved[f.Name] = f.Value.String() })
+	optionsFrom := func(args ...string) *flag.FlagSet {
+		t.Helper()
+		fs := newOptions()
+		fs.VisitAll(func(f *flag.Flag) {
+			if err := f.Value.Set(saved[f.Name]); err != nil {
+				t.Fatalf("--%s: %v", f.Name, err)
+			}
+		})
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+	t.Cleanup(func() { optionsFrom() })
+	return optionsFrom
+}
+
+func TestValidateOptions(t *testing.T) {
+	t.Setenv("GIN_MODE", "")
+	optionsFrom := resettableOptions(t)
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.yaml")
+	invalidRules := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(invalidRules, []byte("enabledRules: [retailer_nme]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"mode", []string{"--mode", "prod"}, `--mode "prod"`},
+		{"log format", []string{"--log-format", "xml"}, `--log-format "xml" is not json or console`},
+		{"both proxy options", []string{"--trust-all-proxies", "--trusted-proxies", "10.0.0.0/8"}, "--trust-all-proxies and --trusted-proxies can't be given together"},
+		{"server limits", []string{"--read-timeout", "1m", "--write-timeout", "30s"}, "--write-timeout"},
+		{"request timeout", []string{"--request-timeout", "-1s"}, "--request-timeout -1s is negative"},
+		{"admin write timeout", []string{"--admin-write-timeout", "-1s"}, "--admin-write-timeout -1s is negative"},
+		{"signature window", []string{"--signature-window", "-1s"}, "--signature-window -1s is negative"},
+		{"quota reset hour", []string{"--quota-reset-hour", "24"}, "--quota-reset-hour 24 is not between 0 and 23"},
+		{"max in flight", []string{"--max-in-flight", "-1"}, "--max-in-flight -1 is negative"},
+		{"max admin in flight", []string{"--max-admin-in-flight", "-1"}, "--max-admin-in-flight -1 is negative"},
+		{"max exports in flight", []string{"--max-export-in-flight", "-1"}, "--max-export-in-flight -1 is negative"},
+		{"route class wait", []string{"--route-class-wait", "-1s"}, "--route-class-wait -1s is negative"},
+		{"points expiry", []string{"--points-expiry-months", "-1"}, "--points-expiry-months -1 is negative"},
+		{"max form items", []string{"--max-form-items", "-1"}, "--max-form-items -1 is negative"},
+		{"experiment percent", []string{"--experiment-percent", "101"}, "--experiment-percent 101 is not between 0 and 100"},
+		{"gzip level", []string{"--gzip-level", "10"}, "--gzip-level 10 is not between 0 and 9"},
+		{"negative burst", []string{"--rate-limit", "10/s", "--rate-burst", "-1"}, "--rate-burst -1 is negative"},
+		{"burst without a rate", []string{"--rate-burst", "5"}, "--rate-burst requires --rate-limit"},
+		{"burst below the rate", []string{"--rate-limit", "10/s", "--rate-burst", "5"}, "--rate-burst 5 is below the 10/s of --rate-limit"},
+		{"certificate without a key", []string{"--tls-cert", "cert.pem"}, "--tls-cert and --tls-key must be given together"},
+		{"client CA without a certificate", []string{"--tls-client-ca", "ca.pem"}, "--tls-client-ca requires --tls-cert and --tls-key"},
+		{"missing rules config", []string{"--rules-config", missing}, "missing.yaml"},
+		{"invalid rules config", []string{"--rules-config", invalidRules}, "retailer_nme"},
+		{"missing shadow rules config", []string{"--shadow-rules-config", missing}, "missing.yaml"},
+		{"missing experiment rules config", []string{"--experiment-rules-config", missing}, "missing.yaml"},
+		{"missing API keys", []string{"--api-keys-file", missing}, "missing.yaml"},
+		{"missing signing secrets", []string{"--signing-secrets-file", missing}, "missing.yaml"},
+		{"webhook URL", []string{"--webhook-url", "ftp://hooks.example.com", "--webhook-secret", "s"}, `webhook URL "ftp://hooks.example.com" is not an absolute http or https URL`},
+		{"webhook without a secret", []string{"--webhook-url", "https://hooks.example.com"}, "--webhook-url requires --webhook-secret"},
+		{"webhook max attempts", []string{"--webhook-max-attempts", "0"}, "--webhook-max-attempts 0 is below 1"},
+		{"webhook max age", []string{"--webhook-max-age", "-1h"}, "--webhook-max-age -1h0m0s is negative"},
+		{"event publisher", []string{"--event-publisher", "kafka"}, `--event-publisher "kafka" is not none, stdout or nats`},
+		{"NATS without a URL", []string{"--event-publisher", "nats"}, "--event-publisher nats requires --nats-url"},
+		{"NATS URL", []string{"--event-publisher", "nats", "--nats-url", "http://localhost:4222"}, `--nats-url "http://localhost:4222" is not a nats://host:port URL`},
+		{"NATS subject prefix", []string{"--event-publisher", "nats", "--nats-url", "nats://localhost", "--nats-subject-prefix", "fetch.>"}, `--nats-subject-prefix "fetch.>" is not a NATS subject`},
+		{"missing htpasswd", []string{"--metrics-htpasswd", missing}, "missing.yaml"},
+		{"deterministic IDs", []string{"--deterministic", "--deterministic-ids", "random"}, `--deterministic-ids "random" is not sequential or content`},
+		{"deterministic time", []string{"--deterministic", "--deterministic-time", "2024-01-01"}, `--deterministic-time "2024-01-01" is not an RFC 3339 time`},
+		{"record dir without deterministic", []string{"--record-dir", dir}, "--record-dir requires --deterministic"},
+	}
+	for _, tc := range testCases {
+		err := validateOptions(optionsFrom(tc.args...))
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s: expected an error containing %q but got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	// The defaults are valid, and every problem is reported, not just the first.
+	if err := validateOptions(optionsFrom()); err != nil {
+		t.Errorf("expected the defaults to be valid but got %v", err)
+	}
+	err := validateOptions(optionsFrom("--log-format", "xml", "--quota-reset-hour", "24", "--rules-config", missing))
+	if err == nil || strings.Count(err.Error(), "\n") != 2 {
+		t.Errorf("expected three problems, one per line, but got %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The --webhook-url every receipt event is posted to, and the --webhook-secret its
+// deliveries are signed with, besides the subscriptions made through the API.
+var (
+	webhookURL    string
+	webhookSecret string
+)
+
+// webhooks delivers receipt events. It is nil until the server starts.
+var webhooks atomic.Pointer[webhookDispatcher]
+
+// webhookQueueSize is how many deliveries may be pending, waiting for their first
+// attempt or a retry, before more events are dropped, and webhookTimeout how long a
+// receiver gets to answer an attempt.
+const (
+	webhookQueueSize = 1024
+	webhookTimeout   = 10 * time.Second
+)
+
+// The --webhook-max-attempts and --webhook-max-age after which a delivery that keeps
+// failing is given up on and dead-lettered. A max age of 0 is no limit.
+var (
+	webhookMaxAttempts = 8
+	webhookMaxAge      = 24 * time.Hour
+)
+
+// webhookStateFile is the --webhook-state-file the deliveries awaiting a retry and the
+// dead letters are kept in, so they survive restarts. Without it they are kept in
+// memory only.
+var webhookStateFile string
+
+// webhookRetryBase is the wait before the first retry of a delivery, doubled for each
+// retry after it up to webhookRetryMax. Each wait is jittered by up to half.
+var (
+	webhookRetryBase = time.Second
+	webhookRetryMax  = 10 * time.Minute
+)
+
+// webhookMaxDeadLetters bounds the dead letters kept; the oldest make way for new ones.
+const webhookMaxDeadLetters = 10000
+
+var (
+	webhookDeliveryAttempts = newCounterVec("webhook_delivery_attempts_total",
+		"Webhook delivery attempts, by outcome: success, or failure for errors and statuses other than 2xx.", "outcome")
+	webhookDeliveries = newCounterVec("webhook_deliveries_total",
+		"Webhook deliveries finished, by outcome: success, or failure for those dead-lettered.", "outcome")
+	webhookEventsDropped = newCounterVec("webhook_events_dropped_total",
+		"Webhook events dropped because the delivery queue was full.")
+	webhookDeadLetters = &gaugeFunc{name: "webhook_dead_letters",
+		help: "Webhook deliveries given up on, awaiting a redrive.",
+		value: func() float64 {
+			if d := webhooks.Load(); d != nil {
+				return float64(d.deadLetterCount())
+			}
+			return 0
+		}}
+)
+
+// webhookTarget is where a delivery goes and the secret it is signed with.
+type webhookTarget struct {
+	url    string
+	secret []byte
+	// subscriptionID is the subscription the target is, or empty for --webhook-url.
+	subscriptionID string
+}
+
+// webhookDelivery is an event on its way to one receiver. The receiver's secret isn't
+// kept with it but looked up for each attempt, so it is never stored twice.
+type webhookDelivery struct {
+	ID string `json:"id"`
+	// SubscriptionID is the subscription it goes to, or empty for --webhook-url.
+	SubscriptionID string     `json:"subscriptionId,omitempty"`
+	URL            string     `json:"url"`
+	Event          Event      `json:"event"`
+	Attempts       int        `json:"attempts"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	NextAttemptAt  time.Time  `json:"nextAttemptAt"`
+	LastAttemptAt  *time.Time `json:"lastAttemptAt,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+
+	// seq orders deliveries due at the same time by when they were sent.
+	seq uint64
+}
+
+// webhookState is the content of a --webhook-state-file.
+type webhookState struct {
+	Pending     []webhookDelivery `json:"pending"`
+	DeadLetters []webhookDelivery `json:"deadLetters"`
+}
+
+// webhookDispatcher posts events to their receivers in the background, so requests
+// never wait on them, retrying failed deliveries with backoff until they succeed or
+// are dead-lettered. Events sent while webhookQueueSize deliveries are pending are
+// dropped and counted.
+type webhookDispatcher struct {
+	client *http.Client
+	path   string
+
+	mu          sync.Mutex
+	pending     map[string]*webhookDelivery
+	deadLetters []webhookDelivery
+	seq         uint64
+	flushes     []chan struct{}
+	closing     bool
+	// stopped is set once close gives up waiting, to stop at the next delivery.
+	stopped bool
+
+	wake    chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// newWebhookDispatcher starts delivering the events sent to it, keeping its state in
+// memory.
+func newWebhookDispatcher() *webhookDispatcher {
+	d := &webhookDispatcher{pending: make(map[string]*webhookDelivery)}
+	d.start()
+	return d
+}
+
+// loadWebhookDispatcher starts a dispatcher saving its state to path, resuming the
+// deliveries and dead letters saved there if it exists.
+func loadWebhookDispatcher(path string) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{path: path, pending: make(map[string]*webhookDelivery)}
+	state, err := loadWebhookState(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(state.Pending, func(i, j int) bool { return state.Pending[i].CreatedAt.Before(state.Pending[j].CreatedAt) })
+	for i := range state.Pending {
+		delivery := state.Pending[i]
+		d.seq++
+		delivery.seq = d.seq
+		d.pending[delivery.ID] = &delivery
+	}
+	d.deadLetters = state.DeadLetters
+	d.start()
+	return d, nil
+}
+
+// loadWebhookState reads a --webhook-state-file, which need not exist.
+func loadWebhookState(path string) (webhookState, error) {
+	var state webhookState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, &configError{path: path, msg: err.Error()}
+	}
+	return state, nil
+}
+
+func (d *webhookDispatcher) start() {
+	d.client = &http.Client{Timeout: webhookTimeout}
+	d.wake = make(chan struct{}, 1)
+	d.done = make(chan struct{})
+	go d.run()
+}
+
+// signal wakes the worker up, if it is waiting.
+func (d *webhookDispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run attempts the due deliveries, earliest first, one at a time, and otherwise waits
+// for the next to come due or for a new one.
+func (d *webhookDispatcher) run() {
+	defer close(d.done)
+	for {
+		d.mu.Lock()
+		next, now := d.nextLocked(), clock.Now()
+		if next == nil || next.NextAttemptAt.After(now) {
+			for _, flushed := range d.flushes {
+				close(flushed)
+			}
+			d.flushes = nil
+			closing := d.closing
+			d.mu.Unlock()
+			if closing {
+				return
+			}
+			d.wait(next, now)
+			continue
+		}
+		if d.stopped {
+			d.mu.Unlock()
+			return
+		}
+		delivery := *next
+		d.mu.Unlock()
+
+		err := d.attempt(&delivery)
+		d.mu.Lock()
+		d.recordLocked(delivery, err)
+		d.mu.Unlock()
+	}
+}
+
+// wait waits until next, if any, comes due, or the worker is woken up.
+func (d *webhookDispatcher) wait(next *webhookDelivery, now time.Time) {
+	if next == nil {
+		<-d.wake
+		return
+	}
+	timer := time.NewTimer(next.NextAttemptAt.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.wake:
+	}
+}
+
+// nextLocked returns the pending delivery due first. It must be called with mu held.
+func (d *webhookDispatcher) nextLocked() *webhookDelivery {
+	var next *webhookDelivery
+	for _, delivery := range d.pending {
+		if next == nil || delivery.NextAttemptAt.Before(next.NextAttemptAt) ||
+			(delivery.NextAttemptAt.Equal(next.NextAttemptAt) && delivery.seq < next.seq) {
+			next = delivery
+		}
+	}
+	return next
+}
+
+// attempt delivers once to the receiver of delivery as it is now configured.
+func (d *webhookDispatcher) attempt(delivery *webhookDelivery) error {
+	target := webhookTarget{url: delivery.URL, secret: []byte(webhookSecret)}
+	if delivery.SubscriptionID != "" {
+		sub, ok := webhookSubscriptions.get(delivery.SubscriptionID)
+		if !ok {
+			return errSubscriptionDeleted
+		}
+		target = sub.target()
+	}
+	return d.deliver(target, delivery.Event)
+}
+
+// errSubscriptionDeleted fails the deliveries to a subscription deleted since.
+var errSubscriptionDeleted = errors.New("the subscription was deleted")
+
+// recordLocked records the outcome of an attempt at delivery: done if it succeeded,
+// else retried after a backoff, or dead-lettered once it is out of attempts or too old.
+// Deliveries to deleted subscriptions are dropped. It must be called with mu held.
+func (d *webhookDispatcher) recordLocked(delivery webhookDelivery, err error) {
+	if _, ok := d.pending[delivery.ID]; !ok {
+		return
+	}
+	if errors.Is(err, errSubscriptionDeleted) {
+		delete(d.pending, delivery.ID)
+		d.saveLocked()
+		return
+	}
+	now := clock.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	if err == nil {
+		webhookDeliveryAttempts.inc("success")
+		webhookDeliveries.inc("success")
+		delete(d.pending, delivery.ID)
+		d.saveLocked()
+		return
+	}
+
+	webhookDeliveryAttempts.inc("failure")
+	delivery.LastError = err.Error()
+	delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts))
+	expired := webhookMaxAge > 0 && delivery.NextAttemptAt.Sub(delivery.CreatedAt) > webhookMaxAge
+	if delivery.Attempts < webhookMaxAttempts && !expired {
+		log.Printf("delivering %s webhook %s to %s failed, attempt %d, retrying at %s: %v",
+			delivery.Event.Type, delivery.Event.ID, delivery.URL, delivery.Attempts, delivery.NextAttemptAt.Format(time.RFC3339), err)
+		d.pending[delivery.ID] = &delivery
+		d.saveLocked()
+		return
+	}
+	log.Printf("delivering %s webhook %s to %s failed, attempt %d, giving up: %v",
+		delivery.Event.Type, delivery.Event.ID, delivery.URL, delivery.Attempts, err)
+	webhookDeliveries.inc("failure")
+	delete(d.pending, delivery.ID)
+	delivery.NextAttemptAt = time.Time{}
+	d.deadLetters = append(d.deadLetters, delivery)
+	if len(d.deadLetters) > webhookMaxDeadLetters {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-webhookMaxDeadLetters:]
+	}
+	d.saveLocked()
+}
+
+// webhookBackoff returns how long to wait after the attempts-th failed attempt:
+// webhookRetryBase doubled for each attempt after the first, at most webhookRetryMax,
+// less a random part of up to half, so receivers coming back aren't hit all at once.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookRetryMax
+	if attempts < 32 {
+		if doubled := webhookRetryBase << (attempts - 1); doubled > 0 && doubled < backoff {
+			backoff = doubled
+		}
+	}
+	half := backoff / 2
+	return backoff - time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// send queues a delivery of event to target without blocking. The first drop and
+// every power of two after it are logged.
+func (d *webhookDispatcher) send(target webhookTarget, event Event) {
+	now := clock.Now()
+	d.mu.Lock()
+	if d.closing || len(d.pending) >= webhookQueueSize {
+		d.mu.Unlock()
+		webhookEventsDropped.inc()
+		if n := d.dropped.Add(1); n&(n-1) == 0 {
+			log.Printf("the webhook queue is full, %d events dropped", n)
+		}
+		return
+	}
+	d.seq++
+	delivery := &webhookDelivery{ID: newID(idDelivery), SubscriptionID: target.subscriptionID, URL: target.url, Event: event, CreatedAt: now, NextAttemptAt: now, seq: d.seq}
+	d.pending[delivery.ID] = delivery
+	d.saveLocked()
+	d.mu.Unlock()
+	d.signal()
+}
+
+// flush waits until no delivery is due, those sent before it attempted.
+func (d *webhookDispatcher) flush() {
+	flushed := make(chan struct{})
+	d.mu.Lock()
+	d.flushes = append(d.flushes, flushed)
+	d.mu.Unlock()
+	d.signal()
+	select {
+	case <-flushed:
+	case <-d.done:
+	}
+}
+
+// close attempts the due deliveries, waiting at most until ctx is done, and stops.
+// Deliveries awaiting a retry are left in the state file, if there is one, and are
+// otherwise lost. Nothing may send to the dispatcher afterwards.
+func (d *webhookDispatcher) close(ctx context.Context) {
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+	d.signal()
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	if n := len(d.pending); n > 0 && d.path == "" {
+		log.Printf("%d webhook deliveries were still pending at shutdown and are lost", n)
+	}
+}
+
+// deadLetterCount returns the number of dead letters.
+func (d *webhookDispatcher) deadLetterCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.deadLetters)
+}
+
+// saveLocked writes the pending deliveries and the dead letters to the state file,
+// replacing it in one rename so a crash never leaves it half written. Failures are
+// logged; the state in memory still applies. It must be called with mu held.
+func (d *webhookDispatcher) saveLocked() {
+	if d.path == "" {
+		return
+	}
+	state := webhookState{Pending: make([]webhookDelivery, 0, len(d.pending)), DeadLetters: d.deadLetters}
+	for _, id := range sortedKeys(d.pending) {
+		state.Pending = append(state.Pending, *d.pending[id])
+	}
+	if state.DeadLetters == nil {
+		state.DeadLetters = []webhookDelivery{}
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(d.path), "."+filepath.Base(d.path)+".tmp")
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, d.path)
+		}
+	}
+	if err != nil {
+		log.Printf("saving the webhook deliveries failed: %v", err)
+	}
+}
+
+// deliver posts event to target once, signed in an X-Webhook-Signature header as
+// "sha256=<hex HMAC-SHA256 of the body>". X-Webhook-ID is the event's ID, the same for
+// every attempt, so receivers can ignore the events they already have.
+func (d *webhookDispatcher) deliver(target webhookTarget, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, target.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fetch-points/"+version)
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-ID", event.ID)
+	req.Header.Set("X-Webhook-Signature", signWebhook(target.secret, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", target.url, resp.Status)
+	}
+	return nil
+}
+
+// validateWebhookURL checks that rawURL is an absolute http or https URL.
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q is not an absolute http or https URL", rawURL)
+	}
+	return nil
+}
+
+// signWebhook returns the X-Webhook-Signature of body under secret, in the format of
+// the X-Signature of signed submissions.
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookTargets returns the receivers of events of type eventType: --webhook-url,
+// which takes every event, and the subscriptions to it.
+func webhookTargets(eventType string) []webhookTarget {
+	var targets []webhookTarget
+	if webhookURL != "" {
+		targets = append(targets, webhookTarget{url: webhookURL})
+	}
+	for _, sub := range webhookSubscriptions.matching(eventType) {
+		targets = append(targets, sub.target())
+	}
+	return targets
+}
+
+// sendWebhooks sends event to each of its receivers, if webhooks are on.
+func sendWebhooks(event Event) {
+	d := webhooks.Load()
+	if d == nil {
+		return
+	}
+	for _, target := range webhookTargets(event.Type) {
+		d.send(target, event)
+	}
+}
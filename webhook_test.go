@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useWebhooks delivers webhooks, of every event to url, signed with secret, if url is
+// given, until the test ends.
+func useWebhooks(t *testing.T, url, secret string) *webhookDispatcher {
+	t.Helper()
+	d := newWebhookDispatcher()
+	webhooks.Store(d)
+	webhookURL, webhookSecret = url, secret
+	t.Cleanup(func() {
+		webhooks.Store(nil)
+		webhookURL, webhookSecret = "", ""
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		d.close(ctx)
+		<-d.done
+	})
+	return d
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header, body}
+	}))
+	defer receiver.Close()
+	useWebhooks(t, receiver.URL, "hook-secret")
+	successes := webhookDeliveries.value("success")
+
+	rr := requestWithKey(newRouter(), http.MethodPost, "/receipts/process", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+
+	d := <-deliveries
+	if !validSignature(d.body, d.header.Get("X-Webhook-Signature"), [][]byte{[]byte("hook-secret")}) {
+		t.Errorf("expected a valid signature but got %q", d.header.Get("X-Webhook-Signature"))
+	}
+	if validSignature(d.body, d.header.Get("X-Webhook-Signature"), [][]byte{[]byte("other-secret")}) {
+		t.Error("expected the signature to be invalid under another secret")
+	}
+	if got := d.header.Get("X-Webhook-Event"); got != eventReceiptProcessed {
+		t.Errorf("expected the event type in X-Webhook-Event but got %q", got)
+	}
+	var event Event
+	if err := json.Unmarshal(d.body, &event); err != nil || event.ID == "" || d.header.Get("X-Webhook-ID") != event.ID {
+		t.Errorf("expected the event ID in the payload and X-Webhook-ID but got %q: %s", d.header.Get("X-Webhook-ID"), d.body)
+	}
+	expected := `{"id":"` + event.ID + `","version":1,"type":"receipt.processed","data":{"id":"` + response.ID + `","points":28,"retailer":"Target","purchaseDate":"2022-01-01","processedAt":"2025-01-30T12:00:00Z","rulesVersion":"` + currentEngine().hash + `"}}`
+	if string(d.body) != expected {
+		t.Errorf("expected the payload\n%s\nbut got\n%s", expected, d.body)
+	}
+	webhooks.Load().flush()
+	if got := webhookDeliveries.value("success"); got != successes+1 {
+		t.Errorf("expected one more successful delivery but got %v", got-successes)
+	}
+}
+
+func TestWebhookSlowReceiver(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+	defer close(release)
+	d := useWebhooks(t, receiver.URL, "hook-secret")
+	router := newRouter()
+	failures, dropped := webhookDeliveryAttempts.value("failure"), webhookEventsDropped.value()
+
+	// The receiver holds the first delivery, yet receipts are answered at once, and
+	// once the queue is full further events are dropped rather than waited on.
+	start := time.Now()
+	for i := 0; i < webhookQueueSize+5; i++ {
+		if rr := requestWithKey(router, http.MethodPost, "/receipts/process", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %v %s", rr.Code, rr.Body.String())
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the receiver not to slow down processing but it took %v", elapsed)
+	}
+	if got := webhookEventsDropped.value() - dropped; got < 4 || d.dropped.Load() < 4 {
+		t.Errorf("expected the events over the queue dropped but got %v", got)
+	}
+
+	// Answers other than 2xx are failed attempts.
+	release <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for webhookDeliveryAttempts.value("failure") == failures && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := webhookDeliveryAttempts.value("failure"); got != failures+1 {
+		t.Errorf("expected a failed attempt but got %v", got-failures)
+	}
+	if _, types := scrapeMetrics(t, router); types["webhook_events_dropped_total"] != "counter" || types["webhook_deliveries_total"] != "counter" {
+		t.Error("expected the webhook counters in the metrics")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditWebhooksRedriven is the action of a redrive of dead-lettered webhooks.
+const auditWebhooksRedriven = "webhook.redriven"
+
+// deadLetterList returns the dead letters, oldest first, and how many deliveries are
+// pending.
+func (d *webhookDispatcher) deadLetterList() ([]webhookDelivery, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]webhookDelivery{}, d.deadLetters...), len(d.pending)
+}
+
+// redrive moves the dead letters in ids, or all of them if ids is nil, back to the
+// pending deliveries with their attempts and age reset, returning how many it moved.
+func (d *webhookDispatcher) redrive(ids []string) int {
+	now := clock.Now()
+	d.mu.Lock()
+	kept := d.deadLetters[:0]
+	redriven := 0
+	for _, delivery := range d.deadLetters {
+		if ids != nil && !containsString(ids, delivery.ID) {
+			kept = append(kept, delivery)
+			continue
+		}
+		d.seq++
+		delivery.Attempts, delivery.CreatedAt, delivery.NextAttemptAt, delivery.seq = 0, now, now, d.seq
+		d.pending[delivery.ID] = &delivery
+		redriven++
+	}
+	d.deadLetters = kept
+	if redriven > 0 {
+		d.saveLocked()
+	}
+	d.mu.Unlock()
+	d.signal()
+	return redriven
+}
+
+// redriveRequest is the body of POST /admin/webhooks/deadletter. Without IDs every
+// dead letter is redriven.
+type redriveRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// deadLetterHandler lists the webhook deliveries given up on.
+func deadLetterHandler(c *gin.Context) {
+	d := webhooks.Load()
+	if d == nil {
+		abortWithProblem(c, http.StatusServiceUnavailable, "WEBHOOKS_UNAVAILABLE", "webhooks are not being delivered")
+		return
+	}
+	deadLetters, pending := d.deadLetterList()
+	c.JSON(http.StatusOK, gin.H{"deadLetters": deadLetters, "pending": pending})
+}
+
+// redriveHandler delivers the dead letters the body names, or all of them given no
+// body, again.
+func redriveHandler(c *gin.Context) {
+	d := webhooks.Load()
+	if d == nil {
+		abortWithProblem(c, http.StatusServiceUnavailable, "WEBHOOKS_UNAVAILABLE", "webhooks are not being delivered")
+		return
+	}
+	var request redriveRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		abortWithProblem(c, http.StatusBadRequest, "REDRIVE_INVALID", err.Error())
+		return
+	}
+
+	redriven := d.redrive(request.IDs)
+	c.Set("auditTarget", "redriven="+strconv.Itoa(redriven))
+	c.JSON(http.StatusOK, gin.H{"redriven": redriven})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useQuickRetries retries failed webhook deliveries within milliseconds, up to
+// maxAttempts times, until the test ends.
+func useQuickRetries(t *testing.T, maxAttempts int) {
+	t.Helper()
+	base, max, attempts := webhookRetryBase, webhookRetryMax, webhookMaxAttempts
+	webhookRetryBase, webhookRetryMax, webhookMaxAttempts = time.Millisecond, 5*time.Millisecond, maxAttempts
+	t.Cleanup(func() { webhookRetryBase, webhookRetryMax, webhookMaxAttempts = base, max, attempts })
+}
+
+// waitFor polls done for up to 5 seconds.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	useQuickRetries(t, 5)
+	var mu sync.Mutex
+	var ids []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, r.Header.Get("X-Webhook-ID"))
+		if len(ids) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+	d := useWebhooks(t, receiver.URL, "hook-secret")
+	attempts, successes := webhookDeliveryAttempts.value("failure"), webhookDeliveries.value("success")
+
+	// The receiver fails twice, then takes the same event.
+	notifyDeleted("r-1", "")
+	waitFor(t, "the delivery", func() bool { return webhookDeliveries.value("success") == successes+1 })
+	mu.Lock()
+	if len(ids) != 3 || ids[0] == "" || ids[1] != ids[0] || ids[2] != ids[0] {
+		t.Errorf("expected three attempts with the same X-Webhook-ID but got %q", ids)
+	}
+	mu.Unlock()
+	if got := webhookDeliveryAttempts.value("failure") - attempts; got != 2 {
+		t.Errorf("expected two failed attempts but got %v", got)
+	}
+	if deadLetters, pending := d.deadLetterList(); len(deadLetters) != 0 || pending != 0 {
+		t.Errorf("expected nothing left but got %d dead letters and %d pending", len(deadLetters), pending)
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useQuickRetries(t, 3)
+	useAPIKeys(t, []apiKey{{ID: "ops", Key: "k-ops", Scopes: []string{scopeAdmin}}})
+	var up atomic.Bool
+	var calls atomic.Int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	path := filepath.Join(t.TempDir(), "webhooks-state.json")
+	d, err := loadWebhookDispatcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.Store(d)
+	webhookURL, webhookSecret = receiver.URL, "hook-secret"
+	defer func() { webhookURL, webhookSecret = "", "" }()
+	router := newRouter()
+	failures := webhookDeliveries.value("failure")
+
+	// A receiver that always fails gets every attempt, then the delivery is
+	// dead-lettered.
+	notifyDeleted("r-1", "")
+	waitFor(t, "the dead letter", func() bool { return d.deadLetterCount() == 1 })
+	if calls.Load() != 3 || webhookDeliveries.value("failure") != failures+1 {
+		t.Errorf("expected 3 attempts and a failed delivery but got %d, %v", calls.Load(), webhookDeliveries.value("failure")-failures)
+	}
+	rr := adminJSON(router, http.MethodGet, "/admin/webhooks/deadletter", "")
+	var listed struct {
+		DeadLetters []webhookDelivery `json:"deadLetters"`
+		Pending     int               `json:"pending"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil || rr.Code != http.StatusOK || len(listed.DeadLetters) != 1 {
+		t.Fatalf("expected the dead letter but got %v %s", rr.Code, rr.Body.String())
+	}
+	dead := listed.DeadLetters[0]
+	if dead.Attempts != 3 || dead.URL != receiver.URL || !strings.Contains(dead.LastError, "503") || dead.Event.Type != eventReceiptDeleted || strings.Contains(rr.Body.String(), "hook-secret") {
+		t.Errorf("expected the failed delivery without its secret but got %s", rr.Body.String())
+	}
+	if _, types := scrapeMetrics(t, router); types["webhook_dead_letters"] != "gauge" || types["webhook_delivery_attempts_total"] != "counter" {
+		t.Error("expected the webhook metrics")
+	}
+
+	// The dead letter survives a restart.
+	d.close(context.Background())
+	if d, err = loadWebhookDispatcher(path); err != nil || d.deadLetterCount() != 1 {
+		t.Fatalf("expected the dead letter saved but got %v", err)
+	}
+	webhooks.Store(d)
+	defer func() {
+		webhooks.Store(nil)
+		d.close(context.Background())
+		<-d.done
+	}()
+
+	// Once the receiver is back, a redrive delivers it.
+	up.Store(true)
+	if rr := adminJSON(router, http.MethodPost, "/admin/webhooks/deadletter", `{"ids": ["unknown"]}`); rr.Body.String() != `{"redriven":0}` {
+		t.Errorf("expected an unknown dead letter left alone but got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = adminJSON(router, http.MethodPost, "/admin/webhooks/deadletter", `{"ids": ["`+dead.ID+`"]}`)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"redriven":1}` {
+		t.Errorf("expected one dead letter redriven but got %v %s", rr.Code, rr.Body.String())
+	}
+	d.flush()
+	if calls.Load() != 4 || d.deadLetterCount() != 0 {
+		t.Errorf("expected the dead letter delivered but got %d calls and %d dead letters", calls.Load(), d.deadLetterCount())
+	}
+	if state, err := loadWebhookState(path); err != nil || len(state.Pending) != 0 || len(state.DeadLetters) != 0 {
+		t.Errorf("expected nothing left in the state file but got %+v, %v", state, err)
+	}
+	if rr := adminJSON(router, http.MethodPost, "/admin/webhooks/deadletter", `{"id": 1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid body rejected but got %v", rr.Code)
+	}
+}
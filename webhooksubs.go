@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audited changes to the webhook subscriptions.
+const (
+	auditWebhookCreated = "webhook.created"
+	auditWebhookDeleted = "webhook.deleted"
+)
+
+// webhookSubscriptionsFile is the --webhook-subscriptions-file the subscriptions are
+// kept in, so they survive restarts. Without it they are kept in memory only.
+var webhookSubscriptionsFile string
+
+// allowInsecureWebhooks is --allow-insecure-webhooks, which lets subscriptions post to
+// plain http URLs, for receivers on a private network or in development.
+var allowInsecureWebhooks bool
+
+// webhookSubscriptions are the subscriptions made through /admin/webhooks.
+var webhookSubscriptions = newSubscriptionStore("")
+
+// webhookSubscription sends the events it names to its URL. The secret is never
+// returned once it is set.
+type webhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// subscriptionInfo is a subscription as the API reports it, without its secret.
+type subscriptionInfo struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s webhookSubscription) info() subscriptionInfo {
+	return subscriptionInfo{ID: s.ID, URL: s.URL, Events: s.Events, CreatedAt: s.CreatedAt}
+}
+
+func (s webhookSubscription) target() webhookTarget {
+	return webhookTarget{url: s.URL, secret: []byte(s.Secret), subscriptionID: s.ID}
+}
+
+// subscriptionRequest is the body of POST /admin/webhooks.
+type subscriptionRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// validate reports what is wrong with a subscription request, if anything.
+func (r subscriptionRequest) validate() error {
+	if r.URL == "" {
+		return errors.New("url is required")
+	}
+	if err := validateWebhookURL(r.URL); err != nil {
+		return err
+	}
+	if u, _ := url.Parse(r.URL); u.Scheme != "https" && !allowInsecureWebhooks {
+		return fmt.Errorf("webhook URL %q is not https, which --allow-insecure-webhooks allows", r.URL)
+	}
+	if r.Secret == "" {
+		return errors.New("secret is required")
+	}
+	if len(r.Events) == 0 {
+		return errors.New("events is required")
+	}
+	for _, event := range r.Events {
+		if !containsString(subscribableEvents, event) {
+			return fmt.Errorf("event %q is not one of %v", event, subscribableEvents)
+		}
+	}
+	return nil
+}
+
+// subscriptionStore holds the subscriptions by ID, saving them to path after every
+// change when path is set.
+type subscriptionStore struct {
+	path string
+
+	mu            sync.RWMutex
+	subscriptions map[string]webhookSubscription
+}
+
+func newSubscriptionStore(path string) *subscriptionStore {
+	return &subscriptionStore{path: path, subscriptions: make(map[string]webhookSubscription)}
+}
+
+// loadSubscriptionStore returns a store saving to path, with the subscriptions saved
+// there if it exists.
+func loadSubscriptionStore(path string) (*subscriptionStore, error) {
+	store := newSubscriptionStore(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []webhookSubscription
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, &configError{path: path, msg: err.Error()}
+	}
+	for _, sub := range subscriptions {
+		store.subscriptions[sub.ID] = sub
+	}
+	return store, nil
+}
+
+// create adds a subscription for request and returns it.
+func (s *subscriptionStore) create(request subscriptionRequest) webhookSubscription {
+	sub := webhookSubscription{ID: newID(idSubscription), URL: request.URL, Secret: request.Secret, Events: request.Events, CreatedAt: clock.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[sub.ID] = sub
+	s.saveLocked()
+	return sub
+}
+
+func (s *subscriptionStore) get(id string) (webhookSubscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subscriptions[id]
+	return sub, ok
+}
+
+// delete removes the subscription id, reporting whether there was one.
+func (s *subscriptionStore) delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscriptions[id]; !ok {
+		return false
+	}
+	delete(s.subscriptions, id)
+	s.saveLocked()
+	return true
+}
+
+// list returns the subscriptions, oldest first.
+func (s *subscriptionStore) list() []webhookSubscription {
+	s.mu.RLock()
+	subscriptions := make([]webhookSubscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	s.mu.RUnlock()
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if !subscriptions[i].CreatedAt.Equal(subscriptions[j].CreatedAt) {
+			return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+		}
+		return subscriptions[i].ID < subscriptions[j].ID
+	})
+	return subscriptions
+}
+
+// matching returns the subscriptions to events of type eventType.
+func (s *subscriptionStore) matching(eventType string) []webhookSubscription {
+	var matching []webhookSubscription
+	for _, sub := range s.list() {
+		if containsString(sub.Events, eventType) {
+			matching = append(matching, sub)
+		}
+	}
+	return matching
+}
+
+// saveLocked writes the subscriptions to the file, replacing it in one rename so a
+// crash never leaves it half written. Failures are logged; the subscriptions in memory
+// still apply. It must be called with mu held.
+func (s *subscriptionStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	subscriptions := make([]webhookSubscription, 0, len(s.subscriptions))
+	for _, id := range sortedKeys(s.subscriptions) {
+		subscriptions = append(subscriptions, s.subscriptions[id])
+	}
+	data, err := json.Marshal(subscriptions)
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		log.Printf("saving the webhook subscriptions failed: %v", err)
+	}
+}
+
+// createSubscription subscribes the URL of the request body to the events it names.
+func createSubscription(c *gin.Context) {
+	var request subscriptionRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithBodyTooLarge(c, maxBytesErr.Limit)
+		return
+	}
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "WEBHOOK_INVALID", err.Error())
+		return
+	}
+
+	sub := webhookSubscriptions.create(request)
+	c.Set("auditTarget", sub.ID)
+	c.JSON(http.StatusCreated, sub.info())
+}
+
+func listSubscriptions(c *gin.Context) {
+	subscriptions := webhookSubscriptions.list()
+	infos := make([]subscriptionInfo, len(subscriptions))
+	for i, sub := range subscriptions {
+		infos[i] = sub.info()
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": infos})
+}
+
+// lookupSubscription returns the subscription named in the path, or responds 404.
+func lookupSubscription(c *gin.Context) (webhookSubscription, bool) {
+	sub, ok := webhookSubscriptions.get(c.Param("webhook_id"))
+	if !ok {
+		abortWithProblem(c, http.StatusNotFound, "WEBHOOK_NOT_FOUND", "no webhook subscription "+c.Param("webhook_id"))
+	}
+	return sub, ok
+}
+
+func getSubscription(c *gin.Context) {
+	if sub, ok := lookupSubscription(c); ok {
+		c.JSON(http.StatusOK, sub.info())
+	}
+}
+
+func deleteSubscription(c *gin.Context) {
+	c.Set("auditTarget", c.Param("webhook_id"))
+	if !webhookSubscriptions.delete(c.Param("webhook_id")) {
+		abortWithProblem(c, http.StatusNotFound, "WEBHOOK_NOT_FOUND", "no webhook subscription "+c.Param("webhook_id"))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// testSubscription delivers a webhook.test event to the subscription at once, rather
+// than from the queue, and reports whether the receiver accepted it.
+func testSubscription(c *gin.Context) {
+	sub, ok := lookupSubscription(c)
+	if !ok {
+		return
+	}
+	d := webhooks.Load()
+	if d == nil {
+		abortWithProblem(c, http.StatusServiceUnavailable, "WEBHOOKS_UNAVAILABLE", "webhooks are not being delivered")
+		return
+	}
+	event := newEvent(eventWebhookTest, eventSubject{ID: sub.ID})
+	if err := d.deliver(sub.target(), event); err != nil {
+		abortWithProblem(c, http.StatusBadGateway, "WEBHOOK_TEST_FAILED", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"delivered": true})
+}
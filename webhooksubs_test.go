@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminJSON sends body, if any, to an /admin path as the "ops" key.
+func adminJSON(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-API-Key", "k-ops")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// eventReceiver records the types of the events posted to it that are signed with
+// secret.
+type eventReceiver struct {
+	*httptest.Server
+	events chan string
+}
+
+func newEventReceiver(t *testing.T, secret string) *eventReceiver {
+	t.Helper()
+	r := &eventReceiver{events: make(chan string, 16)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if !validSignature(body, req.Header.Get("X-Webhook-Signature"), [][]byte{[]byte(secret)}) {
+			t.Errorf("expected deliveries signed with %q but got %q", secret, req.Header.Get("X-Webhook-Signature"))
+		}
+		var event Event
+		json.Unmarshal(body, &event)
+		r.events <- event.Type
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	useFakeClock(t, time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC))
+	useAPIKeys(t, []apiKey{{ID: "ops", Key: "k-ops", Scopes: []string{scopeAdmin, scopeWrite}}})
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	defer func(previous *subscriptionStore) { webhookSubscriptions = previous }(webhookSubscriptions)
+	webhookSubscriptions = newSubscriptionStore(path)
+	defer func(previous bool) { allowInsecureWebhooks = previous }(allowInsecureWebhooks)
+	d := useWebhooks(t, "", "")
+	router := newRouter()
+
+	// httptest receivers are plain http.
+	body := `{"url": "http://hooks.example.com", "secret": "s", "events": ["receipt.processed"]}`
+	if rr := adminJSON(router, http.MethodPost, "/admin/webhooks", body); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "--allow-insecure-webhooks") {
+		t.Errorf("expected a plain http URL rejected but got %v %s", rr.Code, rr.Body.String())
+	}
+	allowInsecureWebhooks = true
+	for _, invalid := range []string{
+		`{"url": "http://hooks.example.com", "events": ["receipt.processed"]}`,
+		`{"url": "http://hooks.example.com", "secret": "s", "events": ["receipt.lost"]}`,
+		`{"url": "hooks.example.com", "secret": "s", "events": ["receipt.processed"]}`,
+	} {
+		if rr := adminJSON(router, http.MethodPost, "/admin/webhooks", invalid); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "WEBHOOK_INVALID") {
+			t.Errorf("expected %s rejected but got %v %s", invalid, rr.Code, rr.Body.String())
+		}
+	}
+
+	processed, deleted := newEventReceiver(t, "secret-a"), newEventReceiver(t, "secret-b")
+	var created []subscriptionInfo
+	for _, body := range []string{
+		`{"url": "` + processed.URL + `", "secret": "secret-a", "events": ["receipt.processed", "receipt.deleted"]}`,
+		`{"url": "` + deleted.URL + `", "secret": "secret-b", "events": ["receipt.deleted"]}`,
+	} {
+		rr := adminJSON(router, http.MethodPost, "/admin/webhooks", body)
+		var sub subscriptionInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &sub); err != nil || rr.Code != http.StatusCreated || strings.Contains(rr.Body.String(), "secret") {
+			t.Fatalf("expected the subscription without its secret but got %v %s", rr.Code, rr.Body.String())
+		}
+		created = append(created, sub)
+	}
+
+	// Secrets are never returned, and the subscriptions survive a restart.
+	rr := adminJSON(router, http.MethodGet, "/admin/webhooks", "")
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "secret") || !strings.Contains(rr.Body.String(), created[1].ID) {
+		t.Errorf("expected both subscriptions without secrets but got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = adminJSON(router, http.MethodGet, "/admin/webhooks/"+created[0].ID, "")
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "secret") || !strings.Contains(rr.Body.String(), processed.URL) {
+		t.Errorf("expected the first subscription but got %v %s", rr.Code, rr.Body.String())
+	}
+	if reloaded, err := loadSubscriptionStore(path); err != nil || len(reloaded.matching(eventReceiptDeleted)) != 2 {
+		t.Errorf("expected the subscriptions saved but got %v", err)
+	}
+
+	// Each event goes to the subscriptions to it.
+	if rr := requestWithKey(router, http.MethodPost, "/receipts/process", "k-ops"); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v %s", rr.Code, rr.Body.String())
+	}
+	receiptsMu.Lock()
+	receipts["r-alice"] = StoredReceipt{Owner: "alice"}
+	receiptsMu.Unlock()
+	if _, err := eraseUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	d.flush()
+	if got := drain(processed.events); strings.Join(got, ",") != "receipt.processed,receipt.deleted" {
+		t.Errorf("expected the first subscriber to get both events but got %v", got)
+	}
+	if got := drain(deleted.events); strings.Join(got, ",") != "receipt.deleted" {
+		t.Errorf("expected the second subscriber to get the deletion only but got %v", got)
+	}
+
+	// A test event is delivered at once.
+	rr = adminJSON(router, http.MethodPost, "/admin/webhooks/"+created[1].ID+"/test", "")
+	if rr.Code != http.StatusOK || strings.Join(drain(deleted.events), ",") != eventWebhookTest {
+		t.Errorf("expected the test event delivered but got %v %s", rr.Code, rr.Body.String())
+	}
+	deleted.Close()
+	if rr := adminJSON(router, http.MethodPost, "/admin/webhooks/"+created[1].ID+"/test", ""); rr.Code != http.StatusBadGateway {
+		t.Errorf("expected a 502 for a receiver that is down but got %v %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := adminJSON(router, http.MethodDelete, "/admin/webhooks/"+created[1].ID, ""); rr.Code != http.StatusNoContent {
+		t.Errorf("expected status 204 but got %v %s", rr.Code, rr.Body.String())
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if rr := adminJSON(router, method, "/admin/webhooks/"+created[1].ID, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected %s of a deleted subscription to be 404 but got %v", method, rr.Code)
+		}
+	}
+	if len(webhookSubscriptions.matching(eventReceiptDeleted)) != 1 {
+		t.Error("expected one subscription left")
+	}
+}
+
+// drain returns what is in events.
+func drain(events chan string) []string {
+	var got []string
+	for {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		default:
+			return got
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsMaxMessageBytes bounds the messages a client may send; the connection is closed
+// with 1009 Message Too Big over it.
+const wsMaxMessageBytes = 64 << 10
+
+// acceptWebSocket completes the handshake of a request to upgrade to a WebSocket with
+// gorilla/websocket and takes over its connection. It answers requests that aren't a
+// valid upgrade, or come from a page of an origin --cors-allowed-origins doesn't
+// allow, with a problem and returns false.
+func acceptWebSocket(c *gin.Context) (*websocket.Conn, bool) {
+	switch {
+	case !websocket.IsWebSocketUpgrade(c.Request):
+		c.Header("Upgrade", "websocket")
+		abortWithProblem(c, http.StatusUpgradeRequired, "WEBSOCKET_REQUIRED", "the request is not a WebSocket upgrade")
+		return nil, false
+	case c.GetHeader("Sec-WebSocket-Version") != "13":
+		c.Header("Sec-WebSocket-Version", "13")
+		abortWithProblem(c, http.StatusUpgradeRequired, "WEBSOCKET_REQUIRED", "only WebSocket version 13 is supported")
+		return nil, false
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: sameOriginOrAllowed,
+		Error: func(_ http.ResponseWriter, r *http.Request, status int, reason error) {
+			switch status {
+			case http.StatusForbidden:
+				abortWithProblem(c, status, "ORIGIN_NOT_ALLOWED", fmt.Sprintf("pages of %s may not open a WebSocket", r.Header.Get("Origin")))
+			case http.StatusInternalServerError:
+				abortWithProblem(c, status, "WEBSOCKET_UNAVAILABLE", reason.Error())
+			default:
+				abortWithProblem(c, status, "WEBSOCKET_INVALID", reason.Error())
+			}
+		},
+	}
+	// Recorded for the request log; the response itself is written to the connection.
+	c.Writer.WriteHeader(http.StatusSwitchingProtocols)
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, false
+	}
+	ws.SetReadLimit(wsMaxMessageBytes)
+	return ws, true
+}
+
+// sameOriginOrAllowed reports whether a WebSocket may be opened by the page the
+// request came from, if any: one of the server's own host, or of an origin
+// --cors-allowed-origins allows. Browsers send cookies and client certificates with
+// the handshake whatever the origin, so other sites' pages are refused.
+func sameOriginOrAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return cors.allows(origin)
+}
+
+// closeWebSocket sends a close message with code and reason, unless one was already
+// sent or it can't be within wsWriteTimeout, and closes the connection.
+func closeWebSocket(ws *websocket.Conn, code int, reason string) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadlineClock.Now().Add(wsWriteTimeout))
+	ws.Close()
+}
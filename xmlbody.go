@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// xmlReceipt is the XML form of a Receipt:
+//
+//	<receipt>
+//	  <retailer>Target</retailer>
+//	  <total>35.35</total>
+//	  <items>
+//	    <item><shortDescription>Mountain Dew 12PK</shortDescription><price>6.49</price></item>
+//	  </items>
+//	  <purchaseDate>2022-01-01</purchaseDate>
+//	  <purchaseTime>13:01</purchaseTime>
+//	</receipt>
+//
+// with an optional <timezone>, and an optional <upc> in each item.
+type xmlReceipt struct {
+	XMLName      xml.Name  `xml:"receipt"`
+	Retailer     string    `xml:"retailer"`
+	Total        string    `xml:"total"`
+	Items        []xmlItem `xml:"items>item"`
+	PurchaseDate string    `xml:"purchaseDate"`
+	PurchaseTime string    `xml:"purchaseTime"`
+	Timezone     string    `xml:"timezone"`
+}
+
+type xmlItem struct {
+	ShortDescription string `xml:"shortDescription"`
+	Price            string `xml:"price"`
+	UPC              string `xml:"upc"`
+}
+
+func (r xmlReceipt) receipt() Receipt {
+	receipt := Receipt{
+		Retailer:     r.Retailer,
+		Total:        r.Total,
+		PurchaseDate: r.PurchaseDate,
+		PurchaseTime: r.PurchaseTime,
+		Timezone:     r.Timezone,
+	}
+	for _, item := range r.Items {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: item.ShortDescription, Price: item.Price, UPC: item.UPC})
+	}
+	return receipt
+}
+
+// xmlReceiptSchema gives the elements each element of an XML receipt may contain, and
+// whether they may repeat. The document may contain one <receipt>. Elements not in it
+// hold text only.
+var xmlReceiptSchema = map[string]map[string]bool{
+	"":        {"receipt": false},
+	"receipt": {"retailer": false, "total": false, "items": false, "purchaseDate": false, "purchaseTime": false, "timezone": false},
+	"items":   {"item": true},
+	"item":    {"shortDescription": false, "price": false, "upc": false},
+}
+
+// xmlElement is an element checkXMLReceipt is inside of.
+type xmlElement struct {
+	name string
+	path string
+	seen map[string]int
+}
+
+// decodeXMLReceipt decodes an XML receipt, rejecting documents that don't follow
+// xmlReceiptSchema with the path of the offending element, since encoding/xml would
+// otherwise skip elements it doesn't know. Errors reading r are returned as they are.
+func decodeXMLReceipt(r io.Reader) (Receipt, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if err := checkXMLReceipt(data); err != nil {
+		return Receipt{}, err
+	}
+	var decoded xmlReceipt
+	if err := xml.Unmarshal(data, &decoded); err != nil {
+		return Receipt{}, xmlDecodeError("%s", strings.TrimPrefix(err.Error(), "xml: "))
+	}
+	return decoded.receipt(), nil
+}
+
+func xmlDecodeError(format string, args ...any) error {
+	return &receiptDecodeError{reason: reasonBodyInvalid, message: "Failed to parse the request body: " + fmt.Sprintf(format, args...)}
+}
+
+// checkXMLReceipt checks data is well formed and follows xmlReceiptSchema: no unknown,
+// repeated or misplaced elements, no attributes, and no text outside the leaves.
+func checkXMLReceipt(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	document := &xmlElement{seen: make(map[string]int)}
+	stack := []*xmlElement{document}
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var syntaxErr *xml.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return xmlDecodeError("malformed XML on line %d: %s", syntaxErr.Line, syntaxErr.Msg)
+		}
+		if err != nil {
+			return xmlDecodeError("%s", strings.TrimPrefix(err.Error(), "xml: "))
+		}
+		line, _ := decoder.InputPos()
+		parent := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			path := parent.path + "/" + name
+			repeats, allowed := xmlReceiptSchema[parent.name][name]
+			if !allowed || t.Name.Space != "" {
+				return xmlDecodeError("unexpected element %s on line %d", path, line)
+			}
+			parent.seen[name]++
+			if repeats {
+				path = fmt.Sprintf("%s[%d]", path, parent.seen[name]-1)
+			} else if parent.seen[name] > 1 {
+				return xmlDecodeError("repeated element %s on line %d", path, line)
+			}
+			if len(t.Attr) > 0 {
+				return xmlDecodeError("unexpected attribute %s of %s on line %d", t.Attr[0].Name.Local, path, line)
+			}
+			stack = append(stack, &xmlElement{name: name, path: path, seen: make(map[string]int)})
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if _, container := xmlReceiptSchema[parent.name]; container && len(bytes.TrimSpace(t)) > 0 {
+				where := parent.path
+				if where == "" {
+					where = "the document"
+				}
+				return xmlDecodeError("unexpected text in %s on line %d", where, line)
+			}
+		case xml.Directive:
+			return xmlDecodeError("unexpected directive on line %d, such as a DOCTYPE", line)
+		}
+	}
+	if document.seen["receipt"] == 0 {
+		return xmlDecodeError("it has no <receipt> element")
+	}
+	return nil
+}
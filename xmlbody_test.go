@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const validReceiptXML = `<?xml version="1.0" encoding="UTF-8"?>
+<receipt>
+  <retailer>Target</retailer>
+  <total>35.35</total>
+  <items>
+    <item><shortDescription>Mountain Dew 12PK</shortDescription><price>6.49</price></item>
+    <item><shortDescription>Emils Cheese Pizza</shortDescription><price>12.25</price></item>
+    <item><shortDescription>Knorr Creamy Chicken</shortDescription><price>1.26</price></item>
+    <item><shortDescription>Doritos Nacho Cheese</shortDescription><price>3.35</price></item>
+    <item><shortDescription>   Klarbrunn 12-PK 12 FL OZ  </shortDescription><price>12.00</price></item>
+  </items>
+  <purchaseDate>2022-01-01</purchaseDate>
+  <purchaseTime>13:01</purchaseTime>
+</receipt>
+`
+
+func TestProcessXMLReceipts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+	serve := func(method, path, contentType, accept, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The canonical receipt in XML is stored and scored as it is in JSON.
+	rr := serve(http.MethodPost, "/receipts/process", "application/xml", "", validReceiptXML)
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected a JSON 200 but got %v: %s", rr.Code, rr.Body.String())
+	}
+	jsonID, want := processAndScore(t, router, validReceiptPayload)
+	receiptsMu.RLock()
+	got := receipts[response.ID].Points
+	receiptsMu.RUnlock()
+	if got != want {
+		t.Errorf("expected the XML receipt to score %d like the JSON one but got %d", want, got)
+	}
+	fromXML := serve(http.MethodGet, "/receipts/"+response.ID, "", "", "").Body.String()
+	fromJSON := serve(http.MethodGet, "/receipts/"+jsonID, "", "", "").Body.String()
+	if strings.ReplaceAll(fromXML, response.ID, jsonID) != fromJSON {
+		t.Errorf("expected the XML receipt to read back as the JSON one\n%s\nbut got\n%s", fromJSON, fromXML)
+	}
+
+	for _, accept := range []string{"application/xml", "text/xml"} {
+		rr := serve(http.MethodPost, "/receipts/process", "text/xml; charset=utf-8", accept, validReceiptXML)
+		var body struct {
+			XMLName xml.Name `xml:"response"`
+			ID      string   `xml:"id"`
+		}
+		if err := xml.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK || body.ID == "" {
+			t.Errorf("%s: expected an XML 200 but got %v: %s", accept, rr.Code, rr.Body.String())
+		}
+		receiptURL := "http://example.com/receipts/" + body.ID
+		links := `<_links><self href="` + receiptURL + `"></self><points href="` + receiptURL + `/points"></points><breakdown href="` + receiptURL + `/breakdown"></breakdown></_links>`
+		if body.ID != "" && rr.Body.String() != "<response>"+links+"<id>"+body.ID+"</id></response>" {
+			t.Errorf("%s: expected a <response> holding the ID but got %s", accept, rr.Body.String())
+		}
+		if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, accept) {
+			t.Errorf("%s: expected the XML content type but got %q", accept, contentType)
+		}
+	}
+}
+
+func TestXMLReceiptErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	item := "<items><item><shortDescription>Gatorade</shortDescription><price>2.25</price></item></items>"
+	dated := "<purchaseDate>2022-03-20</purchaseDate><purchaseTime>14:33</purchaseTime>"
+	receipt := func(inner string) string { return "<receipt>" + inner + "</receipt>" }
+	testCases := []struct {
+		name     string
+		payload  string
+		contains string
+	}{
+		{"TotalMissing", receipt("<retailer>M&amp;M</retailer>" + item + dated), "Total amount is required"},
+		{"ItemsMissing", receipt("<retailer>M&amp;M</retailer><total>2.25</total><items></items>" + dated), "Receipt should have at least one item"},
+		{"ItemPriceInvalid", receipt("<retailer>M&amp;M</retailer><total>2.25</total><items><item><shortDescription>Gatorade</shortDescription><price>2,25</price></item></items>" + dated), "Invalid item price"},
+		{"Malformed", "<receipt>\n<retailer>M&amp;M</total>", "malformed XML on line 2"},
+		{"Unclosed", receipt("<retailer>M&amp;M</retailer>")[:30], "malformed XML"},
+		{"UnknownElement", receipt("<retailer>M&amp;M</retailer><total>2.25</total><cashier>Sam</cashier>" + item + dated), "unexpected element /receipt/cashier on line 1"},
+		{"UnknownItemElement", receipt("<retailer>M&amp;M</retailer><total>4.50</total><items><item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>\n<item><price>2.25</price><qty>1</qty></item></items>" + dated), "unexpected element /receipt/items/item[1]/qty on line 2"},
+		{"RepeatedElement", receipt("<retailer>M&amp;M</retailer><retailer>Target</retailer><total>2.25</total>" + item + dated), "repeated element /receipt/retailer"},
+		{"NestedInLeaf", receipt("<retailer><b>M&amp;M</b></retailer><total>2.25</total>" + item + dated), "unexpected element /receipt/retailer/b"},
+		{"Attribute", `<receipt currency="USD"><retailer>M&amp;M</retailer></receipt>`, "unexpected attribute currency of /receipt"},
+		{"TextInContainer", receipt("<retailer>M&amp;M</retailer><total>2.25</total><items>Gatorade</items>" + dated), "unexpected text in /receipt/items"},
+		{"WrongRoot", "<order><retailer>M&amp;M</retailer></order>", "unexpected element /order"},
+		{"TwoReceipts", receipt("<retailer>M&amp;M</retailer>") + receipt("<retailer>Target</retailer>"), "repeated element /receipt"},
+		{"Namespaced", `<r:receipt xmlns:r="urn:pos"><r:retailer>M&amp;M</r:retailer></r:receipt>`, "unexpected element /receipt"},
+		{"Doctype", `<!DOCTYPE receipt [<!ENTITY x "M&amp;M">]>` + receipt("<retailer>&x;</retailer>"), "unexpected directive on line 1"},
+		{"Empty", "", "it has no <receipt> element"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(tc.payload))
+			req.Header.Set("Content-Type", "application/xml")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400 but got %v: %s", rr.Code, rr.Body.String())
+			}
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(body.Error, tc.contains) {
+				t.Errorf("expected an error containing %q but got %q", tc.contains, body.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeYAMLReceipt decodes a YAML receipt strictly: one document, no fields a
+// Receipt doesn't have, no repeated keys, and amounts given as strings. YAML would
+// otherwise read an unquoted price such as 6.50 as a number, and hand it on as "6.5".
+// Errors reading r are returned as they are.
+func decodeYAMLReceipt(r io.Reader) (Receipt, error) {
+	var receipt Receipt
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return receipt, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return receipt, yamlParseError(err)
+	}
+	if len(root.Content) == 0 {
+		return receipt, &receiptDecodeError{reason: reasonBodyInvalid, message: "Failed to parse the request body: it is empty"}
+	}
+	if err := checkYAMLAmounts(root.Content[0]); err != nil {
+		return receipt, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&receipt); err != nil {
+		return receipt, yamlParseError(err)
+	}
+	if err := decoder.Decode(new(yaml.Node)); !errors.Is(err, io.EOF) {
+		return receipt, &receiptDecodeError{reason: reasonBodyInvalid, message: "Failed to parse the request body: it holds more than one YAML document"}
+	}
+	return receipt, nil
+}
+
+// yamlParseError describes a YAML decoding error on one line, by line and field.
+func yamlParseError(err error) error {
+	message := strings.TrimPrefix(err.Error(), "yaml: ")
+	message = strings.TrimPrefix(message, "unmarshal errors:\n")
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return &receiptDecodeError{reason: reasonBodyInvalid, message: "Failed to parse the request body: " + strings.Join(lines, "; ")}
+}
+
+// checkYAMLAmounts rejects a total or item price given as a YAML number rather than a
+// string.
+func checkYAMLAmounts(receipt *yaml.Node) error {
+	if receipt.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(receipt.Content); i += 2 {
+		key, value := receipt.Content[i], receipt.Content[i+1]
+		switch key.Value {
+		case "total":
+			if isYAMLNumber(value) {
+				return &receiptDecodeError{reason: reasonTotalInvalidFormat,
+					message: fmt.Sprintf(`total must be a quoted string, such as "35.35", not a YAML number (line %d)`, value.Line)}
+			}
+		case "items":
+			if value.Kind != yaml.SequenceNode {
+				continue
+			}
+			for index, item := range value.Content {
+				if item.Kind != yaml.MappingNode {
+					continue
+				}
+				for j := 0; j+1 < len(item.Content); j += 2 {
+					if item.Content[j].Value == "price" && isYAMLNumber(item.Content[j+1]) {
+						return &receiptDecodeError{reason: reasonItemPriceInvalid,
+							message: fmt.Sprintf(`items[%d].price must be a quoted string, such as "6.49", not a YAML number (line %d)`, index, item.Content[j+1].Line)}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isYAMLNumber(node *yaml.Node) bool {
+	if node.Kind != yaml.ScalarNode {
+		return false
+	}
+	switch node.ShortTag() {
+	case "!!int", "!!float":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const validReceiptYAML = `
+retailer: Target
+total: "35.35"
+items:
+  - shortDescription: Mountain Dew 12PK
+    price: "6.49"
+  - shortDescription: Emils Cheese Pizza
+    price: "12.25"
+  - shortDescription: Knorr Creamy Chicken
+    price: "1.26"
+  - shortDescription: Doritos Nacho Cheese
+    price: "3.35"
+  - shortDescription: "   Klarbrunn 12-PK 12 FL OZ  "
+    price: "12.00"
+purchaseDate: 2022-01-01
+purchaseTime: "13:01"
+`
+
+func postYAML(router http.Handler, contentType, accept, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestProcessYAMLReceipts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	// The YAML receipt scores as its JSON twin does, and is answered in JSON.
+	rr := postYAML(router, "application/yaml", "", validReceiptYAML)
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected a JSON 200 but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := uuid.Parse(response.ID); err != nil {
+		t.Errorf("expected a UUID receipt ID but got %q", response.ID)
+	}
+	_, want := processAndScore(t, router, validReceiptPayload)
+	receiptsMu.RLock()
+	got := receipts[response.ID].Points
+	receiptsMu.RUnlock()
+	if got != want {
+		t.Errorf("expected the YAML receipt to score %d like the JSON one but got %d", want, got)
+	}
+
+	for _, accept := range []string{"application/yaml", "text/yaml", "application/yaml, application/json;q=0.5"} {
+		rr := postYAML(router, "text/yaml; charset=utf-8", accept, validReceiptYAML)
+		var body map[string]any
+		if err := yaml.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK || body["id"] == nil {
+			t.Errorf("%s: expected a YAML 200 but got %v: %s", accept, rr.Code, rr.Body.String())
+		}
+		if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, strings.Split(accept, ",")[0]) {
+			t.Errorf("%s: expected the YAML content type but got %q", accept, contentType)
+		}
+	}
+	if rr := postYAML(router, "application/yaml", "application/json", validReceiptYAML); !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("expected a JSON response when asked for but got %q", rr.Header().Get("Content-Type"))
+	}
+	if rr := postYAML(router, "application/x-yaml", "", validReceiptYAML); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected other YAML media types to be rejected but got %v", rr.Code)
+	}
+}
+
+// TestYAMLReceiptValidation mirrors the JSON validation in YAML form.
+func TestYAMLReceiptValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receipts = make(ReceiptsMap)
+	router := newRouter()
+
+	items := "items:\n  - {shortDescription: Gatorade, price: \"2.25\"}\n"
+	dated := "purchaseDate: 2022-03-20\npurchaseTime: \"14:33\"\n"
+	testCases := []struct {
+		name     string
+		payload  string
+		reason   validationReason
+		contains string
+	}{
+		{"InvalidInput", "retailer: Target\ntotal: \"\"\nitems: []\npurchaseDate: \"\"\npurchaseTime: \"13:01\"\n", reasonTotalMissing, "Total amount is required"},
+		{"RetailerMissing", "total: \"2.25\"\n" + items + dated, reasonRetailerMissing, "Retailer name is required"},
+		{"TotalInvalid", "retailer: M&M\ntotal: \"$2.25\"\n" + items + dated, reasonTotalInvalidFormat, "Invalid total amount"},
+		{"PurchaseDateMissing", "retailer: M&M\ntotal: \"2.25\"\n" + items + "purchaseTime: \"14:33\"\n", reasonPurchaseDateMissing, "Purchase date is required"},
+		{"PurchaseTimeMissing", "retailer: M&M\ntotal: \"2.25\"\n" + items + "purchaseDate: 2022-03-20\n", reasonPurchaseTimeMissing, "Purchase time is required"},
+		{"TimezoneInvalid", "retailer: M&M\ntotal: \"2.25\"\ntimezone: Mars/Olympus\n" + items + dated, reasonTimezoneInvalid, "Invalid timezone"},
+		{"ItemsMissing", "retailer: M&M\ntotal: \"2.25\"\nitems: []\n" + dated, reasonItemsMissing, "Receipt should have at least one item"},
+		{"ItemDescriptionMissing", "retailer: M&M\ntotal: \"2.25\"\nitems:\n  - price: \"2.25\"\n" + dated, reasonItemDescriptionMissing, "Item short description is required"},
+		{"ItemPriceInvalid", "retailer: M&M\ntotal: \"2.25\"\nitems:\n  - {shortDescription: Gatorade, price: \"2,25\"}\n" + dated, reasonItemPriceInvalid, "Invalid item price"},
+
+		// YAML's own mistakes.
+		{"NumericTotal", "retailer: M&M\ntotal: 2.25\n" + items + dated, reasonTotalInvalidFormat, `total must be a quoted string, such as "35.35", not a YAML number (line 2)`},
+		{"IntegerTotal", "retailer: M&M\ntotal: 2\n" + items + dated, reasonTotalInvalidFormat, "total must be a quoted string"},
+		{"NumericPrice", "retailer: M&M\ntotal: \"4.50\"\nitems:\n  - {shortDescription: Gatorade, price: \"2.25\"}\n  - {shortDescription: Gatorade, price: 2.25}\n" + dated, reasonItemPriceInvalid, `items[1].price must be a quoted string, such as "6.49", not a YAML number (line 5)`},
+		{"UnknownField", "retailer: M&M\ntotal: \"2.25\"\ncashier: Sam\n" + items + dated, reasonBodyInvalid, "line 3: field cashier not found"},
+		{"DuplicateKey", "retailer: M&M\nretailer: Target\ntotal: \"2.25\"\n" + items + dated, reasonBodyInvalid, `mapping key "retailer" already defined`},
+		{"WrongType", "retailer: [M, M]\ntotal: \"2.25\"\n" + items + dated, reasonBodyInvalid, "cannot unmarshal !!seq into string"},
+		{"Malformed", "retailer: M&M\n  total: \"2.25\n", reasonBodyInvalid, "Failed to parse the request body"},
+		{"Empty", "", reasonBodyInvalid, "it is empty"},
+		{"TwoDocuments", strings.TrimPrefix(validReceiptYAML, "\n") + "---\n" + strings.TrimPrefix(validReceiptYAML, "\n"), reasonBodyInvalid, "more than one YAML document"},
+		{"NotAMapping", "- retailer: M&M\n", reasonBodyInvalid, "cannot unmarshal !!seq into main.Receipt"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			failures := `receipt_validation_failures_total{reason="` + string(tc.reason) + `"}`
+			before, _ := scrapeMetrics(t, router)
+			rr := postYAML(router, "application/yaml", "", tc.payload)
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400 but got %v: %s", rr.Code, rr.Body.String())
+			}
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(body.Error, tc.contains) {
+				t.Errorf("expected an error containing %q but got %q", tc.contains, body.Error)
+			}
+			if after, _ := scrapeMetrics(t, router); after[failures] != before[failures]+1 {
+				t.Errorf("expected the receipt rejected for %s but got %v", tc.reason, after[failures]-before[failures])
+			}
+		})
+	}
+}